@@ -0,0 +1,341 @@
+/*
+Command dbfsck salvages the rows of a damaged db file into a new file.
+
+	dbfsck <damaged.db> <repaired.db>
+
+Every leaf page is scanned directly, without trusting the tree above it.
+Cells of pages with a valid checksum are kept as they are. Pages that fail
+the checksum are still scanned, but only cells whose key matches the id
+stored in the row are kept. The salvaged rows are then written into a fresh
+B-tree in the new file, and everything that was dropped is reported.
+
+Frames still in the WAL are not applied, open the database once to
+checkpoint them before running the repair if the engine still can.
+
+The leaves of every partition of a partitioned table are salvaged alike, but
+into a single tree, so the repaired file is no longer partitioned. The pages
+of the spatial index are dropped, the boxes of the rows are lost. So are the
+trees of materialized views and of the stored generated columns, found from
+the roots the file header lists if it is intact; create the views and add the
+columns again once the rows are salvaged.
+*/
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"sort"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+type cell struct {
+	key   uint32
+	value []byte
+}
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintf(os.Stderr, "usage: %s <damaged.db> <repaired.db>\n", os.Args[0])
+		os.Exit(2)
+	}
+	src, dst := os.Args[1], os.Args[2]
+
+	data, err := os.ReadFile(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(data) >= int(constants.FileHeaderSize) && string(data[:constants.MagicSize]) == constants.FileMagic &&
+		[constants.KeySaltSize]byte(data[constants.KeySaltOffset:]) != [constants.KeySaltSize]byte{} {
+		fmt.Fprintf(os.Stderr, "Error: %s is encrypted, decrypt it with .rekey --none before salvaging it\n", src)
+		os.Exit(1)
+	}
+	if stat, err := os.Stat(src + constants.WalFileSuffix); err == nil && stat.Size() > 0 {
+		fmt.Printf("%s is not empty, frames in it were not applied\n", src+constants.WalFileSuffix)
+	}
+
+	cells, notes := salvage(data)
+	for _, note := range notes {
+		fmt.Println(note)
+	}
+
+	pages, rootPageNum, kept := rebuild(cells)
+	if kept < len(cells) {
+		fmt.Printf("dropped %d rows, the table holds at most %d pages\n", len(cells)-kept, constants.TableMaxPages)
+	}
+	if err := writeDb(dst, pages, rootPageNum, cells[:kept]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("salvaged %d rows into %s\n", kept, dst)
+}
+
+// salvage returns the readable leaf cells of a db file in key order, along
+// with a note for every page or cell that had to be dropped.
+func salvage(data []byte) ([]cell, []string) {
+	notes := []string{}
+	if len(data) < int(constants.FileHeaderSize) {
+		return nil, append(notes, "file is smaller than the file header, nothing to salvage")
+	}
+	if string(data[constants.MagicOffset:constants.MagicOffset+constants.MagicSize]) != constants.FileMagic {
+		notes = append(notes, fmt.Sprintf("file header is damaged, assuming a page size of %d", constants.PageSize))
+	}
+	body := data[constants.FileHeaderSize:]
+	if extra := len(body) % int(constants.PageSize); extra != 0 {
+		notes = append(notes, fmt.Sprintf("ignoring %d bytes of a partial page at the end of the file", extra))
+	}
+
+	auxiliary := auxiliaryPages(data)
+
+	// Cells from intact pages win over cells salvaged from corrupt ones.
+	intact, damaged := []cell{}, []cell{}
+	for pageNum := 0; (pageNum+1)*int(constants.PageSize) <= len(body); pageNum++ {
+		page := body[pageNum*int(constants.PageSize) : (pageNum+1)*int(constants.PageSize)]
+		checksumValid := binary.LittleEndian.Uint32(page[constants.PageChecksumOffset:]) == crc32.ChecksumIEEE(page[:constants.PageChecksumOffset])
+		if auxiliary[uint32(pageNum)] {
+			notes = append(notes, fmt.Sprintf("page %d: materialized view or stored generated column node, dropped", pageNum))
+			continue
+		}
+
+		switch types.NodeType(page[constants.NodeTypeOffset]) {
+		case types.NodeInternal:
+			// Internal nodes only hold keys that are rebuilt from the leaves.
+			if !checksumValid {
+				notes = append(notes, fmt.Sprintf("page %d: checksum mismatch on an internal node, skipped", pageNum))
+			}
+			continue
+		case types.NodeLeaf:
+		case types.NodeSpatial:
+			notes = append(notes, fmt.Sprintf("page %d: spatial index node, dropped", pageNum))
+			continue
+		default:
+			notes = append(notes, fmt.Sprintf("page %d: unknown node type %d, dropped", pageNum, page[constants.NodeTypeOffset]))
+			continue
+		}
+
+		numCells := binary.LittleEndian.Uint32(page[constants.LeafNodeNumCellsOffset:])
+		if numCells > constants.LeafNodeMaxCells {
+			notes = append(notes, fmt.Sprintf("page %d: cell count %d is too large, reading %d cells", pageNum, numCells, constants.LeafNodeMaxCells))
+			numCells = constants.LeafNodeMaxCells
+		}
+		salvaged := uint32(0)
+		for i := uint32(0); i < numCells; i++ {
+			offset := constants.LeafNodeHeaderSize + i*constants.LeafNodeCellSize
+			key := binary.LittleEndian.Uint32(page[offset+constants.LeafNodeKeyOffset:])
+			value := page[offset+constants.LeafNodeValueOffset : offset+constants.LeafNodeValueOffset+constants.LeafNodeValueSize]
+			c := cell{key: key, value: append([]byte{}, value...)}
+			if checksumValid {
+				intact = append(intact, c)
+			} else if binary.LittleEndian.Uint32(value[constants.IdOffset:]) == key {
+				damaged = append(damaged, c)
+			} else {
+				continue
+			}
+			salvaged++
+		}
+		if !checksumValid {
+			notes = append(notes, fmt.Sprintf("page %d: checksum mismatch, salvaged %d of %d cells", pageNum, salvaged, numCells))
+		}
+	}
+
+	seen := map[uint32]bool{}
+	cells := []cell{}
+	for _, c := range append(intact, damaged...) {
+		if seen[c.key] {
+			notes = append(notes, fmt.Sprintf("key %d: duplicate cell dropped", c.key))
+			continue
+		}
+		seen[c.key] = true
+		cells = append(cells, c)
+	}
+	sort.Slice(cells, func(i, j int) bool { return cells[i].key < cells[j].key })
+	return cells, notes
+}
+
+// auxiliaryPages returns the pages of the trees of the materialized views, the
+// stored generated columns, the unique and descending indexes and the statistics, walked from the roots the file header lists. It
+// trusts nothing past an intact magic.
+func auxiliaryPages(data []byte) map[uint32]bool {
+	pages := map[uint32]bool{}
+	if string(data[constants.MagicOffset:constants.MagicOffset+constants.MagicSize]) != constants.FileMagic {
+		return pages
+	}
+	numPages := uint32((len(data) - int(constants.FileHeaderSize)) / int(constants.PageSize))
+	var walk func(pageNum uint32)
+	walk = func(pageNum uint32) {
+		if pageNum >= numPages || pages[pageNum] {
+			return
+		}
+		pages[pageNum] = true
+		page := data[constants.FileHeaderSize+pageNum*constants.PageSize:][:constants.PageSize]
+		if types.NodeType(page[constants.NodeTypeOffset]) != types.NodeInternal {
+			return
+		}
+		numKeys := min(binary.LittleEndian.Uint32(page[constants.InternalNodeNumKeysOffset:]), constants.InternalNodeMaxCells)
+		for i := uint32(0); i < numKeys; i++ {
+			walk(binary.LittleEndian.Uint32(page[constants.InternalNodeHeaderSize+i*constants.InternalNodeCellSize:]))
+		}
+		walk(binary.LittleEndian.Uint32(page[constants.InternalNodeRightChildOffset:]))
+	}
+	count := min(binary.LittleEndian.Uint32(data[constants.ViewCountOffset:]), constants.MaxViews)
+	for i := uint32(0); i < count; i++ {
+		entry := data[constants.ViewsOffset+i*constants.ViewEntrySize:]
+		if root := binary.LittleEndian.Uint32(entry[constants.ViewNameSize:]); root != 0 {
+			walk(root)
+		}
+	}
+	if root := binary.LittleEndian.Uint32(data[constants.GeneratedRootOffset:]); root != 0 {
+		walk(root)
+	}
+	for _, offset := range []uint32{constants.UniqueRootOffset, constants.StatisticsRootOffset, constants.DescendingRootOffset} {
+		if root := binary.LittleEndian.Uint32(data[offset:]); root != 0 {
+			walk(root)
+		}
+	}
+	return pages
+}
+
+// treePages returns the number of pages a tree over numLeaves full leaves takes up.
+func treePages(numLeaves int) int {
+	fanout := int(constants.InternalNodeMaxCells) + 1
+	total := numLeaves
+	for n := numLeaves; n > 1; {
+		n = (n + fanout - 1) / fanout
+		total += n
+	}
+	return total
+}
+
+/*
+rebuild builds a B-tree bottom up from cells in key order. Leaves are packed
+full and chained left to right, every level above groups up to
+InternalNodeMaxCells+1 children per node. Rows that do not fit in
+TableMaxPages are left out, rebuild returns how many were kept.
+*/
+func rebuild(cells []cell) ([]types.Page, uint32, int) {
+	maxCells := int(constants.LeafNodeMaxCells)
+	numLeaves := (len(cells) + maxCells - 1) / maxCells
+	if numLeaves == 0 {
+		numLeaves = 1
+	}
+	for treePages(numLeaves) > int(constants.TableMaxPages) {
+		numLeaves--
+	}
+	if len(cells) > numLeaves*maxCells {
+		cells = cells[:numLeaves*maxCells]
+	}
+
+	pages := make([]types.Page, 0, treePages(numLeaves))
+	level := []uint32{}
+	maxKeys := []uint32{}
+	rows := []uint32{} // Rows under every node of the level.
+	for leaf := 0; leaf < numLeaves; leaf++ {
+		pages = append(pages, types.Page{})
+		pageNum := uint32(len(pages) - 1)
+		page := pages[pageNum][:]
+		page[constants.NodeTypeOffset] = byte(types.NodeLeaf)
+
+		chunk := cells[leaf*maxCells : min((leaf+1)*maxCells, len(cells))]
+		binary.LittleEndian.PutUint32(page[constants.LeafNodeNumCellsOffset:], uint32(len(chunk)))
+		if leaf+1 < numLeaves {
+			binary.LittleEndian.PutUint32(page[constants.LeafNodeNextLeafOffset:], pageNum+1)
+		}
+		for i, c := range chunk {
+			offset := constants.LeafNodeHeaderSize + uint32(i)*constants.LeafNodeCellSize
+			binary.LittleEndian.PutUint32(page[offset+constants.LeafNodeKeyOffset:], c.key)
+			copy(page[offset+constants.LeafNodeValueOffset:], c.value)
+		}
+		level = append(level, pageNum)
+		rows = append(rows, uint32(len(chunk)))
+		if len(chunk) > 0 {
+			maxKeys = append(maxKeys, chunk[len(chunk)-1].key)
+		} else {
+			maxKeys = append(maxKeys, 0)
+		}
+	}
+
+	fanout := int(constants.InternalNodeMaxCells) + 1
+	for len(level) > 1 {
+		// Spread the children evenly so no node is left with a single child.
+		numNodes := (len(level) + fanout - 1) / fanout
+		nextLevel, nextMaxKeys, nextRows := []uint32{}, []uint32{}, []uint32{}
+		start := 0
+		for n := 0; n < numNodes; n++ {
+			size := len(level) / numNodes
+			if n < len(level)%numNodes {
+				size++
+			}
+			children, childMaxKeys, childRows := level[start:start+size], maxKeys[start:start+size], rows[start:start+size]
+			start += size
+			total := uint32(0)
+
+			pages = append(pages, types.Page{})
+			pageNum := uint32(len(pages) - 1)
+			page := pages[pageNum][:]
+			page[constants.NodeTypeOffset] = byte(types.NodeInternal)
+			binary.LittleEndian.PutUint32(page[constants.InternalNodeNumKeysOffset:], uint32(len(children)-1))
+			for i, child := range children {
+				if i == len(children)-1 {
+					binary.LittleEndian.PutUint32(page[constants.InternalNodeRightChildOffset:], child)
+					binary.LittleEndian.PutUint32(page[constants.InternalNodeRightCountOffset:], childRows[i])
+				} else {
+					offset := constants.InternalNodeHeaderSize + uint32(i)*constants.InternalNodeCellSize
+					binary.LittleEndian.PutUint32(page[offset:], child)
+					binary.LittleEndian.PutUint32(page[offset+constants.InternalNodeChildSize:], childMaxKeys[i])
+					binary.LittleEndian.PutUint32(page[offset+constants.InternalNodeChildSize+constants.InternalNodeKeySize:], childRows[i])
+				}
+				total += childRows[i]
+				binary.LittleEndian.PutUint32(pages[child][constants.ParentPointerOffset:], pageNum)
+			}
+			nextLevel = append(nextLevel, pageNum)
+			nextMaxKeys = append(nextMaxKeys, childMaxKeys[len(childMaxKeys)-1])
+			nextRows = append(nextRows, total)
+		}
+		level, maxKeys, rows = nextLevel, nextMaxKeys, nextRows
+	}
+
+	rootPageNum := level[0]
+	pages[rootPageNum][constants.IsRootOffset] = 1
+	return pages, rootPageNum, len(cells)
+}
+
+// writeDb writes the file header, counting the rows of the cells, and pages to a new
+// file, it refuses to overwrite an existing one.
+func writeDb(filename string, pages []types.Page, rootPageNum uint32, cells []cell) error {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, constants.FileHeaderSize)
+	copy(header[constants.MagicOffset:], constants.FileMagic)
+	binary.LittleEndian.PutUint32(header[constants.VersionOffset:], constants.FileFormatVersion)
+	binary.LittleEndian.PutUint32(header[constants.HeaderPageSizeOffset:], constants.PageSize)
+	binary.LittleEndian.PutUint32(header[constants.RootPageNumOffset:], rootPageNum)
+	binary.LittleEndian.PutUint32(header[constants.FreelistHeadOffset:], constants.InvalidPageNum)
+	binary.LittleEndian.PutUint32(header[constants.WalSaltOffset:], rand.Uint32())
+	expiring := 0
+	for _, c := range cells {
+		if binary.LittleEndian.Uint64(c.value[constants.ExpiresAtOffset:]) != 0 {
+			expiring++
+		}
+	}
+	binary.LittleEndian.PutUint32(header[constants.RowCountOffset:], uint32(len(cells)))
+	binary.LittleEndian.PutUint32(header[constants.ExpiringRowsOffset:], uint32(expiring))
+	buf := header
+	for i := range pages {
+		page := pages[i][:]
+		binary.LittleEndian.PutUint32(page[constants.PageChecksumOffset:], crc32.ChecksumIEEE(page[:constants.PageChecksumOffset]))
+		buf = append(buf, page...)
+	}
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	return f.Sync()
+}
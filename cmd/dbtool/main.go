@@ -0,0 +1,615 @@
+/*
+Command dbtool works with db files outside of the REPL.
+
+	dbtool inspect <file.db>         print the file header, the page map and tree statistics
+	dbtool verify <file.db>          run the integrity check, exit with 1 if it finds problems
+	dbtool compact <file.db>         rewrite the file with its leaves packed, dropping emptied pages
+	dbtool waldump <file.db>         print the rows each commit in the WAL changed, as JSON
+	dbtool restore <dir> <file.db>   rebuild a db file from a backup made with .backup
+	dbtool shard <n> <file.db> <manifest>   copy the rows into a new database sharded over n files
+	dbtool serve [flags] <file.db>   serve the database to clients, see below
+
+serve runs until interrupted. Its flags choose the front ends to start:
+
+	--http <addr>   POST /query with a statement, rows as JSON; GET /tables
+	--pg <addr>     the Postgres protocol, simple queries only, for psql
+	--resp <addr>   the Redis protocol, GET/SET/DEL/SCAN with ids as keys
+	--grpc <addr>   the gRPC service of api/db.proto, over HTTP/2, with transactions
+	--sweep <d>     how often expired rows are deleted, 1m by default, 0 never
+
+	--max-rows <n>             fail statements returning more than n rows
+	--statement-timeout <d>    fail statements running longer than d
+	--rate <n>                 statements a connection may run per second
+
+	--audit-max-size <bytes>   rotate the audit log at this size, 10 MiB by default
+	--audit-keep <n>           how many rotated audit logs to keep, 5 by default
+
+	--tls-cert <file> --tls-key <file>   serve every front end over TLS only
+	--tls-client-ca <file>               and require client certificates signed by these CAs
+
+	--raft-id <id> --raft-addr <addr>    replicate the database with Raft as the node id, taking the requests of the others on addr
+	--raft-peers <id=url,...>            the other nodes, like 2=http://10.0.0.2:7000,3=http://10.0.0.3:7000
+
+Once the database has user accounts, added with .user in the REPL, clients
+must sign in: with basic authentication over HTTP and gRPC, the user's password
+for Postgres clients and AUTH for Redis clients. What they may do then is up to
+the privileges grant and revoke gave their accounts.
+
+Every statement changing the database is recorded in the audit log next to
+it, <file.db>-audit, which .audit in the REPL shows.
+
+With --raft-id, the database is a node of a cluster whose nodes all start
+from the same file, usually an empty one, and replicate its inserts and
+deletes with Raft; the node keeps its term and log in <file.db>-raft. Only
+insert, delete and select run, on the leader only, and expired rows are not
+swept. The nodes talk plain HTTP without signing in, so the raft address
+must only be reachable by the other nodes.
+
+waldump prints a JSON object per row on a line of its own, with the commit
+it is in, counted from the start of the WAL, op insert, delete or update,
+key, the id of the row, and before and after, the row as it was and as it is
+after the commit, or null:
+
+	{"commit":2,"op":"insert","key":1,"before":null,"after":{"email":"a@b.c","id":1,"username":"user1"}}
+
+Only the commits not yet checkpointed are in the WAL.
+
+inspect, verify and waldump open the file read-only. compact must be the only user of
+the file while it runs: it copies the rows into a fresh file next to it and
+renames that over the original once it is complete.
+
+An encrypted file is opened with the passphrase in $DB_PASSPHRASE, which
+compact also encrypts the new file with. shard leaves the file as it is and
+writes the shards unencrypted next to the manifest, <manifest>-shard0 and so
+on, which db.OpenSharded opens.
+*/
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/raft"
+	"github.com/MichalPitr/db_from_scratch/pkg/server"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+	}
+	if os.Args[1] == "serve" {
+		if err := serve(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if os.Args[1] == "shard" {
+		if len(os.Args) != 5 {
+			usage()
+		}
+		if err := shard(os.Args[2], os.Args[3], os.Args[4]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if os.Args[1] == "restore" {
+		if len(os.Args) != 4 {
+			usage()
+		}
+		if err := db.RestoreBackup(os.Args[2], os.Args[3]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	} else if len(os.Args) != 3 {
+		usage()
+	}
+	var err error
+	switch cmd, filename := os.Args[1], os.Args[2]; cmd {
+	case "inspect":
+		err = inspect(filename)
+	case "verify":
+		var ok bool
+		if ok, err = verify(filename); err == nil && !ok {
+			os.Exit(1)
+		}
+	case "compact":
+		err = compact(filename)
+	case "waldump":
+		err = waldump(filename)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s inspect|verify|compact|waldump <file.db>\n       %s restore <dir> <file.db>\n       %s shard <n> <file.db> <manifest>\n       %s serve [--http <addr>] [--pg <addr>] [--resp <addr>] [--grpc <addr>] [--tls-cert <file> --tls-key <file>] [--raft-id <id> --raft-addr <addr> --raft-peers <peers>] <file.db>\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+	os.Exit(2)
+}
+
+func inspect(filename string) error {
+	table, err := db.OpenReadOnlyEncrypted(filename, os.Getenv("DB_PASSPHRASE"))
+	if err != nil {
+		return err
+	}
+	defer table.Close()
+
+	header := table.Header()
+	fmt.Println("Header:")
+	fmt.Printf("  version: %d\n", header.Version)
+	fmt.Printf("  pageSize: %d\n", header.PageSize)
+	fmt.Printf("  rootPage: %d\n", header.RootPageNum)
+	fmt.Printf("  freelistHead: %d\n", header.FreelistHead)
+	fmt.Printf("  walSalt: %08x\n", header.WalSalt)
+	fmt.Printf("  encrypted: %t\n", header.KeySalt != [len(header.KeySalt)]byte{})
+	fmt.Printf("  bloomFilter: %t\n", header.Bloom != nil)
+	fmt.Printf("  fulltextColumns: %s\n", strings.Join(table.FulltextColumns(), ", "))
+	fmt.Printf("  spatialRootPage: %d\n", header.SpatialRootPageNum)
+	for _, view := range table.Views() {
+		fmt.Printf("  view: %s at page %d, %s\n", view.Name, view.RootPage, view.Query)
+	}
+	fmt.Printf("  generatedRootPage: %d\n", header.GeneratedRootPageNum)
+	for _, column := range header.Generated {
+		fmt.Printf("  generated: %s as (%s), stored %t\n", column.Name, column.Expr, column.Stored)
+	}
+	for _, column := range table.Schema() {
+		if column.Collation != "" {
+			fmt.Printf("  collation: %s %s\n", column.Name, column.Collation)
+		}
+	}
+	if column, collation, ok := table.UniqueIndex(); ok {
+		fmt.Printf("  uniqueIndex: %s collate %s at page %d\n", column, collation, header.UniqueRootPageNum)
+	}
+	fmt.Printf("  statisticsRootPage: %d\n", header.StatisticsRootPageNum)
+	fmt.Printf("  descendingRootPage: %d\n", header.DescendingRootPageNum)
+	fmt.Printf("  usersRootPage: %d\n", header.UsersRootPageNum)
+	fmt.Printf("  orderedRootPage: %d\n", header.OrderedRootPageNum)
+
+	pages, err := table.Pages()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Pages:")
+	fmt.Printf("  %4s %-8s %6s %5s %8s\n", "page", "type", "parent", "cells", "nextLeaf")
+	for _, page := range pages {
+		parent := fmt.Sprint(page.Parent)
+		if page.IsRoot {
+			parent = "root"
+		}
+		next := ""
+		if page.Type == "leaf" {
+			next = fmt.Sprint(page.NextLeaf)
+		}
+		fmt.Printf("  %4d %-8s %6s %5d %8s\n", page.PageNum, page.Type, parent, page.Cells, next)
+	}
+
+	stats, err := table.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Tree:")
+	fmt.Printf("  depth: %d\n", len(stats.Levels))
+	for i, level := range stats.Levels {
+		fmt.Printf("  level %d: %d nodes, %.0f%% full\n", i, level.Nodes, level.FillFactor*100)
+	}
+	for _, partition := range stats.Partitions {
+		fmt.Printf("  partition %d-%d: root %d, %d rows, %d pages\n", partition.From, partition.To, partition.RootPage, partition.Rows, partition.Pages)
+	}
+	return nil
+}
+
+// waldump prints the rows changed by the commits in the WAL, a JSON object per line.
+func waldump(filename string) error {
+	out := json.NewEncoder(os.Stdout)
+	return db.DecodeWal(filename, os.Getenv("DB_PASSPHRASE"), func(record db.WalRecord) error {
+		return out.Encode(record)
+	})
+}
+
+// verify prints the problems the integrity check finds, or ok, and reports whether there were none.
+func verify(filename string) (bool, error) {
+	table, err := db.OpenReadOnlyEncrypted(filename, os.Getenv("DB_PASSPHRASE"))
+	if err != nil {
+		return false, err
+	}
+	defer table.Close()
+	problems := table.IntegrityCheck()
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) == 0 {
+		fmt.Println("ok")
+	}
+	return len(problems) == 0, nil
+}
+
+func compact(filename string) error {
+	// Opening for writing replays a WAL left behind by a crash.
+	src, err := db.OpenEncrypted(filename, os.Getenv("DB_PASSPHRASE"))
+	if err != nil {
+		return err
+	}
+	before, err := src.Info()
+	if err != nil {
+		src.Close()
+		return err
+	}
+
+	tmpName := filename + ".compact"
+	os.Remove(tmpName)
+	dst, err := db.OpenEncrypted(tmpName, os.Getenv("DB_PASSPHRASE"))
+	if err != nil {
+		src.Close()
+		return err
+	}
+	// The new file keeps the partitions, which must be set up while it is empty, and the index.
+	partitions, err := src.Partitions()
+	if err == nil && len(partitions) > 1 {
+		bounds := []uint32{}
+		for _, partition := range partitions[1:] {
+			bounds = append(bounds, partition.From)
+		}
+		err = dst.Partition(context.Background(), bounds)
+	}
+	if columns := src.FulltextColumns(); err == nil && len(columns) > 0 {
+		err = dst.CreateFulltextIndex(context.Background(), columns)
+	}
+	if err == nil && src.HasSpatialIndex() {
+		err = dst.CreateSpatialIndex(context.Background())
+	}
+	// Stored generated columns are computed again as the rows are loaded.
+	for _, column := range src.Schema() {
+		if err == nil && column.Generated != "" {
+			err = dst.AddColumn(context.Background(), column.Name, column.Generated, column.Stored)
+		}
+	}
+	for _, column := range src.Schema() {
+		if err == nil && column.Collation != "" {
+			err = dst.SetCollation(context.Background(), column.Name, column.Collation)
+		}
+	}
+	if err != nil {
+		dst.Close()
+		src.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	// The rows come out of the cursor in id order, so they are packed into leaves.
+	cursor := src.Cursor()
+	step := cursor.First
+	copied := []uint32{}
+	_, err = dst.BulkLoad(context.Background(), func() (types.Row, error) {
+		if err := step(); err != nil {
+			return types.Row{}, err
+		}
+		step = cursor.Next
+		if !cursor.Valid() {
+			return types.Row{}, io.EOF
+		}
+		row, err := cursor.Value()
+		copied = append(copied, row.Id)
+		return row, err
+	})
+	cursor.Close()
+	if err == nil && src.HasSpatialIndex() {
+		err = copyBoxes(src, dst, copied)
+	}
+	// The unique, descending and ordered indexes are built from the copied rows, the bulk loader would insert them one at a time.
+	if column, collation, ok := src.UniqueIndex(); err == nil && ok {
+		err = dst.CreateUniqueIndex(context.Background(), column, collation)
+	}
+	if err == nil && src.HasDescendingIndex() {
+		err = dst.CreateIndex(context.Background(), "id", true)
+	}
+	if column, ok := src.OrderedIndex(); err == nil && ok {
+		err = dst.CreateIndex(context.Background(), column, false)
+	}
+	// The views are filled from the copied rows, after them so their trees do not split the table's.
+	for _, view := range src.Views() {
+		if err != nil {
+			break
+		}
+		err = dst.CreateView(context.Background(), view.Name, view.Query, view.OnCommit)
+	}
+	if err == nil {
+		err = src.CopyUsers(dst)
+	}
+	// Statistics are measured again rather than copied, the leaves they sampled are gone.
+	if _, analyzed, _ := src.Statistics(context.Background()); err == nil && analyzed {
+		err = dst.Analyze(context.Background())
+	}
+	var after db.TableInfo
+	if err == nil {
+		after, err = dst.Info()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := src.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, filename); err != nil {
+		return err
+	}
+	fmt.Printf("compacted %d rows from %d to %d pages\n", after.Rows, before.Pages, after.Pages)
+	return nil
+}
+
+// copyBoxes gives the copied rows the boxes they have in src, in a single transaction.
+func copyBoxes(src *db.Table, dst *db.Table, copied []uint32) error {
+	ctx := context.Background()
+	boxes, err := src.Boxes(ctx)
+	if err != nil {
+		return err
+	}
+	if err := dst.Begin(); err != nil {
+		return err
+	}
+	// The copied ids are in ascending order, so the new tree does not depend on map order.
+	for _, id := range copied {
+		box, ok := boxes[id]
+		if !ok {
+			continue
+		}
+		if err := dst.SetBox(ctx, id, box); err != nil {
+			dst.Rollback()
+			return err
+		}
+	}
+	return dst.Commit()
+}
+
+// shard copies the rows of a db file into a new sharded database.
+func shard(n string, filename string, manifest string) error {
+	shards, err := strconv.Atoi(n)
+	if err != nil {
+		return fmt.Errorf("the number of shards must be a number, not %q", n)
+	}
+	if _, err := os.Stat(manifest); err == nil {
+		return fmt.Errorf("%s already exists", manifest)
+	}
+	src, err := db.OpenReadOnlyEncrypted(filename, os.Getenv("DB_PASSPHRASE"))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := db.OpenSharded(manifest, shards)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	copied := 0
+	err = src.Scan(ctx, func(row types.Row) error {
+		copied++
+		return dst.Insert(ctx, row)
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("copied %d rows into %d shards\n", copied, shards)
+	return nil
+}
+
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	httpAddr := flags.String("http", "", "serve HTTP on this address, like :8080")
+	pgAddr := flags.String("pg", "", "serve the Postgres protocol on this address, like :5432")
+	respAddr := flags.String("resp", "", "serve the Redis protocol on this address, like :6379")
+	grpcAddr := flags.String("grpc", "", "serve gRPC on this address, like :50051")
+	sweep := flags.Duration("sweep", time.Minute, "delete expired rows this often, 0 to never delete them")
+	tlsCert := flags.String("tls-cert", "", "PEM file with the TLS certificate, enables TLS")
+	tlsKey := flags.String("tls-key", "", "PEM file with the key of the TLS certificate")
+	tlsClientCA := flags.String("tls-client-ca", "", "PEM file with the CAs client certificates must be signed by")
+	auditMaxSize := flags.Int64("audit-max-size", 10<<20, "rotate the audit log once it grows past this many bytes")
+	auditKeep := flags.Int("audit-keep", 5, "how many rotated audit logs to keep")
+	maxRows := flags.Int("max-rows", 0, "fail statements returning more rows than this, 0 for no limit")
+	timeout := flags.Duration("statement-timeout", 0, "fail statements running longer than this, 0 for no limit")
+	rate := flags.Float64("rate", 0, "statements a connection may run per second, 0 for no limit")
+	lockTimeout := flags.Duration("lock-timeout", 0, "fail writes waiting longer than this for a row another transaction locked, 0 to wait until it is unlocked")
+	raftID := flags.String("raft-id", "", "replicate the database with Raft, as the node with this id")
+	raftAddr := flags.String("raft-addr", "", "take the Raft requests of the other nodes on this address, like :7000")
+	raftPeers := flags.String("raft-peers", "", "the other nodes, like 2=http://10.0.0.2:7000,3=http://10.0.0.3:7000")
+	flags.Parse(args)
+	if flags.NArg() != 1 || (*httpAddr == "" && *pgAddr == "" && *respAddr == "" && *grpcAddr == "") ||
+		(*tlsCert == "") != (*tlsKey == "") || (*tlsClientCA != "" && *tlsCert == "") || *auditMaxSize <= 0 || *auditKeep < 0 ||
+		*maxRows < 0 || *timeout < 0 || *rate < 0 || *lockTimeout < 0 ||
+		(*raftID == "") != (*raftAddr == "") || (*raftPeers != "" && *raftID == "") {
+		usage()
+	}
+	peers, err := parsePeers(*raftPeers)
+	if err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		var err error
+		if tlsConfig, err = server.LoadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA); err != nil {
+			return err
+		}
+	}
+	table, err := db.OpenEncrypted(flags.Arg(0), os.Getenv("DB_PASSPHRASE"))
+	if err != nil {
+		return err
+	}
+	table.SetLockTimeout(*lockTimeout)
+	auditName, err := table.AuditFile()
+	if err != nil {
+		table.Close()
+		return err
+	}
+	auditLog, err := db.OpenAuditLog(auditName, *auditMaxSize, *auditKeep)
+	if err != nil {
+		table.Close()
+		return err
+	}
+	defer auditLog.Close()
+	srv := server.New(table)
+	srv.SetTLSConfig(tlsConfig)
+	srv.SetAuditLog(auditLog)
+	srv.SetLimits(server.Limits{MaxRows: *maxRows, MaxRuntime: *timeout, Rate: *rate})
+	var node *raft.Node
+	if *raftID != "" {
+		node, err = raft.Start(raft.Config{
+			ID:        *raftID,
+			Peers:     slices.Sorted(maps.Keys(peers)),
+			Dir:       flags.Arg(0) + "-raft",
+			Transport: &raft.HTTPTransport{URLs: peers},
+			Apply:     srv.ApplyRaft,
+			Applied:   srv.Applied(),
+			Logger:    slog.Default(),
+		})
+		if err != nil {
+			table.Close()
+			return err
+		}
+		srv.SetReplication(node)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Every front end runs until ctx is done and reports to errs once it stopped.
+	var frontEnds []string
+	errs := make(chan error)
+	serveHTTP := func(name string, addr string, handler http.Handler, tlsConfig *tls.Config) {
+		httpServer := &http.Server{
+			Addr:        addr,
+			Handler:     handler,
+			TLSConfig:   tlsConfig,
+			ConnContext: srv.ConnContext,
+			// A client that is slow to send its request, or keeps an idle connection open, does not hold on to it for good.
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       time.Minute,
+			IdleTimeout:       2 * time.Minute,
+		}
+		go func() {
+			<-ctx.Done()
+			// Let running requests finish before the table is closed under them.
+			httpServer.Shutdown(context.Background())
+		}()
+		go func() {
+			var err error
+			if tlsConfig != nil {
+				err = httpServer.ListenAndServeTLS("", "")
+			} else {
+				err = httpServer.ListenAndServe()
+			}
+			if errors.Is(err, http.ErrServerClosed) {
+				err = nil
+			}
+			errs <- err
+		}()
+		frontEnds = append(frontEnds, name+" on "+addr)
+	}
+	if *httpAddr != "" {
+		serveHTTP("HTTP", *httpAddr, srv.HTTPHandler(), tlsConfig)
+	}
+	if node != nil {
+		serveHTTP("Raft", *raftAddr, raft.Handler(node), nil)
+	}
+	for _, frontEnd := range []struct {
+		name  string
+		addr  string
+		serve func(context.Context, net.Listener) error
+	}{
+		{"Postgres", *pgAddr, srv.ServePG},
+		{"Redis", *respAddr, srv.ServeRESP},
+		{"gRPC", *grpcAddr, srv.ServeGRPC},
+	} {
+		if frontEnd.addr == "" {
+			continue
+		}
+		l, err := net.Listen("tcp", frontEnd.addr)
+		if err != nil {
+			stop()
+			for range frontEnds {
+				<-errs
+			}
+			if node != nil {
+				node.Stop()
+			}
+			table.Close()
+			return err
+		}
+		serve := frontEnd.serve
+		go func() { errs <- serve(ctx, l) }()
+		frontEnds = append(frontEnds, frontEnd.name+" on "+frontEnd.addr)
+	}
+	log.Printf("serving %s", strings.Join(frontEnds, ", "))
+	// A failed sweep leaves expired rows in place but does not stop serving them.
+	swept := make(chan struct{})
+	go func() {
+		defer close(swept)
+		// The deletes would not be replicated.
+		if *sweep <= 0 || node != nil {
+			return
+		}
+		if err := srv.SweepExpired(ctx, *sweep); err != nil {
+			log.Printf("stopped deleting expired rows: %v", err)
+		}
+	}()
+
+	// The first front end to fail stops the others.
+	for range frontEnds {
+		if frontEndErr := <-errs; frontEndErr != nil && err == nil {
+			err = frontEndErr
+			stop()
+		}
+	}
+	stop()
+	<-swept
+	// The node applies no more entries to the table once it is closed.
+	if node != nil {
+		node.Stop()
+	}
+	if closeErr := table.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// parsePeers parses the --raft-peers of serve into the URL of every node by id.
+func parsePeers(text string) (map[string]string, error) {
+	peers := map[string]string{}
+	if text == "" {
+		return peers, nil
+	}
+	for _, peer := range strings.Split(text, ",") {
+		id, url, ok := strings.Cut(peer, "=")
+		if !ok || id == "" || url == "" || peers[id] != "" {
+			return nil, fmt.Errorf("invalid raft peer %q, expected id=url", peer)
+		}
+		peers[id] = strings.TrimSuffix(url, "/")
+	}
+	return peers, nil
+}
@@ -0,0 +1,53 @@
+/*
+Package dbprom exposes the metrics of a database as a prometheus.Collector.
+
+It is a module of its own, so the database itself keeps to the standard
+library and only the programs that use Prometheus depend on its client:
+
+	registry.MustRegister(dbprom.NewCollector(table))
+
+Collect reads the metrics within Table.Exclusive, so a program using the
+table from several goroutines must use it within Exclusive too, as the
+server does.
+*/
+package dbprom
+
+import (
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector collects the metrics of a table, see db.Table.Metrics.
+type Collector struct {
+	table *db.Table
+}
+
+// NewCollector returns a collector of the metrics of the table.
+func NewCollector(table *db.Table) *Collector {
+	return &Collector{table: table}
+}
+
+// Describe sends the descriptions of the metrics, taken from a collection of them.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+// Collect sends the current values of the metrics.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	var metrics []db.Metric
+	c.table.Exclusive(func() error {
+		metrics = c.table.Metrics()
+		return nil
+	})
+	for _, m := range metrics {
+		desc := prometheus.NewDesc(m.Name, m.Help, nil, nil)
+		switch m.Kind {
+		case "counter":
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, m.Value)
+		case "gauge":
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, m.Value)
+		case "histogram":
+			ch <- prometheus.MustNewConstHistogram(desc, m.Count, m.Sum, m.Buckets)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package dbprom
+
+import (
+	"context"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+	table, _ := db.Open(db.MemoryDbName)
+	defer table.Close()
+	for _, query := range []string{"insert 1 a a", "insert 2 b b", "select"} {
+		stmt, _ := parser.Parse(query)
+		if _, err := table.Execute(context.Background(), stmt, func(values []any) error { return nil }); err != nil {
+			t.Fatalf("%s failed: %v", query, err)
+		}
+	}
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(NewCollector(table)); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	found := map[string]bool{}
+	for _, family := range families {
+		found[family.GetName()] = true
+		switch family.GetName() {
+		case "simpledb_statements_total":
+			if value := family.GetMetric()[0].GetCounter().GetValue(); value != 3 {
+				t.Fatalf("Expected 3 statements. Got: %v", value)
+			}
+		case "simpledb_flush_duration_seconds":
+			// Opening commits the empty root, then each insert commits.
+			if count := family.GetMetric()[0].GetHistogram().GetSampleCount(); count != 3 {
+				t.Fatalf("Expected 3 flushes. Got: %v", count)
+			}
+		}
+	}
+	for _, name := range []string{"simpledb_statements_total", "simpledb_cache_hit_ratio", "simpledb_flush_duration_seconds"} {
+		if !found[name] {
+			t.Fatalf("Expected the metric %s. Got: %v", name, found)
+		}
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/MichalPitr/db_from_scratch
 
-go 1.21.6
+go 1.24
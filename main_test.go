@@ -3,12 +3,21 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
 )
 
 const dbFile = "test.db"
@@ -53,8 +62,8 @@ func TestPrintStructureOfThreeLeafNode(t *testing.T) {
 		"simpleDB> Executed.",
 		"simpleDB> Executed.",
 		"simpleDB> Tree:",
-		"- internal (size 1)",
-		"  - leaf (size 7)",
+		"- internal (size 1) page 0, root, 14 rows, 33% full",
+		"  - leaf (size 7) page 2, parent 0, next leaf 1, 53% full",
 		"    - 1",
 		"    - 2",
 		"    - 3",
@@ -63,7 +72,7 @@ func TestPrintStructureOfThreeLeafNode(t *testing.T) {
 		"    - 6",
 		"    - 7",
 		"  - key 7",
-		"  - leaf (size 7)",
+		"  - leaf (size 7) page 1, parent 0, next leaf none, 53% full",
 		"    - 8",
 		"    - 9",
 		"    - 10",
@@ -146,8 +155,8 @@ func TestPrintStructureOfFourLeafNode(t *testing.T) {
 		"simpleDB> Executed.",
 		"simpleDB> Executed.",
 		"simpleDB> Tree:",
-		"- internal (size 3)",
-		"  - leaf (size 7)",
+		"- internal (size 3) page 0, root, 30 rows, 100% full",
+		"  - leaf (size 7) page 2, parent 0, next leaf 3, 53% full",
 		"    - 1",
 		"    - 2",
 		"    - 3",
@@ -156,7 +165,7 @@ func TestPrintStructureOfFourLeafNode(t *testing.T) {
 		"    - 6",
 		"    - 7",
 		"  - key 7",
-		"  - leaf (size 8)",
+		"  - leaf (size 8) page 3, parent 0, next leaf 1, 61% full",
 		"    - 8",
 		"    - 9",
 		"    - 10",
@@ -166,7 +175,7 @@ func TestPrintStructureOfFourLeafNode(t *testing.T) {
 		"    - 14",
 		"    - 15",
 		"  - key 15",
-		"  - leaf (size 7)",
+		"  - leaf (size 7) page 1, parent 0, next leaf 4, 53% full",
 		"    - 16",
 		"    - 17",
 		"    - 18",
@@ -175,7 +184,7 @@ func TestPrintStructureOfFourLeafNode(t *testing.T) {
 		"    - 21",
 		"    - 22",
 		"  - key 22",
-		"  - leaf (size 8)",
+		"  - leaf (size 8) page 4, parent 0, next leaf none, 61% full",
 		"    - 23",
 		"    - 24",
 		"    - 25",
@@ -249,7 +258,7 @@ func TestPrintStructureOneNodeTree(t *testing.T) {
 		"simpleDB> Executed.",
 		"simpleDB> Executed.",
 		"simpleDB> Tree:",
-		"- leaf (size 3)",
+		"- leaf (size 3) page 0, root, next leaf none, 23% full",
 		"  - 1",
 		"  - 2",
 		"  - 3",
@@ -259,6 +268,123 @@ func TestPrintStructureOneNodeTree(t *testing.T) {
 	assertEqual(output, expectedOutputs, t)
 }
 
+func TestIntegrityCheck(t *testing.T) {
+	deleteDb()
+	inputs := []string{}
+	for i := 1; i <= 40; i++ {
+		inputs = append(inputs, fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	inputs = append(inputs, ".integrity_check")
+	inputs = append(inputs, ".exit")
+	expectedOutputs := []string{}
+	for i := 1; i <= 40; i++ {
+		expectedOutputs = append(expectedOutputs, "simpleDB> Executed.")
+	}
+	expectedOutputs = append(expectedOutputs, "simpleDB> ok", "simpleDB> ")
+	output := dbDriver(t, inputs)
+	assertEqual(output, expectedOutputs, t)
+}
+
+func TestDbfsckSalvagesCorruptPage(t *testing.T) {
+	deleteDb()
+	repaired := "repaired.db"
+	os.Remove(repaired)
+	defer os.Remove(repaired)
+
+	inputs := []string{}
+	for i := 1; i <= 40; i++ {
+		inputs = append(inputs, fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	inputs = append(inputs, ".exit")
+	dbDriver(t, inputs)
+
+	// Page 1 is the leftmost leaf. Damage the row of its first cell and the key of its second.
+	f, err := os.OpenFile(dbFile, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("Failed to open db file: %v", err)
+	}
+	cell := int64(constants.FileHeaderSize + constants.PageSize + constants.LeafNodeHeaderSize)
+	f.WriteAt([]byte("mangled"), cell+int64(constants.LeafNodeValueOffset+constants.UsernameOffset))
+	f.WriteAt([]byte{0xff, 0xff}, cell+int64(constants.LeafNodeCellSize+constants.LeafNodeKeyOffset))
+	f.Close()
+
+	output, err := exec.Command("go", "run", "./cmd/dbfsck", dbFile, repaired).Output()
+	if err != nil {
+		t.Fatalf("dbfsck failed: %v", err)
+	}
+	expectedOutputs := []string{
+		"page 1: checksum mismatch, salvaged 6 of 7 cells",
+		"salvaged 39 rows into repaired.db",
+	}
+	assertEqual(*bytes.NewBuffer(output), expectedOutputs, t)
+
+	table, err := db.Open(repaired)
+	if err != nil {
+		t.Fatalf("Failed to open repaired db: %v", err)
+	}
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected a sound tree. Got: %v", problems)
+	}
+	numRows := 0
+	table.Scan(context.Background(), func(row types.Row) error {
+		numRows++
+		return nil
+	})
+	if numRows != 39 {
+		t.Fatalf("Expected 39 rows. Got: %d", numRows)
+	}
+	table.Close()
+}
+
+func TestDbtool(t *testing.T) {
+	deleteDb()
+	inputs := []string{}
+	for i := 1; i <= 40; i++ {
+		inputs = append(inputs, fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	// Empty the leftmost leaves.
+	for i := 1; i <= 20; i++ {
+		inputs = append(inputs, fmt.Sprintf("delete %d", i))
+	}
+	inputs = append(inputs, ".exit")
+	dbDriver(t, inputs)
+
+	dbtool := func(args ...string) string {
+		output, err := exec.Command("go", append([]string{"run", "./cmd/dbtool"}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("dbtool %v failed: %v", args, err)
+		}
+		return string(output)
+	}
+	inspect := dbtool("inspect", dbFile)
+	for _, expected := range []string{"  rootPage: 0\n", "     0 internal   root     1         \n", "     2 leaf          7     0        1\n", "  depth: 3\n"} {
+		if !strings.Contains(inspect, expected) {
+			t.Fatalf("Expected %q in the inspect output. Got:\n%s", expected, inspect)
+		}
+	}
+	if output := dbtool("compact", dbFile); output != "compacted 20 rows from 8 to 3 pages\n" {
+		t.Fatalf("Unexpected compact output: %q", output)
+	}
+	if output := dbtool("verify", dbFile); output != "ok\n" {
+		t.Fatalf("Unexpected verify output: %q", output)
+	}
+	assertEqual(dbDriver(t, []string{"select count(*)", ".exit"}), []string{"simpleDB> (20)", "Executed.", "simpleDB> "}, t)
+
+	// waldump reads the commits of a writer that still has the database open.
+	table, err := db.Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open the db: %v", err)
+	}
+	defer table.Close()
+	if err := table.Delete(context.Background(), 21); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	expected := `{"commit":1,"op":"delete","key":21,"before":{"email":"person21@example.com","id":21,"username":"user21"},"after":null}` + "\n"
+	if output := dbtool("waldump", dbFile); output != expected {
+		t.Fatalf("Unexpected waldump output,\ngot: %q\nexpected: %q", output, expected)
+	}
+}
+
 func TestInsertAndSelect(t *testing.T) {
 	deleteDb()
 	inputs := []string{
@@ -355,6 +481,325 @@ func TestPersistData(t *testing.T) {
 	assertEqual(output, expectedOutputs, t)
 }
 
+func TestTransactionRollback(t *testing.T) {
+	deleteDb()
+	inputs := []string{
+		"insert 1 user1 person1@example.com",
+		"begin",
+		"insert 2 user2 person2@example.com",
+		"insert 3 user3 person3@example.com",
+		"rollback",
+		"select",
+		".exit",
+	}
+	expectedOutputs := []string{
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> (1, user1, person1@example.com)",
+		"Executed.",
+		"simpleDB> ",
+	}
+	output := dbDriver(t, inputs)
+	assertEqual(output, expectedOutputs, t)
+}
+
+func TestTransactionCommitPersists(t *testing.T) {
+	deleteDb()
+	inputs := []string{}
+	inputs = append(inputs, "begin")
+	for i := 1; i <= 15; i++ {
+		inputs = append(inputs, fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	inputs = append(inputs, "commit")
+	inputs = append(inputs, "begin")
+	inputs = append(inputs, "insert 16 user16 person16@example.com")
+	// Uncommitted transaction is discarded on exit.
+	inputs = append(inputs, ".exit")
+	dbDriver(t, inputs)
+
+	inputs = []string{
+		".btree",
+		".exit",
+	}
+	expectedOutputs := []string{
+		"simpleDB> Tree:",
+		"- internal (size 1) page 0, root, 15 rows, 33% full",
+		"  - leaf (size 7) page 2, parent 0, next leaf 1, 53% full",
+		"    - 1",
+		"    - 2",
+		"    - 3",
+		"    - 4",
+		"    - 5",
+		"    - 6",
+		"    - 7",
+		"  - key 7",
+		"  - leaf (size 8) page 1, parent 0, next leaf none, 61% full",
+		"    - 8",
+		"    - 9",
+		"    - 10",
+		"    - 11",
+		"    - 12",
+		"    - 13",
+		"    - 14",
+		"    - 15",
+		"simpleDB> ",
+	}
+	output := dbDriver(t, inputs)
+	assertEqual(output, expectedOutputs, t)
+}
+
+func TestTransactionErrors(t *testing.T) {
+	deleteDb()
+	inputs := []string{
+		"commit",
+		"rollback",
+		"begin",
+		"begin",
+		".exit",
+	}
+	expectedOutputs := []string{
+		"simpleDB> Error: cannot commit - no transaction is active",
+		"simpleDB> Error: cannot rollback - no transaction is active",
+		"simpleDB> Executed.",
+		"simpleDB> Error: cannot start a transaction within a transaction",
+		"simpleDB> ",
+	}
+	output := dbDriver(t, inputs)
+	assertEqual(output, expectedOutputs, t)
+}
+
+func TestSavepointPartialRollback(t *testing.T) {
+	deleteDb()
+	inputs := []string{
+		"begin",
+		"insert 1 user1 person1@example.com",
+		"savepoint a",
+	}
+	// Enough rows to split the root after the savepoint.
+	for i := 2; i <= 15; i++ {
+		inputs = append(inputs, fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	inputs = append(inputs, "rollback to a")
+	inputs = append(inputs, "rollback to b")
+	inputs = append(inputs, "insert 20 user20 person20@example.com")
+	inputs = append(inputs, "release a")
+	inputs = append(inputs, "commit")
+	inputs = append(inputs, ".btree")
+	inputs = append(inputs, ".exit")
+	expectedOutputs := []string{
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+	}
+	for i := 2; i <= 15; i++ {
+		expectedOutputs = append(expectedOutputs, "simpleDB> Executed.")
+	}
+	expectedOutputs = append(expectedOutputs,
+		"simpleDB> Executed.",
+		"simpleDB> Error: no such savepoint: b",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Tree:",
+		"- leaf (size 2) page 0, root, next leaf none, 15% full",
+		"  - 1",
+		"  - 20",
+		"simpleDB> ",
+	)
+	output := dbDriver(t, inputs)
+	assertEqual(output, expectedOutputs, t)
+}
+
+func TestGroupBy(t *testing.T) {
+	deleteDb()
+	inputs := []string{
+		"insert 1 alice a1@example.com",
+		"insert 2 bob b@example.com",
+		"insert 3 alice a3@example.com",
+		"select username, count(*), min(id), max(email) group by username",
+		"select count(*)",
+		"select email, id",
+		"select id, count(*)",
+		".exit",
+	}
+	expectedOutputs := []string{
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> (alice, 2, 1, a3@example.com)",
+		"(bob, 1, 2, b@example.com)",
+		"Executed.",
+		"simpleDB> (3)",
+		"Executed.",
+		"simpleDB> (a1@example.com, 1)",
+		"(b@example.com, 2)",
+		"(a3@example.com, 3)",
+		"Executed.",
+		"simpleDB> Error: column id must be aggregated or appear in group by",
+		"simpleDB> ",
+	}
+	output := dbDriver(t, inputs)
+	assertEqual(output, expectedOutputs, t)
+}
+
+func TestInSubquery(t *testing.T) {
+	deleteDb()
+	inputs := []string{
+		"insert 1 alice a1@example.com",
+		"insert 2 bob b@example.com",
+		"insert 3 alice a3@example.com",
+		"select where id in (select max(id) group by username)",
+		"select count(*) where username in (select username where id in (select id))",
+		"select where id in (select id, email)",
+		".exit",
+	}
+	expectedOutputs := []string{
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> (2, bob, b@example.com)",
+		"(3, alice, a3@example.com)",
+		"Executed.",
+		"simpleDB> (3)",
+		"Executed.",
+		"simpleDB> Error: subquery must return 1 column, but returns 2",
+		"simpleDB> ",
+	}
+	output := dbDriver(t, inputs)
+	assertEqual(output, expectedOutputs, t)
+}
+
+func TestImportCSV(t *testing.T) {
+	deleteDb()
+	csvFile := "test.csv"
+	defer os.Remove(csvFile)
+	lines := []string{"email,id,username"}
+	for i := 1; i <= 250; i++ {
+		lines = append(lines, fmt.Sprintf("user%d@example.com,%d,user%d", i, i, i))
+	}
+	lines = append(lines, `"quoted, with comma",251,"a ""b"""`)
+	os.WriteFile(csvFile, []byte(strings.Join(lines, "\n")+"\n"), 0666)
+
+	inputs := []string{
+		".import " + csvFile,
+		"select count(*), max(id)",
+		"select where id = 251",
+		".import " + csvFile,
+		"select count(*)",
+		".exit",
+	}
+	expectedOutputs := []string{
+		"simpleDB> 100 rows imported",
+		"200 rows imported",
+		"Imported 251 rows.",
+		"simpleDB> (251, 251)",
+		"Executed.",
+		`simpleDB> (251, a "b", quoted, with comma)`,
+		"Executed.",
+		"simpleDB> Error: line 2: duplicate key",
+		"simpleDB> (251)",
+		"Executed.",
+		"simpleDB> ",
+	}
+	output := dbDriver(t, inputs)
+	assertEqual(output, expectedOutputs, t)
+}
+
+func TestOutputCSV(t *testing.T) {
+	deleteDb()
+	csvFile := "test.csv"
+	defer os.Remove(csvFile)
+	inputs := []string{
+		"insert 1 user1 'with, comma'",
+		"insert 2 'say \"hi\"' user2@example.com",
+		".output " + csvFile,
+		"select",
+		"select max(id) where id > 5",
+		".output",
+		"select count(*)",
+		".exit",
+	}
+	expectedOutputs := []string{
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> simpleDB> (2)",
+		"Executed.",
+		"simpleDB> ",
+	}
+	output := dbDriver(t, inputs)
+	assertEqual(output, expectedOutputs, t)
+
+	content, _ := os.ReadFile(csvFile)
+	expected := "id,username,email\r\n1,user1,\"with, comma\"\r\n2,\"say \"\"hi\"\"\",user2@example.com\r\nmax(id)\r\n\r\n"
+	if string(content) != expected {
+		t.Fatalf("Unexpected CSV, got: %q\nexpected: %q", content, expected)
+	}
+}
+
+func TestModeJSON(t *testing.T) {
+	deleteDb()
+	inputs := []string{
+		"insert 1 user1 'quote\"d'",
+		".mode json",
+		"select",
+		"select username, count(*), max(email) where id > 5 group by username",
+		"select count(*), max(email) where id > 5",
+		".mode csv",
+		"select id",
+		".mode yaml",
+		".mode tuple",
+		"select",
+		".exit",
+	}
+	expectedOutputs := []string{
+		"simpleDB> Executed.",
+		`simpleDB> simpleDB> {"id":1,"username":"user1","email":"quote\"d"}`,
+		"Executed.",
+		"simpleDB> Executed.",
+		`simpleDB> {"count(*)":0,"max(email)":null}`,
+		"Executed.",
+		"simpleDB> simpleDB> id",
+		"1",
+		"Executed.",
+		"simpleDB> Error: unknown mode yaml, expected tuple, table, csv or json",
+		`simpleDB> simpleDB> (1, user1, quote"d)`,
+		"Executed.",
+		"simpleDB> ",
+	}
+	output := dbDriver(t, inputs)
+	assertEqual(output, expectedOutputs, t)
+}
+
+func TestDumpReplays(t *testing.T) {
+	deleteDb()
+	dumpFile := "test.sql"
+	defer os.Remove(dumpFile)
+	inputs := []string{}
+	for i := 1; i <= 30; i++ {
+		inputs = append(inputs, fmt.Sprintf("insert %d 'user %d' 'it''s%d@example.com'", i, i, i))
+	}
+	inputs = append(inputs, "delete 7", ".dump "+dumpFile, ".exit")
+	dbDriver(t, inputs)
+	before := dbDriver(t, []string{"select", ".exit"})
+
+	deleteDb()
+	script, _ := os.ReadFile(dumpFile)
+	lines := strings.Split(strings.TrimSpace(string(script)), "\n")
+	if lines[0] != "begin;" || lines[1] != "insert 1 'user 1' 'it''s1@example.com';" || lines[len(lines)-1] != "commit;" {
+		t.Fatalf("Unexpected dump: %q", lines)
+	}
+	dbDriver(t, append(lines, ".exit"))
+	after := dbDriver(t, []string{"select", ".exit"})
+	if before.String() != after.String() {
+		t.Fatalf("Replaying the dump changed the rows,\nbefore: %s\nafter: %s", before.String(), after.String())
+	}
+}
+
 func dbDriver(t *testing.T, inputs []string) bytes.Buffer {
 	cmd := exec.Command("./db_from_scratch", dbFile)
 	stdin, err := cmd.StdinPipe()
@@ -413,6 +858,535 @@ func sendCommands(stdin io.WriteCloser, commands []string) error {
 	return nil
 }
 
+var update = flag.Bool("update", false, "rewrite the .golden files of TestGolden with the current output")
+
+/*
+TestGolden runs every testdata/*.sql script against a fresh database, one line
+per REPL input, and compares the output with the .golden file next to it.
+After an intended change of the output, regenerate the files with
+
+	go test -run TestGolden -update
+
+and review the diff.
+*/
+func TestGolden(t *testing.T) {
+	scripts, err := filepath.Glob(filepath.Join("testdata", "*.sql"))
+	if err != nil {
+		t.Fatalf("Failed to list scripts: %v", err)
+	}
+	for _, script := range scripts {
+		name := strings.TrimSuffix(filepath.Base(script), ".sql")
+		t.Run(name, func(t *testing.T) {
+			input, err := os.ReadFile(script)
+			if err != nil {
+				t.Fatalf("Failed to read script: %v", err)
+			}
+			deleteDb()
+			output := dbDriver(t, strings.Split(strings.TrimSuffix(string(input), "\n"), "\n"))
+			golden := strings.TrimSuffix(script, ".sql") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, output.Bytes(), 0666); err != nil {
+					t.Fatalf("Failed to update %s: %v", golden, err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Failed to read %s, run with -update to create it: %v", golden, err)
+			}
+			if output.String() != string(expected) {
+				t.Fatalf("Output differs from %s.\ngot:\n%s\nexpected:\n%s", golden, output.String(), expected)
+			}
+		})
+	}
+}
+
 func deleteDb() {
 	os.Remove("test.db")
+	os.Remove("test.db-wal")
+}
+
+func TestFlags(t *testing.T) {
+	deleteDb()
+	script := "init.sql"
+	os.WriteFile(script, []byte("insert 1 user1 a@b.c\ninsert 2 user2 c@d.e\n"), 0644)
+	defer os.Remove(script)
+
+	out, err := exec.Command("./db_from_scratch", dbFile, "-init", script, "-exec", "select id").Output()
+	if err != nil {
+		t.Fatalf("Command failed: %v", err)
+	}
+	expected := "Executed.\nExecuted.\n(1)\n(2)\nExecuted.\n"
+	if string(out) != expected {
+		t.Fatalf("Unexpected output,\ngot: %q\nexpected: %q", out, expected)
+	}
+
+	out, err = exec.Command("./db_from_scratch", "-readonly", dbFile, "-exec", "delete 1").Output()
+	if err == nil {
+		t.Fatalf("Expected a write to a read-only database to fail")
+	}
+	if expected := "Error: database is read-only\n"; string(out) != expected {
+		t.Fatalf("Unexpected output,\ngot: %q\nexpected: %q", out, expected)
+	}
+}
+
+func TestArchiveCommand(t *testing.T) {
+	deleteDb()
+	archive := t.TempDir()
+	out, err := exec.Command("./db_from_scratch", dbFile, "-archive-command", "cp %p "+archive+"/%f", "-exec", "insert 1 user1 a@b.c").Output()
+	if err != nil {
+		t.Fatalf("Command failed: %v", err)
+	}
+	if expected := "Executed.\n"; string(out) != expected {
+		t.Fatalf("Unexpected output,\ngot: %q\nexpected: %q", out, expected)
+	}
+	// Closing checkpoints the commits of the session, which closes a segment.
+	segments, _ := os.ReadDir(archive)
+	if len(segments) != 1 || !strings.HasPrefix(segments[0].Name(), "test.db-wal-") {
+		t.Fatalf("Expected one archived segment. Got: %v", segments)
+	}
+	if info, _ := segments[0].Info(); info.Size() == 0 || info.Size()%int64(constants.WalFrameSize) != 0 {
+		t.Fatalf("Expected the segment to hold whole frames. Got %d bytes", info.Size())
+	}
+
+	out, _ = exec.Command("./db_from_scratch", dbFile, "-archive-command", "exit 3", "-exec", "insert 2 user2 c@d.e").CombinedOutput()
+	if !strings.Contains(string(out), "failed to archive wal segment") {
+		t.Fatalf("Expected the failed archive to be reported. Got: %q", out)
+	}
+	if stat, err := os.Stat(dbFile + constants.WalFileSuffix); err != nil || stat.Size() == 0 {
+		t.Fatalf("Expected the WAL to be kept when archiving fails. Got: %v", err)
+	}
+}
+
+func TestTimer(t *testing.T) {
+	deleteDb()
+	output := dbDriver(t, []string{".timer on", "insert 1 user1 a@b.c", "insert or ignore 1 user1 a@b.c", "select", ".timer off", "select", ".exit"})
+	lines := strings.Split(output.String(), "\n")
+	if len(lines) != 10 {
+		t.Fatalf("Unexpected output: %q", lines)
+	}
+	for i, rows := range map[int]string{1: "1", 3: "0", 6: "1"} {
+		if !strings.HasPrefix(lines[i], "Run time: ") || !strings.HasSuffix(lines[i], ", "+rows+" rows") {
+			t.Fatalf("Expected the run time and %s rows on line %d. Got: %q", rows, i, lines[i])
+		}
+	}
+	if lines[8] != "Executed." {
+		t.Fatalf("Expected no run time after .timer off. Got: %q", lines)
+	}
+}
+
+func TestModeTable(t *testing.T) {
+	deleteDb()
+	inputs := []string{
+		"insert 1 user1 person1@example.com",
+		"insert 22 'user 22' " + strings.Repeat("x", 50),
+		".mode table",
+		"select",
+		"select max(email) where id > 100",
+		".exit",
+	}
+	expectedOutputs := []string{
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> simpleDB> +----+----------+------------------------------------------+",
+		"| id | username | email                                    |",
+		"+----+----------+------------------------------------------+",
+		"|  1 | user1    | person1@example.com                      |",
+		"| 22 | user 22  | " + strings.Repeat("x", 37) + "... |",
+		"+----+----------+------------------------------------------+",
+		"Executed.",
+		"simpleDB> +------------+",
+		"| max(email) |",
+		"+------------+",
+		"| NULL       |",
+		"+------------+",
+		"Executed.",
+		"simpleDB> ",
+	}
+	output := dbDriver(t, inputs)
+	assertEqual(output, expectedOutputs, t)
+}
+
+func TestMixedCaseRoundTrip(t *testing.T) {
+	deleteDb()
+	inputs := []string{
+		"INSERT 1 JohnSmith John.Smith@Example.COM",
+		`Insert 2 "Mary Jane" 'MJ@Example.com'`,
+		".MODE csv",
+		"Select Username, Email Where Username = 'JohnSmith' Or Email Like 'MJ@%'",
+		".exit",
+	}
+	output := dbDriver(t, inputs)
+	expectedOutputs := []string{
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> simpleDB> username,email",
+		"JohnSmith,John.Smith@Example.COM",
+		"Mary Jane,MJ@Example.com",
+		"Executed.",
+		"simpleDB> ",
+	}
+	assertEqual(output, expectedOutputs, t)
+}
+
+func TestBench(t *testing.T) {
+	deleteDb()
+	output := dbDriver(t, []string{".bench insert 50 random", ".bench select 50 zipfian", ".bench insert 5 zipfian", "select", ".exit"})
+	lines := strings.Split(output.String(), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Unexpected output: %q", lines)
+	}
+	for i, prefix := range []string{"simpleDB> insert random: 50 ops in ", "simpleDB> select zipfian: 50 ops in "} {
+		if !strings.HasPrefix(lines[i], prefix) || !strings.Contains(lines[i], "ops/sec, p50 ") {
+			t.Fatalf("Expected benchmark results on line %d. Got: %q", i, lines[i])
+		}
+	}
+	if !strings.HasSuffix(lines[0], " pages written") || strings.HasSuffix(lines[0], ", 0 pages written") {
+		t.Fatalf("Expected inserts to write pages. Got: %q", lines[0])
+	}
+	// The benchmark runs on a scratch table, the database stays empty.
+	assertEqual(output, []string{
+		lines[0],
+		lines[1],
+		"simpleDB> Error: zipfian keys are only supported for select",
+		"simpleDB> Executed.",
+		"simpleDB> ",
+	}, t)
+}
+
+func TestExportSQLite(t *testing.T) {
+	deleteDb()
+	sqliteFile := "test.sqlite"
+	defer os.Remove(sqliteFile)
+	inputs := []string{}
+	for i := 1; i <= 200; i++ {
+		inputs = append(inputs, fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+	}
+	inputs = append(inputs, "delete 7", ".export sqlite "+sqliteFile, ".exit")
+	output := dbDriver(t, inputs)
+	lines := strings.Split(output.String(), "\n")
+	if got := lines[len(lines)-2]; got != "simpleDB> Exported 199 rows." {
+		t.Fatalf("Expected the export to report 199 rows. Got: %q", got)
+	}
+
+	data, err := os.ReadFile(sqliteFile)
+	if err != nil {
+		t.Fatalf("Failed to read the export: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte("SQLite format 3\x00")) {
+		t.Fatalf("Expected the SQLite magic. Got: %q", data[:16])
+	}
+	if pages := binary.BigEndian.Uint32(data[28:]); int(pages)*4096 != len(data) {
+		t.Fatalf("Header says %d pages, but the file has %d bytes", pages, len(data))
+	}
+
+	// The sqlite3 shell, when installed, checks the file and reads it back.
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	out, err := exec.Command("sqlite3", sqliteFile, "pragma integrity_check; select count(*), sum(id), min(email) from users; select * from users where id = 200;").CombinedOutput()
+	if err != nil {
+		t.Fatalf("sqlite3 failed: %v\n%s", err, out)
+	}
+	expected := "ok\n199|20093|user100@example.com\n200|user200|user200@example.com\n"
+	if string(out) != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, out)
+	}
+}
+
+func TestImportSQLite(t *testing.T) {
+	deleteDb()
+	sqliteFile := "test.sqlite"
+	defer os.Remove(sqliteFile)
+	inputs := []string{}
+	for i := 1; i <= 150; i++ {
+		inputs = append(inputs, fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+	}
+	dbDriver(t, append(inputs, "insert 151 '' ''", ".export sqlite "+sqliteFile, ".exit"))
+
+	// Exported rows read back into an empty database unchanged.
+	deleteDb()
+	output := dbDriver(t, []string{
+		".import sqlite " + sqliteFile + " Users",
+		"select count(*), max(id)",
+		"select where id = 150 or id = 151",
+		".import sqlite " + sqliteFile + " missing",
+		".exit",
+	})
+	assertEqual(output, []string{
+		"simpleDB> 100 rows imported",
+		"Imported 151 rows.",
+		"simpleDB> (151, 151)",
+		"Executed.",
+		"simpleDB> (150, user150, user150@example.com)",
+		"(151, , )",
+		"Executed.",
+		"simpleDB> Error: no table missing in the SQLite database",
+		"simpleDB> ",
+	}, t)
+
+	// A file written by SQLite itself, with small pages so the table has
+	// interior pages and the large fourth column overflow pages.
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	os.Remove(sqliteFile)
+	setup := "pragma page_size = 512; create table people(pid integer, name text, mail text, extra blob);" +
+		"insert into people select value, 'name' || value, null, zeroblob(value * 10) from generate_series(1, 120);" +
+		"create table odd(id integer primary key, name, mail); insert into odd values (1, 2, 'x');"
+	if out, err := exec.Command("sqlite3", sqliteFile, setup).CombinedOutput(); err != nil {
+		t.Fatalf("sqlite3 failed: %v\n%s", err, out)
+	}
+	deleteDb()
+	output = dbDriver(t, []string{
+		".import sqlite " + sqliteFile + " people",
+		"select count(*), min(id), max(id)",
+		"select where id = 120",
+		".import sqlite " + sqliteFile + " odd",
+		".exit",
+	})
+	assertEqual(output, []string{
+		"simpleDB> 100 rows imported",
+		"Imported 120 rows.",
+		"simpleDB> (120, 1, 120)",
+		"Executed.",
+		"simpleDB> (120, name120, )",
+		"Executed.",
+		"simpleDB> Error: rowid 1: username is not text",
+		"simpleDB> ",
+	}, t)
+}
+
+func TestSelectIntoParquet(t *testing.T) {
+	deleteDb()
+	parquetFile := "test.parquet"
+	defer os.Remove(parquetFile)
+	output := dbDriver(t, []string{
+		"insert 1 alice a@example.com",
+		"insert 2 bob b@example.com",
+		"select id, username where id > 1 into parquet '" + parquetFile + "'",
+		"select nope into parquet 'missing.parquet'",
+		".exit",
+	})
+	assertEqual(output, []string{
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Error: no such column: nope",
+		"simpleDB> ",
+	}, t)
+
+	// A failed statement leaves no file behind.
+	if _, err := os.Stat("missing.parquet"); !os.IsNotExist(err) {
+		os.Remove("missing.parquet")
+		t.Fatalf("Expected no file for the failed select. Got: %v", err)
+	}
+	data, err := os.ReadFile(parquetFile)
+	if err != nil {
+		t.Fatalf("Failed to read the Parquet file: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte("PAR1")) || !bytes.HasSuffix(data, []byte("PAR1")) {
+		t.Fatalf("Expected the Parquet magic at both ends. Got: %q", data)
+	}
+	footerLength := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	if footerLength <= 0 || footerLength > len(data)-12 {
+		t.Fatalf("Invalid footer length %d for a file of %d bytes", footerLength, len(data))
+	}
+	footer := data[len(data)-8-footerLength : len(data)-8]
+	for _, name := range []string{"id", "username"} {
+		if !bytes.Contains(footer, []byte(name)) {
+			t.Fatalf("Expected column %s in the footer. Got: %q", name, footer)
+		}
+	}
+	if !bytes.Contains(data, []byte("bob")) || bytes.Contains(data, []byte("alice")) {
+		t.Fatalf("Expected only the selected row in the file. Got: %q", data)
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	deleteDb()
+	jsonFile := "test.ndjson"
+	defer os.Remove(jsonFile)
+	output := dbDriver(t, []string{
+		"insert 2 bob 'b\"@example.com'",
+		"insert 1 alice a@example.com",
+		".export ndjson " + jsonFile,
+		".export xml " + jsonFile,
+		".exit",
+	})
+	assertEqual(output, []string{
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Exported 2 rows.",
+		"simpleDB> Usage: .export sqlite|ndjson <file>",
+		"simpleDB> ",
+	}, t)
+	data, err := os.ReadFile(jsonFile)
+	if err != nil {
+		t.Fatalf("Failed to read the export: %v", err)
+	}
+	expected := `{"id":1,"username":"alice","email":"a@example.com"}` + "\n" +
+		`{"id":2,"username":"bob","email":"b\"@example.com"}` + "\n"
+	if string(data) != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, data)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	deleteDb()
+	inputs := []string{}
+	for _, id := range []int{1, 2, 3, 5, 9, 10} {
+		inputs = append(inputs, fmt.Sprintf("insert %d user%d a@b.c", id, id))
+	}
+	inputs = append(inputs, ".keys", ".keys 2 5", ".keys 6 8", ".keys 1", ".exit")
+	expected := []string{
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> 1-3",
+		"5",
+		"9-10",
+		"keys: 6, min: 1, max: 10",
+		"gaps: 2, 4 missing ids, the largest 3 after 5",
+		"simpleDB> 2-3",
+		"5",
+		"keys: 3, min: 2, max: 5",
+		"gaps: 1, 1 missing ids, the largest 1 after 3",
+		"simpleDB> keys: 0",
+		"simpleDB> Usage: .keys [lo hi]",
+		"simpleDB> ",
+	}
+	assertEqual(dbDriver(t, inputs), expected, t)
+}
+
+func TestExplain(t *testing.T) {
+	deleteDb()
+	inputs := []string{
+		"insert 1 alice a@b.c",
+		"insert 2 bob b@b.c",
+		"create unique index on username",
+		".explain select * where username = 'bob'",
+		".explain select * where id > 1 order by id desc",
+		".explain delete 1",
+		".exit",
+	}
+	expected := []string{
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> Executed.",
+		"simpleDB> lookup of 1 rows in the unique index",
+		"simpleDB> scan of ids 2 to 4294967295 in the primary tree, in descending order",
+		"simpleDB> Usage: .explain <select>",
+		"simpleDB> ",
+	}
+	assertEqual(dbDriver(t, inputs), expected, t)
+}
+
+func TestPrintSubtree(t *testing.T) {
+	deleteDb()
+	inputs := []string{}
+	for i := 1; i <= 14; i++ {
+		inputs = append(inputs, fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	inputs = append(inputs, ".btree 1", ".btree 9", ".btree x", ".exit")
+	expected := []string{}
+	for i := 1; i <= 14; i++ {
+		expected = append(expected, "simpleDB> Executed.")
+	}
+	expected = append(expected,
+		"simpleDB> Tree below page 1:",
+		"- leaf (size 7) page 1, parent 0, next leaf none, 53% full",
+		"  - 8",
+		"  - 9",
+		"  - 10",
+		"  - 11",
+		"  - 12",
+		"  - 13",
+		"  - 14",
+		"simpleDB> Tree below page 9:",
+		"Error: page 9 is out of bounds, the file has 3 pages",
+		"simpleDB> Usage: .btree [page], or .btree dot <file.dot>",
+		"simpleDB> ",
+	)
+	assertEqual(dbDriver(t, inputs), expected, t)
+}
+
+func TestBtreeDot(t *testing.T) {
+	deleteDb()
+	dot := filepath.Join(t.TempDir(), "tree.dot")
+	inputs := []string{}
+	for i := 1; i <= 14; i++ {
+		inputs = append(inputs, fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	output := dbDriver(t, append(inputs, ".btree dot "+dot, ".exit"))
+	if !strings.Contains(output.String(), "Wrote the tree to "+dot+".") {
+		t.Fatalf("Expected the file to be written. Got: %q", output.String())
+	}
+	got, err := os.ReadFile(dot)
+	if err != nil {
+		t.Fatalf("Failed to read the graph: %v", err)
+	}
+	expected := `digraph btree {
+	node [shape=box];
+	p0 -> p2 [label="<= 7"];
+	p2 -> p1 [style=dashed, constraint=false];
+	p2 [label="leaf, page 2\n1-7, 7 rows"];
+	p0 -> p1;
+	p1 [label="leaf, page 1\n8-14, 7 rows"];
+	p0 [label="internal, page 0\n1-14, 14 rows"];
+}
+`
+	if string(got) != expected {
+		t.Fatalf("Unexpected graph:\n%s", got)
+	}
+}
+
+func TestPageDump(t *testing.T) {
+	deleteDb()
+	output := dbDriver(t, []string{"insert 1 alice alice@x.org", ".page 0", ".page 1", ".exit"})
+	lines := strings.Split(output.String(), "\n")
+	expected := []string{
+		"simpleDB> Executed.",
+		"simpleDB> page 0, leaf node",
+		"  0000 node type:   leaf",
+		"  0001 is root:     true",
+		"  0002 parent:      0",
+		"  0006 num cells:   1",
+		"  000a next leaf:   0",
+		"0000  01 01 00 00 00 00 01 00 00 00 00 00 00 00 01 00  |................|",
+		"0010  00 00 01 00 00 00 61 6c 69 63 65 00 00 00 00 00  |......alice.....|",
+	}
+	if len(lines) < len(expected) || !slices.Equal(lines[:len(expected)], expected) {
+		t.Fatalf("Unexpected dump: %q", lines)
+	}
+	if !slices.Contains(lines, "*") || !slices.Contains(lines, "1000") {
+		t.Fatalf("Expected the zeros to be collapsed and the dump to end at the page size. Got: %q", lines)
+	}
+	if !slices.Contains(lines, "simpleDB> Error: page 1 is out of bounds, the file has 1 pages") {
+		t.Fatalf("Expected a page past the end to be refused. Got: %q", lines)
+	}
+}
+
+func TestBlankLinesAndEOF(t *testing.T) {
+	deleteDb()
+	// Blank lines are skipped, and the end of the input closes the database without .exit.
+	output := dbDriver(t, []string{"", "insert 1 user1 a@b.c", "   ", "insert 2 user2 a@b.c"})
+	expected := []string{
+		"simpleDB> simpleDB> Executed.",
+		"simpleDB> simpleDB> Executed.",
+		"simpleDB> ",
+	}
+	assertEqual(output, expected, t)
+
+	output = dbDriver(t, []string{"select"})
+	expected = []string{
+		"simpleDB> (1, user1, a@b.c)",
+		"(2, user2, a@b.c)",
+		"Executed.",
+		"simpleDB> ",
+	}
+	assertEqual(output, expected, t)
 }
@@ -0,0 +1,161 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// benchDefaultOps is how many operations .bench runs when no count is given.
+// It stays below what fits into TableMaxPages, larger runs end with table full.
+const benchDefaultOps = 300
+
+/*
+Bench runs a synthetic workload against a scratch in-memory table and prints
+its throughput, latency percentiles and the pages the pager wrote. The
+arguments are the workload, insert or select, an optional operation count
+and an optional key distribution:
+
+	insert [n] [sequential|random]
+	select [n] [sequential|random|zipfian]
+
+Every insert is committed on its own. Selects look up single rows by id in a
+table loaded with n rows first, the load is not measured.
+*/
+func Bench(ctx context.Context, args []string, w io.Writer) error {
+	workload, n, dist := args[0], benchDefaultOps, "sequential"
+	if len(args) > 1 {
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 1 {
+			return fmt.Errorf("invalid number of operations %q", args[1])
+		}
+		n = count
+	}
+	if len(args) > 2 {
+		dist = args[2]
+	}
+	rng := rand.New(rand.NewSource(1)) // Fixed, so runs can be compared.
+	keys, err := benchKeys(rng, workload, dist, n)
+	if err != nil {
+		return err
+	}
+
+	table, err := db.Open(db.MemoryDbName)
+	if err != nil {
+		return err
+	}
+	defer table.Close()
+	var op func(key uint32) error
+	switch workload {
+	case "insert":
+		op = func(key uint32) error {
+			return table.Insert(ctx, benchRow(key))
+		}
+	case "select":
+		if err := benchLoad(ctx, table, n); err != nil {
+			return fmt.Errorf("loading %d rows: %w", n, err)
+		}
+		cursor := table.Cursor()
+		defer cursor.Close()
+		op = func(key uint32) error {
+			if err := cursor.Seek(key); err != nil {
+				return err
+			}
+			_, err := cursor.Value()
+			return err
+		}
+	}
+
+	before, err := table.Stats()
+	if err != nil {
+		return err
+	}
+	latencies := make([]time.Duration, 0, n)
+	start := time.Now()
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		opStart := time.Now()
+		if err := op(key); err != nil {
+			return fmt.Errorf("%s %d of %d: %w", workload, i+1, n, err)
+		}
+		latencies = append(latencies, time.Since(opStart))
+	}
+	elapsed := time.Since(start)
+	after, err := table.Stats()
+	if err != nil {
+		return err
+	}
+
+	slices.Sort(latencies)
+	_, err = fmt.Fprintf(w, "%s %s: %d ops in %v, %.0f ops/sec, p50 %v, p99 %v, %d pages written\n",
+		workload, dist, n, elapsed.Round(time.Microsecond), float64(n)/elapsed.Seconds(),
+		percentile(latencies, 50), percentile(latencies, 99), after.PagesWritten-before.PagesWritten)
+	return err
+}
+
+// benchKeys returns the ids a workload operates on, in order.
+func benchKeys(rng *rand.Rand, workload string, dist string, n int) ([]uint32, error) {
+	if workload != "insert" && workload != "select" {
+		return nil, fmt.Errorf("unknown workload %s, expected insert or select", workload)
+	}
+	keys := make([]uint32, n)
+	switch dist {
+	case "sequential":
+		for i := range keys {
+			keys[i] = uint32(i + 1)
+		}
+	case "random":
+		for i, k := range rng.Perm(n) {
+			keys[i] = uint32(k + 1)
+		}
+	case "zipfian":
+		if workload == "insert" {
+			// Inserts need distinct ids, repeating the popular ones would only fail.
+			return nil, fmt.Errorf("zipfian keys are only supported for select")
+		}
+		zipf := rand.NewZipf(rng, 1.1, 1, uint64(n-1))
+		for i := range keys {
+			keys[i] = uint32(zipf.Uint64() + 1)
+		}
+	default:
+		return nil, fmt.Errorf("unknown key distribution %s, expected sequential, random or zipfian", dist)
+	}
+	return keys, nil
+}
+
+// benchLoad fills the table with the rows 1 to n.
+func benchLoad(ctx context.Context, table *db.Table, n int) error {
+	id := uint32(0)
+	_, err := table.BulkLoad(ctx, func() (types.Row, error) {
+		if id == uint32(n) {
+			return types.Row{}, io.EOF
+		}
+		id++
+		return benchRow(id), nil
+	})
+	return err
+}
+
+func benchRow(id uint32) types.Row {
+	row := types.Row{Id: id}
+	copy(row.Username[:], fmt.Sprintf("user%d", id))
+	copy(row.Email[:], fmt.Sprintf("user%d@example.com", id))
+	return row
+}
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
@@ -1,81 +1,227 @@
 package cli
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/MichalPitr/db_from_scratch/pkg/constants"
-	"github.com/MichalPitr/db_from_scratch/pkg/types"
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
 )
 
-func PrepareStatement(text string) (*types.Statement, error) {
-	if strings.EqualFold(text[:6], "insert") {
-		stmt := types.Statement{
-			StmtType:    types.StmtInsert,
-			RowToInsert: types.Row{},
-		}
-		var username, email string
-		n, err := fmt.Sscanf(text, "insert %d %s %s", &stmt.RowToInsert.Id, &username, &email)
-		if err != nil {
-			return nil, err
-		}
-		if n < 3 {
-			return nil, fmt.Errorf("expected 3 arguments for insert, but got %d", n)
-		}
+func PrintPrompt() {
+	fmt.Print(Prompt())
+}
 
-		if len(username) > int(constants.UsernameSize) {
-			return nil, fmt.Errorf("string is too long")
-		}
+func Prompt() string {
+	return fmt.Sprintf("%v> ", constants.DbName)
+}
 
-		if len(email) > int(constants.EmailSize) {
-			return nil, fmt.Errorf("string is too long")
-		}
+func DisplayHelp() {
+	fmt.Printf("Welcome to %v! These are the available commands:\n", constants.CliName)
+	fmt.Println(".help    - Show available commands")
+	fmt.Println(".clear   - Clear the terminal screen")
+	fmt.Println(".dump    - Print insert statements recreating the table: .dump [file]")
+	fmt.Println(".import  - Insert the rows of a CSV file or SQLite table: .import <file.csv>, .import sqlite <file.db> <table>")
+	fmt.Println(".export  - Write the table as a SQLite database or JSON lines: .export sqlite|ndjson <file>")
+	fmt.Println(".backup  - Back up the database into a directory: .backup [--incremental] <dir>")
+	fmt.Println(".user    - Manage the accounts clients of dbtool serve sign in with: .user add <name> <password>, .user remove <name>, .user list, privileges with grant and revoke")
+	fmt.Println(".audit   - Show the statements clients of dbtool serve changed the database with: .audit [--user <name>] [n], the last 20 by default, 0 for all")
+	fmt.Println(".rekey   - Encrypt the database with a new passphrase: .rekey <passphrase>, or decrypt it: .rekey --none")
+	fmt.Println(".mode    - Print results as tuples, a table, CSV or JSON lines: .mode tuple|table|csv|json")
+	fmt.Println(".stats   - Show pager and B-tree statistics, and the size of each partition")
+	fmt.Println(".btree   - Print the B-tree, with the page, parent, next leaf and fill of every node: .btree [page], or write it as a Graphviz graph: .btree dot <file.dot>")
+	fmt.Println(".page    - Dump the bytes of a page, after the fields of its node header: .page <n>")
+	fmt.Println(".explain - Show how a select reads its rows, which index or range of ids: .explain <select>")
+	fmt.Println(".keys    - List the ids, runs of consecutive ones as from-to, with their min, max and gaps: .keys [lo hi]")
+	fmt.Println(".bench   - Measure a synthetic workload: .bench insert|select [n] [sequential|random|zipfian]")
+	fmt.Println(".timer   - Print the run time and row count of each statement: .timer on|off")
+	fmt.Println(".tables  - List the tables with their sizes")
+	fmt.Println(".schema  - Show the columns of the table")
+	fmt.Println(".output  - Write results to a CSV file: .output <file.csv>, or back to the screen: .output")
+	fmt.Println(".exit    - Closes your connection to", constants.DbName)
+}
 
-		copy(stmt.RowToInsert.Username[:], []byte(username))
-		copy(stmt.RowToInsert.Email[:], []byte(email))
-		return &stmt, nil
-	}
-	if strings.EqualFold(text, "select") {
-		return &types.Statement{StmtType: types.StmtSelect}, nil
-	}
-	if strings.EqualFold(text[:6], "delete") {
-		stmt := types.Statement{
-			StmtType: types.StmtDelete,
+// DisplaySchema prints the columns of the table and how its rows are indexed.
+func DisplaySchema(table *db.Table) {
+	fmt.Println("Columns:")
+	for _, column := range table.Schema() {
+		var description string
+		switch {
+		case column.Generated != "" && column.Stored:
+			description = fmt.Sprintf("%s, generated as (%s), stored", column.Type, column.Generated)
+		case column.Generated != "":
+			description = fmt.Sprintf("%s, generated as (%s), virtual", column.Type, column.Generated)
+		case column.PrimaryKey:
+			description = fmt.Sprintf("%s primary key, unsigned, %d bytes", column.Type, column.Size)
+		case column.Type == "text":
+			description = fmt.Sprintf("%s, up to %d bytes", column.Type, column.Size)
+		default:
+			description = column.Type
 		}
-		var rowId uint32
-		n, err := fmt.Sscanf(text, "delete %d", &rowId)
-		if err != nil {
-			return nil, err
+		if column.Collation != "" {
+			description += ", collate " + column.Collation
 		}
-		if n < 1 {
-			return nil, fmt.Errorf("expected 1 argument for delete, but got %d", n)
+		fmt.Printf("  %-10s %s\n", column.Name, description)
+	}
+	fmt.Println("Indexes:")
+	fmt.Println("  primary key B-tree on id")
+	if columns := table.FulltextColumns(); len(columns) > 0 {
+		fmt.Printf("  fulltext index on %s\n", strings.Join(columns, ", "))
+	}
+	if table.HasSpatialIndex() {
+		fmt.Println("  spatial index of the boxes given at insert")
+	}
+	if column, collation, ok := table.UniqueIndex(); ok {
+		fmt.Printf("  unique index on %s, collate %s\n", column, collation)
+	}
+	if table.HasDescendingIndex() {
+		fmt.Println("  descending index on id")
+	}
+	if column, ok := table.OrderedIndex(); ok {
+		fmt.Printf("  ordered index on %s\n", column)
+	}
+	if views := table.Views(); len(views) > 0 {
+		fmt.Println("Materialized views:")
+		for _, view := range views {
+			refresh := "refreshed on demand"
+			if view.OnCommit {
+				refresh = "refreshed on commit"
+			}
+			fmt.Printf("  %s as %s, %s\n", view.Name, view.Query, refresh)
 		}
-		stmt.RowToDelete = rowId
-		log.Printf("TODO: Implement delete support., cmd: %+v", stmt)
-		return &stmt, nil
 	}
-	return nil, fmt.Errorf("unknown statement: %v", text)
 }
 
-func PrintRow(row types.Row) {
-	username := string(bytes.Trim(row.Username[:], "\x00"))
-	email := string(bytes.Trim(row.Email[:], "\x00"))
-	fmt.Printf("(%d, %s, %s)\n", row.Id, username, email)
+// DisplayTables prints the name, root page, row count and page count of every table.
+func DisplayTables(table *db.Table) error {
+	info, err := table.Info()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-10s %5s %8s %6s\n", "name", "root", "rows", "pages")
+	fmt.Printf("%-10s %5d %8d %6d\n", info.Name, info.RootPage, info.Rows, info.Pages)
+	return nil
 }
 
-func PrintPrompt() {
-	fmt.Printf("%v> ", constants.DbName)
+// DisplayAudit prints the last n entries of the audit log of the database,
+// all of them if n is 0, leaving out the other users' if user is not empty.
+func DisplayAudit(table *db.Table, user string, n int) error {
+	name, err := table.AuditFile()
+	if err != nil {
+		return err
+	}
+	entries, err := db.ReadAuditLog(name)
+	if err != nil {
+		return err
+	}
+	if user != "" {
+		entries = slices.DeleteFunc(entries, func(entry db.AuditEntry) bool { return entry.User != user })
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	fmt.Printf("%-20s %-10s %-21s %4s  %s\n", "time", "user", "client", "rows", "statement")
+	for _, entry := range entries {
+		statement := entry.Statement
+		if entry.Error != "" {
+			statement += "  -- failed: " + entry.Error
+		}
+		fmt.Printf("%-20s %-10s %-21s %4d  %s\n", entry.Time.UTC().Format(time.DateTime), entry.User, entry.Client, entry.Rows, statement)
+	}
+	return nil
 }
 
-func DisplayHelp() {
-	fmt.Printf("Welcome to %v! These are the available commands:\n", constants.CliName)
-	fmt.Println(".help    - Show available commands")
-	fmt.Println(".clear   - Clear the terminal screen")
-	fmt.Println(".exit    - Closes your connection to", constants.DbName)
+// DisplayStats prints the pager and B-tree counters, the fill factor of every level of the
+// tree, and the statistics of the last analyze.
+func DisplayStats(table *db.Table) error {
+	stats, err := table.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Stats:")
+	fmt.Printf("pagesRead: %d\n", stats.PagesRead)
+	fmt.Printf("pagesWritten: %d\n", stats.PagesWritten)
+	fmt.Printf("cacheHits: %d\n", stats.CacheHits)
+	fmt.Printf("cacheMisses: %d\n", stats.CacheMisses)
+	fmt.Printf("splits: %d\n", stats.Splits)
+	fmt.Printf("bloomSkips: %d\n", stats.BloomSkips)
+	fmt.Printf("rows: %d, %d with a ttl\n", stats.Rows, stats.ExpiringRows)
+	fmt.Printf("treeDepth: %d\n", len(stats.Levels))
+	for i, level := range stats.Levels {
+		fmt.Printf("level %d: %d nodes, %.0f%% full\n", i, level.Nodes, level.FillFactor*100)
+	}
+	for _, partition := range stats.Partitions {
+		fmt.Printf("partition %d-%d: %d rows, %d pages\n", partition.From, partition.To, partition.Rows, partition.Pages)
+	}
+	analyzed, ok, err := table.Statistics(context.Background())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println("analyzed: never, run analyze to estimate rows and ids")
+		return nil
+	}
+	fmt.Printf("analyzed: %s\n", analyzed.AnalyzedAt.UTC().Format(time.DateTime))
+	fmt.Printf("estimatedRows: %d, from %d sampled\n", analyzed.Rows, analyzed.SampledRows)
+	fmt.Printf("avgRowWidth: %.1f bytes\n", analyzed.AvgRowWidth)
+	for _, bucket := range analyzed.Histogram {
+		fmt.Printf("ids %d-%d: %d rows\n", bucket.From, bucket.To, bucket.Rows)
+	}
+	return nil
+}
+
+/*
+DisplayKeys prints the ids of the rows from from to to, a run of consecutive
+ids as from-to on one line, then how many there are, the smallest and largest,
+and the gaps between them. Only the keys of the leaves are read.
+*/
+func DisplayKeys(ctx context.Context, table *db.Table, from uint32, to uint32) error {
+	keys, gaps, missing := 0, 0, uint64(0)
+	var first, last, runStart, largestGap, largestAfter uint32
+	printRun := func() {
+		if runStart == last {
+			fmt.Println(last)
+		} else {
+			fmt.Printf("%d-%d\n", runStart, last)
+		}
+	}
+	err := table.ScanKeys(ctx, from, to, func(id uint32) error {
+		switch {
+		case keys == 0:
+			first, runStart = id, id
+		case id != last+1:
+			printRun()
+			runStart = id
+			gaps++
+			missing += uint64(id - last - 1)
+			if gap := id - last - 1; gap > largestGap {
+				largestGap, largestAfter = gap, last
+			}
+		}
+		keys++
+		last = id
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if keys == 0 {
+		fmt.Println("keys: 0")
+		return nil
+	}
+	printRun()
+	fmt.Printf("keys: %d, min: %d, max: %d\n", keys, first, last)
+	if gaps == 0 {
+		fmt.Println("gaps: none")
+		return nil
+	}
+	fmt.Printf("gaps: %d, %d missing ids, the largest %d after %d\n", gaps, missing, largestGap, largestAfter)
+	return nil
 }
 
 func DisplayConstants() {
@@ -94,10 +240,9 @@ func ClearScreen() {
 	cmd.Run()
 }
 
+// CleanInput trims the whitespace around a line. Case is kept, the parser folds keywords itself.
 func CleanInput(text string) string {
-	output := strings.TrimSpace(text)
-	output = strings.ToLower(output)
-	return output
+	return strings.TrimSpace(text)
 }
 
 func HandleCmd(cmd string) {
@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+)
+
+// Completer returns the words the last, partially typed word of line can be completed to.
+type Completer func(line string) []string
+
+// keywords are completed anywhere in a statement.
+var keywords = []string{
+	"insert", "select", "delete", "begin", "commit", "rollback", "savepoint", "release", "to",
+	"where", "group", "by", "and", "or", "not", "like", "in", "count", "min", "max",
+}
+
+// NewCompleter completes meta-commands at the start of a line, and keywords and column names elsewhere.
+func NewCompleter(metaCommands []string) Completer {
+	words := slices.Clone(keywords)
+	for _, column := range db.Schema() {
+		words = append(words, column.Name)
+	}
+	metaCommands = slices.Clone(metaCommands)
+	slices.Sort(metaCommands)
+	return func(line string) []string {
+		prefix := line[strings.LastIndexAny(line, " \t(,")+1:]
+		candidates := words
+		if strings.HasPrefix(line, ".") {
+			if strings.ContainsAny(line, " \t") {
+				return nil // Arguments of meta-commands are file names and modes.
+			}
+			candidates = metaCommands
+		}
+		var matches []string
+		for _, word := range candidates {
+			if strings.HasPrefix(word, strings.ToLower(prefix)) {
+				matches = append(matches, word)
+			}
+		}
+		return matches
+	}
+}
@@ -0,0 +1,116 @@
+package cli
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// importProgressRows is how often ImportCSV reports its progress.
+const importProgressRows = 100
+
+var csvColumns = []string{"id", "username", "email"}
+
+/*
+ImportCSV inserts the rows of a CSV file and returns how many it inserted.
+If the first record names the columns, they may come in any order, otherwise
+they must be id, username, email. The file is read as a stream and bulk
+loaded, so a file sorted by id is packed into leaves directly. The rows are
+inserted like a single statement, a bad record leaves the table untouched.
+*/
+func ImportCSV(ctx context.Context, table *db.Table, filename string, progress io.Writer) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rows := &csvRows{r: csv.NewReader(f), order: []int{0, 1, 2}, progress: progress}
+	rows.r.FieldsPerRecord = len(csvColumns)
+	n, err := table.BulkLoad(ctx, rows.next)
+	if err != nil && !rows.failed {
+		// The row from the last line read could not be inserted.
+		return 0, fmt.Errorf("line %d: %w", rows.line, err)
+	}
+	return n, err
+}
+
+// csvRows reads the rows of a CSV file for Table.BulkLoad.
+type csvRows struct {
+	r        *csv.Reader
+	order    []int // Position of each column in a record.
+	progress io.Writer
+	line     int
+	n        int
+	failed   bool // Whether the file itself was bad.
+}
+
+func (c *csvRows) next() (types.Row, error) {
+	row, err := c.read()
+	if err != nil && !errors.Is(err, io.EOF) {
+		c.failed = true
+	}
+	return row, err
+}
+
+func (c *csvRows) read() (types.Row, error) {
+	for {
+		c.line++
+		record, err := c.r.Read()
+		if errors.Is(err, io.EOF) {
+			return types.Row{}, io.EOF
+		}
+		if err != nil {
+			return types.Row{}, err
+		}
+		if c.line == 1 && slices.Contains(csvColumns, strings.ToLower(strings.TrimSpace(record[0]))) {
+			for i, name := range record {
+				index := slices.Index(csvColumns, strings.ToLower(strings.TrimSpace(name)))
+				if index < 0 || slices.Contains(c.order[:i], index) {
+					return types.Row{}, fmt.Errorf("line 1: expected the columns %s, but got %s", strings.Join(csvColumns, ","), strings.Join(record, ","))
+				}
+				c.order[i] = index
+			}
+			continue
+		}
+
+		row, err := csvRow(record, c.order)
+		if err != nil {
+			return types.Row{}, fmt.Errorf("line %d: %w", c.line, err)
+		}
+		c.n++
+		if c.n%importProgressRows == 0 {
+			fmt.Fprintf(c.progress, "%d rows imported\n", c.n)
+		}
+		return row, nil
+	}
+}
+
+// csvRow returns the row of a record whose fields are in the given column order.
+func csvRow(record []string, order []int) (types.Row, error) {
+	values := make([]string, len(csvColumns))
+	for i, field := range record {
+		values[order[i]] = field
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(values[0]), 10, 32)
+	if err != nil {
+		return types.Row{}, fmt.Errorf("invalid id %q", values[0])
+	}
+	if len(values[1]) > int(constants.UsernameSize) || len(values[2]) > int(constants.EmailSize) {
+		return types.Row{}, fmt.Errorf("string is too long")
+	}
+	row := types.Row{Id: uint32(id)}
+	copy(row.Username[:], values[1])
+	copy(row.Email[:], values[2])
+	return row, nil
+}
@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// Dump writes a script of insert statements that recreates the rows of the
+// table when it is run against an empty database. The inserts are wrapped in
+// a transaction, so replaying them commits once. A partitioned table is
+// partitioned first, the indexes created, the generated columns added and the
+// collations set, outside the transaction. Rows with a box in the spatial
+// index are inserted at it, and rows with a ttl get the seconds they have
+// left, rows that expired are left out. The unique and descending indexes and
+// the materialized views are created after the commit, from the rows.
+func Dump(ctx context.Context, table *db.Table, w io.Writer) error {
+	partitions, err := table.Partitions()
+	if err != nil {
+		return err
+	}
+	if len(partitions) > 1 {
+		bounds := []string{}
+		for _, partition := range partitions[1:] {
+			bounds = append(bounds, fmt.Sprint(partition.From))
+		}
+		if _, err := fmt.Fprintf(w, "partition by range (id) (%s);\n", strings.Join(bounds, ", ")); err != nil {
+			return err
+		}
+	}
+	if columns := table.FulltextColumns(); len(columns) > 0 {
+		if _, err := fmt.Fprintf(w, "create fulltext index on %s;\n", strings.Join(columns, ", ")); err != nil {
+			return err
+		}
+	}
+	if table.HasSpatialIndex() {
+		if _, err := fmt.Fprintln(w, "create spatial index;"); err != nil {
+			return err
+		}
+	}
+	for _, column := range table.Schema() {
+		if column.Generated == "" {
+			continue
+		}
+		stored := ""
+		if column.Stored {
+			stored = " stored"
+		}
+		if _, err := fmt.Fprintf(w, "add column %s as (%s)%s;\n", column.Name, column.Generated, stored); err != nil {
+			return err
+		}
+	}
+	for _, column := range table.Schema() {
+		if column.Collation == "" {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "alter column %s collate %s;\n", column.Name, column.Collation); err != nil {
+			return err
+		}
+	}
+	boxes, err := table.Boxes(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(w, "begin;"); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	err = table.Scan(ctx, func(row types.Row) error {
+		username := string(bytes.Trim(row.Username[:], "\x00"))
+		email := string(bytes.Trim(row.Email[:], "\x00"))
+		ttl := ""
+		if row.ExpiresAt != 0 {
+			if row.ExpiresAt <= now {
+				return nil
+			}
+			ttl = fmt.Sprintf(" ttl %d", row.ExpiresAt-now)
+		}
+		at := ""
+		if box, ok := boxes[row.Id]; ok {
+			at = fmt.Sprintf(" at (%g, %g, %g, %g)", box.MinX, box.MinY, box.MaxX, box.MaxY)
+		}
+		_, err := fmt.Fprintf(w, "insert %d %s %s%s%s;\n", row.Id, parser.Quote(username), parser.Quote(email), ttl, at)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(w, "commit;"); err != nil {
+		return err
+	}
+	if column, collation, ok := table.UniqueIndex(); ok {
+		if _, err := fmt.Fprintf(w, "create unique index on %s collate %s;\n", column, collation); err != nil {
+			return err
+		}
+	}
+	if table.HasDescendingIndex() {
+		if _, err := fmt.Fprintln(w, "create index on id desc;"); err != nil {
+			return err
+		}
+	}
+	if column, ok := table.OrderedIndex(); ok {
+		if _, err := fmt.Fprintf(w, "create index on %s;\n", column); err != nil {
+			return err
+		}
+	}
+	for _, view := range table.Views() {
+		onCommit := ""
+		if view.OnCommit {
+			onCommit = " refresh on commit"
+		}
+		if _, err := fmt.Fprintf(w, "create materialized view %s as %s%s;\n", view.Name, view.Query, onCommit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
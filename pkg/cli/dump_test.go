@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func openTestTable(t *testing.T) *db.Table {
+	table, err := db.Open(db.MemoryDbName)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	t.Cleanup(func() { table.Close() })
+	return table
+}
+
+// run executes the statements of a script, one per line.
+func run(t *testing.T, table *db.Table, script string) {
+	for _, line := range strings.Split(script, "\n") {
+		if line = CleanInput(line); line == "" {
+			continue
+		}
+		stmt, err := parser.Parse(line)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", line, err)
+		}
+		if _, err := table.Execute(context.Background(), stmt, func([]any) error { return nil }); err != nil {
+			t.Fatalf("%s failed: %v", line, err)
+		}
+	}
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	table := openTestTable(t)
+	run(t, table, `create spatial index
+insert 1 alice 'a b@example.com'
+insert 2 bob b@example.com ttl 3600
+insert 4 dave d@example.com ttl 600 at (1, 2, 3, 4)
+create unique index on username collate nocase
+create index on id desc`)
+	// A row that expired an hour ago, inserted at the time of an old log entry.
+	stmt, _ := parser.Parse("insert 3 carol c@example.com ttl 60")
+	if _, err := table.ApplyEntry(ctx, 1, time.Now().Add(-time.Hour), stmt); err != nil {
+		t.Fatalf("Failed to insert the expired row: %v", err)
+	}
+
+	var dump bytes.Buffer
+	if err := Dump(ctx, table, &dump); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(dump.String()), "\n")
+	if len(lines) != 8 || !strings.HasPrefix(lines[3], "insert 2 'bob' 'b@example.com' ttl 3") || !strings.Contains(lines[4], " at (1, 2, 3, 4);") {
+		t.Fatalf("Expected the rows with their ttls and boxes, without the expired one. Got: %q", lines)
+	}
+
+	replayed := openTestTable(t)
+	run(t, replayed, dump.String())
+	rows := map[uint32]types.Row{}
+	replayed.Scan(ctx, func(row types.Row) error {
+		rows[row.Id] = row
+		return nil
+	})
+	now := time.Now().Unix()
+	if len(rows) != 3 || rows[1].ExpiresAt != 0 || rows[2].ExpiresAt < now+3598 || rows[4].ExpiresAt > now+600 {
+		t.Fatalf("Expected rows 1, 2 and 4 with the time left on their ttls. Got: %+v", rows)
+	}
+	if boxes, _ := replayed.Boxes(ctx); fmt.Sprint(boxes[4]) != fmt.Sprint(types.Box{MinX: 1, MinY: 2, MaxX: 3, MaxY: 4}) {
+		t.Fatalf("Expected row 4 at its box. Got: %v", boxes)
+	}
+	if column, collation, ok := replayed.UniqueIndex(); !ok || column != "username" || collation != "nocase" {
+		t.Fatalf("Expected the unique index to be recreated. Got: %s %s %v", column, collation, ok)
+	}
+	if !replayed.HasDescendingIndex() {
+		t.Fatalf("Expected the descending index to be recreated")
+	}
+}
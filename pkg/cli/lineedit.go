@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// LineReader reads the lines typed into the REPL. On a terminal it edits the line itself so tab
+// can complete words, otherwise it reads plain lines.
+type LineReader struct {
+	in       *bufio.Reader
+	out      io.Writer
+	term     *os.File // Nil if the input is not a terminal.
+	prompt   string
+	complete Completer
+}
+
+func NewLineReader(in *os.File, out io.Writer, prompt string, complete Completer) *LineReader {
+	r := &LineReader{in: bufio.NewReader(in), out: out, prompt: prompt, complete: complete}
+	if isTerminal(in) {
+		r.term = in
+	}
+	return r
+}
+
+// ReadLine returns the next line without its line ending. It returns io.EOF at the end of the
+// input, or when ctrl-D is typed on an empty line.
+func (r *LineReader) ReadLine() (string, error) {
+	if r.term == nil {
+		line, err := r.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	restore, err := enableRawMode(r.term)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+	var line []byte
+	for {
+		b, err := r.in.ReadByte()
+		if err != nil {
+			return string(line), err
+		}
+		switch {
+		case b == '\r' || b == '\n':
+			fmt.Fprint(r.out, "\n")
+			return string(line), nil
+		case b == 4: // ctrl-D.
+			if len(line) == 0 {
+				fmt.Fprint(r.out, "\n")
+				return "", io.EOF
+			}
+		case b == 21: // ctrl-U clears the line.
+			fmt.Fprint(r.out, strings.Repeat("\b \b", utf8.RuneCount(line)))
+			line = line[:0]
+		case b == 127 || b == '\b':
+			if len(line) > 0 {
+				_, size := utf8.DecodeLastRune(line)
+				line = line[:len(line)-size]
+				fmt.Fprint(r.out, "\b \b")
+			}
+		case b == '\t':
+			line = r.completeLine(line)
+		case b == 27: // Escape sequences of arrow and function keys are not supported.
+			r.skipEscapeSequence()
+		case b >= ' ':
+			line = append(line, b)
+			r.out.Write([]byte{b})
+		}
+	}
+}
+
+// Interactive reports whether the lines are typed into a terminal.
+func (r *LineReader) Interactive() bool {
+	return r.term != nil
+}
+
+// ReadKey waits for a single key press. It must only be called if the input is a terminal.
+func (r *LineReader) ReadKey() (byte, error) {
+	restore, err := enableRawMode(r.term)
+	if err != nil {
+		return 0, err
+	}
+	defer restore()
+	return r.in.ReadByte()
+}
+
+// completeLine extends the last word of line as far as all candidates agree. If that does not
+// extend it, the candidates are listed below the line.
+func (r *LineReader) completeLine(line []byte) []byte {
+	text := string(line)
+	candidates := r.complete(text)
+	if len(candidates) == 0 {
+		return line
+	}
+	prefix := text[strings.LastIndexAny(text, " \t(,")+1:]
+	common := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(candidates) == 1 {
+		common += " "
+	}
+	if len(common) > len(prefix) {
+		fmt.Fprint(r.out, common[len(prefix):])
+		return append(line, common[len(prefix):]...)
+	}
+	fmt.Fprintf(r.out, "\n%s\n%s%s", strings.Join(candidates, "  "), r.prompt, line)
+	return line
+}
+
+// skipEscapeSequence consumes a CSI sequence such as ESC [ A, whose ESC has already been read.
+func (r *LineReader) skipEscapeSequence() {
+	if b, err := r.in.ReadByte(); err != nil || b != '[' {
+		return
+	}
+	for {
+		b, err := r.in.ReadByte()
+		if err != nil || (b >= 0x40 && b <= 0x7e) {
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// ExportNDJSON writes every row of the table to filename as a JSON object on
+// its own line, like .mode json prints them, and returns how many it wrote.
+// The rows are streamed from the scan through a buffered writer, so memory
+// use does not grow with the table. An existing file is replaced.
+func ExportNDJSON(ctx context.Context, table *db.Table, filename string) (int, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	out := NewJSONWriter(w)
+	columns := []string{}
+	for _, column := range db.Schema() {
+		columns = append(columns, column.Name)
+	}
+	if err := out.WriteHeader(columns); err != nil {
+		return 0, err
+	}
+	n := 0
+	err = table.Scan(ctx, func(row types.Row) error {
+		n++
+		return out.WriteRow([]any{
+			int64(row.Id),
+			string(bytes.Trim(row.Username[:], "\x00")),
+			string(bytes.Trim(row.Email[:], "\x00")),
+		})
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, f.Close()
+}
@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// ResultWriter prints the rows a statement returns.
+type ResultWriter interface {
+	WriteHeader(columns []string) error
+	WriteRow(values []any) error
+	Flush() error // Called once the statement is done.
+}
+
+// NewResultWriter returns the ResultWriter for an output mode: tuple, table, csv or json.
+func NewResultWriter(mode string, w io.Writer) (ResultWriter, error) {
+	switch mode {
+	case "tuple":
+		return NewTupleWriter(w), nil
+	case "table":
+		return NewTableWriter(w), nil
+	case "csv":
+		return NewCSVWriter(w), nil
+	case "json":
+		return NewJSONWriter(w), nil
+	}
+	return nil, fmt.Errorf("unknown mode %s, expected tuple, table, csv or json", mode)
+}
+
+// NewTupleWriter returns a ResultWriter printing every row as (1, user1, email).
+func NewTupleWriter(w io.Writer) ResultWriter {
+	return &tupleWriter{w: w}
+}
+
+type tupleWriter struct {
+	w io.Writer
+}
+
+func (t *tupleWriter) WriteHeader(columns []string) error {
+	return nil
+}
+
+func (t *tupleWriter) WriteRow(values []any) error {
+	strs := make([]string, len(values))
+	for i, value := range values {
+		if value == nil {
+			strs[i] = "NULL"
+		} else {
+			strs[i] = fmt.Sprint(value)
+		}
+	}
+	_, err := fmt.Fprintf(t.w, "(%s)\n", strings.Join(strs, ", "))
+	return err
+}
+
+func (t *tupleWriter) Flush() error {
+	return nil
+}
+
+// tableMaxColumnWidth is the width at which values are truncated in table mode.
+const tableMaxColumnWidth = 40
+
+// NewTableWriter returns a ResultWriter printing the rows as an aligned ASCII table with a
+// header. The rows are held until Flush, which knows how wide every column has to be.
+func NewTableWriter(w io.Writer) ResultWriter {
+	return &tableWriter{w: w}
+}
+
+type tableWriter struct {
+	w       io.Writer
+	columns []string
+	rows    [][]string
+	numeric []bool // Whether a column holds numbers, which are aligned right.
+}
+
+func (t *tableWriter) WriteHeader(columns []string) error {
+	t.columns = columns
+	t.numeric = make([]bool, len(columns))
+	return nil
+}
+
+func (t *tableWriter) WriteRow(values []any) error {
+	row := make([]string, len(values))
+	for i, value := range values {
+		switch value := value.(type) {
+		case nil:
+			row[i] = "NULL"
+		case int64:
+			row[i] = fmt.Sprint(value)
+			t.numeric[i] = true
+		default:
+			row[i] = truncate(fmt.Sprint(value), tableMaxColumnWidth)
+		}
+	}
+	t.rows = append(t.rows, row)
+	return nil
+}
+
+func (t *tableWriter) Flush() error {
+	defer func() { t.columns, t.rows = nil, nil }()
+	if t.columns == nil {
+		return nil
+	}
+	widths := make([]int, len(t.columns))
+	for _, row := range append([][]string{t.columns}, t.rows...) {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	var sb strings.Builder
+	separator := func() {
+		for _, width := range widths {
+			sb.WriteString("+" + strings.Repeat("-", width+2))
+		}
+		sb.WriteString("+\n")
+	}
+	line := func(row []string, alignNumbers bool) {
+		for i, cell := range row {
+			padding := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+			if alignNumbers && t.numeric[i] {
+				sb.WriteString("| " + padding + cell + " ")
+			} else {
+				sb.WriteString("| " + cell + padding + " ")
+			}
+		}
+		sb.WriteString("|\n")
+	}
+	separator()
+	line(t.columns, false)
+	separator()
+	for _, row := range t.rows {
+		line(row, true)
+	}
+	separator()
+	_, err := io.WriteString(t.w, sb.String())
+	return err
+}
+
+// truncate shortens s to at most width characters, marking the cut with an ellipsis.
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	return string([]rune(s)[:width-3]) + "..."
+}
+
+// NewCSVWriter returns a ResultWriter printing RFC 4180 CSV with a header record.
+// NULL is written as an empty field.
+func NewCSVWriter(w io.Writer) ResultWriter {
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = true
+	return &csvWriter{w: cw}
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) WriteHeader(columns []string) error {
+	return c.w.Write(columns)
+}
+
+func (c *csvWriter) WriteRow(values []any) error {
+	record := make([]string, len(values))
+	for i, value := range values {
+		if value != nil {
+			record[i] = fmt.Sprint(value)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// NewJSONWriter returns a ResultWriter printing every row as a JSON object on
+// its own line, with the keys in column order.
+func NewJSONWriter(w io.Writer) ResultWriter {
+	return &jsonWriter{w: w}
+}
+
+type jsonWriter struct {
+	w       io.Writer
+	columns []string
+}
+
+func (j *jsonWriter) WriteHeader(columns []string) error {
+	j.columns = columns
+	return nil
+}
+
+func (j *jsonWriter) WriteRow(values []any) error {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, value := range values {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		key, err := json.Marshal(j.columns[i])
+		if err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		sb.Write(key)
+		sb.WriteByte(':')
+		sb.Write(encoded)
+	}
+	sb.WriteString("}\n")
+	_, err := io.WriteString(j.w, sb.String())
+	return err
+}
+
+func (j *jsonWriter) Flush() error {
+	return nil
+}
@@ -0,0 +1,142 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// ErrPagerQuit is returned by writes to a Pager once the user quit it, which aborts the statement.
+var ErrPagerQuit = errors.New("output aborted")
+
+// defaultPagerHeight is used when the height of the terminal is unknown.
+const defaultPagerHeight = 24
+
+/*
+Pager shows output a screen at a time. Output that fits on one screen is
+written as is. Longer output is piped into $PAGER if it is set, otherwise
+--More-- is shown after every screen: space shows the next screen, enter the
+next line and q quits.
+*/
+type Pager struct {
+	out     io.Writer
+	keys    *LineReader
+	height  int    // Lines per screen.
+	command string // $PAGER.
+	lines   int    // Lines shown since the last prompt.
+	buf     []byte // Output held back until it is known whether $PAGER is needed.
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser // Of the $PAGER command once it runs.
+	quit    bool
+}
+
+// NewPager returns a Pager writing to the terminal out, which reads keys from keys.
+func NewPager(out *os.File, keys *LineReader) *Pager {
+	height := terminalHeight(out)
+	if height <= 1 {
+		height = defaultPagerHeight
+	}
+	return &Pager{out: out, keys: keys, height: height, command: os.Getenv("PAGER")}
+}
+
+func (p *Pager) Write(b []byte) (int, error) {
+	if p.quit {
+		return 0, ErrPagerQuit
+	}
+	if p.stdin != nil {
+		n, err := p.stdin.Write(b)
+		if err != nil {
+			// The pager exited before reading everything, because the user quit it.
+			p.quit = true
+			return n, ErrPagerQuit
+		}
+		return n, nil
+	}
+	if p.command != "" {
+		p.buf = append(p.buf, b...)
+		if bytes.Count(p.buf, []byte("\n")) >= p.height {
+			if err := p.startCommand(); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	written := 0
+	for len(b) > 0 {
+		if p.lines >= p.height-1 {
+			if err := p.prompt(); err != nil {
+				return written, err
+			}
+		}
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = b[:i+1]
+			p.lines++
+		}
+		n, err := p.out.Write(line)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(line):]
+	}
+	return written, nil
+}
+
+// startCommand runs $PAGER and hands it the output held back so far.
+func (p *Pager) startCommand() error {
+	p.cmd = exec.Command("sh", "-c", p.command)
+	p.cmd.Stdout = p.out
+	p.cmd.Stderr = os.Stderr
+	stdin, err := p.cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := p.cmd.Start(); err != nil {
+		return fmt.Errorf("error starting pager %s: %w", p.command, err)
+	}
+	p.stdin = stdin
+	buf := p.buf
+	p.buf = nil
+	_, err = p.Write(buf)
+	return err
+}
+
+// prompt waits for the key deciding how much more to show.
+func (p *Pager) prompt() error {
+	for {
+		fmt.Fprint(p.out, "--More--")
+		key, err := p.keys.ReadKey()
+		fmt.Fprint(p.out, "\r        \r")
+		if err != nil {
+			return err
+		}
+		switch key {
+		case ' ':
+			p.lines = 0
+			return nil
+		case '\r', '\n':
+			p.lines--
+			return nil
+		case 'q', 'Q':
+			p.quit = true
+			return ErrPagerQuit
+		}
+	}
+}
+
+// Close writes output that was held back, or waits for $PAGER to exit.
+func (p *Pager) Close() error {
+	if p.stdin != nil {
+		p.stdin.Close()
+		if err := p.cmd.Wait(); err != nil && !p.quit {
+			return fmt.Errorf("pager %s failed: %w", p.command, err)
+		}
+		return nil
+	}
+	_, err := p.out.Write(p.buf)
+	return err
+}
@@ -0,0 +1,259 @@
+package cli
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+Parquet files.
+
+A result is written as a single row group with one uncompressed data page per
+column. Integers are INT64 and text is BYTE_ARRAY annotated as UTF8, both
+PLAIN encoded. Every column is OPTIONAL, as min and max of no rows are NULL,
+so each page starts with the definition levels, 1 for a value and 0 for NULL,
+and only holds the values that are not NULL. The metadata in the footer is
+encoded with the Thrift compact protocol.
+
+See https://parquet.apache.org/docs/file-format/ for the layout.
+*/
+
+var parquetMagic = []byte("PAR1")
+
+// Parquet physical types, encodings and other enum values the writer uses.
+const (
+	parquetInt64        = 2
+	parquetByteArray    = 6
+	parquetOptional     = 1
+	parquetUTF8         = 0
+	parquetPlain        = 0
+	parquetRLE          = 3
+	parquetUncompressed = 0
+	parquetDataPage     = 0
+)
+
+// NewParquetWriter returns a ResultWriter writing the rows to w as a Parquet
+// file. columnTypes are integer or text, one for each column. The file is
+// columnar, so the rows are held until Flush writes it.
+func NewParquetWriter(w io.Writer, columnTypes []string) ResultWriter {
+	return &parquetWriter{w: w, types: columnTypes}
+}
+
+type parquetWriter struct {
+	w       io.Writer
+	types   []string
+	columns []string
+	rows    [][]any
+}
+
+func (p *parquetWriter) WriteHeader(columns []string) error {
+	p.columns = columns
+	return nil
+}
+
+func (p *parquetWriter) WriteRow(values []any) error {
+	p.rows = append(p.rows, values)
+	return nil
+}
+
+func (p *parquetWriter) Flush() error {
+	out := append([]byte(nil), parquetMagic...)
+	schema := [][]byte{(&thriftStruct{}).
+		binary(4, "schema").
+		i32(5, int32(len(p.columns))).
+		end()}
+	var chunks [][]byte
+	for i, name := range p.columns {
+		physical := int32(parquetInt64)
+		element := &thriftStruct{}
+		if p.types[i] == "text" {
+			physical = parquetByteArray
+		}
+		element.i32(1, physical).i32(3, parquetOptional).binary(4, name)
+		if physical == parquetByteArray {
+			element.i32(6, parquetUTF8)
+		}
+		schema = append(schema, element.end())
+
+		page, err := p.page(i, physical)
+		if err != nil {
+			return err
+		}
+		header := (&thriftStruct{}).
+			i32(1, parquetDataPage).
+			i32(2, int32(len(page))).
+			i32(3, int32(len(page))).
+			structField(5, (&thriftStruct{}).
+				i32(1, int32(len(p.rows))).
+				i32(2, parquetPlain).
+				i32(3, parquetRLE).
+				i32(4, parquetRLE).
+				end()).
+			end()
+		offset := int64(len(out))
+		out = append(out, header...)
+		out = append(out, page...)
+		size := int64(len(header) + len(page))
+		metadata := (&thriftStruct{}).
+			i32(1, physical).
+			list(2, thriftI32, thriftI32s(parquetPlain, parquetRLE)).
+			list(3, thriftBinary, [][]byte{thriftString(name)}).
+			i32(4, parquetUncompressed).
+			i64(5, int64(len(p.rows))).
+			i64(6, size).
+			i64(7, size).
+			i64(9, offset).
+			end()
+		chunks = append(chunks, (&thriftStruct{}).i64(2, offset).structField(3, metadata).end())
+	}
+
+	// A result without rows has no row group.
+	var rowGroups [][]byte
+	if len(p.rows) > 0 {
+		total := int64(len(out) - len(parquetMagic))
+		rowGroups = append(rowGroups, (&thriftStruct{}).
+			list(1, thriftStructType, chunks).
+			i64(2, total).
+			i64(3, int64(len(p.rows))).
+			end())
+	} else {
+		out = out[:len(parquetMagic)]
+	}
+	footer := (&thriftStruct{}).
+		i32(1, 1).
+		list(2, thriftStructType, schema).
+		i64(3, int64(len(p.rows))).
+		list(4, thriftStructType, rowGroups).
+		end()
+	out = append(out, footer...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(footer)))
+	out = append(out, parquetMagic...)
+	p.rows = nil
+	_, err := p.w.Write(out)
+	return err
+}
+
+// page returns the data of the page holding column i: the definition levels
+// as runs of the RLE hybrid encoding with bit width 1, prefixed by their
+// length, then the values that are not NULL.
+func (p *parquetWriter) page(i int, physical int32) ([]byte, error) {
+	var levels, values []byte
+	for start := 0; start < len(p.rows); {
+		defined := p.rows[start][i] != nil
+		end := start + 1
+		for end < len(p.rows) && (p.rows[end][i] != nil) == defined {
+			end++
+		}
+		levels = binary.AppendUvarint(levels, uint64(end-start)<<1)
+		if defined {
+			levels = append(levels, 1)
+		} else {
+			levels = append(levels, 0)
+		}
+		start = end
+	}
+	for _, row := range p.rows {
+		switch v := row[i].(type) {
+		case nil:
+		case int64:
+			if physical != parquetInt64 {
+				return nil, fmt.Errorf("column %s: expected text, but got %d", p.columns[i], v)
+			}
+			values = binary.LittleEndian.AppendUint64(values, uint64(v))
+		case string:
+			if physical != parquetByteArray {
+				return nil, fmt.Errorf("column %s: expected an integer, but got %q", p.columns[i], v)
+			}
+			values = binary.LittleEndian.AppendUint32(values, uint32(len(v)))
+			values = append(values, v...)
+		default:
+			return nil, fmt.Errorf("column %s: unsupported value %T", p.columns[i], v)
+		}
+	}
+	page := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+	page = append(page, levels...)
+	return append(page, values...), nil
+}
+
+// Thrift compact protocol type ids.
+const (
+	thriftI32        = 5
+	thriftI64        = 6
+	thriftBinary     = 8
+	thriftList       = 9
+	thriftStructType = 12
+)
+
+// thriftStruct encodes a struct with the Thrift compact protocol. Fields must
+// be added in increasing id order, end terminates the struct.
+type thriftStruct struct {
+	b    []byte
+	last int16 // Id of the previous field, field headers store the difference.
+}
+
+func (s *thriftStruct) field(id int16, typ byte) {
+	if delta := id - s.last; delta > 0 && delta <= 15 {
+		s.b = append(s.b, byte(delta)<<4|typ)
+	} else {
+		s.b = append(s.b, typ)
+		s.b = binary.AppendVarint(s.b, int64(id))
+	}
+	s.last = id
+}
+
+func (s *thriftStruct) i32(id int16, v int32) *thriftStruct {
+	s.field(id, thriftI32)
+	s.b = binary.AppendVarint(s.b, int64(v)) // Zigzag, like Thrift.
+	return s
+}
+
+func (s *thriftStruct) i64(id int16, v int64) *thriftStruct {
+	s.field(id, thriftI64)
+	s.b = binary.AppendVarint(s.b, v)
+	return s
+}
+
+func (s *thriftStruct) binary(id int16, v string) *thriftStruct {
+	s.field(id, thriftBinary)
+	s.b = append(s.b, thriftString(v)...)
+	return s
+}
+
+// structField adds a struct encoded by another thriftStruct.
+func (s *thriftStruct) structField(id int16, encoded []byte) *thriftStruct {
+	s.field(id, thriftStructType)
+	s.b = append(s.b, encoded...)
+	return s
+}
+
+// list adds a list of already encoded elements of type elemType.
+func (s *thriftStruct) list(id int16, elemType byte, elems [][]byte) *thriftStruct {
+	s.field(id, thriftList)
+	if len(elems) < 15 {
+		s.b = append(s.b, byte(len(elems))<<4|elemType)
+	} else {
+		s.b = append(s.b, 0xf0|elemType)
+		s.b = binary.AppendUvarint(s.b, uint64(len(elems)))
+	}
+	for _, elem := range elems {
+		s.b = append(s.b, elem...)
+	}
+	return s
+}
+
+func (s *thriftStruct) end() []byte {
+	return append(s.b, 0)
+}
+
+func thriftString(v string) []byte {
+	return append(binary.AppendUvarint(nil, uint64(len(v))), v...)
+}
+
+func thriftI32s(values ...int32) [][]byte {
+	elems := [][]byte{}
+	for _, v := range values {
+		elems = append(elems, binary.AppendVarint(nil, int64(v)))
+	}
+	return elems
+}
@@ -0,0 +1,626 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+SQLite files.
+
+The schema is fixed, so a SQLite database holding the table needs only two
+B-trees: sqlite_master on page 1 with the CREATE TABLE statement, and the
+table itself, keyed by rowid. The id column is declared INTEGER PRIMARY KEY,
+which makes it the rowid, so records store NULL for it and the id lives in
+the cell key. Rows are far smaller than a page, so no exported cell ever
+overflows. Files written by SQLite itself can have overflow pages, interior
+pages on page 1 and more columns, which the import handles.
+
+See https://www.sqlite.org/fileformat.html for the layout.
+*/
+
+const (
+	sqlitePageSize       = 4096
+	sqliteFileHeaderSize = 100
+	sqliteLeafTable      = 0x0d // Page type of a table leaf.
+	sqliteInteriorTable  = 0x05 // Page type of a table interior page.
+	sqliteVersionNumber  = 3045000
+)
+
+var sqliteMagic = []byte("SQLite format 3\x00")
+
+// sqliteCreateTable returns the statement sqlite_master records for the table.
+func sqliteCreateTable() string {
+	columns := []string{}
+	for _, column := range db.Schema() {
+		definition := column.Name + " " + strings.ToUpper(column.Type)
+		if column.PrimaryKey {
+			definition += " PRIMARY KEY"
+		}
+		columns = append(columns, definition)
+	}
+	return fmt.Sprintf("CREATE TABLE %s(%s)", db.TableName, strings.Join(columns, ", "))
+}
+
+/*
+ExportSQLite writes the rows of the table into filename as a SQLite database
+and returns how many it wrote. An existing file is replaced. The leaves are
+filled in id order as the rows are scanned and the interior levels are built
+on top of them once the scan is done.
+*/
+func ExportSQLite(ctx context.Context, table *db.Table, filename string) (int, error) {
+	pages := [][]byte{nil} // Page 1, sqlite_master, is written last.
+	level := []sqliteChild{}
+	leaf := sqliteNode{}
+	flush := func() {
+		pages = append(pages, leaf.page(sqliteLeafTable, 0, 0))
+		level = append(level, sqliteChild{pageNum: uint32(len(pages)), maxKey: leaf.maxKey})
+		leaf = sqliteNode{}
+	}
+	n := 0
+	err := table.Scan(ctx, func(row types.Row) error {
+		username := string(bytes.TrimRight(row.Username[:], "\x00"))
+		email := string(bytes.TrimRight(row.Email[:], "\x00"))
+		cell := sqliteLeafCell(int64(row.Id), sqliteRecord(nil, username, email))
+		if !leaf.fits(cell, 0) {
+			flush()
+		}
+		leaf.add(cell, int64(row.Id))
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(leaf.cells) > 0 || len(level) == 0 {
+		flush()
+	}
+
+	// Each interior level points at the one below until a single root is left.
+	for len(level) > 1 {
+		var parents []sqliteChild
+		node := sqliteNode{}
+		for i, child := range level {
+			if i < len(level)-1 {
+				cell := sqliteInteriorCell(child.pageNum, child.maxKey)
+				if node.fits(cell, 4) {
+					node.add(cell, child.maxKey)
+					continue
+				}
+			}
+			// The child that did not fit becomes the right-most pointer.
+			pages = append(pages, node.page(sqliteInteriorTable, child.pageNum, 0))
+			parents = append(parents, sqliteChild{pageNum: uint32(len(pages)), maxKey: child.maxKey})
+			node = sqliteNode{}
+		}
+		level = parents
+	}
+
+	master := sqliteNode{}
+	record := sqliteRecord("table", db.TableName, db.TableName, int64(level[0].pageNum), sqliteCreateTable())
+	master.add(sqliteLeafCell(1, record), 1)
+	pages[0] = master.page(sqliteLeafTable, 0, sqliteFileHeaderSize)
+	copy(pages[0], sqliteFileHeader(len(pages)))
+
+	if err := os.WriteFile(filename, bytes.Join(pages, nil), 0666); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// sqliteFileHeader returns the header at the start of page 1 for a file of numPages pages.
+func sqliteFileHeader(numPages int) []byte {
+	header := make([]byte, sqliteFileHeaderSize)
+	copy(header, sqliteMagic)
+	binary.BigEndian.PutUint16(header[16:], sqlitePageSize)
+	header[18], header[19] = 1, 1 // Rollback journal, not WAL.
+	header[21], header[22], header[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(header[24:], 1) // File change counter.
+	binary.BigEndian.PutUint32(header[28:], uint32(numPages))
+	binary.BigEndian.PutUint32(header[40:], 1) // Schema cookie.
+	binary.BigEndian.PutUint32(header[44:], 4) // Schema format.
+	binary.BigEndian.PutUint32(header[56:], 1) // UTF-8.
+	binary.BigEndian.PutUint32(header[92:], 1) // Version-valid-for, matches the change counter.
+	binary.BigEndian.PutUint32(header[96:], sqliteVersionNumber)
+	return header
+}
+
+// sqliteChild is a page of one level of the table B-tree and the largest rowid under it.
+type sqliteChild struct {
+	pageNum uint32
+	maxKey  int64
+}
+
+// sqliteNode collects the cells of a B-tree page.
+type sqliteNode struct {
+	cells  [][]byte
+	size   int // Bytes the cells and their pointers take up.
+	maxKey int64
+}
+
+// fits reports whether the page has room for cell, with extraHeader bytes of
+// page header beyond the 8 every page has.
+func (s *sqliteNode) fits(cell []byte, extraHeader int) bool {
+	return 8+extraHeader+s.size+2+len(cell) <= sqlitePageSize
+}
+
+func (s *sqliteNode) add(cell []byte, key int64) {
+	s.cells = append(s.cells, cell)
+	s.size += 2 + len(cell)
+	s.maxKey = key
+}
+
+// page lays out the cells as a page of the given type. The page header starts
+// at headerOffset, which is only non-zero for page 1. Cells are packed at the
+// end of the page in reverse order, their pointers follow the header.
+func (s *sqliteNode) page(pageType byte, rightChild uint32, headerOffset int) []byte {
+	page := make([]byte, sqlitePageSize)
+	header := page[headerOffset:]
+	header[0] = pageType
+	binary.BigEndian.PutUint16(header[3:], uint16(len(s.cells)))
+	pointers := header[8:]
+	if pageType == sqliteInteriorTable {
+		binary.BigEndian.PutUint32(header[8:], rightChild)
+		pointers = header[12:]
+	}
+	end := sqlitePageSize
+	for i, cell := range s.cells {
+		end -= len(cell)
+		copy(page[end:], cell)
+		binary.BigEndian.PutUint16(pointers[2*i:], uint16(end))
+	}
+	// A content area starting at 65536 is stored as 0, which is never the case with 4096 byte pages.
+	binary.BigEndian.PutUint16(header[5:], uint16(end))
+	return page
+}
+
+func sqliteLeafCell(rowid int64, record []byte) []byte {
+	cell := appendSqliteVarint(nil, uint64(len(record)))
+	cell = appendSqliteVarint(cell, uint64(rowid))
+	return append(cell, record...)
+}
+
+func sqliteInteriorCell(child uint32, maxKey int64) []byte {
+	cell := binary.BigEndian.AppendUint32(nil, child)
+	return appendSqliteVarint(cell, uint64(maxKey))
+}
+
+// sqliteRecord encodes values, each nil, int64 or string, in the record format:
+// a header of serial types, then the values in the same order.
+func sqliteRecord(values ...any) []byte {
+	var serialTypes, body []byte
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+			serialTypes = appendSqliteVarint(serialTypes, 0)
+		case int64:
+			// Always 8 bytes, SQLite reads any integer width.
+			serialTypes = appendSqliteVarint(serialTypes, 6)
+			body = binary.BigEndian.AppendUint64(body, uint64(v))
+		case string:
+			serialTypes = appendSqliteVarint(serialTypes, uint64(2*len(v)+13))
+			body = append(body, v...)
+		default:
+			panic(fmt.Sprintf("unsupported record value %T", value))
+		}
+	}
+	// The header size counts itself. Records here have a handful of columns, so it takes one byte.
+	record := appendSqliteVarint(nil, uint64(len(serialTypes)+1))
+	record = append(record, serialTypes...)
+	return append(record, body...)
+}
+
+// appendSqliteVarint appends v as a big-endian varint of 7-bit groups. Values
+// of 2^56 and above, which need the 9-byte form, never occur here.
+func appendSqliteVarint(b []byte, v uint64) []byte {
+	var groups [8]byte
+	n := 0
+	for {
+		groups[n] = byte(v & 0x7f)
+		n++
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	for i := n - 1; i > 0; i-- {
+		b = append(b, groups[i]|0x80)
+	}
+	return append(b, groups[0])
+}
+
+/*
+ImportSQLite inserts the rows of the table tableName of the SQLite database in
+filename and returns how many it inserted. Its first three columns are taken
+as id, username and email: the id must be an integer, or NULL if the column is
+the rowid, and the others text or NULL. Further columns are ignored. The rows
+are read in rowid order and bulk loaded, and like ImportCSV either all of them
+are inserted or none. Only the database file is read, changes still in a
+SQLite WAL file are not seen.
+*/
+func ImportSQLite(ctx context.Context, table *db.Table, filename string, tableName string, progress io.Writer) (int, error) {
+	r, err := openSQLite(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer r.f.Close()
+	rootPage, err := r.findTable(tableName)
+	if err != nil {
+		return 0, err
+	}
+
+	rows := &sqliteRows{cursor: r.cursor(rootPage), progress: progress}
+	n, err := table.BulkLoad(ctx, rows.next)
+	if err != nil && !rows.failed {
+		// The row read last could not be inserted.
+		return 0, fmt.Errorf("rowid %d: %w", rows.rowid, err)
+	}
+	return n, err
+}
+
+// sqliteRows reads the rows of a SQLite table for Table.BulkLoad.
+type sqliteRows struct {
+	cursor   *sqliteCursor
+	progress io.Writer
+	rowid    int64
+	n        int
+	failed   bool // Whether the file itself was bad.
+}
+
+func (s *sqliteRows) next() (types.Row, error) {
+	row, err := s.read()
+	if err != nil && !errors.Is(err, io.EOF) {
+		s.failed = true
+	}
+	return row, err
+}
+
+func (s *sqliteRows) read() (types.Row, error) {
+	rowid, payload, err := s.cursor.next()
+	if err != nil {
+		return types.Row{}, err
+	}
+	s.rowid = rowid
+	values, err := sqliteDecodeRecord(payload)
+	if err != nil {
+		return types.Row{}, err
+	}
+	row, err := sqliteRow(rowid, values)
+	if err != nil {
+		return types.Row{}, fmt.Errorf("rowid %d: %w", rowid, err)
+	}
+	s.n++
+	if s.n%importProgressRows == 0 {
+		fmt.Fprintf(s.progress, "%d rows imported\n", s.n)
+	}
+	return row, nil
+}
+
+// sqliteRow maps the values of a record to a row. Columns missing from the
+// record, which SQLite allows for columns added later, are NULL.
+func sqliteRow(rowid int64, values []any) (types.Row, error) {
+	for len(values) < len(csvColumns) {
+		values = append(values, nil)
+	}
+	id := rowid
+	switch v := values[0].(type) {
+	case nil:
+	case int64:
+		id = v
+	default:
+		return types.Row{}, fmt.Errorf("id is not an integer")
+	}
+	if id < 0 || id > math.MaxUint32 {
+		return types.Row{}, fmt.Errorf("id %d is out of range", id)
+	}
+	text := [2]string{}
+	for i := range text {
+		switch v := values[i+1].(type) {
+		case nil:
+		case string:
+			text[i] = v
+		default:
+			return types.Row{}, fmt.Errorf("%s is not text", csvColumns[i+1])
+		}
+	}
+	if len(text[0]) > int(constants.UsernameSize) || len(text[1]) > int(constants.EmailSize) {
+		return types.Row{}, fmt.Errorf("string is too long")
+	}
+	row := types.Row{Id: uint32(id)}
+	copy(row.Username[:], text[0])
+	copy(row.Email[:], text[1])
+	return row, nil
+}
+
+// sqliteReader reads the pages of a SQLite database file.
+type sqliteReader struct {
+	f        *os.File
+	pageSize int
+	usable   int // Bytes of each page not reserved for extensions.
+	numPages uint32
+}
+
+func openSQLite(filename string) (*sqliteReader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, sqliteFileHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.Equal(header[:len(sqliteMagic)], sqliteMagic) {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a SQLite database", filename)
+	}
+	pageSize := int(binary.BigEndian.Uint16(header[16:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		f.Close()
+		return nil, fmt.Errorf("corrupt SQLite file: invalid page size %d", pageSize)
+	}
+	if encoding := binary.BigEndian.Uint32(header[56:]); encoding > 1 {
+		f.Close()
+		return nil, fmt.Errorf("SQLite text encoding %d is not supported, only UTF-8 is", encoding)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &sqliteReader{
+		f:        f,
+		pageSize: pageSize,
+		usable:   pageSize - int(header[20]),
+		numPages: uint32(info.Size() / int64(pageSize)),
+	}, nil
+}
+
+func (r *sqliteReader) page(pageNum uint32) ([]byte, error) {
+	if pageNum < 1 || pageNum > r.numPages {
+		return nil, fmt.Errorf("corrupt SQLite file: page %d out of range", pageNum)
+	}
+	page := make([]byte, r.pageSize)
+	if _, err := r.f.ReadAt(page, int64(pageNum-1)*int64(r.pageSize)); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// findTable returns the root page of the table named tableName from sqlite_master.
+func (r *sqliteReader) findTable(tableName string) (uint32, error) {
+	master := r.cursor(1)
+	for {
+		_, payload, err := master.next()
+		if errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("no table %s in the SQLite database", tableName)
+		}
+		if err != nil {
+			return 0, err
+		}
+		values, err := sqliteDecodeRecord(payload)
+		if err != nil {
+			return 0, err
+		}
+		if len(values) < 4 || values[0] != "table" {
+			continue
+		}
+		if name, ok := values[1].(string); !ok || !strings.EqualFold(name, tableName) {
+			continue
+		}
+		rootPage, ok := values[3].(int64)
+		if !ok || rootPage < 1 || rootPage > math.MaxUint32 {
+			return 0, fmt.Errorf("%s is a virtual table or corrupt", tableName)
+		}
+		return uint32(rootPage), nil
+	}
+}
+
+// sqliteMaxDepth bounds the depth of a B-tree, so a cycle of pages in a corrupt file ends.
+const sqliteMaxDepth = 32
+
+// sqliteCursor walks the leaves of a table B-tree in rowid order.
+type sqliteCursor struct {
+	r     *sqliteReader
+	stack []sqliteFrame
+	err   error // Error reading the root page, returned by the first call to next.
+}
+
+// sqliteFrame is a page on the path from the root and the next of its cells to visit.
+type sqliteFrame struct {
+	page   []byte
+	header int // Offset of the page header, 100 on page 1, otherwise 0.
+	cell   int
+}
+
+func (r *sqliteReader) cursor(rootPage uint32) *sqliteCursor {
+	c := &sqliteCursor{r: r}
+	c.err = c.push(rootPage)
+	return c
+}
+
+func (c *sqliteCursor) push(pageNum uint32) error {
+	if len(c.stack) == sqliteMaxDepth {
+		return fmt.Errorf("corrupt SQLite file: B-tree deeper than %d levels", sqliteMaxDepth)
+	}
+	page, err := c.r.page(pageNum)
+	if err != nil {
+		return err
+	}
+	frame := sqliteFrame{page: page}
+	if pageNum == 1 {
+		frame.header = sqliteFileHeaderSize
+	}
+	if pageType := page[frame.header]; pageType != sqliteLeafTable && pageType != sqliteInteriorTable {
+		return fmt.Errorf("page %d is not part of a rowid table, WITHOUT ROWID tables are not supported", pageNum)
+	}
+	c.stack = append(c.stack, frame)
+	return nil
+}
+
+// next returns the rowid and payload of the next row, or io.EOF after the last one.
+func (c *sqliteCursor) next() (int64, []byte, error) {
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+		header := top.page[top.header:]
+		numCells := int(binary.BigEndian.Uint16(header[3:]))
+		leaf := header[0] == sqliteLeafTable
+		pointers := header[8:]
+		if !leaf {
+			pointers = header[12:]
+		}
+		if 2*numCells > len(pointers) {
+			return 0, nil, fmt.Errorf("corrupt SQLite file: too many cells")
+		}
+
+		if top.cell > numCells || (leaf && top.cell == numCells) {
+			c.stack = c.stack[:len(c.stack)-1]
+			continue
+		}
+		if !leaf && top.cell == numCells {
+			top.cell++
+			if err := c.push(binary.BigEndian.Uint32(header[8:])); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		offset := int(binary.BigEndian.Uint16(pointers[2*top.cell:]))
+		top.cell++
+		if offset >= len(top.page)-4 {
+			return 0, nil, fmt.Errorf("corrupt SQLite file: cell offset %d out of range", offset)
+		}
+		if !leaf {
+			// An interior cell is the left child, then a key no larger than the rowids under it.
+			if err := c.push(binary.BigEndian.Uint32(top.page[offset:])); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		return c.leafCell(top.page[offset:])
+	}
+	return 0, nil, io.EOF
+}
+
+// leafCell returns the rowid and payload of a table leaf cell, following its
+// overflow pages if the payload does not fit into the page.
+func (c *sqliteCursor) leafCell(cell []byte) (int64, []byte, error) {
+	size, n := sqliteVarint(cell)
+	rowid, m := sqliteVarint(cell[n:])
+	cell = cell[n+m:]
+	if n == 0 || m == 0 || size > 1<<30 {
+		return 0, nil, fmt.Errorf("corrupt SQLite file: invalid cell")
+	}
+
+	// How much of the payload is stored locally, as laid out in the file format.
+	usable := c.r.usable
+	local, maxLocal := int(size), usable-35
+	if local > maxLocal {
+		minLocal := (usable-12)*32/255 - 23
+		local = minLocal + (int(size)-minLocal)%(usable-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	if local > len(cell) || (local < int(size) && local+4 > len(cell)) {
+		return 0, nil, fmt.Errorf("corrupt SQLite file: cell out of range")
+	}
+	payload := append([]byte(nil), cell[:local]...)
+	if local == int(size) {
+		return int64(rowid), payload, nil
+	}
+	for next := binary.BigEndian.Uint32(cell[local:]); len(payload) < int(size); {
+		page, err := c.r.page(next)
+		if err != nil {
+			return 0, nil, err
+		}
+		next = binary.BigEndian.Uint32(page)
+		payload = append(payload, page[4:min(usable, 4+int(size)-len(payload))]...)
+		if next == 0 && len(payload) < int(size) {
+			return 0, nil, fmt.Errorf("corrupt SQLite file: overflow chain ends early")
+		}
+	}
+	return int64(rowid), payload, nil
+}
+
+// sqliteDecodeRecord returns the values of a record, each nil, int64, float64, string or []byte.
+func sqliteDecodeRecord(record []byte) ([]any, error) {
+	corrupt := fmt.Errorf("corrupt SQLite file: invalid record")
+	headerSize, n := sqliteVarint(record)
+	if n == 0 || headerSize > uint64(len(record)) {
+		return nil, corrupt
+	}
+	header, body := record[n:headerSize], record[headerSize:]
+	var values []any
+	for len(header) > 0 {
+		serialType, n := sqliteVarint(header)
+		if n == 0 {
+			return nil, corrupt
+		}
+		header = header[n:]
+		size := 0
+		switch {
+		case serialType >= 12:
+			size = int((serialType - 12) / 2)
+		case serialType == 7:
+			size = 8
+		case serialType >= 1 && serialType <= 6:
+			size = []int{1, 2, 3, 4, 6, 8}[serialType-1]
+		}
+		if size > len(body) {
+			return nil, corrupt
+		}
+		data := body[:size]
+		body = body[size:]
+		switch {
+		case serialType == 0:
+			values = append(values, nil)
+		case serialType <= 6:
+			// Big-endian two's complement, sign-extended from the first byte.
+			v := int64(int8(data[0]))
+			for _, b := range data[1:] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+		case serialType == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(data)))
+		case serialType == 8 || serialType == 9:
+			values = append(values, int64(serialType-8))
+		case serialType >= 12 && serialType%2 == 0:
+			values = append(values, append([]byte(nil), data...))
+		case serialType >= 13:
+			values = append(values, string(data))
+		default:
+			return nil, corrupt
+		}
+	}
+	return values, nil
+}
+
+// sqliteVarint decodes the varint at the start of b and returns it and its
+// length, which is 0 if b ends first. The ninth byte, if any, holds 8 bits.
+func sqliteVarint(b []byte) (uint64, int) {
+	v := uint64(0)
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package cli
+
+import "os"
+
+// Line editing needs raw terminal mode, which is only implemented on Linux. Elsewhere the REPL
+// reads plain lines.
+func isTerminal(f *os.File) bool {
+	return false
+}
+
+func terminalHeight(f *os.File) int {
+	return 0
+}
+
+func enableRawMode(f *os.File) (restore func(), err error) {
+	return func() {}, nil
+}
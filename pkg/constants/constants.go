@@ -1,6 +1,9 @@
 package constants
 
-import "math"
+import (
+	"math"
+	"time"
+)
 
 const (
 	CliName string = "simpleREPL"
@@ -10,13 +13,132 @@ const (
 	TableMaxPages  uint32 = 100
 	InvalidPageNum uint32 = math.MaxUint32
 
-	IdSize         uint32 = 4
-	UsernameSize   uint32 = 32
-	EmailSize      uint32 = 255
-	IdOffset       uint32 = 0
-	UsernameOffset uint32 = IdOffset + IdSize
-	EmailOffset    uint32 = UsernameOffset + UsernameSize
-	RowSize        uint32 = IdSize + UsernameSize + EmailSize
+	// Number of pages the pager keeps cached between statements.
+	DefaultMaxCachedPages uint32 = 32
+
+	// The WAL is checkpointed into the db file once it holds this many frames,
+	// or once its oldest frame is older than the age limit.
+	DefaultCheckpointFrames uint32        = 1000
+	DefaultCheckpointAge    time.Duration = time.Minute
+
+	IdSize          uint32 = 4
+	UsernameSize    uint32 = 32
+	EmailSize       uint32 = 255
+	IdOffset        uint32 = 0
+	UsernameOffset  uint32 = IdOffset + IdSize
+	EmailOffset     uint32 = UsernameOffset + UsernameSize
+	ExpiresAtSize   uint32 = 8
+	ExpiresAtOffset uint32 = EmailOffset + EmailSize
+	RowSize         uint32 = IdSize + UsernameSize + EmailSize + ExpiresAtSize
+)
+
+// File Header Layout
+const (
+	FileMagic             string = "simpleDB"
+	FileFormatVersion     uint32 = 20
+	FileHeaderSize        uint32 = PageSize // Header occupies a whole block so pages stay aligned.
+	MagicSize             uint32 = uint32(len(FileMagic))
+	MagicOffset           uint32 = 0
+	VersionSize           uint32 = 4
+	VersionOffset         uint32 = MagicOffset + MagicSize
+	HeaderPageSizeSize    uint32 = 4
+	HeaderPageSizeOffset  uint32 = VersionOffset + VersionSize
+	RootPageNumSize       uint32 = 4
+	RootPageNumOffset     uint32 = HeaderPageSizeOffset + HeaderPageSizeSize
+	FreelistHeadSize      uint32 = 4
+	FreelistHeadOffset    uint32 = RootPageNumOffset + RootPageNumSize
+	WalSaltSize           uint32 = 4
+	WalSaltOffset         uint32 = FreelistHeadOffset + FreelistHeadSize
+	KeySaltSize           uint32 = 16
+	KeySaltOffset         uint32 = WalSaltOffset + WalSaltSize
+	KeyCheckSize          uint32 = 16
+	KeyCheckOffset        uint32 = KeySaltOffset + KeySaltSize
+	BloomSizeSize         uint32 = 4 // BloomSize if the file has a bloom filter, 0 if not.
+	BloomSizeOffset       uint32 = KeyCheckOffset + KeyCheckSize
+	FulltextColumnsSize   uint32 = 4 // Bit i is set if the i-th column has a fulltext index.
+	FulltextColumnsOffset uint32 = BloomSizeOffset + BloomSizeSize
+	SpatialRootSize       uint32 = 4
+	SpatialRootOffset     uint32 = FulltextColumnsOffset + FulltextColumnsSize
+	PartitionCountSize    uint32 = 4
+	PartitionCountOffset  uint32 = SpatialRootOffset + SpatialRootSize
+	PartitionEntrySize    uint32 = 8 // The smallest id of a partition and the root page of its tree.
+	PartitionsOffset      uint32 = PartitionCountOffset + PartitionCountSize
+	MaxPartitions         uint32 = 64
+	ViewCountSize         uint32 = 4
+	ViewCountOffset       uint32 = PartitionsOffset + (MaxPartitions-1)*PartitionEntrySize
+	ViewNameSize          uint32 = 32
+	ViewEntrySize         uint32 = ViewNameSize + 4 // The name of a view, zero padded, and the root page of its tree.
+	ViewsOffset           uint32 = ViewCountOffset + ViewCountSize
+	MaxViews              uint32 = 8
+	GeneratedRootSize     uint32 = 4
+	GeneratedRootOffset   uint32 = ViewsOffset + MaxViews*ViewEntrySize
+	GeneratedCountSize    uint32 = 4
+	GeneratedCountOffset  uint32 = GeneratedRootOffset + GeneratedRootSize
+	GeneratedNameSize     uint32 = 32
+	GeneratedExprSize     uint32 = 92
+	GeneratedEntrySize    uint32 = GeneratedNameSize + 4 + GeneratedExprSize // The name, 1 if the column is stored, and the text of the expression.
+	GeneratedOffset       uint32 = GeneratedCountOffset + GeneratedCountSize
+	MaxGenerated          uint32 = 4
+	MaxColumns            uint32 = 3 + MaxGenerated // id, username and email, then the generated columns.
+	CollationNameSize     uint32 = 16
+	CollationsOffset      uint32 = GeneratedOffset + MaxGenerated*GeneratedEntrySize // A name per column, empty for binary.
+	UniqueRootSize        uint32 = 4
+	UniqueRootOffset      uint32 = CollationsOffset + MaxColumns*CollationNameSize
+	UniqueColumnSize      uint32 = 4 // The index of the column with the unique index.
+	UniqueColumnOffset    uint32 = UniqueRootOffset + UniqueRootSize
+	UniqueCollationOffset uint32 = UniqueColumnOffset + UniqueColumnSize // CollationNameSize bytes, empty for binary.
+	StatisticsRootSize    uint32 = 4
+	StatisticsRootOffset  uint32 = UniqueCollationOffset + CollationNameSize
+	RowCountSize          uint32 = 4
+	RowCountOffset        uint32 = StatisticsRootOffset + StatisticsRootSize
+	ExpiringRowsSize      uint32 = 4 // Rows with a ttl, which count(*) can not take from RowCount.
+	ExpiringRowsOffset    uint32 = RowCountOffset + RowCountSize
+	AppliedIndexSize      uint32 = 8 // The last replicated log entry applied, see Table.ApplyEntry.
+	AppliedIndexOffset    uint32 = ExpiringRowsOffset + ExpiringRowsSize
+	AppliedTimeSize       uint32 = 8 // The unix time of the last log entry applied, which ttls count from.
+	AppliedTimeOffset     uint32 = AppliedIndexOffset + AppliedIndexSize
+	DescendingRootSize    uint32 = 4
+	DescendingRootOffset  uint32 = AppliedTimeOffset + AppliedTimeSize
+	UsersRootSize         uint32 = 4
+	UsersRootOffset       uint32 = DescendingRootOffset + DescendingRootSize
+	OrderedRootSize       uint32 = 4
+	OrderedRootOffset     uint32 = UsersRootOffset + UsersRootSize
+	OrderedColumnSize     uint32 = 4 // The index into the columns of the column the ordered index is on.
+	OrderedColumnOffset   uint32 = OrderedRootOffset + OrderedRootSize
+	BloomOffset           uint32 = 1600 // Past the largest lists of partitions, views and columns.
+	BloomSize             uint32 = FileHeaderSize - BloomOffset
+	BloomBits             uint32 = BloomSize * 8
+	BloomHashes           uint32 = 7
+)
+
+// Page Trailer Layout
+const (
+	PageChecksumSize   uint32 = 4
+	PageChecksumOffset uint32 = PageSize - PageChecksumSize
+	// Pages of an encrypted file hold everything before the nonce encrypted,
+	// followed by its authentication tag. Nodes never use this space.
+	PageNonceSize     uint32 = 12
+	PageNonceOffset   uint32 = PageChecksumOffset - PageNonceSize
+	PageTagSize       uint32 = 16
+	PageTagOffset     uint32 = PageNonceOffset - PageTagSize
+	PageEncryptedSize uint32 = PageTagOffset
+)
+
+// WAL Frame Layout
+const (
+	WalFileSuffix          string = "-wal"
+	ReadersFileSuffix      string = "-readers"
+	WalFramePageNumSize    uint32 = 4
+	WalFramePageNumOffset  uint32 = 0
+	WalFrameCommitSize     uint32 = 4
+	WalFrameCommitOffset   uint32 = WalFramePageNumOffset + WalFramePageNumSize
+	WalFrameSaltSize       uint32 = 4
+	WalFrameSaltOffset     uint32 = WalFrameCommitOffset + WalFrameCommitSize
+	WalFrameChecksumSize   uint32 = 4
+	WalFrameChecksumOffset uint32 = WalFrameSaltOffset + WalFrameSaltSize
+	WalFrameHeaderSize     uint32 = WalFramePageNumSize + WalFrameCommitSize + WalFrameSaltSize + WalFrameChecksumSize
+	WalFrameSize           uint32 = WalFrameHeaderSize + PageSize
+	WalHeaderPageNum       uint32 = InvalidPageNum // Frame holding the file header rather than a page.
 )
 
 // Node Header Layout
@@ -46,7 +168,7 @@ const (
 	LeafNodeValueSize            = RowSize
 	LeafNodeValueOffset   uint32 = LeafNodeKeyOffset + LeafNodeKeySize
 	LeafNodeCellSize      uint32 = LeafNodeKeySize + LeafNodeValueSize
-	LeafNodeSpaceForcells uint32 = PageSize - LeafNodeHeaderSize
+	LeafNodeSpaceForcells uint32 = PageEncryptedSize - LeafNodeHeaderSize
 	LeafNodeMaxCells      uint32 = LeafNodeSpaceForcells / LeafNodeCellSize
 )
 
@@ -62,13 +184,30 @@ const (
 	InternalNodeNumKeysOffset           = uint32(CommonNodeHeaderSize)
 	InternalNodeRightChildSize   uint32 = 4
 	InternalNodeRightChildOffset        = InternalNodeNumKeysOffset + InternalNodeNumKeysSize
-	InternalNodeHeaderSize       uint32 = uint32(CommonNodeHeaderSize) + InternalNodeNumKeysSize + InternalNodeRightChildSize
+	InternalNodeRightCountSize   uint32 = 4 // Rows under the right child.
+	InternalNodeRightCountOffset        = InternalNodeRightChildOffset + InternalNodeRightChildSize
+	InternalNodeHeaderSize       uint32 = uint32(CommonNodeHeaderSize) + InternalNodeNumKeysSize + InternalNodeRightChildSize + InternalNodeRightCountSize
 )
 
 // Internal Node Body Layout
 const (
 	InternalNodeKeySize   uint32 = 4
 	InternalNodeChildSize uint32 = 4
-	InternalNodeCellSize  uint32 = InternalNodeChildSize + InternalNodeKeySize
+	InternalNodeCountSize uint32 = 4 // Rows under the child.
+	InternalNodeCellSize  uint32 = InternalNodeChildSize + InternalNodeKeySize + InternalNodeCountSize
 	InternalNodeMaxCells  uint32 = 3 // Keep this small for testing.
 )
+
+// Spatial Node Layout
+const (
+	SpatialNodeIsLeafSize       uint32 = 1
+	SpatialNodeIsLeafOffset     uint32 = uint32(CommonNodeHeaderSize)
+	SpatialNodeNumEntriesSize   uint32 = 4
+	SpatialNodeNumEntriesOffset uint32 = SpatialNodeIsLeafOffset + SpatialNodeIsLeafSize
+	SpatialNodeHeaderSize       uint32 = SpatialNodeNumEntriesOffset + SpatialNodeNumEntriesSize
+	SpatialEntryBoxSize         uint32 = 32 // Min x, min y, max x and max y as float64.
+	SpatialEntryPointerSize     uint32 = 4  // Id of the row in a leaf, page of the child in an internal node.
+	SpatialEntrySize            uint32 = SpatialEntryBoxSize + SpatialEntryPointerSize
+	SpatialNodeMaxEntries       uint32 = 8 // Keep this small for testing.
+	SpatialNodeMinEntries       uint32 = 3 // A split leaves at least this many in either node.
+)
@@ -0,0 +1,262 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Table statistics.
+
+analyze samples the leaves of the table, spread evenly over its trees, and
+keeps what it measured in a B-tree of its own whose root the file header
+lists: the number of rows, estimated from the rows of the sampled leaves,
+the average width of a row, and a histogram of the ids, whose buckets hold
+about as many sampled rows each. A small table has all of its leaves
+sampled, so its statistics are exact. They are not kept up to date as rows
+are inserted and deleted; analyze must be run again to refresh them.
+
+The tree holds the totals at key 0 and the buckets of the histogram from key
+1 on, packed like the rows of a view. Estimates for a range of ids, which a
+planner weighing a scan against a lookup would want, come from the histogram.
+*/
+
+// analyzeSampleLeaves caps the leaves analyze reads, the others are estimated from them.
+const analyzeSampleLeaves = 32
+
+// analyzeBuckets is the number of buckets of the histogram, fewer if fewer rows were sampled.
+const analyzeBuckets = 8
+
+// TableStatistics is what the last analyze measured of the rows of the table.
+type TableStatistics struct {
+	AnalyzedAt  time.Time         `json:"analyzedAt"`
+	Rows        uint64            `json:"rows"`        // Estimated from the sampled rows.
+	SampledRows uint64            `json:"sampledRows"` // Rows of the sampled leaves, all of them if every leaf was sampled.
+	AvgRowWidth float64           `json:"avgRowWidth"` // Bytes of the values of a row, without the padding of its text columns.
+	Histogram   []HistogramBucket `json:"histogram"`
+}
+
+// HistogramBucket is a range of ids and the estimated number of rows in it.
+type HistogramBucket struct {
+	From uint32 `json:"from"`
+	To   uint32 `json:"to"`
+	Rows uint64 `json:"rows"`
+}
+
+// EstimateRows estimates how many rows have ids from from to to, taking the
+// ids of a bucket to be spread evenly over its range.
+func (s TableStatistics) EstimateRows(from uint32, to uint32) uint64 {
+	rows := 0.0
+	for _, bucket := range s.Histogram {
+		lo, hi := max(from, bucket.From), min(to, bucket.To)
+		if lo > hi {
+			continue
+		}
+		rows += float64(bucket.Rows) * (float64(hi-lo) + 1) / (float64(bucket.To-bucket.From) + 1)
+	}
+	return uint64(math.Round(rows))
+}
+
+// leafPages returns the leaves of the tree at the root, in key order.
+func leafPages(pager *Pager, pageNum uint32) ([]uint32, error) {
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return nil, err
+	}
+	if getNodeType(node) == types.NodeLeaf {
+		return []uint32{pageNum}, nil
+	}
+	children := []uint32{}
+	numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+	for i := uint32(0); i < numKeys; i++ {
+		children = append(children, binary.LittleEndian.Uint32(internalNodeCell(node, i)))
+	}
+	children = append(children, binary.LittleEndian.Uint32(internalNodeRightChild(node)))
+	leaves := []uint32{}
+	for _, child := range children {
+		below, err := leafPages(pager, child)
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, below...)
+	}
+	return leaves, nil
+}
+
+// Analyze samples the rows of the table and replaces the statistics kept of them.
+func (t *Table) Analyze(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pager := t.pager
+	if pager.readOnly {
+		return errReadOnly
+	}
+	if pager.inTxn {
+		return fmt.Errorf("cannot analyze - a transaction is active")
+	}
+	stats, err := t.sample()
+	if err != nil {
+		return err
+	}
+	oldRoot := pager.header.StatisticsRootPageNum
+	err = t.write(func() error {
+		if pager.header.StatisticsRootPageNum == 0 {
+			pageNum, err := getUnusedPageNum(pager)
+			if err != nil {
+				return err
+			}
+			root, err := getPage(pager, pageNum)
+			if err != nil {
+				return err
+			}
+			initializeLeafNode(root)
+			setNodeRoot(root, true)
+			markPageDirty(pager, pageNum)
+			// The header is written by the commit, along with the tree.
+			pager.header.StatisticsRootPageNum = pageNum
+		}
+		tree := statisticsTree(pager)
+		old := []uint32{}
+		err := tree.scanKeys(ctx, 0, math.MaxUint32, false, func(key uint32) error {
+			old = append(old, key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range old {
+			if err := deleteRow(tree, key); err != nil {
+				return err
+			}
+		}
+		width := int64(math.Round(stats.AvgRowWidth * float64(stats.SampledRows)))
+		rows := [][]any{{stats.AnalyzedAt.Unix(), int64(stats.Rows), int64(stats.SampledRows), width}}
+		for _, bucket := range stats.Histogram {
+			rows = append(rows, []any{int64(bucket.From), int64(bucket.To), int64(bucket.Rows)})
+		}
+		for i, values := range rows {
+			row, err := packRow(uint32(i), values)
+			if err != nil {
+				return err
+			}
+			if err := insertRow(tree, &row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		pager.header.StatisticsRootPageNum = oldRoot
+	}
+	return err
+}
+
+// sample measures the rows of up to analyzeSampleLeaves leaves spread evenly over the trees.
+func (t *Table) sample() (TableStatistics, error) {
+	pager := t.pager
+	leaves := []uint32{}
+	for _, p := range t.trees() {
+		below, err := leafPages(pager, p.tree.rootPageNum)
+		if err != nil {
+			return TableStatistics{}, err
+		}
+		leaves = append(leaves, below...)
+	}
+	picked := min(len(leaves), analyzeSampleLeaves)
+	ids := []uint32{}
+	width := 0
+	now := t.now()
+	for i := 0; i < picked; i++ {
+		// The first and the last leaf are always picked, so the histogram spans every id.
+		leaf := 0
+		if picked > 1 {
+			leaf = i * (len(leaves) - 1) / (picked - 1)
+		}
+		node, err := getPage(pager, leaves[leaf])
+		if err != nil {
+			return TableStatistics{}, err
+		}
+		numCells := binary.LittleEndian.Uint32(leafNodeNumCells(node))
+		for cellNum := uint32(0); cellNum < numCells; cellNum++ {
+			raw := leafNodeValue(node, cellNum)
+			if expiredAt(raw, now.Unix()) {
+				continue
+			}
+			values := rowValues(deserializeRow(raw))
+			ids = append(ids, uint32(values[0].(int64)))
+			width += 4 + len(values[1].(string)) + len(values[2].(string))
+		}
+	}
+	stats := TableStatistics{AnalyzedAt: now.Truncate(time.Second), SampledRows: uint64(len(ids))}
+	if len(ids) == 0 {
+		return stats, nil
+	}
+	scale := float64(len(leaves)) / float64(picked)
+	stats.Rows = uint64(math.Round(float64(len(ids)) * scale))
+	stats.AvgRowWidth = float64(width) / float64(len(ids))
+	// The leaves of the partitions follow each other in id order, so the ids are
+	// sorted. A bucket starts right after the one before it, so the ids of the
+	// leaves that were not sampled fall into one too.
+	buckets := min(len(ids), analyzeBuckets)
+	from := ids[0]
+	for b := 0; b < buckets; b++ {
+		first, last := b*len(ids)/buckets, (b+1)*len(ids)/buckets-1
+		stats.Histogram = append(stats.Histogram, HistogramBucket{
+			From: from,
+			To:   ids[last],
+			Rows: uint64(math.Round(float64(last-first+1) * scale)),
+		})
+		from = ids[last] + 1
+	}
+	return stats, nil
+}
+
+// statisticsTree returns the tree of the statistics.
+func statisticsTree(pager *Pager) *Table {
+	return &Table{
+		pager:       pager,
+		rootPageNum: pager.header.StatisticsRootPageNum,
+		logger:      pager.logger,
+		now:         time.Now,
+		auxiliary:   true,
+	}
+}
+
+// Statistics returns the statistics the last analyze kept, and false if the table was never analyzed.
+func (t *Table) Statistics(ctx context.Context) (TableStatistics, bool, error) {
+	if t.pager.header.StatisticsRootPageNum == 0 {
+		return TableStatistics{}, false, nil
+	}
+	var stats TableStatistics
+	var width int64
+	err := statisticsTree(t.pager).scanRange(ctx, 0, math.MaxUint32, func(row types.Row) error {
+		values := unpackRow(row)
+		if row.Id == 0 && len(values) == 4 {
+			stats.AnalyzedAt = time.Unix(values[0].(int64), 0)
+			stats.Rows, stats.SampledRows, width = uint64(values[1].(int64)), uint64(values[2].(int64)), values[3].(int64)
+			return nil
+		}
+		if len(values) != 3 {
+			return fmt.Errorf("statistics entry %d holds %d values, expected 3", row.Id, len(values))
+		}
+		stats.Histogram = append(stats.Histogram, HistogramBucket{
+			From: uint32(values[0].(int64)),
+			To:   uint32(values[1].(int64)),
+			Rows: uint64(values[2].(int64)),
+		})
+		return nil
+	})
+	if err != nil {
+		return TableStatistics{}, false, err
+	}
+	if stats.SampledRows > 0 {
+		stats.AvgRowWidth = float64(width) / float64(stats.SampledRows)
+	}
+	return stats, true, nil
+}
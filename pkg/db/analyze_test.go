@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestAnalyze(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	if _, ok, _ := table.Statistics(ctx); ok {
+		t.Fatalf("Expected no statistics before analyze")
+	}
+	ids := []int{}
+	for i := 1; i <= 100; i++ {
+		ids = append(ids, i*10)
+	}
+	table.BulkLoad(ctx, rowsOf(ids...))
+	if _, err := table.Execute(ctx, &parser.Analyze{}, nil); err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	// Every leaf of a small table is sampled, so its statistics are exact.
+	stats, ok, err := table.Statistics(ctx)
+	if err != nil || !ok || stats.Rows != 100 || stats.SampledRows != 100 {
+		t.Fatalf("Expected 100 rows, all sampled. Got: %+v, %t, %v", stats, ok, err)
+	}
+	// 4 bytes of id, user10 to user1000 and user10@example.com to user1000@example.com.
+	if stats.AvgRowWidth < 4+6+18 || stats.AvgRowWidth > 4+8+20 {
+		t.Fatalf("Expected the width of the values of a row. Got: %f", stats.AvgRowWidth)
+	}
+	if len(stats.Histogram) != analyzeBuckets || stats.Histogram[0].From != 10 || stats.Histogram[analyzeBuckets-1].To != 1000 {
+		t.Fatalf("Expected %d buckets spanning ids 10 to 1000. Got: %+v", analyzeBuckets, stats.Histogram)
+	}
+	for _, test := range []struct {
+		from, to uint32
+		want     uint64
+	}{{0, math.MaxUint32, 100}, {10, 500, 50}, {501, 1000, 50}, {2000, 3000, 0}} {
+		if got := stats.EstimateRows(test.from, test.to); got != test.want {
+			t.Fatalf("Expected %d rows from %d to %d. Got: %d", test.want, test.from, test.to, got)
+		}
+	}
+
+	table.Close()
+	table, _ = Open(dbName)
+	if kept, ok, _ := table.Statistics(ctx); !ok || kept.Rows != 100 || len(kept.Histogram) != analyzeBuckets {
+		t.Fatalf("Expected the statistics to be kept. Got: %+v", kept)
+	}
+	table.Close()
+
+	// A larger table has some of its leaves sampled and the others estimated.
+	table, _ = Open(filepath.Join(t.TempDir(), "large.db"))
+	defer table.Close()
+	ids = ids[:0]
+	for i := 1; i <= 600; i++ {
+		ids = append(ids, i)
+	}
+	if _, err := table.BulkLoad(ctx, rowsOf(ids...)); err != nil {
+		t.Fatalf("BulkLoad failed: %v", err)
+	}
+	if err := table.Analyze(ctx); err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	stats, ok, err = table.Statistics(ctx)
+	if err != nil || !ok || stats.SampledRows >= 600 || stats.Rows < 570 || stats.Rows > 630 {
+		t.Fatalf("Expected about 600 rows estimated from a sample. Got: %+v, %t, %v", stats, ok, err)
+	}
+	if got := stats.EstimateRows(301, 600); got < 270 || got > 330 {
+		t.Fatalf("Expected about 300 rows from 301 to 600. Got: %d", got)
+	}
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected no problems. Got: %v", problems)
+	}
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+/*
+Applying replicated writes.
+
+A node of a replicated database runs the writes of a log in order. The index
+of the last entry it applied is kept in the file header and committed along
+with the entry's write, so after a crash the node knows exactly which entries
+its rows have, and a backup of the file, a snapshot, carries its index.
+
+Every node must also agree on the time, or a ttl would expire rows at a
+different moment on each. An entry carries the time the leader accepted it,
+and the write runs with the table's clock at that time: the ttl of an insert
+counts from it, and whether a row with the id expired is decided by it. The
+time of the last entry is kept in the header as well, and a table with
+entries applied only deletes the rows expired by then, see DeleteExpired.
+*/
+
+// AppliedIndex returns the index of the last log entry applied with ApplyEntry, 0 if none was.
+func (t *Table) AppliedIndex() uint64 {
+	return t.pager.header.AppliedIndex
+}
+
+/*
+ApplyEntry runs stmt, the write of the log entry with the index accepted at
+the time at, and stores the index as applied in the same commit. An entry
+without a write, such as the one a new Raft leader appends, has a nil stmt
+and only moves the index on. The clock of the write never goes back: an
+entry accepted before the last one applied runs at that one's time. A
+statement failing with duplicate key or key not found fails alike on every
+node, so the index is stored all the same and the statement's error
+returned. Any other error, such as one writing the file, leaves the rows and
+the index as they were.
+*/
+func (t *Table) ApplyEntry(ctx context.Context, index uint64, at time.Time, stmt parser.Statement) (ExecResult, error) {
+	var result ExecResult
+	var stmtErr error
+	header := &t.pager.header
+	oldIndex, oldTime := header.AppliedIndex, header.AppliedTime
+	appliedTime := max(at.Unix(), oldTime)
+	now := t.now
+	t.now = func() time.Time { return time.Unix(appliedTime, 0) }
+	defer func() { t.now = now }()
+	err := t.write(func() error {
+		if stmt != nil {
+			result, stmtErr = t.Execute(ctx, stmt, func([]any) error { return nil })
+		}
+		if stmtErr != nil && !errors.Is(stmtErr, dberr.ErrDuplicateKey) && !errors.Is(stmtErr, dberr.ErrKeyNotFound) {
+			return stmtErr
+		}
+		if _, err := getPage(t.pager, t.rootPageNum); err != nil {
+			return err
+		}
+		// A commit only writes the header along with the pages it changed.
+		markPageDirty(t.pager, t.rootPageNum)
+		header.AppliedIndex, header.AppliedTime = index, appliedTime
+		return nil
+	})
+	if err != nil {
+		header.AppliedIndex, header.AppliedTime = oldIndex, oldTime
+		return ExecResult{}, err
+	}
+	return result, stmtErr
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestApplyEntryClock(t *testing.T) {
+	ctx := context.Background()
+	// Two nodes whose clocks are more than an hour apart.
+	nodes := []*Table{}
+	for _, clock := range []int64{1000, 5000} {
+		table, _ := Open(MemoryDbName)
+		defer table.Close()
+		table.now = func() time.Time { return time.Unix(clock, 0) }
+		nodes = append(nodes, table)
+	}
+	entries := []struct {
+		at   int64
+		text string
+		err  error
+	}{
+		{1000, "insert 1 alice a ttl 60", nil},
+		{1030, "insert 1 bob b", dberr.ErrDuplicateKey},
+		{1100, "insert 1 carol c ttl 60", nil},
+		{1050, "insert 2 dave d ttl 100", nil}, // Runs at 1100, the clock of the writes does not go back.
+	}
+	for i, entry := range entries {
+		stmt, _ := parser.Parse(entry.text)
+		for _, node := range nodes {
+			if _, err := node.ApplyEntry(ctx, uint64(i+1), time.Unix(entry.at, 0), stmt); !errors.Is(err, entry.err) {
+				t.Fatalf("%s: expected %v. Got: %v", entry.text, entry.err, err)
+			}
+			// Sweeping on the node's own clock would make the next entry find no row where the others do.
+			if _, err := node.DeleteExpired(ctx); err != nil {
+				t.Fatalf("DeleteExpired failed: %v", err)
+			}
+		}
+	}
+	for _, node := range nodes {
+		rows := []types.Row{}
+		for _, id := range []uint32{1, 2} {
+			row, _, _ := uniqueRow(node, id)
+			rows = append(rows, row)
+		}
+		if rows[0].ExpiresAt != 1160 || rows[1].ExpiresAt != 1200 || node.AppliedIndex() != 4 || node.pager.header.AppliedTime != 1100 {
+			t.Fatalf("Expected the ttls to count from the times of the entries. Got: %+v", rows)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+WAL archiving.
+
+Every checkpoint closes a segment of the WAL: the commits appended to it
+since the last checkpoint. With an archiver set, the checkpoint hands it the
+segment once its pages are in the db file, and only empties the WAL if the
+archiver succeeds. If it fails, the checkpoint fails and the WAL is kept, so
+the next checkpoint offers the same commits again along with the newer ones.
+Shipped in order, the segments replay every commit on top of a backup.
+
+A crash between archiving a segment and emptying the WAL offers its commits
+again under a new name, so an archiver must not mind seeing a commit twice.
+*/
+
+// WalSegment is a closed segment of the WAL.
+type WalSegment struct {
+	Path string // The WAL file, which holds the segment until the archiver returns.
+	Name string // A file name for the segment, later segments sort after it.
+	Size int64  // The segment is the first Size bytes of the file, whole frames.
+}
+
+// SetWalArchiver sets archive, which every checkpoint hands the segment of the
+// WAL it closes, or archives none if it is nil.
+func (t *Table) SetWalArchiver(archive func(segment WalSegment) error) error {
+	if t.pager.readOnly {
+		return errReadOnly
+	}
+	if t.pager.inMemory {
+		return fmt.Errorf("an in-memory database has no WAL to archive")
+	}
+	t.pager.archive = archive
+	return nil
+}
+
+// pagerArchive hands the WAL to the archiver before a checkpoint empties it.
+func pagerArchive(pager *Pager) error {
+	if pager.archive == nil {
+		return nil
+	}
+	name := pager.wal.Name()
+	segment := WalSegment{
+		Path: name,
+		Name: fmt.Sprintf("%s-%020d", filepath.Base(name), time.Now().UnixNano()),
+		Size: int64(pager.walLength),
+	}
+	if err := pager.archive(segment); err != nil {
+		return fmt.Errorf("failed to archive wal segment %s: %w", segment.Name, err)
+	}
+	pager.logger.Debug("archived wal segment", "name", segment.Name, "bytes", segment.Size)
+	return nil
+}
+
+/*
+CommandArchiver returns an archiver that runs a shell command for every
+segment, with %p replaced by the path of the WAL file, %f by the name of the
+segment and %% by a single %, such as cp %p /mnt/archive/%f. The command fails
+the checkpoint if it exits with an error.
+*/
+func CommandArchiver(command string) func(segment WalSegment) error {
+	return func(segment WalSegment) error {
+		replacer := strings.NewReplacer("%p", segment.Path, "%f", segment.Name, "%%", "%")
+		output, err := exec.Command("sh", "-c", replacer.Replace(command)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %w: %s", command, err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWalArchiver(t *testing.T) {
+	ctx := context.Background()
+	table, _ := openTestDb(t)
+	segments := []WalSegment{}
+	fail := errors.New("archive is down")
+	archiveErr := fail
+	table.SetWalArchiver(func(segment WalSegment) error {
+		if archiveErr != nil {
+			return archiveErr
+		}
+		data, err := os.ReadFile(segment.Path)
+		if err != nil || int64(len(data)) < segment.Size {
+			t.Fatalf("Expected the WAL to hold the segment. Got %d bytes: %v", len(data), err)
+		}
+		segments = append(segments, segment)
+		return nil
+	})
+	table.Insert(ctx, parseRow("insert 1 user1 user1@example.com"))
+	if err := table.Checkpoint(); !errors.Is(err, fail) {
+		t.Fatalf("Expected the checkpoint to fail with the archiver. Got: %v", err)
+	}
+	size := int64(table.pager.walLength)
+	if size == 0 {
+		t.Fatalf("Expected the WAL to be kept when archiving fails.")
+	}
+	archiveErr = nil
+	table.Insert(ctx, parseRow("insert 2 user2 user2@example.com"))
+	if err := table.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if len(segments) != 1 || segments[0].Size <= size || !strings.HasPrefix(segments[0].Name, "test.db-wal-") {
+		t.Fatalf("Expected one segment holding both commits. Got: %+v", segments)
+	}
+	table.Insert(ctx, parseRow("insert 3 user3 user3@example.com"))
+	table.Close()
+	if len(segments) != 2 || segments[1].Name <= segments[0].Name {
+		t.Fatalf("Expected closing to archive a later segment. Got: %+v", segments)
+	}
+
+	memory, _ := Open(MemoryDbName)
+	if err := memory.SetWalArchiver(CommandArchiver("true")); err == nil {
+		t.Fatalf("Expected an in-memory database to refuse an archiver.")
+	}
+	memory.Close()
+}
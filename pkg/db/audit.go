@@ -0,0 +1,178 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Audit log.
+
+A server records every statement that changes the database, or tries to, in
+an append-only log next to the db file, ending in -audit: who ran it, when,
+its text and how many rows it affected. Every entry is a line of JSON, synced
+before the statement's reply is sent. Once the log reaches its size limit it
+is rotated: it is renamed to -audit.1, the older -audit.1 to -audit.2 and so
+on, and the oldest beyond the number of logs kept is deleted.
+*/
+
+// AuditFileSuffix is appended to the name of the db file to get the audit log.
+const AuditFileSuffix = "-audit"
+
+// AuditEntry is a statement recorded in the audit log.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user,omitempty"`   // Empty if the database has no accounts.
+	Client    string    `json:"client,omitempty"` // The address the statement came from.
+	Statement string    `json:"statement"`
+	Rows      int       `json:"rows"`            // Rows inserted or deleted.
+	Error     string    `json:"error,omitempty"` // Why the statement failed, if it did.
+}
+
+// AuditLog appends entries to an audit log, rotating it. It is safe for concurrent use.
+type AuditLog struct {
+	mu      sync.Mutex
+	name    string
+	file    *os.File
+	size    int64
+	maxSize int64 // Size at which the log is rotated.
+	keep    int   // Rotated logs kept.
+}
+
+// AuditFile returns the name of the audit log of the database, which an in-memory database does not have.
+func (t *Table) AuditFile() (string, error) {
+	if t.pager.inMemory {
+		return "", fmt.Errorf("an in-memory database has no audit log")
+	}
+	return t.pager.file.Name() + AuditFileSuffix, nil
+}
+
+// OpenAuditLog opens the audit log for appending, creating it if needed. It
+// is rotated once it grows past maxSize bytes, keeping keep rotated logs.
+func OpenAuditLog(name string, maxSize int64, keep int) (*AuditLog, error) {
+	log := &AuditLog{name: name, maxSize: maxSize, keep: keep}
+	if err := log.open(); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+func (log *AuditLog) open() error {
+	file, err := os.OpenFile(log.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	log.file, log.size = file, info.Size()
+	return nil
+}
+
+// Write appends an entry, rotating the log first if the entry would take it past its size limit.
+func (log *AuditLog) Write(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if log.file == nil {
+		return fmt.Errorf("the audit log is closed")
+	}
+	if log.size > 0 && log.size+int64(len(line)) > log.maxSize {
+		if err := log.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := log.file.Write(line)
+	log.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return log.file.Sync()
+}
+
+// rotate renames the log and the rotated logs one number up and starts an empty log.
+func (log *AuditLog) rotate() error {
+	if err := log.file.Close(); err != nil {
+		return err
+	}
+	log.file = nil
+	// Renaming over the oldest kept log deletes it.
+	for i := log.keep; i > 1; i-- {
+		err := os.Rename(log.name+"."+strconv.Itoa(i-1), log.name+"."+strconv.Itoa(i))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	var err error
+	if log.keep > 0 {
+		err = os.Rename(log.name, log.name+".1")
+	} else {
+		err = os.Remove(log.name)
+	}
+	if err != nil {
+		return err
+	}
+	return log.open()
+}
+
+// Close closes the log, after which Write fails.
+func (log *AuditLog) Close() error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if log.file == nil {
+		return nil
+	}
+	err := log.file.Close()
+	log.file = nil
+	return err
+}
+
+// ReadAuditLog returns the entries of an audit log and of its rotated logs, oldest first.
+func ReadAuditLog(name string) ([]AuditEntry, error) {
+	names := []string{name}
+	for i := 1; ; i++ {
+		rotated := name + "." + strconv.Itoa(i)
+		if _, err := os.Stat(rotated); err != nil {
+			break
+		}
+		names = append([]string{rotated}, names...)
+	}
+	entries := []AuditEntry{}
+	for _, name := range names {
+		file, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			var entry AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("corrupt audit log %s, line %d: %w", name, line, err)
+			}
+			entries = append(entries, entry)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db"+AuditFileSuffix)
+	// Every entry is about 80 bytes, so each log holds two.
+	log, err := OpenAuditLog(name, 200, 2)
+	if err != nil {
+		t.Fatalf("OpenAuditLog failed: %v", err)
+	}
+	for i := 1; i <= 7; i++ {
+		entry := AuditEntry{Time: time.Unix(int64(i), 0).UTC(), User: "alice", Statement: fmt.Sprintf("delete %d", i), Rows: 1}
+		if err := log.Write(entry); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	log.Close()
+	if err := log.Write(AuditEntry{}); err == nil {
+		t.Fatalf("Expected writing a closed log to fail.")
+	}
+	if _, err := os.Stat(name + ".3"); err == nil {
+		t.Fatalf("Expected only two rotated logs to be kept.")
+	}
+	entries, err := ReadAuditLog(name)
+	if err != nil {
+		t.Fatalf("ReadAuditLog failed: %v", err)
+	}
+	statements := []string{}
+	for _, entry := range entries {
+		statements = append(statements, entry.Statement)
+	}
+	if expected := []string{"delete 3", "delete 4", "delete 5", "delete 6", "delete 7"}; !slices.Equal(statements, expected) {
+		t.Fatalf("Expected %v. Got: %v", expected, statements)
+	}
+
+	// Appending continues the log.
+	log, _ = OpenAuditLog(name, 1<<20, 2)
+	log.Write(AuditEntry{Statement: "delete 8"})
+	log.Close()
+	if entries, _ := ReadAuditLog(name); len(entries) != 6 || entries[5].Statement != "delete 8" {
+		t.Fatalf("Expected the entry to be appended. Got: %v", entries)
+	}
+}
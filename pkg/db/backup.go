@@ -0,0 +1,186 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+)
+
+/*
+Backups.
+
+A backup is a directory holding a chain of files and a manifest. The first
+file is a copy of the db file. Every incremental backup adds a file of
+records, each a page number followed by the page, holding only the pages
+that changed since the previous backup, plus the file header. Restoring
+copies the first file and applies the records of the others in order.
+
+Changed pages are found by their checksums rather than by tracking writes:
+the manifest keeps the checksum of every page as of the last backup, and
+every page carries its own checksum, so a page whose checksum differs was
+written since. This needs no state in the db file and still works after the
+database was closed and reopened between backups.
+*/
+
+const (
+	backupManifestName = "manifest.json"
+	backupRecordSize   = 4 + constants.PageSize // Page number, then the page.
+)
+
+type backupManifest struct {
+	Files     []string `json:"files"`     // In the order they are restored.
+	Checksums []uint32 `json:"checksums"` // Of every page as of the last backup.
+}
+
+// BackupInfo describes a backup that was written.
+type BackupInfo struct {
+	File  string // Name of the file added to the backup directory.
+	Pages int    // Pages written to it, not counting the file header.
+}
+
+/*
+Backup writes a backup of the database into dir, creating it if needed. A
+full backup starts a new chain, replacing any backup in dir. An incremental
+one adds the pages changed since the last backup in dir, which must exist.
+Committed changes are checkpointed first, so the db file is complete.
+*/
+func (t *Table) Backup(dir string, incremental bool) (BackupInfo, error) {
+	pager := t.pager
+	if pager.inTxn {
+		return BackupInfo{}, fmt.Errorf("cannot back up inside a transaction")
+	}
+	if !pager.readOnly {
+		if err := pagerCheckpoint(pager); err != nil {
+			return BackupInfo{}, err
+		}
+	} else if pager.walLength != 0 {
+		return BackupInfo{}, fmt.Errorf("cannot back up a read-only database with uncheckpointed commits")
+	}
+
+	manifest := backupManifest{}
+	if incremental {
+		data, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+		if err != nil {
+			return BackupInfo{}, fmt.Errorf("no full backup in %s to add to: %w", dir, err)
+		}
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return BackupInfo{}, fmt.Errorf("corrupt backup manifest: %w", err)
+		}
+	} else if err := os.MkdirAll(dir, 0777); err != nil {
+		return BackupInfo{}, err
+	}
+
+	// The header and every page, straight from the db file.
+	numPages := int((pager.fileLength - constants.FileHeaderSize) / constants.PageSize)
+	data := make([]byte, pageOffset(uint32(numPages)))
+	if _, err := pager.file.ReadAt(data, 0); err != nil {
+		return BackupInfo{}, fmt.Errorf("error reading db file: %w", err)
+	}
+	checksums := make([]uint32, numPages)
+	for i := range checksums {
+		page := data[pageOffset(uint32(i)):pageOffset(uint32(i+1))]
+		checksums[i] = binary.LittleEndian.Uint32(page[constants.PageChecksumOffset:])
+	}
+
+	info := BackupInfo{File: "0.full", Pages: numPages}
+	out := data
+	if incremental {
+		info.File, info.Pages = fmt.Sprintf("%d.incr", len(manifest.Files)), 0
+		out = appendBackupRecord(nil, constants.WalHeaderPageNum, data[:constants.FileHeaderSize])
+		for i, checksum := range checksums {
+			if i < len(manifest.Checksums) && manifest.Checksums[i] == checksum {
+				continue
+			}
+			out = appendBackupRecord(out, uint32(i), data[pageOffset(uint32(i)):pageOffset(uint32(i+1))])
+			info.Pages++
+		}
+	} else {
+		manifest.Files = nil
+	}
+	if err := writeFileSynced(filepath.Join(dir, info.File), out); err != nil {
+		return BackupInfo{}, err
+	}
+
+	// The manifest is replaced last, so a backup that failed halfway is not part of the chain.
+	manifest.Files = append(manifest.Files, info.File)
+	manifest.Checksums = checksums
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	tmpName := filepath.Join(dir, backupManifestName+".tmp")
+	if err := writeFileSynced(tmpName, encoded); err != nil {
+		return BackupInfo{}, err
+	}
+	return info, os.Rename(tmpName, filepath.Join(dir, backupManifestName))
+}
+
+func appendBackupRecord(out []byte, pageNum uint32, page []byte) []byte {
+	out = binary.LittleEndian.AppendUint32(out, pageNum)
+	return append(out, page...)
+}
+
+// RestoreBackup rebuilds the db file filename, which must not exist, from the backup in dir.
+func RestoreBackup(dir string, filename string) error {
+	data, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+	if err != nil {
+		return fmt.Errorf("no backup in %s: %w", dir, err)
+	}
+	manifest := backupManifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("corrupt backup manifest: %w", err)
+	}
+	if len(manifest.Files) == 0 {
+		return fmt.Errorf("corrupt backup manifest: no files")
+	}
+
+	file, err := os.ReadFile(filepath.Join(dir, manifest.Files[0]))
+	if err != nil {
+		return err
+	}
+	for _, name := range manifest.Files[1:] {
+		records, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if len(records)%int(backupRecordSize) != 0 {
+			return fmt.Errorf("backup file %s is truncated", name)
+		}
+		for ; len(records) > 0; records = records[backupRecordSize:] {
+			pageNum := binary.LittleEndian.Uint32(records)
+			offset := int64(0)
+			if pageNum != constants.WalHeaderPageNum {
+				offset = pageOffset(pageNum)
+			}
+			if end := offset + int64(constants.PageSize); end > int64(len(file)) {
+				file = append(file, make([]byte, end-int64(len(file)))...)
+			}
+			copy(file[offset:], records[4:backupRecordSize])
+		}
+	}
+
+	if _, err := os.Stat(filename); err == nil {
+		return fmt.Errorf("%s already exists", filename)
+	}
+	return writeFileSynced(filename, file)
+}
+
+func writeFileSynced(name string, data []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupIncremental(t *testing.T) {
+	dir := t.TempDir()
+	dbName, restored := filepath.Join(dir, "test.db"), filepath.Join(dir, "restored.db")
+	dir = filepath.Join(dir, "test.backup")
+	table, _ := Open(dbName)
+	defer table.Close()
+	for i := 1; i <= 40; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)))
+	}
+	if _, err := table.Backup(dir, true); err == nil {
+		t.Fatalf("Expected an incremental backup without a full one to fail.")
+	}
+	full, err := table.Backup(dir, false)
+	if err != nil || full.File != "0.full" || full.Pages != int(table.pager.numPages) {
+		t.Fatalf("Unexpected full backup: %+v, %v", full, err)
+	}
+
+	// Only the last leaf changes, and the row counts of the two nodes above it.
+	table.Insert(context.Background(), parseRow("insert 41 user41 user41@example.com"))
+	incr, err := table.Backup(dir, true)
+	if err != nil || incr.File != "1.incr" || incr.Pages != 3 {
+		t.Fatalf("Expected three changed pages. Got: %+v, %v", incr, err)
+	}
+	table.Delete(context.Background(), 1)
+	if _, err := table.Backup(dir, true); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	if err := RestoreBackup(dir, restored); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if err := RestoreBackup(dir, restored); err == nil || err.Error() != restored+" already exists" {
+		t.Fatalf("Expected restoring over a file to fail. Got: %v", err)
+	}
+	restoredTable, err := Open(restored)
+	if err != nil {
+		t.Fatalf("Failed to open the restored db: %v", err)
+	}
+	defer restoredTable.Close()
+	keys := checkTable(t, restoredTable)
+	if len(keys) != 40 || keys[0] != 2 || keys[39] != 41 {
+		t.Fatalf("Expected rows 2 to 41. Got: %v", keys)
+	}
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"context"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// Tx applies the writes of a Batch.
+type Tx struct {
+	ctx   context.Context
+	table *Table
+}
+
+/*
+Batch runs fn, which inserts and deletes rows through tx, and commits all of
+its writes at once, so the WAL is written and synced a single time rather than
+once per row. If fn returns an error, including one returned by a write, none
+of the writes are applied. Inside an explicit transaction the writes become
+part of it instead.
+*/
+func (t *Table) Batch(ctx context.Context, fn func(tx *Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.write(func() error {
+		return fn(&Tx{ctx: ctx, table: t})
+	})
+}
+
+// Insert adds a row, failing if a row with the same id exists.
+func (tx *Tx) Insert(row types.Row) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	return insertRow(tx.table.treeOf(row.Id), &row)
+}
+
+// Delete removes the row with the given id.
+func (tx *Tx) Delete(id uint32) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	return deleteRow(tx.table.treeOf(id), id)
+}
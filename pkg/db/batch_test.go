@@ -0,0 +1,43 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	wal := &countingFile{pagerFile: table.pager.wal}
+	table.pager.wal = wal
+
+	err := table.Batch(context.Background(), func(tx *Tx) error {
+		for i := 1; i <= 50; i++ {
+			if err := tx.Insert(parseRow(fmt.Sprintf("insert %d u e", i))); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(7)
+	})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	if wal.syncs != 1 {
+		t.Fatalf("Expected the batch to sync the WAL once. Got: %d", wal.syncs)
+	}
+	if keys := checkTable(t, table); len(keys) != 49 {
+		t.Fatalf("Expected 49 rows. Got: %d", len(keys))
+	}
+
+	err = table.Batch(context.Background(), func(tx *Tx) error {
+		tx.Delete(1)
+		return tx.Insert(parseRow("insert 2 u e"))
+	})
+	if err == nil || err.Error() != "duplicate key" {
+		t.Fatalf("Expected a duplicate key error. Got: %v", err)
+	}
+	if keys := checkTable(t, table); len(keys) != 49 || keys[0] != 1 {
+		t.Fatalf("Expected a failed batch to change nothing. Got: %v", keys)
+	}
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+)
+
+/*
+Bloom filter.
+
+The file header of a new db file holds a bloom filter of the ids of its rows,
+in the space the header block has to spare. Every insert sets the bits of its
+id, so a lookup of an id whose bits are not all set can tell the row does not
+exist without descending any tree, which matters once the tree is no longer
+cached. A lookup the filter can not rule out descends as usual.
+
+The filter is committed with the header at the end of every commit. Rolling
+back does not clear the bits of the undone inserts, and deletes leave the bits
+of their ids set, since other ids may share them: both only make the filter
+rule out fewer ids, until compact builds a fresh one in the new file. The
+header is not encrypted, so encrypted files, and those dbfsck writes, have no
+filter and always descend.
+*/
+
+// bloomPositions returns the bits of an id, derived from two halves of a 64-bit hash.
+func bloomPositions(id uint32) [constants.BloomHashes]uint32 {
+	h := uint64(id) * 0x9e3779b97f4a7c15
+	h ^= h >> 32
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 29
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	var positions [constants.BloomHashes]uint32
+	for i := range positions {
+		positions[i] = (h1 + uint32(i)*h2) % constants.BloomBits
+	}
+	return positions
+}
+
+// bloomAdd sets the bits of an inserted id.
+func bloomAdd(pager *Pager, id uint32) {
+	bloom := pager.header.Bloom
+	if bloom == nil {
+		return
+	}
+	for _, bit := range bloomPositions(id) {
+		bloom[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// bloomMayContain reports whether a row with the id may exist. If it returns
+// false there is none, and the lookup is counted as skipped.
+func bloomMayContain(pager *Pager, id uint32) bool {
+	bloom := pager.header.Bloom
+	if bloom == nil {
+		return true
+	}
+	for _, bit := range bloomPositions(id) {
+		if bloom[bit/8]&(1<<(bit%8)) == 0 {
+			pager.bloomSkips++
+			return false
+		}
+	}
+	return true
+}
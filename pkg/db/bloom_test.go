@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestBloomFilter(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	for i := 1; i <= 200; i += 2 {
+		table.Insert(ctx, parseRow(fmt.Sprintf("insert %d user%d e", i, i)))
+	}
+	// A rolled back insert leaves its bits set, which only costs a descent.
+	table.Begin()
+	table.Insert(ctx, parseRow("insert 1000 x e"))
+	table.Rollback()
+
+	lookup := func(id int) int {
+		stmt, _ := parser.Parse(fmt.Sprintf("select where id = %d", id))
+		found := 0
+		table.Execute(ctx, stmt, func([]any) error { found++; return nil })
+		return found
+	}
+	fetches := table.pager.cacheHits + table.pager.cacheMisses
+	for i := 2; i <= 200; i += 2 {
+		if lookup(i) != 0 {
+			t.Fatalf("Expected no row %d.", i)
+		}
+	}
+	if skips := table.pager.bloomSkips; skips < 95 {
+		t.Fatalf("Expected the filter to rule out most of the 100 absent ids. Got: %d", skips)
+	}
+	if fetched := table.pager.cacheHits + table.pager.cacheMisses - fetches; fetched > 20 {
+		t.Fatalf("Expected lookups of absent ids to fetch few pages. Got: %d", fetched)
+	}
+	if err := table.Delete(ctx, 2); err == nil || err.Error() != "key 2 does not exist" {
+		t.Fatalf("Expected deleting an absent id to fail. Got: %v", err)
+	}
+
+	// The filter is kept in the file header.
+	table.Close()
+	table, _ = Open(dbName)
+	defer table.Close()
+	for i := 1; i <= 200; i += 2 {
+		if lookup(i) != 1 {
+			t.Fatalf("Expected to find row %d after reopening.", i)
+		}
+	}
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected no problems. Got: %v", problems)
+	}
+	if stats, _ := table.Stats(); stats.BloomSkips != 0 {
+		t.Fatalf("Expected no skips when every id exists. Got: %d", stats.BloomSkips)
+	}
+}
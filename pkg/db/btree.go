@@ -0,0 +1,1121 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// Cursor is a position in the table. Embedders get one from Table.Cursor, see cursor.go.
+type Cursor struct {
+	table      *Table // The tree the cursor is in, a partition of owner's if it is partitioned.
+	owner      *Table // The table of a cursor from Table.Cursor, nil for the B-tree code's own.
+	pageNum    uint32
+	cellNum    uint32
+	endOfTable bool // Indicates position one past the last element.
+	pinned     bool // Whether the cursor holds a pin on pageNum, see Cursor.Close.
+	// The id of the row a cursor from Table.Cursor is at, and the pager's
+	// pageWrites when it got there. Once pages changed, pageNum and cellNum
+	// may point elsewhere, and the cursor finds its row again by the key.
+	key        uint32
+	pageWrites uint64
+	err        error // The error that ended the last Range or All, see Cursor.Err.
+}
+
+func tableStart(table *Table) (*Cursor, error) {
+	// Looks for the smallest allowed id. Returns the smallest actual id >= 0.
+	return tableSeek(table, 0)
+}
+
+// tableSeek returns a cursor at the row with the smallest key >= key.
+func tableSeek(table *Table, key uint32) (*Cursor, error) {
+	cursor, err := tableFind(table, key)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		node, err := getPage(table.pager, cursor.pageNum)
+		if err != nil {
+			return nil, err
+		}
+		if cursor.cellNum < binary.LittleEndian.Uint32(leafNodeNumCells(node)) {
+			return cursor, nil
+		}
+		// Every key in this leaf is smaller, the row is at the start of the next one.
+		nextPageNum := binary.LittleEndian.Uint32(leafNodeNextLeaf(node))
+		if nextPageNum == 0 {
+			cursor.endOfTable = true
+			return cursor, nil
+		}
+		cursor.pageNum = nextPageNum
+		cursor.cellNum = 0
+	}
+}
+
+// tableSeekBefore returns a cursor at the row with the largest key <= key.
+// If there is none, the cursor is at the end of the table.
+func tableSeekBefore(table *Table, key uint32) (*Cursor, error) {
+	cursor, err := tableFind(table, key)
+	if err != nil {
+		return nil, err
+	}
+	node, err := getPage(table.pager, cursor.pageNum)
+	if err != nil {
+		return nil, err
+	}
+	if cursor.cellNum < binary.LittleEndian.Uint32(leafNodeNumCells(node)) &&
+		binary.LittleEndian.Uint32(leafNodeKey(node, cursor.cellNum)) == key {
+		return cursor, nil
+	}
+	// The cursor is where key would be inserted, the row before it is the one.
+	return cursor, cursor.retreat()
+}
+
+func tableFind(table *Table, key uint32) (*Cursor, error) {
+	rootPageNum := table.rootPageNum
+	rootNode, err := getPage(table.pager, rootPageNum)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTreeNode(rootNode, rootPageNum); err != nil {
+		return nil, err
+	}
+	nodeType := getNodeType(rootNode)
+
+	if nodeType == types.NodeLeaf {
+		return leafNodeFind(table, rootPageNum, key)
+	} else {
+		return internalNodeFind(table, rootPageNum, key)
+	}
+}
+
+// Returns the index of the child which should contain the given key.
+func internalNodeFindChild(node []byte, key uint32) uint32 {
+	numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+	// Binary search
+	minIdx := uint32(0)
+	maxIdx := numKeys
+
+	for minIdx != maxIdx {
+		midIdx := (maxIdx-minIdx)/2 + minIdx // mid without overflow
+		keyToRight := binary.LittleEndian.Uint32(internalNodeKey(node, midIdx))
+		if keyToRight >= key {
+			maxIdx = midIdx
+		} else {
+			minIdx = midIdx + 1
+		}
+	}
+	return minIdx
+}
+
+func internalNodeFind(table *Table, pageNum uint32, key uint32) (*Cursor, error) {
+	node, err := getPage(table.pager, pageNum)
+	if err != nil {
+		return nil, err
+	}
+
+	childIdx := internalNodeFindChild(node, key)
+	childNumBytes, err := internalNodeChild(node, childIdx)
+	if err != nil {
+		return nil, err
+	}
+	childNum := binary.LittleEndian.Uint32(childNumBytes)
+	child, err := getPage(table.pager, childNum)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTreeNode(child, childNum); err != nil {
+		return nil, err
+	}
+	t := getNodeType(child)
+	if t == types.NodeLeaf {
+		return leafNodeFind(table, childNum, key)
+	}
+	return internalNodeFind(table, childNum, key)
+}
+
+func leafNodeFind(table *Table, pageNum uint32, key uint32) (*Cursor, error) {
+	node, err := getPage(table.pager, pageNum)
+	if err != nil {
+		return nil, err
+	}
+	numCells := binary.LittleEndian.Uint32(leafNodeNumCells(node))
+
+	cursor := Cursor{
+		table:   table,
+		pageNum: pageNum,
+	}
+
+	// Binary search
+	minIdx := uint32(0)
+	onePastMaxIdx := numCells
+	for onePastMaxIdx != minIdx {
+		midIdx := (onePastMaxIdx-minIdx)/2 + minIdx // mid without overflow
+		keyAtIdx := binary.LittleEndian.Uint32(leafNodeKey(node, midIdx))
+		if key == keyAtIdx {
+			cursor.cellNum = midIdx
+			return &cursor, nil
+		}
+		if key < keyAtIdx {
+			onePastMaxIdx = midIdx
+		} else {
+			minIdx = midIdx + 1
+		}
+	}
+
+	cursor.cellNum = minIdx
+	return &cursor, nil
+}
+
+/*
+checkTreeNode verifies that a page reached from the root is a node of a
+B-tree holding no more cells than fit, so that a file whose pages hold
+something else fails with an error rather than being walked out of bounds.
+*/
+func checkTreeNode(node []byte, pageNum uint32) error {
+	switch getNodeType(node) {
+	case types.NodeLeaf:
+		if numCells := binary.LittleEndian.Uint32(leafNodeNumCells(node)); numCells > constants.LeafNodeMaxCells {
+			return dberr.Errorf(dberr.ErrCorrupt, "page %d has %d cells, at most %d fit - the file is corrupt", pageNum, numCells, constants.LeafNodeMaxCells)
+		}
+	case types.NodeInternal:
+		if numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node)); numKeys > constants.InternalNodeMaxCells {
+			return dberr.Errorf(dberr.ErrCorrupt, "page %d has %d keys, at most %d fit - the file is corrupt", pageNum, numKeys, constants.InternalNodeMaxCells)
+		}
+	default:
+		return dberr.Errorf(dberr.ErrCorrupt, "page %d is not a B-tree node - the file is corrupt", pageNum)
+	}
+	return nil
+}
+
+func getNodeType(node []byte) types.NodeType {
+	return types.NodeType(node[constants.NodeTypeOffset])
+}
+
+func setNodeType(node []byte, nt types.NodeType) {
+	node[constants.NodeTypeOffset] = byte(nt)
+}
+
+func leafNodeNumCells(node []byte) []byte {
+	return node[constants.LeafNodeNumCellsOffset : constants.LeafNodeNumCellsOffset+constants.LeafNodeNumCellsSize]
+}
+
+func leafNodeNextLeaf(node []byte) []byte {
+	return node[constants.LeafNodeNextLeafOffset : constants.LeafNodeNextLeafOffset+constants.LeafNodeNextLeafSize]
+}
+
+func leafNodeCell(node []byte, cellNum uint32) []byte {
+	offset := constants.LeafNodeHeaderSize + cellNum*constants.LeafNodeCellSize
+	return node[offset : offset+constants.LeafNodeCellSize]
+}
+
+func leafNodeKey(node []byte, cellNum uint32) []byte {
+	return leafNodeCell(node, cellNum)
+}
+
+func leafNodeValue(node []byte, cellNum uint32) []byte {
+	return leafNodeCell(node, cellNum)[constants.LeafNodeKeySize : constants.LeafNodeKeySize+constants.LeafNodeValueSize]
+}
+
+func initializeLeafNode(node []byte) {
+	setNodeType(node, types.NodeLeaf)
+	setNodeRoot(node, false)
+	binary.LittleEndian.PutUint32(leafNodeNumCells(node), 0)
+	binary.LittleEndian.PutUint32(leafNodeNextLeaf(node), 0) // 0 represents no sibling
+}
+
+func initializeInternalNode(node []byte) {
+	setNodeType(node, types.NodeInternal)
+	setNodeRoot(node, false)
+	binary.LittleEndian.PutUint32(internalNodeNumKeys(node), 0)
+	/*
+		Necessary because the root page number is 0. By not initializing the internal node's
+		right child to an invalid page number, we may end up with 0 as the node's right child,
+		which makes the node the parent of the root.
+	*/
+	binary.LittleEndian.PutUint32(internalNodeRightChild(node), constants.InvalidPageNum)
+}
+
+func internalNodeNumKeys(node []byte) []byte {
+	return node[constants.InternalNodeNumKeysOffset : constants.InternalNodeNumKeysOffset+constants.InternalNodeNumKeysSize]
+}
+
+func internalNodeRightChild(node []byte) []byte {
+	return node[constants.InternalNodeRightChildOffset : constants.InternalNodeRightChildOffset+constants.InternalNodeRightChildSize]
+}
+
+func internalNodeCell(node []byte, cellNum uint32) []byte {
+	offset := constants.InternalNodeHeaderSize + cellNum*constants.InternalNodeCellSize
+	res := node[offset : offset+constants.InternalNodeCellSize]
+	return res
+}
+
+func internalNodeChild(node []byte, childNum uint32) ([]byte, error) {
+	numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+	if childNum > numKeys {
+		return nil, fmt.Errorf("tried to access childNum %d > numKeys %d", childNum, numKeys)
+	} else if childNum == numKeys {
+		rightChild := internalNodeRightChild(node)
+		rightChildNum := binary.LittleEndian.Uint32(rightChild)
+		if rightChildNum == constants.InvalidPageNum {
+			return nil, fmt.Errorf("tried to access right child of node, but it was invalid page")
+		}
+		return rightChild, nil
+	}
+
+	child := internalNodeCell(node, childNum)
+	childPageNum := binary.LittleEndian.Uint32(child)
+	if childPageNum == constants.InvalidPageNum {
+		return nil, fmt.Errorf("tried to access child %d of node, but it was invalid page", childNum)
+	}
+	return child, nil
+}
+
+func internalNodeKey(node []byte, keyNum uint32) []byte {
+	return internalNodeCell(node, keyNum)[constants.InternalNodeChildSize : constants.InternalNodeChildSize+constants.InternalNodeKeySize]
+}
+
+// internalNodeCount returns the bytes holding the number of rows under a child,
+// childNum numKeys being the right child.
+func internalNodeCount(node []byte, childNum uint32) []byte {
+	if childNum == binary.LittleEndian.Uint32(internalNodeNumKeys(node)) {
+		return node[constants.InternalNodeRightCountOffset : constants.InternalNodeRightCountOffset+constants.InternalNodeRightCountSize]
+	}
+	offset := constants.InternalNodeChildSize + constants.InternalNodeKeySize
+	return internalNodeCell(node, childNum)[offset : offset+constants.InternalNodeCountSize]
+}
+
+// nodeRows returns the number of rows under a node, which its parent keeps for it.
+func nodeRows(node []byte) uint32 {
+	if getNodeType(node) == types.NodeLeaf {
+		return binary.LittleEndian.Uint32(leafNodeNumCells(node))
+	}
+	rows := uint32(0)
+	numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+	for i := uint32(0); i <= numKeys; i++ {
+		rows += binary.LittleEndian.Uint32(internalNodeCount(node, i))
+	}
+	return rows
+}
+
+/*
+recountRows sets the row counts of the internal nodes of the subtree at
+pageNum from its leaves up and returns the rows under it. Splits move whole
+subtrees between nodes, so they recount the tree once the split is done
+rather than carrying the counts along; only nodes whose counts changed are
+marked dirty.
+*/
+func recountRows(pager *Pager, pageNum uint32) (uint32, error) {
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return 0, err
+	}
+	if getNodeType(node) == types.NodeLeaf {
+		return nodeRows(node), nil
+	}
+	rows := uint32(0)
+	numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+	for i := uint32(0); i <= numKeys; i++ {
+		childNumBytes, err := internalNodeChild(node, i)
+		if err != nil {
+			return 0, err
+		}
+		childRows, err := recountRows(pager, binary.LittleEndian.Uint32(childNumBytes))
+		if err != nil {
+			return 0, err
+		}
+		if binary.LittleEndian.Uint32(internalNodeCount(node, i)) != childRows {
+			binary.LittleEndian.PutUint32(internalNodeCount(node, i), childRows)
+			markPageDirty(pager, pageNum)
+		}
+		rows += childRows
+	}
+	return rows, nil
+}
+
+// countRows adds delta to the row counts the ancestors of a leaf keep for it,
+// after a row was inserted into or deleted from it without a split.
+func countRows(pager *Pager, pageNum uint32, delta int) error {
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return err
+	}
+	for !isNodeRoot(node) {
+		parentPageNum := binary.LittleEndian.Uint32(nodeParent(node))
+		parent, err := getPage(pager, parentPageNum)
+		if err != nil {
+			return err
+		}
+		numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(parent))
+		childNum := numKeys
+		for i := uint32(0); i < numKeys; i++ {
+			if binary.LittleEndian.Uint32(internalNodeCell(parent, i)) == pageNum {
+				childNum = i
+			}
+		}
+		count := internalNodeCount(parent, childNum)
+		binary.LittleEndian.PutUint32(count, binary.LittleEndian.Uint32(count)+uint32(delta))
+		markPageDirty(pager, parentPageNum)
+		node, pageNum = parent, parentPageNum
+	}
+	return nil
+}
+
+// nodeParent returns the bytes containing the page number of this node's parent
+func nodeParent(node []byte) []byte {
+	return node[constants.ParentPointerOffset : constants.ParentPointerOffset+constants.ParentPointerSize]
+}
+
+func updateInternalNodeKey(node []byte, oldKey uint32, newKey uint32) {
+	oldChildIdx := internalNodeFindChild(node, oldKey)
+	binary.LittleEndian.PutUint32(internalNodeKey(node, oldChildIdx), newKey)
+}
+
+func isNodeRoot(node []byte) bool {
+	value := uint8(node[constants.IsRootOffset])
+	return value == 1
+}
+
+func setNodeRoot(node []byte, isRoot bool) {
+	if isRoot {
+		node[constants.IsRootOffset] = 1
+	} else {
+		node[constants.IsRootOffset] = 0
+	}
+}
+
+func getNodeMaxKey(pager *Pager, node []byte) (uint32, error) {
+	if getNodeType(node) == types.NodeLeaf {
+		numCells := binary.LittleEndian.Uint32(leafNodeNumCells(node))
+		if numCells == 0 {
+			// A leaf emptied by deletes still holds the key of its last row in its
+			// first cell, which is the key its parent has for it.
+			return binary.LittleEndian.Uint32(leafNodeKey(node, 0)), nil
+		}
+		return binary.LittleEndian.Uint32(leafNodeKey(node, numCells-1)), nil
+	}
+	rightChildPageNum := binary.LittleEndian.Uint32(internalNodeRightChild(node))
+	rightChild, err := getPage(pager, rightChildPageNum)
+	if err != nil {
+		return 0, err
+	}
+	return getNodeMaxKey(pager, rightChild)
+}
+
+// Until we start recycling free pages, new pages will always go onto the end of the db file.
+func getUnusedPageNum(pager *Pager) (uint32, error) {
+	if pager.numPages >= constants.TableMaxPages {
+		return 0, dberr.ErrTableFull
+	}
+	return pager.numPages, nil
+}
+
+func internalNodeSplitAndInsert(table *Table, parentPageNum uint32, childPageNum uint32) error {
+	oldPageNum := parentPageNum
+	oldNode, err := getPage(table.pager, parentPageNum)
+	if err != nil {
+		return err
+	}
+	oldMax, err := getNodeMaxKey(table.pager, oldNode)
+	if err != nil {
+		return err
+	}
+	markPageDirty(table.pager, oldPageNum)
+	table.pager.splits++
+
+	child, err := getPage(table.pager, childPageNum)
+	if err != nil {
+		return err
+	}
+	childMax, err := getNodeMaxKey(table.pager, child)
+	if err != nil {
+		return err
+	}
+	markPageDirty(table.pager, childPageNum)
+
+	newPageNum, err := getUnusedPageNum(table.pager)
+	if err != nil {
+		return err
+	}
+
+	/*
+	  Declaring a flag before updating pointers which
+	  records whether this operation involves splitting the root -
+	  if it does, we will insert our newly created node during
+	  the step where the table's new root is created. If it does
+	  not, we have to insert the newly created node into its parent
+	  after the old node's keys have been transferred over. We are not
+	  able to do this if the newly created node's parent is not a newly
+	  initialized root node, because in that case its parent may have existing
+	  keys aside from our old node which we are splitting. If that is true, we
+	  need to find a place for our newly created node in its parent, and we
+	  cannot insert it at the correct index if it does not yet have any keys
+	*/
+
+	splittingRoot := isNodeRoot(oldNode)
+
+	var parent []byte
+	var newNode []byte
+	if splittingRoot {
+		if err := createNewRoot(table, newPageNum); err != nil {
+			return err
+		}
+		if parent, err = getPage(table.pager, table.rootPageNum); err != nil {
+			return err
+		}
+		/*
+			If we are splitting the root, we need to update the oldNode
+			to point to the new root's left child, newPageNum will already
+			point to the new root's right child.
+		*/
+		leftChild, err := internalNodeChild(parent, 0)
+		if err != nil {
+			return err
+		}
+		oldPageNum = binary.LittleEndian.Uint32(leftChild)
+		if oldNode, err = getPage(table.pager, oldPageNum); err != nil {
+			return err
+		}
+	} else {
+		parentPageNum := binary.LittleEndian.Uint32(nodeParent(oldNode))
+		if parent, err = getPage(table.pager, parentPageNum); err != nil {
+			return err
+		}
+		markPageDirty(table.pager, parentPageNum)
+		if newNode, err = getPage(table.pager, newPageNum); err != nil {
+			return err
+		}
+		initializeInternalNode(newNode)
+		markPageDirty(table.pager, newPageNum)
+	}
+
+	oldNumKeys := internalNodeNumKeys(oldNode)
+
+	curPageNum := binary.LittleEndian.Uint32(internalNodeRightChild(oldNode))
+	cur, err := getPage(table.pager, curPageNum)
+	if err != nil {
+		return err
+	}
+
+	// First put right child into the new node and set right child of node to invalid page number.
+	if err := internalNodeInsert(table, newPageNum, curPageNum); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(nodeParent(cur), newPageNum)
+	markPageDirty(table.pager, curPageNum)
+	binary.LittleEndian.PutUint32(internalNodeRightChild(oldNode), constants.InvalidPageNum)
+	// For each key until you get to the middle key, move the child to the new node.
+	for i := constants.InternalNodeMaxCells - 1; i > constants.InternalNodeMaxCells/2; i-- {
+		curPageNumBytes, err := internalNodeChild(oldNode, i)
+		if err != nil {
+			return err
+		}
+		curPageNum = binary.LittleEndian.Uint32(curPageNumBytes)
+		if cur, err = getPage(table.pager, curPageNum); err != nil {
+			return err
+		}
+
+		if err := internalNodeInsert(table, newPageNum, curPageNum); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(nodeParent(cur), newPageNum)
+		markPageDirty(table.pager, curPageNum)
+
+		oldNumKeysNum := binary.LittleEndian.Uint32(oldNumKeys)
+		binary.LittleEndian.PutUint32(nodeParent(cur), newPageNum)
+		binary.LittleEndian.PutUint32(oldNumKeys, oldNumKeysNum-1)
+	}
+
+	/*
+		Set child before middle key, which is now the highest key, to be the node's right child
+		and decrement number of keys.
+	*/
+	oldNumKeysNum := binary.LittleEndian.Uint32(oldNumKeys)
+	middleChild, err := internalNodeChild(oldNode, oldNumKeysNum-1)
+	if err != nil {
+		return err
+	}
+	copy(internalNodeRightChild(oldNode), middleChild)
+	binary.LittleEndian.PutUint32(oldNumKeys, oldNumKeysNum-1)
+
+	/*
+		Determine which of the two nodes after the split should contain the child
+		and insert it there.
+	*/
+	maxAfterSplit, err := getNodeMaxKey(table.pager, oldNode)
+	if err != nil {
+		return err
+	}
+	destPageNum := newPageNum
+	if childMax < maxAfterSplit {
+		destPageNum = oldPageNum
+	}
+
+	if err := internalNodeInsert(table, destPageNum, childPageNum); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(nodeParent(child), destPageNum)
+
+	newOldMax, err := getNodeMaxKey(table.pager, oldNode)
+	if err != nil {
+		return err
+	}
+	updateInternalNodeKey(parent, oldMax, newOldMax)
+
+	if !splittingRoot {
+		// Set the parent first, inserting may split the parent and move the new node elsewhere.
+		parentNum := binary.LittleEndian.Uint32(nodeParent(oldNode))
+		copy(nodeParent(newNode), nodeParent(oldNode))
+		return internalNodeInsert(table, parentNum, newPageNum)
+	}
+	return nil
+}
+
+// Inserts a new child key pair to parent that corresponds to the child.
+func internalNodeInsert(table *Table, parentPageNum uint32, childPageNum uint32) error {
+	parent, err := getPage(table.pager, parentPageNum)
+	if err != nil {
+		return err
+	}
+	child, err := getPage(table.pager, childPageNum)
+	if err != nil {
+		return err
+	}
+
+	childMaxKey, err := getNodeMaxKey(table.pager, child)
+	if err != nil {
+		return err
+	}
+	index := internalNodeFindChild(parent, childMaxKey)
+
+	// Increment number of keys in parent.
+	originalNumKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(parent))
+
+	if originalNumKeys >= constants.InternalNodeMaxCells {
+		return internalNodeSplitAndInsert(table, parentPageNum, childPageNum)
+	}
+	markPageDirty(table.pager, parentPageNum)
+
+	rightChildPageNum := binary.LittleEndian.Uint32(internalNodeRightChild(parent))
+	// Internal node with a right child of INVALID_PAGE_NUM is empty.
+	if rightChildPageNum == constants.InvalidPageNum {
+		binary.LittleEndian.PutUint32(internalNodeRightChild(parent), childPageNum)
+		return nil
+	}
+
+	rightChild, err := getPage(table.pager, rightChildPageNum)
+	if err != nil {
+		return err
+	}
+	rightChildMaxKey, err := getNodeMaxKey(table.pager, rightChild)
+	if err != nil {
+		return err
+	}
+	/*
+		If we are laready at the max number of cells for a node, we cannot increment
+		before splitting. Incrementing without inserting a new key/child pair
+		and immediately calling internalNodeSplitAndInsert hsa the effect of creating
+		a new key at (maxCells + 1) with an unitialized value.
+	*/
+	binary.LittleEndian.PutUint32(internalNodeNumKeys(parent), originalNumKeys+1)
+
+	if childMaxKey > rightChildMaxKey {
+		// Replace right child, whose row count moves into its cell.
+		binary.LittleEndian.PutUint32(internalNodeCell(parent, originalNumKeys), rightChildPageNum)
+		binary.LittleEndian.PutUint32(internalNodeKey(parent, originalNumKeys), rightChildMaxKey)
+		copy(internalNodeCount(parent, originalNumKeys), parent[constants.InternalNodeRightCountOffset:])
+		binary.LittleEndian.PutUint32(internalNodeRightChild(parent), childPageNum)
+	} else {
+		// Make room for a new cell.
+		for i := originalNumKeys; i > index; i-- {
+			dest := internalNodeCell(parent, i)
+			source := internalNodeCell(parent, i-1)
+			copy(dest, source)
+		}
+		// Something changes here for unknown reasons!?
+		binary.LittleEndian.PutUint32(internalNodeCell(parent, index), childPageNum)
+		binary.LittleEndian.PutUint32(internalNodeKey(parent, index), childMaxKey)
+	}
+	return nil
+}
+
+/*
+Handle splitting the root.
+
+Old root copied to new page, becomes left child.
+Address of right child passed in.
+Re-initialize root page to contain the new root node.
+New root node points to two children.
+*/
+func createNewRoot(table *Table, rightChildPageNum uint32) error {
+	root, err := getPage(table.pager, table.rootPageNum)
+	if err != nil {
+		return err
+	}
+	rightChild, err := getPage(table.pager, rightChildPageNum)
+	if err != nil {
+		return err
+	}
+	leftChildPageNum, err := getUnusedPageNum(table.pager)
+	if err != nil {
+		return err
+	}
+	leftChild, err := getPage(table.pager, leftChildPageNum)
+	if err != nil {
+		return err
+	}
+	markPageDirty(table.pager, table.rootPageNum)
+	markPageDirty(table.pager, rightChildPageNum)
+	markPageDirty(table.pager, leftChildPageNum)
+
+	if getNodeType(root) == types.NodeInternal {
+		initializeInternalNode(rightChild)
+		initializeInternalNode(leftChild)
+	}
+
+	// Old root is copied into left child.
+	copy(leftChild, root)
+	setNodeRoot(leftChild, false)
+
+	if getNodeType(leftChild) == types.NodeInternal {
+		numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(leftChild))
+		for i := uint32(0); i <= numKeys; i++ {
+			childPageNumBytes, err := internalNodeChild(leftChild, i)
+			if err != nil {
+				return err
+			}
+			childPageNum := binary.LittleEndian.Uint32(childPageNumBytes)
+			child, err := getPage(table.pager, childPageNum)
+			if err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint32(nodeParent(child), leftChildPageNum)
+			markPageDirty(table.pager, childPageNum)
+		}
+	}
+
+	// Root node is a new internal node with one key and two children.
+	leftChildMaxKey, err := getNodeMaxKey(table.pager, leftChild)
+	if err != nil {
+		return err
+	}
+	initializeInternalNode(root)
+	setNodeRoot(root, true)
+	binary.LittleEndian.PutUint32(internalNodeNumKeys(root), 1)
+	binary.LittleEndian.PutUint32(internalNodeCell(root, 0), leftChildPageNum)
+	binary.LittleEndian.PutUint32(internalNodeKey(root, 0), leftChildMaxKey)
+	binary.LittleEndian.PutUint32(internalNodeRightChild(root), rightChildPageNum)
+	binary.LittleEndian.PutUint32(nodeParent(leftChild), table.rootPageNum)
+	binary.LittleEndian.PutUint32(nodeParent(rightChild), table.rootPageNum)
+	return nil
+}
+
+/*
+leafNodeSplitAndInsert creates a new node and moves half of the cells over.
+
+Inserts the new value in one of the two nodes.
+Updates parent or creates a new parent.
+*/
+func leafNodeSplitAndInsert(cursor *Cursor, key uint32, value *types.Row) error {
+	oldNode, err := getPage(cursor.table.pager, cursor.pageNum)
+	if err != nil {
+		return err
+	}
+	oldMax, err := getNodeMaxKey(cursor.table.pager, oldNode)
+	if err != nil {
+		return err
+	}
+	newPageNum, err := getUnusedPageNum(cursor.table.pager)
+	if err != nil {
+		return err
+	}
+	newNode, err := getPage(cursor.table.pager, newPageNum)
+	if err != nil {
+		return err
+	}
+	cursor.table.pager.splits++
+	initializeLeafNode(newNode)
+	markPageDirty(cursor.table.pager, cursor.pageNum)
+	markPageDirty(cursor.table.pager, newPageNum)
+	copy(nodeParent(newNode), nodeParent(oldNode))
+	copy(leafNodeNextLeaf(newNode), leafNodeNextLeaf(oldNode))
+	binary.LittleEndian.PutUint32(leafNodeNextLeaf(oldNode), newPageNum)
+
+	// Existing keys should be divided evenly between old (left) and new (right) nodes.
+	// Starting from the right, move each key to the correct position.
+	for i := int(constants.LeafNodeMaxCells); i >= 0; i-- {
+		var destNode = []byte{}
+		if uint32(i) >= constants.LeafNodeLeftSplitCount {
+			destNode = newNode
+		} else {
+			destNode = oldNode
+		}
+		indexWithinNode := uint32(i) % constants.LeafNodeLeftSplitCount
+		destination := leafNodeCell(destNode, indexWithinNode)
+
+		if uint32(i) == cursor.cellNum {
+			// inserts new row
+			// Copy does nothing???
+			copy(leafNodeValue(destNode, indexWithinNode), serializeRow(value))
+			binary.LittleEndian.PutUint32(leafNodeKey(destNode, indexWithinNode), key)
+		} else if uint32(i) > cursor.cellNum {
+			copy(destination, leafNodeCell(oldNode, uint32(i)-1))
+		} else {
+			copy(destination, leafNodeCell(oldNode, uint32(i)))
+		}
+	}
+
+	// Update cell count on each leaf node
+	binary.LittleEndian.PutUint32(leafNodeNumCells(oldNode), constants.LeafNodeLeftSplitCount)
+	binary.LittleEndian.PutUint32(leafNodeNumCells(newNode), constants.LeafNodeRightSplitCount)
+
+	if isNodeRoot(oldNode) {
+		return createNewRoot(cursor.table, newPageNum)
+	}
+	parentPageNum := binary.LittleEndian.Uint32(nodeParent(oldNode))
+	newMax, err := getNodeMaxKey(cursor.table.pager, oldNode)
+	if err != nil {
+		return err
+	}
+	parent, err := getPage(cursor.table.pager, parentPageNum)
+	if err != nil {
+		return err
+	}
+
+	updateInternalNodeKey(parent, oldMax, newMax)
+	markPageDirty(cursor.table.pager, parentPageNum)
+	return internalNodeInsert(cursor.table, parentPageNum, newPageNum)
+}
+
+func leafNodeInsert(cursor *Cursor, key uint32, value *types.Row) error {
+	node, err := getPage(cursor.table.pager, cursor.pageNum)
+	if err != nil {
+		return err
+	}
+	numCells := binary.LittleEndian.Uint32(leafNodeNumCells(node))
+	if numCells >= constants.LeafNodeMaxCells {
+		if err := leafNodeSplitAndInsert(cursor, key, value); err != nil {
+			return err
+		}
+		_, err := recountRows(cursor.table.pager, cursor.table.rootPageNum)
+		return err
+	}
+	markPageDirty(cursor.table.pager, cursor.pageNum)
+
+	if cursor.cellNum < numCells {
+		// Make room for a new cell.
+		for i := numCells; i > cursor.cellNum; i-- {
+			copy(leafNodeCell(node, i), leafNodeCell(node, i-1))
+		}
+	}
+	binary.LittleEndian.PutUint32(leafNodeNumCells(node), numCells+1)
+	binary.LittleEndian.PutUint32(leafNodeKey(node, cursor.cellNum), key)
+	copy(leafNodeValue(node, cursor.cellNum), serializeRow(value))
+	return countRows(cursor.table.pager, cursor.pageNum, 1)
+}
+
+func (c *Cursor) advance() error {
+	node, err := getPage(c.table.pager, c.pageNum)
+	if err != nil {
+		return err
+	}
+	c.cellNum++
+	// Advance to the next leaf node, skipping leaves left empty by deletes.
+	for c.cellNum >= binary.LittleEndian.Uint32(leafNodeNumCells(node)) {
+		nextPageNum := binary.LittleEndian.Uint32(leafNodeNextLeaf(node))
+		if nextPageNum == 0 {
+			// This is the rightmost leaf.
+			c.endOfTable = true
+			return nil
+		}
+		if node, err = getPage(c.table.pager, nextPageNum); err != nil {
+			return err
+		}
+		if err := checkTreeNode(node, nextPageNum); err != nil {
+			return err
+		}
+		if getNodeType(node) != types.NodeLeaf {
+			return dberr.Errorf(dberr.ErrCorrupt, "page %d follows a leaf but is not one - the file is corrupt", nextPageNum)
+		}
+		c.pageNum = nextPageNum
+		c.cellNum = 0
+	}
+	return nil
+}
+
+// retreat moves the cursor to the previous row. Before the first row it is at the end of the table.
+func (c *Cursor) retreat() error {
+	for c.cellNum == 0 {
+		// Leaves left empty by deletes are skipped.
+		pageNum, err := prevLeaf(c.table, c.pageNum)
+		if err != nil {
+			return err
+		}
+		if pageNum == constants.InvalidPageNum {
+			c.endOfTable = true
+			return nil
+		}
+		node, err := getPage(c.table.pager, pageNum)
+		if err != nil {
+			return err
+		}
+		c.pageNum = pageNum
+		c.cellNum = binary.LittleEndian.Uint32(leafNodeNumCells(node))
+	}
+	c.cellNum--
+	return nil
+}
+
+// prevLeaf returns the leaf before pageNum in key order, or InvalidPageNum if it is the leftmost.
+// Leaves only link to the next one, so it climbs parent pointers until it can step left.
+func prevLeaf(table *Table, pageNum uint32) (uint32, error) {
+	for pageNum != table.rootPageNum {
+		node, err := getPage(table.pager, pageNum)
+		if err != nil {
+			return 0, err
+		}
+		parentPageNum := binary.LittleEndian.Uint32(nodeParent(node))
+		parent, err := getPage(table.pager, parentPageNum)
+		if err != nil {
+			return 0, err
+		}
+		numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(parent))
+		childIdx := numKeys
+		for i := uint32(0); i < numKeys; i++ {
+			if binary.LittleEndian.Uint32(internalNodeCell(parent, i)) == pageNum {
+				childIdx = i
+				break
+			}
+		}
+		if childIdx > 0 {
+			return rightmostLeaf(table, binary.LittleEndian.Uint32(internalNodeCell(parent, childIdx-1)))
+		}
+		pageNum = parentPageNum
+	}
+	return constants.InvalidPageNum, nil
+}
+
+// rightmostLeaf returns the last leaf of the subtree rooted at pageNum.
+func rightmostLeaf(table *Table, pageNum uint32) (uint32, error) {
+	for {
+		node, err := getPage(table.pager, pageNum)
+		if err != nil {
+			return 0, err
+		}
+		if getNodeType(node) == types.NodeLeaf {
+			return pageNum, nil
+		}
+		pageNum = binary.LittleEndian.Uint32(internalNodeRightChild(node))
+	}
+}
+
+// value returns the serialized row under the cursor.
+func (c *Cursor) value() ([]byte, error) {
+	page, err := getPage(c.table.pager, c.pageNum)
+	if err != nil {
+		return nil, err
+	}
+	return leafNodeValue(page, c.cellNum), nil
+}
+
+// internalNodeFindKey returns the index of the cell exactly matching the provided key.
+// If such key doesn't exist, second return value is false.
+func internalNodeFindKey(node []byte, key uint32) (uint32, bool) {
+	numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+	// Binary search
+	minIdx := uint32(0)
+	maxIdx := numKeys
+	for minIdx != maxIdx {
+		midIdx := (maxIdx-minIdx)/2 + minIdx // mid without overflow
+		keyToRight := binary.LittleEndian.Uint32(internalNodeKey(node, midIdx))
+		if keyToRight >= key {
+			maxIdx = midIdx
+		} else {
+			minIdx = midIdx + 1
+		}
+	}
+	if keyToRight := binary.LittleEndian.Uint32(internalNodeKey(node, minIdx)); keyToRight != key {
+		return 0, false
+	}
+
+	return minIdx, true
+}
+
+func indent(w io.Writer, level uint32) {
+	for i := uint32(0); i < level; i++ {
+		fmt.Fprintf(w, "  ")
+	}
+}
+
+/*
+writeDot writes the nodes of the tree at pageNum as Graphviz boxes labeled
+with their page and the range of keys below them, with an edge to every child
+labeled with the largest key its parent has for it, and a dashed edge from
+every leaf to the next. It returns the smallest and largest key of the tree,
+and false if it holds none.
+*/
+func writeDot(w io.Writer, pager *Pager, pageNum uint32) (uint32, uint32, bool, error) {
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if getNodeType(node) == types.NodeLeaf {
+		numCells := binary.LittleEndian.Uint32(leafNodeNumCells(node))
+		if next := binary.LittleEndian.Uint32(leafNodeNextLeaf(node)); next != 0 {
+			fmt.Fprintf(w, "\tp%d -> p%d [style=dashed, constraint=false];\n", pageNum, next)
+		}
+		if numCells == 0 {
+			fmt.Fprintf(w, "\tp%d [label=\"leaf, page %d\\nempty\"];\n", pageNum, pageNum)
+			return 0, 0, false, nil
+		}
+		lo, hi := binary.LittleEndian.Uint32(leafNodeKey(node, 0)), binary.LittleEndian.Uint32(leafNodeKey(node, numCells-1))
+		fmt.Fprintf(w, "\tp%d [label=\"leaf, page %d\\n%d-%d, %d rows\"];\n", pageNum, pageNum, lo, hi, numCells)
+		return lo, hi, true, nil
+	}
+	var lo, hi uint32
+	found := false
+	numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+	for i := uint32(0); i <= numKeys; i++ {
+		childNumBytes, err := internalNodeChild(node, i)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		child := binary.LittleEndian.Uint32(childNumBytes)
+		if i < numKeys {
+			fmt.Fprintf(w, "\tp%d -> p%d [label=\"<= %d\"];\n", pageNum, child, binary.LittleEndian.Uint32(internalNodeKey(node, i)))
+		} else {
+			fmt.Fprintf(w, "\tp%d -> p%d;\n", pageNum, child)
+		}
+		childLo, childHi, ok, err := writeDot(w, pager, child)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if ok {
+			if !found {
+				lo = childLo
+			}
+			hi, found = childHi, true
+		}
+	}
+	keys := "empty"
+	if found {
+		keys = fmt.Sprintf("%d-%d, %d rows", lo, hi, nodeRows(node))
+	}
+	fmt.Fprintf(w, "\tp%d [label=\"internal, page %d\\n%s\"];\n", pageNum, pageNum, keys)
+	return lo, hi, found, nil
+}
+
+/*
+dumpPage writes the fields of the node header of a page, each with its offset,
+then the bytes of the page, 16 to a line, with a run of repeated lines
+collapsed into a * like hexdump does.
+*/
+func dumpPage(w io.Writer, node []byte, pageNum uint32) {
+	field := func(offset uint32, name string, value any) {
+		fmt.Fprintf(w, "  %04x %-12s %v\n", offset, name+":", value)
+	}
+	u32 := func(offset uint32) uint32 { return binary.LittleEndian.Uint32(node[offset:]) }
+	nodeTypes := map[types.NodeType]string{types.NodeInternal: "internal", types.NodeLeaf: "leaf", types.NodeSpatial: "spatial"}
+	nodeType, ok := nodeTypes[getNodeType(node)]
+	if !ok {
+		nodeType = fmt.Sprintf("unknown (%d)", getNodeType(node))
+	}
+	fmt.Fprintf(w, "page %d, %s node\n", pageNum, nodeType)
+	field(constants.NodeTypeOffset, "node type", nodeType)
+	field(constants.IsRootOffset, "is root", isNodeRoot(node))
+	field(constants.ParentPointerOffset, "parent", u32(constants.ParentPointerOffset))
+	switch getNodeType(node) {
+	case types.NodeLeaf:
+		field(constants.LeafNodeNumCellsOffset, "num cells", u32(constants.LeafNodeNumCellsOffset))
+		field(constants.LeafNodeNextLeafOffset, "next leaf", u32(constants.LeafNodeNextLeafOffset))
+	case types.NodeInternal:
+		field(constants.InternalNodeNumKeysOffset, "num keys", u32(constants.InternalNodeNumKeysOffset))
+		field(constants.InternalNodeRightChildOffset, "right child", u32(constants.InternalNodeRightChildOffset))
+		field(constants.InternalNodeRightCountOffset, "right rows", u32(constants.InternalNodeRightCountOffset))
+	case types.NodeSpatial:
+		field(constants.SpatialNodeIsLeafOffset, "is leaf", spatialNodeIsLeaf(node))
+		field(constants.SpatialNodeNumEntriesOffset, "num entries", u32(constants.SpatialNodeNumEntriesOffset))
+	}
+	var prev []byte
+	repeated := false
+	for offset := 0; offset < len(node); offset += 16 {
+		line := node[offset:min(offset+16, len(node))]
+		if prev != nil && bytes.Equal(line, prev) {
+			if !repeated {
+				fmt.Fprintln(w, "*")
+			}
+			repeated = true
+			continue
+		}
+		prev, repeated = line, false
+		ascii := make([]byte, len(line))
+		for i, b := range line {
+			ascii[i] = '.'
+			if b >= 0x20 && b < 0x7f {
+				ascii[i] = b
+			}
+		}
+		fmt.Fprintf(w, "%04x  % x  |%s|\n", offset, line, ascii)
+	}
+	fmt.Fprintf(w, "%04x\n", len(node))
+}
+
+// describeNode returns where a node sits in the file: its page, its parent, and how full it is.
+func describeNode(node []byte, pageNum uint32) string {
+	parent := "root"
+	if !isNodeRoot(node) {
+		parent = fmt.Sprintf("parent %d", binary.LittleEndian.Uint32(nodeParent(node)))
+	}
+	if getNodeType(node) == types.NodeLeaf {
+		next := "none"
+		if nextLeaf := binary.LittleEndian.Uint32(leafNodeNextLeaf(node)); nextLeaf != 0 {
+			next = fmt.Sprint(nextLeaf)
+		}
+		numCells := binary.LittleEndian.Uint32(leafNodeNumCells(node))
+		return fmt.Sprintf("page %d, %s, next leaf %s, %d%% full", pageNum, parent, next, numCells*100/constants.LeafNodeMaxCells)
+	}
+	numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+	return fmt.Sprintf("page %d, %s, %d rows, %d%% full", pageNum, parent, nodeRows(node), numKeys*100/constants.InternalNodeMaxCells)
+}
+
+func displayTree(w io.Writer, pager *Pager, pageNum uint32, indentLevel uint32) error {
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return err
+	}
+	var numKeys, child uint32
+
+	switch getNodeType(node) {
+	case types.NodeLeaf:
+		numKeys = binary.LittleEndian.Uint32(leafNodeNumCells(node))
+		indent(w, indentLevel)
+		fmt.Fprintf(w, "- leaf (size %d) %s\n", numKeys, describeNode(node, pageNum))
+		for i := uint32(0); i < numKeys; i++ {
+			indent(w, indentLevel+1)
+			fmt.Fprintf(w, "- %d\n", binary.LittleEndian.Uint32(leafNodeKey(node, i)))
+		}
+	case types.NodeInternal:
+		numKeys = binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+		indent(w, indentLevel)
+		fmt.Fprintf(w, "- internal (size %d) %s\n", numKeys, describeNode(node, pageNum))
+		// Avoid printing nodes with 0 keys, since then we'd access invalid page.
+		if numKeys > 0 {
+			for i := uint32(0); i < numKeys; i++ {
+				child = binary.LittleEndian.Uint32(internalNodeCell(node, i))
+				if err := displayTree(w, pager, child, indentLevel+1); err != nil {
+					return err
+				}
+				indent(w, indentLevel+1)
+				fmt.Fprintf(w, "- key %d\n", binary.LittleEndian.Uint32(internalNodeKey(node, i)))
+			}
+		}
+		child = binary.LittleEndian.Uint32(internalNodeRightChild(node))
+		return displayTree(w, pager, child, indentLevel+1)
+	}
+	return nil
+}
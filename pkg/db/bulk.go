@@ -0,0 +1,233 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Bulk loading.
+
+Inserting rows in id order one at a time always splits the rightmost leaf,
+which leaves every leaf but the last one half empty. The bulk loader instead
+fills leaves left to right up to bulkLoadLeafCells, leaving some room for
+later inserts, and once the rows run out builds each level of internal nodes
+on top of the one below until a level fits in the root. A partitioned table
+gets a loader per partition, started when the ids reach it.
+*/
+
+// bulkLoadLeafCells is how many cells the bulk loader puts in a leaf, 90% of what fits.
+const bulkLoadLeafCells = max(1, constants.LeafNodeMaxCells*9/10)
+
+// BulkLoad inserts the rows returned by next until it returns io.EOF, and returns how many it
+// inserted. If the table is empty, rows arriving in ascending id order are packed into leaves
+// directly. Rows after the first one out of order, or all rows if the table already has some,
+// are inserted one at a time, as are all rows of a table with a unique index, which looks up
+// the rows an insert might collide with. Like a single statement, it inserts either every row or none.
+func (t *Table) BulkLoad(ctx context.Context, next func() (types.Row, error)) (int, error) {
+	n := 0
+	err := t.write(func() error {
+		empty := t.pager.header.UniqueRootPageNum == 0
+		for _, p := range t.trees() {
+			root, err := getPage(t.pager, p.tree.rootPageNum)
+			if err != nil {
+				return err
+			}
+			empty = empty && getNodeType(root) == types.NodeLeaf && binary.LittleEndian.Uint32(leafNodeNumCells(root)) == 0
+		}
+		part := 0 // The partition being loaded, the ones before it are complete.
+		loader := &bulkLoader{table: t.trees()[part].tree}
+		for {
+			row, err := next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if n%int(constants.LeafNodeMaxCells) == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+			if i := t.partitionIndex(row.Id); empty && i > part {
+				if err := loader.finish(); err != nil {
+					return err
+				}
+				part = i
+				loader = &bulkLoader{table: t.partitions[part].tree}
+			}
+			if empty && t.treeOf(row.Id) == loader.table && (len(loader.level) == 0 || row.Id > loader.level[len(loader.level)-1].maxKey) {
+				err = loader.add(&row)
+			} else {
+				if empty {
+					if err := loader.finish(); err != nil {
+						return err
+					}
+					empty = false
+				}
+				err = insertRow(t.treeOf(row.Id), &row)
+			}
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		if empty {
+			return loader.finish()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+type bulkLoader struct {
+	table *Table
+	level []bulkNode // The leaves filled so far.
+}
+
+// bulkNode is a node of the level being built.
+type bulkNode struct {
+	pageNum uint32
+	maxKey  uint32
+}
+
+// add appends a row with a larger id than every row before it.
+func (b *bulkLoader) add(row *types.Row) error {
+	pager := b.table.pager
+	if len(b.level) == 0 {
+		// The first leaf is the root, which is all there is if the rows fit in one leaf.
+		b.level = append(b.level, bulkNode{pageNum: b.table.rootPageNum})
+	}
+	leaf := &b.level[len(b.level)-1]
+	node, err := getPage(pager, leaf.pageNum)
+	if err != nil {
+		return err
+	}
+	numCells := binary.LittleEndian.Uint32(leafNodeNumCells(node))
+	if numCells >= bulkLoadLeafCells {
+		pageNum, err := getUnusedPageNum(pager)
+		if err != nil {
+			return err
+		}
+		next, err := getPage(pager, pageNum)
+		if err != nil {
+			return err
+		}
+		initializeLeafNode(next)
+		binary.LittleEndian.PutUint32(leafNodeNextLeaf(node), pageNum)
+		markPageDirty(pager, leaf.pageNum)
+		b.level = append(b.level, bulkNode{pageNum: pageNum})
+		leaf, node, numCells = &b.level[len(b.level)-1], next, 0
+	}
+	markPageDirty(pager, leaf.pageNum)
+	binary.LittleEndian.PutUint32(leafNodeKey(node, numCells), row.Id)
+	copy(leafNodeValue(node, numCells), serializeRow(row))
+	inserted := *row
+	pager.changes.record(Change{Op: "insert", After: &inserted})
+	binary.LittleEndian.PutUint32(leafNodeNumCells(node), numCells+1)
+	leaf.maxKey = row.Id
+	pager.rowsWritten++
+	countRow(pager, row.ExpiresAt, 1)
+	bloomAdd(pager, row.Id)
+	if err := generatedInsert(pager, row); err != nil {
+		return err
+	}
+	if err := descendingInsert(pager, *row); err != nil {
+		return err
+	}
+	return orderedInsert(pager, *row)
+}
+
+// finish builds the internal levels above the leaves.
+func (b *bulkLoader) finish() error {
+	if len(b.level) <= 1 {
+		return nil
+	}
+	pager := b.table.pager
+	// The root page has to hold the root of the tree, so the first leaf moves out of it.
+	pageNum, err := getUnusedPageNum(pager)
+	if err != nil {
+		return err
+	}
+	leaf, err := getPage(pager, pageNum)
+	if err != nil {
+		return err
+	}
+	root, err := getPage(pager, b.table.rootPageNum)
+	if err != nil {
+		return err
+	}
+	copy(leaf, root)
+	setNodeRoot(leaf, false)
+	markPageDirty(pager, pageNum)
+	b.level[0].pageNum = pageNum
+
+	level := b.level
+	maxChildren := int(constants.InternalNodeMaxCells) + 1
+	for len(level) > maxChildren {
+		// Spread the children evenly, so that every node has at least two.
+		numNodes := (len(level) + maxChildren - 1) / maxChildren
+		parents := make([]bulkNode, 0, numNodes)
+		for i, total := 0, len(level); i < numNodes; i++ {
+			size := total / numNodes
+			if i < total%numNodes {
+				size++
+			}
+			pageNum, err := getUnusedPageNum(pager)
+			if err != nil {
+				return err
+			}
+			parent, err := b.buildInternalNode(pageNum, level[:size])
+			if err != nil {
+				return err
+			}
+			parents = append(parents, parent)
+			level = level[size:]
+		}
+		level = parents
+	}
+	if _, err := b.buildInternalNode(b.table.rootPageNum, level); err != nil {
+		return err
+	}
+	setNodeRoot(root, true)
+	b.level = nil
+	return nil
+}
+
+// buildInternalNode makes pageNum the internal node above children.
+func (b *bulkLoader) buildInternalNode(pageNum uint32, children []bulkNode) (bulkNode, error) {
+	pager := b.table.pager
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return bulkNode{}, err
+	}
+	markPageDirty(pager, pageNum)
+	initializeInternalNode(node)
+	numKeys := uint32(len(children) - 1)
+	binary.LittleEndian.PutUint32(internalNodeNumKeys(node), numKeys)
+	for i, child := range children[:numKeys] {
+		binary.LittleEndian.PutUint32(internalNodeCell(node, uint32(i)), child.pageNum)
+		binary.LittleEndian.PutUint32(internalNodeKey(node, uint32(i)), child.maxKey)
+	}
+	last := children[numKeys]
+	binary.LittleEndian.PutUint32(internalNodeRightChild(node), last.pageNum)
+	for i, child := range children {
+		childNode, err := getPage(pager, child.pageNum)
+		if err != nil {
+			return bulkNode{}, err
+		}
+		binary.LittleEndian.PutUint32(internalNodeCount(node, uint32(i)), nodeRows(childNode))
+		binary.LittleEndian.PutUint32(nodeParent(childNode), pageNum)
+		markPageDirty(pager, child.pageNum)
+	}
+	return bulkNode{pageNum: pageNum, maxKey: last.maxKey}, nil
+}
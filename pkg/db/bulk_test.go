@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// rowsOf returns an iterator for BulkLoad over rows with the given ids.
+func rowsOf(ids ...int) func() (types.Row, error) {
+	return func() (types.Row, error) {
+		if len(ids) == 0 {
+			return types.Row{}, io.EOF
+		}
+		row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", ids[0], ids[0], ids[0]))
+		ids = ids[1:]
+		return row, nil
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	sorted := []int{}
+	for i := 1; i <= 300; i++ {
+		sorted = append(sorted, i)
+	}
+	tests := []struct {
+		name string
+		ids  []int
+	}{
+		{"one leaf", []int{1, 2, 3}},
+		{"sorted", sorted},
+		{"sorted, then not", append(slices.Clone(sorted[:100]), 5000, 150, 101, 4000)},
+	}
+	for _, test := range tests {
+		table, _ := Open(MemoryDbName)
+		n, err := table.BulkLoad(context.Background(), rowsOf(test.ids...))
+		if err != nil || n != len(test.ids) {
+			t.Fatalf("%s: BulkLoad = %d, %v", test.name, n, err)
+		}
+		if problems := table.IntegrityCheck(); len(problems) > 0 {
+			t.Fatalf("%s: integrity check failed: %v", test.name, problems)
+		}
+		expected := slices.Clone(test.ids)
+		slices.Sort(expected)
+		if keys := checkTable(t, table); fmt.Sprint(keys) != fmt.Sprint(expected) {
+			t.Fatalf("%s: got keys %v, expected %v", test.name, keys, expected)
+		}
+		table.Close()
+	}
+
+	// Sorted rows are packed tighter than inserting them one at a time.
+	loaded, _ := Open(MemoryDbName)
+	defer loaded.Close()
+	loaded.BulkLoad(context.Background(), rowsOf(sorted...))
+	inserted, _ := Open(MemoryDbName)
+	defer inserted.Close()
+	for _, id := range sorted {
+		inserted.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d u e", id)))
+	}
+	loadedInfo, _ := loaded.Info()
+	insertedInfo, _ := inserted.Info()
+	if loadedInfo.Pages >= insertedInfo.Pages {
+		t.Fatalf("Expected bulk loading to use fewer pages. Got %d, inserting used %d", loadedInfo.Pages, insertedInfo.Pages)
+	}
+
+	// Into a table with rows, and with a duplicate that undoes the whole load.
+	if _, err := loaded.BulkLoad(context.Background(), rowsOf(1000, 1001, 300)); err == nil || err.Error() != "duplicate key" {
+		t.Fatalf("Expected a duplicate key error. Got: %v", err)
+	}
+	if keys := checkTable(t, loaded); len(keys) != 300 {
+		t.Fatalf("Expected a failed bulk load to insert nothing. Got %d rows", len(keys))
+	}
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"context"
+	"sync"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Change data capture.
+
+Every row a write statement inserts or deletes is recorded by the pager as a
+Change while the transaction is open. Rolling back to a savepoint drops the
+changes recorded after it, rolling back drops all of them, and committing
+hands them to the fulltext index and the subscribers in the order they were
+made. Nothing is recorded while there is neither an index nor a subscriber.
+
+There is no update statement, a row is changed by deleting and inserting it,
+so a subscriber sees a delete with the old row followed by an insert with the
+new one.
+*/
+
+// changeBuffer is how many changes a subscriber's channel holds. A subscriber
+// that lets it fill up is dropped rather than stalling commits.
+const changeBuffer = 1024
+
+// Change is a row inserted or deleted by a committed write.
+type Change struct {
+	Op     string     // "insert" or "delete".
+	Before *types.Row // The deleted row, nil for an insert.
+	After  *types.Row // The inserted row, nil for a delete.
+}
+
+// changeLog holds the changes of the open transaction and the subscribers they go to.
+type changeLog struct {
+	pending []Change
+	index   *fulltextIndex // Kept up to date with the committed changes, nil if there is none.
+
+	mu          sync.Mutex // Guards subscribers, which are dropped from other goroutines.
+	subscribers map[chan Change]bool
+}
+
+/*
+Changes returns a channel receiving every change committed from now on, in
+commit order. A subscription taken inside a transaction only gets the changes
+made after it. The channel is closed when ctx is done, when the table is
+closed, or when the subscriber falls more than changeBuffer changes behind,
+after which it must subscribe again and resynchronize by scanning the table.
+*/
+func (t *Table) Changes(ctx context.Context) <-chan Change {
+	log := &t.pager.changes
+	ch := make(chan Change, changeBuffer)
+	log.mu.Lock()
+	if log.subscribers == nil {
+		log.subscribers = map[chan Change]bool{}
+	}
+	log.subscribers[ch] = true
+	log.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		log.unsubscribe(ch)
+	}()
+	return ch
+}
+
+// unsubscribe closes ch unless it was closed already.
+func (log *changeLog) unsubscribe(ch chan Change) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if log.subscribers[ch] {
+		delete(log.subscribers, ch)
+		close(ch)
+	}
+}
+
+// record adds a change to the open transaction if anyone is subscribed or there is an index.
+func (log *changeLog) record(change Change) {
+	log.mu.Lock()
+	subscribed := len(log.subscribers) > 0
+	log.mu.Unlock()
+	if subscribed || log.index != nil {
+		log.pending = append(log.pending, change)
+	}
+}
+
+// publish applies the changes of the committed transaction to the index and sends them to every subscriber.
+func (log *changeLog) publish() {
+	pending := log.pending
+	log.pending = nil
+	if len(pending) == 0 {
+		return
+	}
+	if log.index != nil {
+		log.index.apply(pending)
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for ch := range log.subscribers {
+		for _, change := range pending {
+			select {
+			case ch <- change:
+				continue
+			default:
+			}
+			delete(log.subscribers, ch)
+			close(ch)
+			break
+		}
+	}
+}
+
+// closeAll closes every subscriber's channel, the table is going away.
+func (log *changeLog) closeAll() {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for ch := range log.subscribers {
+		delete(log.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Watch is Changes limited to the rows with an id between from and to, inclusive.
+func (t *Table) Watch(ctx context.Context, from uint32, to uint32) <-chan Change {
+	changes := t.Changes(ctx)
+	ch := make(chan Change, changeBuffer)
+	go func() {
+		defer close(ch)
+		for change := range changes {
+			row := change.After
+			if row == nil {
+				row = change.Before
+			}
+			if row.Id < from || row.Id > to {
+				continue
+			}
+			select {
+			case ch <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestChanges(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := table.Changes(ctx)
+
+	table.Insert(ctx, parseRow("insert 1 alice a@example.com"))
+	table.Begin()
+	table.Insert(ctx, parseRow("insert 2 bob b@example.com"))
+	table.Savepoint("sp")
+	table.Delete(ctx, 1)
+	table.RollbackTo("sp")
+	table.Insert(ctx, parseRow("insert 2 dup dup")) // Fails, so nothing is recorded.
+	table.Delete(ctx, 2)
+	table.Commit()
+	table.Begin()
+	table.Insert(ctx, parseRow("insert 3 carol c@example.com"))
+	table.Rollback()
+	table.BulkLoad(ctx, func() (types.Row, error) { return types.Row{}, io.EOF })
+	table.Batch(ctx, func(tx *Tx) error {
+		tx.Delete(1)
+		return tx.Insert(parseRow("insert 1 alice alice@example.com"))
+	})
+
+	want := []string{"insert 1 alice", "insert 2 bob", "delete 2 bob", "delete 1 alice", "insert 1 alice"}
+	for _, w := range want {
+		change := <-changes
+		row := change.After
+		if change.Op == "delete" {
+			row = change.Before
+		}
+		if got := fmt.Sprintf("%s %d %s", change.Op, row.Id, strings.TrimRight(string(row.Username[:]), "\x00")); got != w {
+			t.Fatalf("Expected %q. Got: %q", w, got)
+		}
+	}
+	select {
+	case change := <-changes:
+		t.Fatalf("Expected no more changes. Got: %+v", change)
+	default:
+	}
+
+	cancel()
+	if _, ok := <-changes; ok {
+		t.Fatalf("Expected the channel to be closed once the context is done.")
+	}
+	changes = table.Changes(context.Background())
+	table.Close()
+	if _, ok := <-changes; ok {
+		t.Fatalf("Expected the channel to be closed with the table.")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	watch := table.Watch(context.Background(), 2, 3)
+	for i := 1; i <= 4; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d u e", i)))
+	}
+	table.Delete(context.Background(), 4)
+	table.Delete(context.Background(), 3)
+	table.Close()
+
+	got := []string{}
+	for change := range watch {
+		row := change.After
+		if row == nil {
+			row = change.Before
+		}
+		got = append(got, fmt.Sprintf("%s %d", change.Op, row.Id))
+	}
+	if want := []string{"insert 2", "insert 3", "delete 3"}; !slices.Equal(got, want) {
+		t.Fatalf("Expected %v. Got: %v", want, got)
+	}
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+)
+
+/*
+Collations.
+
+A collation decides how the text values of a column compare: in =, <, order
+by, min and max, and which values group by puts in the same group. binary,
+the default, compares the bytes, and nocase ignores case. Others, such as
+the rules of a language from golang.org/x/text/collate, are registered by
+the program with RegisterCollation before it opens a database. A column gets
+its collation from alter column <column> collate <name>, which the file
+header keeps by name, so a database using a registered collation can only be
+opened by programs that register it too.
+
+A comparison uses the collation of its column, the left one if it compares
+two columns. Like, match and in compare the bytes whatever the collation.
+*/
+
+// Collation orders text values.
+type Collation struct {
+	Compare func(a, b string) int
+	// Key maps the strings Compare considers equal to the same string, for
+	// grouping them. Nil if only identical strings are equal.
+	Key func(s string) string
+}
+
+var (
+	collationsMu sync.RWMutex
+	collations   = map[string]Collation{
+		"binary": {Compare: strings.Compare},
+		"nocase": {
+			Compare: func(a, b string) int { return strings.Compare(strings.ToLower(a), strings.ToLower(b)) },
+			Key:     strings.ToLower,
+		},
+	}
+)
+
+// RegisterCollation makes a collation available by name, which is case-insensitive
+// like keywords. Like sql.Register it panics if the name is taken or Compare is nil.
+func RegisterCollation(name string, collation Collation) {
+	name = strings.ToLower(name)
+	collationsMu.Lock()
+	defer collationsMu.Unlock()
+	if collation.Compare == nil {
+		panic("db: RegisterCollation compare is nil")
+	}
+	if _, dup := collations[name]; dup {
+		panic("db: RegisterCollation called twice for collation " + name)
+	}
+	collations[name] = collation
+}
+
+func lookupCollation(name string) (Collation, bool) {
+	collationsMu.RLock()
+	defer collationsMu.RUnlock()
+	collation, ok := collations[name]
+	return collation, ok
+}
+
+// compare orders two values of the same column, text by the collation.
+func (c Collation) compare(a, b any) int {
+	if a, ok := a.(string); ok {
+		return c.Compare(a, b.(string))
+	}
+	return compareValues(a, b)
+}
+
+// groupKey returns the value rows are grouped by, the same for text values the collation considers equal.
+func (c Collation) groupKey(value any) any {
+	if s, ok := value.(string); ok && c.Key != nil {
+		return c.Key(s)
+	}
+	return value
+}
+
+// checkCollations verifies that the collations the file header names are registered.
+func (t *Table) checkCollations() error {
+	for _, name := range t.pager.header.Collations {
+		if _, ok := lookupCollation(name); name != "" && !ok {
+			return fmt.Errorf("unknown collation %s, register it before opening the database", name)
+		}
+	}
+	return nil
+}
+
+// collation returns the collation of a column, binary unless one was set.
+func (t *Table) collation(column string) Collation {
+	names, _ := t.columns()
+	name := "binary"
+	if i := slices.Index(names, column); i >= 0 && t.pager.header.Collations[i] != "" {
+		name = t.pager.header.Collations[i]
+	}
+	collation, _ := lookupCollation(name)
+	return collation
+}
+
+// collation returns binary, the columns of a sharded database have no other collation.
+func (s *Sharded) collation(column string) Collation {
+	collation, _ := lookupCollation("binary")
+	return collation
+}
+
+// SetCollation sets the collation the values of a text column are compared by.
+func (t *Table) SetCollation(ctx context.Context, column string, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	name = strings.ToLower(name)
+	pager := t.pager
+	if pager.readOnly {
+		return errReadOnly
+	}
+	if pager.inTxn {
+		return fmt.Errorf("cannot change a collation - a transaction is active")
+	}
+	names, valueTypes := t.columns()
+	index := slices.Index(names, column)
+	if index < 0 {
+		return fmt.Errorf("no such column: %s", column)
+	}
+	if valueTypes[index] != "text" {
+		return fmt.Errorf("a collation orders text, but %s is %s", column, valueTypes[index])
+	}
+	if _, ok := lookupCollation(name); !ok {
+		return fmt.Errorf("unknown collation: %s", name)
+	}
+	if len(name) > int(constants.CollationNameSize) {
+		return fmt.Errorf("a collation name is at most %d bytes", constants.CollationNameSize)
+	}
+	if name == "binary" {
+		name = ""
+	}
+	old := pager.header.Collations
+	err := t.write(func() error {
+		if _, err := getPage(pager, t.rootPageNum); err != nil {
+			return err
+		}
+		// A commit only writes the header along with the pages it changed.
+		markPageDirty(pager, t.rootPageNum)
+		pager.header.Collations[index] = name
+		return nil
+	})
+	if err != nil {
+		pager.header.Collations = old
+	}
+	return err
+}
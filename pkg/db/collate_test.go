@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestCollations(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	execute := func(text string) ([]string, error) {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		rows := []string{}
+		_, err = table.Execute(ctx, stmt, func(values []any) error {
+			rows = append(rows, fmt.Sprint(values))
+			return nil
+		})
+		return rows, err
+	}
+	for i, name := range []string{"bob", "Alice", "carol", "BOB", "alice"} {
+		execute(fmt.Sprintf("insert %d %s %s@x.org", i+1, name, name))
+	}
+	if rows, _ := execute("select username order by username"); !slices.Equal(rows, []string{"[Alice]", "[BOB]", "[alice]", "[bob]", "[carol]"}) {
+		t.Fatalf("Expected binary order. Got: %v", rows)
+	}
+	if _, err := execute("alter column username collate NoCase"); err != nil {
+		t.Fatalf("Setting the collation failed: %v", err)
+	}
+	for text, want := range map[string][]string{
+		"select username order by username":                                  {"[Alice]", "[alice]", "[bob]", "[BOB]", "[carol]"},
+		"select id where username = 'BOB'":                                   {"[1]", "[4]"},
+		"select id where 'ALICE' = username":                                 {"[2]", "[5]"},
+		"select id where username > 'BOB'":                                   {"[3]"},
+		"select username, count(*) group by username order by username desc": {"[carol 1]", "[bob 2]", "[Alice 2]"},
+		"select min(username), max(username)":                                {"[Alice carol]"},
+		"select id where email = 'BOB@x.org'":                                {"[4]"},
+		"select id where username like 'b%'":                                 {"[1]"},
+	} {
+		if rows, err := execute(text); err != nil || !slices.Equal(rows, want) {
+			t.Fatalf("Expected %s to return %v. Got: %v, %v", text, want, rows, err)
+		}
+	}
+
+	RegisterCollation("Test_Reverse", Collation{Compare: func(a, b string) int { return strings.Compare(b, a) }})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Expected registering a collation twice to panic")
+			}
+		}()
+		RegisterCollation("test_reverse", Collation{Compare: strings.Compare})
+	}()
+	if _, err := execute("alter column email collate test_reverse"); err != nil {
+		t.Fatalf("Setting a registered collation failed: %v", err)
+	}
+	for text, want := range map[string]string{
+		"alter column id collate nocase":     "a collation orders text, but id is integer",
+		"alter column email collate klingon": "unknown collation: klingon",
+		"alter column phone collate nocase":  "no such column: phone",
+	} {
+		if _, err := execute(text); err == nil || err.Error() != want {
+			t.Fatalf("Expected %s to fail with %q. Got: %v", text, want, err)
+		}
+	}
+
+	table.Close()
+	table, _ = Open(dbName)
+	defer table.Close()
+	if rows, _ := execute("select id order by email limit 2"); !slices.Equal(rows, []string{"[3]", "[1]"}) {
+		t.Fatalf("Expected the registered collation to be kept. Got: %v", rows)
+	}
+	if rows, _ := execute("select id where username = 'CAROL'"); !slices.Equal(rows, []string{"[3]"}) {
+		t.Fatalf("Expected nocase to be kept. Got: %v", rows)
+	}
+	if schema := table.Schema(); schema[1].Collation != "nocase" || schema[2].Collation != "test_reverse" {
+		t.Fatalf("Expected the collations in the schema. Got: %+v", schema)
+	}
+}
@@ -0,0 +1,283 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Row count.
+
+The file header counts the rows in the trees of the table, and how many of
+them have a ttl. Every insert and delete updates the counts, which commit
+with the header at the end of every commit. The header is not part of the
+pages a rollback restores, so the counts are set back by hand to what they
+were when the transaction or savepoint began.
+
+Internal nodes also count the rows under each of their children, so the
+rows with ids in a range are counted, and the row at a position in id order
+is found, by descending the tree rather than scanning it. An insert or delete
+adds to the counts on the path from its leaf up to the root, a split
+recounts the tree once it is done.
+
+select count(*) returns the count from the header, or from the counts of the
+internal nodes if the where clause only compares the id with numbers,
+instead of walking the leaves; so does offset skip rows of a select in id
+order. Neither does while rows with a ttl are among them: those may have
+expired without being deleted yet, and only a scan tells.
+*/
+
+// rowCounts are the row counts of the file header.
+type rowCounts struct {
+	rows     uint32
+	expiring uint32
+}
+
+func (p *Pager) rowCounts() rowCounts {
+	return rowCounts{rows: p.header.RowCount, expiring: p.header.ExpiringRows}
+}
+
+func (p *Pager) setRowCounts(counts rowCounts) {
+	p.header.RowCount, p.header.ExpiringRows = counts.rows, counts.expiring
+}
+
+// countRow adds delta, 1 or -1, to the counts for a row inserted or deleted.
+func countRow(pager *Pager, expiresAt int64, delta int) {
+	pager.header.RowCount += uint32(delta)
+	if expiresAt != 0 {
+		pager.header.ExpiringRows += uint32(delta)
+	}
+}
+
+// countsIdRange reports whether a select is a count(*) of the rows in a range
+// of ids, which the row counts answer while no row has a ttl.
+func countsIdRange(t *Table, stmt *parser.Select) bool {
+	return onlyIdRange(stmt.Where) && stmt.GroupBy == "" && len(stmt.Columns) == 1 &&
+		stmt.Columns[0] == parser.SelectItem{Aggregate: "count", Column: "*"} &&
+		t.pager.header.ExpiringRows == 0
+}
+
+// seeksOffset reports whether the rows a select skips with offset can be passed
+// over by their position in id order, rather than by reading them.
+func seeksOffset(t *Table, stmt *parser.Select, where *filter) bool {
+	return stmt.Offset > 0 && onlyIdRange(stmt.Where) && where.ids == nil && stmt.GroupBy == "" &&
+		(stmt.OrderBy == "" || stmt.OrderBy == "id") && !slices.ContainsFunc(stmt.Columns, func(item parser.SelectItem) bool { return item.Aggregate != "" }) &&
+		t.pager.header.ExpiringRows == 0
+}
+
+// onlyIdRange reports whether a where clause matches exactly the rows in the range
+// of ids narrowIdRange takes from it. No where clause matches every id.
+func onlyIdRange(expr parser.Expr) bool {
+	switch e := expr.(type) {
+	case nil:
+		return true
+	case *parser.Logical:
+		return e.Op == "and" && onlyIdRange(e.Left) && onlyIdRange(e.Right)
+	case *parser.Compare:
+		op, _, ok := idComparison(e)
+		return ok && op != "!="
+	}
+	return false
+}
+
+// rowsBelow returns the number of rows in the tree at pageNum with an id below id.
+func rowsBelow(pager *Pager, pageNum uint32, id uint32) (uint32, error) {
+	rows := uint32(0)
+	for {
+		node, err := getPage(pager, pageNum)
+		if err != nil {
+			return 0, err
+		}
+		if getNodeType(node) == types.NodeLeaf {
+			numCells := binary.LittleEndian.Uint32(leafNodeNumCells(node))
+			below := sort.Search(int(numCells), func(i int) bool {
+				return binary.LittleEndian.Uint32(leafNodeKey(node, uint32(i))) >= id
+			})
+			return rows + uint32(below), nil
+		}
+		// Every child before the one that could hold id only holds smaller ids.
+		childIdx := internalNodeFindChild(node, id)
+		for i := uint32(0); i < childIdx; i++ {
+			rows += binary.LittleEndian.Uint32(internalNodeCount(node, i))
+		}
+		childNumBytes, err := internalNodeChild(node, childIdx)
+		if err != nil {
+			return 0, err
+		}
+		pageNum = binary.LittleEndian.Uint32(childNumBytes)
+	}
+}
+
+// keyAt returns the id of the row at position n, from 0, of the tree at pageNum,
+// and false if the tree holds n rows or fewer.
+func keyAt(pager *Pager, pageNum uint32, n uint32) (uint32, bool, error) {
+	for {
+		node, err := getPage(pager, pageNum)
+		if err != nil {
+			return 0, false, err
+		}
+		if getNodeType(node) == types.NodeLeaf {
+			if n >= binary.LittleEndian.Uint32(leafNodeNumCells(node)) {
+				return 0, false, nil
+			}
+			return binary.LittleEndian.Uint32(leafNodeKey(node, n)), true, nil
+		}
+		numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+		childIdx := uint32(0)
+		for ; childIdx <= numKeys; childIdx++ {
+			rows := binary.LittleEndian.Uint32(internalNodeCount(node, childIdx))
+			if n < rows {
+				break
+			}
+			n -= rows
+		}
+		if childIdx > numKeys {
+			return 0, false, nil
+		}
+		childNumBytes, err := internalNodeChild(node, childIdx)
+		if err != nil {
+			return 0, false, err
+		}
+		pageNum = binary.LittleEndian.Uint32(childNumBytes)
+	}
+}
+
+// rank returns the number of rows of the table with an id below id, counting rows that expired.
+func (t *Table) rank(id uint32) (uint64, error) {
+	rows := uint64(0)
+	for i, p := range t.trees() {
+		if p.from >= id {
+			break
+		}
+		if partitionEnd(t.trees(), i) < id {
+			root, err := getPage(t.pager, p.tree.rootPageNum)
+			if err != nil {
+				return 0, err
+			}
+			rows += uint64(nodeRows(root))
+			continue
+		}
+		below, err := rowsBelow(t.pager, p.tree.rootPageNum, id)
+		if err != nil {
+			return 0, err
+		}
+		rows += uint64(below)
+	}
+	return rows, nil
+}
+
+// countRange returns the number of rows with an id from from to to, counting rows that expired.
+func (t *Table) countRange(from uint32, to uint32) (uint64, error) {
+	if from > to {
+		return 0, nil
+	}
+	below, err := t.rank(from)
+	if err != nil {
+		return 0, err
+	}
+	if to == math.MaxUint32 {
+		return uint64(t.pager.header.RowCount) - below, nil
+	}
+	upTo, err := t.rank(to + 1)
+	if err != nil {
+		return 0, err
+	}
+	return upTo - below, nil
+}
+
+// keyAt returns the id of the row at position n, from 0, in id order, counting rows that expired.
+func (t *Table) keyAt(n uint64) (uint32, bool, error) {
+	for _, p := range t.trees() {
+		root, err := getPage(t.pager, p.tree.rootPageNum)
+		if err != nil {
+			return 0, false, err
+		}
+		if rows := uint64(nodeRows(root)); n >= rows {
+			n -= rows
+			continue
+		}
+		return keyAt(t.pager, p.tree.rootPageNum, uint32(n))
+	}
+	return 0, false, nil
+}
+
+// CountRange returns the number of rows with an id from from to to, inclusive.
+func (t *Table) CountRange(ctx context.Context, from uint32, to uint32) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if t.pager.header.ExpiringRows == 0 {
+		return t.countRange(from, to)
+	}
+	rows := uint64(0)
+	err := t.scanPartitions(from, to, false, func(tree *Table, from uint32, to uint32) error {
+		return tree.scanKeys(ctx, from, to, false, func(id uint32) error {
+			rows++
+			return nil
+		})
+	})
+	return rows, err
+}
+
+// KeyAt returns the id of the row at position n, from 0, in id order, and false
+// if the table has n rows or fewer.
+func (t *Table) KeyAt(ctx context.Context, n uint64) (uint32, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, false, err
+	}
+	if t.pager.header.ExpiringRows == 0 {
+		return t.keyAt(n)
+	}
+	var key uint32
+	found := false
+	err := t.scanPartitions(0, math.MaxUint32, false, func(tree *Table, from uint32, to uint32) error {
+		return tree.scanKeys(ctx, from, to, false, func(id uint32) error {
+			if n > 0 {
+				n--
+				return nil
+			}
+			key, found = id, true
+			return errLimitReached
+		})
+	})
+	if err == errLimitReached {
+		err = nil
+	}
+	return key, found, err
+}
+
+/*
+skipRows narrows the range of ids of a select to skip its first n rows in id
+order, or its last n rows in descending order, found by their position.
+*/
+func (t *Table) skipRows(where *filter, desc bool, n int64) error {
+	if where.from > where.to {
+		return nil
+	}
+	below, err := t.rank(where.from)
+	if err != nil {
+		return err
+	}
+	rows, err := t.countRange(where.from, where.to)
+	if err != nil {
+		return err
+	}
+	if uint64(n) >= rows {
+		where.from, where.to = 1, 0
+		return nil
+	}
+	if desc {
+		key, _, err := t.keyAt(below + rows - 1 - uint64(n))
+		where.to = key
+		return err
+	}
+	key, _, err := t.keyAt(below + uint64(n))
+	where.from = key
+	return err
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestRowCount(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	count := func() int64 {
+		var n int64
+		table.Execute(ctx, &parser.Select{Columns: []parser.SelectItem{{Aggregate: "count", Column: "*"}}}, func(values []any) error {
+			n = values[0].(int64)
+			return nil
+		})
+		return n
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("Expected an empty table to count 0. Got: %d", n)
+	}
+	ids := []int{}
+	for i := 1; i <= 40; i++ {
+		ids = append(ids, i)
+	}
+	table.BulkLoad(ctx, rowsOf(ids...))
+	for i := 41; i <= 60; i++ {
+		table.Insert(ctx, parseRow(fmt.Sprintf("insert %d user%d e", i, i)))
+	}
+	table.Delete(ctx, 7)
+	table.Delete(ctx, 1000)
+	if n := count(); n != 59 {
+		t.Fatalf("Expected 59 rows. Got: %d", n)
+	}
+
+	// Rolled back inserts and deletes, whole transactions or failed statements, are not counted.
+	table.Begin()
+	table.Insert(ctx, parseRow("insert 100 a e"))
+	table.Savepoint("s")
+	table.Delete(ctx, 8)
+	table.Insert(ctx, parseRow("insert 100 a e"))
+	table.RollbackTo("s")
+	if n := count(); n != 60 {
+		t.Fatalf("Expected 60 rows in the transaction. Got: %d", n)
+	}
+	table.Rollback()
+	if n := count(); n != 59 {
+		t.Fatalf("Expected 59 rows after the rollback. Got: %d", n)
+	}
+
+	// A cold count reads no pages.
+	table.Close()
+	table, _ = Open(dbName)
+	defer table.Close()
+	pagesRead := table.pager.pagesRead
+	if n := count(); n != 59 || table.pager.pagesRead != pagesRead {
+		t.Fatalf("Expected 59 rows from the header. Got: %d, %d pages read", n, table.pager.pagesRead-pagesRead)
+	}
+
+	// Rows with a ttl may have expired, so they are counted by a scan.
+	stmt, _ := parser.Parse("insert 200 a e ttl 10")
+	table.Execute(ctx, stmt, nil)
+	if n := count(); n != 60 {
+		t.Fatalf("Expected 60 rows with the one with a ttl. Got: %d", n)
+	}
+	now := time.Now()
+	table.now = func() time.Time { return now.Add(time.Minute) }
+	if n := count(); n != 59 {
+		t.Fatalf("Expected the expired row not to be counted. Got: %d", n)
+	}
+	if info, _ := table.Info(); info.Rows != 60 {
+		t.Fatalf("Expected Info to count the expired row until it is deleted. Got: %d", info.Rows)
+	}
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected no problems. Got: %v", problems)
+	}
+}
+
+func TestSubtreeCounts(t *testing.T) {
+	table, _ := openTestDb(t)
+	defer table.Close()
+	ctx := context.Background()
+	// Inserted out of order, so that leaves and internal nodes split in the middle.
+	ids := []int{}
+	for _, i := range rand.New(rand.NewSource(1)).Perm(200) {
+		if err := table.Insert(ctx, parseRow(fmt.Sprintf("insert %d user%d e", 3*i+3, i))); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	for i := 1; i <= 200; i++ {
+		if i%10 == 0 {
+			table.Delete(ctx, uint32(3*i))
+			continue
+		}
+		ids = append(ids, 3*i)
+	}
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected the counts to match the leaves. Got: %v", problems)
+	}
+
+	for n, id := range ids {
+		if key, ok, err := table.KeyAt(ctx, uint64(n)); err != nil || !ok || key != uint32(id) {
+			t.Fatalf("Expected row %d to have id %d. Got: %d, %t, %v", n, id, key, ok, err)
+		}
+	}
+	if _, ok, _ := table.KeyAt(ctx, uint64(len(ids))); ok {
+		t.Fatalf("Expected no row past the last one.")
+	}
+	for _, r := range [][2]uint32{{0, math.MaxUint32}, {4, 5}, {3, 3}, {30, 30}, {100, 400}, {599, 1000}, {500, 20}} {
+		want := uint64(0)
+		for _, id := range ids {
+			if uint32(id) >= r[0] && uint32(id) <= r[1] {
+				want++
+			}
+		}
+		if got, err := table.CountRange(ctx, r[0], r[1]); err != nil || got != want {
+			t.Fatalf("Expected %d rows from %d to %d. Got: %d, %v", want, r[0], r[1], got, err)
+		}
+	}
+
+	query := func(sql string) []int64 {
+		stmt, err := parser.Parse(sql)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		got := []int64{}
+		_, err = table.Execute(ctx, stmt, func(values []any) error {
+			got = append(got, values[0].(int64))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+		return got
+	}
+	// An offset seeks to its row instead of reading the rows before it.
+	scanned := table.rowsScanned
+	if got := query("select id limit 2 offset 150"); !slices.Equal(got, []int64{int64(ids[150]), int64(ids[151])}) {
+		t.Fatalf("Expected rows 150 and 151. Got: %v", got)
+	}
+	if table.rowsScanned-scanned > uint64(constants.LeafNodeMaxCells) {
+		t.Fatalf("Expected the offset not to scan the rows it skips. Got: %d rows scanned", table.rowsScanned-scanned)
+	}
+	if got := query("select id where id > 30 order by id desc limit 1 offset 2"); !slices.Equal(got, []int64{int64(ids[len(ids)-3])}) {
+		t.Fatalf("Expected the third row from the end. Got: %v", got)
+	}
+	if got := query("select id where id >= 27 and id <= 36 offset 1"); !slices.Equal(got, []int64{33, 36}) {
+		t.Fatalf("Expected the rows after 27. Got: %v", got)
+	}
+	if got := query("select id where email = 'e' and id < 20 offset 2"); !slices.Equal(got, []int64{9, 12, 15, 18}) {
+		t.Fatalf("Expected an offset over a filter to skip matching rows. Got: %v", got)
+	}
+	if got := query("select id offset 1000"); len(got) != 0 {
+		t.Fatalf("Expected no rows past the end. Got: %v", got)
+	}
+	if got := query("select count(*) where id >= 100 and id < 200"); !slices.Equal(got, []int64{30}) {
+		t.Fatalf("Expected 30 rows from 100 to 199. Got: %v", got)
+	}
+}
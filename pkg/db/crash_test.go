@@ -0,0 +1,152 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+)
+
+// powerLoss is shared by the files of one database and simulates the machine
+// losing power once a number of writes went through.
+type powerLoss struct {
+	writesLeft int
+	tornWrite  bool // Only the first half of the write hitting the limit reaches the disk.
+	crashed    bool
+}
+
+// errPowerLoss is the panic value that stops the engine at the moment the power is lost.
+var errPowerLoss = errors.New("power loss")
+
+// faultyFile forwards to a real file until the power is lost, which unwinds
+// the engine so that nothing after the failed write happens.
+type faultyFile struct {
+	*os.File
+	power *powerLoss
+}
+
+func (f *faultyFile) WriteAt(b []byte, off int64) (int, error) {
+	if f.power.writesLeft == 0 {
+		f.power.crashed = true
+		if f.power.tornWrite {
+			f.File.WriteAt(b[:len(b)/2], off)
+		}
+		panic(errPowerLoss)
+	}
+	f.power.writesLeft--
+	return f.File.WriteAt(b, off)
+}
+
+// insertUntilPowerLoss commits a single insert and reports whether the power was lost doing so.
+func insertUntilPowerLoss(table *Table, id int) (crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errPowerLoss {
+				panic(r)
+			}
+			crashed = true
+		}
+	}()
+	row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", id, id, id))
+	pagerBegin(table.pager)
+	insertRow(table, &row)
+	pagerCommit(table.pager)
+	pagerEvict(table.pager)
+	return false
+}
+
+func openFaultyTable(t *testing.T, dbName string, power *powerLoss) *Table {
+	f, err := os.OpenFile(dbName, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("Failed to open db file: %v", err)
+	}
+	wal, err := os.OpenFile(dbName+constants.WalFileSuffix, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatalf("Failed to open wal file: %v", err)
+	}
+	pager, err := newPager(&faultyFile{f, power}, &faultyFile{wal, power})
+	if err != nil {
+		t.Fatalf("Failed to open pager: %v", err)
+	}
+	table, err := openTable(pager)
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	return table
+}
+
+// checkTable verifies the whole tree and returns all keys in order.
+func checkTable(t *testing.T, table *Table) []uint32 {
+	if problems := integrityCheck(table); len(problems) > 0 {
+		t.Fatalf("Integrity check failed:\n%s", strings.Join(problems, "\n"))
+	}
+	cursor, err := tableStart(table)
+	if err != nil {
+		t.Fatalf("Failed to scan table: %v", err)
+	}
+	keys := []uint32{}
+	for !cursor.endOfTable {
+		rawRow, err := cursor.value()
+		if err != nil {
+			t.Fatalf("Failed to read row: %v", err)
+		}
+		keys = append(keys, deserializeRow(rawRow).Id)
+		if err := cursor.advance(); err != nil {
+			t.Fatalf("Failed to advance cursor: %v", err)
+		}
+	}
+	return keys
+}
+
+func TestCrashRecovery(t *testing.T) {
+	// Enough rows for a few leaf splits, but below the first internal node split.
+	const numRows = 28
+	dbName := filepath.Join(t.TempDir(), "test.db")
+	for _, torn := range []bool{false, true} {
+		for crashAfter := 0; ; crashAfter++ {
+			os.Remove(dbName)
+			os.Remove(dbName + constants.WalFileSuffix)
+			table, _ := Open(dbName)
+			table.Close()
+
+			power := &powerLoss{writesLeft: crashAfter, tornWrite: torn}
+			table = openFaultyTable(t, dbName, power)
+			// Checkpoint often so crashes also hit the copy into the db file.
+			table.pager.checkpointFrames = 8
+			durable := 0
+			for i := 1; i <= numRows; i++ {
+				if insertUntilPowerLoss(table, i) {
+					break
+				}
+				durable = i
+			}
+			if !power.crashed {
+				// Every insert went through, nothing left to crash.
+				break
+			}
+			// The process died, reopen the files as they are on disk.
+			table.pager.file.Close()
+			table.pager.wal.Close()
+
+			table, err := Open(dbName)
+			if err != nil {
+				t.Fatalf("Crash after %d writes (torn %v): failed to reopen: %v", crashAfter, torn, err)
+			}
+			keys := checkTable(t, table)
+			// The commit that was interrupted may or may not have made it.
+			if len(keys) != durable && len(keys) != durable+1 {
+				t.Fatalf("Crash after %d writes (torn %v): expected %d or %d rows, got %d.", crashAfter, torn, durable, durable+1, len(keys))
+			}
+			for i, key := range keys {
+				if key != uint32(i+1) {
+					t.Fatalf("Crash after %d writes (torn %v): unexpected keys %v", crashAfter, torn, keys)
+				}
+			}
+			table.Close()
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"iter"
+	"math"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Cursor iterates over the rows of a table in id order, in either direction.
+
+	c := table.Cursor()
+	for err := c.First(); c.Valid(); err = c.Next() {
+		...
+	}
+
+A cursor is positioned by First, Last or Seek. Moving past either end makes it
+invalid until it is positioned again. On a partitioned table it moves from one
+partition's tree into the next.
+
+A cursor stays valid across writes to the table, by the cursor's own program
+or anything sharing the table. It remembers the id of its row, and once a
+write may have moved rows, say by splitting the leaf it was in, it finds its
+place again by that id: Next goes to the row with the smallest id above it
+and Prev to the one with the largest id below it, so rows inserted ahead of
+the cursor are visited and deleted ones are not. Key keeps returning the id,
+while Value fails if the row was deleted.
+
+While a cursor is at a row it pins that row's page, so the page stays cached
+between calls. Close releases the pin once the cursor is no longer needed.
+*/
+
+// Cursor returns an unpositioned cursor over the table.
+func (t *Table) Cursor() *Cursor {
+	return &Cursor{table: t, owner: t, endOfTable: true}
+}
+
+// First moves the cursor to the row with the smallest id.
+func (c *Cursor) First() error {
+	return c.Seek(0)
+}
+
+// move runs a step of the cursor, then skip until it is not at an expired row,
+// moving its pin to the page it ends up on.
+func (c *Cursor) move(step func() error, skip func() error) error {
+	c.Close()
+	err := step()
+	for err == nil && !c.endOfTable {
+		var expired bool
+		if expired, err = c.expired(); err != nil || !expired {
+			break
+		}
+		err = skip()
+	}
+	if err == nil && !c.endOfTable {
+		c.anchor()
+	}
+	return err
+}
+
+// anchor pins the page of the row the cursor is at and remembers the row's id.
+func (c *Cursor) anchor() {
+	pager := c.table.pager
+	pinPage(pager, c.pageNum)
+	c.pinned = true
+	if node, err := getPage(pager, c.pageNum); err == nil {
+		c.key = binary.LittleEndian.Uint32(leafNodeKey(node, c.cellNum))
+	}
+	c.pageWrites = pager.pageWrites
+}
+
+// stale reports whether pages changed since the cursor got to its row, so
+// pageNum and cellNum may no longer point at it. The B-tree code's own
+// cursors never outlive a write.
+func (c *Cursor) stale() bool {
+	return c.owner != nil && !c.endOfTable && c.pageWrites != c.table.pager.pageWrites
+}
+
+// Last moves the cursor to the row with the largest id.
+func (c *Cursor) Last() error {
+	return c.move(func() error {
+		trees := c.owner.trees()
+		c.table = trees[len(trees)-1].tree
+		pageNum, err := rightmostLeaf(c.table, c.table.rootPageNum)
+		if err != nil {
+			return err
+		}
+		node, err := getPage(c.table.pager, pageNum)
+		if err != nil {
+			return err
+		}
+		c.pageNum = pageNum
+		c.cellNum = binary.LittleEndian.Uint32(leafNodeNumCells(node))
+		c.endOfTable = false
+		return c.backward()
+	}, c.backward)
+}
+
+// seekBefore moves the cursor to the row with the largest id <= key.
+func (c *Cursor) seekBefore(key uint32) error {
+	return c.move(func() error {
+		cursor, err := tableSeekBefore(c.owner.treeOf(key), key)
+		if err != nil {
+			return err
+		}
+		cursor.owner = c.owner
+		*c = *cursor
+		return c.hop(true)
+	}, c.backward)
+}
+
+// Seek moves the cursor to the row with the smallest id >= key.
+func (c *Cursor) Seek(key uint32) error {
+	return c.move(func() error {
+		cursor, err := tableSeek(c.owner.treeOf(key), key)
+		if err != nil {
+			return err
+		}
+		cursor.owner = c.owner
+		*c = *cursor
+		return c.hop(false)
+	}, c.forward)
+}
+
+// Next moves the cursor to the next row.
+func (c *Cursor) Next() error {
+	if c.endOfTable {
+		return nil
+	}
+	if c.stale() {
+		if c.key == math.MaxUint32 {
+			c.Close()
+			c.endOfTable = true
+			return nil
+		}
+		return c.Seek(c.key + 1)
+	}
+	return c.move(c.forward, c.forward)
+}
+
+// Prev moves the cursor to the previous row.
+func (c *Cursor) Prev() error {
+	if c.endOfTable {
+		return nil
+	}
+	if c.stale() {
+		if c.key == 0 {
+			c.Close()
+			c.endOfTable = true
+			return nil
+		}
+		return c.seekBefore(c.key - 1)
+	}
+	return c.move(c.backward, c.backward)
+}
+
+// forward advances the cursor, into the next partition at the end of one.
+func (c *Cursor) forward() error {
+	if err := c.advance(); err != nil {
+		return err
+	}
+	return c.hop(false)
+}
+
+// backward retreats the cursor, into the previous partition at the start of one.
+func (c *Cursor) backward() error {
+	if err := c.retreat(); err != nil {
+		return err
+	}
+	return c.hop(true)
+}
+
+// hop moves a cursor that ran off its partition's tree to the first row of
+// the next partition, or the last row of the previous one if backwards,
+// skipping empty partitions. It stays invalid once there are no more.
+func (c *Cursor) hop(backwards bool) error {
+	for c.endOfTable {
+		tree := c.owner.adjacentTree(c.table, backwards)
+		if tree == nil {
+			return nil
+		}
+		seek, key := tableSeek, uint32(0)
+		if backwards {
+			seek, key = tableSeekBefore, math.MaxUint32
+		}
+		cursor, err := seek(tree, key)
+		if err != nil {
+			return err
+		}
+		cursor.owner = c.owner
+		*c = *cursor
+	}
+	return nil
+}
+
+// Close releases the cursor's pin. The cursor can still be positioned again.
+func (c *Cursor) Close() {
+	if c.pinned {
+		unpinPage(c.table.pager, c.pageNum)
+		c.pinned = false
+	}
+}
+
+// Valid reports whether the cursor is at a row.
+func (c *Cursor) Valid() bool {
+	return !c.endOfTable
+}
+
+// Key returns the id of the row under the cursor.
+func (c *Cursor) Key() (uint32, error) {
+	if c.endOfTable {
+		return 0, fmt.Errorf("cursor is not at a row")
+	}
+	if c.stale() {
+		return c.key, nil
+	}
+	node, err := getPage(c.table.pager, c.pageNum)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(leafNodeKey(node, c.cellNum)), nil
+}
+
+// Value returns the row under the cursor.
+func (c *Cursor) Value() (types.Row, error) {
+	if c.endOfTable {
+		return types.Row{}, fmt.Errorf("cursor is not at a row")
+	}
+	if c.stale() {
+		if err := c.refind(); err != nil {
+			return types.Row{}, err
+		}
+	}
+	raw, err := c.value()
+	if err != nil {
+		return types.Row{}, err
+	}
+	return deserializeRow(raw), nil
+}
+
+// refind moves a stale cursor back to its row, failing if the row was deleted.
+func (c *Cursor) refind() error {
+	tree := c.owner.treeOf(c.key)
+	cursor, err := tableFind(tree, c.key)
+	if err != nil {
+		return err
+	}
+	node, err := getPage(tree.pager, cursor.pageNum)
+	if err != nil {
+		return err
+	}
+	if cursor.cellNum >= binary.LittleEndian.Uint32(leafNodeNumCells(node)) ||
+		binary.LittleEndian.Uint32(leafNodeKey(node, cursor.cellNum)) != c.key {
+		return fmt.Errorf("row %d under the cursor was deleted", c.key)
+	}
+	c.Close()
+	c.table, c.pageNum, c.cellNum = tree, cursor.pageNum, cursor.cellNum
+	c.anchor()
+	return nil
+}
+
+/*
+Range returns an iterator moving the cursor over the rows with ids from lo to
+hi, in id order:
+
+	c := table.Cursor()
+	defer c.Close()
+	for id, row := range c.Range(10, 20) {
+		...
+	}
+	if err := c.Err(); err != nil {
+		...
+	}
+
+Breaking out of the loop stops the iteration, leaving the cursor at the last
+row it yielded. An error reading the table ends the iteration early, Err
+returns it. Like any use of the cursor, the loop may write to the table.
+*/
+func (c *Cursor) Range(lo uint32, hi uint32) iter.Seq2[uint32, types.Row] {
+	return func(yield func(uint32, types.Row) bool) {
+		for c.err = c.Seek(lo); c.err == nil && c.Valid(); c.err = c.Next() {
+			var row types.Row
+			if row, c.err = c.Value(); c.err != nil || row.Id > hi || !yield(row.Id, row) {
+				return
+			}
+		}
+	}
+}
+
+// All returns an iterator moving the cursor over every row of the table in id order, like Range.
+func (c *Cursor) All() iter.Seq2[uint32, types.Row] {
+	return c.Range(0, math.MaxUint32)
+}
+
+// Err returns the error that ended the last iteration of Range or All, nil if there was none.
+func (c *Cursor) Err() error {
+	return c.err
+}
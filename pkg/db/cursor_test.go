@@ -0,0 +1,230 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestCursor(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	c := table.Cursor()
+	if err := c.First(); err != nil || c.Valid() {
+		t.Fatalf("Expected a cursor over an empty table to be invalid. Got: %v, %v", c.Valid(), err)
+	}
+	for i := 1; i <= 100; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d e", i, i)))
+	}
+	// Empty some leaves in the middle.
+	for i := 30; i <= 60; i++ {
+		table.Delete(context.Background(), uint32(i))
+	}
+	expected := []uint32{}
+	for i := uint32(1); i <= 100; i++ {
+		if i < 30 || i > 60 {
+			expected = append(expected, i)
+		}
+	}
+
+	forward := []uint32{}
+	for err := c.First(); c.Valid(); err = c.Next() {
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		key, _ := c.Key()
+		row, _ := c.Value()
+		if row.Id != key {
+			t.Fatalf("Key %d does not match row %d", key, row.Id)
+		}
+		forward = append(forward, key)
+	}
+	if fmt.Sprint(forward) != fmt.Sprint(expected) {
+		t.Fatalf("Forward iteration: got %v, expected %v", forward, expected)
+	}
+
+	backward := []uint32{}
+	for err := c.Last(); c.Valid(); err = c.Prev() {
+		if err != nil {
+			t.Fatalf("Prev failed: %v", err)
+		}
+		key, _ := c.Key()
+		backward = append(backward, key)
+	}
+	slices.Reverse(backward)
+	if fmt.Sprint(backward) != fmt.Sprint(expected) {
+		t.Fatalf("Backward iteration: got %v, expected %v", backward, expected)
+	}
+
+	c.Seek(45)
+	if key, _ := c.Key(); key != 61 {
+		t.Fatalf("Expected Seek(45) to land on 61. Got: %d", key)
+	}
+	c.Prev()
+	if key, _ := c.Key(); key != 29 {
+		t.Fatalf("Expected Prev from 61 to land on 29. Got: %d", key)
+	}
+	c.Seek(101)
+	if _, err := c.Key(); c.Valid() || err == nil {
+		t.Fatalf("Expected Seek past the last row to invalidate the cursor")
+	}
+}
+
+func TestCursorPinsPage(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	for i := 1; i <= 100; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d e", i, i)))
+	}
+	table.pager.maxCachedPages = 1
+
+	c := table.Cursor()
+	c.Seek(50)
+	pageNum := c.pageNum
+	// Scans evict everything they can once they are done.
+	table.Scan(context.Background(), func(row types.Row) error { return nil })
+	if _, ok := table.pager.pages[pageNum]; !ok {
+		t.Fatalf("Expected the page under the cursor to stay cached.")
+	}
+	c.Last()
+	if c.pageNum == pageNum || table.pager.pins[pageNum] != 0 || table.pager.pins[c.pageNum] != 1 {
+		t.Fatalf("Expected the pin to move with the cursor. Got: %v", table.pager.pins)
+	}
+	c.Close()
+	if len(table.pager.pins) != 0 {
+		t.Fatalf("Expected Close to release the pin. Got: %v", table.pager.pins)
+	}
+	table.Scan(context.Background(), func(row types.Row) error { return nil })
+	if got := table.pager.lru.Len(); got > 1 {
+		t.Fatalf("Expected unpinned pages to be evicted. Got %d cached pages", got)
+	}
+}
+
+func TestCursorSurvivesWrites(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	ctx := context.Background()
+	for i := 2; i <= 200; i += 2 {
+		table.Insert(ctx, parseRow(fmt.Sprintf("insert %d user%d e", i, i)))
+	}
+	// Inserting the row after the cursor's splits leaves under it, and the
+	// inserted row is visited next.
+	c := table.Cursor()
+	visited := []uint32{}
+	for err := c.First(); c.Valid(); err = c.Next() {
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		key, _ := c.Key()
+		if row, err := c.Value(); err != nil || row.Id != key {
+			t.Fatalf("Expected row %d. Got: %d, %v", key, row.Id, err)
+		}
+		visited = append(visited, key)
+		if key%2 == 0 {
+			table.Insert(ctx, parseRow(fmt.Sprintf("insert %d user%d e", key+1, key+1)))
+		}
+	}
+	if len(visited) != 200 || visited[0] != 2 || visited[199] != 201 {
+		t.Fatalf("Expected ids 2 to 201. Got %d ids: %v", len(visited), visited)
+	}
+
+	// Deleting the rows around the cursor, it skips them both ways.
+	c.Seek(100)
+	table.Delete(ctx, 99)
+	table.Delete(ctx, 101)
+	if c.Next(); !c.Valid() {
+		t.Fatalf("Expected Next to find a row")
+	}
+	if key, _ := c.Key(); key != 102 {
+		t.Fatalf("Expected Next to skip the deleted 101. Got: %d", key)
+	}
+	c.Seek(100)
+	table.Delete(ctx, 98)
+	if c.Prev(); !c.Valid() {
+		t.Fatalf("Expected Prev to find a row")
+	}
+	if key, _ := c.Key(); key != 97 {
+		t.Fatalf("Expected Prev to skip the deleted 99 and 98. Got: %d", key)
+	}
+
+	// The cursor's own row being deleted, it keeps its id but has no value.
+	c.Seek(100)
+	table.Delete(ctx, 100)
+	if key, err := c.Key(); err != nil || key != 100 {
+		t.Fatalf("Expected the cursor to keep id 100. Got: %d, %v", key, err)
+	}
+	if _, err := c.Value(); err == nil {
+		t.Fatalf("Expected the value of a deleted row to fail")
+	}
+	if c.Next(); !c.Valid() {
+		t.Fatalf("Expected Next to find a row")
+	}
+	if key, _ := c.Key(); key != 102 {
+		t.Fatalf("Expected Next from the deleted 100 to land on 102. Got: %d", key)
+	}
+
+	// A rollback puts back the pages, the cursor follows.
+	table.Begin()
+	table.Delete(ctx, 103)
+	c.Seek(102)
+	table.Rollback()
+	if c.Next(); !c.Valid() {
+		t.Fatalf("Expected Next to find a row")
+	}
+	if key, _ := c.Key(); key != 103 {
+		t.Fatalf("Expected the rolled back 103. Got: %d", key)
+	}
+	c.Close()
+	if len(table.pager.pins) != 0 {
+		t.Fatalf("Expected no pins left. Got: %v", table.pager.pins)
+	}
+}
+
+func TestRangeIterator(t *testing.T) {
+	table, _ := Open(filepath.Join(t.TempDir(), "test.db"))
+	for i := 1; i <= 50; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d e", i, i)))
+	}
+	c := table.Cursor()
+	ids := []uint32{}
+	for id, row := range c.Range(10, 20) {
+		if id != row.Id {
+			t.Fatalf("Expected id %d to be the row's. Got: %d", id, row.Id)
+		}
+		ids = append(ids, id)
+	}
+	if err := c.Err(); err != nil || len(ids) != 11 || ids[0] != 10 || ids[10] != 20 {
+		t.Fatalf("Expected ids 10 to 20. Got: %v, %v", ids, err)
+	}
+
+	// The loop may break out early and delete rows.
+	ids = ids[:0]
+	for id := range c.All() {
+		ids = append(ids, id)
+		table.Delete(context.Background(), id+1)
+		if len(ids) == 5 {
+			break
+		}
+	}
+	c.Close()
+	if err := c.Err(); err != nil || fmt.Sprint(ids) != "[1 3 5 7 9]" || len(table.pager.pins) != 0 {
+		t.Fatalf("Expected 5 rows, skipping the deleted ones, and no pins once closed. Got: %v, %v, %v", ids, err, table.pager.pins)
+	}
+
+	// A failed read ends the iteration and is kept for Err.
+	table.pager.file.Close()
+	table.pager.wal.Close()
+	table.pager.pages = map[uint32]*list.Element{}
+	table.pager.lru.Init()
+	for range c.All() {
+		t.Fatalf("Expected no rows from a table that can not be read.")
+	}
+	if c.Err() == nil {
+		t.Fatalf("Expected the failed read to be returned by Err.")
+	}
+}
@@ -0,0 +1,705 @@
+/*
+Package db is the storage engine: a single table of rows stored in a B-tree,
+paged through an LRU cache and made durable by a write-ahead log.
+
+A Table is not safe for concurrent use.
+*/
+package db
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+var errReadOnly = dberr.ErrReadOnly
+
+type Table struct {
+	pager       *Pager
+	rootPageNum uint32
+	statements  uint64 // Executed, see WriteMetrics.
+	rowsScanned uint64
+	logger      *slog.Logger
+	now         func() time.Time // Decides which rows have expired.
+	partitions  []partition      // Nil unless the table is partitioned, see partition.go.
+	views       []view           // The materialized views, see views.go.
+	auxiliary   bool             // The tree of a view or of stored generated values, whose rows are not rows of the table.
+	txnWritten  uint64           // The pager's rowsWritten when the explicit transaction began.
+	locks       *rowLocks        // Of the transactions of BeginTxn, see locks.go.
+	lockTimeout time.Duration    // Of the transactions of BeginTxn, see SetLockTimeout.
+	isolation   string           // Of the transactions of BeginTxn, see SetIsolation.
+}
+
+// discardLogger is the logger of a table until SetLogger is called, the engine is silent by default.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// SetLogger routes the diagnostics of the table and its pager to logger.
+func (t *Table) SetLogger(logger *slog.Logger) {
+	t.logger = logger
+	t.pager.logger = logger
+	for _, p := range t.partitions {
+		p.tree.logger = logger
+	}
+}
+
+// Open opens the database file, creating it if it does not exist. Passing
+// MemoryDbName opens a fresh database that is held in memory only.
+func Open(filename string) (*Table, error) {
+	return OpenEncrypted(filename, "")
+}
+
+// OpenReadOnly opens an existing database for reading. Statements that write fail.
+func OpenReadOnly(filename string) (*Table, error) {
+	return OpenReadOnlyEncrypted(filename, "")
+}
+
+func openTable(pager *Pager) (*Table, error) {
+	table := Table{
+		rootPageNum: pager.header.RootPageNum,
+		pager:       pager,
+		logger:      pager.logger,
+		now:         time.Now,
+		locks:       newRowLocks(),
+		isolation:   "read committed",
+	}
+	if pager.numPages == 0 && pager.readOnly {
+		return nil, fmt.Errorf("%s holds no pages, open it for writing once", pager.file.Name())
+	}
+	if pager.numPages == 0 {
+		rootNode, err := getPage(pager, table.rootPageNum)
+		if err != nil {
+			return nil, err
+		}
+		initializeLeafNode(rootNode)
+		setNodeRoot(rootNode, true)
+		markPageDirty(pager, table.rootPageNum)
+		// Commit the empty root right away, so rolling back the first transaction keeps it.
+		if err := pagerCommit(pager); err != nil {
+			return nil, err
+		}
+	}
+	if err := table.load(); err != nil {
+		return nil, err
+	}
+	return &table, nil
+}
+
+// load sets the table up from the file header: its trees, indexes, generated columns and views.
+func (t *Table) load() error {
+	pager := t.pager
+	t.rootPageNum = pager.header.RootPageNum
+	t.loadPartitions()
+	for _, p := range t.trees() {
+		// The pages themselves are only read on demand, see checkTreeNode.
+		if p.tree.rootPageNum >= pager.numPages {
+			return fmt.Errorf("the root page %d is past the end of the file, which has %d pages", p.tree.rootPageNum, pager.numPages)
+		}
+	}
+	if err := t.loadFulltextIndex(); err != nil {
+		return err
+	}
+	if err := t.loadGenerated(); err != nil {
+		return err
+	}
+	if err := t.checkCollations(); err != nil {
+		return err
+	}
+	if err := t.checkUniqueIndex(); err != nil {
+		return err
+	}
+	return t.loadViews()
+}
+
+// Refresh makes a table opened read-only see the commits a writer made since
+// it was opened or last refreshed. Execute refreshes before every statement.
+func (t *Table) Refresh() error {
+	if !t.pager.readOnly {
+		return nil
+	}
+	keySalt := t.pager.header.KeySalt
+	changed, err := pagerRefresh(t.pager)
+	if err != nil || !changed {
+		return err
+	}
+	if t.pager.header.KeySalt != keySalt {
+		return fmt.Errorf("%s was rekeyed, open it again with its new passphrase", t.pager.file.Name())
+	}
+	return t.load()
+}
+
+// Close commits any pending changes, checkpoints the WAL and closes the files.
+// A transaction that was never committed is rolled back.
+func (t *Table) Close() error {
+	pager := t.pager
+	pagerDropPrefetches(pager)
+	// Uncommitted changes are rolled back below, nothing more reaches the subscribers.
+	pager.changes.closeAll()
+	if pager.inMemory {
+		// Nothing outlives the process, the pages are simply dropped.
+		pager.pages = map[uint32]*list.Element{}
+		pager.lru.Init()
+		pager.file.Close()
+		return pager.wal.Close()
+	}
+	if pager.readOnly {
+		return pagerCloseFiles(pager, false)
+	}
+	if pager.inTxn {
+		pagerRollback(pager)
+	}
+	if err := pagerCommit(pager); err != nil {
+		return err
+	}
+	// Held until the files are closed, so no reader opens while the WAL goes away.
+	if _, err := pagerExcludeReaders(pager); errors.Is(err, errReadersOpen) {
+		// The readers still read the commits in the WAL, which is left for the
+		// next writer to checkpoint once they are gone.
+		pager.pages = map[uint32]*list.Element{}
+		pager.lru.Init()
+		return pagerCloseFiles(pager, false)
+	} else if err != nil {
+		return err
+	}
+	if err := pagerCheckpoint(pager); err != nil {
+		return err
+	}
+	if err := pagerWriteHeader(pager); err != nil {
+		return err
+	}
+	// The commit leaves nothing dirty, pages that were only read are not written back.
+	for i := uint32(0); i < pager.numPages; i++ {
+		if elem, ok := pager.pages[i]; !ok || !elem.Value.(*cachedPage).dirty {
+			continue
+		}
+		if err := pagerFlush(pager, i); err != nil {
+			return err
+		}
+	}
+	pager.pages = map[uint32]*list.Element{}
+	pager.lru.Init()
+	return pagerCloseFiles(pager, true)
+}
+
+// Insert adds a row, failing if a row with the same id exists.
+func (t *Table) Insert(ctx context.Context, row types.Row) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.write(func() error {
+		return insertRow(t.treeOf(row.Id), &row)
+	})
+}
+
+// Delete removes the row with the given id.
+func (t *Table) Delete(ctx context.Context, id uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.write(func() error {
+		return deleteRow(t.treeOf(id), id)
+	})
+}
+
+// Scan calls fn for every row in id order, stopping at the first error.
+// The context is checked before every leaf page, cancelling it aborts the scan.
+func (t *Table) Scan(ctx context.Context, fn func(row types.Row) error) error {
+	return t.scanPartitions(0, math.MaxUint32, false, func(tree *Table, from uint32, to uint32) error {
+		return tree.scanRange(ctx, from, to, fn)
+	})
+}
+
+// ScanKeys calls fn with the id of every row with an id between from and to, inclusive,
+// in ascending order. The rows themselves are not decoded.
+func (t *Table) ScanKeys(ctx context.Context, from uint32, to uint32, fn func(id uint32) error) error {
+	return t.scanPartitions(from, to, false, func(tree *Table, from uint32, to uint32) error {
+		return tree.scanKeys(ctx, from, to, false, fn)
+	})
+}
+
+// scanRange is Scan limited to the rows with an id between from and to, inclusive, in
+// the tree of the table. Partitioned tables scan each partition, see scanPartitions.
+func (t *Table) scanRange(ctx context.Context, from uint32, to uint32, fn func(row types.Row) error) error {
+	defer pagerEvict(t.pager)
+	cursor, err := tableSeek(t, from)
+	if err != nil {
+		return err
+	}
+	leafPageNum := constants.InvalidPageNum
+	for !cursor.endOfTable {
+		if cursor.pageNum != leafPageNum {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			leafPageNum = cursor.pageNum
+			if err := prefetchNextLeaf(t.pager, leafPageNum); err != nil {
+				return err
+			}
+		}
+		rawRow, err := cursor.value()
+		if err != nil {
+			return err
+		}
+		row := deserializeRow(rawRow)
+		t.rowsScanned++
+		if row.Id > to {
+			return nil
+		}
+		if !t.expired(row) {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		if err := cursor.advance(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanRangeDesc is scanRange in descending id order.
+func (t *Table) scanRangeDesc(ctx context.Context, from uint32, to uint32, fn func(row types.Row) error) error {
+	defer pagerEvict(t.pager)
+	cursor, err := tableSeekBefore(t, to)
+	if err != nil {
+		return err
+	}
+	leafPageNum := constants.InvalidPageNum
+	for !cursor.endOfTable {
+		if cursor.pageNum != leafPageNum {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			leafPageNum = cursor.pageNum
+		}
+		rawRow, err := cursor.value()
+		if err != nil {
+			return err
+		}
+		row := deserializeRow(rawRow)
+		t.rowsScanned++
+		if row.Id < from {
+			return nil
+		}
+		if !t.expired(row) {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		if err := cursor.retreat(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanKeys calls fn with every id between from and to, inclusive, in ascending or descending
+// order. It reads the keys from the leaves without decoding the rows.
+func (t *Table) scanKeys(ctx context.Context, from uint32, to uint32, desc bool, fn func(id uint32) error) error {
+	defer pagerEvict(t.pager)
+	seek, step := tableSeek, (*Cursor).advance
+	start := from
+	if desc {
+		seek, step = tableSeekBefore, (*Cursor).retreat
+		start = to
+	}
+	cursor, err := seek(t, start)
+	if err != nil {
+		return err
+	}
+	leafPageNum := constants.InvalidPageNum
+	for !cursor.endOfTable {
+		if cursor.pageNum != leafPageNum {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			leafPageNum = cursor.pageNum
+		}
+		id, err := cursor.Key()
+		if err != nil {
+			return err
+		}
+		t.rowsScanned++
+		if id < from || id > to {
+			return nil
+		}
+		expired, err := cursor.expired()
+		if err != nil {
+			return err
+		}
+		if !expired {
+			if err := fn(id); err != nil {
+				return err
+			}
+		}
+		if err := step(cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+write runs a write statement so that a failure leaves no trace. Outside of an
+explicit transaction the statement commits on its own, refreshing the views
+that are refreshed on commit first, inside one it is undone by rolling back
+to a savepoint without aborting the transaction.
+*/
+func (t *Table) write(fn func() error) error {
+	if t.pager.readOnly {
+		return errReadOnly
+	}
+	defer pagerEvict(t.pager)
+	if t.pager.inTxn {
+		pagerSavepoint(t.pager, statementSavepoint)
+		err := fn()
+		if err != nil {
+			pagerRollbackTo(t.pager, statementSavepoint)
+		}
+		pagerRelease(t.pager, statementSavepoint)
+		return err
+	}
+
+	pagerBegin(t.pager)
+	written := t.pager.rowsWritten
+	err := fn()
+	if err == nil {
+		err = t.refreshOnCommit(written)
+	}
+	if err == nil {
+		err = pagerCommit(t.pager)
+	}
+	// Still open if either the statement or its commit failed.
+	if t.pager.inTxn {
+		pagerRollback(t.pager)
+	}
+	return err
+}
+
+// Begin starts an explicit transaction, which lasts until Commit or Rollback.
+func (t *Table) Begin() error {
+	if t.pager.readOnly {
+		return errReadOnly
+	}
+	if t.pager.inTxn {
+		return fmt.Errorf("cannot start a transaction within a transaction")
+	}
+	pagerBegin(t.pager)
+	t.txnWritten = t.pager.rowsWritten
+	return nil
+}
+
+// InTransaction reports whether an explicit transaction is open.
+func (t *Table) InTransaction() bool {
+	return t.pager.inTxn
+}
+
+// Commit commits the explicit transaction. If refreshing the views that are
+// refreshed on commit fails, the transaction is rolled back instead.
+func (t *Table) Commit() error {
+	if !t.pager.inTxn {
+		return fmt.Errorf("cannot commit - no transaction is active")
+	}
+	defer pagerEvict(t.pager)
+	if err := t.refreshOnCommit(t.txnWritten); err != nil {
+		pagerRollback(t.pager)
+		return err
+	}
+	return pagerCommit(t.pager)
+}
+
+func (t *Table) Rollback() error {
+	if !t.pager.inTxn {
+		return fmt.Errorf("cannot rollback - no transaction is active")
+	}
+	pagerRollback(t.pager)
+	return nil
+}
+
+func (t *Table) Savepoint(name string) error {
+	if !t.pager.inTxn {
+		return fmt.Errorf("cannot create savepoint - no transaction is active")
+	}
+	pagerSavepoint(t.pager, name)
+	return nil
+}
+
+func (t *Table) RollbackTo(name string) error {
+	if !t.pager.inTxn {
+		return fmt.Errorf("cannot rollback - no transaction is active")
+	}
+	return pagerRollbackTo(t.pager, name)
+}
+
+func (t *Table) Release(name string) error {
+	if !t.pager.inTxn {
+		return fmt.Errorf("cannot release savepoint - no transaction is active")
+	}
+	return pagerRelease(t.pager, name)
+}
+
+// Checkpoint copies the committed pages from the WAL into the db file.
+func (t *Table) Checkpoint() error {
+	if t.pager.readOnly {
+		return errReadOnly
+	}
+	return pagerCheckpoint(t.pager)
+}
+
+// IntegrityCheck returns a description of every broken invariant in the tree, or nothing if it is sound.
+func (t *Table) IntegrityCheck() []string {
+	return integrityCheck(t)
+}
+
+// PrintTree writes the structure of the B-tree to w, or of every partition's.
+func (t *Table) PrintTree(w io.Writer) error {
+	if t.partitions == nil {
+		return displayTree(w, t.pager, t.rootPageNum, 0)
+	}
+	for i, p := range t.partitions {
+		fmt.Fprintf(w, "partition %d-%d:\n", p.from, partitionEnd(t.partitions, i))
+		if err := displayTree(w, t.pager, p.tree.rootPageNum, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTreeDot writes the B-tree, or every partition's, to w as a Graphviz graph, see writeDot.
+func (t *Table) WriteTreeDot(w io.Writer) error {
+	fmt.Fprintln(w, "digraph btree {")
+	fmt.Fprintln(w, "\tnode [shape=box];")
+	for _, p := range t.trees() {
+		if _, _, _, err := writeDot(w, t.pager, p.tree.rootPageNum); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// DumpPage writes the bytes of a page to w, after the fields of its node header.
+func (t *Table) DumpPage(w io.Writer, pageNum uint32) error {
+	if pageNum >= t.pager.numPages {
+		return fmt.Errorf("page %d is out of bounds, the file has %d pages", pageNum, t.pager.numPages)
+	}
+	node, err := getPage(t.pager, pageNum)
+	if err != nil {
+		return err
+	}
+	dumpPage(w, node, pageNum)
+	return nil
+}
+
+// PrintSubtree writes the structure of the B-tree below the node at a page to w,
+// which may be the node of any tree in the file, an index's as well as the table's.
+func (t *Table) PrintSubtree(w io.Writer, pageNum uint32) error {
+	if pageNum >= t.pager.numPages {
+		return fmt.Errorf("page %d is out of bounds, the file has %d pages", pageNum, t.pager.numPages)
+	}
+	node, err := getPage(t.pager, pageNum)
+	if err != nil {
+		return err
+	}
+	if nodeType := getNodeType(node); nodeType != types.NodeLeaf && nodeType != types.NodeInternal {
+		return fmt.Errorf("page %d is not a B-tree node", pageNum)
+	}
+	return displayTree(w, t.pager, pageNum, 0)
+}
+
+// TableName is the name of the only table in a database.
+const TableName = "users"
+
+// TableInfo describes where a table is stored and how large it is.
+type TableInfo struct {
+	Name     string `json:"name"`
+	RootPage uint32 `json:"rootPage"`
+	Rows     uint32 `json:"rows"`
+	Pages    uint32 `json:"pages"` // Pages in the database file, including free ones.
+}
+
+// Info describes the table, with the row count of the file header, which
+// counts the rows that expired but were not deleted yet.
+func (t *Table) Info() (TableInfo, error) {
+	return TableInfo{Name: TableName, RootPage: t.rootPageNum, Rows: t.pager.header.RowCount, Pages: t.pager.numPages}, nil
+}
+
+func serializeRow(r *types.Row) []byte {
+	buf := make([]byte, constants.RowSize)
+	binary.LittleEndian.PutUint32(buf[constants.IdOffset:], r.Id)
+	copy(buf[constants.UsernameOffset:], r.Username[:])
+	copy(buf[constants.EmailOffset:], r.Email[:])
+	binary.LittleEndian.PutUint64(buf[constants.ExpiresAtOffset:], uint64(r.ExpiresAt))
+	return buf
+}
+
+func deserializeRow(buf []byte) types.Row {
+	r := types.Row{}
+	r.Id = binary.LittleEndian.Uint32(buf[:constants.IdSize])
+	copy(r.Username[:], buf[constants.UsernameOffset:constants.UsernameOffset+constants.UsernameSize])
+	copy(r.Email[:], buf[constants.EmailOffset:constants.EmailOffset+constants.EmailSize])
+	r.ExpiresAt = int64(binary.LittleEndian.Uint64(buf[constants.ExpiresAtOffset:]))
+	return r
+}
+
+func insertRow(table *Table, rowToInsert *types.Row) error {
+	keyToInsert := rowToInsert.Id
+	cursor, err := tableFind(table, keyToInsert)
+	if err != nil {
+		return err
+	}
+	node, err := getPage(table.pager, cursor.pageNum)
+	if err != nil {
+		return err
+	}
+	numCells := binary.LittleEndian.Uint32(leafNodeNumCells(node))
+
+	if cursor.cellNum < numCells {
+		keyAtIndex := binary.LittleEndian.Uint32(leafNodeKey(node, cursor.cellNum))
+		if keyAtIndex == keyToInsert {
+			if !expiredAt(leafNodeValue(node, cursor.cellNum), table.now().Unix()) {
+				return dberr.ErrDuplicateKey
+			}
+			// The expired row is deleted first, as if it had been swept already.
+			if err := deleteRow(table, keyToInsert); err != nil {
+				return err
+			}
+			return insertRow(table, rowToInsert)
+		}
+	}
+	if err := leafNodeInsert(cursor, rowToInsert.Id, rowToInsert); err != nil {
+		return err
+	}
+	if table.auxiliary {
+		return nil
+	}
+	table.pager.rowsWritten++
+	countRow(table.pager, rowToInsert.ExpiresAt, 1)
+	bloomAdd(table.pager, rowToInsert.Id)
+	inserted := *rowToInsert
+	table.pager.changes.record(Change{Op: "insert", After: &inserted})
+	if err := generatedInsert(table.pager, rowToInsert); err != nil {
+		return err
+	}
+	if err := descendingInsert(table.pager, *rowToInsert); err != nil {
+		return err
+	}
+	if err := orderedInsert(table.pager, *rowToInsert); err != nil {
+		return err
+	}
+	return uniqueInsert(table, rowToInsert)
+}
+
+func deleteRow(table *Table, keyToDelete uint32) error {
+	/*
+		1) Find leaf node that should contain the key.
+		2) If key not in the node, terminate search as key does not exist.
+		3) If it exists, remove the cell
+		4) shift all cells to the right to the left by 1
+		5) if the number of cells >= minCellsLeafNode, delete terminates here.
+		6) Otherwise, must restructure the node by merging with neighbors
+		7) TODO: restucturing follows up as a next step.
+	*/
+	if !table.auxiliary && !bloomMayContain(table.pager, keyToDelete) {
+		return dberr.Errorf(dberr.ErrKeyNotFound, "key %d does not exist", keyToDelete)
+	}
+	cursor, err := tableFind(table, keyToDelete)
+	if err != nil {
+		return err
+	}
+	node, err := getPage(table.pager, cursor.pageNum)
+	if err != nil {
+		return err
+	}
+	numCells := binary.LittleEndian.Uint32(leafNodeNumCells(node))
+
+	if cursor.cellNum >= numCells {
+		return dberr.Errorf(dberr.ErrKeyNotFound, "key %d does not exist", keyToDelete)
+	}
+
+	keyAtIndex := binary.LittleEndian.Uint32(leafNodeKey(node, cursor.cellNum))
+	if keyAtIndex != keyToDelete {
+		return dberr.Errorf(dberr.ErrKeyNotFound, "key %d does not exist", keyToDelete)
+	}
+
+	table.logger.Debug("deleting row", "id", keyToDelete, "page", cursor.pageNum, "cell", cursor.cellNum)
+	if !table.auxiliary {
+		table.pager.rowsWritten++
+		deleted := deserializeRow(leafNodeValue(node, cursor.cellNum))
+		countRow(table.pager, deleted.ExpiresAt, -1)
+		table.pager.changes.record(Change{Op: "delete", Before: &deleted})
+		if err := spatialDelete(table.pager, keyToDelete); err != nil {
+			return err
+		}
+		if err := descendingDelete(table.pager, keyToDelete); err != nil {
+			return err
+		}
+		if err := orderedDelete(table.pager, deleted); err != nil {
+			return err
+		}
+		// Before the stored generated values, which the indexed column may be one of.
+		if err := uniqueDelete(table.pager, deleted); err != nil {
+			return err
+		}
+		if err := generatedDelete(table.pager, keyToDelete); err != nil {
+			return err
+		}
+	}
+
+	// 2) Move all cells above the deleted row 1 level down.
+
+	for i := cursor.cellNum + 1; i < numCells; i++ {
+		copy(leafNodeCell(node, i-1), leafNodeCell(node, i))
+	}
+	markPageDirty(table.pager, cursor.pageNum)
+
+	// Update node's cellnum.
+	// TODO: handle deleting last cell in node:
+	binary.LittleEndian.PutUint32(leafNodeNumCells(node), numCells-1)
+	if err := countRows(table.pager, cursor.pageNum, -1); err != nil {
+		return err
+	}
+	if numCells-1 == 0 {
+		table.logger.Debug("leaf left empty by delete", "page", cursor.pageNum)
+		// TODO: remove node
+		// Update parent pointers to this node
+		return nil
+	}
+	newMaxKey := binary.LittleEndian.Uint32(leafNodeKey(node, numCells-2))
+
+	if keyToDelete < newMaxKey {
+		// Can stop delete here since parent's key for this node is unchanged.
+		return nil
+	}
+
+	// TODO:
+	// Add underflow node merging support.
+
+	// Update the maxKey in parent.
+	for !isNodeRoot(node) {
+		parentPageNum := binary.LittleEndian.Uint32(nodeParent(node))
+		parent, err := getPage(table.pager, parentPageNum)
+		if err != nil {
+			return err
+		}
+		// A rightmost child has no key in its parent, but the key may still
+		// be the max of the parent's subtree further up.
+		if idx, ok := internalNodeFindKey(parent, keyToDelete); ok {
+			binary.LittleEndian.PutUint32(internalNodeKey(parent, idx), newMaxKey)
+			markPageDirty(table.pager, parentPageNum)
+		}
+		// Update node to be the current parent so that we traverse up towards root.
+		node = parent
+	}
+
+	return nil
+}
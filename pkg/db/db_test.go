@@ -1,27 +1,41 @@
-package main
+package db
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
-	"github.com/MichalPitr/db_from_scratch/pkg/cli"
 	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
 	"github.com/MichalPitr/db_from_scratch/pkg/types"
 )
 
+// openTestDb opens a new database in a directory of the test and returns it with its file name.
+func openTestDb(t *testing.T) (*Table, string) {
+	dbName := filepath.Join(t.TempDir(), "test.db")
+	table, err := Open(dbName)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", dbName, err)
+	}
+	return table, dbName
+}
+
 func TestNewDbRootType(t *testing.T) {
-	dbName := "test.db"
-	os.Remove(dbName)
-	table := dbOpen(dbName)
+	table, _ := openTestDb(t)
 
 	// Should have 1 leaf node, 1 page
 	if table.pager.numPages != 1 {
 		t.Error("Expected new table to have 1 page.")
 	}
 
-	node := getPage(table.pager, 0)
+	node, _ := getPage(table.pager, 0)
 	if len(node) != int(constants.PageSize) {
 		t.Errorf("Expected page to be 4096 in size.")
 	}
@@ -38,19 +52,17 @@ func TestNewDbRootType(t *testing.T) {
 }
 
 func TestInsertRow(t *testing.T) {
-	dbName := "test.db"
-	os.Remove(dbName)
-	table := dbOpen(dbName)
+	table, _ := openTestDb(t)
 
-	stmt, _ := cli.PrepareStatement("insert 1 user1 user1@example.com")
-	executeInsert(stmt, table)
+	row := parseRow("insert 1 user1 user1@example.com")
+	insertRow(table, &row)
 
 	// Should have 1 leaf page.
 	if table.pager.numPages != 1 {
 		t.Error("Expected new table to have 2 page.")
 	}
 
-	node := getPage(table.pager, 0)
+	node, _ := getPage(table.pager, 0)
 	if len(node) != int(constants.PageSize) {
 		t.Errorf("Expected page to be 4096 in size.")
 	}
@@ -67,14 +79,12 @@ func TestInsertRow(t *testing.T) {
 }
 
 func TestInsertSplit(t *testing.T) {
-	dbName := "test.db"
-	os.Remove(dbName)
-	table := dbOpen(dbName)
+	table, _ := openTestDb(t)
 
 	// Fill up page, next insert should trigger split.
 	for i := 0; i < int(constants.LeafNodeMaxCells); i++ {
-		stmt, _ := cli.PrepareStatement(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
-		executeInsert(stmt, table)
+		row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+		insertRow(table, &row)
 	}
 
 	// Should have 1 leaf page.
@@ -82,7 +92,7 @@ func TestInsertSplit(t *testing.T) {
 		t.Error("Expected new table to have 1 page.")
 	}
 
-	node := getPage(table.pager, 0)
+	node, _ := getPage(table.pager, 0)
 	if len(node) != int(constants.PageSize) {
 		t.Errorf("Expected page to be 4096 in size.")
 	}
@@ -98,8 +108,8 @@ func TestInsertSplit(t *testing.T) {
 	}
 
 	// Insert 1 more row to trigger split.
-	stmt, _ := cli.PrepareStatement("insert 14 user14 user14@example.com")
-	executeInsert(stmt, table)
+	row := parseRow("insert 14 user14 user14@example.com")
+	insertRow(table, &row)
 
 	// Should have 2 leaf nodes, 1 root internal node.
 	if table.pager.numPages != 3 {
@@ -107,7 +117,7 @@ func TestInsertSplit(t *testing.T) {
 	}
 
 	// Check internal node.
-	node = getPage(table.pager, 0)
+	node, _ = getPage(table.pager, 0)
 	nt = getNodeType(node)
 	if nt != types.NodeInternal {
 		t.Errorf("Expected internal node.")
@@ -121,13 +131,13 @@ func TestInsertSplit(t *testing.T) {
 		t.Errorf("Expected right child page num to be 1. Got: %d", rightChildPageNum)
 	}
 
-	leftChildPageNum := binary.LittleEndian.Uint32(internalNodeChild(node, 0))
+	leftChildPageNum := binary.LittleEndian.Uint32(internalNodeCell(node, 0))
 	if leftChildPageNum != 2 {
 		t.Errorf("Expected left child page num to be 2. Got: %d", leftChildPageNum)
 	}
 
 	// Check if left child node contains the expected rows:
-	leftChild := getPage(table.pager, leftChildPageNum)
+	leftChild, _ := getPage(table.pager, leftChildPageNum)
 	parentNum := binary.LittleEndian.Uint32(nodeParent(leftChild))
 	if parentNum != 0 {
 		t.Errorf("Child's parent should be 0, got: %d", parentNum)
@@ -142,7 +152,7 @@ func TestInsertSplit(t *testing.T) {
 	}
 
 	// Check if right child node contains the expected rows:
-	rightChild := getPage(table.pager, rightChildPageNum)
+	rightChild, _ := getPage(table.pager, rightChildPageNum)
 	parentNum = binary.LittleEndian.Uint32(nodeParent(rightChild))
 	if parentNum != 0 {
 		t.Errorf("Child's parent should be 0, got: %d", parentNum)
@@ -158,9 +168,7 @@ func TestInsertSplit(t *testing.T) {
 }
 
 func TestInsertSplitUnordered(t *testing.T) {
-	dbName := "test.db"
-	os.Remove(dbName)
-	table := dbOpen(dbName)
+	table, _ := openTestDb(t)
 
 	commands := []string{
 		"insert 26 user26 user26@example.com",
@@ -188,8 +196,8 @@ func TestInsertSplitUnordered(t *testing.T) {
 	}
 
 	for _, cmd := range commands {
-		stmt, _ := cli.PrepareStatement(cmd)
-		executeInsert(stmt, table)
+		row := parseRow(cmd)
+		insertRow(table, &row)
 	}
 
 	// Should have 4 pages:
@@ -197,7 +205,7 @@ func TestInsertSplitUnordered(t *testing.T) {
 		t.Fatalf("Expected new table to have 4 page. Got: %d", table.pager.numPages)
 	}
 
-	node := getPage(table.pager, 0)
+	node, _ := getPage(table.pager, 0)
 	if len(node) != int(constants.PageSize) {
 		t.Errorf("Expected page to be 4096 in size.")
 	}
@@ -219,8 +227,8 @@ func TestInsertSplitUnordered(t *testing.T) {
 	fmt.Println(pageNum)
 
 	// Insert 1 more row to trigger split.
-	stmt, _ := cli.PrepareStatement("insert 14 user14 user14@example.com")
-	executeInsert(stmt, table)
+	row := parseRow("insert 14 user14 user14@example.com")
+	insertRow(table, &row)
 
 	// Should have 3 leaf nodes, 1 root internal node.
 	if table.pager.numPages != 4 {
@@ -228,7 +236,7 @@ func TestInsertSplitUnordered(t *testing.T) {
 	}
 
 	// Check internal node.
-	node = getPage(table.pager, 0)
+	node, _ = getPage(table.pager, 0)
 	nt = getNodeType(node)
 	if nt != types.NodeInternal {
 		t.Fatalf("Expected internal node.")
@@ -243,18 +251,18 @@ func TestInsertSplitUnordered(t *testing.T) {
 		t.Fatalf("Expected right child page num to be 1. Got: %d", rightChildPageNum)
 	}
 
-	firstChildPageNum := binary.LittleEndian.Uint32(internalNodeChild(node, 0))
+	firstChildPageNum := binary.LittleEndian.Uint32(internalNodeCell(node, 0))
 	if firstChildPageNum != 2 {
 		t.Fatalf("Expected left child page num to be 2. Got: %d", firstChildPageNum)
 	}
 
-	secondChildPageNum := binary.LittleEndian.Uint32(internalNodeChild(node, 1))
+	secondChildPageNum := binary.LittleEndian.Uint32(internalNodeCell(node, 1))
 	if secondChildPageNum != 3 {
 		t.Fatalf("Expected second child page num to be 3. Got: %d", secondChildPageNum)
 	}
 
 	// Check if first child node contains the expected rows:
-	firstChild := getPage(table.pager, firstChildPageNum)
+	firstChild, _ := getPage(table.pager, firstChildPageNum)
 	parentNum := binary.LittleEndian.Uint32(nodeParent(firstChild))
 	if parentNum != 0 {
 		t.Fatalf("Child's parent should be 0, got: %d", parentNum)
@@ -269,7 +277,7 @@ func TestInsertSplitUnordered(t *testing.T) {
 	}
 
 	// Check if second child node contains the expected rows:
-	secondChild := getPage(table.pager, secondChildPageNum)
+	secondChild, _ := getPage(table.pager, secondChildPageNum)
 	parentNum = binary.LittleEndian.Uint32(nodeParent(secondChild))
 	if parentNum != 0 {
 		t.Fatalf("Child's parent should be 0, got: %d", parentNum)
@@ -284,7 +292,7 @@ func TestInsertSplitUnordered(t *testing.T) {
 	}
 
 	// Check if right child node contains the expected rows:
-	rightChild := getPage(table.pager, rightChildPageNum)
+	rightChild, _ := getPage(table.pager, rightChildPageNum)
 	parentNum = binary.LittleEndian.Uint32(nodeParent(rightChild))
 	if parentNum != 0 {
 		t.Fatalf("Child's parent should be 0, got: %d", parentNum)
@@ -300,9 +308,7 @@ func TestInsertSplitUnordered(t *testing.T) {
 }
 
 func TestInsertInternalNodeSplit(t *testing.T) {
-	dbName := "test.db"
-	os.Remove(dbName)
-	table := dbOpen(dbName)
+	table, _ := openTestDb(t)
 
 	commands := []string{
 		"insert 58 user58 person58@example.com",
@@ -372,24 +378,22 @@ func TestInsertInternalNodeSplit(t *testing.T) {
 	}
 
 	for _, cmd := range commands {
-		stmt, _ := cli.PrepareStatement(cmd)
-		executeInsert(stmt, table)
+		row := parseRow(cmd)
+		insertRow(table, &row)
 	}
 
 	// Expect no crash.
 }
 
 func TestInsertMaxSize(t *testing.T) {
-	dbName := "test.db"
-	os.Remove(dbName)
-	table := dbOpen(dbName)
+	table, _ := openTestDb(t)
 
 	// Fill up page, next insert should trigger split.
 	for i := 0; i < 384; i++ {
-		stmt, _ := cli.PrepareStatement(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
-		executeInsert(stmt, table)
+		row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+		insertRow(table, &row)
 	}
-	displayTree(table.pager, 0, 0)
+	displayTree(os.Stdout, table.pager, 0, 0)
 	// Expect no crash.
 }
 
@@ -408,56 +412,308 @@ func TestInternalNodeFindKey(t *testing.T) {
 }
 
 func TestDeleteLargestKeyLeftSubtree(t *testing.T) {
-	dbName := "test.db"
-	os.Remove(dbName)
-	table := dbOpen(dbName)
+	table, _ := openTestDb(t)
 
 	// Fill up page, next insert should trigger split.
 	for i := 1; i < 16; i++ {
-		stmt, _ := cli.PrepareStatement(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
-		executeInsert(stmt, table)
+		row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+		insertRow(table, &row)
 	}
 
-	displayTree(table.pager, 0, 0)
-	stmt, _ := cli.PrepareStatement(fmt.Sprintf("delete 7"))
-	executeDelete(stmt, table)
+	displayTree(os.Stdout, table.pager, 0, 0)
+	deleteRow(table, 7)
 	// For now, verify with debugger.
 	// TODO: Add check if key is indeed deleted.
 }
 
 func TestDeleteLargestKeyRightSubtree(t *testing.T) {
-	dbName := "test.db"
-	os.Remove(dbName)
-	table := dbOpen(dbName)
+	table, _ := openTestDb(t)
 
 	// Fill up page, next insert should trigger split.
 	for i := 1; i < 16; i++ {
-		stmt, _ := cli.PrepareStatement(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
-		executeInsert(stmt, table)
+		row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+		insertRow(table, &row)
 	}
 
-	displayTree(table.pager, 0, 0)
-	stmt, _ := cli.PrepareStatement(fmt.Sprintf("delete 15"))
+	displayTree(os.Stdout, table.pager, 0, 0)
 	// Expect the row to be deleted, but nothing in parent, since right-most leaf
 	// is referenced by a right-pointer without a key.
-	executeDelete(stmt, table)
+	deleteRow(table, 15)
 	// For now, verify with debuger.
 	// TODO: Add check if key is deleted.
 }
 
 func TestDeleteLastItemInRootNode(t *testing.T) {
-	dbName := "test.db"
-	os.Remove(dbName)
-	table := dbOpen(dbName)
+	table, _ := openTestDb(t)
 
-	stmt, _ := cli.PrepareStatement("insert 1 user1 user1@example.com")
-	executeInsert(stmt, table)
+	row := parseRow("insert 1 user1 user1@example.com")
+	insertRow(table, &row)
 
-	displayTree(table.pager, 0, 0)
-	stmt, _ = cli.PrepareStatement(fmt.Sprintf("delete 1"))
+	displayTree(os.Stdout, table.pager, 0, 0)
 	// Expect the row to be deleted, but nothing in parent, since right-most leaf
 	// is referenced by a right-pointer without a key.
-	executeDelete(stmt, table)
+	deleteRow(table, 1)
 	// For now, verify with debuger.
 	// TODO: Add check if key is deleted.
 }
+
+func TestErrorCodes(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	table.Insert(ctx, parseRow("insert 1 user1 user1@example.com"))
+
+	if err := table.Insert(ctx, parseRow("insert 1 user1 user1@example.com")); !errors.Is(err, dberr.ErrDuplicateKey) {
+		t.Fatalf("Expected a duplicate key. Got: %v", err)
+	}
+	if err := table.Delete(ctx, 2); !errors.Is(err, dberr.ErrKeyNotFound) || err.Error() != "key 2 does not exist" {
+		t.Fatalf("Expected key 2 not to be found. Got: %v", err)
+	}
+	if err := table.CreateUniqueIndex(ctx, "username", ""); err != nil {
+		t.Fatalf("Failed to create the unique index: %v", err)
+	}
+	if err := table.Insert(ctx, parseRow("insert 2 user1 other@example.com")); !errors.Is(err, dberr.ErrDuplicateKey) || errors.Is(err, dberr.ErrKeyNotFound) {
+		t.Fatalf("Expected a duplicate username. Got: %v", err)
+	}
+	table.Close()
+
+	reader, _ := OpenReadOnly(dbName)
+	if err := reader.Insert(ctx, parseRow("insert 3 user3 user3@example.com")); !errors.Is(err, dberr.ErrReadOnly) {
+		t.Fatalf("Expected the insert to be refused. Got: %v", err)
+	}
+	reader.Close()
+
+	f, _ := os.OpenFile(dbName, os.O_RDWR, 0666)
+	f.WriteAt([]byte{0xff}, pageOffset(0)+int64(constants.LeafNodeHeaderSize+constants.LeafNodeValueOffset+constants.UsernameOffset))
+	f.Close()
+	table, _ = Open(dbName)
+	err := table.Scan(ctx, func(row types.Row) error { return nil })
+	if !errors.Is(err, dberr.ErrCorrupt) {
+		t.Fatalf("Expected the page to be corrupt. Got: %v", err)
+	}
+	table.Close()
+
+	os.Remove(dbName)
+	table, _ = Open(dbName)
+	err = nil
+	for i := 1; err == nil; i++ {
+		err = table.Insert(ctx, parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)))
+	}
+	if !errors.Is(err, dberr.ErrTableFull) {
+		t.Fatalf("Expected the table to be full. Got: %v", err)
+	}
+	table.Close()
+}
+
+func TestFailedStatementInTransactionIsUndone(t *testing.T) {
+	table, dbName := openTestDb(t)
+	table.Begin()
+
+	// Insert until the table is full, the failed insert must not leave a half split tree behind.
+	var err error
+	numRows := 0
+	for err == nil {
+		row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", numRows+1, numRows+1, numRows+1))
+		if err = table.Insert(context.Background(), row); err == nil {
+			numRows++
+		}
+	}
+	if err.Error() != "table full" {
+		t.Fatalf("Expected table full error. Got: %v", err)
+	}
+	if !table.pager.inTxn {
+		t.Fatalf("Expected the transaction to stay open after a failed statement.")
+	}
+	if problems := integrityCheck(table); len(problems) > 0 {
+		t.Fatalf("Expected a sound tree. Got: %v", problems)
+	}
+
+	if err := table.Commit(); err != nil {
+		t.Fatalf("Expected commit to succeed. Got: %v", err)
+	}
+	table.Close()
+	table, _ = Open(dbName)
+	count := 0
+	table.Scan(context.Background(), func(row types.Row) error {
+		count++
+		return nil
+	})
+	if count != numRows {
+		t.Fatalf("Expected %d rows after commit. Got: %d", numRows, count)
+	}
+}
+
+func TestCancelledContextAbortsStatement(t *testing.T) {
+	table, _ := openTestDb(t)
+	defer table.Close()
+	for i := 1; i <= 30; i++ {
+		row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+		table.Insert(context.Background(), row)
+	}
+
+	// Cancel once the first leaf page has been read, the scan stops before the next one.
+	ctx, cancel := context.WithCancel(context.Background())
+	count := 0
+	err := table.Scan(ctx, func(row types.Row) error {
+		count++
+		cancel()
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled. Got: %v", err)
+	}
+	if count != int(constants.LeafNodeLeftSplitCount) {
+		t.Fatalf("Expected the scan to stop after the first leaf, %d rows. Got: %d", constants.LeafNodeLeftSplitCount, count)
+	}
+
+	row := parseRow("insert 31 user31 user31@example.com")
+	if err := table.Insert(ctx, row); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled. Got: %v", err)
+	}
+	if err := table.Scan(context.Background(), func(row types.Row) error {
+		if row.Id == 31 {
+			return fmt.Errorf("cancelled insert was applied")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInMemoryDb(t *testing.T) {
+	table, err := Open(MemoryDbName)
+	if err != nil {
+		t.Fatalf("Failed to open in-memory db: %v", err)
+	}
+	// Enough commits to checkpoint and evict pages, which then have to be read back.
+	table.pager.maxCachedPages = 2
+	for i := 1; i <= 100; i++ {
+		row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+		if err := table.Insert(context.Background(), row); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	table.Begin()
+	table.Delete(context.Background(), 1)
+	table.Rollback()
+
+	if keys := checkTable(t, table); len(keys) != 100 {
+		t.Fatalf("Expected 100 rows. Got: %d", len(keys))
+	}
+	if err := table.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(MemoryDbName); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file to be created. Got: %v", err)
+	}
+
+	table, _ = Open(MemoryDbName)
+	defer table.Close()
+	if keys := checkTable(t, table); len(keys) != 0 {
+		t.Fatalf("Expected a fresh in-memory db to be empty. Got: %d rows", len(keys))
+	}
+}
+
+// parseRow returns the row added by an insert statement.
+func parseRow(text string) types.Row {
+	stmt, err := parser.Parse(text)
+	if err != nil {
+		panic(err)
+	}
+	return insertedRow(stmt.(*parser.Insert))
+}
+
+func TestDuplicateKeyBelowRoot(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	for i := 1; i <= 100; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)))
+	}
+	for _, id := range []int{1, 50, 100} {
+		err := table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d dup dup@example.com", id)))
+		if err == nil || err.Error() != "duplicate key" {
+			t.Fatalf("Expected duplicate key error for id %d. Got: %v", id, err)
+		}
+	}
+	if keys := checkTable(t, table); len(keys) != 100 {
+		t.Fatalf("Expected 100 rows. Got: %d", len(keys))
+	}
+}
+
+func TestInfo(t *testing.T) {
+	table, err := Open(MemoryDbName)
+	if err != nil {
+		t.Fatalf("Failed to open in-memory db: %v", err)
+	}
+	defer table.Close()
+	info, err := table.Info()
+	if err != nil {
+		t.Fatalf("Info failed: %v", err)
+	}
+	if info != (TableInfo{Name: TableName, RootPage: 0, Rows: 0, Pages: 1}) {
+		t.Fatalf("Unexpected info of an empty table: %+v", info)
+	}
+	for i := 1; i <= 50; i++ {
+		if err := table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d u e", i))); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if info, _ = table.Info(); info.Rows != 50 || info.Pages < 4 {
+		t.Fatalf("Expected 50 rows spread over several pages. Got: %+v", info)
+	}
+}
+
+// formatNode prints the header and cells of a node, for debugging tests.
+func formatNode(node []byte) {
+	nt := types.NodeType(node[constants.NodeTypeOffset])
+	if nt == types.NodeInternal {
+		isRoot := uint8(node[constants.IsRootOffset])
+		parentPtr := binary.LittleEndian.Uint32(node[constants.ParentPointerOffset:])
+		numKeys := binary.LittleEndian.Uint32(node[constants.InternalNodeNumKeysOffset:])
+		rightChildPtr := binary.LittleEndian.Uint32(node[constants.InternalNodeRightChildOffset:])
+
+		fmt.Printf("node type: %d\n", nt)
+		fmt.Printf("is root: %d\n", isRoot)
+		fmt.Printf("parent ptr: %d\n", parentPtr)
+		fmt.Printf("num keys: %d\n", numKeys)
+		fmt.Printf("rightChildPtr: %d\n", rightChildPtr)
+
+		ptr := constants.InternalNodeHeaderSize
+		for i := uint32(0); i < numKeys; i++ {
+			childPtr := binary.LittleEndian.Uint32(node[ptr:])
+			childKey := binary.LittleEndian.Uint32(node[ptr+constants.InternalNodeChildSize:])
+			fmt.Printf("child ptr: %d - key %d\n", childPtr, childKey)
+			ptr += constants.InternalNodeCellSize
+		}
+	} else {
+		isRoot := uint8(node[constants.IsRootOffset])
+		parentPtr := binary.LittleEndian.Uint32(node[constants.ParentPointerOffset:])
+		numCells := binary.LittleEndian.Uint32(node[constants.LeafNodeNumCellsOffset:])
+		nextLeafPageNum := binary.LittleEndian.Uint32(node[constants.LeafNodeNextLeafOffset:])
+		fmt.Printf("node type: %d\n", nt)
+		fmt.Printf("is root: %d\n", isRoot)
+		fmt.Printf("parent ptr: %d\n", parentPtr)
+		fmt.Printf("num cells: %d\n", numCells)
+		fmt.Printf("next leaf page num: %d\n", nextLeafPageNum)
+
+		i := constants.LeafNodeHeaderSize
+		for i+constants.LeafNodeCellSize < constants.PageChecksumOffset {
+			key := binary.LittleEndian.Uint32(node[i:])
+			row := deserializeRow(node[i+constants.LeafNodeKeySize:])
+			fmt.Printf("key: %d - row %+v\n", key, row)
+			i += constants.LeafNodeCellSize
+		}
+		fmt.Printf("Leaf Node ends at offset %d\n", i)
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	var out strings.Builder
+	table.SetLogger(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	table.Insert(context.Background(), parseRow("insert 1 a a"))
+	table.Delete(context.Background(), 1)
+	if !strings.Contains(out.String(), "msg=\"deleting row\" id=1 page=0 cell=0") {
+		t.Fatalf("Expected the delete to be logged. Got: %q", out.String())
+	}
+}
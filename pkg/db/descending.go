@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Descending index.
+
+The rows are stored in a B-tree in ascending id order. Leaves only link to
+the next one, so a scan in descending order, select ... order by id desc,
+climbs the parent pointers to find the leaf before every one it finishes.
+create index on id desc keeps a copy of every row in a second B-tree keyed by
+math.MaxUint32 minus its id, in which the row with the largest id comes first.
+A scan in descending order reads its leaves one after the other like a scan in
+ascending order reads the table's, so the latest rows are sequential reads.
+The file header lists the root of its tree.
+
+Its pages go through the pager like those of the table, so the index commits
+and rolls back with the rows it copies. Every row takes up its space twice.
+An index in ascending id order would be the table itself. A text column is
+indexed in ascending order by an ordered index, see createOrderedIndex.
+*/
+
+// HasDescendingIndex reports whether the table has a descending index on id.
+func (t *Table) HasDescendingIndex() bool {
+	return t.pager.header.DescendingRootPageNum != 0
+}
+
+// CreateIndex creates an index storing the rows in the order of a column,
+// descending if desc: the descending index on id, or the ordered index on
+// username or email.
+func (t *Table) CreateIndex(ctx context.Context, column string, desc bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pager := t.pager
+	if pager.readOnly {
+		return errReadOnly
+	}
+	if pager.inTxn {
+		return fmt.Errorf("cannot create an index - a transaction is active")
+	}
+	names, _ := t.columns()
+	switch {
+	case !slices.Contains(names, column):
+		return fmt.Errorf("no such column: %s", column)
+	case column != "id" && desc:
+		return fmt.Errorf("only the id can be indexed in descending order")
+	case column != "id" && !slices.Contains(columnNames, column):
+		return fmt.Errorf("only the text columns username and email can be indexed in order, %s is generated", column)
+	case column != "id":
+		return t.createOrderedIndex(ctx, column)
+	case !desc:
+		return fmt.Errorf("the rows are already stored in ascending id order")
+	case t.HasDescendingIndex():
+		return fmt.Errorf("there is already a descending index on id")
+	}
+	err := t.write(func() error {
+		pageNum, err := getUnusedPageNum(pager)
+		if err != nil {
+			return err
+		}
+		root, err := getPage(pager, pageNum)
+		if err != nil {
+			return err
+		}
+		initializeLeafNode(root)
+		setNodeRoot(root, true)
+		markPageDirty(pager, pageNum)
+		// The header is written by the commit, along with the tree.
+		pager.header.DescendingRootPageNum = pageNum
+		rows := []types.Row{}
+		err = t.Scan(ctx, func(row types.Row) error {
+			rows = append(rows, row)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Inserted from the largest id, every copy lands at the end of the tree.
+		for i := len(rows) - 1; i >= 0; i-- {
+			if err := descendingInsert(pager, rows[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		pager.header.DescendingRootPageNum = 0
+	}
+	return err
+}
+
+// descendingKey returns the key of the copy of the row with the id in the descending index.
+// It is its own inverse, the key of a copy is turned back into the id alike.
+func descendingKey(id uint32) uint32 {
+	return math.MaxUint32 - id
+}
+
+// descendingTree returns the tree of the descending index.
+func descendingTree(pager *Pager) *Table {
+	return &Table{
+		pager:       pager,
+		rootPageNum: pager.header.DescendingRootPageNum,
+		logger:      pager.logger,
+		now:         time.Now,
+		auxiliary:   true,
+	}
+}
+
+// descendingInsert adds a copy of a row being inserted to the descending index.
+func descendingInsert(pager *Pager, row types.Row) error {
+	if pager.header.DescendingRootPageNum == 0 {
+		return nil
+	}
+	row.Id = descendingKey(row.Id)
+	return insertRow(descendingTree(pager), &row)
+}
+
+// descendingDelete removes the copy of a row being deleted from the descending index.
+func descendingDelete(pager *Pager, id uint32) error {
+	if pager.header.DescendingRootPageNum == 0 {
+		return nil
+	}
+	return deleteRow(descendingTree(pager), descendingKey(id))
+}
+
+// scanDescending calls fn with the rows with an id between from and to, inclusive, in
+// descending id order, read from the descending index. Rows that expired are skipped.
+func (t *Table) scanDescending(ctx context.Context, from uint32, to uint32, fn func(row types.Row) error) error {
+	defer pagerEvict(t.pager)
+	tree := descendingTree(t.pager)
+	cursor, err := tableSeek(tree, descendingKey(to))
+	if err != nil {
+		return err
+	}
+	leafPageNum := constants.InvalidPageNum
+	for !cursor.endOfTable {
+		if cursor.pageNum != leafPageNum {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			leafPageNum = cursor.pageNum
+			if err := prefetchNextLeaf(t.pager, leafPageNum); err != nil {
+				return err
+			}
+		}
+		rawRow, err := cursor.value()
+		if err != nil {
+			return err
+		}
+		row := deserializeRow(rawRow)
+		row.Id = descendingKey(row.Id)
+		t.rowsScanned++
+		if row.Id < from {
+			return nil
+		}
+		if !t.expired(row) {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		if err := cursor.advance(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestDescendingIndex(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	execute := func(text string) error {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		_, err = table.Execute(ctx, stmt, func(values []any) error { return nil })
+		return err
+	}
+	selectIds := func(text string) []int64 {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		ids := []int64{}
+		_, err = table.Execute(ctx, stmt, func(values []any) error {
+			ids = append(ids, values[0].(int64))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s failed: %v", text, err)
+		}
+		return ids
+	}
+	for i := 1; i <= 40; i++ {
+		execute(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+	}
+	for text, expected := range map[string]string{
+		"create index on id":            "the rows are already stored in ascending id order",
+		"create index on username desc": "only the id can be indexed in descending order",
+		"create index on nickname desc": "no such column: nickname",
+	} {
+		if err := execute(text); err == nil || err.Error() != expected {
+			t.Fatalf("%s: expected %q. Got: %v", text, expected, err)
+		}
+	}
+	table.Begin()
+	if err := execute("create index on id desc"); err == nil || err.Error() != "cannot create an index - a transaction is active" {
+		t.Fatalf("Expected the index not to be created in a transaction. Got: %v", err)
+	}
+	table.Rollback()
+	if err := execute("create index on id desc"); err != nil {
+		t.Fatalf("Creating the descending index failed: %v", err)
+	}
+	if err := execute("create index on id desc"); err == nil || err.Error() != "there is already a descending index on id" {
+		t.Fatalf("Expected a second descending index to fail. Got: %v", err)
+	}
+
+	// Inserts, deletes and rollbacks reach the index along with the table.
+	for i := 41; i <= 60; i++ {
+		execute(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+	}
+	execute("delete 59")
+	execute("insert or replace 60 sixty sixty@example.com")
+	table.Begin()
+	execute("insert 61 user61 user61@example.com")
+	execute("delete 58")
+	table.Rollback()
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected no problems. Got: %v", problems)
+	}
+
+	if ids := selectIds("select id order by id desc limit 4"); !slices.Equal(ids, []int64{60, 58, 57, 56}) {
+		t.Fatalf("Expected the latest rows first. Got: %v", ids)
+	}
+	if ids := selectIds("select id where id >= 10 and id < 14 order by id desc"); !slices.Equal(ids, []int64{13, 12, 11, 10}) {
+		t.Fatalf("Expected the rows of the range in descending order. Got: %v", ids)
+	}
+	if ids := selectIds("select * where username = 'sixty' order by id desc"); !slices.Equal(ids, []int64{60}) {
+		t.Fatalf("Expected the replaced row from the index. Got: %v", ids)
+	}
+	if ids := selectIds("select id order by id desc"); len(ids) != 59 || ids[58] != 1 {
+		t.Fatalf("Expected every row from the index. Got: %v", ids)
+	}
+
+	// Rows that expired are skipped like in the table.
+	execute("insert 70 late late@example.com ttl 1")
+	now := time.Now()
+	table.now = func() time.Time { return now.Add(time.Minute) }
+	if ids := selectIds("select id order by id desc limit 1"); !slices.Equal(ids, []int64{60}) {
+		t.Fatalf("Expected the expired row to be skipped. Got: %v", ids)
+	}
+	execute("delete 70")
+
+	table.Close()
+	table, _ = Open(dbName)
+	defer table.Close()
+	if !table.HasDescendingIndex() {
+		t.Fatalf("Expected the descending index to be kept")
+	}
+	if ids := selectIds("select id order by id desc limit 2"); !slices.Equal(ids, []int64{60, 58}) {
+		t.Fatalf("Expected the latest rows after reopening. Got: %v", ids)
+	}
+}
+
+func TestDescendingIndexBulkLoad(t *testing.T) {
+	table, _ := openTestDb(t)
+	defer table.Close()
+	ctx := context.Background()
+	if err := table.CreateIndex(ctx, "id", true); err != nil {
+		t.Fatalf("Creating the descending index failed: %v", err)
+	}
+	ids := []int{}
+	for i := 1; i <= 100; i++ {
+		ids = append(ids, i)
+	}
+	if _, err := table.BulkLoad(ctx, rowsOf(ids...)); err != nil {
+		t.Fatalf("BulkLoad failed: %v", err)
+	}
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected the index to have every row. Got: %v", problems)
+	}
+}
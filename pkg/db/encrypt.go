@@ -0,0 +1,233 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+)
+
+/*
+Encryption at rest.
+
+An encrypted file holds its pages encrypted with AES-256-GCM under a key
+derived from a passphrase with PBKDF2-HMAC-SHA256. The salt of the key and a
+check value, which tells a wrong passphrase apart from damaged pages, are kept
+in the file header, which itself stays readable. Every time a page is written
+it gets a fresh random nonce, stored next to the authentication tag at the end
+of the page, and its page number is authenticated along with it, so pages can
+not be swapped around unnoticed. The checksum covers the encrypted page, so
+checkpoints, recovery and backups copy pages without the key.
+
+Pages are encrypted where they leave the pager, in pagerSeal, and decrypted in
+getPage, so the cache only ever holds plain pages.
+*/
+
+// keyIterations is how many rounds of PBKDF2 derive a key from a passphrase.
+const keyIterations = 100_000
+
+// OpenEncrypted is Open for an encrypted database. A new database is encrypted
+// with the passphrase. An empty passphrase opens an unencrypted database, like Open.
+func OpenEncrypted(filename string, passphrase string) (*Table, error) {
+	pager, err := pagerOpen(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := pagerUnlock(pager, passphrase); err != nil {
+		pagerCloseFiles(pager, false)
+		return nil, err
+	}
+	return openTable(pager)
+}
+
+// OpenReadOnlyEncrypted is OpenReadOnly for an encrypted database.
+func OpenReadOnlyEncrypted(filename string, passphrase string) (*Table, error) {
+	pager, err := pagerOpenReadOnly(filename)
+	if err != nil {
+		return nil, err
+	}
+	// The commits in the WAL may have changed the header, and the key with it.
+	if _, err := pagerRefresh(pager); err != nil {
+		pagerCloseFiles(pager, false)
+		return nil, err
+	}
+	if err := pagerCheckLength(pager); err != nil {
+		pagerCloseFiles(pager, false)
+		return nil, err
+	}
+	if err := pagerUnlock(pager, passphrase); err != nil {
+		pagerCloseFiles(pager, false)
+		return nil, err
+	}
+	table, err := openTable(pager)
+	if err != nil {
+		pagerCloseFiles(pager, false)
+		return nil, err
+	}
+	return table, nil
+}
+
+// pagerUnlock sets up the key of an encrypted file, or encrypts a new one.
+func pagerUnlock(pager *Pager, passphrase string) error {
+	name := pager.file.Name()
+	encrypted := pager.header.KeySalt != [constants.KeySaltSize]byte{}
+	switch {
+	case encrypted && passphrase == "":
+		return fmt.Errorf("%s is encrypted, open it with its passphrase", name)
+	case encrypted:
+		key := deriveKey(passphrase, pager.header.KeySalt[:])
+		if !hmac.Equal(keyCheck(key), pager.header.KeyCheck[:]) {
+			return fmt.Errorf("wrong passphrase for %s", name)
+		}
+		aead, err := newPageCipher(key)
+		if err != nil {
+			return err
+		}
+		pager.cipher = aead
+		return nil
+	case passphrase == "":
+		return nil
+	case pager.numPages > 0 || pager.readOnly:
+		return fmt.Errorf("%s is not encrypted, rekey it to encrypt it", name)
+	}
+	if err := pagerSetKey(pager, passphrase); err != nil {
+		return err
+	}
+	return pagerWriteHeader(pager)
+}
+
+// pagerSetKey derives a key from the passphrase with a fresh salt and records it in the
+// header. An empty passphrase turns encryption off. The header is not written.
+func pagerSetKey(pager *Pager, passphrase string) error {
+	if passphrase == "" {
+		pager.cipher = nil
+		pager.header.KeySalt = [constants.KeySaltSize]byte{}
+		pager.header.KeyCheck = [constants.KeyCheckSize]byte{}
+		return nil
+	}
+	var salt [constants.KeySaltSize]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return err
+	}
+	key := deriveKey(passphrase, salt[:])
+	aead, err := newPageCipher(key)
+	if err != nil {
+		return err
+	}
+	pager.cipher = aead
+	// The header is not encrypted, so the filter would give away which ids exist.
+	pager.header.Bloom = nil
+	pager.header.KeySalt = salt
+	copy(pager.header.KeyCheck[:], keyCheck(key))
+	return nil
+}
+
+/*
+Rekey encrypts the database with a new passphrase, or decrypts it if the
+passphrase is empty. Every page is rewritten in one commit along with the new
+header, so a crash leaves either the old or the new key in effect. The WAL is
+checkpointed afterwards unless readers are open, but backups and blocks the
+file system freed may still hold pages encrypted with the old key.
+*/
+func (t *Table) Rekey(passphrase string) error {
+	pager := t.pager
+	if pager.readOnly {
+		return errReadOnly
+	}
+	if pager.inTxn {
+		return fmt.Errorf("cannot rekey - a transaction is active")
+	}
+	oldCipher, oldHeader := pager.cipher, pager.header
+	err := t.write(func() error {
+		// The pages are read with the old key and stay cached until the commit writes them.
+		for pageNum := uint32(0); pageNum < pager.numPages; pageNum++ {
+			if _, err := getPage(pager, pageNum); err != nil {
+				return err
+			}
+			markPageDirty(pager, pageNum)
+		}
+		return pagerSetKey(pager, passphrase)
+	})
+	if err != nil {
+		pager.cipher, pager.header = oldCipher, oldHeader
+		return err
+	}
+	// The new key is committed either way, open readers only keep the WAL from being checkpointed.
+	if err := pagerCheckpoint(pager); !errors.Is(err, errReadersOpen) {
+		return err
+	}
+	return nil
+}
+
+// deriveKey returns the 32 byte key of a passphrase with PBKDF2-HMAC-SHA256.
+// The key is exactly one SHA-256 block, so only the first block of PBKDF2 is needed.
+func deriveKey(passphrase string, salt []byte) []byte {
+	prf := hmac.New(sha256.New, []byte(passphrase))
+	prf.Write(salt)
+	prf.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < keyIterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// keyCheck returns the value stored in the header to recognize the key.
+func keyCheck(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(constants.FileMagic + " key check"))
+	return mac.Sum(nil)[:constants.KeyCheckSize]
+}
+
+func newPageCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pagerSeal sets the checksum of a cached page and returns it as it is written
+// to disk: the page itself, or an encrypted copy with its own checksum.
+func pagerSeal(pager *Pager, pageNum uint32, page []byte) ([]byte, error) {
+	setPageChecksum(page)
+	if pager.cipher == nil {
+		return page, nil
+	}
+	sealed := make([]byte, constants.PageSize)
+	nonce := sealed[constants.PageNonceOffset:constants.PageChecksumOffset]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	pager.cipher.Seal(sealed[:0], nonce, page[:constants.PageEncryptedSize], binary.LittleEndian.AppendUint32(nil, pageNum))
+	setPageChecksum(sealed)
+	return sealed, nil
+}
+
+// pagerUnseal decrypts a page read from disk in place, once its checksum was verified.
+func pagerUnseal(pager *Pager, pageNum uint32, page []byte) error {
+	if pager.cipher == nil {
+		return nil
+	}
+	var nonce [constants.PageNonceSize]byte
+	copy(nonce[:], page[constants.PageNonceOffset:])
+	_, err := pager.cipher.Open(page[:0], nonce[:], page[:constants.PageNonceOffset], binary.LittleEndian.AppendUint32(nil, pageNum))
+	if err != nil {
+		return dberr.Errorf(dberr.ErrCorrupt, "page %d is corrupt: it does not decrypt", pageNum)
+	}
+	clear(page[constants.PageEncryptedSize:constants.PageChecksumOffset])
+	return nil
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	dbName := filepath.Join(t.TempDir(), "encrypted.db")
+
+	table, err := OpenEncrypted(dbName, "secret")
+	if err != nil {
+		t.Fatalf("Failed to create an encrypted db: %v", err)
+	}
+	for i := 1; i <= 40; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d alice%d alice@example.com", i, i)))
+	}
+	table.Close()
+	if data, _ := os.ReadFile(dbName); bytes.Contains(data, []byte("alice")) {
+		t.Fatalf("Expected the rows to be encrypted on disk.")
+	}
+
+	if _, err := Open(dbName); err == nil || err.Error() != dbName+" is encrypted, open it with its passphrase" {
+		t.Fatalf("Expected opening without the passphrase to fail. Got: %v", err)
+	}
+	if _, err := OpenReadOnlyEncrypted(dbName, "wrong"); err == nil || err.Error() != "wrong passphrase for "+dbName {
+		t.Fatalf("Expected a wrong passphrase to fail. Got: %v", err)
+	}
+	table, err = OpenReadOnlyEncrypted(dbName, "secret")
+	if err != nil {
+		t.Fatalf("Failed to open the encrypted db: %v", err)
+	}
+	if keys := checkTable(t, table); len(keys) != 40 {
+		t.Fatalf("Expected 40 rows. Got: %d", len(keys))
+	}
+	table.Close()
+
+	table, _ = OpenEncrypted(dbName, "secret")
+	if err := table.Rekey("other"); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	table.Close()
+	if _, err := OpenReadOnlyEncrypted(dbName, "secret"); err == nil {
+		t.Fatalf("Expected the old passphrase to stop working.")
+	}
+	table, _ = OpenEncrypted(dbName, "other")
+	if err := table.Rekey(""); err != nil {
+		t.Fatalf("Decrypting failed: %v", err)
+	}
+	table.Close()
+	if data, _ := os.ReadFile(dbName); !bytes.Contains(data, []byte("alice")) {
+		t.Fatalf("Expected the rows to be decrypted on disk.")
+	}
+	table, err = Open(dbName)
+	if err != nil {
+		t.Fatalf("Failed to open the decrypted db: %v", err)
+	}
+	defer table.Close()
+	if keys := checkTable(t, table); len(keys) != 40 {
+		t.Fatalf("Expected 40 rows. Got: %d", len(keys))
+	}
+	if _, err := OpenEncrypted(MemoryDbName, "secret"); err != nil {
+		t.Fatalf("Failed to create an encrypted in-memory db: %v", err)
+	}
+}
@@ -0,0 +1,533 @@
+package db
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// columnNames are the columns of the table, in the order of a row's values.
+var columnNames = []string{"id", "username", "email"}
+
+// columnTypes are the types of the columns, integer values are int64 and text values string.
+var columnTypes = []string{"integer", "text", "text"}
+
+// ColumnDef describes a column of the table.
+type ColumnDef struct {
+	Name       string
+	Type       string // integer or text.
+	Size       uint32 // Bytes a value takes up in a row, the limit on the length of text.
+	PrimaryKey bool   // The rows are stored in a B-tree ordered by this column.
+	Generated  string // The expression computing a generated column, empty for the columns of the schema.
+	Stored     bool   // The generated column is kept with the row rather than computed when read.
+	Collation  string // The collation text values are compared by, empty for binary.
+}
+
+// Schema returns the columns of the table. The schema is fixed, every database has the same one.
+func Schema() []ColumnDef {
+	return []ColumnDef{
+		{Name: columnNames[0], Type: columnTypes[0], Size: constants.IdSize, PrimaryKey: true},
+		{Name: columnNames[1], Type: columnTypes[1], Size: constants.UsernameSize},
+		{Name: columnNames[2], Type: columnTypes[2], Size: constants.EmailSize},
+	}
+}
+
+// InsertOutcome is what an insert did with its row.
+type InsertOutcome int
+
+const (
+	NotInserted InsertOutcome = iota // The statement was not an insert.
+	Inserted                         // The row was added.
+	Replaced                         // insert or replace deleted the row with the id first.
+	Ignored                          // insert or ignore did nothing, the id or unique value was taken.
+)
+
+// ExecResult is what a statement did to the rows of the table.
+type ExecResult struct {
+	RowsAffected int           // The rows inserted or deleted, a replaced row counts once.
+	Insert       InsertOutcome // What an insert did with its row.
+}
+
+// Execute runs a parsed statement. Every row a select returns is passed to fn,
+// its values line up with Columns(stmt). Ids and counts are int64, text is string.
+func (t *Table) Execute(ctx context.Context, stmt parser.Statement, fn func(values []any) error) (ExecResult, error) {
+	t.statements++
+	if err := t.Refresh(); err != nil {
+		return ExecResult{}, err
+	}
+	if privilege := RequiredPrivilege(stmt); privilege != "" {
+		if err := t.CheckPrivilege(ctx, privilege); err != nil {
+			return ExecResult{}, err
+		}
+	}
+	switch s := stmt.(type) {
+	case *parser.Insert:
+		return t.executeInsert(ctx, s, fn)
+	case *parser.Delete:
+		if err := t.Delete(ctx, s.Id); err != nil {
+			return ExecResult{}, err
+		}
+		return ExecResult{RowsAffected: 1}, nil
+	}
+	return ExecResult{}, t.execute(ctx, stmt, fn)
+}
+
+// execute runs a statement that changes no rows.
+func (t *Table) execute(ctx context.Context, stmt parser.Statement, fn func(values []any) error) error {
+	switch s := stmt.(type) {
+	case *parser.Select:
+		return executeSelect(ctx, t, s, fn)
+	case *parser.Begin:
+		return t.Begin()
+	case *parser.Commit:
+		return t.Commit()
+	case *parser.Rollback:
+		return t.Rollback()
+	case *parser.Savepoint:
+		return t.Savepoint(s.Name)
+	case *parser.RollbackTo:
+		return t.RollbackTo(s.Name)
+	case *parser.Release:
+		return t.Release(s.Name)
+	case *parser.Grant:
+		return t.Grant(s.User, s.Privileges)
+	case *parser.Revoke:
+		return t.Revoke(s.User, s.Privileges)
+	case *parser.Partition:
+		return t.Partition(ctx, s.Bounds)
+	case *parser.CreateFulltextIndex:
+		return t.CreateFulltextIndex(ctx, s.Columns)
+	case *parser.DropFulltextIndex:
+		return t.DropFulltextIndex(ctx)
+	case *parser.CreateSpatialIndex:
+		return t.CreateSpatialIndex(ctx)
+	case *parser.CreateUniqueIndex:
+		return t.CreateUniqueIndex(ctx, s.Column, s.Collation)
+	case *parser.CreateIndex:
+		return t.CreateIndex(ctx, s.Column, s.Desc)
+	case *parser.Analyze:
+		return t.Analyze(ctx)
+	case *parser.CreateView:
+		return t.CreateView(ctx, s.Name, s.Text, s.OnCommit)
+	case *parser.RefreshView:
+		return t.RefreshView(ctx, s.Name)
+	case *parser.AddColumn:
+		return t.AddColumn(ctx, s.Name, s.Text, s.Stored)
+	case *parser.Collate:
+		return t.SetCollation(ctx, s.Column, s.Collation)
+	case *parser.Set:
+		if s.Name == "isolation" {
+			// The only transaction on the table is isolated from nothing.
+			return fmt.Errorf("the isolation level only applies in a transaction that runs alongside others, such as one begun over gRPC; use SetIsolation for those of BeginTxn")
+		}
+		// Begin takes no row locks, so there is nothing to wait for.
+		return fmt.Errorf("lock_timeout only applies in a transaction that locks rows, such as one begun over gRPC; use SetLockTimeout for those of BeginTxn")
+	}
+	return fmt.Errorf("unknown statement %T", stmt)
+}
+
+// Columns returns the names of the columns a statement returns, nil if it returns no rows.
+func Columns(stmt parser.Statement) []string {
+	names, _ := selectedColumns(stmt, columnNames, columnTypes)
+	return names
+}
+
+// ColumnTypes returns the types of the columns Columns names, integer or text.
+// Counts are integers, min and max have the type of their column.
+func ColumnTypes(stmt parser.Statement) []string {
+	_, result := selectedColumns(stmt, columnNames, columnTypes)
+	return result
+}
+
+// selectedColumns returns the names and types of the columns a statement
+// returns when it reads rows with the columns names of valueTypes.
+func selectedColumns(stmt parser.Statement, names []string, valueTypes []string) ([]string, []string) {
+	if s, ok := stmt.(*parser.Insert); ok {
+		return returnedColumns(s, names, valueTypes)
+	}
+	s, ok := stmt.(*parser.Select)
+	if !ok {
+		return nil, nil
+	}
+	if len(s.Columns) == 0 {
+		return names, valueTypes
+	}
+	selected, result := []string{}, []string{}
+	for _, item := range s.Columns {
+		selected = append(selected, item.String())
+		index := slices.Index(names, item.Column)
+		if item.Aggregate == "count" || index < 0 {
+			result = append(result, "integer")
+		} else {
+			result = append(result, valueTypes[index])
+		}
+	}
+	return selected, result
+}
+
+// returnedColumns returns the names and types of the columns insert ... returning returns.
+func returnedColumns(stmt *parser.Insert, names []string, valueTypes []string) ([]string, []string) {
+	if stmt.Returning == nil {
+		return nil, nil
+	}
+	if stmt.Returning[0] == "*" {
+		return names, valueTypes
+	}
+	result := []string{}
+	for _, column := range stmt.Returning {
+		if index := slices.Index(names, column); index >= 0 {
+			result = append(result, valueTypes[index])
+		} else {
+			result = append(result, "integer")
+		}
+	}
+	return stmt.Returning, result
+}
+
+/*
+executeInsert adds the row of an insert statement. insert or ignore does
+nothing if a row has the id, or the value of the unique index, and insert or
+replace deletes the row with the id first. The value of the unique index
+being taken by another row still fails an insert or replace.
+
+With returning, fn is passed the row as stored once the insert is done, with
+the values of its generated columns. An ignored row is not returned.
+*/
+func (t *Table) executeInsert(ctx context.Context, stmt *parser.Insert, fn func(values []any) error) (ExecResult, error) {
+	if err := ctx.Err(); err != nil {
+		return ExecResult{}, err
+	}
+	names, _ := t.columns()
+	for _, column := range stmt.Returning {
+		if column != "*" && !slices.Contains(names, column) {
+			return ExecResult{}, fmt.Errorf("no such column: %s", column)
+		}
+	}
+	row := insertedRow(stmt)
+	if stmt.TTL > 0 {
+		row.ExpiresAt = t.now().Unix() + stmt.TTL
+	}
+	result := ExecResult{RowsAffected: 1, Insert: Inserted}
+	err := t.write(func() error {
+		tree := t.treeOf(row.Id)
+		if stmt.Conflict == "replace" {
+			err := deleteRow(tree, row.Id)
+			if err != nil && !errors.Is(err, dberr.ErrKeyNotFound) {
+				return err
+			}
+			if err == nil {
+				result.Insert = Replaced
+			}
+		}
+		if err := insertRow(tree, &row); err != nil {
+			return err
+		}
+		if stmt.Box != nil {
+			return setBox(t.pager, row.Id, *stmt.Box)
+		}
+		return nil
+	})
+	// The failed statement was rolled back by write.
+	if stmt.Conflict == "ignore" && errors.Is(err, dberr.ErrDuplicateKey) {
+		return ExecResult{Insert: Ignored}, nil
+	}
+	if err != nil {
+		return ExecResult{}, err
+	}
+	if stmt.Returning == nil {
+		return result, nil
+	}
+	values, err := appendGenerated(t.pager, rowValues(row))
+	if err != nil {
+		return result, err
+	}
+	return result, returnRow(stmt.Returning, names, values, fn)
+}
+
+// returnRow passes the columns of returning of an inserted row to fn, values
+// being those of the columns names.
+func returnRow(returning []string, names []string, values []any, fn func(values []any) error) error {
+	if returning[0] == "*" {
+		return fn(values)
+	}
+	returned := make([]any, 0, len(returning))
+	for _, column := range returning {
+		returned = append(returned, values[slices.Index(names, column)])
+	}
+	return fn(returned)
+}
+
+// insertedRow returns the row an insert statement adds. The parser already checked the lengths.
+func insertedRow(stmt *parser.Insert) types.Row {
+	row := types.Row{Id: stmt.Id}
+	copy(row.Username[:], stmt.Username)
+	copy(row.Email[:], stmt.Email)
+	return row
+}
+
+// rowValues returns the values of a row's columns.
+func rowValues(row types.Row) []any {
+	return []any{
+		int64(row.Id),
+		string(bytes.Trim(row.Username[:], "\x00")),
+		string(bytes.Trim(row.Email[:], "\x00")),
+	}
+}
+
+// rowSource is what a select reads rows from: a table, or the shards of a sharded database.
+type rowSource interface {
+	scanWhere(ctx context.Context, where *filter, desc bool, fn func(values []any) error) error
+	// columns returns the names and types of the values scanWhere passes on.
+	columns() ([]string, []string)
+	// collation returns the collation the text values of a column are compared by.
+	collation(column string) Collation
+}
+
+func executeSelect(ctx context.Context, src rowSource, stmt *parser.Select, fn func(values []any) error) error {
+	if stmt.From != "" {
+		t, ok := src.(*Table)
+		if !ok {
+			return fmt.Errorf("no such view: %s", stmt.From)
+		}
+		return t.selectView(ctx, stmt, fn)
+	}
+	if err := checkSelect(src, stmt); err != nil {
+		return err
+	}
+	where, err := compileWhere(ctx, src, stmt.Where)
+	if err != nil {
+		return err
+	}
+	where.keysOnly = readsOnlyId(stmt)
+	if stmt.Limit != nil {
+		fn = limitRows(*stmt.Limit, fn)
+	}
+	if t, ok := src.(*Table); ok && seeksOffset(t, stmt, where) {
+		if err := t.skipRows(where, stmt.Desc, stmt.Offset); err != nil {
+			return err
+		}
+	} else if stmt.Offset > 0 {
+		fn = offsetRows(stmt.Offset, fn)
+	}
+	if t, ok := src.(*Table); ok && countsIdRange(t, stmt) {
+		var rows uint64
+		if rows, err = t.countRange(where.from, where.to); err == nil {
+			err = fn([]any{int64(rows)})
+		}
+	} else if stmt.GroupBy != "" || slices.ContainsFunc(stmt.Columns, func(item parser.SelectItem) bool { return item.Aggregate != "" }) {
+		err = aggregate(ctx, src, stmt, where, fn)
+	} else {
+		err = selectRows(ctx, src, stmt, where, fn)
+	}
+	if err == errLimitReached {
+		return nil
+	}
+	return err
+}
+
+// offsetRows returns fn skipping the first n rows passed to it.
+func offsetRows(n int64, fn func(values []any) error) func(values []any) error {
+	skipped := int64(0)
+	return func(values []any) error {
+		if skipped < n {
+			skipped++
+			return nil
+		}
+		return fn(values)
+	}
+}
+
+// errLimitReached stops a scan once a select returned as many rows as its limit allows.
+var errLimitReached = fmt.Errorf("limit reached")
+
+func limitRows(limit int64, fn func(values []any) error) func(values []any) error {
+	returned := int64(0)
+	return func(values []any) error {
+		if returned >= limit {
+			return errLimitReached
+		}
+		returned++
+		return fn(values)
+	}
+}
+
+/*
+selectRows returns the rows of a select without aggregates. Rows ordered by id
+come straight from the tree, which is scanned backwards for descending order.
+Ordering by another column sorts all matching rows first.
+*/
+func selectRows(ctx context.Context, src rowSource, stmt *parser.Select, where *filter, fn func(values []any) error) error {
+	names, _ := src.columns()
+	project := func(values []any) error {
+		if len(stmt.Columns) == 0 {
+			return fn(values)
+		}
+		projected := make([]any, len(stmt.Columns))
+		for i, item := range stmt.Columns {
+			projected[i] = values[slices.Index(names, item.Column)]
+		}
+		return fn(projected)
+	}
+	if stmt.OrderBy == "" || stmt.OrderBy == "id" {
+		return src.scanWhere(ctx, where, stmt.Desc, project)
+	}
+	rows := [][]any{}
+	err := src.scanWhere(ctx, where, false, func(values []any) error {
+		rows = append(rows, values)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	column := slices.Index(names, stmt.OrderBy)
+	collation := src.collation(stmt.OrderBy)
+	slices.SortStableFunc(rows, func(a, b []any) int {
+		if stmt.Desc {
+			return collation.compare(b[column], a[column])
+		}
+		return collation.compare(a[column], b[column])
+	})
+	for _, values := range rows {
+		if err := project(values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSelect verifies that the columns exist and that the select list can be computed per group.
+func checkSelect(src rowSource, stmt *parser.Select) error {
+	names, _ := src.columns()
+	if stmt.GroupBy != "" && !slices.Contains(names, stmt.GroupBy) {
+		return fmt.Errorf("no such column: %s", stmt.GroupBy)
+	}
+	if stmt.OrderBy != "" && !slices.Contains(names, stmt.OrderBy) {
+		return fmt.Errorf("no such column: %s", stmt.OrderBy)
+	}
+	grouped := stmt.GroupBy != ""
+	for _, item := range stmt.Columns {
+		if item.Column != "*" && !slices.Contains(names, item.Column) {
+			return fmt.Errorf("no such column: %s", item.Column)
+		}
+		grouped = grouped || item.Aggregate != ""
+	}
+	if !grouped {
+		return nil
+	}
+	if len(stmt.Columns) == 0 {
+		return fmt.Errorf("select * can not be grouped, list the columns")
+	}
+	for _, item := range stmt.Columns {
+		if item.Aggregate == "" && item.Column != stmt.GroupBy {
+			return fmt.Errorf("column %s must be aggregated or appear in group by", item.Column)
+		}
+	}
+	if stmt.OrderBy != "" && stmt.OrderBy != stmt.GroupBy {
+		return fmt.Errorf("column %s in order by must appear in group by", stmt.OrderBy)
+	}
+	return nil
+}
+
+/*
+aggregate groups the rows of a scan in a hash table keyed by the group by
+column, or puts them all in one group if there is none. Groups are returned
+in the order their first row was scanned, so ordered by their smallest id,
+unless they are ordered by the group by column.
+*/
+func aggregate(ctx context.Context, src rowSource, stmt *parser.Select, where *filter, fn func(values []any) error) error {
+	names, _ := src.columns()
+	groupIndex := slices.Index(names, stmt.GroupBy)
+	groupCollation := src.collation(stmt.GroupBy)
+	itemCollations := []Collation{}
+	for _, item := range stmt.Columns {
+		itemCollations = append(itemCollations, src.collation(item.Column))
+	}
+	groups := map[any][]any{}
+	order := [][]any{}
+	keys := []any{} // Group by value of every group in order.
+	newGroup := func(key any) []any {
+		results := make([]any, len(stmt.Columns))
+		for i, item := range stmt.Columns {
+			if item.Aggregate == "count" {
+				results[i] = int64(0)
+			}
+		}
+		order = append(order, results)
+		keys = append(keys, key)
+		return results
+	}
+
+	err := src.scanWhere(ctx, where, false, func(values []any) error {
+		var key any
+		if groupIndex >= 0 {
+			key = groupCollation.groupKey(values[groupIndex])
+		}
+		results, ok := groups[key]
+		if !ok {
+			results = newGroup(key)
+			groups[key] = results
+		}
+		for i, item := range stmt.Columns {
+			if item.Aggregate == "count" {
+				results[i] = results[i].(int64) + 1
+				continue
+			}
+			value := values[slices.Index(names, item.Column)]
+			if results[i] == nil ||
+				(item.Aggregate == "min" && itemCollations[i].compare(value, results[i]) < 0) ||
+				(item.Aggregate == "max" && itemCollations[i].compare(value, results[i]) > 0) {
+				results[i] = value
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(order) == 0 && groupIndex < 0 {
+		// Aggregates over no rows still return a row, with a count of 0.
+		newGroup(nil)
+	}
+	if stmt.OrderBy != "" {
+		indexes := make([]int, len(order))
+		for i := range indexes {
+			indexes[i] = i
+		}
+		slices.SortStableFunc(indexes, func(a, b int) int {
+			if stmt.Desc {
+				return groupCollation.compare(keys[b], keys[a])
+			}
+			return groupCollation.compare(keys[a], keys[b])
+		})
+		sorted := make([][]any, len(order))
+		for i, index := range indexes {
+			sorted[i] = order[index]
+		}
+		order = sorted
+	}
+	for _, results := range order {
+		if err := fn(results); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareValues orders two values of the same column.
+func compareValues(a, b any) int {
+	switch a := a.(type) {
+	case int64:
+		return cmp.Compare(a, b.(int64))
+	case string:
+		return cmp.Compare(a, b.(string))
+	}
+	panic(fmt.Sprintf("unexpected value type %T", a))
+}
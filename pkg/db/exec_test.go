@@ -0,0 +1,242 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestOrderByAndLimit(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	ids := []int{}
+	for _, i := range rand.New(rand.NewSource(1)).Perm(100) {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d e", i+1, (i+1)%7)))
+	}
+	// Deleting a run of ids empties whole leaves, which descending scans have to step over.
+	for i := 20; i <= 45; i++ {
+		table.Delete(context.Background(), uint32(i))
+	}
+	for i := 100; i >= 1; i-- {
+		if i < 20 || i > 45 {
+			ids = append(ids, i)
+		}
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"select id order by id desc", fmt.Sprint(ids)},
+		{"select id where id < 50 and id >= 10 order by id desc limit 5", "[49 48 47 46 19]"},
+		{"select id where id > 200 order by id desc", "[]"},
+		{"select id order by id limit 3", "[1 2 3]"},
+		{"select id limit 0", "[]"},
+		{"select id order by username desc limit 4", "[6 13 48 55]"},
+		{"select min(id) group by username order by username desc limit 2", "[6 5]"},
+	}
+	for _, test := range tests {
+		stmt, err := parser.Parse(test.query)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", test.query, err)
+		}
+		got := []int{}
+		_, err = table.Execute(context.Background(), stmt, func(values []any) error {
+			got = append(got, int(values[0].(int64)))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s failed: %v", test.query, err)
+		}
+		if fmt.Sprint(got) != test.expected {
+			t.Fatalf("%s: got %v, expected %s", test.query, got, test.expected)
+		}
+	}
+
+	stmt, _ := parser.Parse("select count(*) order by id")
+	_, err := table.Execute(context.Background(), stmt, func(values []any) error { return nil })
+	if err == nil || err.Error() != "column id in order by must appear in group by" {
+		t.Fatalf("Expected order by a column that is not grouped to fail. Got: %v", err)
+	}
+}
+
+func TestKeyOnlyScan(t *testing.T) {
+	tests := []struct {
+		query    string
+		keysOnly bool
+	}{
+		{"select count(*)", true},
+		{"select id where id > 5 and not id = 7 order by id desc", true},
+		{"select max(id), count(*) where id in (select id where username = 'x') group by id", true},
+		{"select", false},
+		{"select count(*) where username = 'x'", false},
+		{"select id order by email", false},
+		{"select count(*) group by username", false},
+	}
+	for _, test := range tests {
+		stmt, _ := parser.Parse(test.query)
+		if got := readsOnlyId(stmt.(*parser.Select)); got != test.keysOnly {
+			t.Fatalf("readsOnlyId(%q) = %v, expected %v", test.query, got, test.keysOnly)
+		}
+	}
+
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	for i := 1; i <= 50; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d e", i, i%3)))
+	}
+	results := map[string]string{
+		"select count(*) where id > 10":                                   "[[40]]",
+		"select id where id >= 48 order by id desc":                       "[[50] [49] [48]]",
+		"select min(id) where id in (select id where username = 'user2')": "[[2]]",
+	}
+	for query, expected := range results {
+		stmt, _ := parser.Parse(query)
+		got := [][]any{}
+		if _, err := table.Execute(context.Background(), stmt, func(values []any) error {
+			got = append(got, values)
+			return nil
+		}); err != nil {
+			t.Fatalf("%s failed: %v", query, err)
+		}
+		if fmt.Sprint(got) != expected {
+			t.Fatalf("%s: got %v, expected %s", query, got, expected)
+		}
+	}
+}
+
+func TestInsertConflict(t *testing.T) {
+	table, _ := openTestDb(t)
+	ctx := context.Background()
+	execute := func(text string) error {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		_, err = table.Execute(ctx, stmt, func(values []any) error { return nil })
+		return err
+	}
+	usernames := func() []string {
+		names := []string{}
+		table.Scan(ctx, func(row types.Row) error {
+			names = append(names, rowValues(row)[1].(string))
+			return nil
+		})
+		return names
+	}
+	execute("insert 1 alice alice@x.org")
+	execute("insert 2 bob bob@x.org")
+	if err := execute("insert 1 carol carol@x.org"); !errors.Is(err, dberr.ErrDuplicateKey) {
+		t.Fatalf("Expected a plain insert to fail. Got: %v", err)
+	}
+	if err := execute("insert or ignore 1 carol carol@x.org"); err != nil {
+		t.Fatalf("Expected insert or ignore to skip the row. Got: %v", err)
+	}
+	if err := execute("insert or ignore 3 carol carol@x.org"); err != nil {
+		t.Fatalf("Insert or ignore of a new id failed: %v", err)
+	}
+	if err := execute("insert or replace 2 robert robert@x.org"); err != nil {
+		t.Fatalf("Insert or replace failed: %v", err)
+	}
+	if err := execute("insert or replace 4 dave dave@x.org"); err != nil {
+		t.Fatalf("Insert or replace of a new id failed: %v", err)
+	}
+	for _, test := range []struct {
+		text     string
+		expected ExecResult
+	}{
+		{"insert or ignore 1 carol carol@x.org", ExecResult{Insert: Ignored}},
+		{"insert or replace 4 dave dave@x.org", ExecResult{RowsAffected: 1, Insert: Replaced}},
+		{"insert 5 erin erin@x.org", ExecResult{RowsAffected: 1, Insert: Inserted}},
+		{"delete 5", ExecResult{RowsAffected: 1}},
+		{"select", ExecResult{}},
+	} {
+		stmt, _ := parser.Parse(test.text)
+		if result, err := table.Execute(ctx, stmt, func([]any) error { return nil }); err != nil || result != test.expected {
+			t.Fatalf("%s: expected %+v. Got: %+v, %v", test.text, test.expected, result, err)
+		}
+	}
+	if names := usernames(); !slices.Equal(names, []string{"alice", "robert", "carol", "dave"}) {
+		t.Fatalf("Expected the ignored row skipped and the replaced one overwritten. Got: %v", names)
+	}
+	if info, _ := table.Info(); info.Rows != 4 {
+		t.Fatalf("Expected 4 rows counted. Got: %d", info.Rows)
+	}
+
+	// A row replaced with its own unique value keeps it, one taken by another row still fails.
+	if err := execute("create unique index on username"); err != nil {
+		t.Fatalf("Creating the unique index failed: %v", err)
+	}
+	if err := execute("insert or replace 1 alice new@x.org"); err != nil {
+		t.Fatalf("Expected alice to replace her own row. Got: %v", err)
+	}
+	if err := execute("insert or replace 1 bob new@x.org"); err != nil {
+		t.Fatalf("Expected bob to be free. Got: %v", err)
+	}
+	if err := execute("insert or replace 1 robert robert2@x.org"); err == nil || err.Error() != "duplicate username 'robert', row 2 has 'robert'" {
+		t.Fatalf("Expected robert to collide with row 2. Got: %v", err)
+	}
+	if err := execute("insert or ignore 5 robert robert2@x.org"); err != nil {
+		t.Fatalf("Expected insert or ignore to skip a taken unique value. Got: %v", err)
+	}
+	if names := usernames(); !slices.Equal(names, []string{"bob", "robert", "carol", "dave"}) {
+		t.Fatalf("Expected the failed replace to be undone. Got: %v", names)
+	}
+	table.Close()
+}
+
+func TestInsertReturning(t *testing.T) {
+	table, _ := openTestDb(t)
+	ctx := context.Background()
+	execute := func(text string) ([][]any, error) {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		rows := [][]any{}
+		_, err = table.Execute(ctx, stmt, func(values []any) error {
+			rows = append(rows, values)
+			return nil
+		})
+		return rows, err
+	}
+	execute("add column email_lower as (lower(email)) stored")
+	execute("add column name_length as (length(username))")
+
+	rows, err := execute("insert 1 Alice Alice@X.org returning *")
+	if err != nil || fmt.Sprint(rows) != "[[1 Alice Alice@X.org alice@x.org 5]]" {
+		t.Fatalf("Expected the row with its generated values. Got: %v, %v", rows, err)
+	}
+	stmt, _ := parser.Parse("insert 1 a b returning *")
+	if columns := table.Columns(stmt); !slices.Equal(columns, []string{"id", "username", "email", "email_lower", "name_length"}) {
+		t.Fatalf("Expected every column for returning *. Got: %v", columns)
+	}
+	rows, err = execute("insert or replace 1 Bob bob@x.org returning email_lower, id")
+	if err != nil || fmt.Sprint(rows) != "[[bob@x.org 1]]" {
+		t.Fatalf("Expected the replaced row. Got: %v, %v", rows, err)
+	}
+	stmt, _ = parser.Parse("insert 1 a b returning email_lower, id")
+	if valueTypes := table.ColumnTypes(stmt); !slices.Equal(valueTypes, []string{"text", "integer"}) {
+		t.Fatalf("Expected the types of the returned columns. Got: %v", valueTypes)
+	}
+	if rows, err = execute("insert or ignore 1 Carol carol@x.org returning id"); err != nil || len(rows) != 0 {
+		t.Fatalf("Expected an ignored row not to be returned. Got: %v, %v", rows, err)
+	}
+	if rows, err = execute("insert 2 Carol carol@x.org"); err != nil || len(rows) != 0 {
+		t.Fatalf("Expected an insert without returning to return nothing. Got: %v, %v", rows, err)
+	}
+	if _, err = execute("insert 3 Dave dave@x.org returning phone"); err == nil || err.Error() != "no such column: phone" {
+		t.Fatalf("Expected an unknown column to fail. Got: %v", err)
+	}
+	if rows, _ = execute("select id where id = 3"); len(rows) != 0 {
+		t.Fatalf("Expected the insert returning an unknown column not to insert the row. Got: %v", rows)
+	}
+	table.Close()
+}
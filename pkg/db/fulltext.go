@@ -0,0 +1,202 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Fulltext index.
+
+A fulltext index maps every word of the indexed text columns to the ids of
+the rows containing it, so <column> match '<words>' only looks up the rows
+that contain all of the words instead of scanning the table. A word is a run
+of letters and digits, lowercased, so alice@example.com has the words alice,
+example and com.
+
+Only which columns are indexed is stored, in the file header. The index
+itself is held in memory: it is built from the rows when the database is
+opened, and kept up to date with the changes of every committed transaction.
+Inside a transaction it does not see the uncommitted rows yet, so a match
+there scans the table instead. Without an index on its column a match always
+scans, testing the words of every row.
+*/
+
+// fulltextIndex maps the words of the indexed columns to the ids of the rows holding them.
+type fulltextIndex struct {
+	columns []int                              // Indexes into columnNames.
+	words   map[int]map[string]map[uint32]bool // Column, word, ids.
+}
+
+func newFulltextIndex(columns []int) *fulltextIndex {
+	index := &fulltextIndex{columns: columns, words: map[int]map[string]map[uint32]bool{}}
+	for _, column := range columns {
+		index.words[column] = map[string]map[uint32]bool{}
+	}
+	return index
+}
+
+// tokenize returns the distinct words of a text, sorted.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	slices.Sort(words)
+	return slices.Compact(words)
+}
+
+func (index *fulltextIndex) add(row types.Row) {
+	values := rowValues(row)
+	for _, column := range index.columns {
+		for _, word := range tokenize(values[column].(string)) {
+			ids := index.words[column][word]
+			if ids == nil {
+				ids = map[uint32]bool{}
+				index.words[column][word] = ids
+			}
+			ids[row.Id] = true
+		}
+	}
+}
+
+func (index *fulltextIndex) remove(row types.Row) {
+	values := rowValues(row)
+	for _, column := range index.columns {
+		for _, word := range tokenize(values[column].(string)) {
+			delete(index.words[column][word], row.Id)
+			if len(index.words[column][word]) == 0 {
+				delete(index.words[column], word)
+			}
+		}
+	}
+}
+
+// apply brings the index up to date with committed changes.
+func (index *fulltextIndex) apply(changes []Change) {
+	for _, change := range changes {
+		if change.Before != nil {
+			index.remove(*change.Before)
+		}
+		if change.After != nil {
+			index.add(*change.After)
+		}
+	}
+}
+
+// lookup returns the ids of the rows whose column has every one of the words, in
+// ascending order. It reports false if the column is not indexed.
+func (index *fulltextIndex) lookup(column int, words []string) ([]uint32, bool) {
+	postings, ok := index.words[column]
+	if !ok {
+		return nil, false
+	}
+	if len(words) == 0 {
+		return nil, false // Every row matches, there is nothing to narrow.
+	}
+	ids := []uint32{}
+	// Candidates come from the rarest word and must have all the others.
+	rarest := slices.MinFunc(words, func(a, b string) int { return len(postings[a]) - len(postings[b]) })
+	for id := range postings[rarest] {
+		if !slices.ContainsFunc(words, func(word string) bool { return !postings[word][id] }) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, true
+}
+
+// loadFulltextIndex builds the index of the columns the file header lists, if any.
+func (t *Table) loadFulltextIndex() error {
+	t.pager.changes.index = nil
+	columns := []int{}
+	for i := range columnNames {
+		if t.pager.header.FulltextColumns&(1<<i) != 0 {
+			columns = append(columns, i)
+		}
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	index := newFulltextIndex(columns)
+	err := t.Scan(context.Background(), func(row types.Row) error {
+		index.add(row)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.pager.changes.index = index
+	return nil
+}
+
+// FulltextColumns returns the columns with a fulltext index, in schema order.
+func (t *Table) FulltextColumns() []string {
+	names := []string{}
+	for i, name := range columnNames {
+		if t.pager.header.FulltextColumns&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// CreateFulltextIndex indexes the words of text columns, replacing any index there was.
+func (t *Table) CreateFulltextIndex(ctx context.Context, columns []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mask := uint32(0)
+	for _, column := range columns {
+		index := slices.Index(columnNames, column)
+		if index < 0 {
+			return fmt.Errorf("no such column: %s", column)
+		}
+		if columnTypes[index] != "text" {
+			return fmt.Errorf("a fulltext index needs text columns, but %s is %s", column, columnTypes[index])
+		}
+		mask |= 1 << index
+	}
+	return t.setFulltextColumns(mask)
+}
+
+// DropFulltextIndex removes the fulltext index.
+func (t *Table) DropFulltextIndex(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t.pager.header.FulltextColumns == 0 {
+		return fmt.Errorf("there is no fulltext index")
+	}
+	return t.setFulltextColumns(0)
+}
+
+// setFulltextColumns commits the indexed columns to the file header and rebuilds the index.
+func (t *Table) setFulltextColumns(mask uint32) error {
+	pager := t.pager
+	if pager.readOnly {
+		return errReadOnly
+	}
+	if pager.inTxn {
+		return fmt.Errorf("cannot change the fulltext index - a transaction is active")
+	}
+	old := pager.header.FulltextColumns
+	err := t.write(func() error {
+		if _, err := getPage(pager, t.rootPageNum); err != nil {
+			return err
+		}
+		// A commit only writes the header along with the pages it changed.
+		markPageDirty(pager, t.rootPageNum)
+		pager.header.FulltextColumns = mask
+		return nil
+	})
+	if err != nil {
+		pager.header.FulltextColumns = old
+		return err
+	}
+	return t.loadFulltextIndex()
+}
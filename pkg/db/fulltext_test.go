@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestFulltextIndex(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	execute := func(text string) ([]string, error) {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		rows := []string{}
+		_, err = table.Execute(ctx, stmt, func(values []any) error {
+			rows = append(rows, fmt.Sprint(values[0]))
+			return nil
+		})
+		return rows, err
+	}
+	for i := 1; i <= 60; i++ {
+		domain := "example.com"
+		if i%10 == 0 {
+			domain = "Mail.Example.org"
+		}
+		execute(fmt.Sprintf("insert %d user%d user%d@%s", i, i, i, domain))
+	}
+	if _, err := execute("create fulltext index on id"); err == nil || err.Error() != "a fulltext index needs text columns, but id is integer" {
+		t.Fatalf("Expected indexing the id to fail. Got: %v", err)
+	}
+	if _, err := execute("create fulltext index on username, email"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	scanned := table.rowsScanned
+	rows, err := execute("select id where email match 'MAIL example' and id > 15 order by id desc")
+	if expected := []string{"60", "50", "40", "30", "20"}; err != nil || !slices.Equal(rows, expected) {
+		t.Fatalf("Expected %v. Got: %v, %v", expected, rows, err)
+	}
+	// A point scan reads the row after the id too, to see its range ends.
+	if got := table.rowsScanned - scanned; got > 10 {
+		t.Fatalf("Expected the index to find the rows without a scan. Got %d rows scanned", got)
+	}
+	// Deleting and inserting keep the index up to date.
+	execute("delete 20")
+	execute("insert 61 carol carol@mail.example.org")
+	if rows, _ := execute("select id where email match 'mail'"); !slices.Equal(rows, []string{"10", "30", "40", "50", "60", "61"}) {
+		t.Fatalf("Expected the index to follow the changes. Got: %v", rows)
+	}
+	// Inside a transaction the uncommitted rows are found by scanning.
+	execute("begin")
+	execute("insert 62 dave dave@mail.example.org")
+	if rows, _ := execute("select id where email match 'mail' and username match 'DAVE'"); !slices.Equal(rows, []string{"62"}) {
+		t.Fatalf("Expected the uncommitted row. Got: %v", rows)
+	}
+	execute("rollback")
+	if rows, _ := execute("select id where username match 'dave'"); len(rows) != 0 {
+		t.Fatalf("Expected the rolled back row to be gone. Got: %v", rows)
+	}
+
+	// The index is rebuilt when the database is opened again.
+	table.Close()
+	table, _ = Open(dbName)
+	defer table.Close()
+	if columns := table.FulltextColumns(); !slices.Equal(columns, []string{"username", "email"}) {
+		t.Fatalf("Expected the indexed columns to be kept. Got: %v", columns)
+	}
+	if rows, _ := execute("select id where username match 'carol'"); !slices.Equal(rows, []string{"61"}) {
+		t.Fatalf("Expected carol after reopening. Got: %v", rows)
+	}
+	if _, err := execute("drop fulltext index"); err != nil {
+		t.Fatalf("Drop failed: %v", err)
+	}
+	if rows, _ := execute("select id where username match 'carol'"); !slices.Equal(rows, []string{"61"}) {
+		t.Fatalf("Expected match to scan without an index. Got: %v", rows)
+	}
+}
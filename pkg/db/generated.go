@@ -0,0 +1,251 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Generated columns.
+
+A generated column computes its value from the columns of the schema with an
+expression, as in add column email_lower as (lower(email)), and follows them
+in select * and wherever a column can be named. A virtual column, the
+default, is computed whenever a row is read. A stored one is computed when
+the row is inserted and kept in a B-tree of its own, keyed by id like the
+table, so reading it costs a lookup in that tree instead. The file header
+lists the columns with the text of their expressions, which are compiled
+again when the database is opened.
+*/
+
+// generatedColumn is a generated column with its expression compiled.
+type generatedColumn struct {
+	types.GeneratedColumn
+	valueType string
+	value     func(values []any) any // Computed from the values of the schema's columns.
+}
+
+// compileGenerated compiles the expression of a generated column, which may only use the columns of the schema.
+func compileGenerated(column types.GeneratedColumn) (generatedColumn, error) {
+	stmt, err := parser.Parse(fmt.Sprintf("add column %s as (%s)", column.Name, column.Expr))
+	if err != nil {
+		return generatedColumn{}, fmt.Errorf("generated column %s: %w", column.Name, err)
+	}
+	value, valueType, err := compileOperand(columnNames, columnTypes, stmt.(*parser.AddColumn).Expr)
+	if err != nil {
+		return generatedColumn{}, fmt.Errorf("generated column %s: %w", column.Name, err)
+	}
+	return generatedColumn{GeneratedColumn: column, valueType: valueType, value: value}, nil
+}
+
+// loadGenerated compiles the generated columns the file header lists.
+func (t *Table) loadGenerated() error {
+	t.pager.generated = nil
+	for _, column := range t.pager.header.Generated {
+		compiled, err := compileGenerated(column)
+		if err != nil {
+			return err
+		}
+		t.pager.generated = append(t.pager.generated, compiled)
+	}
+	return nil
+}
+
+// columns returns the names and types of the columns of the schema followed by the generated ones.
+func (t *Table) columns() ([]string, []string) {
+	names, valueTypes := slices.Clone(columnNames), slices.Clone(columnTypes)
+	for _, column := range t.pager.generated {
+		names = append(names, column.Name)
+		valueTypes = append(valueTypes, column.valueType)
+	}
+	return names, valueTypes
+}
+
+// Schema returns the columns of the schema followed by the generated columns of the table.
+func (t *Table) Schema() []ColumnDef {
+	columns := Schema()
+	for _, column := range t.pager.generated {
+		columns = append(columns, ColumnDef{Name: column.Name, Type: column.valueType, Generated: column.Expr, Stored: column.Stored})
+	}
+	for i := range columns {
+		columns[i].Collation = t.pager.header.Collations[i]
+	}
+	return columns
+}
+
+/*
+AddColumn adds a generated column computing expr from the columns of the
+schema. A stored column is computed for the rows already in the table as
+part of adding it.
+*/
+func (t *Table) AddColumn(ctx context.Context, name string, expr string, stored bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pager := t.pager
+	if pager.readOnly {
+		return errReadOnly
+	}
+	if pager.inTxn {
+		return fmt.Errorf("cannot add a column - a transaction is active")
+	}
+	if names, _ := t.columns(); slices.Contains(names, name) {
+		return fmt.Errorf("column %s already exists", name)
+	}
+	if len(name) > int(constants.GeneratedNameSize) {
+		return fmt.Errorf("a column name is at most %d bytes", constants.GeneratedNameSize)
+	}
+	if len(expr) > int(constants.GeneratedExprSize) {
+		return fmt.Errorf("the expression of a generated column is at most %d bytes", constants.GeneratedExprSize)
+	}
+	if len(pager.generated) >= int(constants.MaxGenerated) {
+		return fmt.Errorf("a table has at most %d generated columns", constants.MaxGenerated)
+	}
+	column, err := compileGenerated(types.GeneratedColumn{Name: name, Expr: expr, Stored: stored})
+	if err != nil {
+		return err
+	}
+	oldColumns, oldRoot, oldGenerated := pager.header.Generated, pager.header.GeneratedRootPageNum, pager.generated
+	err = t.write(func() error {
+		if _, err := getPage(pager, t.rootPageNum); err != nil {
+			return err
+		}
+		// A commit only writes the header along with the pages it changed.
+		markPageDirty(pager, t.rootPageNum)
+		pager.header.Generated = append(slices.Clip(oldColumns), column.GeneratedColumn)
+		pager.generated = append(slices.Clip(oldGenerated), column)
+		if !stored {
+			return nil
+		}
+		if pager.header.GeneratedRootPageNum == 0 {
+			pageNum, err := getUnusedPageNum(pager)
+			if err != nil {
+				return err
+			}
+			root, err := getPage(pager, pageNum)
+			if err != nil {
+				return err
+			}
+			initializeLeafNode(root)
+			setNodeRoot(root, true)
+			markPageDirty(pager, pageNum)
+			pager.header.GeneratedRootPageNum = pageNum
+		}
+		// Every row is given its stored values again, with those of the new column among them.
+		rows := []types.Row{}
+		err := t.Scan(ctx, func(row types.Row) error {
+			rows = append(rows, row)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := range rows {
+			if err := generatedDelete(pager, rows[i].Id); err != nil {
+				return err
+			}
+			if err := generatedInsert(pager, &rows[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		pager.header.Generated, pager.header.GeneratedRootPageNum, pager.generated = oldColumns, oldRoot, oldGenerated
+		return err
+	}
+	return nil
+}
+
+// generatedTree returns the tree of the stored generated values.
+func generatedTree(pager *Pager) *Table {
+	return &Table{
+		pager:       pager,
+		rootPageNum: pager.header.GeneratedRootPageNum,
+		logger:      pager.logger,
+		now:         time.Now,
+		auxiliary:   true,
+	}
+}
+
+// generatedInsert stores the values of the stored generated columns of a row being inserted.
+func generatedInsert(pager *Pager, row *types.Row) error {
+	if pager.header.GeneratedRootPageNum == 0 {
+		return nil
+	}
+	values := rowValues(*row)
+	stored := []any{}
+	for _, column := range pager.generated {
+		if column.Stored {
+			stored = append(stored, column.value(values))
+		}
+	}
+	packed, err := packRow(row.Id, stored)
+	if err != nil {
+		return fmt.Errorf("the stored generated columns of row %d: %w", row.Id, err)
+	}
+	return insertRow(generatedTree(pager), &packed)
+}
+
+// generatedDelete removes the stored generated values of a row being deleted, if
+// it has any. Rows that had expired before a stored column was added have none.
+func generatedDelete(pager *Pager, id uint32) error {
+	if pager.header.GeneratedRootPageNum == 0 {
+		return nil
+	}
+	tree := generatedTree(pager)
+	if _, found, err := storedValues(tree, id); err != nil || !found {
+		return err
+	}
+	return deleteRow(tree, id)
+}
+
+// storedValues returns the stored generated values of the row with the id, and whether it has any.
+func storedValues(tree *Table, id uint32) ([]any, bool, error) {
+	cursor, err := tableFind(tree, id)
+	if err != nil {
+		return nil, false, err
+	}
+	node, err := getPage(tree.pager, cursor.pageNum)
+	if err != nil {
+		return nil, false, err
+	}
+	if cursor.cellNum >= binary.LittleEndian.Uint32(leafNodeNumCells(node)) ||
+		binary.LittleEndian.Uint32(leafNodeKey(node, cursor.cellNum)) != id {
+		return nil, false, nil
+	}
+	return unpackRow(deserializeRow(leafNodeValue(node, cursor.cellNum))), true, nil
+}
+
+// appendGenerated appends the values of the generated columns to the values of a row.
+func appendGenerated(pager *Pager, values []any) ([]any, error) {
+	row := values[:len(columnNames)]
+	var stored []any // Read once the first stored column is reached.
+	next := 0
+	for _, column := range pager.generated {
+		if !column.Stored {
+			values = append(values, column.value(row))
+			continue
+		}
+		if stored == nil {
+			id := uint32(row[0].(int64))
+			var found bool
+			var err error
+			if stored, found, err = storedValues(generatedTree(pager), id); err != nil {
+				return nil, err
+			} else if !found {
+				return nil, fmt.Errorf("row %d has no stored generated values", id)
+			}
+		}
+		values = append(values, stored[next])
+		next++
+	}
+	return values, nil
+}
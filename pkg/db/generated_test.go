@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestGeneratedColumns(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	execute := func(text string) ([]string, error) {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		rows := []string{}
+		_, err = table.Execute(ctx, stmt, func(values []any) error {
+			rows = append(rows, fmt.Sprint(values))
+			return nil
+		})
+		return rows, err
+	}
+	execute("insert 1 Alice Alice@Example.com")
+	execute("insert 2 bob BOB@x.org")
+	execute("insert 3 carol carol@x.org")
+	if _, err := execute("add column email_lower as (lower(email)) stored"); err != nil {
+		t.Fatalf("Adding a stored column failed: %v", err)
+	}
+	if _, err := execute("add column name_length as (length(username))"); err != nil {
+		t.Fatalf("Adding a virtual column failed: %v", err)
+	}
+	execute("insert 4 Dave DAVE@X.ORG")
+	expected := []string{
+		"[1 Alice Alice@Example.com alice@example.com 5]",
+		"[2 bob BOB@x.org bob@x.org 3]",
+		"[3 carol carol@x.org carol@x.org 5]",
+		"[4 Dave DAVE@X.ORG dave@x.org 4]",
+	}
+	if rows, err := execute("select *"); err != nil || !slices.Equal(rows, expected) {
+		t.Fatalf("Expected the generated values after the others. Got: %v, %v", rows, err)
+	}
+	stmt, _ := parser.Parse("select *")
+	if columns, types := table.Columns(stmt), table.ColumnTypes(stmt); !slices.Equal(columns, []string{"id", "username", "email", "email_lower", "name_length"}) ||
+		types[3] != "text" || types[4] != "integer" {
+		t.Fatalf("Expected the generated columns. Got: %v %v", columns, types)
+	}
+	for text, want := range map[string][]string{
+		"select id where email_lower = 'bob@x.org'":                              {"[2]"},
+		"select id where email_lower like '%x.org'":                              {"[2]", "[3]", "[4]"},
+		"select id, name_length where name_length > 4":                           {"[1 5]", "[3 5]"},
+		"select name_length, count(*) group by name_length order by name_length": {"[3 1]", "[4 1]", "[5 2]"},
+		"select email_lower order by name_length desc limit 1":                   {"[alice@example.com]"},
+	} {
+		if rows, err := execute(text); err != nil || !slices.Equal(rows, want) {
+			t.Fatalf("Expected %s to return %v. Got: %v, %v", text, want, rows, err)
+		}
+	}
+
+	// Deleting a row deletes its stored values, a rolled back insert leaves none.
+	execute("delete 2")
+	execute("begin")
+	execute("insert 5 eve EVE@x.org")
+	execute("rollback")
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected sound stored values. Got: %v", problems)
+	}
+
+	for text, want := range map[string]string{
+		"add column email as (lower(email))":   "column email already exists",
+		"add column n as (length(id))":         "generated column n: length needs text, but got integer",
+		"add column n as (upper(nope))":        "generated column n: no such column: nope",
+		"add column n as (upper(email_lower))": "generated column n: no such column: email_lower",
+		"select where length(email) = 'x'":     "can not compare integer with text",
+	} {
+		if _, err := execute(text); err == nil || err.Error() != want {
+			t.Fatalf("Expected %s to fail with %q. Got: %v", text, want, err)
+		}
+	}
+	execute("begin")
+	if _, err := execute("add column n as (upper(email))"); err == nil || err.Error() != "cannot add a column - a transaction is active" {
+		t.Fatalf("Expected a column to need no transaction. Got: %v", err)
+	}
+	execute("rollback")
+
+	table.Close()
+	table, _ = Open(dbName)
+	defer table.Close()
+	if rows, _ := execute("select * where id >= 3"); !slices.Equal(rows, expected[2:]) {
+		t.Fatalf("Expected the generated columns to be kept. Got: %v", rows)
+	}
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected sound stored values. Got: %v", problems)
+	}
+}
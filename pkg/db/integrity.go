@@ -0,0 +1,290 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Integrity check.
+
+Walks every node reachable from the root and verifies:
+  - keys are strictly ascending within and across leaves,
+  - every child points back to its parent and only the root is marked as root,
+  - the key of every internal cell is at least the max key of its child and
+    below the keys of the next child. It equals the max key unless deletes
+    emptied the leaves that held the larger keys, as they are not merged.
+  - the next-leaf chain visits the leaves in tree order,
+  - every page in the file is reachable from the root,
+  - the keys of a partitioned table's trees are within their partitions,
+  - the bloom filter has the bits of every key set,
+  - the boxes of the spatial index's nodes hold those of their children, and
+    its leaves have at most one box for every key and none for other ids,
+  - the trees of materialized views are sound B-trees too, and their keys,
+    which are not keys of the table, are left out of the bloom filter check,
+  - so is the tree of the stored generated values, whose keys are all keys
+    of the table,
+  - and the tree of the descending index, which holds a copy of every row
+    and of no other.
+
+The check reads raw node fields instead of going through the node accessors,
+so a corrupt tree is reported rather than crashing the process.
+*/
+
+type integrityChecker struct {
+	pager    *Pager
+	visited  map[uint32]bool
+	leaves   []uint32
+	problems []string
+}
+
+// integrityCheck returns a description of every broken invariant, or nothing if the tree is sound.
+func integrityCheck(table *Table) []string {
+	c := integrityChecker{
+		pager:   table.pager,
+		visited: map[uint32]bool{},
+	}
+	partitions := table.trees()
+	allKeys := []uint32{}
+	for i, p := range partitions {
+		c.leaves = nil
+		keys := c.checkNode(p.tree.rootPageNum, constants.InvalidPageNum)
+		allKeys = append(allKeys, keys...)
+		c.checkAscending(p.tree.rootPageNum, keys)
+		if end := partitionEnd(partitions, i); len(keys) > 0 && (keys[0] < p.from || keys[len(keys)-1] > end) {
+			c.report("tree at page %d has keys %d to %d outside of its partition %d-%d", p.tree.rootPageNum, keys[0], keys[len(keys)-1], p.from, end)
+		}
+		c.checkLeafChain()
+	}
+	c.checkBloom(allKeys)
+	if count := c.pager.header.RowCount; count != uint32(len(allKeys)) {
+		c.report("the file header counts %d rows, the trees hold %d", count, len(allKeys))
+	}
+	keys := map[uint32]bool{}
+	for _, key := range allKeys {
+		keys[key] = true
+	}
+	if root := c.pager.header.SpatialRootPageNum; root != 0 {
+		c.checkSpatialNode(root, true, nil, keys, map[uint32]bool{})
+	}
+	for _, v := range c.pager.header.Views {
+		c.leaves = nil
+		c.checkAscending(v.RootPageNum, c.checkNode(v.RootPageNum, constants.InvalidPageNum))
+		c.checkLeafChain()
+	}
+	if root := c.pager.header.GeneratedRootPageNum; root != 0 {
+		c.leaves = nil
+		stored := c.checkNode(root, constants.InvalidPageNum)
+		c.checkAscending(root, stored)
+		c.checkLeafChain()
+		for _, key := range stored {
+			if !keys[key] {
+				c.report("stored generated values for key %d, which is not a row", key)
+			}
+		}
+	}
+	if root := c.pager.header.DescendingRootPageNum; root != 0 {
+		c.leaves = nil
+		copies := c.checkNode(root, constants.InvalidPageNum)
+		c.checkAscending(root, copies)
+		c.checkLeafChain()
+		indexed := map[uint32]bool{}
+		for _, key := range copies {
+			id := descendingKey(key)
+			indexed[id] = true
+			if !keys[id] {
+				c.report("the descending index has a copy of row %d, which is not a row", id)
+			}
+		}
+		for _, key := range allKeys {
+			if !indexed[key] {
+				c.report("row %d is missing from the descending index", key)
+			}
+		}
+	}
+	for _, root := range []uint32{c.pager.header.UniqueRootPageNum, c.pager.header.StatisticsRootPageNum, c.pager.header.UsersRootPageNum, c.pager.header.OrderedRootPageNum} {
+		if root == 0 {
+			continue
+		}
+		c.leaves = nil
+		c.checkAscending(root, c.checkNode(root, constants.InvalidPageNum))
+		c.checkLeafChain()
+	}
+	for pageNum := uint32(0); pageNum < c.pager.numPages; pageNum++ {
+		if !c.visited[pageNum] {
+			c.report("page %d is not reachable from the root", pageNum)
+		}
+	}
+	return c.problems
+}
+
+func (c *integrityChecker) report(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// checkNode verifies the subtree rooted at pageNum and returns its keys in tree order.
+func (c *integrityChecker) checkNode(pageNum uint32, parentPageNum uint32) []uint32 {
+	if pageNum >= c.pager.numPages || pageNum >= constants.TableMaxPages {
+		c.report("page %d is out of bounds, the file has %d pages", pageNum, c.pager.numPages)
+		return nil
+	}
+	if c.visited[pageNum] {
+		c.report("page %d is referenced more than once", pageNum)
+		return nil
+	}
+	c.visited[pageNum] = true
+
+	node, err := getPage(c.pager, pageNum)
+	if err != nil {
+		c.report("page %d can not be read: %v", pageNum, err)
+		return nil
+	}
+	isRoot := parentPageNum == constants.InvalidPageNum
+	if isNodeRoot(node) != isRoot {
+		c.report("page %d has root flag %t, expected %t", pageNum, isNodeRoot(node), isRoot)
+	}
+	if parent := binary.LittleEndian.Uint32(nodeParent(node)); !isRoot && parent != parentPageNum {
+		c.report("page %d has parent %d, expected %d", pageNum, parent, parentPageNum)
+	}
+
+	switch getNodeType(node) {
+	case types.NodeLeaf:
+		c.leaves = append(c.leaves, pageNum)
+		numCells := binary.LittleEndian.Uint32(leafNodeNumCells(node))
+		if numCells > constants.LeafNodeMaxCells {
+			c.report("page %d has %d cells, at most %d fit", pageNum, numCells, constants.LeafNodeMaxCells)
+			numCells = constants.LeafNodeMaxCells
+		}
+		keys := make([]uint32, 0, numCells)
+		for i := uint32(0); i < numCells; i++ {
+			keys = append(keys, binary.LittleEndian.Uint32(leafNodeKey(node, i)))
+		}
+		c.checkAscending(pageNum, keys)
+		return keys
+	case types.NodeInternal:
+		numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+		if numKeys > constants.InternalNodeMaxCells {
+			c.report("page %d has %d keys, at most %d fit", pageNum, numKeys, constants.InternalNodeMaxCells)
+			numKeys = constants.InternalNodeMaxCells
+		}
+		keys := []uint32{}
+		var prevKey uint32 // Key of the previous cell, all keys of the child must be larger.
+		for i := uint32(0); i <= numKeys; i++ {
+			var childPageNum uint32
+			if i == numKeys {
+				childPageNum = binary.LittleEndian.Uint32(internalNodeRightChild(node))
+			} else {
+				childPageNum = binary.LittleEndian.Uint32(internalNodeCell(node, i))
+			}
+			childKeys := c.checkNode(childPageNum, pageNum)
+			if rows := binary.LittleEndian.Uint32(internalNodeCount(node, i)); rows != uint32(len(childKeys)) {
+				c.report("page %d counts %d rows under child %d, which holds %d", pageNum, rows, childPageNum, len(childKeys))
+			}
+			var key uint32
+			if i < numKeys {
+				key = binary.LittleEndian.Uint32(internalNodeKey(node, i))
+			}
+			if len(childKeys) > 0 {
+				if i > 0 && childKeys[0] <= prevKey {
+					c.report("page %d has key %d above the min key %d of child %d", pageNum, prevKey, childKeys[0], childPageNum)
+				}
+				if max := childKeys[len(childKeys)-1]; i < numKeys && key < max {
+					c.report("page %d has key %d for child %d whose max key is %d", pageNum, key, childPageNum, max)
+				}
+			}
+			prevKey = key
+			keys = append(keys, childKeys...)
+		}
+		return keys
+	default:
+		c.report("page %d has unknown node type %d", pageNum, getNodeType(node))
+		return nil
+	}
+}
+
+// checkSpatialNode verifies the subtree of the spatial index at pageNum, whose box in its
+// parent is bounds, nil for the root. The ids of the rows it has a box for are added to boxed.
+func (c *integrityChecker) checkSpatialNode(pageNum uint32, isRoot bool, bounds *types.Box, keys map[uint32]bool, boxed map[uint32]bool) {
+	if pageNum >= c.pager.numPages || pageNum >= constants.TableMaxPages {
+		c.report("spatial index page %d is out of bounds, the file has %d pages", pageNum, c.pager.numPages)
+		return
+	}
+	if c.visited[pageNum] {
+		c.report("page %d is referenced more than once", pageNum)
+		return
+	}
+	c.visited[pageNum] = true
+	node, err := getPage(c.pager, pageNum)
+	if err != nil {
+		c.report("page %d can not be read: %v", pageNum, err)
+		return
+	}
+	if getNodeType(node) != types.NodeSpatial {
+		c.report("spatial index page %d has node type %d", pageNum, getNodeType(node))
+		return
+	}
+	if isNodeRoot(node) != isRoot {
+		c.report("page %d has root flag %t, expected %t", pageNum, isNodeRoot(node), isRoot)
+	}
+	if n := binary.LittleEndian.Uint32(node[constants.SpatialNodeNumEntriesOffset:]); n > constants.SpatialNodeMaxEntries {
+		c.report("page %d has %d entries, at most %d fit", pageNum, n, constants.SpatialNodeMaxEntries)
+	}
+	isLeaf := spatialNodeIsLeaf(node)
+	for _, e := range spatialNodeEntries(node) {
+		if bounds != nil && !boxContains(*bounds, e.box) {
+			c.report("spatial index page %d has a box outside of the box its parent has for it", pageNum)
+		}
+		if !isLeaf {
+			c.checkSpatialNode(e.pointer, false, &e.box, keys, boxed)
+			continue
+		}
+		if !keys[e.pointer] {
+			c.report("the spatial index has a box for key %d, which is not in the table", e.pointer)
+		}
+		if boxed[e.pointer] {
+			c.report("the spatial index has more than one box for key %d", e.pointer)
+		}
+		boxed[e.pointer] = true
+	}
+}
+
+// checkBloom verifies that the bloom filter, if there is one, does not rule out any of the keys.
+func (c *integrityChecker) checkBloom(keys []uint32) {
+	skips := c.pager.bloomSkips
+	for _, key := range keys {
+		if !bloomMayContain(c.pager, key) {
+			c.report("the bloom filter rules out key %d", key)
+		}
+	}
+	c.pager.bloomSkips = skips
+}
+
+func (c *integrityChecker) checkAscending(pageNum uint32, keys []uint32) {
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			c.report("keys under page %d are not ascending: %d before %d", pageNum, keys[i-1], keys[i])
+			return
+		}
+	}
+}
+
+// checkLeafChain verifies that following next-leaf pointers visits the leaves in tree order.
+func (c *integrityChecker) checkLeafChain() {
+	for i, pageNum := range c.leaves {
+		node, err := getPage(c.pager, pageNum)
+		if err != nil {
+			continue // Already reported while walking the tree.
+		}
+		next := binary.LittleEndian.Uint32(leafNodeNextLeaf(node))
+		want := uint32(0) // 0 marks the rightmost leaf.
+		if i+1 < len(c.leaves) {
+			want = c.leaves[i+1]
+		}
+		if next != want {
+			c.report("leaf %d points to next leaf %d, expected %d", pageNum, next, want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+)
+
+func TestIntegrityCheckRandomInserts(t *testing.T) {
+	dbName := filepath.Join(t.TempDir(), "test.db")
+	for seed := int64(0); seed < 20; seed++ {
+		os.Remove(dbName)
+		os.Remove(dbName + constants.WalFileSuffix)
+		table, _ := Open(dbName)
+
+		r := rand.New(rand.NewSource(seed))
+		for _, i := range r.Perm(300) {
+			row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+			insertRow(table, &row)
+		}
+		if problems := integrityCheck(table); len(problems) > 0 {
+			t.Fatalf("Seed %d: expected a sound tree. Got: %v", seed, problems)
+		}
+	}
+}
+
+func TestIntegrityCheckDetectsCorruption(t *testing.T) {
+	table, _ := openTestDb(t)
+	for i := 1; i <= 20; i++ {
+		row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+		insertRow(table, &row)
+	}
+
+	root, _ := getPage(table.pager, table.rootPageNum)
+	leftPageNum := binary.LittleEndian.Uint32(internalNodeCell(root, 0))
+	left, _ := getPage(table.pager, leftPageNum)
+	binary.LittleEndian.PutUint32(nodeParent(left), 42)
+	binary.LittleEndian.PutUint32(leafNodeKey(left, 0), 99)
+	getPage(table.pager, table.pager.numPages) // Allocates a page nothing points to.
+
+	expected := []string{
+		fmt.Sprintf("page %d has parent 42, expected %d", leftPageNum, table.rootPageNum),
+		fmt.Sprintf("keys under page %d are not ascending: 99 before 2", leftPageNum),
+		fmt.Sprintf("keys under page %d are not ascending: 99 before 2", table.rootPageNum),
+		"the bloom filter rules out key 99", // The key was changed behind the filter's back.
+		fmt.Sprintf("page %d is not reachable from the root", table.pager.numPages-1),
+	}
+	problems := integrityCheck(table)
+	if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Got: %q, Expected: %q", problems, expected)
+	}
+}
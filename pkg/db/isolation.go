@@ -0,0 +1,300 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Isolation levels.
+
+The transactions of BeginTxn run at the isolation level the table had when
+they began, see SetIsolation, unless set isolation level <level> runs in one
+before it reads or writes a row. The table's own transaction, of Begin, has
+no level: it is the only one, so nothing it reads can change under it, and
+the setting fails there.
+
+read committed, the default: every read sees the rows as last committed when
+it runs. Reading a row twice may give two different rows, if another
+transaction committed a change to it in between (a non-repeatable read), and
+reading a range of ids twice may find rows added or gone (phantoms).
+
+snapshot: every read sees the rows as they were committed when the
+transaction began, along with its own writes. A commit fails with
+dberr.ErrSerialization if a transaction that committed after it began wrote
+one of the rows it writes, so the first of them to commit wins. Two
+transactions may still each read rows the other writes and both commit,
+which no serial order of the two would do (write skew).
+
+serializable: snapshot, and a commit also fails if a transaction that
+committed after it began wrote a row it read, or a row in a range of ids it
+scanned, including rows inserted there. The transactions that commit then
+behave as if they ran one at a time, in the order they committed. The check
+is on ids rather than on what the rows held, so a transaction may fail that
+would have been fine; retry it.
+
+Transactions do not write before they commit, so the tree holds the rows as
+last committed. To read them as they were, each commit made while a snapshot
+or serializable transaction is open keeps the rows it changed as they were
+before it, and these are dropped once no open transaction began before it.
+*/
+
+// isolationLevels are the levels of SetIsolation.
+var isolationLevels = []string{"read committed", "snapshot", "serializable"}
+
+// SetIsolation sets the isolation level of the transactions begun from now on.
+func (t *Table) SetIsolation(level string) error {
+	if err := checkIsolation(level); err != nil {
+		return err
+	}
+	t.isolation = level
+	return nil
+}
+
+// SetIsolation sets the isolation level of the transaction, which has to be
+// done before it reads or writes a row.
+func (txn *Txn) SetIsolation(level string) error {
+	if err := checkIsolation(level); err != nil {
+		return err
+	}
+	if txn.done {
+		return errTxnDone
+	}
+	if txn.started {
+		return fmt.Errorf("the isolation level can only be set before the transaction reads or writes a row")
+	}
+	t := txn.table
+	t.locks.tree.Lock()
+	defer t.locks.tree.Unlock()
+	// Begun again, the transaction reads the rows as of now.
+	t.locks.commits.end(txn)
+	txn.isolation = level
+	t.locks.commits.begin(txn)
+	return nil
+}
+
+func checkIsolation(level string) error {
+	if !slices.Contains(isolationLevels, level) {
+		return fmt.Errorf("unknown isolation level %s, expected read committed, snapshot or serializable", level)
+	}
+	return nil
+}
+
+// idRange is the ids from from to to, inclusive.
+type idRange struct {
+	from uint32
+	to   uint32
+}
+
+// commitLog numbers the commits of transactions, and keeps the rows they
+// changed for the snapshot and serializable transactions that began before them.
+type commitLog struct {
+	last    uint64         // The number of the last commit.
+	commits []loggedCommit // Oldest first.
+	open    map[*Txn]bool  // The snapshot and serializable transactions.
+}
+
+// loggedCommit is the rows a commit changed, as they were before it.
+type loggedCommit struct {
+	num    uint64
+	ids    []uint32              // Of the rows, in ascending order.
+	before map[uint32]*types.Row // Nil for the rows that did not exist.
+}
+
+func (l *commitLog) begin(txn *Txn) {
+	txn.begin = l.last
+	if txn.isolation != "read committed" {
+		l.open[txn] = true
+	}
+}
+
+// end forgets a transaction, and the commits only it could still read past.
+func (l *commitLog) end(txn *Txn) {
+	delete(l.open, txn)
+	oldest := l.last
+	for open := range l.open {
+		oldest = min(oldest, open.begin)
+	}
+	l.commits = slices.DeleteFunc(l.commits, func(c loggedCommit) bool { return c.num <= oldest })
+}
+
+// before returns the rows the transaction writes as they are before it commits,
+// nil if no other open transaction may read them.
+func (l *commitLog) before(txn *Txn) (map[uint32]*types.Row, error) {
+	if len(l.open) == 0 || len(l.open) == 1 && l.open[txn] {
+		return nil, nil
+	}
+	before := map[uint32]*types.Row{}
+	for id := range txn.rows {
+		row, err := committedRow(txn.table, id)
+		if err != nil {
+			return nil, err
+		}
+		before[id] = row
+	}
+	return before, nil
+}
+
+// commit numbers a commit, keeping the rows it changed as they were before it if any.
+func (l *commitLog) commit(before map[uint32]*types.Row) {
+	l.last++
+	if before == nil {
+		return
+	}
+	ids := make([]uint32, 0, len(before))
+	for id := range before {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	l.commits = append(l.commits, loggedCommit{num: l.last, ids: ids, before: before})
+}
+
+// check fails a snapshot or serializable transaction that conflicts with the
+// commits made since it began.
+func (l *commitLog) check(txn *Txn) error {
+	if txn.isolation == "read committed" {
+		return nil
+	}
+	for _, c := range l.commits {
+		if c.num <= txn.begin {
+			continue
+		}
+		for _, id := range c.ids {
+			if _, wrote := txn.rows[id]; wrote {
+				return dberr.Errorf(dberr.ErrSerialization, "could not serialize: row %d was written by a transaction that committed after this one began", id)
+			}
+			if slices.ContainsFunc(txn.read, func(r idRange) bool { return r.from <= id && id <= r.to }) {
+				return dberr.Errorf(dberr.ErrSerialization, "could not serialize: row %d was read, and written by a transaction that committed after this one began", id)
+			}
+		}
+	}
+	return nil
+}
+
+// rowsBefore returns the rows with ids from from to to that commits made after
+// the transaction began changed, as they were when it began.
+func (l *commitLog) rowsBefore(txn *Txn, from uint32, to uint32) map[uint32]*types.Row {
+	rows := map[uint32]*types.Row{}
+	for _, c := range l.commits {
+		if c.num <= txn.begin {
+			continue
+		}
+		for _, id := range c.ids {
+			if _, seen := rows[id]; !seen && from <= id && id <= to {
+				rows[id] = c.before[id]
+			}
+		}
+	}
+	return rows
+}
+
+// committedRow returns the row with the id as last committed, nil if there is none or it expired.
+func committedRow(t *Table, id uint32) (*types.Row, error) {
+	row, found, err := uniqueRow(t, id)
+	if err != nil || !found || t.expired(row) {
+		return nil, err
+	}
+	return &row, nil
+}
+
+// readRange notes that the transaction read the ids from from to to, which
+// a serializable one keeps.
+func (txn *Txn) readRange(from uint32, to uint32) {
+	txn.started = true
+	if txn.isolation == "serializable" {
+		txn.read = append(txn.read, idRange{from: from, to: to})
+	}
+}
+
+// get returns the row with the id as the transaction sees it, nil if there is none.
+func (txn *Txn) get(id uint32) (*types.Row, error) {
+	if row, ok := txn.rows[id]; ok {
+		return row, nil
+	}
+	txn.readRange(id, id)
+	t := txn.table
+	t.locks.tree.Lock()
+	defer t.locks.tree.Unlock()
+	defer pagerEvict(t.pager)
+	if txn.isolation != "read committed" {
+		if row, ok := t.locks.commits.rowsBefore(txn, id, id)[id]; ok {
+			return row, nil
+		}
+	}
+	return committedRow(t, id)
+}
+
+// Get returns the row with the id as the transaction sees it, and false if there is none.
+func (txn *Txn) Get(ctx context.Context, id uint32) (types.Row, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return types.Row{}, false, err
+	}
+	if txn.done {
+		return types.Row{}, false, errTxnDone
+	}
+	row, err := txn.get(id)
+	if err != nil || row == nil {
+		return types.Row{}, false, err
+	}
+	return *row, true, nil
+}
+
+// Scan calls fn for every row with an id from from to to, inclusive, as the
+// transaction sees it, in id order, stopping at the first error.
+func (txn *Txn) Scan(ctx context.Context, from uint32, to uint32, fn func(row types.Row) error) error {
+	if txn.done {
+		return errTxnDone
+	}
+	txn.readRange(from, to)
+	rows, err := txn.scanCommitted(ctx, from, to)
+	if err != nil {
+		return err
+	}
+	for id, row := range txn.rows {
+		if from <= id && id <= to {
+			rows[id] = row
+		}
+	}
+	ids := make([]uint32, 0, len(rows))
+	for id, row := range rows {
+		if row != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if err := fn(*rows[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanCommitted returns the committed rows with ids from from to to, as they
+// were when the transaction began unless it reads committed rows. Rows that
+// did not exist then are nil.
+func (txn *Txn) scanCommitted(ctx context.Context, from uint32, to uint32) (map[uint32]*types.Row, error) {
+	t := txn.table
+	// The rows are collected before fn sees any, fn may use the transaction.
+	t.locks.tree.Lock()
+	defer t.locks.tree.Unlock()
+	rows := map[uint32]*types.Row{}
+	err := t.scanPartitions(from, to, false, func(tree *Table, from uint32, to uint32) error {
+		return tree.scanRange(ctx, from, to, func(row types.Row) error {
+			rows[row.Id] = &row
+			return nil
+		})
+	})
+	if err != nil || txn.isolation == "read committed" {
+		return rows, err
+	}
+	for id, row := range t.locks.commits.rowsBefore(txn, from, to) {
+		rows[id] = row
+	}
+	return rows, nil
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestIsolation(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	ctx := context.Background()
+	for i := 1; i <= 5; i++ {
+		table.Insert(ctx, parseRow(fmt.Sprintf("insert %d u e", i)))
+	}
+	setIsolation := func(txn *Txn, level string) error {
+		stmt, _ := parser.Parse("set isolation level " + level)
+		_, err := txn.Execute(ctx, stmt, nil)
+		return err
+	}
+	scan := func(txn *Txn, from uint32, to uint32) []uint32 {
+		ids := []uint32{}
+		if err := txn.Scan(ctx, from, to, func(row types.Row) error {
+			ids = append(ids, row.Id)
+			return nil
+		}); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		return ids
+	}
+
+	// Read committed sees what was committed in between.
+	txn1, _ := table.BeginTxn(ctx)
+	txn2, _ := table.BeginTxn(ctx)
+	if _, found, _ := txn1.Get(ctx, 1); !found {
+		t.Fatalf("Expected row 1")
+	}
+	txn2.Delete(ctx, 1)
+	txn2.Insert(ctx, parseRow("insert 6 u e"))
+	if ids := scan(txn2, 0, 10); !slices.Equal(ids, []uint32{2, 3, 4, 5, 6}) {
+		t.Fatalf("Expected the transaction to see its own writes. Got: %v", ids)
+	}
+	txn2.Commit()
+	if _, found, _ := txn1.Get(ctx, 1); found {
+		t.Fatalf("Expected read committed to see row 1 deleted")
+	}
+	txn1.Rollback()
+
+	// A snapshot keeps seeing the rows as they were, and the first writer of a row wins.
+	table.SetIsolation("snapshot")
+	txn1, _ = table.BeginTxn(ctx)
+	txn2, _ = table.BeginTxn(ctx)
+	txn2.Delete(ctx, 2)
+	txn2.Insert(ctx, parseRow("insert 7 u e"))
+	if err := txn2.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if ids := scan(txn1, 0, 10); !slices.Equal(ids, []uint32{2, 3, 4, 5, 6}) {
+		t.Fatalf("Expected the snapshot of when the transaction began. Got: %v", ids)
+	}
+	if err := txn1.Delete(ctx, 2); err != nil {
+		t.Fatalf("Expected row 2 to exist in the snapshot. Got: %v", err)
+	}
+	if err := txn1.Commit(); !errors.Is(err, dberr.ErrSerialization) {
+		t.Fatalf("Expected the second writer of row 2 to fail. Got: %v", err)
+	}
+
+	// Snapshot allows write skew, serializable does not.
+	table.SetIsolation("read committed")
+	for _, level := range []string{"snapshot", "serializable"} {
+		txn1, _ = table.BeginTxn(ctx)
+		txn2, _ = table.BeginTxn(ctx)
+		// Each inserts a row into the range if it is empty.
+		for i, txn := range []*Txn{txn1, txn2} {
+			if err := setIsolation(txn, level); err != nil {
+				t.Fatalf("Setting the isolation level failed: %v", err)
+			}
+			if ids := scan(txn, 100, 200); len(ids) != 0 {
+				t.Fatalf("Expected no rows from 100 on. Got: %v", ids)
+			}
+			txn.Insert(ctx, parseRow(fmt.Sprintf("insert %d u e", 100+i)))
+		}
+		if err := txn1.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		err := txn2.Commit()
+		if level == "snapshot" && err != nil {
+			t.Fatalf("Expected snapshot to allow write skew. Got: %v", err)
+		}
+		if level == "serializable" && (!errors.Is(err, dberr.ErrSerialization) || err.Error() != "could not serialize: row 100 was read, and written by a transaction that committed after this one began") {
+			t.Fatalf("Expected serializable to refuse write skew. Got: %v", err)
+		}
+		for _, id := range []uint32{100, 101} {
+			table.Delete(ctx, id)
+		}
+	}
+	if commits := len(table.locks.commits.commits); commits != 0 {
+		t.Fatalf("Expected no commits kept once every transaction finished. Got: %d", commits)
+	}
+	if err := table.SetIsolation("chaos"); err == nil {
+		t.Fatalf("Expected an unknown isolation level to fail")
+	}
+
+	// The level is fixed once the transaction read a row, and the table's own transaction has none.
+	txn1, _ = table.BeginTxn(ctx)
+	txn1.Get(ctx, 3)
+	if err := setIsolation(txn1, "serializable"); err == nil {
+		t.Fatalf("Expected the isolation level of a transaction that read a row to be fixed")
+	}
+	txn1.Rollback()
+	stmt, _ := parser.Parse("set isolation level serializable")
+	if _, err := table.Execute(ctx, stmt, nil); err == nil {
+		t.Fatalf("Expected set isolation level to fail outside a transaction of BeginTxn")
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !unix
+
+package db
+
+import "os"
+
+// lockFile is a no-op on platforms without flock, nothing stops two processes
+// from opening the same file there.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+// lockReaders is a no-op on platforms without flock.
+func lockReaders(f *os.File) error {
+	return nil
+}
+
+// excludeReaders is a no-op on platforms without flock, so a checkpoint may
+// change the db file under a reader there.
+func excludeReaders(f *os.File) (bool, error) {
+	return true, nil
+}
+
+// unlockFile is a no-op on platforms without flock.
+func unlockFile(f *os.File) error {
+	return nil
+}
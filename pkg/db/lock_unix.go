@@ -0,0 +1,58 @@
+//go:build unix
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an advisory lock on the db file, shared for readers and
+// exclusive for a writer. It fails straight away rather than waiting for
+// another process to let go. The lock is released when the file is closed.
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return fmt.Errorf("database is locked: %s is in use by another process", f.Name())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock file: %w", err)
+	}
+	return nil
+}
+
+// lockReaders takes a shared lock on the readers file, waiting for a
+// checkpoint in progress to finish. It is held until the file is closed.
+func lockReaders(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return fmt.Errorf("failed to lock file: %w", err)
+	}
+	return nil
+}
+
+// excludeReaders takes an exclusive lock on the readers file, reporting
+// false instead if a reader holds it.
+func excludeReaders(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to lock file: %w", err)
+	}
+	return true, nil
+}
+
+// unlockFile releases the lock on a file.
+func unlockFile(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		return fmt.Errorf("failed to unlock file: %w", err)
+	}
+	return nil
+}
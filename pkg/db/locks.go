@@ -0,0 +1,297 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Row locks.
+
+Begin gives a table a single transaction, which every statement runs in.
+BeginTxn instead starts a transaction of its own, and any number of them may
+be open on a table at once, each used by its own goroutine. A transaction
+locks the id of every row it inserts or deletes in the lock table of the
+table, and keeps the lock until it commits or rolls back: a transaction
+writing a row another one holds waits for it to finish, while transactions
+writing different rows go on side by side.
+
+The pager can only undo the pages of one transaction at a time, so the
+writes of a transaction are kept aside until it commits, and a commit applies
+them to the tree in one write, one commit after the other. A transaction
+reads its own writes, and the other rows as its isolation level has it, see
+isolation.go. As nothing is written before the commit, the unique index is
+only checked then.
+
+A transaction about to wait for one that waits for it, directly or through
+others, would wait forever, so it fails with a deadlock instead, which
+leaves it open to be rolled back. Other waits last as long as the lock is
+held, or up to the lock timeout if there is one: SetLockTimeout sets it for
+the transactions begun from then on, and set lock_timeout = 5s, run in a
+transaction, for that transaction. The table's own transaction locks no
+rows, so set lock_timeout fails outside one of BeginTxn.
+
+The table itself is still not safe for concurrent use: while transactions
+from BeginTxn are open, use it directly only within Exclusive, which keeps
+them off the tree.
+*/
+
+// rowLocks is the lock table of the transactions of a table, keyed by id.
+type rowLocks struct {
+	mu      sync.Mutex
+	held    map[uint32]*rowLock
+	waiting map[*Txn]*Txn // The transaction each waiting transaction waits for.
+	tree    sync.Mutex    // Held by a transaction while it reads or changes the tree.
+	commits commitLog     // Guarded by tree, see isolation.go.
+}
+
+// rowLock is the lock on a row, released is closed once its holder finished.
+type rowLock struct {
+	holder   *Txn
+	released chan struct{}
+}
+
+func newRowLocks() *rowLocks {
+	return &rowLocks{held: map[uint32]*rowLock{}, waiting: map[*Txn]*Txn{}, commits: commitLog{open: map[*Txn]bool{}}}
+}
+
+// lock locks the row with the id for txn, waiting for the transaction holding it to finish.
+func (l *rowLocks) lock(ctx context.Context, txn *Txn, id uint32) error {
+	var timeout <-chan time.Time
+	if txn.lockTimeout > 0 {
+		timer := time.NewTimer(txn.lockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		held, ok := l.held[id]
+		if !ok {
+			l.held[id] = &rowLock{holder: txn, released: make(chan struct{})}
+			txn.locked = append(txn.locked, id)
+			return nil
+		}
+		if held.holder == txn {
+			return nil
+		}
+		for other := held.holder; other != nil; other = l.waiting[other] {
+			if other == txn {
+				return dberr.Errorf(dberr.ErrDeadlock, "deadlock: row %d is locked by a transaction waiting for this one", id)
+			}
+		}
+		l.waiting[txn] = held.holder
+		l.mu.Unlock()
+		var err error
+		select {
+		case <-held.released:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-timeout:
+			err = dberr.Errorf(dberr.ErrLockTimeout, "lock timeout: row %d is still locked after %v", id, txn.lockTimeout)
+		}
+		l.mu.Lock()
+		delete(l.waiting, txn)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// release releases the locks of txn, waking the transactions waiting for them.
+func (l *rowLocks) release(txn *Txn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range txn.locked {
+		close(l.held[id].released)
+		delete(l.held, id)
+	}
+	txn.locked = nil
+}
+
+// Txn is a transaction started by BeginTxn. It is not safe for concurrent use,
+// but the transactions of a table are safe to use from different goroutines.
+type Txn struct {
+	table  *Table
+	writes []txnWrite            // In the order they were made, which the commit applies them in.
+	rows   map[uint32]*types.Row // What each row the transaction wrote holds after its last write, nil once deleted.
+	locked []uint32              // Ids of the rows the transaction locked.
+	done   bool
+
+	lockTimeout time.Duration // 0 to wait for a lock as long as it is held.
+	isolation   string        // read committed, snapshot or serializable, see isolation.go.
+	started     bool          // Whether it read or wrote a row, which fixes its isolation level.
+	begin       uint64        // The last commit before the transaction began, see commitLog.
+	read        []idRange     // The ids a serializable transaction read.
+}
+
+// txnWrite is a row a transaction inserted, or the id of a row it deleted.
+type txnWrite struct {
+	row     types.Row
+	deleted bool
+	box     *types.Box // Of the row in the spatial index, nil if it has none.
+}
+
+// BeginTxn starts a transaction that locks the rows it writes, see locks.go.
+func (t *Table) BeginTxn(ctx context.Context) (*Txn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if t.pager.readOnly {
+		return nil, errReadOnly
+	}
+	txn := &Txn{table: t, rows: map[uint32]*types.Row{}, lockTimeout: t.lockTimeout, isolation: t.isolation}
+	t.locks.tree.Lock()
+	defer t.locks.tree.Unlock()
+	t.locks.commits.begin(txn)
+	return txn, nil
+}
+
+// Exclusive runs fn while no transaction of BeginTxn reads or writes the
+// tree, so fn may use the table directly while transactions are open. A
+// transaction waiting for a row lock does not hold the tree.
+func (t *Table) Exclusive(fn func() error) error {
+	t.locks.tree.Lock()
+	defer t.locks.tree.Unlock()
+	return fn()
+}
+
+// SetLockTimeout sets how long the transactions begun from now on wait for a
+// row lock before failing with dberr.ErrLockTimeout, 0 to wait as long as it is held.
+func (t *Table) SetLockTimeout(timeout time.Duration) {
+	t.lockTimeout = timeout
+}
+
+// SetLockTimeout sets how long the transaction waits for a row lock, overriding the table's.
+func (txn *Txn) SetLockTimeout(timeout time.Duration) {
+	txn.lockTimeout = timeout
+}
+
+// write locks the row of w and records w, after check accepted whether the row exists.
+func (txn *Txn) write(ctx context.Context, w txnWrite, check func(exists bool) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if txn.done {
+		return errTxnDone
+	}
+	if err := txn.table.locks.lock(ctx, txn, w.row.Id); err != nil {
+		return err
+	}
+	row, err := txn.get(w.row.Id)
+	if err != nil {
+		return err
+	}
+	if err := check(row != nil); err != nil {
+		return err
+	}
+	txn.writes = append(txn.writes, w)
+	txn.rows[w.row.Id] = nil
+	if !w.deleted {
+		txn.rows[w.row.Id] = &w.row
+	}
+	return nil
+}
+
+// errTxnDone is returned by the methods of a transaction that committed or rolled back.
+var errTxnDone = fmt.Errorf("the transaction has already been committed or rolled back")
+
+// Insert adds a row, failing if a row with the same id exists.
+func (txn *Txn) Insert(ctx context.Context, row types.Row) error {
+	return txn.write(ctx, txnWrite{row: row}, func(exists bool) error {
+		if exists {
+			return dberr.ErrDuplicateKey
+		}
+		return nil
+	})
+}
+
+// Delete removes the row with the given id.
+func (txn *Txn) Delete(ctx context.Context, id uint32) error {
+	return txn.write(ctx, txnWrite{row: types.Row{Id: id}, deleted: true}, func(exists bool) error {
+		if !exists {
+			return dberr.Errorf(dberr.ErrKeyNotFound, "key %d does not exist", id)
+		}
+		return nil
+	})
+}
+
+// Commit applies the writes of the transaction and releases its locks. If
+// applying them fails, or they conflict with the commits of other transactions
+// under its isolation level, none of them are and the transaction is rolled back.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return errTxnDone
+	}
+	t := txn.table
+	t.locks.tree.Lock()
+	if t.pager.inTxn {
+		t.locks.tree.Unlock()
+		return fmt.Errorf("cannot commit - the table's own transaction is active")
+	}
+	err := txn.apply()
+	t.locks.tree.Unlock()
+	txn.finish()
+	return err
+}
+
+// apply checks the transaction for conflicts and writes its rows to the tree.
+func (txn *Txn) apply() error {
+	t := txn.table
+	commits := &t.locks.commits
+	if err := commits.check(txn); err != nil {
+		return err
+	}
+	before, err := commits.before(txn)
+	if err != nil {
+		return err
+	}
+	err = t.write(func() error {
+		for _, w := range txn.writes {
+			if w.deleted {
+				if err := deleteRow(t.treeOf(w.row.Id), w.row.Id); err != nil {
+					return err
+				}
+				continue
+			}
+			row := w.row
+			if err := insertRow(t.treeOf(row.Id), &row); err != nil {
+				return err
+			}
+			if w.box != nil {
+				if err := setBox(t.pager, row.Id, *w.box); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		commits.commit(before)
+	}
+	return err
+}
+
+// Rollback drops the writes of the transaction and releases its locks.
+func (txn *Txn) Rollback() error {
+	if txn.done {
+		return errTxnDone
+	}
+	txn.finish()
+	return nil
+}
+
+func (txn *Txn) finish() {
+	t := txn.table
+	t.locks.tree.Lock()
+	t.locks.commits.end(txn)
+	t.locks.tree.Unlock()
+	txn.done = true
+	txn.writes, txn.rows, txn.read = nil, nil, nil
+	txn.table.locks.release(txn)
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestRowLocks(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	ctx := context.Background()
+	table.Insert(ctx, parseRow("insert 1 u e"))
+	// waitFor waits until txn waits for a lock.
+	waitFor := func(txn *Txn) {
+		for {
+			table.locks.mu.Lock()
+			_, waiting := table.locks.waiting[txn]
+			table.locks.mu.Unlock()
+			if waiting {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Transactions writing different rows go on side by side.
+	txn1, _ := table.BeginTxn(ctx)
+	txn2, _ := table.BeginTxn(ctx)
+	var wg sync.WaitGroup
+	for i, txn := range []*Txn{txn1, txn2} {
+		i, txn := i, txn
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				id := 10 + 10*i + j
+				if err := txn.Insert(ctx, parseRow(fmt.Sprintf("insert %d u e", id))); err != nil {
+					t.Errorf("Inserting %d failed: %v", id, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := txn2.Delete(ctx, 1); err != nil {
+		t.Fatalf("Deleting 1 failed: %v", err)
+	}
+	if keys := checkTable(t, table); len(keys) != 1 {
+		t.Fatalf("Expected nothing written before the commits. Got: %v", keys)
+	}
+	if err := txn1.Commit(); err != nil {
+		t.Fatalf("Committing failed: %v", err)
+	}
+	if err := txn2.Commit(); err != nil {
+		t.Fatalf("Committing failed: %v", err)
+	}
+	if keys := checkTable(t, table); len(keys) != 20 || keys[0] != 10 {
+		t.Fatalf("Expected the rows of both transactions. Got: %v", keys)
+	}
+	if err := txn1.Rollback(); err != errTxnDone {
+		t.Fatalf("Expected a committed transaction to be done. Got: %v", err)
+	}
+
+	// A write of a locked row waits for the transaction holding it.
+	txn1, _ = table.BeginTxn(ctx)
+	txn2, _ = table.BeginTxn(ctx)
+	txn1.Insert(ctx, parseRow("insert 5 u e"))
+	done := make(chan error)
+	go func() { done <- txn2.Insert(ctx, parseRow("insert 5 u e")) }()
+	waitFor(txn2)
+	txn1.Commit()
+	if err := <-done; !errors.Is(err, dberr.ErrDuplicateKey) {
+		t.Fatalf("Expected the row committed by the other transaction to be taken. Got: %v", err)
+	}
+	// The failed insert still holds the lock on 5.
+	txn3, _ := table.BeginTxn(ctx)
+	go func() { done <- txn3.Delete(ctx, 5) }()
+	waitFor(txn3)
+	txn2.Rollback()
+	if err := <-done; err != nil {
+		t.Fatalf("Expected the lock to be free after the rollback. Got: %v", err)
+	}
+	txn3.Rollback()
+
+	// Transactions waiting for each other deadlock, and a cancelled wait gives up.
+	txn1, _ = table.BeginTxn(ctx)
+	txn2, _ = table.BeginTxn(ctx)
+	txn1.Delete(ctx, 10)
+	txn2.Delete(ctx, 11)
+	go func() { done <- txn2.Delete(ctx, 10) }()
+	waitFor(txn2)
+	if err := txn1.Delete(ctx, 11); !errors.Is(err, dberr.ErrDeadlock) {
+		t.Fatalf("Expected a deadlock. Got: %v", err)
+	}
+	txn1.Rollback()
+	if err := <-done; err != nil {
+		t.Fatalf("Expected the delete to go on once the deadlock was rolled back. Got: %v", err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	txn3, _ = table.BeginTxn(ctx)
+	go func() { done <- txn3.Delete(cancelled, 11) }()
+	waitFor(txn3)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Expected the wait to be cancelled. Got: %v", err)
+	}
+	if err := txn2.Commit(); err != nil {
+		t.Fatalf("Committing failed: %v", err)
+	}
+	if keys := checkTable(t, table); len(keys) != 19 || keys[0] != 5 || keys[1] != 12 {
+		t.Fatalf("Expected rows 10 and 11 deleted. Got: %v", keys)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	ctx := context.Background()
+	table.Insert(ctx, parseRow("insert 1 u e"))
+	// Begin locks no rows, so the setting has no effect on the table.
+	stmt, _ := parser.Parse("set lock_timeout = 20ms")
+	if _, err := table.Execute(ctx, stmt, nil); err == nil {
+		t.Fatalf("Expected set lock_timeout to fail outside a transaction of BeginTxn")
+	}
+	table.SetLockTimeout(20 * time.Millisecond)
+
+	txn1, _ := table.BeginTxn(ctx)
+	txn2, _ := table.BeginTxn(ctx)
+	txn1.Delete(ctx, 1)
+	start := time.Now()
+	err := txn2.Delete(ctx, 1)
+	if !errors.Is(err, dberr.ErrLockTimeout) || err.Error() != "lock timeout: row 1 is still locked after 20ms" {
+		t.Fatalf("Expected the wait to time out. Got: %v", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Fatalf("Expected to wait for the timeout. Waited: %v", waited)
+	}
+
+	// The transaction's own timeout overrides the table's.
+	stmt, _ = parser.Parse("set lock_timeout = 0")
+	if _, err := txn2.Execute(ctx, stmt, nil); err != nil {
+		t.Fatalf("Setting the lock timeout of the transaction failed: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- txn2.Delete(ctx, 1) }()
+	time.Sleep(40 * time.Millisecond)
+	txn1.Rollback()
+	if err := <-done; err != nil {
+		t.Fatalf("Expected to wait until the lock was released. Got: %v", err)
+	}
+	txn2.Commit()
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// MemoryDbName opens a database that lives only in memory and is gone once closed.
+const MemoryDbName = ":memory:"
+
+// memFile is a pagerFile kept in memory, it backs both files of an in-memory database.
+type memFile struct {
+	name string
+	data []byte
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	if end := off + int64(len(b)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], b), nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return memFileInfo{f}, nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if size < int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.data = nil
+	return nil
+}
+
+type memFileInfo struct {
+	f *memFile
+}
+
+func (fi memFileInfo) Name() string       { return fi.f.name }
+func (fi memFileInfo) Size() int64        { return int64(len(fi.f.data)) }
+func (fi memFileInfo) Mode() fs.FileMode  { return 0666 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() any           { return nil }
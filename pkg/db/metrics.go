@@ -0,0 +1,132 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+)
+
+// flushLatencyBuckets are the upper bounds, in seconds, of the flush latency histogram.
+var flushLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// histogram counts observed durations in cumulative buckets, like a Prometheus histogram.
+type histogram struct {
+	buckets []uint64 // Observations at or below each of flushLatencyBuckets.
+	count   uint64
+	sum     float64 // In seconds.
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(flushLatencyBuckets))
+	}
+	seconds := d.Seconds()
+	for i, bound := range flushLatencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// Metric is a counter, gauge or histogram of a table, see Table.Metrics.
+type Metric struct {
+	Name string // Prefixed with the name of the database, like simpledb_statements_total.
+	Help string
+	Kind string // counter, gauge or histogram.
+	// The value of a counter or a gauge.
+	Value float64
+	// The observations of a histogram at or below each bound, their count and their sum.
+	Buckets map[float64]uint64
+	Count   uint64
+	Sum     float64
+}
+
+/*
+Metrics returns the counters of the table, which an embedding program can
+hand to Prometheus with a collector, see the dbprom module, or write with
+WriteMetrics. Like every other method it must not run concurrently with
+statements, a server reads them within Exclusive.
+*/
+func (t *Table) Metrics() []Metric {
+	pager := t.pager
+	prefix := strings.ToLower(constants.DbName) + "_"
+	metrics := []Metric{}
+	counter := func(name, help string, value uint64) {
+		metrics = append(metrics, Metric{Name: prefix + name, Help: help, Kind: "counter", Value: float64(value)})
+	}
+	counter("statements_total", "Statements executed.", t.statements)
+	rowsScanned := t.rowsScanned
+	for _, p := range t.partitions {
+		if p.tree != t {
+			rowsScanned += p.tree.rowsScanned
+		}
+	}
+	counter("rows_scanned_total", "Rows read from leaves by scans.", rowsScanned)
+	counter("pages_read_total", "Pages read from the db file or the WAL.", pager.pagesRead)
+	counter("pages_written_total", "Pages written to the db file or the WAL.", pager.pagesWritten)
+	counter("cache_hits_total", "Page lookups served from the cache.", pager.cacheHits)
+	counter("cache_misses_total", "Page lookups that had to read the page.", pager.cacheMisses)
+	counter("splits_total", "B-tree nodes split.", pager.splits)
+	counter("bloom_skips_total", "Lookups of absent ids the bloom filter answered.", pager.bloomSkips)
+
+	ratio := 0.0
+	if lookups := pager.cacheHits + pager.cacheMisses; lookups > 0 {
+		ratio = float64(pager.cacheHits) / float64(lookups)
+	}
+	metrics = append(metrics, Metric{Name: prefix + "cache_hit_ratio", Help: "Fraction of page lookups served from the cache.", Kind: "gauge", Value: ratio})
+
+	h := &pager.flushLatency
+	flush := Metric{
+		Name:    prefix + "flush_duration_seconds",
+		Help:    "Time to write and sync a commit to the WAL, or to checkpoint it.",
+		Kind:    "histogram",
+		Buckets: map[float64]uint64{},
+		Count:   h.count,
+		Sum:     h.sum,
+	}
+	for i, bound := range flushLatencyBuckets {
+		flush.Buckets[bound] = 0
+		if h.buckets != nil {
+			flush.Buckets[bound] = h.buckets[i]
+		}
+	}
+	return append(metrics, flush)
+}
+
+// WriteMetrics writes the metrics of the table in the Prometheus text
+// exposition format, so an embedding program can serve them on its /metrics
+// endpoint.
+func (t *Table) WriteMetrics(w io.Writer) error {
+	var sb strings.Builder
+	for _, m := range t.Metrics() {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Kind)
+		switch m.Kind {
+		case "counter":
+			fmt.Fprintf(&sb, "%s %d\n", m.Name, uint64(m.Value))
+			continue
+		case "gauge":
+			fmt.Fprintf(&sb, "%s %s\n", m.Name, formatFloat(m.Value))
+			continue
+		}
+		for _, bound := range slices.Sorted(maps.Keys(m.Buckets)) {
+			fmt.Fprintf(&sb, "%s_bucket{le=\"%s\"} %d\n", m.Name, formatFloat(bound), m.Buckets[bound])
+		}
+		fmt.Fprintf(&sb, "%s_bucket{le=\"+Inf\"} %d\n", m.Name, m.Count)
+		fmt.Fprintf(&sb, "%s_sum %s\n", m.Name, formatFloat(m.Sum))
+		fmt.Fprintf(&sb, "%s_count %d\n", m.Name, m.Count)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
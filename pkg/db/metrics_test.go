@@ -0,0 +1,36 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	for _, query := range []string{"insert 1 a a", "insert 2 b b", "select", "select where id = 2"} {
+		stmt, _ := parser.Parse(query)
+		if _, err := table.Execute(context.Background(), stmt, func(values []any) error { return nil }); err != nil {
+			t.Fatalf("%s failed: %v", query, err)
+		}
+	}
+	var out strings.Builder
+	if err := table.WriteMetrics(&out); err != nil {
+		t.Fatalf("WriteMetrics failed: %v", err)
+	}
+	for _, expected := range []string{
+		"# TYPE simpledb_statements_total counter\nsimpledb_statements_total 4\n",
+		"simpledb_rows_scanned_total 3\n",
+		"# TYPE simpledb_flush_duration_seconds histogram\n",
+		// Opening commits the empty root, then each insert commits.
+		"simpledb_flush_duration_seconds_bucket{le=\"+Inf\"} 3\n",
+		"simpledb_flush_duration_seconds_count 3\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Expected %q in the metrics. Got:\n%s", expected, out.String())
+		}
+	}
+}
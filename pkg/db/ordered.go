@@ -0,0 +1,301 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Ordered index.
+
+create index on username keeps the values of a text column in byte order, so
+where username like 'user1%' reads the ids of the rows whose values start with
+user1 from a range of the index instead of testing every row. The keys of a
+B-tree are integers, so the index is a B-tree with an entry per row, the value
+and the id packed by packRow, under keys that ascend with the entries: a seek
+finds the first entry not before a value by a binary search over the keys,
+reading the entry each key leads to.
+
+An entry is inserted under a key halfway between those of its neighbours, or
+orderedStep after the last one. Once two neighbours have no key left between
+them the entries are numbered again, spread over the lower half of the keys so
+that entries appended in order find room above them. The file header lists
+the root of the tree and the column.
+
+Its pages go through the pager like those of the table, so the index commits
+and rolls back with the rows it belongs to. A table has at most one ordered
+index, on username or email.
+*/
+
+// orderedStep is how far above the last entry of the ordered index a new last one goes.
+const orderedStep = 1 << 16
+
+// orderedEntry is an entry of the ordered index.
+type orderedEntry struct {
+	key   uint32
+	value string
+	id    uint32
+}
+
+// OrderedIndex returns the column of the ordered index, and false if there is none.
+func (t *Table) OrderedIndex() (string, bool) {
+	if t.pager.header.OrderedRootPageNum == 0 {
+		return "", false
+	}
+	return columnNames[t.pager.header.OrderedColumn], true
+}
+
+// createOrderedIndex creates the ordered index on a text column, see CreateIndex.
+func (t *Table) createOrderedIndex(ctx context.Context, column string) error {
+	pager := t.pager
+	if _, ok := t.OrderedIndex(); ok {
+		return fmt.Errorf("there is already an ordered index")
+	}
+	err := t.write(func() error {
+		pageNum, err := getUnusedPageNum(pager)
+		if err != nil {
+			return err
+		}
+		root, err := getPage(pager, pageNum)
+		if err != nil {
+			return err
+		}
+		initializeLeafNode(root)
+		setNodeRoot(root, true)
+		markPageDirty(pager, pageNum)
+		// The header is written by the commit, along with the tree.
+		pager.header.OrderedRootPageNum = pageNum
+		pager.header.OrderedColumn = uint32(slices.Index(columnNames, column))
+		entries := []orderedEntry{}
+		err = t.Scan(ctx, func(row types.Row) error {
+			entries = append(entries, orderedEntry{value: orderedValue(pager, row), id: row.Id})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return orderedWrite(orderedTree(pager), entries)
+	})
+	if err != nil {
+		pager.header.OrderedRootPageNum, pager.header.OrderedColumn = 0, 0
+	}
+	return err
+}
+
+// orderedTree returns the tree of the ordered index.
+func orderedTree(pager *Pager) *Table {
+	return &Table{
+		pager:       pager,
+		rootPageNum: pager.header.OrderedRootPageNum,
+		logger:      pager.logger,
+		now:         time.Now,
+		auxiliary:   true,
+	}
+}
+
+// orderedValue returns the value of a row in the column of the ordered index.
+func orderedValue(pager *Pager, row types.Row) string {
+	return rowValues(row)[pager.header.OrderedColumn].(string)
+}
+
+// compare orders the entry against the value and id, the way the index does.
+func (e orderedEntry) compare(value string, id uint32) int {
+	if c := strings.Compare(e.value, value); c != 0 {
+		return c
+	}
+	return int(e.id) - int(id)
+}
+
+// orderedRead returns the entry under the cursor.
+func orderedRead(cursor *Cursor) (orderedEntry, error) {
+	raw, err := cursor.value()
+	if err != nil {
+		return orderedEntry{}, err
+	}
+	row := deserializeRow(raw)
+	values := unpackRow(row)
+	if len(values) != 2 {
+		return orderedEntry{}, fmt.Errorf("ordered index entry %d holds %d values, expected 2", row.Id, len(values))
+	}
+	return orderedEntry{key: row.Id, value: values[0].(string), id: uint32(values[1].(int64))}, nil
+}
+
+// orderedSeek returns a cursor at the first entry not before the value and id,
+// and the key of the entry before it, if there is one.
+func orderedSeek(tree *Table, value string, id uint32) (*Cursor, uint32, bool, error) {
+	// The smallest key from which on the entries are not before the value,
+	// math.MaxUint32+1 if every entry is.
+	low, high := uint64(0), uint64(math.MaxUint32)+1
+	for low < high {
+		mid := low + (high-low)/2
+		cursor, err := tableSeek(tree, uint32(mid))
+		if err != nil {
+			return nil, 0, false, err
+		}
+		before := false
+		if !cursor.endOfTable {
+			entry, err := orderedRead(cursor)
+			if err != nil {
+				return nil, 0, false, err
+			}
+			before = entry.compare(value, id) < 0
+		}
+		if before {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	var cursor *Cursor
+	var err error
+	if low > math.MaxUint32 {
+		// Past the entry at the largest key, if there is one.
+		if cursor, err = tableSeek(tree, math.MaxUint32); err == nil && !cursor.endOfTable {
+			err = cursor.advance()
+		}
+	} else {
+		cursor, err = tableSeek(tree, uint32(low))
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	// The entry at the key before low is before the value, and the last one that is.
+	return cursor, uint32(low - 1), low > 0, nil
+}
+
+// orderedInsert adds the entry of a row being inserted to the ordered index.
+func orderedInsert(pager *Pager, row types.Row) error {
+	if pager.header.OrderedRootPageNum == 0 {
+		return nil
+	}
+	tree := orderedTree(pager)
+	value := orderedValue(pager, row)
+	cursor, before, found, err := orderedSeek(tree, value, row.Id)
+	if err != nil {
+		return err
+	}
+	free, next := uint64(0), uint64(math.MaxUint32)+1
+	if found {
+		free = uint64(before) + 1
+	}
+	if !cursor.endOfTable {
+		entry, err := orderedRead(cursor)
+		if err != nil {
+			return err
+		}
+		next = uint64(entry.key)
+	}
+	if free == next {
+		if err := orderedRenumber(tree); err != nil {
+			return err
+		}
+		return orderedInsert(pager, row)
+	}
+	key := free + (next-free)/2
+	if next > math.MaxUint32 {
+		key = free + min(orderedStep, (next-free)/2)
+	}
+	packed, err := packRow(uint32(key), []any{value, int64(row.Id)})
+	if err != nil {
+		return err
+	}
+	return insertRow(tree, &packed)
+}
+
+// orderedDelete removes the entry of a row being deleted from the ordered index.
+func orderedDelete(pager *Pager, row types.Row) error {
+	if pager.header.OrderedRootPageNum == 0 {
+		return nil
+	}
+	tree := orderedTree(pager)
+	cursor, _, _, err := orderedSeek(tree, orderedValue(pager, row), row.Id)
+	if err != nil {
+		return err
+	}
+	// A row that had expired when the index was created has no entry.
+	if cursor.endOfTable {
+		return nil
+	}
+	entry, err := orderedRead(cursor)
+	if err != nil || entry.compare(orderedValue(pager, row), row.Id) != 0 {
+		return err
+	}
+	return deleteRow(tree, entry.key)
+}
+
+// orderedRenumber spreads the keys of the entries evenly over the lower half of the keys.
+func orderedRenumber(tree *Table) error {
+	entries := []orderedEntry{}
+	cursor, err := tableStart(tree)
+	for err == nil && !cursor.endOfTable {
+		var entry orderedEntry
+		if entry, err = orderedRead(cursor); err == nil {
+			entries = append(entries, entry)
+			err = cursor.advance()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := deleteRow(tree, entry.key); err != nil {
+			return err
+		}
+	}
+	return orderedWrite(tree, entries)
+}
+
+// orderedWrite inserts the entries into an empty index, sorted and spread over the lower half of the keys.
+func orderedWrite(tree *Table, entries []orderedEntry) error {
+	slices.SortFunc(entries, func(a, b orderedEntry) int { return a.compare(b.value, b.id) })
+	spacing := uint64(math.MaxUint32/2) / uint64(len(entries)+1)
+	for i, entry := range entries {
+		packed, err := packRow(uint32(uint64(i+1)*spacing), []any{entry.value, int64(entry.id)})
+		if err != nil {
+			return err
+		}
+		if err := insertRow(tree, &packed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderedPrefix returns the ids of the rows whose value in the column of the ordered
+// index starts with prefix, in ascending order, reading the range of entries that do.
+func orderedPrefix(pager *Pager, prefix string) ([]uint32, error) {
+	cursor, _, _, err := orderedSeek(orderedTree(pager), prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint32{}
+	for !cursor.endOfTable {
+		entry, err := orderedRead(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(entry.value, prefix) {
+			break
+		}
+		ids = append(ids, entry.id)
+		if err := cursor.advance(); err != nil {
+			return nil, err
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// likePrefix returns the literal text a like pattern starts with, before its first wildcard.
+func likePrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "%_"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestOrderedIndex(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	execute := func(text string) error {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		_, err = table.Execute(ctx, stmt, func(values []any) error { return nil })
+		return err
+	}
+	names := map[uint32]string{}
+	random := rand.New(rand.NewSource(1))
+	for _, id := range random.Perm(100) {
+		names[uint32(id+1)] = fmt.Sprintf("u%d", random.Intn(1000))
+		execute(fmt.Sprintf("insert %d %s u%d@example.com", id+1, names[uint32(id+1)], id+1))
+	}
+	if err := execute("create index on username"); err != nil {
+		t.Fatalf("Creating the ordered index failed: %v", err)
+	}
+	if err := execute("create index on email"); err == nil || err.Error() != "there is already an ordered index" {
+		t.Fatalf("Expected a second ordered index to fail. Got: %v", err)
+	}
+	// Inserts in random order and deletes keep the entries in order.
+	for _, id := range random.Perm(200) {
+		if id < 100 {
+			execute(fmt.Sprintf("delete %d", id+1))
+			delete(names, uint32(id+1))
+			continue
+		}
+		names[uint32(id+1)] = fmt.Sprintf("u%d", random.Intn(1000))
+		execute(fmt.Sprintf("insert %d %s u%d@example.com", id+1, names[uint32(id+1)], id+1))
+	}
+	// Inserted in order, the entries are appended.
+	for id := uint32(1000); id < 1040; id++ {
+		names[id] = "zz"
+		execute(fmt.Sprintf("insert %d zz z@example.com", id))
+	}
+	// Every entry goes right before the last one inserted, halving the keys
+	// left between it and the one before until they are numbered again.
+	for id := uint32(1100); id > 1060; id-- {
+		names[id] = "m"
+		execute(fmt.Sprintf("insert %d m m@example.com", id))
+	}
+	check := func() {
+		t.Helper()
+		for _, prefix := range []string{"u1", "u99", "u", "zz", "m", "v", ""} {
+			expected := []uint32{}
+			for id, name := range names {
+				if strings.HasPrefix(name, prefix) {
+					expected = append(expected, id)
+				}
+			}
+			slices.Sort(expected)
+			if ids, err := orderedPrefix(table.pager, prefix); err != nil || !slices.Equal(ids, expected) {
+				t.Fatalf("%q: expected %d ids. Got: %d, %v", prefix, len(expected), len(ids), err)
+			}
+		}
+		if problems := integrityCheck(table); len(problems) > 0 {
+			t.Fatalf("Expected a sound file. Got: %v", problems)
+		}
+	}
+	check()
+
+	// The index rolls back with the rows.
+	table.Begin()
+	execute("insert 2000 u1x u@example.com")
+	table.Rollback()
+	check()
+
+	table.Close()
+	var err error
+	if table, err = Open(dbName); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer table.Close()
+	if column, ok := table.OrderedIndex(); !ok || column != "username" {
+		t.Fatalf("Expected the ordered index on username after reopening. Got: %q, %v", column, ok)
+	}
+	check()
+}
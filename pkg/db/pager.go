@@ -0,0 +1,619 @@
+package db
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// pagerFile is the storage behind the db file and the WAL. It is satisfied by
+// *os.File, tests substitute implementations that inject faults.
+type pagerFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+type Pager struct {
+	file             pagerFile
+	wal              pagerFile
+	walLength        uint32
+	walIndex         map[uint32]int64               // Offset of the latest committed frame of each page in the WAL.
+	walStarted       time.Time                      // When the first frame was appended to an empty WAL.
+	readers          *os.File                       // Locked by readers while they are open, see wal.go. Nil in memory.
+	readersExcluded  bool                           // Whether the writer holds the readers file exclusively.
+	archive          func(segment WalSegment) error // Nil unless the WAL is archived, see archive.go.
+	checkpointFrames uint32
+	checkpointAge    time.Duration
+	header           types.FileHeader
+	fileLength       uint32
+	numPages         uint32
+	readOnly         bool
+	inMemory         bool
+	inTxn            bool
+	txnNumPages      uint32 // numPages when the transaction began.
+	savepoints       []savepoint
+	changes          changeLog   // Rows written by the open transaction, see Table.Changes.
+	cipher           cipher.AEAD // Encrypts the pages on disk, nil if the file is not encrypted.
+	maxCachedPages   uint32
+	pages            map[uint32]*list.Element // Values are *cachedPage.
+	lru              *list.List               // Most recently used page at the front.
+	pins             map[uint32]int           // Pages held by open cursors, which are never evicted.
+	prefetches       map[uint32]*prefetch     // Reads ahead of a scan, see prefetchNextLeaf.
+	cacheHits        uint64
+	cacheMisses      uint64
+	pagesRead        uint64            // From the db file or the WAL.
+	pagesWritten     uint64            // To the db file or the WAL.
+	splits           uint64            // Leaf and internal nodes split by the B-tree.
+	bloomSkips       uint64            // Lookups of absent keys the bloom filter answered.
+	rowsWritten      uint64            // Rows inserted or deleted, to tell whether a commit changed any.
+	txnRowCounts     rowCounts         // The header's row counts when the transaction began.
+	pageWrites       uint64            // Changes to pages, which may move rows, so cursors know to find theirs again.
+	generated        []generatedColumn // Compiled from the file header, see generated.go.
+	flushLatency     histogram
+	logger           *slog.Logger
+}
+
+// cachedPage is a page held in the pager's cache.
+type cachedPage struct {
+	pageNum uint32
+	data    *types.Page
+	dirty   bool // Modified since it was loaded or last flushed.
+}
+
+func getPage(pager *Pager, pageNum uint32) ([]byte, error) {
+	if pageNum >= constants.TableMaxPages {
+		return nil, fmt.Errorf("tried to fetch page number out of bounds. %d > %d", pageNum, constants.TableMaxPages)
+	}
+
+	if elem, ok := pager.pages[pageNum]; ok {
+		pager.cacheHits++
+		pager.lru.MoveToFront(elem)
+		return elem.Value.(*cachedPage).data[:], nil
+	}
+
+	// Cache miss. Allocate memory and load from file.
+	pager.cacheMisses++
+	page := types.Page{}
+	numPages := (pager.fileLength - constants.FileHeaderSize) / constants.PageSize
+
+	if (pager.fileLength-constants.FileHeaderSize)%constants.PageSize != 0 {
+		numPages++
+	}
+
+	if offset, ok := pager.walIndex[pageNum]; ok {
+		// Committed but not checkpointed yet, the WAL holds the latest version.
+		if _, err := pager.wal.ReadAt(page[:], offset+int64(constants.WalFrameHeaderSize)); err != nil {
+			return nil, fmt.Errorf("error reading wal file: %w", err)
+		}
+		if !pageChecksumValid(page[:]) {
+			return nil, dberr.Errorf(dberr.ErrCorrupt, "page %d is corrupt: checksum mismatch", pageNum)
+		}
+		if err := pagerUnseal(pager, pageNum, page[:]); err != nil {
+			return nil, err
+		}
+		pager.pagesRead++
+	} else if pageNum < numPages {
+		var n int
+		var err error
+		if p, ok := takePrefetch(pager, pageNum); ok {
+			page, n, err = p.page, p.n, p.err
+		} else {
+			n, err = pager.file.ReadAt(page[:], pageOffset(pageNum))
+		}
+		if errors.Is(err, io.EOF) && n < len(page) {
+			// The file ended inside the page, it was cut short after it was opened.
+			return nil, fmt.Errorf("page %d is truncated: read %d of %d bytes", pageNum, n, len(page))
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("error reading page %d: %w", pageNum, err)
+		}
+		if !pageChecksumValid(page[:]) {
+			return nil, dberr.Errorf(dberr.ErrCorrupt, "page %d is corrupt: checksum mismatch", pageNum)
+		}
+		if err := pagerUnseal(pager, pageNum, page[:]); err != nil {
+			return nil, err
+		}
+		pager.pagesRead++
+	}
+
+	pager.pages[pageNum] = pager.lru.PushFront(&cachedPage{pageNum: pageNum, data: &page})
+
+	if pageNum >= pager.numPages {
+		pager.numPages = pageNum + 1
+	}
+	return page[:], nil
+}
+
+// markPageDirty records that a cached page was modified and must be written
+// back before it is evicted.
+func markPageDirty(pager *Pager, pageNum uint32) {
+	pager.pageWrites++
+	if elem, ok := pager.pages[pageNum]; ok {
+		elem.Value.(*cachedPage).dirty = true
+	}
+}
+
+// pinPage keeps a page cached until it is unpinned as often as it was pinned.
+func pinPage(pager *Pager, pageNum uint32) {
+	pager.pins[pageNum]++
+}
+
+func unpinPage(pager *Pager, pageNum uint32) {
+	if pager.pins[pageNum]--; pager.pins[pageNum] <= 0 {
+		delete(pager.pins, pageNum)
+	}
+}
+
+/*
+pagerEvict shrinks the cache to maxCachedPages by dropping the least recently
+used clean pages. Dirty pages hold uncommitted changes which must not reach
+the db file before commit, so they stay cached until then. Pinned pages stay
+cached until their cursors move on.
+
+Node functions hold on to the slices returned by getPage while they work, so
+eviction must only run between statements, never in the middle of one.
+*/
+func pagerEvict(pager *Pager) {
+	elem := pager.lru.Back()
+	for elem != nil && uint32(pager.lru.Len()) > pager.maxCachedPages {
+		prev := elem.Prev()
+		if cp := elem.Value.(*cachedPage); !cp.dirty && pager.pins[cp.pageNum] == 0 {
+			pager.lru.Remove(elem)
+			delete(pager.pages, cp.pageNum)
+		}
+		elem = prev
+	}
+}
+
+func pagerOpen(filename string) (*Pager, error) {
+	if filename == MemoryDbName {
+		pager, err := newPager(&memFile{name: filename}, &memFile{name: filename + constants.WalFileSuffix})
+		if err != nil {
+			return nil, err
+		}
+		pager.inMemory = true
+		return pager, nil
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if err := lockFile(f, true); err != nil {
+		f.Close()
+		return nil, err
+	}
+	wal, err := os.OpenFile(filename+constants.WalFileSuffix, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open wal file: %w", err)
+	}
+	readers, err := openReadersFile(filename + constants.ReadersFileSuffix)
+	if err != nil {
+		f.Close()
+		wal.Close()
+		return nil, err
+	}
+	pager, err := newPager(f, wal)
+	if err == nil {
+		pager.readers = readers
+		// The commits of the last writer are checkpointed now, unless readers still read them.
+		if err = pagerCheckpoint(pager); errors.Is(err, errReadersOpen) {
+			err = nil
+		}
+	}
+	if err != nil {
+		f.Close()
+		wal.Close()
+		readers.Close()
+		return nil, err
+	}
+	return pager, nil
+}
+
+/*
+pagerOpenReadOnly opens an existing db file without ever writing to it. Any
+number of readers may have it open, alongside a writer, see wal.go. The pager
+reads the db file alone until it is refreshed.
+*/
+func pagerOpenReadOnly(filename string) (*Pager, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	// Locked before the db file is read, so no checkpoint changes it from under the reader.
+	var readers *os.File
+	for {
+		if readers, err = openReadersFile(filename + constants.ReadersFileSuffix); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := lockReaders(readers); err != nil {
+			f.Close()
+			readers.Close()
+			return nil, err
+		}
+		if readersCurrent(readers) {
+			break
+		}
+		// Removed by whoever closed the database while we waited, lock the new one.
+		readers.Close()
+	}
+	pager, err := newPager(f, nil)
+	if err != nil {
+		f.Close()
+		readers.Close()
+		return nil, err
+	}
+	pager.readers = readers
+	return pager, nil
+}
+
+func openReadersFile(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open readers file: %w", err)
+	}
+	return f, nil
+}
+
+// readersCurrent reports whether the readers file is still the one at its name.
+func readersCurrent(f *os.File) bool {
+	opened, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(f.Name())
+	return err == nil && os.SameFile(opened, current)
+}
+
+/*
+pagerCloseFiles closes the files of the pager, removing the WAL if every
+commit in it was checkpointed. The readers file is removed too if no other
+reader has it locked, before the db file is closed so no writer opens meanwhile.
+*/
+func pagerCloseFiles(pager *Pager, removeWal bool) error {
+	if pager.readers != nil {
+		excluded := pager.readersExcluded
+		if !excluded {
+			// A reader lets go of its shared lock trying, which it is about to do anyway.
+			excluded, _ = excludeReaders(pager.readers)
+		}
+		if excluded && readersCurrent(pager.readers) {
+			if err := os.Remove(pager.readers.Name()); err != nil {
+				return fmt.Errorf("error removing readers file: %s", err.Error())
+			}
+		}
+	}
+	if err := pager.file.Close(); err != nil {
+		return fmt.Errorf("error closing db file: %s", err.Error())
+	}
+	if pager.wal != nil {
+		if err := pager.wal.Close(); err != nil {
+			return fmt.Errorf("error closing wal file: %s", err.Error())
+		}
+		if removeWal {
+			if err := os.Remove(pager.wal.Name()); err != nil {
+				return fmt.Errorf("error removing wal file: %s", err.Error())
+			}
+		}
+	}
+	// Closing the readers file releases its lock, after the WAL is gone.
+	if pager.readers != nil {
+		if err := pager.readers.Close(); err != nil {
+			return fmt.Errorf("error closing readers file: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// newPager reads the file header and, for a writer, picks up the commits left
+// in the WAL. A read-only pager opens the WAL later, see pagerRefresh.
+func newPager(f pagerFile, wal pagerFile) (*Pager, error) {
+	pager := Pager{
+		file:             f,
+		wal:              wal,
+		readOnly:         wal == nil,
+		walIndex:         map[uint32]int64{},
+		checkpointFrames: constants.DefaultCheckpointFrames,
+		checkpointAge:    constants.DefaultCheckpointAge,
+		maxCachedPages:   constants.DefaultMaxCachedPages,
+		pages:            map[uint32]*list.Element{},
+		pins:             map[uint32]int{},
+		prefetches:       map[uint32]*prefetch{},
+		logger:           discardLogger,
+		lru:              list.New(),
+	}
+
+	fileSize, err := fileStatSize(f)
+	if err != nil {
+		return nil, err
+	}
+	if fileSize == 0 && pager.readOnly {
+		return nil, fmt.Errorf("%s is not a %s file", f.Name(), constants.DbName)
+	}
+	if fileSize == 0 {
+		// New database, the header is written straight away so the file is recognizable.
+		// A WAL left behind by a deleted database of the same name must not be replayed.
+		if err := walTruncate(wal); err != nil {
+			return nil, err
+		}
+		pager.header = types.FileHeader{
+			Version:      constants.FileFormatVersion,
+			PageSize:     constants.PageSize,
+			RootPageNum:  0,
+			FreelistHead: constants.InvalidPageNum,
+			WalSalt:      rand.Uint32(),
+			Bloom:        make([]byte, constants.BloomSize),
+		}
+		if err := pagerWriteHeader(&pager); err != nil {
+			return nil, err
+		}
+		return &pager, nil
+	}
+
+	if pager.header, err = readFileHeader(f); err != nil {
+		return nil, err
+	}
+	pager.fileLength = uint32(fileSize)
+	pager.numPages = (uint32(fileSize) - constants.FileHeaderSize) / constants.PageSize
+	if pager.readOnly {
+		return &pager, nil
+	}
+
+	index := map[uint32]int64{}
+	walLength, err := walScan(wal, pager.header.WalSalt, 0, index)
+	if err != nil {
+		return nil, err
+	}
+	// A commit torn off by a crash is dropped, the next one is appended in its place.
+	if err := wal.Truncate(int64(walLength)); err != nil {
+		return nil, fmt.Errorf("error truncating wal file: %w", err)
+	}
+	if err := pagerAdoptWal(&pager, index, walLength); err != nil {
+		return nil, err
+	}
+	if walLength > 0 {
+		pager.walStarted = time.Now()
+	}
+	if err := pagerCheckLength(&pager); err != nil {
+		return nil, err
+	}
+	return &pager, nil
+}
+
+// pagerCheckLength fails if the db file ends in part of a page, unless it was
+// cut short copying a page the WAL still holds.
+func pagerCheckLength(pager *Pager) error {
+	if pager.fileLength%constants.PageSize != 0 && pager.walLength == 0 {
+		return dberr.Errorf(dberr.ErrCorrupt, "db file is not a whole number of pages. Corrupt file")
+	}
+	return nil
+}
+
+func fileStatSize(f pagerFile) (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get file stats: %w", err)
+	}
+	return stat.Size(), nil
+}
+
+func readFileHeader(f pagerFile) (types.FileHeader, error) {
+	buf := make([]byte, constants.FileHeaderSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return types.FileHeader{}, fmt.Errorf("%s is not a %s file", f.Name(), constants.DbName)
+	}
+	header, err := deserializeFileHeader(buf)
+	if err != nil {
+		return types.FileHeader{}, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	return header, nil
+}
+
+// pageChecksum returns the CRC32 of everything in the page except the checksum itself.
+func pageChecksum(page []byte) uint32 {
+	return crc32.ChecksumIEEE(page[:constants.PageChecksumOffset])
+}
+
+func setPageChecksum(page []byte) {
+	binary.LittleEndian.PutUint32(page[constants.PageChecksumOffset:], pageChecksum(page))
+}
+
+func pageChecksumValid(page []byte) bool {
+	return binary.LittleEndian.Uint32(page[constants.PageChecksumOffset:]) == pageChecksum(page)
+}
+
+// pageOffset returns the position of a page in the db file, which starts with the file header.
+func pageOffset(pageNum uint32) int64 {
+	return int64(constants.FileHeaderSize) + int64(pageNum)*int64(constants.PageSize)
+}
+
+func serializeFileHeader(h *types.FileHeader) []byte {
+	buf := make([]byte, constants.FileHeaderSize)
+	copy(buf[constants.MagicOffset:], constants.FileMagic)
+	binary.LittleEndian.PutUint32(buf[constants.VersionOffset:], h.Version)
+	binary.LittleEndian.PutUint32(buf[constants.HeaderPageSizeOffset:], h.PageSize)
+	binary.LittleEndian.PutUint32(buf[constants.RootPageNumOffset:], h.RootPageNum)
+	binary.LittleEndian.PutUint32(buf[constants.FreelistHeadOffset:], h.FreelistHead)
+	binary.LittleEndian.PutUint32(buf[constants.WalSaltOffset:], h.WalSalt)
+	copy(buf[constants.KeySaltOffset:], h.KeySalt[:])
+	copy(buf[constants.KeyCheckOffset:], h.KeyCheck[:])
+	binary.LittleEndian.PutUint32(buf[constants.BloomSizeOffset:], uint32(len(h.Bloom)))
+	copy(buf[constants.BloomOffset:], h.Bloom)
+	binary.LittleEndian.PutUint32(buf[constants.FulltextColumnsOffset:], h.FulltextColumns)
+	binary.LittleEndian.PutUint32(buf[constants.SpatialRootOffset:], h.SpatialRootPageNum)
+	binary.LittleEndian.PutUint32(buf[constants.PartitionCountOffset:], uint32(len(h.Partitions)))
+	for i, partition := range h.Partitions {
+		entry := buf[constants.PartitionsOffset+uint32(i)*constants.PartitionEntrySize:]
+		binary.LittleEndian.PutUint32(entry, partition.From)
+		binary.LittleEndian.PutUint32(entry[4:], partition.RootPageNum)
+	}
+	binary.LittleEndian.PutUint32(buf[constants.ViewCountOffset:], uint32(len(h.Views)))
+	for i, view := range h.Views {
+		entry := buf[constants.ViewsOffset+uint32(i)*constants.ViewEntrySize:]
+		copy(entry[:constants.ViewNameSize], view.Name)
+		binary.LittleEndian.PutUint32(entry[constants.ViewNameSize:], view.RootPageNum)
+	}
+	binary.LittleEndian.PutUint32(buf[constants.GeneratedRootOffset:], h.GeneratedRootPageNum)
+	binary.LittleEndian.PutUint32(buf[constants.GeneratedCountOffset:], uint32(len(h.Generated)))
+	for i, column := range h.Generated {
+		entry := buf[constants.GeneratedOffset+uint32(i)*constants.GeneratedEntrySize:]
+		copy(entry[:constants.GeneratedNameSize], column.Name)
+		if column.Stored {
+			binary.LittleEndian.PutUint32(entry[constants.GeneratedNameSize:], 1)
+		}
+		copy(entry[constants.GeneratedNameSize+4:constants.GeneratedEntrySize], column.Expr)
+	}
+	for i, collation := range h.Collations {
+		entry := buf[constants.CollationsOffset+uint32(i)*constants.CollationNameSize:]
+		copy(entry[:constants.CollationNameSize], collation)
+	}
+	binary.LittleEndian.PutUint32(buf[constants.UniqueRootOffset:], h.UniqueRootPageNum)
+	binary.LittleEndian.PutUint32(buf[constants.UniqueColumnOffset:], h.UniqueColumn)
+	copy(buf[constants.UniqueCollationOffset:constants.UniqueCollationOffset+constants.CollationNameSize], h.UniqueCollation)
+	binary.LittleEndian.PutUint32(buf[constants.StatisticsRootOffset:], h.StatisticsRootPageNum)
+	binary.LittleEndian.PutUint32(buf[constants.RowCountOffset:], h.RowCount)
+	binary.LittleEndian.PutUint32(buf[constants.ExpiringRowsOffset:], h.ExpiringRows)
+	binary.LittleEndian.PutUint64(buf[constants.AppliedIndexOffset:], h.AppliedIndex)
+	binary.LittleEndian.PutUint64(buf[constants.AppliedTimeOffset:], uint64(h.AppliedTime))
+	binary.LittleEndian.PutUint32(buf[constants.DescendingRootOffset:], h.DescendingRootPageNum)
+	binary.LittleEndian.PutUint32(buf[constants.UsersRootOffset:], h.UsersRootPageNum)
+	binary.LittleEndian.PutUint32(buf[constants.OrderedRootOffset:], h.OrderedRootPageNum)
+	binary.LittleEndian.PutUint32(buf[constants.OrderedColumnOffset:], h.OrderedColumn)
+	return buf
+}
+
+// deserializeFileHeader decodes and validates the header at the start of a db file.
+func deserializeFileHeader(buf []byte) (types.FileHeader, error) {
+	h := types.FileHeader{}
+	if string(buf[constants.MagicOffset:constants.MagicOffset+constants.MagicSize]) != constants.FileMagic {
+		return h, fmt.Errorf("not a %s file", constants.DbName)
+	}
+	h.Version = binary.LittleEndian.Uint32(buf[constants.VersionOffset:])
+	h.PageSize = binary.LittleEndian.Uint32(buf[constants.HeaderPageSizeOffset:])
+	h.RootPageNum = binary.LittleEndian.Uint32(buf[constants.RootPageNumOffset:])
+	h.FreelistHead = binary.LittleEndian.Uint32(buf[constants.FreelistHeadOffset:])
+	h.WalSalt = binary.LittleEndian.Uint32(buf[constants.WalSaltOffset:])
+	copy(h.KeySalt[:], buf[constants.KeySaltOffset:])
+	copy(h.KeyCheck[:], buf[constants.KeyCheckOffset:])
+	if h.Version != constants.FileFormatVersion {
+		return h, fmt.Errorf("unsupported file format version %d, expected %d", h.Version, constants.FileFormatVersion)
+	}
+	switch bloomSize := binary.LittleEndian.Uint32(buf[constants.BloomSizeOffset:]); bloomSize {
+	case 0:
+	case constants.BloomSize:
+		h.Bloom = append([]byte{}, buf[constants.BloomOffset:constants.BloomOffset+bloomSize]...)
+	default:
+		return h, fmt.Errorf("bloom filter of %d bytes, expected %d", bloomSize, constants.BloomSize)
+	}
+	h.FulltextColumns = binary.LittleEndian.Uint32(buf[constants.FulltextColumnsOffset:])
+	h.SpatialRootPageNum = binary.LittleEndian.Uint32(buf[constants.SpatialRootOffset:])
+	numPartitions := binary.LittleEndian.Uint32(buf[constants.PartitionCountOffset:])
+	if numPartitions >= constants.MaxPartitions {
+		return h, fmt.Errorf("%d partitions, at most %d are supported", numPartitions+1, constants.MaxPartitions)
+	}
+	for i := uint32(0); i < numPartitions; i++ {
+		entry := buf[constants.PartitionsOffset+i*constants.PartitionEntrySize:]
+		h.Partitions = append(h.Partitions, types.Partition{
+			From:        binary.LittleEndian.Uint32(entry),
+			RootPageNum: binary.LittleEndian.Uint32(entry[4:]),
+		})
+	}
+	numViews := binary.LittleEndian.Uint32(buf[constants.ViewCountOffset:])
+	if numViews > constants.MaxViews {
+		return h, fmt.Errorf("%d views, at most %d are supported", numViews, constants.MaxViews)
+	}
+	for i := uint32(0); i < numViews; i++ {
+		entry := buf[constants.ViewsOffset+i*constants.ViewEntrySize:]
+		h.Views = append(h.Views, types.View{
+			Name:        string(bytes.TrimRight(entry[:constants.ViewNameSize], "\x00")),
+			RootPageNum: binary.LittleEndian.Uint32(entry[constants.ViewNameSize:]),
+		})
+	}
+	h.GeneratedRootPageNum = binary.LittleEndian.Uint32(buf[constants.GeneratedRootOffset:])
+	numGenerated := binary.LittleEndian.Uint32(buf[constants.GeneratedCountOffset:])
+	if numGenerated > constants.MaxGenerated {
+		return h, fmt.Errorf("%d generated columns, at most %d are supported", numGenerated, constants.MaxGenerated)
+	}
+	for i := uint32(0); i < numGenerated; i++ {
+		entry := buf[constants.GeneratedOffset+i*constants.GeneratedEntrySize:]
+		h.Generated = append(h.Generated, types.GeneratedColumn{
+			Name:   string(bytes.TrimRight(entry[:constants.GeneratedNameSize], "\x00")),
+			Stored: binary.LittleEndian.Uint32(entry[constants.GeneratedNameSize:]) == 1,
+			Expr:   string(bytes.TrimRight(entry[constants.GeneratedNameSize+4:constants.GeneratedEntrySize], "\x00")),
+		})
+	}
+	for i := range h.Collations {
+		entry := buf[constants.CollationsOffset+uint32(i)*constants.CollationNameSize:]
+		h.Collations[i] = string(bytes.TrimRight(entry[:constants.CollationNameSize], "\x00"))
+	}
+	h.UniqueRootPageNum = binary.LittleEndian.Uint32(buf[constants.UniqueRootOffset:])
+	h.UniqueColumn = binary.LittleEndian.Uint32(buf[constants.UniqueColumnOffset:])
+	h.UniqueCollation = string(bytes.TrimRight(buf[constants.UniqueCollationOffset:constants.UniqueCollationOffset+constants.CollationNameSize], "\x00"))
+	h.StatisticsRootPageNum = binary.LittleEndian.Uint32(buf[constants.StatisticsRootOffset:])
+	h.RowCount = binary.LittleEndian.Uint32(buf[constants.RowCountOffset:])
+	h.ExpiringRows = binary.LittleEndian.Uint32(buf[constants.ExpiringRowsOffset:])
+	h.AppliedIndex = binary.LittleEndian.Uint64(buf[constants.AppliedIndexOffset:])
+	h.AppliedTime = int64(binary.LittleEndian.Uint64(buf[constants.AppliedTimeOffset:]))
+	h.DescendingRootPageNum = binary.LittleEndian.Uint32(buf[constants.DescendingRootOffset:])
+	h.UsersRootPageNum = binary.LittleEndian.Uint32(buf[constants.UsersRootOffset:])
+	h.OrderedRootPageNum = binary.LittleEndian.Uint32(buf[constants.OrderedRootOffset:])
+	h.OrderedColumn = binary.LittleEndian.Uint32(buf[constants.OrderedColumnOffset:])
+	if h.PageSize != constants.PageSize {
+		return h, fmt.Errorf("unsupported page size %d, expected %d", h.PageSize, constants.PageSize)
+	}
+	return h, nil
+}
+
+func pagerWriteHeader(pager *Pager) error {
+	_, err := pager.file.WriteAt(serializeFileHeader(&pager.header), 0)
+	if err != nil {
+		return fmt.Errorf("error writing file header: %w", err)
+	}
+	if pager.fileLength < constants.FileHeaderSize {
+		pager.fileLength = constants.FileHeaderSize
+	}
+	return nil
+}
+
+func pagerFlush(pager *Pager, pageNum uint32) error {
+	elem, ok := pager.pages[pageNum]
+	if !ok {
+		return fmt.Errorf("tried to flush null page")
+	}
+	cp := elem.Value.(*cachedPage)
+
+	pagerDropPrefetches(pager)
+	page, err := pagerSeal(pager, pageNum, cp.data[:])
+	if err != nil {
+		return err
+	}
+	if _, err := pager.file.WriteAt(page, pageOffset(pageNum)); err != nil {
+		return fmt.Errorf("error writing to file: %w", err)
+	}
+	cp.dirty = false
+	pager.pagesWritten++
+	// Pages past the old end of file must be read back from disk once evicted.
+	if end := uint32(pageOffset(pageNum + 1)); end > pager.fileLength {
+		pager.fileLength = end
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestPagerEvictsLeastRecentlyUsed(t *testing.T) {
+	table, _ := openTestDb(t)
+	table.pager.maxCachedPages = 2
+
+	// Enough rows to spread over several leaves.
+	for i := 1; i <= 60; i++ {
+		row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+		insertRow(table, &row)
+		// Only committed pages may be evicted.
+		pagerCommit(table.pager)
+		pagerEvict(table.pager)
+	}
+
+	if got := table.pager.lru.Len(); got > 2 {
+		t.Fatalf("Expected at most 2 cached pages after eviction. Got: %d", got)
+	}
+	if table.pager.cacheMisses == 0 {
+		t.Errorf("Expected evicted pages to be reloaded on a cache miss.")
+	}
+	if table.pager.cacheHits == 0 {
+		t.Errorf("Expected cache hits.")
+	}
+
+	// Evicted pages must have been flushed, so every row is still readable.
+	cursor, _ := tableStart(table)
+	for i := uint32(1); i <= 60; i++ {
+		if cursor.endOfTable {
+			t.Fatalf("Table ended early, expected row %d.", i)
+		}
+		rawRow, _ := cursor.value()
+		if row := deserializeRow(rawRow); row.Id != i {
+			t.Fatalf("Expected row %d. Got: %d", i, row.Id)
+		}
+		cursor.advance()
+	}
+	if !cursor.endOfTable {
+		t.Errorf("Expected end of table after 60 rows.")
+	}
+}
+
+func TestFileHeaderWrittenOnCreate(t *testing.T) {
+	table, dbName := openTestDb(t)
+	table.Close()
+
+	buf, err := os.ReadFile(dbName)
+	if err != nil {
+		t.Fatalf("Failed to read db file: %v", err)
+	}
+	// Header block followed by the root page.
+	if got, want := len(buf), int(constants.FileHeaderSize+constants.PageSize); got != want {
+		t.Fatalf("Unexpected file size. Got: %d, Want: %d", got, want)
+	}
+	header, err := deserializeFileHeader(buf)
+	if err != nil {
+		t.Fatalf("Expected valid header, got: %v", err)
+	}
+	if header.Version != constants.FileFormatVersion || header.PageSize != constants.PageSize {
+		t.Errorf("Unexpected header: %+v", header)
+	}
+	if header.RootPageNum != 0 || header.FreelistHead != constants.InvalidPageNum {
+		t.Errorf("Unexpected header: %+v", header)
+	}
+}
+
+func TestFileHeaderRejectsForeignFile(t *testing.T) {
+	buf := make([]byte, constants.FileHeaderSize)
+	copy(buf, "this is not a database file")
+	if _, err := deserializeFileHeader(buf); err == nil || err.Error() != "not a simpleDB file" {
+		t.Fatalf("Expected not a simpleDB file error, got: %v", err)
+	}
+
+	buf = serializeFileHeader(&types.FileHeader{Version: constants.FileFormatVersion + 1, PageSize: constants.PageSize})
+	if _, err := deserializeFileHeader(buf); err == nil {
+		t.Fatalf("Expected unsupported version error.")
+	}
+}
+
+func TestPageChecksumDetectsCorruption(t *testing.T) {
+	table, dbName := openTestDb(t)
+	row := parseRow("insert 1 user1 user1@example.com")
+	insertRow(table, &row)
+	table.Close()
+
+	buf, err := os.ReadFile(dbName)
+	if err != nil {
+		t.Fatalf("Failed to read db file: %v", err)
+	}
+	page := buf[constants.FileHeaderSize : constants.FileHeaderSize+constants.PageSize]
+	if !pageChecksumValid(page) {
+		t.Fatalf("Expected flushed page to have a valid checksum.")
+	}
+
+	// Flip a bit inside the row.
+	page[constants.LeafNodeHeaderSize+constants.LeafNodeKeySize+constants.UsernameOffset] ^= 1
+	if pageChecksumValid(page) {
+		t.Fatalf("Expected checksum mismatch after corrupting the page.")
+	}
+}
+
+func TestOpenRejectsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	text := filepath.Join(dir, "notes.txt")
+	os.WriteFile(text, bytes.Repeat([]byte("not a database\n"), int(2*constants.PageSize)/15+1)[:2*constants.PageSize], 0666)
+	if _, err := Open(text); err == nil || !strings.Contains(err.Error(), "not a simpleDB file") {
+		t.Fatalf("Expected a text file to be refused. Got: %v", err)
+	}
+
+	// A sound header and checksum over a page that holds no node fails on read.
+	dbName := filepath.Join(dir, "bogus.db")
+	table, _ := Open(dbName)
+	table.Insert(context.Background(), parseRow("insert 1 user1 user1@example.com"))
+	table.Close()
+	f, _ := os.OpenFile(dbName, os.O_RDWR, 0666)
+	page := make([]byte, constants.PageSize)
+	f.ReadAt(page, pageOffset(0))
+	page[constants.NodeTypeOffset] = 7
+	setPageChecksum(page)
+	f.WriteAt(page, pageOffset(0))
+	f.Close()
+	table, err := Open(dbName)
+	if err != nil {
+		t.Fatalf("Expected the db to open, pages are only read on demand. Got: %v", err)
+	}
+	err = table.Scan(context.Background(), func(row types.Row) error { return nil })
+	if err == nil || err.Error() != "page 0 is not a B-tree node - the file is corrupt" {
+		t.Fatalf("Expected the root to be refused. Got: %v", err)
+	}
+	table.Close()
+
+	// A root past the end of the file is refused right away.
+	f, _ = os.OpenFile(dbName, os.O_RDWR, 0666)
+	buf := make([]byte, constants.FileHeaderSize)
+	f.ReadAt(buf, 0)
+	header, _ := deserializeFileHeader(buf)
+	header.RootPageNum = 40
+	f.WriteAt(serializeFileHeader(&header), 0)
+	f.Close()
+	if _, err := Open(dbName); err == nil || err.Error() != "the root page 40 is past the end of the file, which has 1 pages" {
+		t.Fatalf("Expected the root to be out of bounds. Got: %v", err)
+	}
+}
+
+func TestCorruptPageReturnsError(t *testing.T) {
+	table, dbName := openTestDb(t)
+	row := parseRow("insert 1 user1 user1@example.com")
+	table.Insert(context.Background(), row)
+	table.Close()
+
+	f, _ := os.OpenFile(dbName, os.O_RDWR, 0666)
+	f.WriteAt([]byte{0xff}, pageOffset(0)+int64(constants.LeafNodeHeaderSize+constants.LeafNodeValueOffset+constants.UsernameOffset))
+	f.Close()
+
+	table, err := Open(dbName)
+	if err != nil {
+		t.Fatalf("Expected the db to open, pages are only read on demand. Got: %v", err)
+	}
+	err = table.Scan(context.Background(), func(row types.Row) error { return nil })
+	if err == nil || err.Error() != "page 0 is corrupt: checksum mismatch" {
+		t.Fatalf("Expected checksum mismatch error. Got: %v", err)
+	}
+}
+
+func TestCloseWritesOnlyDirtyPages(t *testing.T) {
+	table, dbName := openTestDb(t)
+	for i := 1; i <= 20; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)))
+	}
+	table.Close()
+
+	table, _ = Open(dbName)
+	table.Scan(context.Background(), func(row types.Row) error { return nil })
+	table.Close()
+	if table.pager.pagesWritten != 0 {
+		t.Fatalf("Expected closing after a read to write no pages. Got: %d", table.pager.pagesWritten)
+	}
+
+	table, _ = Open(dbName)
+	table.Delete(context.Background(), 20)
+	table.Close()
+	// The leaf and the root, which counts the rows under it, land in the WAL on
+	// commit, the checkpoint copies them and the file header into the db file.
+	if table.pager.pagesWritten != 5 {
+		t.Fatalf("Expected only the changed leaf, its parent and the header to be written. Got: %d", table.pager.pagesWritten)
+	}
+}
+
+func TestTruncatedPageReturnsError(t *testing.T) {
+	table, dbName := openTestDb(t)
+	for i := 1; i <= 20; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)))
+	}
+	table.Close()
+
+	table, err := Open(dbName)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer table.Close()
+	lastPage := table.pager.numPages - 1
+	os.Truncate(dbName, pageOffset(lastPage)+100)
+	err = table.Scan(context.Background(), func(row types.Row) error { return nil })
+	expected := fmt.Sprintf("page %d is truncated: read 100 of %d bytes", lastPage, constants.PageSize)
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected %q. Got: %v", expected, err)
+	}
+}
+
+func TestFileLocking(t *testing.T) {
+	table, dbName := openTestDb(t)
+	row := parseRow("insert 1 user1 user1@example.com")
+	table.Insert(context.Background(), row)
+
+	locked := fmt.Sprintf("database is locked: %s is in use by another process", dbName)
+	if _, err := Open(dbName); err == nil || err.Error() != locked {
+		t.Fatalf("Expected a second writer to be refused. Got: %v", err)
+	}
+	reader, err := OpenReadOnly(dbName)
+	if err != nil {
+		t.Fatalf("Expected a reader to open alongside the writer. Got: %v", err)
+	}
+	reader.Close()
+	table.Close()
+
+	reader1, err := OpenReadOnly(dbName)
+	if err != nil {
+		t.Fatalf("Failed to open reader: %v", err)
+	}
+	reader2, err := OpenReadOnly(dbName)
+	if err != nil {
+		t.Fatalf("Expected readers to share the file. Got: %v", err)
+	}
+	table, err = Open(dbName)
+	if err != nil {
+		t.Fatalf("Expected a writer to open alongside the readers. Got: %v", err)
+	}
+	if _, err := Open(dbName); err == nil || err.Error() != locked {
+		t.Fatalf("Expected a second writer to be refused while readers are open. Got: %v", err)
+	}
+	table.Close()
+	if err := reader1.Insert(context.Background(), row); err == nil || err.Error() != "database is read-only" {
+		t.Fatalf("Expected read-only error. Got: %v", err)
+	}
+	count := 0
+	reader2.Scan(context.Background(), func(row types.Row) error {
+		count++
+		return nil
+	})
+	if count != 1 {
+		t.Fatalf("Expected 1 row. Got: %d", count)
+	}
+	reader1.Close()
+	reader2.Close()
+
+	table, err = Open(dbName)
+	if err != nil {
+		t.Fatalf("Expected the lock to be released on close. Got: %v", err)
+	}
+	table.Close()
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Range partitioning.
+
+A partitioned table splits its ids into ranges at the bounds it was
+partitioned at, and stores every range in a B-tree of its own: the first in
+the tree at the root page, the others in trees whose roots the file header
+lists. All trees share the pager, so a statement touching several partitions
+still commits atomically. Inserts and deletes go to the tree of the id, and
+scans only visit the trees whose ranges overlap the ids a where clause
+narrows them to, so a point or range query on one partition never reads the
+others.
+
+A table can only be partitioned while it is empty. Each partition is a
+*Table of its own for the B-tree code, sharing the pager and clock of the
+table it belongs to.
+*/
+
+// partition is a range of ids and the tree holding them.
+type partition struct {
+	from uint32 // The range ends where the next partition's starts.
+	tree *Table
+}
+
+// PartitionInfo describes a partition of a table and its size.
+type PartitionInfo struct {
+	From     uint32 `json:"from"`
+	To       uint32 `json:"to"`
+	RootPage uint32 `json:"rootPage"`
+	Rows     uint32 `json:"rows"`
+	Pages    uint32 `json:"pages"` // Pages of its tree.
+}
+
+// loadPartitions sets up the partitions the file header lists.
+func (t *Table) loadPartitions() {
+	t.partitions = nil
+	if len(t.pager.header.Partitions) == 0 {
+		return
+	}
+	t.partitions = []partition{{from: 0, tree: t}}
+	for _, p := range t.pager.header.Partitions {
+		tree := &Table{
+			pager:       t.pager,
+			rootPageNum: p.RootPageNum,
+			logger:      t.logger,
+			now:         func() time.Time { return t.now() },
+		}
+		t.partitions = append(t.partitions, partition{from: p.From, tree: tree})
+	}
+}
+
+// trees returns the partitions of the table, or the table itself as its only partition.
+func (t *Table) trees() []partition {
+	if t.partitions == nil {
+		return []partition{{from: 0, tree: t}}
+	}
+	return t.partitions
+}
+
+// partitionIndex returns the index in trees of the partition holding id.
+func (t *Table) partitionIndex(id uint32) int {
+	return sort.Search(len(t.partitions), func(i int) bool { return t.partitions[i].from > id }) - 1
+}
+
+// treeOf returns the tree holding the row with the id.
+func (t *Table) treeOf(id uint32) *Table {
+	if t.partitions == nil {
+		return t
+	}
+	return t.partitions[t.partitionIndex(id)].tree
+}
+
+// partitionEnd returns the largest id of the i-th partition.
+func partitionEnd(partitions []partition, i int) uint32 {
+	if i+1 < len(partitions) {
+		return partitions[i+1].from - 1
+	}
+	return math.MaxUint32
+}
+
+// adjacentTree returns the tree of the partition after the one of tree, or before it if
+// backwards, nil if there is none.
+func (t *Table) adjacentTree(tree *Table, backwards bool) *Table {
+	for i, p := range t.partitions {
+		if p.tree != tree {
+			continue
+		}
+		if backwards && i > 0 {
+			return t.partitions[i-1].tree
+		}
+		if !backwards && i+1 < len(t.partitions) {
+			return t.partitions[i+1].tree
+		}
+		return nil
+	}
+	return nil
+}
+
+// scanPartitions runs scan on every partition overlapping the ids from to to, in
+// descending order of ids if desc, with the range clipped to the partition.
+func (t *Table) scanPartitions(from uint32, to uint32, desc bool, scan func(tree *Table, from uint32, to uint32) error) error {
+	partitions := t.trees()
+	order := make([]int, len(partitions))
+	for i := range order {
+		order[i] = i
+	}
+	if desc {
+		slices.Reverse(order)
+	}
+	for _, i := range order {
+		end := partitionEnd(partitions, i)
+		if end < from || partitions[i].from > to {
+			continue
+		}
+		if err := scan(partitions[i].tree, max(from, partitions[i].from), min(to, end)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Partition splits the ids of the table into ranges starting at the bounds,
+in ascending order, and gives each a tree of its own. Partitioning at 100 and
+1000 stores ids below 100, from 100 to 999, and from 1000 up in three trees.
+The table must be empty and not partitioned already.
+*/
+func (t *Table) Partition(ctx context.Context, bounds []uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pager := t.pager
+	if pager.readOnly {
+		return errReadOnly
+	}
+	if pager.inTxn {
+		return fmt.Errorf("cannot partition - a transaction is active")
+	}
+	if t.partitions != nil {
+		return fmt.Errorf("the table is already partitioned")
+	}
+	if len(bounds) == 0 || len(bounds) >= int(constants.MaxPartitions) {
+		return fmt.Errorf("a table has 2 to %d partitions", constants.MaxPartitions)
+	}
+	for i, bound := range bounds {
+		if bound == 0 || (i > 0 && bound <= bounds[i-1]) {
+			return fmt.Errorf("partition bounds must be ascending and above 0")
+		}
+	}
+	info, err := t.Info()
+	if err != nil {
+		return err
+	}
+	if info.Rows > 0 {
+		return fmt.Errorf("only an empty table can be partitioned, this one has %d rows", info.Rows)
+	}
+	oldHeader := pager.header
+	err = t.write(func() error {
+		partitions := []types.Partition{}
+		for _, bound := range bounds {
+			pageNum, err := getUnusedPageNum(pager)
+			if err != nil {
+				return err
+			}
+			root, err := getPage(pager, pageNum)
+			if err != nil {
+				return err
+			}
+			initializeLeafNode(root)
+			setNodeRoot(root, true)
+			markPageDirty(pager, pageNum)
+			partitions = append(partitions, types.Partition{From: bound, RootPageNum: pageNum})
+		}
+		// The header is written by the commit, along with the new roots.
+		pager.header.Partitions = partitions
+		return nil
+	})
+	if err != nil {
+		pager.header = oldHeader
+		return err
+	}
+	t.loadPartitions()
+	return nil
+}
+
+// Partitions describes the partitions of the table in id order, a single one
+// covering every id if the table is not partitioned.
+func (t *Table) Partitions() ([]PartitionInfo, error) {
+	partitions := t.trees()
+	infos := []PartitionInfo{}
+	for i, p := range partitions {
+		info := PartitionInfo{From: p.from, To: partitionEnd(partitions, i), RootPage: p.tree.rootPageNum}
+		for level := []uint32{p.tree.rootPageNum}; len(level) > 0; {
+			var next []uint32
+			for _, pageNum := range level {
+				node, err := getPage(t.pager, pageNum)
+				if err != nil {
+					return nil, err
+				}
+				info.Pages++
+				if getNodeType(node) == types.NodeLeaf {
+					info.Rows += binary.LittleEndian.Uint32(leafNodeNumCells(node))
+					continue
+				}
+				numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+				for i := uint32(0); i < numKeys; i++ {
+					next = append(next, binary.LittleEndian.Uint32(internalNodeCell(node, i)))
+				}
+				next = append(next, binary.LittleEndian.Uint32(internalNodeRightChild(node)))
+			}
+			level = next
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestPartitions(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	if err := table.Partition(ctx, []uint32{50, 20}); err == nil {
+		t.Fatalf("Expected descending bounds to fail.")
+	}
+	if err := table.Partition(ctx, []uint32{20, 50}); err != nil {
+		t.Fatalf("Partition failed: %v", err)
+	}
+	if err := table.Partition(ctx, []uint32{100}); err == nil {
+		t.Fatalf("Expected partitioning twice to fail.")
+	}
+	for _, i := range rand.Perm(80) {
+		id := i + 1
+		if err := table.Insert(ctx, parseRow(fmt.Sprintf("insert %d user%d e", id, id))); err != nil {
+			t.Fatalf("Insert %d failed: %v", id, err)
+		}
+	}
+	table.Delete(ctx, 20)
+
+	partitions, err := table.Partitions()
+	if err != nil {
+		t.Fatalf("Partitions failed: %v", err)
+	}
+	rows := []uint32{}
+	for _, partition := range partitions {
+		rows = append(rows, partition.Rows)
+	}
+	if len(partitions) != 3 || partitions[1].From != 20 || partitions[1].To != 49 || !slices.Equal(rows, []uint32{19, 29, 31}) {
+		t.Fatalf("Expected partitions from 0, 20 and 50 with 19, 29 and 31 rows. Got: %+v", partitions)
+	}
+	if stats, _ := table.Stats(); len(stats.Partitions) != 3 {
+		t.Fatalf("Expected the stats to report 3 partitions. Got: %+v", stats.Partitions)
+	}
+
+	// A range query within the last partition does not scan the others.
+	stmt, _ := parser.Parse("select where id >= 60")
+	found := 0
+	table.Execute(ctx, stmt, func([]any) error { found++; return nil })
+	if found != 21 {
+		t.Fatalf("Expected 21 rows from 60. Got: %d", found)
+	}
+	if scanned := table.rowsScanned + table.partitions[1].tree.rowsScanned; scanned != 0 {
+		t.Fatalf("Expected the first two partitions to be pruned. Got %d rows scanned", scanned)
+	}
+
+	// The cursor crosses partitions both ways.
+	c := table.Cursor()
+	ids := []uint32{}
+	for c.Seek(15); c.Valid(); c.Next() {
+		key, _ := c.Key()
+		if ids = append(ids, key); key == 22 {
+			break
+		}
+	}
+	for c.Prev(); c.Valid(); c.Prev() {
+		key, _ := c.Key()
+		if ids = append(ids, key); key == 18 {
+			break
+		}
+	}
+	c.Close()
+	if expected := []uint32{15, 16, 17, 18, 19, 21, 22, 21, 19, 18}; !slices.Equal(ids, expected) {
+		t.Fatalf("Expected %v. Got: %v", expected, ids)
+	}
+
+	// The partitions are kept in the file header.
+	table.Close()
+	table, _ = Open(dbName)
+	defer table.Close()
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected no problems. Got: %v", problems)
+	}
+	if info, _ := table.Info(); info.Rows != 79 {
+		t.Fatalf("Expected 79 rows after reopening. Got: %d", info.Rows)
+	}
+	all := 0
+	table.Scan(ctx, func(row types.Row) error { all++; return nil })
+	c = table.Cursor()
+	defer c.Close()
+	c.Seek(55)
+	if key, _ := c.Key(); key != 55 || all != 79 {
+		t.Fatalf("Expected to find 55 among 79 rows. Got: %d, %d rows", key, all)
+	}
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+/*
+Query planner.
+
+A select reads the rows its where clause can match along one of three access
+paths, which planWhere picks from the conditions joined to the rest of the
+clause by and:
+
+  - a seek in the primary tree: comparisons of the id with a number narrow
+    the range of ids that is read, down to a single row for id = <n>.
+  - a lookup in the secondary indexes: = on the column of the unique index,
+    like with a literal prefix on the column of the ordered index, match on a
+    column of the fulltext index and within in the spatial index give the ids
+    of the rows that can match, which are then read one by one. Several of
+    them give the ids all of them have.
+  - a full scan of the tree, when nothing narrows it.
+
+Reading rows one by one costs a descent of the tree each, so the ids of the
+indexes are only used if there are fewer of them than rows in the range of
+ids, which the counts in the nodes tell without reading a leaf. Otherwise the
+range is scanned. Every row read is still matched against the whole where
+clause, so an index only has to find every row that can match: a unique
+index finds the values sharing the hash of the one looked up as well.
+
+A like without wildcards is = to the unique index, comparing bytes. One with
+a literal prefix, like 'user1%', reads the range of the ordered index whose
+values start with the prefix, user1 up to the first value that does not.
+*/
+
+// planWhere picks the access path of a compiled where clause: it narrows the
+// range of ids the filter scans and sets the ids the indexes give, if reading
+// them is cheaper than the range.
+func planWhere(src rowSource, expr parser.Expr, where *filter) error {
+	narrowIdRange(expr, where)
+	t, ok := src.(*Table)
+	if !ok || where.from >= where.to {
+		// A single row, or none, is a seek whatever the indexes have.
+		return nil
+	}
+	if err := t.narrowByIndex(expr, where); err != nil {
+		return err
+	}
+	if where.ids == nil {
+		return nil
+	}
+	where.ids = slices.DeleteFunc(where.ids, func(id uint32) bool { return id < where.from || id > where.to })
+	rows, err := t.countRange(where.from, where.to)
+	if err != nil {
+		return err
+	}
+	if uint64(len(where.ids)) >= rows {
+		where.ids, where.indexes = nil, nil
+	}
+	return nil
+}
+
+// narrowByIndex limits a filter to the ids the unique, fulltext and spatial indexes
+// find for the conditions joined to the rest of the where clause by and.
+func (t *Table) narrowByIndex(expr parser.Expr, where *filter) error {
+	var ids []uint32
+	var index string
+	switch e := expr.(type) {
+	case *parser.Logical:
+		if e.Op != "and" {
+			return nil
+		}
+		if err := t.narrowByIndex(e.Left, where); err != nil {
+			return err
+		}
+		return t.narrowByIndex(e.Right, where)
+	case *parser.Compare:
+		column, value, ok := columnEquals(e)
+		names, _ := t.columns()
+		if !ok || !slices.Contains(names, column) || !t.uniqueFinds(column, t.pager.header.Collations[slices.Index(names, column)]) {
+			return nil
+		}
+		var err error
+		if ids, err = uniqueLookup(t.pager, value); err != nil {
+			return err
+		}
+		index = "unique"
+	case *parser.Like:
+		// Like compares the bytes, as the binary collation and the ordered index do.
+		prefix := likePrefix(e.Pattern)
+		ordered, ok := t.OrderedIndex()
+		var err error
+		switch {
+		case prefix == e.Pattern && t.uniqueFinds(e.Column, ""):
+			ids, err = uniqueLookup(t.pager, e.Pattern)
+			index = "unique"
+		case ok && ordered == e.Column && prefix != "":
+			ids, err = orderedPrefix(t.pager, prefix)
+			index = "ordered"
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	case *parser.Match:
+		fulltext := t.pager.changes.index
+		if fulltext == nil || t.pager.inTxn {
+			return nil
+		}
+		var ok bool
+		if ids, ok = fulltext.lookup(slices.Index(columnNames, e.Column), tokenize(e.Words)); !ok {
+			return nil
+		}
+		index = "fulltext"
+	case *parser.Within:
+		// The spatial index is in the pages, it sees the changes of the transaction too.
+		var err error
+		if ids, err = spatialSearch(t.pager, e.Box); err != nil {
+			return err
+		}
+		index = "spatial"
+	default:
+		return nil
+	}
+	if where.ids != nil {
+		ids = slices.DeleteFunc(ids, func(id uint32) bool {
+			_, found := slices.BinarySearch(where.ids, id)
+			return !found
+		})
+	}
+	where.ids = ids
+	if !slices.Contains(where.indexes, index) {
+		where.indexes = append(where.indexes, index)
+	}
+	return nil
+}
+
+// columnEquals reports whether a comparison is between a column and a value with
+// =, and returns them.
+func columnEquals(e *parser.Compare) (string, any, bool) {
+	if e.Op != "=" {
+		return "", nil, false
+	}
+	column, ok := e.Left.(*parser.Column)
+	literal, isLiteral := e.Right.(*parser.Literal)
+	if !ok {
+		column, ok = e.Right.(*parser.Column)
+		literal, isLiteral = e.Left.(*parser.Literal)
+	}
+	if !ok || !isLiteral {
+		return "", nil, false
+	}
+	return column.Name, literal.Value, true
+}
+
+// uniqueFinds reports whether the unique index finds every row whose value of the
+// column equals a value by the collation, "" for binary: the index is on the column,
+// and its collation is the same or nocase, which only adds the values differing in case.
+func (t *Table) uniqueFinds(column string, collation string) bool {
+	indexed, indexCollation, ok := t.UniqueIndex()
+	if !ok || indexed != column {
+		return false
+	}
+	if collation == "" {
+		collation = "binary"
+	}
+	return indexCollation == collation || (indexCollation == "nocase" && collation == "binary")
+}
+
+// scanIds calls fn with the values of the rows with the ids of the filter that match it.
+func (t *Table) scanIds(ctx context.Context, where *filter, desc bool, fn func(values []any) error) error {
+	ids := slices.Clone(where.ids)
+	if desc {
+		slices.Reverse(ids)
+	}
+	for _, id := range ids {
+		if id < where.from || id > where.to {
+			continue
+		}
+		point := &filter{from: id, to: id, match: where.match, keysOnly: where.keysOnly}
+		if err := t.scanWhere(ctx, point, desc, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readsDescendingIndex reports whether a scan of the range of ids of a filter in
+// descending order reads the descending index rather than the table.
+func (t *Table) readsDescendingIndex(where *filter, desc bool) bool {
+	return desc && where.from < where.to && where.ids == nil && t.HasDescendingIndex()
+}
+
+/*
+Explain describes how a select reads its rows: the access path the planner
+picks for its where clause, the order it reads them in and whether they are
+sorted afterwards. Subqueries of the where clause are run to plan it, the
+select itself is not.
+*/
+func (t *Table) Explain(ctx context.Context, stmt *parser.Select) (string, error) {
+	if err := t.Refresh(); err != nil {
+		return "", err
+	}
+	if stmt.From != "" {
+		return "scan of the view " + stmt.From, nil
+	}
+	if err := checkSelect(t, stmt); err != nil {
+		return "", err
+	}
+	where, err := compileWhere(ctx, t, stmt.Where)
+	if err != nil {
+		return "", err
+	}
+	if countsIdRange(t, stmt) {
+		return fmt.Sprintf("count of ids %d to %d from the row counts of the primary tree", where.from, where.to), nil
+	}
+	grouped := stmt.GroupBy != "" || slices.ContainsFunc(stmt.Columns, func(item parser.SelectItem) bool { return item.Aggregate != "" })
+	desc := stmt.Desc && !grouped && (stmt.OrderBy == "" || stmt.OrderBy == "id")
+	var plan string
+	switch {
+	case where.from > where.to:
+		return "no rows, the where clause rules out every id", nil
+	case where.ids != nil:
+		plan = fmt.Sprintf("lookup of %d rows in the %s index", len(where.ids), strings.Join(where.indexes, " and "))
+	case t.readsDescendingIndex(where, desc):
+		plan = "scan of the descending index"
+		if where.from > 0 || where.to < math.MaxUint32 {
+			plan += fmt.Sprintf(" from id %d down to %d", where.to, where.from)
+		}
+		desc = false
+	case where.from == where.to:
+		plan = fmt.Sprintf("seek of id %d in the primary tree", where.from)
+	case where.from > 0 || where.to < math.MaxUint32:
+		plan = fmt.Sprintf("scan of ids %d to %d in the primary tree", where.from, where.to)
+	default:
+		plan = "full scan of the primary tree"
+	}
+	if desc {
+		plan += ", in descending order"
+	}
+	if stmt.OrderBy != "" && stmt.OrderBy != "id" && !grouped {
+		plan += ", sorted by " + stmt.OrderBy
+	}
+	return plan, nil
+}
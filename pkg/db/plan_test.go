@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestQueryPlanner(t *testing.T) {
+	table, _ := openTestDb(t)
+	defer table.Close()
+	ctx := context.Background()
+	execute := func(text string) ([]string, error) {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		rows := []string{}
+		_, err = table.Execute(ctx, stmt, func(values []any) error {
+			rows = append(rows, fmt.Sprint(values[0]))
+			return nil
+		})
+		return rows, err
+	}
+	explain := func(text string) string {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		plan, err := table.Explain(ctx, stmt.(*parser.Select))
+		if err != nil {
+			t.Fatalf("Explain(%q) failed: %v", text, err)
+		}
+		return plan
+	}
+	execute("create spatial index")
+	for i := 1; i <= 60; i++ {
+		domain := "example.com"
+		if i%20 == 0 {
+			domain = "mail.example.org"
+		}
+		execute(fmt.Sprintf("insert %d user%d user%d@%s at (%d, 0, %d, 1)", i, i, i, domain, i, i))
+	}
+	execute("create unique index on username")
+	execute("create fulltext index on email")
+	execute("create index on username")
+
+	for _, test := range []struct {
+		query    string
+		plan     string
+		expected []string
+	}{
+		{"select id where username = 'user42'", "lookup of 1 rows in the unique index", []string{"42"}},
+		{"select id where 'user42' = username and id > 50", "lookup of 0 rows in the unique index", []string{}},
+		{"select id where username like 'user7'", "lookup of 1 rows in the unique index", []string{"7"}},
+		{"select id where username like 'user1%'", "lookup of 11 rows in the ordered index", []string{"1", "10", "11", "12", "13", "14", "15", "16", "17", "18", "19"}},
+		{"select id where username like 'user4_'", "lookup of 11 rows in the ordered index", []string{"40", "41", "42", "43", "44", "45", "46", "47", "48", "49"}},
+		// Every row starts with user, reading them one by one would cost more than the scan.
+		{"select id where username like 'user%5'", "full scan of the primary tree", []string{"5", "15", "25", "35", "45", "55"}},
+		{"select id where email match 'mail'", "lookup of 3 rows in the fulltext index", []string{"20", "40", "60"}},
+		{"select id where email match 'mail' and within(30, 0, 45, 1) order by id desc", "lookup of 1 rows in the fulltext and spatial index, in descending order", []string{"40"}},
+		{"select id where within(10, 0, 12, 1)", "lookup of 3 rows in the spatial index", []string{"10", "11", "12"}},
+		// Every row of the range has the word, reading the range is cheaper than reading them one by one.
+		{"select id where email match 'example' and id >= 39 and id <= 41", "scan of ids 39 to 41 in the primary tree", []string{"39", "40", "41"}},
+		{"select id where id = 5", "seek of id 5 in the primary tree", []string{"5"}},
+		{"select id where id > 5 and id < 3", "no rows, the where clause rules out every id", []string{}},
+		{"select id where username = 'user5' or id = 6", "full scan of the primary tree", []string{"5", "6"}},
+		{"select id where id < 4 order by username", "scan of ids 0 to 3 in the primary tree, sorted by username", []string{"1", "2", "3"}},
+	} {
+		if plan := explain(test.query); plan != test.plan {
+			t.Errorf("%s: expected the plan %q. Got: %q", test.query, test.plan, plan)
+		}
+		if rows, err := execute(test.query); err != nil || !slices.Equal(rows, test.expected) {
+			t.Errorf("%s: expected %v. Got: %v, %v", test.query, test.expected, rows, err)
+		}
+	}
+
+	// The index only finds the rows equal by its own collation.
+	execute("alter column username collate nocase")
+	if plan := explain("select id where username = 'USER42'"); plan != "full scan of the primary tree" {
+		t.Fatalf("Expected a binary index not to be used for a nocase column. Got: %q", plan)
+	}
+	if rows, _ := execute("select id where username = 'USER42'"); !slices.Equal(rows, []string{"42"}) {
+		t.Fatalf("Expected the row equal without case. Got: %v", rows)
+	}
+
+	execute("create index on id desc")
+	if plan := explain("select id where id >= 10 order by id desc limit 2"); plan != "scan of the descending index from id 4294967295 down to 10" {
+		t.Fatalf("Expected the descending index to be read. Got: %q", plan)
+	}
+	if plan := explain("select count(*) where id < 30"); plan != "count of ids 0 to 29 from the row counts of the primary tree" {
+		t.Fatalf("Expected the count from the tree. Got: %q", plan)
+	}
+}
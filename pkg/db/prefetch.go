@@ -0,0 +1,74 @@
+package db
+
+import (
+	"encoding/binary"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// prefetch is a read of a page from the db file running in the background.
+type prefetch struct {
+	done chan struct{} // Closed once the read finished.
+	page types.Page
+	n    int
+	err  error
+}
+
+/*
+prefetchNextLeaf starts reading the leaf after pageNum, so that a scan finds
+it cached by the time the cursor gets there. Only the read runs in the
+background, the result is handed to getPage on the next cache miss for it.
+*/
+func prefetchNextLeaf(pager *Pager, pageNum uint32) error {
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return err
+	}
+	if nextPageNum := binary.LittleEndian.Uint32(leafNodeNextLeaf(node)); nextPageNum != 0 {
+		prefetchPage(pager, nextPageNum)
+	}
+	return nil
+}
+
+func prefetchPage(pager *Pager, pageNum uint32) {
+	if pager.inMemory {
+		return
+	}
+	if _, ok := pager.pages[pageNum]; ok {
+		return
+	}
+	if _, ok := pager.prefetches[pageNum]; ok {
+		return
+	}
+	// Pages in the WAL or not yet written are not read from the db file.
+	if _, ok := pager.walIndex[pageNum]; ok || pageOffset(pageNum+1) > int64(pager.fileLength) {
+		return
+	}
+	p := &prefetch{done: make(chan struct{})}
+	pager.prefetches[pageNum] = p
+	file := pager.file
+	go func() {
+		p.n, p.err = file.ReadAt(p.page[:], pageOffset(pageNum))
+		close(p.done)
+	}()
+}
+
+// takePrefetch waits for the prefetch of a page, if one was started, and returns it.
+func takePrefetch(pager *Pager, pageNum uint32) (*prefetch, bool) {
+	p, ok := pager.prefetches[pageNum]
+	if !ok {
+		return nil, false
+	}
+	delete(pager.prefetches, pageNum)
+	<-p.done
+	return p, true
+}
+
+// pagerDropPrefetches waits for every prefetch and discards it. It must be
+// called before the db file is written, which would make them stale.
+func pagerDropPrefetches(pager *Pager) {
+	for pageNum, p := range pager.prefetches {
+		<-p.done
+		delete(pager.prefetches, pageNum)
+	}
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestScanPrefetchesNextLeaf(t *testing.T) {
+	table, dbName := openTestDb(t)
+	for i := 1; i <= 40; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)))
+	}
+	table.Close()
+
+	table, _ = Open(dbName)
+	defer table.Close()
+	stop := errors.New("stop")
+	table.Scan(context.Background(), func(row types.Row) error { return stop })
+	cursor, _ := tableStart(table)
+	node, _ := getPage(table.pager, cursor.pageNum)
+	nextPageNum := binary.LittleEndian.Uint32(leafNodeNextLeaf(node))
+	if _, ok := table.pager.prefetches[nextPageNum]; !ok {
+		t.Fatalf("Expected the scan to prefetch leaf %d. Got: %v", nextPageNum, table.pager.prefetches)
+	}
+
+	rows := 0
+	if err := table.Scan(context.Background(), func(row types.Row) error { rows++; return nil }); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if rows != 40 {
+		t.Fatalf("Expected 40 rows. Got: %d", rows)
+	}
+	if len(table.pager.prefetches) != 0 {
+		t.Fatalf("Expected every prefetch to be used. Got: %v", table.pager.prefetches)
+	}
+}
@@ -0,0 +1,254 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Sharding.
+
+A sharded database spreads its rows over several db files, the shards, each
+with a pager, WAL and size limit of its own. The id of a row is hashed to pick
+its shard, so inserts and deletes go to a single shard, while a select scans
+every shard at once, in a goroutine per shard, and merges their rows back into
+id order. The shards are named after a small manifest file that records how
+many there are, <name>-shard0, <name>-shard1 and so on; the number can not
+change once the database is created, as that would move rows between shards.
+
+Every shard commits on its own, so a sharded database has no transactions,
+and no accounts, partitions or other features that are kept per db file.
+*/
+
+// ShardFileSuffix is appended to the name of the manifest, followed by its number, to get a shard.
+const ShardFileSuffix = "-shard"
+
+// MaxShards caps the shards of a database, every shard keeps two files open.
+const MaxShards = 256
+
+// shardManifest is the content of the manifest file.
+type shardManifest struct {
+	Shards int `json:"shards"`
+}
+
+// Sharded is a database whose rows are spread over several db files. Like a
+// Table it is not safe for concurrent use.
+type Sharded struct {
+	name   string
+	shards []*Table
+}
+
+/*
+OpenSharded opens the sharded database with the manifest file, creating it
+with the number of shards if it does not exist. Opening an existing database
+takes the number from the manifest, passing a different one than 0 fails.
+*/
+func OpenSharded(name string, shards int) (*Sharded, error) {
+	var manifest shardManifest
+	data, err := os.ReadFile(name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if shards < 1 || shards > MaxShards {
+			return nil, fmt.Errorf("a sharded database has 1 to %d shards", MaxShards)
+		}
+		manifest.Shards = shards
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileSynced(name, data); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &manifest); err != nil || manifest.Shards < 1 || manifest.Shards > MaxShards {
+			return nil, fmt.Errorf("%s is not the manifest of a sharded database", name)
+		}
+		if shards != 0 && shards != manifest.Shards {
+			return nil, fmt.Errorf("%s has %d shards, not %d", name, manifest.Shards, shards)
+		}
+	}
+	s := &Sharded{name: name}
+	for i := 0; i < manifest.Shards; i++ {
+		shard, err := Open(fmt.Sprintf("%s%s%d", name, ShardFileSuffix, i))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, shard)
+	}
+	return s, nil
+}
+
+// Close closes every shard, returning the first error.
+func (s *Sharded) Close() error {
+	var first error
+	for _, shard := range s.shards {
+		if err := shard.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Shards returns the tables of the shards, in the order of their files.
+func (s *Sharded) Shards() []*Table {
+	return s.shards
+}
+
+// columns returns the columns of the schema, a sharded database has no generated columns.
+func (s *Sharded) columns() ([]string, []string) {
+	return columnNames, columnTypes
+}
+
+// shardOf returns the shard holding the row with the id.
+func (s *Sharded) shardOf(id uint32) *Table {
+	h := fnv.New32a()
+	h.Write(binary.LittleEndian.AppendUint32(nil, id))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// Insert adds a row to the shard of its id.
+func (s *Sharded) Insert(ctx context.Context, row types.Row) error {
+	return s.shardOf(row.Id).Insert(ctx, row)
+}
+
+// Delete removes the row with the id from its shard.
+func (s *Sharded) Delete(ctx context.Context, id uint32) error {
+	return s.shardOf(id).Delete(ctx, id)
+}
+
+// Scan calls fn with every row of every shard, in id order.
+func (s *Sharded) Scan(ctx context.Context, fn func(row types.Row) error) error {
+	where, _ := compileWhere(ctx, s, nil)
+	return s.scanWhere(ctx, where, false, func(values []any) error {
+		row := types.Row{Id: uint32(values[0].(int64))}
+		copy(row.Username[:], values[1].(string))
+		copy(row.Email[:], values[2].(string))
+		return fn(row)
+	})
+}
+
+// Info sums up the rows and pages of the shards.
+func (s *Sharded) Info() (TableInfo, error) {
+	info := TableInfo{Name: TableName}
+	for _, shard := range s.shards {
+		shardInfo, err := shard.Info()
+		if err != nil {
+			return TableInfo{}, err
+		}
+		info.Rows += shardInfo.Rows
+		info.Pages += shardInfo.Pages
+	}
+	return info, nil
+}
+
+// Execute runs a parsed statement like Table.Execute: inserts and deletes on
+// the shard of their id, selects on all of them. Privileges are not checked.
+func (s *Sharded) Execute(ctx context.Context, stmt parser.Statement, fn func(values []any) error) (ExecResult, error) {
+	switch st := stmt.(type) {
+	case *parser.Insert:
+		if st.Box != nil {
+			return ExecResult{}, fmt.Errorf("a sharded database has no spatial index")
+		}
+		return s.shardOf(st.Id).executeInsert(ctx, st, fn)
+	case *parser.Select:
+		return ExecResult{}, executeSelect(ctx, s, st, fn)
+	case *parser.Delete:
+		if err := s.Delete(ctx, st.Id); err != nil {
+			return ExecResult{}, err
+		}
+		return ExecResult{RowsAffected: 1}, nil
+	case *parser.Begin, *parser.Commit, *parser.Rollback, *parser.Savepoint, *parser.RollbackTo, *parser.Release:
+		return ExecResult{}, fmt.Errorf("a sharded database has no transactions, every shard commits on its own")
+	}
+	return ExecResult{}, fmt.Errorf("%T is not supported on a sharded database", stmt)
+}
+
+// scanWhere scans the shards in parallel and merges the rows they return by id.
+func (s *Sharded) scanWhere(ctx context.Context, where *filter, desc bool, fn func(values []any) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	streams := make([]chan []any, len(s.shards))
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, shard := range s.shards {
+		i, shard := i, shard
+		streams[i] = make(chan []any, 64)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The error is set before the stream is closed, so it is seen once the stream ends.
+			defer close(streams[i])
+			errs[i] = shard.scanWhere(ctx, where, desc, func(values []any) error {
+				select {
+				case streams[i] <- values:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}()
+	}
+	err := mergeStreams(streams, errs, desc, fn)
+	// Stop the shards still scanning and wait for them, so none outlives the scan.
+	cancel()
+	wg.Wait()
+	return err
+}
+
+// mergeStreams passes the rows of the streams to fn in id order, each stream
+// already being in that order. It fails with the error of a stream that ends in one.
+func mergeStreams(streams []chan []any, errs []error, desc bool, fn func(values []any) error) error {
+	heads := make([][]any, len(streams))
+	next := func(i int) error {
+		values, ok := <-streams[i]
+		if !ok {
+			heads[i] = nil
+			return errs[i]
+		}
+		heads[i] = values
+		return nil
+	}
+	for i := range streams {
+		if err := next(i); err != nil {
+			return err
+		}
+	}
+	for {
+		// There are few shards, a linear search for the next row beats a heap.
+		pick := -1
+		for i, values := range heads {
+			if values == nil {
+				continue
+			}
+			if pick < 0 {
+				pick = i
+				continue
+			}
+			id, best := values[0].(int64), heads[pick][0].(int64)
+			if (!desc && id < best) || (desc && id > best) {
+				pick = i
+			}
+		}
+		if pick < 0 {
+			return nil
+		}
+		if err := fn(heads[pick]); err != nil {
+			return err
+		}
+		if err := next(pick); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestSharded(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "sharded")
+	if _, err := OpenSharded(name, 0); err == nil {
+		t.Fatalf("Expected creating a database without shards to fail.")
+	}
+	sharded, err := OpenSharded(name, 4)
+	if err != nil {
+		t.Fatalf("OpenSharded failed: %v", err)
+	}
+	ctx := context.Background()
+	execute := func(text string) ([]string, error) {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		rows := []string{}
+		_, err = sharded.Execute(ctx, stmt, func(values []any) error {
+			rows = append(rows, strings.TrimSpace(fmt.Sprintln(values...)))
+			return nil
+		})
+		return rows, err
+	}
+	for _, i := range rand.Perm(100) {
+		if _, err := execute(fmt.Sprintf("insert %d user%d e", i+1, i+1)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	execute("delete 50")
+	for i, shard := range sharded.Shards() {
+		if info, _ := shard.Info(); info.Rows == 0 || info.Rows > 50 {
+			t.Fatalf("Expected the rows to be spread over the shards. Shard %d has %d", i, info.Rows)
+		}
+	}
+
+	rows, err := execute("select id where id >= 45 and id < 53")
+	if expected := []string{"45", "46", "47", "48", "49", "51", "52"}; err != nil || !slices.Equal(rows, expected) {
+		t.Fatalf("Expected %v. Got: %v, %v", expected, rows, err)
+	}
+	// The scans of the other shards stop once the limit is reached.
+	rows, err = execute("select id order by id desc limit 3")
+	if expected := []string{"100", "99", "98"}; err != nil || !slices.Equal(rows, expected) {
+		t.Fatalf("Expected %v. Got: %v, %v", expected, rows, err)
+	}
+	rows, err = execute("select count(*), min(username) where id in (select id where id > 90)")
+	if expected := []string{"10 user100"}; err != nil || !slices.Equal(rows, expected) {
+		t.Fatalf("Expected %v. Got: %v, %v", expected, rows, err)
+	}
+	if _, err := execute("begin"); err == nil {
+		t.Fatalf("Expected a transaction to fail.")
+	}
+	sharded.Close()
+
+	if _, err := OpenSharded(name, 3); err == nil {
+		t.Fatalf("Expected opening with another number of shards to fail.")
+	}
+	sharded, err = OpenSharded(name, 0)
+	if err != nil {
+		t.Fatalf("OpenSharded failed: %v", err)
+	}
+	defer sharded.Close()
+	ids := []uint32{}
+	sharded.Scan(ctx, func(row types.Row) error {
+		ids = append(ids, row.Id)
+		return nil
+	})
+	if info, _ := sharded.Info(); len(ids) != 99 || info.Rows != 99 || !slices.IsSorted(ids) {
+		t.Fatalf("Expected 99 rows in id order after reopening. Got %d rows: %v", info.Rows, ids)
+	}
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Simulation tests.
+
+Random inserts and deletes run against the table and against a map holding
+what the table should contain. After every step the tree must pass the
+integrity check and hold exactly the rows of the map. Every run is derived
+from its seed, a failure names the seed and step so it can be replayed with
+
+	go test ./pkg/db -run TestSimulation -sim.seed=<seed> -sim.runs=1
+*/
+
+var (
+	simSeed  = flag.Int64("sim.seed", 1, "seed of the first simulation run")
+	simRuns  = flag.Int("sim.runs", 20, "number of simulation runs, each with the next seed")
+	simSteps = flag.Int("sim.steps", 1000, "operations per simulation run")
+)
+
+// simKeySpace is the range ids are drawn from, small enough that inserts
+// collide with existing rows and deletes often find their row.
+const simKeySpace = 400
+
+func TestSimulation(t *testing.T) {
+	for seed := *simSeed; seed < *simSeed+int64(*simRuns); seed++ {
+		simulate(t, seed, *simSteps)
+	}
+}
+
+func simulate(t *testing.T, seed int64, steps int) {
+	table, err := Open(MemoryDbName)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer table.Close()
+	r := rand.New(rand.NewSource(seed))
+	expected := map[uint32]string{}
+	ctx := context.Background()
+
+	for step := 0; step < steps; step++ {
+		id := uint32(r.Intn(simKeySpace) + 1)
+		var op string
+		var err, expectedErr error
+		if r.Intn(10) < 6 {
+			username := fmt.Sprintf("u%d-%d", id, step)
+			op = fmt.Sprintf("insert %d %s", id, username)
+			row := types.Row{Id: id}
+			copy(row.Username[:], username)
+			err = table.Insert(ctx, row)
+			if _, ok := expected[id]; ok {
+				expectedErr = fmt.Errorf("duplicate key")
+			} else if err == nil {
+				expected[id] = username
+			}
+		} else {
+			op = fmt.Sprintf("delete %d", id)
+			err = table.Delete(ctx, id)
+			if _, ok := expected[id]; !ok {
+				expectedErr = fmt.Errorf("key %d does not exist", id)
+			} else if err == nil {
+				delete(expected, id)
+			}
+		}
+		if err != nil && err.Error() == "table full" {
+			// Pages are never freed, so the file fills up eventually. The
+			// failed insert must have left the table as it was.
+			simCheck(t, table, expected, seed, step, op)
+			return
+		}
+		if fmt.Sprint(err) != fmt.Sprint(expectedErr) {
+			t.Fatalf("Seed %d, step %d, %s: expected error %v. Got: %v", seed, step, op, expectedErr, err)
+		}
+		simCheck(t, table, expected, seed, step, op)
+	}
+}
+
+// simCheck verifies the tree and compares its rows with the expected ones.
+func simCheck(t *testing.T, table *Table, expected map[uint32]string, seed int64, step int, op string) {
+	if problems := integrityCheck(table); len(problems) > 0 {
+		t.Fatalf("Seed %d, step %d, %s: integrity check failed:\n%s", seed, step, op, strings.Join(problems, "\n"))
+	}
+	seen := 0
+	err := table.Scan(context.Background(), func(row types.Row) error {
+		username, ok := expected[row.Id]
+		if !ok {
+			return fmt.Errorf("unexpected row %d", row.Id)
+		}
+		if got := string(bytes.TrimRight(row.Username[:], "\x00")); got != username {
+			return fmt.Errorf("row %d has username %s, expected %s", row.Id, got, username)
+		}
+		seen++
+		return nil
+	})
+	if err == nil && seen != len(expected) {
+		err = fmt.Errorf("scanned %d rows, expected %d", seen, len(expected))
+	}
+	if err != nil {
+		t.Fatalf("Seed %d, step %d, %s: %v", seed, step, op, err)
+	}
+}
@@ -0,0 +1,457 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Spatial index.
+
+The spatial index keeps a box for the rows that were given one, in an R-tree
+stored in pages of the db file next to the B-tree of the rows, with its root
+listed in the file header. Every node holds entries of a box and a pointer: in
+a leaf the box of a row and its id, in an internal node a child and the box
+bounding all of the child's entries. within(x1, y1, x2, y2) only descends
+into the children whose box overlaps the one asked for, and returns the rows
+whose box lies inside it.
+
+Its pages go through the pager like those of the table, so a change to the
+index commits and rolls back with the rows it belongs to. An insert descends
+into the child whose box grows the least and splits a full node in two with
+Guttman's quadratic split; like the B-tree, the root page never moves, a full
+root moves its entries into two new children instead. A box is found by its
+id, which is not a key of the tree, so removing a row visits every node.
+Nodes emptied by deletes stay in the tree, as the leaves of the B-tree do.
+*/
+
+// spatialEntry is a box and the row or child it belongs to.
+type spatialEntry struct {
+	box     types.Box
+	pointer uint32 // Id of the row in a leaf, page of the child in an internal node.
+}
+
+func spatialNodeIsLeaf(node []byte) bool {
+	return node[constants.SpatialNodeIsLeafOffset] == 1
+}
+
+// spatialNodeEntries decodes the entries of a node, reading no more than fit into one.
+func spatialNodeEntries(node []byte) []spatialEntry {
+	numEntries := min(binary.LittleEndian.Uint32(node[constants.SpatialNodeNumEntriesOffset:]), constants.SpatialNodeMaxEntries)
+	entries := make([]spatialEntry, 0, numEntries)
+	for i := uint32(0); i < numEntries; i++ {
+		entry := node[constants.SpatialNodeHeaderSize+i*constants.SpatialEntrySize:]
+		entries = append(entries, spatialEntry{
+			box: types.Box{
+				MinX: math.Float64frombits(binary.LittleEndian.Uint64(entry[0:])),
+				MinY: math.Float64frombits(binary.LittleEndian.Uint64(entry[8:])),
+				MaxX: math.Float64frombits(binary.LittleEndian.Uint64(entry[16:])),
+				MaxY: math.Float64frombits(binary.LittleEndian.Uint64(entry[24:])),
+			},
+			pointer: binary.LittleEndian.Uint32(entry[constants.SpatialEntryBoxSize:]),
+		})
+	}
+	return entries
+}
+
+// writeSpatialNode replaces the content of a node, keeping its root flag.
+func writeSpatialNode(node []byte, isLeaf bool, entries []spatialEntry) {
+	setNodeType(node, types.NodeSpatial)
+	node[constants.SpatialNodeIsLeafOffset] = 0
+	if isLeaf {
+		node[constants.SpatialNodeIsLeafOffset] = 1
+	}
+	binary.LittleEndian.PutUint32(node[constants.SpatialNodeNumEntriesOffset:], uint32(len(entries)))
+	for i, e := range entries {
+		entry := node[constants.SpatialNodeHeaderSize+uint32(i)*constants.SpatialEntrySize:]
+		binary.LittleEndian.PutUint64(entry[0:], math.Float64bits(e.box.MinX))
+		binary.LittleEndian.PutUint64(entry[8:], math.Float64bits(e.box.MinY))
+		binary.LittleEndian.PutUint64(entry[16:], math.Float64bits(e.box.MaxX))
+		binary.LittleEndian.PutUint64(entry[24:], math.Float64bits(e.box.MaxY))
+		binary.LittleEndian.PutUint32(entry[constants.SpatialEntryBoxSize:], e.pointer)
+	}
+}
+
+func boxUnion(a types.Box, b types.Box) types.Box {
+	return types.Box{MinX: min(a.MinX, b.MinX), MinY: min(a.MinY, b.MinY), MaxX: max(a.MaxX, b.MaxX), MaxY: max(a.MaxY, b.MaxY)}
+}
+
+func boxArea(b types.Box) float64 {
+	return (b.MaxX - b.MinX) * (b.MaxY - b.MinY)
+}
+
+// boxContains reports whether inner lies inside outer, edges included.
+func boxContains(outer types.Box, inner types.Box) bool {
+	return outer.MinX <= inner.MinX && outer.MinY <= inner.MinY && inner.MaxX <= outer.MaxX && inner.MaxY <= outer.MaxY
+}
+
+func boxesOverlap(a types.Box, b types.Box) bool {
+	return a.MinX <= b.MaxX && b.MinX <= a.MaxX && a.MinY <= b.MaxY && b.MinY <= a.MaxY
+}
+
+// boundingBox returns the smallest box holding the boxes of the entries, which must not be empty.
+func boundingBox(entries []spatialEntry) types.Box {
+	box := entries[0].box
+	for _, e := range entries[1:] {
+		box = boxUnion(box, e.box)
+	}
+	return box
+}
+
+// HasSpatialIndex reports whether the table has a spatial index.
+func (t *Table) HasSpatialIndex() bool {
+	return t.pager.header.SpatialRootPageNum != 0
+}
+
+// CreateSpatialIndex creates an empty spatial index, rows get their boxes as they are inserted.
+func (t *Table) CreateSpatialIndex(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pager := t.pager
+	if pager.readOnly {
+		return errReadOnly
+	}
+	if pager.inTxn {
+		return fmt.Errorf("cannot create a spatial index - a transaction is active")
+	}
+	if t.HasSpatialIndex() {
+		return fmt.Errorf("there is already a spatial index")
+	}
+	err := t.write(func() error {
+		pageNum, err := getUnusedPageNum(pager)
+		if err != nil {
+			return err
+		}
+		root, err := getPage(pager, pageNum)
+		if err != nil {
+			return err
+		}
+		writeSpatialNode(root, true, nil)
+		setNodeRoot(root, true)
+		markPageDirty(pager, pageNum)
+		// The header is written by the commit, along with the new root.
+		pager.header.SpatialRootPageNum = pageNum
+		return nil
+	})
+	if err != nil {
+		pager.header.SpatialRootPageNum = 0
+	}
+	return err
+}
+
+// SetBox gives the row with the id a box in the spatial index, replacing the one it had.
+func (t *Table) SetBox(ctx context.Context, id uint32, box types.Box) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.write(func() error {
+		tree := t.treeOf(id)
+		cursor, err := tableFind(tree, id)
+		if err != nil {
+			return err
+		}
+		node, err := getPage(t.pager, cursor.pageNum)
+		if err != nil {
+			return err
+		}
+		if cursor.cellNum >= binary.LittleEndian.Uint32(leafNodeNumCells(node)) ||
+			binary.LittleEndian.Uint32(leafNodeKey(node, cursor.cellNum)) != id {
+			return dberr.Errorf(dberr.ErrKeyNotFound, "key %d does not exist", id)
+		}
+		return setBox(t.pager, id, box)
+	})
+}
+
+// setBox replaces the entry of the row with the id in the spatial index.
+func setBox(pager *Pager, id uint32, box types.Box) error {
+	if pager.header.SpatialRootPageNum == 0 {
+		return fmt.Errorf("there is no spatial index, create one to give rows a box")
+	}
+	if err := spatialDelete(pager, id); err != nil {
+		return err
+	}
+	return spatialInsert(pager, spatialEntry{box: box, pointer: id})
+}
+
+// spatialInsert adds the entry of a row to the spatial index.
+func spatialInsert(pager *Pager, entry spatialEntry) error {
+	rootPageNum := pager.header.SpatialRootPageNum
+	sibling, err := spatialInsertInto(pager, rootPageNum, entry)
+	if err != nil || sibling == nil {
+		return err
+	}
+	// The root split, its entries move into a new child next to the sibling.
+	root, err := getPage(pager, rootPageNum)
+	if err != nil {
+		return err
+	}
+	isLeaf, entries := spatialNodeIsLeaf(root), spatialNodeEntries(root)
+	childPageNum, err := getUnusedPageNum(pager)
+	if err != nil {
+		return err
+	}
+	child, err := getPage(pager, childPageNum)
+	if err != nil {
+		return err
+	}
+	writeSpatialNode(child, isLeaf, entries)
+	setNodeRoot(child, false)
+	markPageDirty(pager, childPageNum)
+	writeSpatialNode(root, false, []spatialEntry{{box: boundingBox(entries), pointer: childPageNum}, *sibling})
+	markPageDirty(pager, rootPageNum)
+	return nil
+}
+
+// spatialInsertInto adds an entry to the subtree at pageNum. If the node split, it
+// returns the entry of the new node, which the caller adds next to it.
+func spatialInsertInto(pager *Pager, pageNum uint32, entry spatialEntry) (*spatialEntry, error) {
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return nil, err
+	}
+	isLeaf, entries := spatialNodeIsLeaf(node), spatialNodeEntries(node)
+	if isLeaf {
+		entries = append(entries, entry)
+	} else {
+		i := chooseSubtree(entries, entry.box)
+		sibling, err := spatialInsertInto(pager, entries[i].pointer, entry)
+		if err != nil {
+			return nil, err
+		}
+		child, err := getPage(pager, entries[i].pointer)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].box = boundingBox(spatialNodeEntries(child))
+		if sibling != nil {
+			entries = append(entries, *sibling)
+		}
+	}
+	markPageDirty(pager, pageNum)
+	if uint32(len(entries)) <= constants.SpatialNodeMaxEntries {
+		writeSpatialNode(node, isLeaf, entries)
+		return nil, nil
+	}
+	kept, moved := quadraticSplit(entries)
+	writeSpatialNode(node, isLeaf, kept)
+	siblingPageNum, err := getUnusedPageNum(pager)
+	if err != nil {
+		return nil, err
+	}
+	sibling, err := getPage(pager, siblingPageNum)
+	if err != nil {
+		return nil, err
+	}
+	writeSpatialNode(sibling, isLeaf, moved)
+	setNodeRoot(sibling, false)
+	markPageDirty(pager, siblingPageNum)
+	pager.splits++
+	return &spatialEntry{box: boundingBox(moved), pointer: siblingPageNum}, nil
+}
+
+// chooseSubtree returns the child whose box grows the least to hold box, the smallest one on a tie.
+func chooseSubtree(entries []spatialEntry, box types.Box) int {
+	best := 0
+	bestGrowth, bestArea := math.Inf(1), math.Inf(1)
+	for i, e := range entries {
+		area := boxArea(e.box)
+		growth := boxArea(boxUnion(e.box, box)) - area
+		if growth < bestGrowth || (growth == bestGrowth && area < bestArea) {
+			best, bestGrowth, bestArea = i, growth, area
+		}
+	}
+	return best
+}
+
+/*
+quadraticSplit divides the entries of an overfull node into two groups. It
+starts them with the pair of entries that would waste the most area in one
+box, then repeatedly assigns the entry with the strongest preference for one
+of the groups to the group whose box grows the least, until one group must
+take the rest to keep the minimum number of entries.
+*/
+func quadraticSplit(entries []spatialEntry) ([]spatialEntry, []spatialEntry) {
+	seedA, seedB, worst := 0, 1, math.Inf(-1)
+	for i := range entries {
+		for j := i + 1; j < len(entries); j++ {
+			waste := boxArea(boxUnion(entries[i].box, entries[j].box)) - boxArea(entries[i].box) - boxArea(entries[j].box)
+			if waste > worst {
+				seedA, seedB, worst = i, j, waste
+			}
+		}
+	}
+	a, b := []spatialEntry{entries[seedA]}, []spatialEntry{entries[seedB]}
+	boxA, boxB := entries[seedA].box, entries[seedB].box
+	rest := []spatialEntry{}
+	for i, e := range entries {
+		if i != seedA && i != seedB {
+			rest = append(rest, e)
+		}
+	}
+	for len(rest) > 0 {
+		minEntries := int(constants.SpatialNodeMinEntries)
+		if len(a)+len(rest) <= minEntries {
+			a = append(a, rest...)
+			break
+		}
+		if len(b)+len(rest) <= minEntries {
+			b = append(b, rest...)
+			break
+		}
+		pick, preference := 0, math.Inf(-1)
+		for i, e := range rest {
+			growthA := boxArea(boxUnion(boxA, e.box)) - boxArea(boxA)
+			growthB := boxArea(boxUnion(boxB, e.box)) - boxArea(boxB)
+			if d := math.Abs(growthA - growthB); d > preference {
+				pick, preference = i, d
+			}
+		}
+		e := rest[pick]
+		rest = slices.Delete(rest, pick, pick+1)
+		growthA := boxArea(boxUnion(boxA, e.box)) - boxArea(boxA)
+		growthB := boxArea(boxUnion(boxB, e.box)) - boxArea(boxB)
+		if growthA < growthB || (growthA == growthB && (boxArea(boxA) < boxArea(boxB) || (boxArea(boxA) == boxArea(boxB) && len(a) <= len(b)))) {
+			a, boxA = append(a, e), boxUnion(boxA, e.box)
+		} else {
+			b, boxB = append(b, e), boxUnion(boxB, e.box)
+		}
+	}
+	return a, b
+}
+
+// spatialDelete removes the entry of the row with the id from the spatial index, if it has one.
+func spatialDelete(pager *Pager, id uint32) error {
+	if pager.header.SpatialRootPageNum == 0 {
+		return nil
+	}
+	_, err := spatialDeleteFrom(pager, pager.header.SpatialRootPageNum, id)
+	return err
+}
+
+// spatialDeleteFrom removes the entry of the row with the id from the subtree at
+// pageNum and reports whether it was there.
+func spatialDeleteFrom(pager *Pager, pageNum uint32, id uint32) (bool, error) {
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return false, err
+	}
+	entries := spatialNodeEntries(node)
+	if spatialNodeIsLeaf(node) {
+		i := slices.IndexFunc(entries, func(e spatialEntry) bool { return e.pointer == id })
+		if i < 0 {
+			return false, nil
+		}
+		writeSpatialNode(node, true, slices.Delete(entries, i, i+1))
+		markPageDirty(pager, pageNum)
+		return true, nil
+	}
+	for i, e := range entries {
+		found, err := spatialDeleteFrom(pager, e.pointer, id)
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			continue
+		}
+		child, err := getPage(pager, e.pointer)
+		if err != nil {
+			return false, err
+		}
+		// An emptied child keeps its old box, it is found again by the next insert there.
+		if childEntries := spatialNodeEntries(child); len(childEntries) > 0 {
+			entries[i].box = boundingBox(childEntries)
+			writeSpatialNode(node, false, entries)
+			markPageDirty(pager, pageNum)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// spatialSearch returns the ids of the rows whose box lies inside box, in ascending order.
+func spatialSearch(pager *Pager, box types.Box) ([]uint32, error) {
+	ids := []uint32{}
+	var search func(pageNum uint32) error
+	search = func(pageNum uint32) error {
+		node, err := getPage(pager, pageNum)
+		if err != nil {
+			return err
+		}
+		isLeaf, entries := spatialNodeIsLeaf(node), spatialNodeEntries(node)
+		for _, e := range entries {
+			switch {
+			case isLeaf && boxContains(box, e.box):
+				ids = append(ids, e.pointer)
+			case !isLeaf && boxesOverlap(box, e.box):
+				if err := search(e.pointer); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := search(pager.header.SpatialRootPageNum); err != nil {
+		return nil, err
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// Boxes returns the box of every row that has one in the spatial index, by id.
+func (t *Table) Boxes(ctx context.Context) (map[uint32]types.Box, error) {
+	boxes := map[uint32]types.Box{}
+	if !t.HasSpatialIndex() {
+		return boxes, nil
+	}
+	var walk func(pageNum uint32) error
+	walk = func(pageNum uint32) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		node, err := getPage(t.pager, pageNum)
+		if err != nil {
+			return err
+		}
+		isLeaf, entries := spatialNodeIsLeaf(node), spatialNodeEntries(node)
+		for _, e := range entries {
+			if isLeaf {
+				boxes[e.pointer] = e.box
+			} else if err := walk(e.pointer); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(t.pager.header.SpatialRootPageNum); err != nil {
+		return nil, err
+	}
+	return boxes, nil
+}
+
+// compileWithin returns the condition of within, which looks the rows up in the spatial index once.
+func compileWithin(src rowSource, e *parser.Within) (func(values []any) bool, error) {
+	if _, ok := src.(txnSource); ok {
+		return nil, fmt.Errorf("within can not be used in a transaction, the spatial index holds the boxes as last committed")
+	}
+	t, ok := src.(*Table)
+	if !ok || !t.HasSpatialIndex() {
+		return nil, fmt.Errorf("within needs a spatial index")
+	}
+	ids, err := spatialSearch(t.pager, e.Box)
+	if err != nil {
+		return nil, err
+	}
+	return func(values []any) bool {
+		_, found := slices.BinarySearch(ids, uint32(values[0].(int64)))
+		return found
+	}, nil
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestSpatialIndex(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	execute := func(text string) ([]string, error) {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		rows := []string{}
+		_, err = table.Execute(ctx, stmt, func(values []any) error {
+			rows = append(rows, fmt.Sprint(values[0]))
+			return nil
+		})
+		return rows, err
+	}
+	if _, err := execute("insert 1 a a@x.y at (0, 0, 1, 1)"); err == nil || err.Error() != "there is no spatial index, create one to give rows a box" {
+		t.Fatalf("Expected a box to need an index. Got: %v", err)
+	}
+	if _, err := execute("select id where within(0, 0, 1, 1)"); err == nil || err.Error() != "within needs a spatial index" {
+		t.Fatalf("Expected within to need an index. Got: %v", err)
+	}
+	if _, err := execute("create spatial index"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := execute("create spatial index"); err == nil || err.Error() != "there is already a spatial index" {
+		t.Fatalf("Expected a second index to fail. Got: %v", err)
+	}
+
+	// A grid of small boxes, the cell of id i at column i%20 and row i/20.
+	boxOf := func(i int) types.Box {
+		x, y := float64(i%20), float64(i/20)
+		return types.Box{MinX: x, MinY: y, MaxX: x + 0.5, MaxY: y + 0.5}
+	}
+	for i := 0; i < 200; i++ {
+		box := boxOf(i)
+		text := fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)
+		if i%3 != 0 {
+			text += fmt.Sprintf(" at (%g, %g, %g, %g)", box.MinX, box.MinY, box.MaxX, box.MaxY)
+		}
+		if _, err := execute(text); err != nil {
+			t.Fatalf("%s failed: %v", text, err)
+		}
+	}
+	query := types.Box{MinX: 2, MinY: 3, MaxX: 5.5, MaxY: 6}
+	expected := func() []string {
+		ids := []string{}
+		for i := 0; i < 200; i++ {
+			if _, err := execute(fmt.Sprintf("select id where id = %d", i)); err == nil && i%3 != 0 && boxContains(query, boxOf(i)) {
+				ids = append(ids, fmt.Sprint(i))
+			}
+		}
+		return ids
+	}
+	scanned := table.rowsScanned
+	rows, err := execute("select id where within(2, 3, 5.5, 6)")
+	if got := table.rowsScanned - scanned; got > 20 {
+		t.Fatalf("Expected the index to find the rows without a scan. Got %d rows scanned", got)
+	}
+	if want := expected(); err != nil || !slices.Equal(rows, want) {
+		t.Fatalf("Expected %v. Got: %v, %v", want, rows, err)
+	}
+	if rows, _ := execute("select id where not within(2, 3, 5.5, 6) and id < 5"); !slices.Equal(rows, []string{"0", "1", "2", "3", "4"}) {
+		t.Fatalf("Expected the rows outside of the box. Got: %v", rows)
+	}
+
+	// Deleted rows lose their box, rolled back ones never get to keep it.
+	execute("delete 62")
+	execute("begin")
+	execute("delete 64")
+	execute("insert 1000 x x@y.z at (2, 3, 2, 3)")
+	if rows, _ := execute("select id where within(2, 3, 2.5, 3.5)"); !slices.Equal(rows, []string{"1000"}) {
+		t.Fatalf("Expected the row inserted in the transaction. Got: %v", rows)
+	}
+	execute("rollback")
+	if rows, _ := execute("select id where within(2, 3, 4.5, 3.5)"); !slices.Equal(rows, []string{"64"}) {
+		t.Fatalf("Expected the deleted row gone and the rolled back delete undone. Got: %v", rows)
+	}
+	if err := table.SetBox(ctx, 3, types.Box{MinX: -10, MinY: -10, MaxX: -9, MaxY: -9}); err != nil {
+		t.Fatalf("SetBox failed: %v", err)
+	}
+	if err := table.SetBox(ctx, 4000, types.Box{}); err == nil || err.Error() != "key 4000 does not exist" {
+		t.Fatalf("Expected a box for a missing row to fail. Got: %v", err)
+	}
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected a sound spatial index. Got: %v", problems)
+	}
+
+	table.Close()
+	table, _ = Open(dbName)
+	defer table.Close()
+	if rows, _ := execute("select id where within(-10, -10, 0, 0)"); !slices.Equal(rows, []string{"3"}) {
+		t.Fatalf("Expected the box to be kept. Got: %v", rows)
+	}
+	boxes, err := table.Boxes(ctx)
+	if err != nil || len(boxes) != 133 {
+		t.Fatalf("Expected 133 boxes. Got %d, %v", len(boxes), err)
+	}
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"encoding/binary"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// Stats counts the work done by the pager and the B-tree since the table was opened, and
+// describes the shape of the tree.
+type Stats struct {
+	PagesRead    uint64 // From the db file or the WAL.
+	PagesWritten uint64 // To the db file or the WAL, a page is written twice when it is checkpointed.
+	CacheHits    uint64
+	CacheMisses  uint64
+	Splits       uint64
+	BloomSkips   uint64 // Lookups of absent ids answered by the bloom filter without descending.
+	Rows         uint32 // The row count of the file header, see count.go.
+	ExpiringRows uint32 // Rows with a ttl among them.
+	// From the root down, the depth of the tree is their number. The trees of
+	// a partitioned table are counted together by depth.
+	Levels     []LevelStats
+	Partitions []PartitionInfo // Nil unless the table is partitioned.
+}
+
+// LevelStats describes the nodes at one depth of the tree.
+type LevelStats struct {
+	Nodes      int
+	FillFactor float64 // Fraction of the cells of the nodes that are in use.
+}
+
+// Stats walks the tree to measure its levels. The walk itself is not counted.
+func (t *Table) Stats() (Stats, error) {
+	pager := t.pager
+	stats := Stats{
+		PagesRead:    pager.pagesRead,
+		PagesWritten: pager.pagesWritten,
+		CacheHits:    pager.cacheHits,
+		CacheMisses:  pager.cacheMisses,
+		Splits:       pager.splits,
+		BloomSkips:   pager.bloomSkips,
+		Rows:         pager.header.RowCount,
+		ExpiringRows: pager.header.ExpiringRows,
+	}
+	level := []uint32{}
+	for _, p := range t.trees() {
+		level = append(level, p.tree.rootPageNum)
+	}
+	for len(level) > 0 {
+		var next []uint32
+		used, capacity := 0, 0
+		for _, pageNum := range level {
+			node, err := getPage(pager, pageNum)
+			if err != nil {
+				return Stats{}, err
+			}
+			if getNodeType(node) == types.NodeLeaf {
+				used += int(binary.LittleEndian.Uint32(leafNodeNumCells(node)))
+				capacity += int(constants.LeafNodeMaxCells)
+				continue
+			}
+			numKeys := binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+			for i := uint32(0); i < numKeys; i++ {
+				next = append(next, binary.LittleEndian.Uint32(internalNodeCell(node, i)))
+			}
+			next = append(next, binary.LittleEndian.Uint32(internalNodeRightChild(node)))
+			used += int(numKeys)
+			capacity += int(constants.InternalNodeMaxCells)
+		}
+		stats.Levels = append(stats.Levels, LevelStats{Nodes: len(level), FillFactor: float64(used) / float64(capacity)})
+		level = next
+	}
+	if t.partitions != nil {
+		partitions, err := t.Partitions()
+		if err != nil {
+			return Stats{}, err
+		}
+		stats.Partitions = partitions
+	}
+	pager.pagesRead, pager.cacheHits, pager.cacheMisses = stats.PagesRead, stats.CacheHits, stats.CacheMisses
+	return stats, nil
+}
+
+// PageInfo describes a page of the db file.
+type PageInfo struct {
+	PageNum  uint32
+	Type     string // leaf, internal or spatial.
+	IsRoot   bool
+	Parent   uint32
+	Cells    uint32 // Rows of a leaf, keys of an internal node, entries of a spatial node.
+	NextLeaf uint32 // 0 for the rightmost leaf and for internal nodes.
+}
+
+// Header returns the file header of the database.
+func (t *Table) Header() types.FileHeader {
+	return t.pager.header
+}
+
+// Pages describes every page of the db file in page order. Like Stats, reading
+// the pages is not counted.
+func (t *Table) Pages() ([]PageInfo, error) {
+	pager := t.pager
+	pagesRead, cacheHits, cacheMisses := pager.pagesRead, pager.cacheHits, pager.cacheMisses
+	defer func() {
+		pager.pagesRead, pager.cacheHits, pager.cacheMisses = pagesRead, cacheHits, cacheMisses
+	}()
+	pages := make([]PageInfo, 0, pager.numPages)
+	for pageNum := uint32(0); pageNum < pager.numPages; pageNum++ {
+		node, err := getPage(pager, pageNum)
+		if err != nil {
+			return nil, err
+		}
+		info := PageInfo{PageNum: pageNum, IsRoot: isNodeRoot(node), Parent: binary.LittleEndian.Uint32(nodeParent(node))}
+		switch getNodeType(node) {
+		case types.NodeLeaf:
+			info.Type = "leaf"
+			info.Cells = binary.LittleEndian.Uint32(leafNodeNumCells(node))
+			info.NextLeaf = binary.LittleEndian.Uint32(leafNodeNextLeaf(node))
+		case types.NodeSpatial:
+			info.Type = "spatial"
+			info.Cells = binary.LittleEndian.Uint32(node[constants.SpatialNodeNumEntriesOffset:])
+		default:
+			info.Type = "internal"
+			info.Cells = binary.LittleEndian.Uint32(internalNodeNumKeys(node))
+		}
+		pages = append(pages, info)
+	}
+	return pages, nil
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+)
+
+func TestStats(t *testing.T) {
+	table, err := Open(MemoryDbName)
+	if err != nil {
+		t.Fatalf("Failed to open in-memory db: %v", err)
+	}
+	defer table.Close()
+	for i := 1; i <= 40; i++ {
+		if err := table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d u e", i))); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	stats, err := table.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.Splits == 0 || stats.PagesWritten == 0 || stats.CacheHits == 0 {
+		t.Fatalf("Expected splits, writes and cache hits to be counted. Got: %+v", stats)
+	}
+	if len(stats.Levels) != 3 || stats.Levels[0].Nodes != 1 {
+		t.Fatalf("Expected a tree of depth 3 with a single root. Got: %+v", stats.Levels)
+	}
+	leaves := stats.Levels[len(stats.Levels)-1]
+	if cells := leaves.FillFactor * float64(leaves.Nodes) * float64(constants.LeafNodeMaxCells); math.Round(cells) != 40 {
+		t.Fatalf("Expected the leaves to hold 40 cells. Got: %v", cells)
+	}
+	again, _ := table.Stats()
+	if again.CacheHits != stats.CacheHits {
+		t.Fatalf("Expected Stats not to count its own page reads. Got %d hits, then %d", stats.CacheHits, again.CacheHits)
+	}
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Row expiration.
+
+A row inserted with a TTL stores the time it expires at. From then on it is
+gone for every reader: scans and cursors skip it, and inserting its id again
+replaces it. It still takes up its cell until it is deleted, either lazily by
+such an insert or by DeleteExpired, which a server runs periodically. On a
+table applying the writes of a replicated log, DeleteExpired only deletes
+the rows expired by the time of the last entry applied, which every node
+agrees on, rather than by its own clock.
+Deleting rows does not free the leaves they emptied, so the pages are only
+handed back by compacting the file.
+*/
+
+// expiredAt reports whether the serialized row has expired by the unix time now.
+func expiredAt(raw []byte, now int64) bool {
+	expiresAt := int64(binary.LittleEndian.Uint64(raw[constants.ExpiresAtOffset:]))
+	return expiresAt != 0 && now >= expiresAt
+}
+
+// expired reports whether the row has expired.
+func (t *Table) expired(row types.Row) bool {
+	return row.ExpiresAt != 0 && t.now().Unix() >= row.ExpiresAt
+}
+
+// expired reports whether the row under the cursor has expired.
+func (c *Cursor) expired() (bool, error) {
+	raw, err := c.value()
+	if err != nil {
+		return false, err
+	}
+	return expiredAt(raw, c.table.now().Unix()), nil
+}
+
+// DeleteExpired deletes every expired row in a single write and returns how many it deleted.
+func (t *Table) DeleteExpired(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	now := t.now().Unix()
+	if t.pager.header.AppliedIndex > 0 {
+		now = min(now, t.pager.header.AppliedTime)
+	}
+	ids := []uint32{}
+	for _, p := range t.trees() {
+		cursor, err := tableSeek(p.tree, 0)
+		if err != nil {
+			return 0, err
+		}
+		for !cursor.endOfTable {
+			raw, err := cursor.value()
+			if err != nil {
+				return 0, err
+			}
+			if expiredAt(raw, now) {
+				ids = append(ids, binary.LittleEndian.Uint32(raw[constants.IdOffset:]))
+			}
+			if err := cursor.advance(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	err := t.write(func() error {
+		for _, id := range ids {
+			if err := deleteRow(t.treeOf(id), id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestExpiredRows(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	now := time.Unix(1000, 0)
+	table.now = func() time.Time { return now }
+	run := func(text string) []string {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", text, err)
+		}
+		got := []string{}
+		_, err = table.Execute(context.Background(), stmt, func(values []any) error {
+			got = append(got, fmt.Sprint(values...))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s failed: %v", text, err)
+		}
+		return got
+	}
+	for i := 1; i <= 30; i++ {
+		ttl := ""
+		if i%3 == 0 {
+			ttl = " ttl 60"
+		}
+		run(fmt.Sprintf("insert %d u%d e%s", i, i, ttl))
+	}
+	if got := run("select count(*)"); got[0] != "30" {
+		t.Fatalf("Expected 30 rows before they expire. Got: %v", got)
+	}
+
+	now = now.Add(time.Minute)
+	if got := run("select count(*)"); got[0] != "20" {
+		t.Fatalf("Expected 20 rows once 10 expired. Got: %v", got)
+	}
+	if got := run("select id where id >= 2 and id <= 4 order by id desc"); fmt.Sprint(got) != "[4 2]" {
+		t.Fatalf("Expected the expired row to be skipped. Got: %v", got)
+	}
+	cursor := table.Cursor()
+	defer cursor.Close()
+	cursor.Seek(3)
+	if id, _ := cursor.Key(); id != 4 {
+		t.Fatalf("Expected Seek to skip the expired row. Got: %d", id)
+	}
+	cursor.Prev()
+	if id, _ := cursor.Key(); id != 2 {
+		t.Fatalf("Expected Prev to skip the expired row. Got: %d", id)
+	}
+	cursor.Last()
+	if id, _ := cursor.Key(); id != 29 {
+		t.Fatalf("Expected Last to skip the expired row. Got: %d", id)
+	}
+	cursor.Close()
+
+	// Inserting the id of an expired row replaces it.
+	run("insert 3 again e")
+	if got := run("select username where id = 3"); fmt.Sprint(got) != "[again]" {
+		t.Fatalf("Expected the expired row to be replaced. Got: %v", got)
+	}
+	n, err := table.DeleteExpired(context.Background())
+	if err != nil || n != 9 {
+		t.Fatalf("Expected 9 expired rows to be deleted. Got: %d, %v", n, err)
+	}
+	if info, _ := table.Info(); info.Rows != 21 {
+		t.Fatalf("Expected 21 rows left. Got: %d", info.Rows)
+	}
+	checkTable(t, table)
+}
@@ -0,0 +1,270 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Statements in transactions.
+
+Execute runs the statements that read and write rows, insert, delete and
+select, in a transaction of BeginTxn, which lets a server run the writes of
+its clients side by side, each waiting only for the rows it writes. set
+lock_timeout sets how long the statements of the transaction wait for a row
+lock from then on, and set isolation level its isolation level, before its
+first read or write. A select
+sees the rows as the transaction does, along with its writes, so it reads
+them by id: the indexes hold the rows as last committed. The generated
+columns of the rows are computed from their expressions, the stored values
+of rows not committed yet do not exist.
+
+A failed statement undoes its writes, but the locks it took are kept until
+the transaction ends. The unique index is checked when a row is inserted,
+against the rows the transaction sees and those it wrote, and again by the
+commit, against the rows committed by then.
+
+The other statements change the table rather than rows, and run on the
+table itself, see Exclusive.
+*/
+
+// Execute runs an insert, delete or select in the transaction, like Table.Execute.
+func (txn *Txn) Execute(ctx context.Context, stmt parser.Statement, fn func(values []any) error) (ExecResult, error) {
+	if err := ctx.Err(); err != nil {
+		return ExecResult{}, err
+	}
+	if txn.done {
+		return ExecResult{}, errTxnDone
+	}
+	t := txn.table
+	err := txn.onTree(func() error {
+		t.statements++
+		if privilege := RequiredPrivilege(stmt); privilege != "" {
+			return t.CheckPrivilege(ctx, privilege)
+		}
+		return nil
+	})
+	if err != nil {
+		return ExecResult{}, err
+	}
+	switch s := stmt.(type) {
+	case *parser.Insert:
+		return txn.executeInsert(ctx, s, fn)
+	case *parser.Delete:
+		if err := txn.Delete(ctx, s.Id); err != nil {
+			return ExecResult{}, err
+		}
+		return ExecResult{RowsAffected: 1}, nil
+	case *parser.Select:
+		if s.From != "" {
+			return ExecResult{}, fmt.Errorf("views can not be read in a transaction, they hold the rows as last committed")
+		}
+		return ExecResult{}, executeSelect(ctx, txnSource{txn}, s, fn)
+	case *parser.Set:
+		if s.Name == "isolation" {
+			return ExecResult{}, txn.SetIsolation(s.Level)
+		}
+		txn.SetLockTimeout(s.Timeout)
+		return ExecResult{}, nil
+	}
+	return ExecResult{}, fmt.Errorf("only insert, delete, select and set can run in a transaction")
+}
+
+// onTree runs fn while the transaction holds the tree.
+func (txn *Txn) onTree(fn func() error) error {
+	txn.table.locks.tree.Lock()
+	defer txn.table.locks.tree.Unlock()
+	defer pagerEvict(txn.table.pager)
+	return fn()
+}
+
+// executeInsert adds the row of an insert statement to the transaction, see Table.executeInsert.
+func (txn *Txn) executeInsert(ctx context.Context, stmt *parser.Insert, fn func(values []any) error) (ExecResult, error) {
+	t := txn.table
+	var names []string
+	err := txn.onTree(func() error {
+		names, _ = t.columns()
+		if stmt.Box != nil && !t.HasSpatialIndex() {
+			return fmt.Errorf("there is no spatial index, create one to give rows a box")
+		}
+		return nil
+	})
+	if err != nil {
+		return ExecResult{}, err
+	}
+	for _, column := range stmt.Returning {
+		if column != "*" && !slices.Contains(names, column) {
+			return ExecResult{}, fmt.Errorf("no such column: %s", column)
+		}
+	}
+	row := insertedRow(stmt)
+	if stmt.TTL > 0 {
+		row.ExpiresAt = t.now().Unix() + stmt.TTL
+	}
+	result := ExecResult{RowsAffected: 1, Insert: Inserted}
+	written := len(txn.writes)
+	err = func() error {
+		if stmt.Conflict == "replace" {
+			err := txn.Delete(ctx, row.Id)
+			if err != nil && !errors.Is(err, dberr.ErrKeyNotFound) {
+				return err
+			}
+			if err == nil {
+				result.Insert = Replaced
+			}
+		}
+		err := txn.write(ctx, txnWrite{row: row, box: stmt.Box}, func(exists bool) error {
+			if exists {
+				return dberr.ErrDuplicateKey
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return txn.checkUnique(row)
+	}()
+	if err != nil {
+		txn.undo(written)
+	}
+	if stmt.Conflict == "ignore" && errors.Is(err, dberr.ErrDuplicateKey) {
+		return ExecResult{Insert: Ignored}, nil
+	}
+	if err != nil {
+		return ExecResult{}, err
+	}
+	if stmt.Returning == nil {
+		return result, nil
+	}
+	var values []any
+	txn.onTree(func() error {
+		values = computeGenerated(t.pager, rowValues(row))
+		return nil
+	})
+	return result, returnRow(stmt.Returning, names, values, fn)
+}
+
+// undo drops the writes made after the first n, those of a statement that failed.
+func (txn *Txn) undo(n int) {
+	txn.writes = txn.writes[:n]
+	clear(txn.rows)
+	for i, w := range txn.writes {
+		txn.rows[w.row.Id] = nil
+		if !w.deleted {
+			txn.rows[w.row.Id] = &txn.writes[i].row
+		}
+	}
+}
+
+// checkUnique fails with dberr.ErrDuplicateKey if another row the transaction
+// sees has the value of row in the column of the unique index.
+func (txn *Txn) checkUnique(row types.Row) error {
+	t := txn.table
+	return txn.onTree(func() error {
+		pager := t.pager
+		if pager.header.UniqueRootPageNum == 0 {
+			return nil
+		}
+		column := pager.header.UniqueColumn
+		value := computeGenerated(pager, rowValues(row))[column]
+		if value == nil {
+			return nil
+		}
+		ids, err := uniqueLookup(pager, value)
+		if err != nil {
+			return err
+		}
+		others := map[uint32]*types.Row{}
+		for _, id := range ids {
+			if others[id], err = committedRow(t, id); err != nil {
+				return err
+			}
+		}
+		maps.Copy(others, txn.rows)
+		collation := uniqueCollation(pager)
+		for _, id := range slices.Sorted(maps.Keys(others)) {
+			if others[id] == nil || id == row.Id {
+				continue
+			}
+			otherValue := computeGenerated(pager, rowValues(*others[id]))[column]
+			if otherValue != nil && collation.compare(value, otherValue) == 0 {
+				names, _ := t.columns()
+				return dberr.Errorf(dberr.ErrDuplicateKey, "duplicate %s %s, row %d has %s", names[column], quoteValue(value), id, quoteValue(otherValue))
+			}
+		}
+		return nil
+	})
+}
+
+// computeGenerated appends the values of the generated columns to the values
+// of a row, computing the stored ones as well.
+func computeGenerated(pager *Pager, values []any) []any {
+	row := values[:len(columnNames)]
+	for _, column := range pager.generated {
+		values = append(values, column.value(row))
+	}
+	return values
+}
+
+// txnSource is what a select in a transaction reads rows from.
+type txnSource struct {
+	txn *Txn
+}
+
+func (s txnSource) scanWhere(ctx context.Context, where *filter, desc bool, fn func(values []any) error) error {
+	if where.from > where.to {
+		return nil
+	}
+	rows := []types.Row{}
+	err := s.txn.Scan(ctx, where.from, where.to, func(row types.Row) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if desc {
+		slices.Reverse(rows)
+	}
+	matched := [][]any{}
+	s.txn.onTree(func() error {
+		for _, row := range rows {
+			if values := computeGenerated(s.txn.table.pager, rowValues(row)); where.match(values) {
+				matched = append(matched, values)
+			}
+		}
+		return nil
+	})
+	// fn may use the transaction, so it is called once the tree was let go.
+	for _, values := range matched {
+		if err := fn(values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s txnSource) columns() ([]string, []string) {
+	var names, valueTypes []string
+	s.txn.onTree(func() error {
+		names, valueTypes = s.txn.table.columns()
+		return nil
+	})
+	return names, valueTypes
+}
+
+func (s txnSource) collation(column string) Collation {
+	var collation Collation
+	s.txn.onTree(func() error {
+		collation = s.txn.table.collation(column)
+		return nil
+	})
+	return collation
+}
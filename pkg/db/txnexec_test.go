@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestTxnExecute(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	ctx := context.Background()
+	execute := func(run func(ctx context.Context, stmt parser.Statement, fn func(values []any) error) (ExecResult, error), text string) ([]string, ExecResult, error) {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		rows := []string{}
+		result, err := run(ctx, stmt, func(values []any) error {
+			rows = append(rows, fmt.Sprint(values...))
+			return nil
+		})
+		return rows, result, err
+	}
+	for _, text := range []string{"insert 1 alice a@example.com", "insert 2 bob b@example.com", "create unique index on username", "add column upper as (upper(username)) stored"} {
+		if _, _, err := execute(table.Execute, text); err != nil {
+			t.Fatalf("%s failed: %v", text, err)
+		}
+	}
+
+	txn, _ := table.BeginTxn(ctx)
+	for _, test := range []struct {
+		statement string
+		rows      []string
+		result    ExecResult
+	}{
+		{"insert 3 carol c@example.com returning id, upper", []string{"3CAROL"}, ExecResult{RowsAffected: 1, Insert: Inserted}},
+		{"delete 1", []string{}, ExecResult{RowsAffected: 1}},
+		{"insert or replace 2 bobby b@example.com", []string{}, ExecResult{RowsAffected: 1, Insert: Replaced}},
+		// The value of the unique index is taken by a row of the transaction.
+		{"insert or ignore 4 carol d@example.com", []string{}, ExecResult{Insert: Ignored}},
+		// alice was deleted, which frees her name.
+		{"insert 5 alice e@example.com", []string{}, ExecResult{RowsAffected: 1, Insert: Inserted}},
+		{"select id, upper where username like '%b%' or id > 4 order by id desc", []string{"5ALICE", "2BOBBY"}, ExecResult{}},
+	} {
+		rows, result, err := execute(txn.Execute, test.statement)
+		if err != nil || !slices.Equal(rows, test.rows) || result != test.result {
+			t.Errorf("%s: expected %v %+v. Got: %v %+v, %v", test.statement, test.rows, test.result, rows, result, err)
+		}
+	}
+	if _, _, err := execute(txn.Execute, "insert 6 bobby f@example.com"); !errors.Is(err, dberr.ErrDuplicateKey) {
+		t.Fatalf("Expected the unique index to fail the insert. Got: %v", err)
+	}
+	if _, _, err := execute(txn.Execute, "create index on id desc"); err == nil {
+		t.Fatalf("Expected a statement changing the table to fail in a transaction")
+	}
+	if rows, _, _ := execute(table.Execute, "select id"); !slices.Equal(rows, []string{"1", "2"}) {
+		t.Fatalf("Expected nothing written before the commit. Got: %v", rows)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if rows, _, _ := execute(table.Execute, "select id, username, upper"); !slices.Equal(rows, []string{"2bobbyBOBBY", "3carolCAROL", "5aliceALICE"}) {
+		t.Fatalf("Expected the rows of the transaction. Got: %v", rows)
+	}
+}
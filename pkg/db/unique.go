@@ -0,0 +1,306 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Unique index.
+
+A unique index keeps two rows from having values of a column that compare
+equal by the collation of the index, so that with create unique index on
+username collate nocase, 'Alice' and 'alice' collide. The file header names
+the column and the collation and lists the root of a B-tree keyed by a hash
+of the collation's key of a value, which holds the ids of the rows whose
+values have that hash. An insert reads the rows under the hash of its value
+and fails if one of them has an equal value; rows that expired do not count,
+as they are gone for every reader. Null values are not indexed.
+
+Its pages go through the pager like those of the table, so the index commits
+and rolls back with the rows it belongs to. A table has at most one unique
+index.
+*/
+
+// UniqueIndex returns the column the unique index is on and the collation it
+// compares values by, and false if there is no unique index.
+func (t *Table) UniqueIndex() (string, string, bool) {
+	header := &t.pager.header
+	if header.UniqueRootPageNum == 0 {
+		return "", "", false
+	}
+	names, _ := t.columns()
+	collation := header.UniqueCollation
+	if collation == "" {
+		collation = "binary"
+	}
+	return names[header.UniqueColumn], collation, true
+}
+
+/*
+CreateUniqueIndex creates a unique index on a column, comparing values by the
+collation, or by the collation of the column if it is empty. It fails if rows
+already in the table have equal values.
+*/
+func (t *Table) CreateUniqueIndex(ctx context.Context, column string, collation string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pager := t.pager
+	if pager.readOnly {
+		return errReadOnly
+	}
+	if pager.inTxn {
+		return fmt.Errorf("cannot create a unique index - a transaction is active")
+	}
+	if existing, _, ok := t.UniqueIndex(); ok {
+		return fmt.Errorf("there is already a unique index on %s", existing)
+	}
+	names, valueTypes := t.columns()
+	index := slices.Index(names, column)
+	if index < 0 {
+		return fmt.Errorf("no such column: %s", column)
+	}
+	collation = strings.ToLower(collation)
+	if collation == "" {
+		collation = pager.header.Collations[index]
+	} else if valueTypes[index] != "text" {
+		return fmt.Errorf("a collation orders text, but %s is %s", column, valueTypes[index])
+	} else if _, ok := lookupCollation(collation); !ok {
+		return fmt.Errorf("unknown collation: %s", collation)
+	}
+	if collation == "binary" {
+		collation = ""
+	}
+	err := t.write(func() error {
+		pageNum, err := getUnusedPageNum(pager)
+		if err != nil {
+			return err
+		}
+		root, err := getPage(pager, pageNum)
+		if err != nil {
+			return err
+		}
+		initializeLeafNode(root)
+		setNodeRoot(root, true)
+		markPageDirty(pager, pageNum)
+		// The header is written by the commit, along with the tree.
+		pager.header.UniqueRootPageNum = pageNum
+		pager.header.UniqueColumn = uint32(index)
+		pager.header.UniqueCollation = collation
+		rows := []types.Row{}
+		err = t.Scan(ctx, func(row types.Row) error {
+			rows = append(rows, row)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := range rows {
+			if err := uniqueInsert(t, &rows[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		pager.header.UniqueRootPageNum, pager.header.UniqueColumn, pager.header.UniqueCollation = 0, 0, ""
+	}
+	return err
+}
+
+// uniqueTree returns the tree of the unique index.
+func uniqueTree(pager *Pager) *Table {
+	return &Table{
+		pager:       pager,
+		rootPageNum: pager.header.UniqueRootPageNum,
+		logger:      pager.logger,
+		now:         time.Now,
+		auxiliary:   true,
+	}
+}
+
+// uniqueCollation returns the collation the unique index compares values by.
+func uniqueCollation(pager *Pager) Collation {
+	name := pager.header.UniqueCollation
+	if name == "" {
+		name = "binary"
+	}
+	collation, _ := lookupCollation(name)
+	return collation
+}
+
+// uniqueValue returns the value of a row in the column of the unique index.
+func uniqueValue(pager *Pager, row types.Row) (any, error) {
+	values, err := appendGenerated(pager, rowValues(row))
+	if err != nil {
+		return nil, err
+	}
+	return values[pager.header.UniqueColumn], nil
+}
+
+// uniqueHash returns the key in the tree of the unique index of the values
+// the collation considers equal to value.
+func uniqueHash(collation Collation, value any) uint32 {
+	h := fnv.New32a()
+	fmt.Fprint(h, collation.groupKey(value))
+	return h.Sum32()
+}
+
+// uniqueIds returns the ids of the rows whose values have the hash.
+func uniqueIds(tree *Table, hash uint32) ([]uint32, error) {
+	values, _, err := storedValues(tree, hash)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint32, 0, len(values))
+	for _, value := range values {
+		ids = append(ids, uint32(value.(int64)))
+	}
+	return ids, nil
+}
+
+// uniqueLookup returns the ids of the rows whose value in the column of the unique
+// index may equal value by its collation, in ascending order: those of the rows whose
+// values share its hash, expired or not.
+func uniqueLookup(pager *Pager, value any) ([]uint32, error) {
+	ids, err := uniqueIds(uniqueTree(pager), uniqueHash(uniqueCollation(pager), value))
+	slices.Sort(ids)
+	return ids, err
+}
+
+// setUniqueIds replaces the ids of the rows whose values have the hash.
+func setUniqueIds(tree *Table, hash uint32, ids []uint32) error {
+	if _, found, err := storedValues(tree, hash); err != nil {
+		return err
+	} else if found {
+		if err := deleteRow(tree, hash); err != nil {
+			return err
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	values := make([]any, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, int64(id))
+	}
+	packed, err := packRow(hash, values)
+	if err != nil {
+		return fmt.Errorf("too many values of the unique index share a hash: %w", err)
+	}
+	return insertRow(tree, &packed)
+}
+
+// uniqueRow returns the row with the id, looked up in the partition the file header lists for it.
+func uniqueRow(table *Table, id uint32) (types.Row, bool, error) {
+	pager := table.pager
+	tree := &Table{pager: pager, rootPageNum: pager.header.RootPageNum, logger: pager.logger, now: table.now}
+	for _, p := range pager.header.Partitions {
+		if id >= p.From {
+			tree.rootPageNum = p.RootPageNum
+		}
+	}
+	cursor, err := tableFind(tree, id)
+	if err != nil {
+		return types.Row{}, false, err
+	}
+	node, err := getPage(pager, cursor.pageNum)
+	if err != nil {
+		return types.Row{}, false, err
+	}
+	if cursor.cellNum >= binary.LittleEndian.Uint32(leafNodeNumCells(node)) ||
+		binary.LittleEndian.Uint32(leafNodeKey(node, cursor.cellNum)) != id {
+		return types.Row{}, false, nil
+	}
+	return deserializeRow(leafNodeValue(node, cursor.cellNum)), true, nil
+}
+
+// uniqueInsert adds a row being inserted to the unique index, failing if a row
+// that has not expired has a value equal to the row's.
+func uniqueInsert(table *Table, row *types.Row) error {
+	pager := table.pager
+	if pager.header.UniqueRootPageNum == 0 {
+		return nil
+	}
+	value, err := uniqueValue(pager, *row)
+	if err != nil || value == nil {
+		return err
+	}
+	collation := uniqueCollation(pager)
+	tree := uniqueTree(pager)
+	hash := uniqueHash(collation, value)
+	ids, err := uniqueIds(tree, hash)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		other, found, err := uniqueRow(table, id)
+		if err != nil {
+			return err
+		}
+		if !found || table.expired(other) {
+			continue
+		}
+		otherValue, err := uniqueValue(pager, other)
+		if err != nil {
+			return err
+		}
+		if otherValue != nil && collation.compare(value, otherValue) == 0 {
+			names, _ := table.columns()
+			return dberr.Errorf(dberr.ErrDuplicateKey, "duplicate %s %s, row %d has %s", names[pager.header.UniqueColumn], quoteValue(value), id, quoteValue(otherValue))
+		}
+	}
+	return setUniqueIds(tree, hash, append(ids, row.Id))
+}
+
+// uniqueDelete removes a row being deleted from the unique index.
+func uniqueDelete(pager *Pager, row types.Row) error {
+	if pager.header.UniqueRootPageNum == 0 {
+		return nil
+	}
+	value, err := uniqueValue(pager, row)
+	if err != nil || value == nil {
+		return err
+	}
+	tree := uniqueTree(pager)
+	hash := uniqueHash(uniqueCollation(pager), value)
+	ids, err := uniqueIds(tree, hash)
+	if err != nil {
+		return err
+	}
+	return setUniqueIds(tree, hash, slices.DeleteFunc(ids, func(id uint32) bool { return id == row.Id }))
+}
+
+// quoteValue formats a value the way a statement writes it.
+func quoteValue(value any) string {
+	if s, ok := value.(string); ok {
+		return parser.Quote(s)
+	}
+	return fmt.Sprint(value)
+}
+
+// checkUniqueIndex verifies that the collation of the unique index is registered
+// and the column it is on exists.
+func (t *Table) checkUniqueIndex() error {
+	header := &t.pager.header
+	if header.UniqueRootPageNum == 0 {
+		return nil
+	}
+	if names, _ := t.columns(); header.UniqueColumn >= uint32(len(names)) {
+		return fmt.Errorf("the unique index is on column %d, which does not exist", header.UniqueColumn)
+	}
+	if _, ok := lookupCollation(header.UniqueCollation); header.UniqueCollation != "" && !ok {
+		return fmt.Errorf("unknown collation %s, register it before opening the database", header.UniqueCollation)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestUniqueIndex(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	execute := func(text string) error {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		_, err = table.Execute(ctx, stmt, func(values []any) error { return nil })
+		return err
+	}
+	execute("insert 1 Alice alice@x.org")
+	execute("insert 2 bob bob@x.org")
+	execute("insert 3 ALICE alice2@x.org")
+	if err := execute("create unique index on username collate nocase"); err == nil || err.Error() != "duplicate username 'ALICE', row 1 has 'Alice'" {
+		t.Fatalf("Expected the existing duplicates to fail the index. Got: %v", err)
+	}
+	if _, _, ok := table.UniqueIndex(); ok {
+		t.Fatalf("Expected no unique index after creating it failed")
+	}
+	execute("delete 3")
+	if err := execute("create unique index on username collate nocase"); err != nil {
+		t.Fatalf("Creating the unique index failed: %v", err)
+	}
+	if err := execute("insert 4 alice a@x.org"); err == nil || err.Error() != "duplicate username 'alice', row 1 has 'Alice'" {
+		t.Fatalf("Expected alice to collide with Alice. Got: %v", err)
+	}
+	if err := execute("create unique index on email"); err == nil {
+		t.Fatalf("Expected a second unique index to fail")
+	}
+
+	// Within a transaction the rows inserted earlier count, and a rollback forgets them.
+	table.Begin()
+	if err := execute("insert 5 carol carol@x.org"); err != nil {
+		t.Fatalf("Inserting carol failed: %v", err)
+	}
+	if err := execute("insert 6 Carol carol2@x.org"); err == nil {
+		t.Fatalf("Expected Carol to collide with carol in the transaction")
+	}
+	table.Rollback()
+	if err := execute("insert 6 Carol carol2@x.org"); err != nil {
+		t.Fatalf("Expected Carol to be free after the rollback. Got: %v", err)
+	}
+
+	// Deleting or expiring a row frees its value.
+	execute("delete 1")
+	if err := execute("insert 7 alice a@x.org ttl 1"); err != nil {
+		t.Fatalf("Expected alice to be free after deleting Alice. Got: %v", err)
+	}
+	now := time.Now()
+	table.now = func() time.Time { return now.Add(time.Minute) }
+	if err := execute("insert 8 ALICE a@x.org"); err != nil {
+		t.Fatalf("Expected ALICE to be free after alice expired. Got: %v", err)
+	}
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected no problems. Got: %v", problems)
+	}
+
+	table.Close()
+	table, _ = Open(dbName)
+	defer table.Close()
+	if column, collation, ok := table.UniqueIndex(); !ok || column != "username" || collation != "nocase" {
+		t.Fatalf("Expected the unique index to be kept. Got: %s, %s, %t", column, collation, ok)
+	}
+	if err := execute("insert 9 BOB b@x.org"); err == nil {
+		t.Fatalf("Expected BOB to collide with bob after reopening")
+	}
+	rows := []types.Row{{Id: 10}, {Id: 11}}
+	copy(rows[0].Username[:], "dave")
+	copy(rows[1].Username[:], "Dave")
+	_, err := table.BulkLoad(ctx, func() (types.Row, error) {
+		if len(rows) == 0 {
+			return types.Row{}, io.EOF
+		}
+		row := rows[0]
+		rows = rows[1:]
+		return row, nil
+	})
+	if err == nil {
+		t.Fatalf("Expected the bulk load to fail on Dave")
+	}
+	if err := execute("insert 12 DAVE d@x.org"); err != nil {
+		t.Fatalf("Expected the failed bulk load to leave no trace. Got: %v", err)
+	}
+}
@@ -0,0 +1,373 @@
+package db
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+User accounts.
+
+The accounts clients sign in to a server with are kept in a system table of
+the db file, a B-tree at UsersRootPageNum with a row per account packed by
+packRow: its name, the salt and hash of its password and its privileges. So
+they are written through the WAL, copied by Backup and encrypted with the
+rest of the database. Passwords are stored as salted PBKDF2 hashes, derived
+like encryption keys. A database without accounts needs no password. The
+accounts are few, so every change rewrites the table in name order, and they
+are read on every sign in, so a running server sees accounts added after it
+started. Reading them reads pages, so a server reads them within Exclusive,
+while deriving the key of a password to compare does not need the table, see
+Password.
+
+Each account also holds the privileges grant and revoke give it, which decide
+the statements it may run: read for select, write for insert and delete, and
+admin for grant, revoke, partition by and indexes. A new account may read
+and write. Execute checks them for the user in its context, see WithUser, so a
+server only has to say who signed in. Without a user in the context, as in the REPL, everything is
+allowed. Once there are several tables, grants will name the tables too.
+*/
+
+// ErrPermissionDenied is returned, wrapped, for statements the user lacks the privilege for.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// defaultPrivileges are the privileges of a new account.
+var defaultPrivileges = []string{"read", "write"}
+
+// maxUserNameLength limits user names, which must also be free of colons for HTTP basic auth.
+const maxUserNameLength = 64
+
+type userAccount struct {
+	name       string
+	salt       []byte
+	hash       []byte
+	privileges []string
+}
+
+// userKey is the context key of the user a statement runs for.
+type userKey struct{}
+
+// WithUser returns a context for running statements on behalf of the user,
+// whose privileges Execute checks.
+func WithUser(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, userKey{}, name)
+}
+
+// UserFrom returns the user set with WithUser, if any.
+func UserFrom(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(userKey{}).(string)
+	return name, ok
+}
+
+// usersTree returns the tree of the accounts.
+func usersTree(pager *Pager) *Table {
+	return &Table{
+		pager:       pager,
+		rootPageNum: pager.header.UsersRootPageNum,
+		logger:      pager.logger,
+		now:         time.Now,
+		auxiliary:   true,
+	}
+}
+
+func (t *Table) readUsers() ([]userAccount, error) {
+	if t.pager.header.UsersRootPageNum == 0 {
+		return nil, nil
+	}
+	users := []userAccount{}
+	err := usersTree(t.pager).scanRange(context.Background(), 0, math.MaxUint32, func(row types.Row) error {
+		values := unpackRow(row)
+		if len(values) != 4 {
+			return fmt.Errorf("account %d holds %d values, expected 4", row.Id, len(values))
+		}
+		user := userAccount{
+			name:       values[0].(string),
+			salt:       []byte(values[1].(string)),
+			hash:       []byte(values[2].(string)),
+			privileges: strings.Fields(values[3].(string)),
+		}
+		users = append(users, user)
+		return nil
+	})
+	return users, err
+}
+
+// writeUsers replaces the accounts, in the transaction of the statement if there is one.
+func (t *Table) writeUsers(users []userAccount) error {
+	pager := t.pager
+	if pager.header.UsersRootPageNum == 0 && pager.inTxn {
+		// Rolling back would leave the header with the root of a tree that is gone.
+		return fmt.Errorf("cannot add the first user - a transaction is active")
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].name < users[j].name })
+	oldRoot := pager.header.UsersRootPageNum
+	err := t.write(func() error {
+		if pager.header.UsersRootPageNum == 0 {
+			pageNum, err := getUnusedPageNum(pager)
+			if err != nil {
+				return err
+			}
+			root, err := getPage(pager, pageNum)
+			if err != nil {
+				return err
+			}
+			initializeLeafNode(root)
+			setNodeRoot(root, true)
+			markPageDirty(pager, pageNum)
+			// The header is written by the commit, along with the tree.
+			pager.header.UsersRootPageNum = pageNum
+		}
+		tree := usersTree(pager)
+		old := []uint32{}
+		err := tree.scanKeys(context.Background(), 0, math.MaxUint32, false, func(key uint32) error {
+			old = append(old, key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range old {
+			if err := deleteRow(tree, key); err != nil {
+				return err
+			}
+		}
+		for i, user := range users {
+			values := []any{user.name, string(user.salt), string(user.hash), strings.Join(user.privileges, " ")}
+			row, err := packRow(uint32(i), values)
+			if err != nil {
+				return err
+			}
+			if err := insertRow(tree, &row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		pager.header.UsersRootPageNum = oldRoot
+	}
+	return err
+}
+
+// Users returns the names of the accounts in alphabetical order.
+func (t *Table) Users() ([]string, error) {
+	users, err := t.readUsers()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, user := range users {
+		names = append(names, user.name)
+	}
+	return names, nil
+}
+
+// AddUser adds an account, or sets the password of an existing one.
+func (t *Table) AddUser(name string, password string) error {
+	if t.pager.readOnly {
+		return errReadOnly
+	}
+	if name == "" || len(name) > maxUserNameLength || strings.ContainsAny(name, ":\x00") {
+		return fmt.Errorf("user names must have 1 to %d characters and no colons", maxUserNameLength)
+	}
+	if password == "" {
+		return fmt.Errorf("the password must not be empty")
+	}
+	users, err := t.readUsers()
+	if err != nil {
+		return err
+	}
+	account := userAccount{name: name, salt: make([]byte, constants.KeySaltSize)}
+	if _, err := rand.Read(account.salt); err != nil {
+		return err
+	}
+	account.hash = deriveKey(password, account.salt)
+	account.privileges = defaultPrivileges
+	if i := slices.IndexFunc(users, func(user userAccount) bool { return user.name == name }); i >= 0 {
+		// A new password keeps the privileges.
+		account.privileges = users[i].privileges
+	}
+	users = deleteUser(users, name)
+	return t.writeUsers(append(users, account))
+}
+
+// RemoveUser deletes an account.
+func (t *Table) RemoveUser(name string) error {
+	if t.pager.readOnly {
+		return errReadOnly
+	}
+	users, err := t.readUsers()
+	if err != nil {
+		return err
+	}
+	remaining := deleteUser(users, name)
+	if len(remaining) == len(users) {
+		return fmt.Errorf("no such user: %s", name)
+	}
+	return t.writeUsers(remaining)
+}
+
+// CopyUsers adds the accounts of the table to another, keeping their
+// passwords and privileges, as compacting a database does.
+func (t *Table) CopyUsers(to *Table) error {
+	users, err := t.readUsers()
+	if err != nil || len(users) == 0 {
+		return err
+	}
+	return to.writeUsers(users)
+}
+
+// Privileges returns the privileges of an account, in the order of parser.Privileges.
+func (t *Table) Privileges(name string) ([]string, error) {
+	users, err := t.readUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.name == name {
+			return user.privileges, nil
+		}
+	}
+	return nil, fmt.Errorf("no such user: %s", name)
+}
+
+// Grant gives an account privileges, which it keeps until they are revoked.
+// Like the rows, the accounts are written in the transaction of the statement,
+// so rolling it back undoes the grant.
+func (t *Table) Grant(name string, privileges []string) error {
+	return t.changePrivileges(name, func(current []string) []string {
+		return slices.DeleteFunc(slices.Clone(parser.Privileges), func(privilege string) bool {
+			return !slices.Contains(current, privilege) && !slices.Contains(privileges, privilege)
+		})
+	})
+}
+
+// Revoke takes privileges away from an account.
+func (t *Table) Revoke(name string, privileges []string) error {
+	return t.changePrivileges(name, func(current []string) []string {
+		return slices.DeleteFunc(slices.Clone(current), func(privilege string) bool {
+			return slices.Contains(privileges, privilege)
+		})
+	})
+}
+
+// changePrivileges replaces the privileges of an account with what change returns.
+func (t *Table) changePrivileges(name string, change func(current []string) []string) error {
+	if t.pager.readOnly {
+		return errReadOnly
+	}
+	users, err := t.readUsers()
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		if users[i].name == name {
+			users[i].privileges = change(users[i].privileges)
+			return t.writeUsers(users)
+		}
+	}
+	return fmt.Errorf("no such user: %s", name)
+}
+
+// CheckPrivilege returns an error unless the user in ctx has the privilege.
+// Without a user in ctx it always succeeds.
+func (t *Table) CheckPrivilege(ctx context.Context, privilege string) error {
+	name, ok := UserFrom(ctx)
+	if !ok {
+		return nil
+	}
+	privileges, err := t.Privileges(name)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(privileges, privilege) {
+		return fmt.Errorf("%w: %s does not have the %s privilege", ErrPermissionDenied, name, privilege)
+	}
+	return nil
+}
+
+// RequiredPrivilege returns the privilege running a statement takes, "" if it takes none.
+func RequiredPrivilege(stmt parser.Statement) string {
+	switch stmt.(type) {
+	case *parser.Select:
+		return "read"
+	case *parser.Insert, *parser.Delete, *parser.RefreshView:
+		return "write"
+	case *parser.Grant, *parser.Revoke, *parser.Partition, *parser.CreateFulltextIndex, *parser.DropFulltextIndex,
+		*parser.CreateSpatialIndex, *parser.CreateUniqueIndex, *parser.CreateIndex, *parser.CreateView, *parser.AddColumn, *parser.Collate,
+		*parser.Analyze:
+		return "admin"
+	}
+	return ""
+}
+
+func deleteUser(users []userAccount, name string) []userAccount {
+	remaining := []userAccount{}
+	for _, user := range users {
+		if user.name != name {
+			remaining = append(remaining, user)
+		}
+	}
+	return remaining
+}
+
+// AuthRequired reports whether clients must sign in, which they must once there is an account.
+func (t *Table) AuthRequired() (bool, error) {
+	users, err := t.readUsers()
+	return len(users) > 0, err
+}
+
+// unknownUserSalt is what the password of a name without an account is derived
+// with, so signing in takes as long whether or not the account exists.
+var unknownUserSalt = make([]byte, constants.KeySaltSize)
+
+// Password is the hashed password of an account, see Table.Password.
+type Password struct {
+	salt  []byte
+	hash  []byte
+	found bool
+}
+
+// Matches reports whether password is the one hashed. It derives the key of
+// password whether or not the account exists, so both take as long.
+func (p Password) Matches(password string) bool {
+	return hmac.Equal(deriveKey(password, p.salt), p.hash) && p.found
+}
+
+// Password returns the hashed password of an account, which does not match
+// any password if there is no such account. Only reading it takes the table,
+// a server compares passwords with Matches without holding up statements.
+func (t *Table) Password(name string) (Password, error) {
+	users, err := t.readUsers()
+	if err != nil {
+		return Password{}, err
+	}
+	password := Password{salt: unknownUserSalt}
+	for _, user := range users {
+		if user.name == name {
+			password = Password{salt: user.salt, hash: user.hash, found: true}
+		}
+	}
+	return password, nil
+}
+
+// Authenticate reports whether the account exists and has the password.
+func (t *Table) Authenticate(name string, password string) (bool, error) {
+	hashed, err := t.Password(name)
+	if err != nil {
+		return false, err
+	}
+	return hashed.Matches(password), nil
+}
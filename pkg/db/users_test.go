@@ -0,0 +1,154 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestUsers(t *testing.T) {
+	table, dbName := openTestDb(t)
+	if required, err := table.AuthRequired(); required || err != nil {
+		t.Fatalf("Expected no sign in without accounts. Got: %v, %v", required, err)
+	}
+	table.AddUser("bob", "pw1")
+	table.AddUser("alice", "pw2")
+	table.AddUser("bob", "pw3")
+	if users, _ := table.Users(); !slices.Equal(users, []string{"alice", "bob"}) {
+		t.Fatalf("Expected alice and bob. Got: %v", users)
+	}
+	if required, _ := table.AuthRequired(); !required {
+		t.Fatalf("Expected sign in to be required.")
+	}
+	for _, test := range []struct {
+		name, password string
+		ok             bool
+	}{
+		{"bob", "pw3", true}, {"bob", "pw1", false}, {"alice", "pw2", true}, {"carol", "pw2", false},
+	} {
+		if ok, err := table.Authenticate(test.name, test.password); ok != test.ok || err != nil {
+			t.Fatalf("Authenticate(%s, %s): expected %v. Got: %v, %v", test.name, test.password, test.ok, ok, err)
+		}
+	}
+	if problems := integrityCheck(table); len(problems) > 0 {
+		t.Fatalf("Expected the accounts tree to be sound. Got: %v", problems)
+	}
+	if err := table.AddUser("a:b", "pw"); err == nil {
+		t.Fatalf("Expected a user name with a colon to be refused.")
+	}
+	if err := table.RemoveUser("bob"); err != nil {
+		t.Fatalf("RemoveUser failed: %v", err)
+	}
+	if err := table.RemoveUser("bob"); err == nil || err.Error() != "no such user: bob" {
+		t.Fatalf("Expected removing a missing user to fail. Got: %v", err)
+	}
+	if users, _ := table.Users(); !slices.Equal(users, []string{"alice"}) {
+		t.Fatalf("Expected only alice. Got: %v", users)
+	}
+
+	// The accounts are in the db file, hashed, and no file is left next to it.
+	table.Close()
+	if data, _ := os.ReadFile(dbName); bytes.Contains(data, []byte("pw2")) {
+		t.Fatalf("Expected the passwords to be hashed.")
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(dbName)); len(entries) != 1 {
+		t.Fatalf("Expected only the db file. Got: %v", entries)
+	}
+	table, err := Open(dbName)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if ok, _ := table.Authenticate("alice", "pw2"); !ok {
+		t.Fatalf("Expected alice to sign in after reopening.")
+	}
+
+	// A grant is written in the transaction of the statement.
+	table.Begin()
+	if _, err := table.Execute(context.Background(), &parser.Grant{User: "alice", Privileges: []string{"admin"}}, nil); err != nil {
+		t.Fatalf("Grant failed: %v", err)
+	}
+	table.Rollback()
+	if privileges, _ := table.Privileges("alice"); !slices.Equal(privileges, []string{"read", "write"}) {
+		t.Fatalf("Expected the rollback to undo the grant. Got: %v", privileges)
+	}
+	table.Close()
+
+	memory, _ := Open(MemoryDbName)
+	defer memory.Close()
+	if err := memory.AddUser("alice", "pw"); err != nil {
+		t.Fatalf("Expected an in-memory db to have accounts. Got: %v", err)
+	}
+	if required, _ := memory.AuthRequired(); !required {
+		t.Fatalf("Expected sign in to the in-memory db to be required.")
+	}
+}
+
+func TestPrivileges(t *testing.T) {
+	table, dbName := openTestDb(t)
+	defer func() { table.Close() }()
+	table.AddUser("alice", "pw")
+	table.AddUser("bob", "pw")
+	ctx := context.Background()
+	alice, bob := WithUser(ctx, "alice"), WithUser(ctx, "bob")
+	execute := func(ctx context.Context, text string) error {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		_, err = table.Execute(ctx, stmt, func([]any) error { return nil })
+		return err
+	}
+
+	if err := execute(alice, "insert 1 a a@b.c"); err != nil {
+		t.Fatalf("Expected a new account to write. Got: %v", err)
+	}
+	if err := execute(alice, "grant admin to bob"); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("Expected grant without admin to be denied. Got: %v", err)
+	}
+	// Without a user, as in the REPL, everything is allowed.
+	if err := execute(ctx, "grant admin to alice"); err != nil {
+		t.Fatalf("Grant failed: %v", err)
+	}
+	if err := execute(alice, "revoke write from bob"); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if privileges, _ := table.Privileges("bob"); !slices.Equal(privileges, []string{"read"}) {
+		t.Fatalf("Expected bob to only read. Got: %v", privileges)
+	}
+	if err := execute(bob, "select"); err != nil {
+		t.Fatalf("Expected bob to read. Got: %v", err)
+	}
+	err := execute(bob, "delete 1")
+	if !errors.Is(err, ErrPermissionDenied) || err.Error() != "permission denied: bob does not have the write privilege" {
+		t.Fatalf("Expected bob's delete to be denied. Got: %v", err)
+	}
+	// A new password keeps the privileges.
+	table.AddUser("bob", "pw2")
+	if privileges, _ := table.Privileges("bob"); !slices.Equal(privileges, []string{"read"}) {
+		t.Fatalf("Expected bob to still only read. Got: %v", privileges)
+	}
+	if err := execute(alice, "grant write, read to bob"); err != nil {
+		t.Fatalf("Grant failed: %v", err)
+	}
+	if privileges, _ := table.Privileges("bob"); !slices.Equal(privileges, []string{"read", "write"}) {
+		t.Fatalf("Expected bob to read and write. Got: %v", privileges)
+	}
+	// The grants are stored with the accounts, in the db file.
+	table.Close()
+	table, _ = Open(dbName)
+	if privileges, _ := table.Privileges("alice"); !slices.Equal(privileges, []string{"read", "write", "admin"}) {
+		t.Fatalf("Expected alice to keep admin after reopening. Got: %v", privileges)
+	}
+	if err := execute(alice, "grant read to carol"); err == nil || err.Error() != "no such user: carol" {
+		t.Fatalf("Expected granting to a missing user to fail. Got: %v", err)
+	}
+	if err := execute(WithUser(ctx, "carol"), "select"); err == nil {
+		t.Fatalf("Expected a missing user to be denied.")
+	}
+}
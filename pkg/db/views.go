@@ -0,0 +1,358 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Materialized views.
+
+A materialized view stores the rows of a select in a B-tree of its own, so an
+aggregation that is expensive to compute is run once and then read back with
+select * from <view> as often as needed. The tree holds the text of the select
+at key 0 and the rows of its result from key 1 on, in the order the select
+returned them; the file header lists the names of the views and the roots of
+their trees. The values of a row of a view are packed into the bytes of a
+row, so they can take up to packedRowSize bytes.
+
+Refreshing a view runs its select again and replaces its rows, in the same
+transaction. refresh view <name> does so on demand. A view created with
+refresh on commit is refreshed as part of every commit that inserted or
+deleted rows, so readers never see it stale, at the cost of running its
+select on every such commit. The rows of a view are not rows of the table:
+they are not in the bloom filter or the indexes, and changes subscribers do
+not see them.
+*/
+
+// packedRowSize is the space packRow packs values into, the username and email of a row.
+const packedRowSize = int(constants.UsernameSize + constants.EmailSize)
+
+// view is a materialized view of the table.
+type view struct {
+	name     string
+	text     string
+	query    *parser.Select
+	onCommit bool
+	tree     *Table
+}
+
+// ViewInfo describes a materialized view.
+type ViewInfo struct {
+	Name     string `json:"name"`
+	Query    string `json:"query"`
+	OnCommit bool   `json:"onCommit"`
+	RootPage uint32 `json:"rootPage"`
+}
+
+// packRow packs the values of a row of a view, or the stored generated values
+// of a row, into a row with the id.
+func packRow(id uint32, values []any) (types.Row, error) {
+	buf := []byte{byte(len(values))}
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+			buf = append(buf, 'n')
+		case int64:
+			buf = binary.LittleEndian.AppendUint64(append(buf, 'i'), uint64(v))
+		case string:
+			buf = binary.LittleEndian.AppendUint16(append(buf, 's'), uint16(len(v)))
+			buf = append(buf, v...)
+		default:
+			return types.Row{}, fmt.Errorf("can not store a value of type %T", value)
+		}
+	}
+	if len(buf) > packedRowSize {
+		return types.Row{}, fmt.Errorf("the values take up %d bytes, at most %d fit in a row", len(buf), packedRowSize)
+	}
+	row := types.Row{Id: id}
+	copy(row.Email[:], buf[copy(row.Username[:], buf):])
+	return row, nil
+}
+
+// unpackRow unpacks the values packRow packed into a row.
+func unpackRow(row types.Row) []any {
+	buf := append(append([]byte{}, row.Username[:]...), row.Email[:]...)
+	values := make([]any, buf[0])
+	pos := 1
+	for i := range values {
+		tag := buf[pos]
+		pos++
+		switch tag {
+		case 'i':
+			values[i] = int64(binary.LittleEndian.Uint64(buf[pos:]))
+			pos += 8
+		case 's':
+			n := int(binary.LittleEndian.Uint16(buf[pos:]))
+			values[i] = string(buf[pos+2 : pos+2+n])
+			pos += 2 + n
+		}
+	}
+	return values
+}
+
+// viewTree returns the tree of a view, which shares the pager and clock of the table.
+func (t *Table) viewTree(rootPageNum uint32) *Table {
+	return &Table{
+		pager:       t.pager,
+		rootPageNum: rootPageNum,
+		logger:      t.logger,
+		now:         func() time.Time { return t.now() },
+		auxiliary:   true,
+	}
+}
+
+// loadViews reads the definitions of the views the file header lists.
+func (t *Table) loadViews() error {
+	t.views = nil
+	for _, v := range t.pager.header.Views {
+		tree := t.viewTree(v.RootPageNum)
+		var definition []any
+		err := tree.scanRange(context.Background(), 0, 0, func(row types.Row) error {
+			definition = unpackRow(row)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(definition) != 2 {
+			return fmt.Errorf("view %s has no definition", v.Name)
+		}
+		text, _ := definition[0].(string)
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			return fmt.Errorf("view %s: %w", v.Name, err)
+		}
+		query, ok := stmt.(*parser.Select)
+		if !ok {
+			return fmt.Errorf("view %s is not defined by a select", v.Name)
+		}
+		t.views = append(t.views, view{name: v.Name, text: text, query: query, onCommit: definition[1] == int64(1), tree: tree})
+	}
+	return nil
+}
+
+// findView returns the view with the name, nil if there is none.
+func (t *Table) findView(name string) *view {
+	for i := range t.views {
+		if t.views[i].name == name {
+			return &t.views[i]
+		}
+	}
+	return nil
+}
+
+// Views describes the materialized views, in the order they were created.
+func (t *Table) Views() []ViewInfo {
+	infos := []ViewInfo{}
+	for _, v := range t.views {
+		infos = append(infos, ViewInfo{Name: v.name, Query: v.text, OnCommit: v.onCommit, RootPage: v.tree.rootPageNum})
+	}
+	return infos
+}
+
+/*
+CreateView creates a materialized view of the rows the select in query returns
+and fills it. With onCommit it is refreshed by every commit that changes rows,
+otherwise only by RefreshView.
+*/
+func (t *Table) CreateView(ctx context.Context, name string, query string, onCommit bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pager := t.pager
+	if pager.readOnly {
+		return errReadOnly
+	}
+	if pager.inTxn {
+		return fmt.Errorf("cannot create a view - a transaction is active")
+	}
+	if name == TableName || t.findView(name) != nil {
+		return fmt.Errorf("%s already exists", name)
+	}
+	if len(name) > int(constants.ViewNameSize) {
+		return fmt.Errorf("a view name is at most %d bytes", constants.ViewNameSize)
+	}
+	if len(t.views) >= int(constants.MaxViews) {
+		return fmt.Errorf("a database has at most %d views", constants.MaxViews)
+	}
+	stmt, err := parser.Parse(query)
+	if err != nil {
+		return err
+	}
+	s, ok := stmt.(*parser.Select)
+	if !ok {
+		return fmt.Errorf("a view is defined by a select, not %T", stmt)
+	}
+	if s.From != "" || s.Into != nil {
+		return fmt.Errorf("a view selects from the table and returns its rows")
+	}
+	refresh := int64(0)
+	if onCommit {
+		refresh = 1
+	}
+	definition, err := packRow(0, []any{query, refresh})
+	if err != nil {
+		return fmt.Errorf("the query of a view is too long: %w", err)
+	}
+	oldViews := pager.header.Views
+	err = t.write(func() error {
+		pageNum, err := getUnusedPageNum(pager)
+		if err != nil {
+			return err
+		}
+		root, err := getPage(pager, pageNum)
+		if err != nil {
+			return err
+		}
+		initializeLeafNode(root)
+		setNodeRoot(root, true)
+		markPageDirty(pager, pageNum)
+		v := view{name: name, text: query, query: s, onCommit: onCommit, tree: t.viewTree(pageNum)}
+		if err := insertRow(v.tree, &definition); err != nil {
+			return err
+		}
+		if err := t.refreshView(ctx, &v); err != nil {
+			return err
+		}
+		// The header is written by the commit, along with the tree.
+		pager.header.Views = append(slices.Clip(oldViews), types.View{Name: name, RootPageNum: pageNum})
+		return nil
+	})
+	if err != nil {
+		pager.header.Views = oldViews
+		return err
+	}
+	return t.loadViews()
+}
+
+// RefreshView runs the select of a view again and replaces the rows it stores.
+func (t *Table) RefreshView(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	v := t.findView(name)
+	if v == nil {
+		return fmt.Errorf("no such view: %s", name)
+	}
+	return t.write(func() error {
+		return t.refreshView(ctx, v)
+	})
+}
+
+// refreshView replaces the rows of a view with those its select returns now.
+func (t *Table) refreshView(ctx context.Context, v *view) error {
+	rows := []types.Row{}
+	err := executeSelect(ctx, t, v.query, func(values []any) error {
+		row, err := packRow(uint32(len(rows)+1), values)
+		if err != nil {
+			return fmt.Errorf("view %s: %w", v.name, err)
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	old := []uint32{}
+	err = v.tree.scanKeys(ctx, 1, math.MaxUint32, false, func(id uint32) error {
+		old = append(old, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range old {
+		if err := deleteRow(v.tree, id); err != nil {
+			return err
+		}
+	}
+	for i := range rows {
+		if err := insertRow(v.tree, &rows[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshOnCommit refreshes the views that are refreshed on commit, if rows were
+// inserted or deleted since rowsWritten was at written.
+func (t *Table) refreshOnCommit(written uint64) error {
+	if t.pager.rowsWritten == written {
+		return nil
+	}
+	for i := range t.views {
+		if !t.views[i].onCommit {
+			continue
+		}
+		if err := t.refreshView(context.Background(), &t.views[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectedView returns the view a select reads from, failing if there is no such view.
+func (t *Table) selectedView(stmt *parser.Select) (*view, error) {
+	v := t.findView(stmt.From)
+	if v == nil {
+		return nil, fmt.Errorf("no such view: %s", stmt.From)
+	}
+	if len(stmt.Columns) > 0 || stmt.Where != nil || stmt.GroupBy != "" || stmt.OrderBy != "" {
+		return nil, fmt.Errorf("a view is read whole, with select * from %s [limit <n>]", stmt.From)
+	}
+	return v, nil
+}
+
+// selectView calls fn with the rows of the view a select reads from, in the order they were stored.
+func (t *Table) selectView(ctx context.Context, stmt *parser.Select, fn func(values []any) error) error {
+	v, err := t.selectedView(stmt)
+	if err != nil {
+		return err
+	}
+	if stmt.Limit != nil {
+		fn = limitRows(*stmt.Limit, fn)
+	}
+	// The rows of a view are numbered from 1, so the skipped ones are never read.
+	if stmt.Offset >= math.MaxUint32 {
+		return nil
+	}
+	err = v.tree.scanRange(ctx, uint32(stmt.Offset)+1, math.MaxUint32, func(row types.Row) error {
+		return fn(unpackRow(row))
+	})
+	if err == errLimitReached {
+		return nil
+	}
+	return err
+}
+
+// Columns returns the names of the columns a statement returns, like the
+// function Columns, but also for the generated columns and the views of the table.
+func (t *Table) Columns(stmt parser.Statement) []string {
+	names, _ := t.selectedColumns(stmt)
+	return names
+}
+
+// ColumnTypes returns the types of the columns Table.Columns names.
+func (t *Table) ColumnTypes(stmt parser.Statement) []string {
+	_, valueTypes := t.selectedColumns(stmt)
+	return valueTypes
+}
+
+func (t *Table) selectedColumns(stmt parser.Statement) ([]string, []string) {
+	if s, ok := stmt.(*parser.Select); ok && s.From != "" {
+		if v := t.findView(s.From); v != nil {
+			stmt = v.query
+		}
+	}
+	names, valueTypes := t.columns()
+	return selectedColumns(stmt, names, valueTypes)
+}
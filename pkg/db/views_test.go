@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestMaterializedViews(t *testing.T) {
+	table, dbName := openTestDb(t)
+	ctx := context.Background()
+	execute := func(text string) ([]string, error) {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", text, err)
+		}
+		rows := []string{}
+		_, err = table.Execute(ctx, stmt, func(values []any) error {
+			rows = append(rows, fmt.Sprint(values))
+			return nil
+		})
+		return rows, err
+	}
+	for i := 0; i < 30; i++ {
+		if _, err := execute(fmt.Sprintf("insert %d user%d user%d@example.com", i, i%3, i)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if _, err := execute("create materialized view counts as select username, count(*) group by username order by username"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := execute("create materialized view firsts as select id, username where id < 3 refresh on commit"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if rows, err := execute("select * from counts"); err != nil || !slices.Equal(rows, []string{"[user0 10]", "[user1 10]", "[user2 10]"}) {
+		t.Fatalf("Expected the counts. Got: %v, %v", rows, err)
+	}
+	if columns := table.Columns(&parser.Select{From: "counts"}); !slices.Equal(columns, []string{"username", "count(*)"}) {
+		t.Fatalf("Expected the columns of the view's select. Got: %v", columns)
+	}
+
+	// A view refreshed on demand goes stale, one refreshed on commit does not.
+	execute("insert 100 user0 x@y.z")
+	execute("delete 1")
+	if rows, _ := execute("select * from counts limit 1"); !slices.Equal(rows, []string{"[user0 10]"}) {
+		t.Fatalf("Expected the stale count. Got: %v", rows)
+	}
+	if rows, _ := execute("select * from firsts"); !slices.Equal(rows, []string{"[0 user0]", "[2 user2]"}) {
+		t.Fatalf("Expected the view refreshed by the commit. Got: %v", rows)
+	}
+	if _, err := execute("refresh view counts"); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if rows, _ := execute("select * from counts"); !slices.Equal(rows, []string{"[user0 11]", "[user1 9]", "[user2 10]"}) {
+		t.Fatalf("Expected the refreshed counts. Got: %v", rows)
+	}
+
+	// Inside a transaction the view is refreshed when it commits, and not at all if it rolls back.
+	execute("begin")
+	execute("delete 2")
+	if rows, _ := execute("select * from firsts"); !slices.Equal(rows, []string{"[0 user0]", "[2 user2]"}) {
+		t.Fatalf("Expected the view unchanged before the commit. Got: %v", rows)
+	}
+	if _, err := execute("commit"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	execute("begin")
+	execute("delete 0")
+	execute("rollback")
+	if rows, _ := execute("select * from firsts"); !slices.Equal(rows, []string{"[0 user0]"}) {
+		t.Fatalf("Expected the view refreshed by the commit only. Got: %v", rows)
+	}
+
+	for text, expected := range map[string]string{
+		"create materialized view counts as select *":        "counts already exists",
+		"create materialized view users as select *":         "users already exists",
+		"select id from counts":                              "a view is read whole, with select * from counts [limit <n>]",
+		"select * from nope":                                 "no such view: nope",
+		"refresh view nope":                                  "no such view: nope",
+		"select where id in (select * from counts)":          "a subquery can not read a view",
+		"create materialized view v as select * from counts": "a view selects from the table and returns its rows",
+	} {
+		if _, err := execute(text); err == nil || err.Error() != expected {
+			t.Fatalf("Expected %s to fail with %q. Got: %v", text, expected, err)
+		}
+	}
+	execute("begin")
+	if _, err := execute("create materialized view v as select *"); err == nil || err.Error() != "cannot create a view - a transaction is active" {
+		t.Fatalf("Expected a view to need no transaction. Got: %v", err)
+	}
+	execute("rollback")
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected sound views. Got: %v", problems)
+	}
+
+	table.Close()
+	table, _ = Open(dbName)
+	defer table.Close()
+	if views := table.Views(); len(views) != 2 || views[1] != (ViewInfo{Name: "firsts", Query: "select id, username where id < 3", OnCommit: true, RootPage: views[1].RootPage}) {
+		t.Fatalf("Expected the views to be kept. Got: %+v", views)
+	}
+	execute("delete 0")
+	if rows, _ := execute("select * from firsts"); len(rows) != 0 {
+		t.Fatalf("Expected the reopened view refreshed on commit. Got: %v", rows)
+	}
+	if rows, _ := execute("select * from counts"); !slices.Equal(rows, []string{"[user0 11]", "[user1 9]", "[user2 10]"}) {
+		t.Fatalf("Expected the counts to be kept. Got: %v", rows)
+	}
+	if problems := table.IntegrityCheck(); len(problems) > 0 {
+		t.Fatalf("Expected sound views. Got: %v", problems)
+	}
+}
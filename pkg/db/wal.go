@@ -0,0 +1,475 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Write-ahead log.
+
+A commit appends every dirty page to the WAL as a frame, followed by a frame
+holding the file header which marks the end of the commit. The commit is done
+once the WAL is synced, the db file is only updated by a checkpoint, which
+copies the latest committed version of every page over and empties the WAL.
+Until then, pages evicted from the cache are read back from the WAL.
+
+If the process dies, the next writer to open the file reads the committed
+frames it finds in the WAL with walScan, and drops a commit torn off its end.
+
+Frame layout: page number, commit flag, salt, CRC32 of the frame, page contents.
+The salt is copied from the file header, frames left behind by another
+database of the same name are ignored because their salt does not match.
+
+Readers.
+
+A read-only connection reads the db file along with the committed frames of
+the WAL, so it opens the database alongside a writer rather than waiting for
+it. It sees the commits made before it opened, and those appended since once
+it refreshes, which it does before every statement, so a statement reads a
+consistent snapshot while the writer goes on appending. A checkpoint writes
+over the pages in the db file a reader reads, so readers hold a shared lock
+on the readers file for as long as they are open, and the writer only
+checkpoints if it can lock it exclusively. Whoever closes the database while
+holding that lock removes the file; a lock taken on a file that was removed
+meanwhile guards nothing, so it is taken again on the new one. While readers
+are open the WAL keeps growing, and a writer that closes leaves it behind for
+them.
+*/
+
+func appendWalFrame(buf []byte, salt uint32, pageNum uint32, commit bool, data []byte) []byte {
+	frame := make([]byte, constants.WalFrameSize)
+	binary.LittleEndian.PutUint32(frame[constants.WalFramePageNumOffset:], pageNum)
+	if commit {
+		binary.LittleEndian.PutUint32(frame[constants.WalFrameCommitOffset:], 1)
+	}
+	binary.LittleEndian.PutUint32(frame[constants.WalFrameSaltOffset:], salt)
+	copy(frame[constants.WalFrameHeaderSize:], data)
+	binary.LittleEndian.PutUint32(frame[constants.WalFrameChecksumOffset:], walFrameChecksum(frame))
+	return append(buf, frame...)
+}
+
+// walFrameChecksum covers the page number, commit flag, salt and page contents.
+func walFrameChecksum(frame []byte) uint32 {
+	crc := crc32.ChecksumIEEE(frame[:constants.WalFrameChecksumOffset])
+	return crc32.Update(crc, crc32.IEEETable, frame[constants.WalFrameHeaderSize:])
+}
+
+// savepoint remembers the state of a transaction so it can be partially rolled back.
+type savepoint struct {
+	name     string
+	numPages uint32
+	pages    map[uint32]*types.Page // Copies of the pages that were dirty when the savepoint was taken.
+	changes  int                    // Changes recorded when the savepoint was taken.
+	counts   rowCounts              // The header's row counts when the savepoint was taken.
+}
+
+// statementSavepoint is taken around every write statement inside an explicit
+// transaction. Savepoint names can not be empty, so it never clashes with the user's.
+const statementSavepoint = ""
+
+func pagerBegin(pager *Pager) {
+	pager.inTxn = true
+	pager.txnNumPages = pager.numPages
+	pager.txnRowCounts = pager.rowCounts()
+}
+
+/*
+pagerCommit durably appends all dirty pages to the WAL. If writing the WAL
+fails the transaction stays open and untouched, so the caller can roll it back.
+*/
+func pagerCommit(pager *Pager) error {
+	dirty := []uint32{}
+	for pageNum, elem := range pager.pages {
+		if elem.Value.(*cachedPage).dirty {
+			dirty = append(dirty, pageNum)
+		}
+	}
+	if len(dirty) == 0 {
+		pager.inTxn = false
+		pager.savepoints = nil
+		pager.changes.publish()
+		return nil
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i] < dirty[j] })
+
+	frames := []byte{}
+	for _, pageNum := range dirty {
+		page, err := pagerSeal(pager, pageNum, pager.pages[pageNum].Value.(*cachedPage).data[:])
+		if err != nil {
+			return err
+		}
+		frames = appendWalFrame(frames, pager.header.WalSalt, pageNum, false, page)
+	}
+	frames = appendWalFrame(frames, pager.header.WalSalt, constants.WalHeaderPageNum, true, serializeFileHeader(&pager.header))
+	start := time.Now()
+	if _, err := pager.wal.WriteAt(frames, int64(pager.walLength)); err != nil {
+		return fmt.Errorf("error writing to wal file: %w", err)
+	}
+	if err := pager.wal.Sync(); err != nil {
+		return fmt.Errorf("error syncing wal file: %w", err)
+	}
+	pager.flushLatency.observe(time.Since(start))
+	pager.inTxn = false
+	pager.savepoints = nil
+
+	if pager.walLength == 0 {
+		pager.walStarted = time.Now()
+	}
+	for i, pageNum := range dirty {
+		pager.walIndex[pageNum] = int64(pager.walLength) + int64(i)*int64(constants.WalFrameSize)
+		pager.pages[pageNum].Value.(*cachedPage).dirty = false
+	}
+	pager.walIndex[constants.WalHeaderPageNum] = int64(pager.walLength) + int64(len(dirty))*int64(constants.WalFrameSize)
+	pager.walLength += uint32(len(frames))
+	pager.pagesWritten += uint64(len(dirty))
+	pager.changes.publish()
+
+	numFrames := pager.walLength / constants.WalFrameSize
+	if numFrames >= pager.checkpointFrames || time.Since(pager.walStarted) >= pager.checkpointAge {
+		// The commit is durable even if this fails, the next commit tries again.
+		if err := pagerCheckpoint(pager); !errors.Is(err, errReadersOpen) {
+			return err
+		}
+	}
+	return nil
+}
+
+// errReadersOpen is returned by pagerCheckpoint while a read-only connection has the database open.
+var errReadersOpen = fmt.Errorf("cannot checkpoint - the database is open for reading by another connection")
+
+// pagerExcludeReaders locks the readers file exclusively, failing with
+// errReadersOpen if a reader has it open. Readers opening the database wait
+// until release is called or the file is closed.
+func pagerExcludeReaders(pager *Pager) (release func(), err error) {
+	if pager.readers == nil || pager.readersExcluded {
+		return func() {}, nil
+	}
+	for {
+		ok, err := excludeReaders(pager.readers)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errReadersOpen
+		}
+		if readersCurrent(pager.readers) {
+			break
+		}
+		// The last reader removed the file as it closed, the readers to come lock a new one.
+		name := pager.readers.Name()
+		pager.readers.Close()
+		if pager.readers, err = openReadersFile(name); err != nil {
+			return nil, err
+		}
+	}
+	pager.readersExcluded = true
+	return func() {
+		pager.readersExcluded = false
+		unlockFile(pager.readers)
+	}, nil
+}
+
+/*
+pagerCheckpoint copies the latest committed version of every page in the WAL
+into the db file and empties the WAL. It reads the frames rather than the
+cache, so it is safe to run while a transaction has uncommitted pages. It
+fails with errReadersOpen while readers may be reading the db file.
+*/
+func pagerCheckpoint(pager *Pager) error {
+	if pager.walLength == 0 {
+		return nil
+	}
+	release, err := pagerExcludeReaders(pager)
+	if err != nil {
+		return err
+	}
+	defer release()
+	pagerDropPrefetches(pager)
+	start := time.Now()
+	// Offsets in the db file of every page in the WAL. The header fills the
+	// block before page 0, so it is written like any other page.
+	offsets := map[int64]uint32{}
+	for pageNum := range pager.walIndex {
+		if pageNum == constants.WalHeaderPageNum {
+			offsets[0] = pageNum
+		} else {
+			offsets[pageOffset(pageNum)] = pageNum
+		}
+	}
+	sorted := make([]int64, 0, len(offsets))
+	for offset := range offsets {
+		sorted = append(sorted, offset)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	// Runs of adjacent pages are copied with a single write.
+	run := []byte{}
+	runStart := int64(0)
+	writeRun := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+		if _, err := pager.file.WriteAt(run, runStart); err != nil {
+			return fmt.Errorf("error writing to file: %w", err)
+		}
+		if end := uint32(runStart) + uint32(len(run)); end > pager.fileLength {
+			pager.fileLength = end
+		}
+		pager.pagesWritten += uint64(len(run)) / uint64(constants.PageSize)
+		run = run[:0]
+		return nil
+	}
+	for _, offset := range sorted {
+		if offset != runStart+int64(len(run)) {
+			if err := writeRun(); err != nil {
+				return err
+			}
+			runStart = offset
+		}
+		run = append(run, make([]byte, constants.PageSize)...)
+		page := run[len(run)-int(constants.PageSize):]
+		if _, err := pager.wal.ReadAt(page, pager.walIndex[offsets[offset]]+int64(constants.WalFrameHeaderSize)); err != nil {
+			return fmt.Errorf("error reading wal file: %w", err)
+		}
+	}
+	if err := writeRun(); err != nil {
+		return err
+	}
+	if err := pager.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing db file: %w", err)
+	}
+	if err := pagerArchive(pager); err != nil {
+		return err
+	}
+	if err := walTruncate(pager.wal); err != nil {
+		return err
+	}
+	pager.walLength = 0
+	pager.walIndex = map[uint32]int64{}
+	pager.flushLatency.observe(time.Since(start))
+	pager.logger.Debug("checkpointed wal", "pages", len(sorted), "duration", time.Since(start))
+	return nil
+}
+
+// walTruncate empties the WAL. The truncation is synced so that frames of
+// commits that were already checkpointed can never be replayed over newer ones.
+func walTruncate(wal pagerFile) error {
+	if err := wal.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating wal file: %w", err)
+	}
+	if err := wal.Sync(); err != nil {
+		return fmt.Errorf("error syncing wal file: %w", err)
+	}
+	return nil
+}
+
+// pagerRollback drops the uncommitted pages from the cache, so they are read back from disk.
+func pagerRollback(pager *Pager) {
+	pager.inTxn = false
+	pager.savepoints = nil
+	pager.changes.pending = nil
+	pager.setRowCounts(pager.txnRowCounts)
+	pager.pageWrites++
+	for pageNum, elem := range pager.pages {
+		if elem.Value.(*cachedPage).dirty {
+			pager.lru.Remove(elem)
+			delete(pager.pages, pageNum)
+		}
+	}
+	pager.numPages = pager.txnNumPages
+}
+
+func pagerSavepoint(pager *Pager, name string) {
+	sp := savepoint{name: name, numPages: pager.numPages, pages: map[uint32]*types.Page{}, changes: len(pager.changes.pending), counts: pager.rowCounts()}
+	for pageNum, elem := range pager.pages {
+		if cp := elem.Value.(*cachedPage); cp.dirty {
+			page := *cp.data
+			sp.pages[pageNum] = &page
+		}
+	}
+	pager.savepoints = append(pager.savepoints, sp)
+}
+
+// findSavepoint returns the index of the most recent savepoint with the given name.
+func findSavepoint(pager *Pager, name string) (int, error) {
+	for i := len(pager.savepoints) - 1; i >= 0; i-- {
+		if pager.savepoints[i].name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no such savepoint: %s", name)
+}
+
+/*
+pagerRollbackTo undoes everything done since the savepoint was taken. Pages that
+were dirty at the time get their copy back, pages modified only afterwards are
+dropped from the cache. The savepoint itself stays, later ones are discarded.
+*/
+func pagerRollbackTo(pager *Pager, name string) error {
+	i, err := findSavepoint(pager, name)
+	if err != nil {
+		return err
+	}
+	sp := pager.savepoints[i]
+	pager.pageWrites++
+	for pageNum, elem := range pager.pages {
+		cp := elem.Value.(*cachedPage)
+		if !cp.dirty {
+			continue
+		}
+		if page, ok := sp.pages[pageNum]; ok {
+			*cp.data = *page
+		} else {
+			pager.lru.Remove(elem)
+			delete(pager.pages, pageNum)
+		}
+	}
+	pager.numPages = sp.numPages
+	pager.changes.pending = pager.changes.pending[:sp.changes]
+	pager.setRowCounts(sp.counts)
+	pager.savepoints = pager.savepoints[:i+1]
+	return nil
+}
+
+// pagerRelease forgets the savepoint and every savepoint taken after it, keeping their changes.
+func pagerRelease(pager *Pager, name string) error {
+	i, err := findSavepoint(pager, name)
+	if err != nil {
+		return err
+	}
+	pager.savepoints = pager.savepoints[:i]
+	return nil
+}
+
+/*
+walScan reads the WAL from offset on, adding the offset of every frame of a
+fully committed transaction to index by page number. It stops at the first
+frame that is torn or left behind by another database, and returns the
+offset just past the last commit it read.
+*/
+func walScan(wal pagerFile, salt uint32, offset uint32, index map[uint32]int64) (uint32, error) {
+	end := offset
+	err := walCommits(wal, salt, offset, func(commit map[uint32]int64, commitEnd uint32) error {
+		for pageNum, frameOffset := range commit {
+			index[pageNum] = frameOffset
+		}
+		end = commitEnd
+		return nil
+	})
+	return end, err
+}
+
+// walCommits calls fn with the offset of the frame of every page of each
+// commit in the WAL from offset on, and the offset just past the commit, in
+// commit order. It stops like walScan.
+func walCommits(wal pagerFile, salt uint32, offset uint32, fn func(commit map[uint32]int64, end uint32) error) error {
+	stat, err := wal.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get wal file stats: %w", err)
+	}
+	if stat.Size() <= int64(offset) {
+		return nil
+	}
+	buf := make([]byte, stat.Size()-int64(offset))
+	// A writer that just opened may cut a torn commit off the end meanwhile.
+	n, err := wal.ReadAt(buf, int64(offset))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading wal file: %w", err)
+	}
+	buf = buf[:n]
+
+	pending := map[uint32]int64{}
+	for pos := offset; len(buf) >= int(constants.WalFrameSize); pos += constants.WalFrameSize {
+		frame := buf[:constants.WalFrameSize]
+		buf = buf[constants.WalFrameSize:]
+		if binary.LittleEndian.Uint32(frame[constants.WalFrameChecksumOffset:]) != walFrameChecksum(frame) {
+			// Torn write of a commit that never completed.
+			break
+		}
+		if binary.LittleEndian.Uint32(frame[constants.WalFrameSaltOffset:]) != salt {
+			break
+		}
+		pending[binary.LittleEndian.Uint32(frame[constants.WalFramePageNumOffset:])] = int64(pos)
+		if binary.LittleEndian.Uint32(frame[constants.WalFrameCommitOffset:]) == 0 {
+			continue
+		}
+		if err := fn(pending, pos+constants.WalFrameSize); err != nil {
+			return err
+		}
+		pending = map[uint32]int64{}
+	}
+	return nil
+}
+
+/*
+pagerAdoptWal makes the pager read the pages of the commits walScan found,
+which end at length, from the WAL, dropping the copies it cached. The header
+is taken from the last of them.
+*/
+func pagerAdoptWal(pager *Pager, index map[uint32]int64, length uint32) error {
+	pagerDropPrefetches(pager)
+	pager.pageWrites++
+	for pageNum, offset := range index {
+		pager.walIndex[pageNum] = offset
+		if elem, ok := pager.pages[pageNum]; ok {
+			pager.lru.Remove(elem)
+			delete(pager.pages, pageNum)
+		}
+		if pageNum != constants.WalHeaderPageNum && pageNum >= pager.numPages {
+			pager.numPages = pageNum + 1
+		}
+	}
+	pager.walLength = length
+	offset, ok := index[constants.WalHeaderPageNum]
+	if !ok {
+		return nil
+	}
+	buf := make([]byte, constants.FileHeaderSize)
+	if _, err := pager.wal.ReadAt(buf, offset+int64(constants.WalFrameHeaderSize)); err != nil {
+		return fmt.Errorf("error reading wal file: %w", err)
+	}
+	header, err := deserializeFileHeader(buf)
+	if err != nil {
+		return fmt.Errorf("%s: %w", pager.wal.Name(), err)
+	}
+	pager.header = header
+	return nil
+}
+
+/*
+pagerRefresh makes a read-only pager see the commits appended to the WAL
+since it opened or last refreshed, and reports whether there were any. The
+WAL is opened once a writer has created it.
+*/
+func pagerRefresh(pager *Pager) (bool, error) {
+	if pager.wal == nil {
+		wal, err := os.Open(pager.file.Name() + constants.WalFileSuffix)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to open wal file: %w", err)
+		}
+		pager.wal = wal
+	}
+	index := map[uint32]int64{}
+	length, err := walScan(pager.wal, pager.header.WalSalt, pager.walLength, index)
+	if err != nil || length == pager.walLength {
+		return false, err
+	}
+	if err := pagerAdoptWal(pager, index, length); err != nil {
+		return false, err
+	}
+	return true, nil
+}
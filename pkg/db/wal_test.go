@@ -0,0 +1,254 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestWalRecoversCommittedFrames(t *testing.T) {
+	table, dbName := openTestDb(t)
+	table.Close()
+
+	// Simulate a crash after the WAL was synced but before the db file was written.
+	table, _ = Open(dbName)
+	row := parseRow("insert 1 user1 user1@example.com")
+	insertRow(table, &row)
+	page, _ := getPage(table.pager, 0)
+	setPageChecksum(page)
+	salt := table.pager.header.WalSalt
+	frames := appendWalFrame([]byte{}, salt, 0, false, page)
+	frames = appendWalFrame(frames, salt, constants.WalHeaderPageNum, true, serializeFileHeader(&table.pager.header))
+	// A second commit torn half way must be ignored.
+	frames = appendWalFrame(frames, salt, 0, false, make([]byte, constants.PageSize))
+	frames = append(frames, make([]byte, constants.WalFrameSize/2)...)
+	table.pager.wal.WriteAt(frames, 0)
+	table.pager.file.Close()
+	table.pager.wal.Close()
+
+	table, _ = Open(dbName)
+	cursor, _ := tableStart(table)
+	if cursor.endOfTable {
+		t.Fatalf("Expected the committed row to be recovered from the WAL.")
+	}
+	rawRow, _ := cursor.value()
+	if row := deserializeRow(rawRow); row.Id != 1 {
+		t.Fatalf("Expected row 1. Got: %d", row.Id)
+	}
+	cursor.advance()
+	if !cursor.endOfTable {
+		t.Errorf("Expected exactly one row.")
+	}
+	if stat, _ := table.pager.wal.Stat(); stat.Size() != 0 {
+		t.Errorf("Expected WAL to be empty after recovery. Got %d bytes.", stat.Size())
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	table, _ := openTestDb(t)
+	pagerCheckpoint(table.pager)
+	stat, _ := table.pager.file.Stat()
+	sizeBefore := stat.Size()
+
+	for i := 1; i <= 20; i++ {
+		row := parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i))
+		pagerBegin(table.pager)
+		insertRow(table, &row)
+		pagerCommit(table.pager)
+	}
+
+	// Commits only append to the WAL.
+	if stat, _ := table.pager.file.Stat(); stat.Size() != sizeBefore {
+		t.Fatalf("Expected db file to be untouched before a checkpoint. Got size %d, was %d.", stat.Size(), sizeBefore)
+	}
+	if table.pager.walLength == 0 {
+		t.Fatalf("Expected commits to be in the WAL.")
+	}
+
+	// Evicted pages are read back from the WAL.
+	table.pager.maxCachedPages = 0
+	pagerEvict(table.pager)
+	cursor, _ := tableFind(table, 20)
+	rawRow, _ := cursor.value()
+	if row := deserializeRow(rawRow); row.Id != 20 {
+		t.Fatalf("Expected row 20 to be read from the WAL. Got: %d", row.Id)
+	}
+
+	pagerCheckpoint(table.pager)
+	if stat, _ := table.pager.wal.Stat(); stat.Size() != 0 {
+		t.Fatalf("Expected empty WAL after checkpoint. Got %d bytes.", stat.Size())
+	}
+	if stat, _ := table.pager.file.Stat(); stat.Size() != int64(pageOffset(table.pager.numPages)) {
+		t.Fatalf("Expected all %d pages in the db file. Got size %d.", table.pager.numPages, stat.Size())
+	}
+
+	// Automatic checkpoint once the WAL grows past the limit.
+	table.pager.checkpointFrames = 2
+	row := parseRow("insert 21 user21 user21@example.com")
+	pagerBegin(table.pager)
+	insertRow(table, &row)
+	pagerCommit(table.pager)
+	if table.pager.walLength != 0 {
+		t.Fatalf("Expected WAL to be checkpointed automatically.")
+	}
+}
+
+func TestWalReaders(t *testing.T) {
+	ctx := context.Background()
+	table, dbName := openTestDb(t)
+	table.pager.checkpointFrames = 2
+	for i := 1; i <= 3; i++ {
+		table.Insert(ctx, parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)))
+	}
+	reader, err := OpenReadOnly(dbName)
+	if err != nil {
+		t.Fatalf("Failed to open reader: %v", err)
+	}
+	stmt, _ := parser.Parse("select")
+	selectIds := func(table *Table, fn func()) []int64 {
+		ids := []int64{}
+		_, err := table.Execute(ctx, stmt, func(values []any) error {
+			ids = append(ids, values[0].(int64))
+			if fn != nil {
+				fn()
+				fn = nil
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Select failed: %v", err)
+		}
+		return ids
+	}
+	if ids := selectIds(reader, nil); len(ids) != 3 {
+		t.Fatalf("Expected the reader to see the 3 rows committed before it opened. Got: %v", ids)
+	}
+
+	for i := 4; i <= 100; i++ {
+		table.Insert(ctx, parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)))
+	}
+	count := 0
+	reader.Scan(ctx, func(row types.Row) error {
+		count++
+		return nil
+	})
+	if count != 3 {
+		t.Fatalf("Expected the reader to keep its snapshot until it refreshes. Got: %d rows", count)
+	}
+	// The writer deletes rows while the select runs, which still reads the snapshot it began with.
+	ids := selectIds(reader, func() {
+		if err := table.Begin(); err != nil {
+			t.Fatalf("Failed to begin: %v", err)
+		}
+		for id := uint32(2); id <= 100; id++ {
+			table.Delete(ctx, id)
+		}
+		if err := table.Commit(); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+	})
+	if len(ids) != 100 || ids[99] != 100 {
+		t.Fatalf("Expected the select to see the 100 rows of its snapshot. Got: %v", ids)
+	}
+	if ids := selectIds(reader, nil); len(ids) != 1 {
+		t.Fatalf("Expected the next select to see the delete. Got: %v", ids)
+	}
+
+	if err := table.Checkpoint(); !errors.Is(err, errReadersOpen) {
+		t.Fatalf("Expected the checkpoint to wait for the reader. Got: %v", err)
+	}
+	table.Close()
+	if stat, err := os.Stat(dbName + constants.WalFileSuffix); err != nil || stat.Size() == 0 {
+		t.Fatalf("Expected the WAL to be kept for the reader. Got: %v", err)
+	}
+	reader2, err := OpenReadOnly(dbName)
+	if err != nil {
+		t.Fatalf("Failed to open reader: %v", err)
+	}
+	if ids := selectIds(reader2, nil); len(ids) != 1 {
+		t.Fatalf("Expected a new reader to see the commits in the WAL. Got: %v", ids)
+	}
+	readersFile := dbName + constants.ReadersFileSuffix
+	reader.Close()
+	if _, err := os.Stat(readersFile); err != nil {
+		t.Fatalf("Expected the readers file to stay while a reader is open. Got: %v", err)
+	}
+	reader2.Close()
+	if _, err := os.Stat(readersFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected the last reader to remove the readers file. Got: %v", err)
+	}
+
+	table, err = Open(dbName)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	if stat, _ := os.Stat(dbName + constants.WalFileSuffix); stat.Size() != 0 {
+		t.Fatalf("Expected the writer to checkpoint once the readers closed. Got %d bytes", stat.Size())
+	}
+	if keys := checkTable(t, table); len(keys) != 1 || keys[0] != 1 {
+		t.Fatalf("Expected row 1 to remain. Got: %v", keys)
+	}
+	// The readers file the writer opened is removed by a reader and created again by the next.
+	reader, _ = OpenReadOnly(dbName)
+	reader.Close()
+	reader, _ = OpenReadOnly(dbName)
+	table.Insert(ctx, parseRow("insert 2 user2 user2@example.com"))
+	if err := table.Checkpoint(); !errors.Is(err, errReadersOpen) {
+		t.Fatalf("Expected the checkpoint to wait for the reader of the new readers file. Got: %v", err)
+	}
+	reader.Close()
+	if err := table.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	table.Close()
+	for _, name := range []string{readersFile, dbName + constants.WalFileSuffix} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("Expected the writer to remove %s on close. Got: %v", name, err)
+		}
+	}
+}
+
+// countingFile counts the writes and syncs of a pager file.
+type countingFile struct {
+	pagerFile
+	writes int
+	syncs  int
+}
+
+func (f *countingFile) WriteAt(b []byte, off int64) (int, error) {
+	f.writes++
+	return f.pagerFile.WriteAt(b, off)
+}
+
+func (f *countingFile) Sync() error {
+	f.syncs++
+	return f.pagerFile.Sync()
+}
+
+func TestCheckpointCoalescesAdjacentPages(t *testing.T) {
+	table, _ := openTestDb(t)
+	defer table.Close()
+	table.Begin()
+	for i := 1; i <= 40; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)))
+	}
+	table.Commit()
+	file := &countingFile{pagerFile: table.pager.file}
+	table.pager.file = file
+	if err := table.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	// The header and pages 0 to 3 are adjacent in the file.
+	if file.writes != 1 || table.pager.pagesWritten < 5 {
+		t.Fatalf("Expected the pages to be copied with one write. Got %d writes", file.writes)
+	}
+	if keys := checkTable(t, table); len(keys) != 40 {
+		t.Fatalf("Expected 40 rows. Got: %d", len(keys))
+	}
+}
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+WAL decoding.
+
+The WAL holds pages rather than rows: each commit is the pages it changed.
+DecodeWal turns the commits back into the rows they inserted, deleted or
+changed. It reads the database twice over, as it was before a commit and as
+it is after it, collects the ids in the leaves the commit changed in both,
+and looks up the row with each id in both. Leaves of the indexes and views
+turn up ids as well, but those rows are the same before and after unless the
+commit changed them, so they are not reported.
+
+There is no update statement, but a commit that deleted a row and inserted
+it again, like insert or replace, is an update here: only the rows as they
+were before and after the commit can be told apart. Only the commits still in
+the WAL are decoded, a checkpoint empties it.
+*/
+
+// WalRecord is a row a commit in the WAL inserted, deleted or changed.
+type WalRecord struct {
+	Commit int        // The number of the commit in the WAL, from 1.
+	Op     string     // "insert", "delete" or "update".
+	Key    uint32     // The id of the row.
+	Before *types.Row // The row before the commit, nil for an insert.
+	After  *types.Row // The row after the commit, nil for a delete.
+}
+
+// MarshalJSON encodes the rows of the record as objects keyed by column name.
+// expires_at is only set for rows with a ttl.
+func (r WalRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Commit int            `json:"commit"`
+		Op     string         `json:"op"`
+		Key    uint32         `json:"key"`
+		Before map[string]any `json:"before"`
+		After  map[string]any `json:"after"`
+	}{r.Commit, r.Op, r.Key, walRecordRow(r.Before), walRecordRow(r.After)})
+}
+
+func walRecordRow(row *types.Row) map[string]any {
+	if row == nil {
+		return nil
+	}
+	values := map[string]any{}
+	for i, value := range rowValues(*row) {
+		values[columnNames[i]] = value
+	}
+	if row.ExpiresAt != 0 {
+		values["expires_at"] = row.ExpiresAt
+	}
+	return values
+}
+
+/*
+DecodeWal calls fn with the rows changed by every commit in the WAL of the
+database, in commit order and by id within a commit, stopping at the first
+error. It reads the files like a reader, so a writer may have them open.
+*/
+func DecodeWal(filename string, passphrase string, fn func(record WalRecord) error) error {
+	before, err := walDecodePager(filename, passphrase)
+	if err != nil {
+		return err
+	}
+	defer pagerCloseFiles(before, false)
+	after, err := walDecodePager(filename, passphrase)
+	if err != nil {
+		return err
+	}
+	defer pagerCloseFiles(after, false)
+	if after.wal == nil {
+		return nil
+	}
+
+	commitNum := 0
+	return walCommits(after.wal, after.header.WalSalt, 0, func(commit map[uint32]int64, end uint32) error {
+		commitNum++
+		if err := pagerAdoptWal(after, commit, end); err != nil {
+			return err
+		}
+		if after.header.KeySalt != before.header.KeySalt {
+			return fmt.Errorf("commit %d rekeys %s, its pages can not be decoded with the passphrase", commitNum, filename)
+		}
+		ids := map[uint32]bool{}
+		for pageNum := range commit {
+			if pageNum == constants.WalHeaderPageNum {
+				continue
+			}
+			if err := walLeafIds(before, pageNum, ids); err != nil {
+				return err
+			}
+			if err := walLeafIds(after, pageNum, ids); err != nil {
+				return err
+			}
+		}
+		sorted := make([]uint32, 0, len(ids))
+		for id := range ids {
+			sorted = append(sorted, id)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		for _, id := range sorted {
+			record := WalRecord{Commit: commitNum, Key: id}
+			if record.Before, err = walRow(before, id); err != nil {
+				return err
+			}
+			if record.After, err = walRow(after, id); err != nil {
+				return err
+			}
+			switch {
+			case record.Before == nil && record.After == nil:
+				continue
+			case record.Before == nil:
+				record.Op = "insert"
+			case record.After == nil:
+				record.Op = "delete"
+			case *record.Before == *record.After:
+				continue
+			default:
+				record.Op = "update"
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		pagerEvict(before)
+		pagerEvict(after)
+		return pagerAdoptWal(before, commit, end)
+	})
+}
+
+// walDecodePager opens the database read-only, as it is in the db file, with
+// the WAL open but none of its commits applied.
+func walDecodePager(filename string, passphrase string) (*Pager, error) {
+	pager, err := pagerOpenReadOnly(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := pagerUnlock(pager, passphrase); err != nil {
+		pagerCloseFiles(pager, false)
+		return nil, err
+	}
+	wal, err := os.Open(filename + constants.WalFileSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		pagerCloseFiles(pager, false)
+		return nil, fmt.Errorf("failed to open wal file: %w", err)
+	}
+	if err == nil {
+		pager.wal = wal
+	}
+	return pager, nil
+}
+
+// walLeafIds adds the ids in the page to ids, if the pager has it and it is a leaf.
+func walLeafIds(pager *Pager, pageNum uint32, ids map[uint32]bool) error {
+	if pageNum >= pager.numPages {
+		return nil
+	}
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return err
+	}
+	if getNodeType(node) != types.NodeLeaf {
+		return nil
+	}
+	numCells := min(binary.LittleEndian.Uint32(leafNodeNumCells(node)), constants.LeafNodeMaxCells)
+	for i := uint32(0); i < numCells; i++ {
+		ids[binary.LittleEndian.Uint32(leafNodeKey(node, i))] = true
+	}
+	return nil
+}
+
+// walRow returns the row with the id as the pager has it, counting rows that expired, nil if there is none.
+func walRow(pager *Pager, id uint32) (*types.Row, error) {
+	// Before the first commit of a new database there is not even a root.
+	if pager.header.RootPageNum >= pager.numPages {
+		return nil, nil
+	}
+	row, found, err := uniqueRow(&Table{pager: pager, logger: pager.logger, now: time.Now}, id)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &row, nil
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestDecodeWal(t *testing.T) {
+	ctx := context.Background()
+	table, dbName := openTestDb(t)
+	table.pager.checkpointFrames = 1 << 20
+	// Enough rows to split leaves, which moves rows without changing them.
+	for i := 1; i <= 30; i++ {
+		table.Insert(ctx, parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)))
+	}
+	table.Delete(ctx, 2)
+	stmt, _ := parser.Parse("insert or replace 3 other3 other3@example.com")
+	if _, err := table.Execute(ctx, stmt, nil); err != nil {
+		t.Fatalf("Replace failed: %v", err)
+	}
+
+	records := []WalRecord{}
+	err := DecodeWal(dbName, "", func(record WalRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DecodeWal failed: %v", err)
+	}
+	if len(records) != 32 {
+		t.Fatalf("Expected 30 inserts, a delete and an update. Got %d records: %+v", len(records), records)
+	}
+	for i, record := range records[:30] {
+		// The first commit is the empty root of the new database.
+		if record.Op != "insert" || record.Key != uint32(i+1) || record.Commit != i+2 || record.Before != nil || record.After.Id != uint32(i+1) {
+			t.Fatalf("Expected insert %d. Got: %+v", i+1, record)
+		}
+	}
+	if record := records[30]; record.Op != "delete" || record.Key != 2 || record.Before == nil || record.After != nil {
+		t.Fatalf("Expected the delete of row 2. Got: %+v", record)
+	}
+	update, _ := json.Marshal(records[31])
+	expected := `{"commit":33,"op":"update","key":3,"before":{"email":"user3@example.com","id":3,"username":"user3"},"after":{"email":"other3@example.com","id":3,"username":"other3"}}`
+	if string(update) != expected {
+		t.Fatalf("Unexpected update,\ngot: %s\nexpected: %s", update, expected)
+	}
+
+	table.Close()
+	records = records[:0]
+	DecodeWal(dbName, "", func(record WalRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	if len(records) != 0 {
+		t.Fatalf("Expected nothing to decode once the WAL is checkpointed. Got: %+v", records)
+	}
+}
@@ -0,0 +1,399 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// filter is a compiled where clause.
+type filter struct {
+	from     uint32 // Only rows with an id in from..to can match, from > to if none can.
+	to       uint32
+	match    func(values []any) bool
+	ids      []uint32 // If not nil, only rows with these ids, in ascending order, can match.
+	indexes  []string // The indexes that gave the ids.
+	keysOnly bool     // The statement only reads the id, so rows are not decoded and the other values are nil.
+}
+
+// scanWhere calls fn with the values of every row that matches the where clause, in ascending
+// or descending id order.
+func (t *Table) scanWhere(ctx context.Context, where *filter, desc bool, fn func(values []any) error) error {
+	if where.from > where.to {
+		return nil
+	}
+	if where.ids != nil {
+		return t.scanIds(ctx, where, desc, fn)
+	}
+	if where.from == where.to {
+		// A point query for an id the bloom filter rules out finds nothing.
+		if !bloomMayContain(t.pager, where.from) {
+			return nil
+		}
+	}
+	matchRow := func(row types.Row) error {
+		values, err := appendGenerated(t.pager, rowValues(row))
+		if err != nil {
+			return err
+		}
+		if !where.match(values) {
+			return nil
+		}
+		return fn(values)
+	}
+	if t.readsDescendingIndex(where, desc) {
+		// The index holds the rows of every partition in one tree.
+		return t.scanDescending(ctx, where.from, where.to, matchRow)
+	}
+	// Only the partitions overlapping the range of ids are scanned.
+	return t.scanPartitions(where.from, where.to, desc, func(tree *Table, from uint32, to uint32) error {
+		if where.keysOnly {
+			return tree.scanKeys(ctx, from, to, desc, func(id uint32) error {
+				values := []any{int64(id), nil, nil}
+				if !where.match(values) {
+					return nil
+				}
+				return fn(values)
+			})
+		}
+		if desc {
+			return tree.scanRangeDesc(ctx, from, to, matchRow)
+		}
+		return tree.scanRange(ctx, from, to, matchRow)
+	})
+}
+
+/*
+compileWhere turns a where clause into a filter. Comparisons of the id with a
+number that every matching row has to pass narrow the range of ids that is
+scanned. Subqueries are run here, once, and their results kept in a hash set,
+so the outer scan never has to nest another one.
+*/
+func compileWhere(ctx context.Context, src rowSource, expr parser.Expr) (*filter, error) {
+	where := &filter{from: 0, to: math.MaxUint32, match: func(values []any) bool { return true }}
+	if expr == nil {
+		return where, nil
+	}
+	match, err := compileCondition(ctx, src, expr)
+	if err != nil {
+		return nil, err
+	}
+	where.match = match
+	if err := planWhere(src, expr, where); err != nil {
+		return nil, err
+	}
+	return where, nil
+}
+
+// readsOnlyId reports whether a select needs no column but the id, which is the key of the tree.
+func readsOnlyId(stmt *parser.Select) bool {
+	if len(stmt.Columns) == 0 || (stmt.GroupBy != "" && stmt.GroupBy != "id") || (stmt.OrderBy != "" && stmt.OrderBy != "id") {
+		return false
+	}
+	for _, item := range stmt.Columns {
+		if item.Column != "id" && item.Column != "*" {
+			return false
+		}
+	}
+	return exprReadsOnlyId(stmt.Where)
+}
+
+func exprReadsOnlyId(expr parser.Expr) bool {
+	switch e := expr.(type) {
+	case nil, *parser.Literal:
+		return true
+	case *parser.Column:
+		return e.Name == "id"
+	case *parser.Compare:
+		return exprReadsOnlyId(e.Left) && exprReadsOnlyId(e.Right)
+	case *parser.Logical:
+		return exprReadsOnlyId(e.Left) && exprReadsOnlyId(e.Right)
+	case *parser.Not:
+		return exprReadsOnlyId(e.Expr)
+	case *parser.Like:
+		return e.Column == "id"
+	case *parser.Match:
+		return e.Column == "id"
+	case *parser.Within:
+		// The box is in the spatial index, the row itself is not read.
+		return true
+	case *parser.In:
+		// The subquery runs on its own, only the column it is matched against is read here.
+		return e.Column == "id"
+	}
+	return false
+}
+
+func compileCondition(ctx context.Context, src rowSource, expr parser.Expr) (func(values []any) bool, error) {
+	names, valueTypes := src.columns()
+	switch e := expr.(type) {
+	case *parser.Logical:
+		left, err := compileCondition(ctx, src, e.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := compileCondition(ctx, src, e.Right)
+		if err != nil {
+			return nil, err
+		}
+		if e.Op == "and" {
+			return func(values []any) bool { return left(values) && right(values) }, nil
+		}
+		return func(values []any) bool { return left(values) || right(values) }, nil
+	case *parser.Not:
+		inner, err := compileCondition(ctx, src, e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return func(values []any) bool { return !inner(values) }, nil
+	case *parser.Compare:
+		return compileCompare(src, e)
+	case *parser.Like:
+		index := slices.Index(names, e.Column)
+		if index < 0 {
+			return nil, fmt.Errorf("no such column: %s", e.Column)
+		}
+		if valueTypes[index] != "text" {
+			return nil, fmt.Errorf("like needs a text column, but %s is %s", e.Column, valueTypes[index])
+		}
+		matches := compileLike(e.Pattern)
+		return func(values []any) bool { return matches(values[index].(string)) }, nil
+	case *parser.Match:
+		index := slices.Index(names, e.Column)
+		if index < 0 {
+			return nil, fmt.Errorf("no such column: %s", e.Column)
+		}
+		if valueTypes[index] != "text" {
+			return nil, fmt.Errorf("match needs a text column, but %s is %s", e.Column, valueTypes[index])
+		}
+		words := tokenize(e.Words)
+		return func(values []any) bool {
+			found := tokenize(values[index].(string))
+			return !slices.ContainsFunc(words, func(word string) bool {
+				_, ok := slices.BinarySearch(found, word)
+				return !ok
+			})
+		}, nil
+	case *parser.Within:
+		return compileWithin(src, e)
+	case *parser.In:
+		index := slices.Index(names, e.Column)
+		if index < 0 {
+			return nil, fmt.Errorf("no such column: %s", e.Column)
+		}
+		if e.Subquery.From != "" {
+			return nil, fmt.Errorf("a subquery can not read a view")
+		}
+		if selected, _ := selectedColumns(e.Subquery, names, valueTypes); len(selected) != 1 {
+			return nil, fmt.Errorf("subquery must return 1 column, but returns %d", len(selected))
+		}
+		set := map[any]bool{}
+		err := executeSelect(ctx, src, e.Subquery, func(values []any) error {
+			set[values[0]] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return func(values []any) bool { return set[values[index]] }, nil
+	case *parser.Column, *parser.Literal, *parser.Call:
+		return nil, fmt.Errorf("expected a condition, but got a value")
+	}
+	return nil, fmt.Errorf("unknown expression %T", expr)
+}
+
+func compileCompare(src rowSource, e *parser.Compare) (func(values []any) bool, error) {
+	names, valueTypes := src.columns()
+	left, leftType, err := compileOperand(names, valueTypes, e.Left)
+	if err != nil {
+		return nil, err
+	}
+	right, rightType, err := compileOperand(names, valueTypes, e.Right)
+	if err != nil {
+		return nil, err
+	}
+	if leftType != rightType {
+		return nil, fmt.Errorf("can not compare %s with %s", leftType, rightType)
+	}
+	var test func(c int) bool
+	switch e.Op {
+	case "=":
+		test = func(c int) bool { return c == 0 }
+	case "!=":
+		test = func(c int) bool { return c != 0 }
+	case "<":
+		test = func(c int) bool { return c < 0 }
+	case "<=":
+		test = func(c int) bool { return c <= 0 }
+	case ">":
+		test = func(c int) bool { return c > 0 }
+	case ">=":
+		test = func(c int) bool { return c >= 0 }
+	default:
+		return nil, fmt.Errorf("unknown comparison %s", e.Op)
+	}
+	// The collation of the column compared, the left one if both are columns.
+	collation := src.collation("")
+	if column, ok := e.Right.(*parser.Column); ok {
+		collation = src.collation(column.Name)
+	}
+	if column, ok := e.Left.(*parser.Column); ok {
+		collation = src.collation(column.Name)
+	}
+	return func(values []any) bool { return test(collation.compare(left(values), right(values))) }, nil
+}
+
+// compileOperand returns a function computing the value of a column, literal or
+// function of the columns names of valueTypes, and its type.
+func compileOperand(names []string, valueTypes []string, expr parser.Expr) (func(values []any) any, string, error) {
+	switch e := expr.(type) {
+	case *parser.Column:
+		index := slices.Index(names, e.Name)
+		if index < 0 {
+			return nil, "", fmt.Errorf("no such column: %s", e.Name)
+		}
+		return func(values []any) any { return values[index] }, valueTypes[index], nil
+	case *parser.Call:
+		return compileCall(names, valueTypes, e)
+	case *parser.Literal:
+		valueType := "integer"
+		if _, ok := e.Value.(string); ok {
+			valueType = "text"
+		}
+		return func(values []any) any { return e.Value }, valueType, nil
+	}
+	return nil, "", fmt.Errorf("expected a column or value, but got a condition")
+}
+
+// compileCall returns a function computing the value of a function of an operand, and its type.
+func compileCall(names []string, valueTypes []string, e *parser.Call) (func(values []any) any, string, error) {
+	if len(e.Args) != 1 {
+		return nil, "", fmt.Errorf("%s takes 1 argument, but got %d", e.Func, len(e.Args))
+	}
+	arg, argType, err := compileOperand(names, valueTypes, e.Args[0])
+	if err != nil {
+		return nil, "", err
+	}
+	if argType != "text" {
+		return nil, "", fmt.Errorf("%s needs text, but got %s", e.Func, argType)
+	}
+	switch e.Func {
+	case "lower":
+		return func(values []any) any { return strings.ToLower(arg(values).(string)) }, "text", nil
+	case "upper":
+		return func(values []any) any { return strings.ToUpper(arg(values).(string)) }, "text", nil
+	case "length":
+		return func(values []any) any { return int64(utf8.RuneCountInString(arg(values).(string))) }, "integer", nil
+	}
+	return nil, "", fmt.Errorf("unknown function: %s", e.Func)
+}
+
+/*
+compileLike returns a function matching text against a like pattern. The
+common patterns, a literal with a % at the start, the end or both, are
+turned into a plain prefix, suffix or substring test.
+*/
+func compileLike(pattern string) func(s string) bool {
+	literal := strings.Trim(pattern, "%")
+	if !strings.ContainsAny(literal, "%_") {
+		switch {
+		case pattern == literal:
+			return func(s string) bool { return s == literal }
+		case pattern == literal+"%":
+			return func(s string) bool { return strings.HasPrefix(s, literal) }
+		case pattern == "%"+literal:
+			return func(s string) bool { return strings.HasSuffix(s, literal) }
+		default:
+			return func(s string) bool { return strings.Contains(s, literal) }
+		}
+	}
+	p := []rune(pattern)
+	return func(s string) bool { return likeMatch(p, []rune(s)) }
+}
+
+// likeMatch matches greedily, when a mismatch is found after a % it retries
+// with the % taking one more character.
+func likeMatch(pattern []rune, s []rune) bool {
+	pi, si := 0, 0
+	starPi, starSi := -1, 0
+	for si < len(s) {
+		switch {
+		case pi < len(pattern) && pattern[pi] == '%':
+			starPi, starSi = pi, si
+			pi++
+		case pi < len(pattern) && (pattern[pi] == '_' || pattern[pi] == s[si]):
+			pi++
+			si++
+		case starPi >= 0:
+			starSi++
+			pi, si = starPi+1, starSi
+		default:
+			return false
+		}
+	}
+	for pi < len(pattern) && pattern[pi] == '%' {
+		pi++
+	}
+	return pi == len(pattern)
+}
+
+// narrowIdRange shrinks the range of ids a filter scans using the comparisons
+// of the id with a number that are joined to the rest of the condition by and.
+func narrowIdRange(expr parser.Expr, where *filter) {
+	switch e := expr.(type) {
+	case *parser.Logical:
+		if e.Op == "and" {
+			narrowIdRange(e.Left, where)
+			narrowIdRange(e.Right, where)
+		}
+	case *parser.Compare:
+		op, n, ok := idComparison(e)
+		if !ok {
+			return
+		}
+		// Bounds outside of the range of ids are clamped to it.
+		from, to := int64(where.from), int64(where.to)
+		switch op {
+		case "=":
+			from, to = max(from, n), min(to, n)
+		case "<":
+			to = min(to, n-1)
+		case "<=":
+			to = min(to, n)
+		case ">":
+			from = max(from, n+1)
+		case ">=":
+			from = max(from, n)
+		}
+		if from > to {
+			where.from, where.to = 1, 0
+			return
+		}
+		where.from, where.to = uint32(from), uint32(to)
+	}
+}
+
+// idComparison reports whether a comparison is between the id and a number,
+// and returns it rewritten as id <op> n.
+func idComparison(e *parser.Compare) (string, int64, bool) {
+	mirrored := map[string]string{"=": "=", "!=": "!=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+	column, ok := e.Left.(*parser.Column)
+	literal, isLiteral := e.Right.(*parser.Literal)
+	op := e.Op
+	if !ok {
+		column, ok = e.Right.(*parser.Column)
+		literal, isLiteral = e.Left.(*parser.Literal)
+		op = mirrored[op]
+	}
+	if !ok || !isLiteral || column.Name != "id" {
+		return "", 0, false
+	}
+	n, ok := literal.Value.(int64)
+	return op, n, ok
+}
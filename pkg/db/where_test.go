@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+func TestWhere(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	for i := 1; i <= 60; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i%7, i)))
+	}
+
+	tests := []struct {
+		where    string
+		expected func(id int) bool
+	}{
+		{"id = 5", func(id int) bool { return id == 5 }},
+		{"5 <= id and id < 9", func(id int) bool { return 5 <= id && id < 9 }},
+		{"id > 55 or id <= 2", func(id int) bool { return id > 55 || id <= 2 }},
+		{"not (id != 3)", func(id int) bool { return id == 3 }},
+		{"username = 'user3' and id >= 20 and not id > 40", func(id int) bool { return id%7 == 3 && id >= 20 && id <= 40 }},
+		{"email < 'user2' and id <> 1", func(id int) bool { return fmt.Sprintf("user%d@example.com", id) < "user2" && id != 1 }},
+		{"id > 100", func(id int) bool { return false }},
+		{"id < 0 or id = 60", func(id int) bool { return id == 60 }},
+		{"email like 'user1%' and id < 30", func(id int) bool { return strings.HasPrefix(fmt.Sprint(id), "1") && id < 30 }},
+		{"not email like '%5@example.com'", func(id int) bool { return id%10 != 5 }},
+	}
+	for _, test := range tests {
+		stmt, err := parser.Parse("select id where " + test.where)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", test.where, err)
+		}
+		got := []int{}
+		_, err = table.Execute(context.Background(), stmt, func(values []any) error {
+			got = append(got, int(values[0].(int64)))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Select where %s failed: %v", test.where, err)
+		}
+		expected := []int{}
+		for id := 1; id <= 60; id++ {
+			if test.expected(id) {
+				expected = append(expected, id)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("Select where %s: got %v, expected %v", test.where, got, expected)
+		}
+	}
+
+	stmt, _ := parser.Parse("select where id = 'x'")
+	if _, err := table.Execute(context.Background(), stmt, nil); err == nil || err.Error() != "can not compare integer with text" {
+		t.Fatalf("Expected a type error. Got: %v", err)
+	}
+}
+
+func TestLike(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		matches bool
+	}{
+		{"user1", "user1", true},
+		{"user1", "user10", false},
+		{"user1%", "user10", true},
+		{"%1", "user1", true},
+		{"%ser%", "user1", true},
+		{"%", "", true},
+		{"_", "", false},
+		{"u_er_", "user1", true},
+		{"u_er_", "user12", false},
+		{"%a%b%c", "xaybzcabc", true},
+		{"%a%b%c", "xaybzcab", false},
+		{"a%%b", "ab", true},
+		{"ü_", "üß", true},
+	}
+	for _, test := range tests {
+		if got := compileLike(test.pattern)(test.s); got != test.matches {
+			t.Fatalf("%q like %q = %v, expected %v", test.s, test.pattern, got, test.matches)
+		}
+	}
+}
+
+func TestWhereOnIdNarrowsScan(t *testing.T) {
+	table, _ := Open(MemoryDbName)
+	defer table.Close()
+	for i := 1; i <= 60; i++ {
+		table.Insert(context.Background(), parseRow(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)))
+	}
+	where, err := compileWhere(context.Background(), table, mustParseWhere(t, "id >= 20 and (id < 25 or username = 'x') and id <= 30"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if where.from != 20 || where.to != 30 {
+		t.Fatalf("Expected the scan to be narrowed to 20..30. Got: %d..%d", where.from, where.to)
+	}
+
+	// A full scan fetches pages a couple of times per row, a point query only around the one row.
+	fetches := table.pager.cacheHits + table.pager.cacheMisses
+	stmt, _ := parser.Parse("select where id = 42")
+	table.Execute(context.Background(), stmt, func(values []any) error { return nil })
+	if got := table.pager.cacheHits + table.pager.cacheMisses - fetches; got > 15 {
+		t.Fatalf("Expected a point query to fetch few pages. Got: %d", got)
+	}
+}
+
+func mustParseWhere(t *testing.T, where string) parser.Expr {
+	stmt, err := parser.Parse("select where " + where)
+	if err != nil {
+		t.Fatalf("Failed to parse %q: %v", where, err)
+	}
+	return stmt.(*parser.Select).Where
+}
@@ -0,0 +1,47 @@
+/*
+Package dberr holds the errors of the engine that callers may want to handle,
+so that they can tell them apart with errors.Is rather than by their text:
+
+	if err := table.Insert(ctx, row); errors.Is(err, dberr.ErrDuplicateKey) {
+		// The id is taken.
+	}
+
+The engine returns a sentinel as is where its text says everything, and an
+*Error, whose text names the key or page, where it does not.
+*/
+package dberr
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrDuplicateKey  = errors.New("duplicate key")         // A row with the id, or a unique value, exists.
+	ErrKeyNotFound   = errors.New("key not found")         // No row has the id.
+	ErrTableFull     = errors.New("table full")            // No page is left for the tree to grow.
+	ErrCorrupt       = errors.New("corrupt")               // A page or the file does not hold what it should.
+	ErrReadOnly      = errors.New("database is read-only") // The database was opened read-only.
+	ErrDeadlock      = errors.New("deadlock")              // Transactions wait for each other's row locks.
+	ErrLockTimeout   = errors.New("lock timeout")          // A row stayed locked longer than the lock timeout.
+	ErrSerialization = errors.New("serialization failure") // A transaction conflicts with one that committed after it began.
+)
+
+// Error is an error with a text of its own, which errors.Is matches to Code.
+type Error struct {
+	Code error // One of the sentinels above.
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Code
+}
+
+// Errorf returns an *Error with the code and a text formatted like fmt.Sprintf.
+func Errorf(code error, format string, args ...any) error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,258 @@
+package parser
+
+import (
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+// Statement is the root of the syntax tree of a parsed statement.
+type Statement interface {
+	statement()
+}
+
+type Insert struct {
+	Id       uint32
+	Username string
+	Email    string
+	TTL      int64      // Seconds until the row expires, 0 if it never does.
+	Box      *types.Box // Box of the row in the spatial index, nil if it has none.
+	Conflict string     // ignore or replace, from insert or ..., what to do if the id is taken. Empty to fail.
+	// Columns of the row as stored that the insert returns, * for all of them. Nil if it returns nothing.
+	Returning []string
+}
+
+type Select struct {
+	Columns []SelectItem // Empty for select *.
+	From    string       // Materialized view the rows are read from, empty for the table.
+	Where   Expr         // Nil if every row is selected.
+	GroupBy string       // Column the rows are grouped by, empty if they are not.
+	OrderBy string       // Column the rows are sorted by, empty for id order.
+	Desc    bool         // Sort in descending order.
+	Limit   *int64       // Maximum number of rows returned, nil if there is no limit.
+	Offset  int64        // Rows skipped before the first one returned.
+	Into    *Into        // File the rows are written to instead of being returned, nil if they are returned.
+}
+
+// Into is the target of select ... into <format> '<file>'. The engine returns
+// the rows as usual, the caller writes them to the file.
+type Into struct {
+	Format string // Only parquet.
+	File   string
+}
+
+// SelectItem is a column or an aggregate over a column in the select list.
+type SelectItem struct {
+	Aggregate string // count, min or max. Empty for a plain column.
+	Column    string // * for count(*).
+}
+
+func (item SelectItem) String() string {
+	if item.Aggregate == "" {
+		return item.Column
+	}
+	return item.Aggregate + "(" + item.Column + ")"
+}
+
+// Expr is a condition in a where clause, or a value compared in one.
+type Expr interface {
+	expr()
+}
+
+// Column is the value of a column of the row being matched.
+type Column struct {
+	Name string
+}
+
+// Literal is a number, which is an int64, or a string.
+type Literal struct {
+	Value any
+}
+
+// Compare compares two values with =, !=, <, <=, > or >=.
+type Compare struct {
+	Op    string
+	Left  Expr
+	Right Expr
+}
+
+// Logical combines two conditions with and or or.
+type Logical struct {
+	Op    string
+	Left  Expr
+	Right Expr
+}
+
+type Not struct {
+	Expr Expr
+}
+
+// In matches rows whose column value is among the rows of a subquery.
+type In struct {
+	Column   string
+	Subquery *Select
+}
+
+// Like matches a text column against a pattern, in which % stands for any
+// sequence of characters and _ for any single character.
+type Like struct {
+	Column  string
+	Pattern string
+}
+
+// Match matches a text column containing every word of Words, ignoring case
+// and punctuation, which a fulltext index on the column speeds up.
+type Match struct {
+	Column string
+	Words  string
+}
+
+// Within matches the rows whose box in the spatial index lies inside Box.
+type Within struct {
+	Box types.Box
+}
+
+// Call is the value of a function, lower, upper or length, of its arguments.
+type Call struct {
+	Func string
+	Args []Expr
+}
+
+func (*Like) expr()    {}
+func (*Within) expr()  {}
+func (*Match) expr()   {}
+func (*Column) expr()  {}
+func (*Literal) expr() {}
+func (*Compare) expr() {}
+func (*Logical) expr() {}
+func (*Not) expr()     {}
+func (*In) expr()      {}
+func (*Call) expr()    {}
+
+type Delete struct {
+	Id uint32
+}
+
+type Begin struct{}
+
+type Commit struct{}
+
+type Rollback struct{}
+
+type Savepoint struct {
+	Name string
+}
+
+type RollbackTo struct {
+	Name string
+}
+
+type Release struct {
+	Name string
+}
+
+// Privileges are what grant and revoke give and take: read allows select,
+// write insert and delete, and admin grant and revoke.
+var Privileges = []string{"read", "write", "admin"}
+
+type Grant struct {
+	Privileges []string
+	User       string
+}
+
+type Revoke struct {
+	Privileges []string
+	User       string
+}
+
+// CreateFulltextIndex indexes the words of text columns for match.
+type CreateFulltextIndex struct {
+	Columns []string
+}
+
+// DropFulltextIndex removes the fulltext index.
+type DropFulltextIndex struct{}
+
+// CreateSpatialIndex creates the index of the boxes of the rows for within.
+type CreateSpatialIndex struct{}
+
+// CreateUniqueIndex creates an index that keeps two rows from having values of
+// a column that compare equal, by the collation if one is given.
+type CreateUniqueIndex struct {
+	Column    string
+	Collation string // Empty for the collation of the column.
+}
+
+// CreateIndex creates an index storing the rows in the order of a column.
+type CreateIndex struct {
+	Column string
+	Desc   bool // In descending order.
+}
+
+// CreateView creates a materialized view storing the rows of Query.
+type CreateView struct {
+	Name     string
+	Query    *Select
+	Text     string // The text of the query, which the view keeps.
+	OnCommit bool   // Refreshed by every commit that changes rows, rather than on demand.
+}
+
+// RefreshView runs the query of a materialized view again.
+type RefreshView struct {
+	Name string
+}
+
+// AddColumn adds a generated column, whose value is computed from the other
+// columns of the row.
+type AddColumn struct {
+	Name   string
+	Expr   Expr
+	Text   string // The text of the expression, which the file header keeps.
+	Stored bool   // Computed when the row is inserted and kept, rather than when it is read.
+}
+
+// Collate sets the collation text values of a column are compared by.
+type Collate struct {
+	Column    string
+	Collation string
+}
+
+// Analyze samples the rows of the table and keeps statistics of them.
+type Analyze struct{}
+
+// Set changes a setting of the session.
+type Set struct {
+	Name    string        // lock_timeout or isolation.
+	Timeout time.Duration // How long a write waits for a row lock another transaction holds, 0 for as long as it takes.
+	Level   string        // The isolation level: read committed, snapshot or serializable.
+}
+
+// Partition splits the table into partitions starting at the bounds, after the
+// first one, which starts at 0.
+type Partition struct {
+	Bounds []uint32
+}
+
+func (*Insert) statement()              {}
+func (*Select) statement()              {}
+func (*Delete) statement()              {}
+func (*Begin) statement()               {}
+func (*Commit) statement()              {}
+func (*Rollback) statement()            {}
+func (*Savepoint) statement()           {}
+func (*RollbackTo) statement()          {}
+func (*Release) statement()             {}
+func (*Grant) statement()               {}
+func (*Revoke) statement()              {}
+func (*Partition) statement()           {}
+func (*CreateFulltextIndex) statement() {}
+func (*DropFulltextIndex) statement()   {}
+func (*CreateSpatialIndex) statement()  {}
+func (*CreateUniqueIndex) statement()   {}
+func (*CreateIndex) statement()         {}
+func (*CreateView) statement()          {}
+func (*RefreshView) statement()         {}
+func (*AddColumn) statement()           {}
+func (*Collate) statement()             {}
+func (*Analyze) statement()             {}
+func (*Set) statement()                 {}
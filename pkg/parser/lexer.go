@@ -0,0 +1,141 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type TokenKind int
+
+const (
+	TokEOF TokenKind = iota
+	TokWord
+	TokNumber
+	TokString
+	TokSymbol
+)
+
+type Token struct {
+	Kind TokenKind
+	Text string // For strings, the value without quotes and with escapes resolved.
+	Pos  int    // Byte offset of the token in the input.
+}
+
+// symbols are the punctuation characters that end a word.
+const symbols = "(),;*=<>!?"
+
+// twoCharSymbols are the operators made of two symbol characters.
+var twoCharSymbols = []string{"<=", ">=", "!=", "<>"}
+
+/*
+Lex splits a statement into tokens. Words are runs of anything but whitespace,
+quotes and symbols, so unquoted values like emails stay in one piece. A word
+made of digits only is a number. Strings are enclosed in single quotes, a
+quote inside one is written twice, or in double quotes, inside which a
+backslash escapes \", \\, \n and \t. The last token is always TokEOF.
+*/
+func Lex(text string) ([]Token, error) {
+	tokens := []Token{}
+	for pos := 0; pos < len(text); {
+		c := text[pos]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			pos++
+		case c == '\'':
+			value, end, err := lexString(text, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, Token{Kind: TokString, Text: value, Pos: pos})
+			pos = end
+		case c == '"':
+			value, end, err := lexDoubleQuotedString(text, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, Token{Kind: TokString, Text: value, Pos: pos})
+			pos = end
+		case strings.IndexByte(symbols, c) >= 0:
+			symbol := text[pos : pos+1]
+			for _, s := range twoCharSymbols {
+				if strings.HasPrefix(text[pos:], s) {
+					symbol = s
+				}
+			}
+			tokens = append(tokens, Token{Kind: TokSymbol, Text: symbol, Pos: pos})
+			pos += len(symbol)
+		default:
+			end := pos
+			for end < len(text) && !unicode.IsSpace(rune(text[end])) && text[end] != '\'' && text[end] != '"' && strings.IndexByte(symbols, text[end]) < 0 {
+				end++
+			}
+			kind := TokWord
+			if isDigits(text[pos:end]) {
+				kind = TokNumber
+			}
+			tokens = append(tokens, Token{Kind: kind, Text: text[pos:end], Pos: pos})
+			pos = end
+		}
+	}
+	return append(tokens, Token{Kind: TokEOF, Pos: len(text)}), nil
+}
+
+// lexString reads the quoted string starting at pos and returns its value and the offset after it.
+func lexString(text string, pos int) (string, int, error) {
+	var sb strings.Builder
+	for i := pos + 1; i < len(text); i++ {
+		if text[i] != '\'' {
+			sb.WriteByte(text[i])
+			continue
+		}
+		if i+1 < len(text) && text[i+1] == '\'' {
+			sb.WriteByte('\'')
+			i++
+			continue
+		}
+		return sb.String(), i + 1, nil
+	}
+	return "", 0, fmt.Errorf("unterminated string starting at position %d", pos)
+}
+
+// escapes maps the character after a backslash in a double-quoted string to the character it stands for.
+var escapes = map[byte]byte{'"': '"', '\\': '\\', 'n': '\n', 't': '\t'}
+
+// lexDoubleQuotedString reads the double-quoted string starting at pos and returns its value and the offset after it.
+func lexDoubleQuotedString(text string, pos int) (string, int, error) {
+	var sb strings.Builder
+	for i := pos + 1; i < len(text); i++ {
+		switch text[i] {
+		case '"':
+			return sb.String(), i + 1, nil
+		case '\\':
+			if i+1 == len(text) {
+				break
+			}
+			c, ok := escapes[text[i+1]]
+			if !ok {
+				return "", 0, fmt.Errorf("unknown escape sequence \\%c at position %d", text[i+1], i)
+			}
+			sb.WriteByte(c)
+			i++
+		default:
+			sb.WriteByte(text[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string starting at position %d", pos)
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Quote returns s as a string literal.
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
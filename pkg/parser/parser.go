@@ -0,0 +1,832 @@
+/*
+Package parser turns the text of a statement into a syntax tree.
+
+	insert [or ignore | or replace] <id> <username> <email> [ttl <seconds>] [at (<x1>, <y1>, <x2>, <y2>)]
+	       [returning * | <column>, ...]
+	select [* | <item>, ...] [from <view>] [where <condition>] [group by <column>]
+	       [order by <column> [asc | desc]] [limit <n>] [offset <n>] [into parquet '<file>']
+	delete <id>
+	begin | commit | rollback
+	savepoint <name>
+	rollback to [savepoint] <name>
+	release [savepoint] <name>
+	grant <privilege>, ... to <user>
+	revoke <privilege>, ... from <user>
+	partition by range (id) (<id>, ...)
+	create fulltext index on <column>, ...
+	drop fulltext index
+	create spatial index
+	create unique index on <column> [collate <collation>]
+	create index on <column> [asc | desc]
+	create materialized view <name> as <select> [refresh on commit]
+	refresh view <name>
+	add column <name> as (<value>) [stored | virtual]
+	alter column <column> collate <collation>
+	analyze
+	set lock_timeout = <duration>
+	set isolation level read committed | snapshot | serializable
+
+An item in the select list is a column, count(*), or count, min or max of a
+column. Conditions compare columns and values with =, !=, <>, <, <=, > and >=,
+test <column> like '<pattern>', <column> match '<words>', <column> in (<select>)
+or within(<x1>, <y1>, <x2>, <y2>), and are combined with and, or, not and
+parentheses. Values compared, and the values of generated columns, may apply
+the functions lower, upper and length to columns and other values. Privileges are read, write and admin. The ids of partition by range
+are where the partitions after the first start. The box of an insert and of
+within is given by two corners, x1 and y1 at most x2 and y2, whose coordinates
+may have a fraction and a sign. Values are numbers or quoted strings. Keywords
+are case-insensitive and a statement may end with a semicolon. A duration
+is a number with a unit, such as 5s or 200ms, or a number of milliseconds.
+*/
+package parser
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+type parser struct {
+	text   string
+	tokens []Token
+	pos    int
+}
+
+// Parse parses a single statement.
+func Parse(text string) (Statement, error) {
+	tokens, err := Lex(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{text: text, tokens: tokens}
+	stmt, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	p.symbol(";")
+	if tok := p.peek(); tok.Kind != TokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.Text, tok.Pos)
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseStatement() (Statement, error) {
+	switch {
+	case p.keyword("insert"):
+		return p.parseInsert()
+	case p.keyword("select"):
+		return p.parseSelect()
+	case p.keyword("delete"):
+		id, err := p.parseId()
+		if err != nil {
+			return nil, err
+		}
+		return &Delete{Id: id}, nil
+	case p.keyword("begin"):
+		return &Begin{}, nil
+	case p.keyword("commit"):
+		return &Commit{}, nil
+	case p.keyword("rollback"):
+		if !p.keyword("to") {
+			return &Rollback{}, nil
+		}
+		p.keyword("savepoint")
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		return &RollbackTo{Name: name}, nil
+	case p.keyword("savepoint"):
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		return &Savepoint{Name: name}, nil
+	case p.keyword("release"):
+		p.keyword("savepoint")
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		return &Release{Name: name}, nil
+	case p.keyword("grant"):
+		privileges, user, err := p.parseGrant("to")
+		if err != nil {
+			return nil, err
+		}
+		return &Grant{Privileges: privileges, User: user}, nil
+	case p.keyword("revoke"):
+		privileges, user, err := p.parseGrant("from")
+		if err != nil {
+			return nil, err
+		}
+		return &Revoke{Privileges: privileges, User: user}, nil
+	case p.keyword("partition"):
+		return p.parsePartition()
+	case p.keyword("analyze"):
+		return &Analyze{}, nil
+	case p.keyword("set"):
+		return p.parseSet()
+	case p.keyword("add"):
+		return p.parseAddColumn()
+	case p.keyword("alter"):
+		if !p.keyword("column") {
+			return nil, fmt.Errorf("expected column, but got %s", describe(p.peek()))
+		}
+		column, err := p.parseColumn()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword("collate") {
+			return nil, fmt.Errorf("expected collate, but got %s", describe(p.peek()))
+		}
+		tok := p.next()
+		if tok.Kind != TokWord {
+			return nil, fmt.Errorf("expected a collation, but got %s", describe(tok))
+		}
+		return &Collate{Column: column, Collation: strings.ToLower(tok.Text)}, nil
+	case p.keyword("refresh"):
+		if !p.keyword("view") {
+			return nil, fmt.Errorf("expected view, but got %s", describe(p.peek()))
+		}
+		name, err := p.parseViewName()
+		if err != nil {
+			return nil, err
+		}
+		return &RefreshView{Name: name}, nil
+	case p.keyword("create"):
+		if p.keyword("materialized") {
+			return p.parseCreateView()
+		}
+		if p.keyword("unique") {
+			if !p.keyword("index") || !p.keyword("on") {
+				return nil, fmt.Errorf("expected index on, but got %s", describe(p.peek()))
+			}
+			column, err := p.parseColumn()
+			if err != nil {
+				return nil, err
+			}
+			stmt := &CreateUniqueIndex{Column: column}
+			if p.keyword("collate") {
+				tok := p.next()
+				if tok.Kind != TokWord {
+					return nil, fmt.Errorf("expected a collation, but got %s", describe(tok))
+				}
+				stmt.Collation = strings.ToLower(tok.Text)
+			}
+			return stmt, nil
+		}
+		if p.keyword("index") {
+			if !p.keyword("on") {
+				return nil, fmt.Errorf("expected on, but got %s", describe(p.peek()))
+			}
+			column, err := p.parseColumn()
+			if err != nil {
+				return nil, err
+			}
+			stmt := &CreateIndex{Column: column}
+			if p.keyword("desc") {
+				stmt.Desc = true
+			} else {
+				p.keyword("asc")
+			}
+			return stmt, nil
+		}
+		if p.keyword("spatial") {
+			if !p.keyword("index") {
+				return nil, fmt.Errorf("expected index, but got %s", describe(p.peek()))
+			}
+			return &CreateSpatialIndex{}, nil
+		}
+		if !p.keyword("fulltext") || !p.keyword("index") || !p.keyword("on") {
+			return nil, fmt.Errorf("expected fulltext index on, but got %s", describe(p.peek()))
+		}
+		stmt := &CreateFulltextIndex{}
+		for {
+			tok := p.next()
+			if tok.Kind != TokWord {
+				return nil, fmt.Errorf("expected a column, but got %s", describe(tok))
+			}
+			stmt.Columns = append(stmt.Columns, strings.ToLower(tok.Text))
+			if !p.symbol(",") {
+				return stmt, nil
+			}
+		}
+	case p.keyword("drop"):
+		if !p.keyword("fulltext") || !p.keyword("index") {
+			return nil, fmt.Errorf("expected fulltext index, but got %s", describe(p.peek()))
+		}
+		return &DropFulltextIndex{}, nil
+	}
+	return nil, fmt.Errorf("unknown statement: %v", strings.TrimSpace(p.text))
+}
+
+// parseGrant parses the privileges and the user of grant and revoke, which
+// are separated by the keyword preposition.
+func (p *parser) parseGrant(preposition string) ([]string, string, error) {
+	privileges := []string{}
+	for {
+		tok := p.next()
+		privilege := strings.ToLower(tok.Text)
+		if tok.Kind != TokWord || !slices.Contains(Privileges, privilege) {
+			return nil, "", fmt.Errorf("expected a privilege, but got %s", describe(tok))
+		}
+		privileges = append(privileges, privilege)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if !p.keyword(preposition) {
+		return nil, "", fmt.Errorf("expected %s, but got %s", preposition, describe(p.peek()))
+	}
+	tok := p.next()
+	if tok.Kind != TokWord && tok.Kind != TokString {
+		return nil, "", fmt.Errorf("expected a user name, but got %s", describe(tok))
+	}
+	return privileges, tok.Text, nil
+}
+
+// parseViewName parses the name of a materialized view, lowercased.
+func (p *parser) parseViewName() (string, error) {
+	tok := p.next()
+	if tok.Kind != TokWord {
+		return "", fmt.Errorf("expected a view name, but got %s", describe(tok))
+	}
+	return strings.ToLower(tok.Text), nil
+}
+
+func (p *parser) parseCreateView() (Statement, error) {
+	if !p.keyword("view") {
+		return nil, fmt.Errorf("expected view, but got %s", describe(p.peek()))
+	}
+	name, err := p.parseViewName()
+	if err != nil {
+		return nil, err
+	}
+	if !p.keyword("as") {
+		return nil, fmt.Errorf("expected as, but got %s", describe(p.peek()))
+	}
+	start := p.peek().Pos
+	if !p.keyword("select") {
+		return nil, fmt.Errorf("expected a select, but got %s", describe(p.peek()))
+	}
+	query, err := p.parseSelect()
+	if err != nil {
+		return nil, err
+	}
+	// The text of the select is kept, it is what the view stores.
+	stmt := &CreateView{Name: name, Query: query.(*Select), Text: strings.TrimSpace(p.text[start:p.peek().Pos])}
+	if p.keyword("refresh") {
+		if !p.keyword("on") || !p.keyword("commit") {
+			return nil, fmt.Errorf("expected on commit, but got %s", describe(p.peek()))
+		}
+		stmt.OnCommit = true
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseAddColumn() (Statement, error) {
+	if !p.keyword("column") {
+		return nil, fmt.Errorf("expected column, but got %s", describe(p.peek()))
+	}
+	name, err := p.parseColumn()
+	if err != nil {
+		return nil, err
+	}
+	if !p.keyword("as") || !p.symbol("(") {
+		return nil, fmt.Errorf("expected as (, but got %s", describe(p.peek()))
+	}
+	start := p.peek().Pos
+	expr, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &AddColumn{Name: name, Expr: expr, Text: strings.TrimSpace(p.text[start:p.peek().Pos])}
+	if !p.symbol(")") {
+		return nil, fmt.Errorf("expected ), but got %s", describe(p.peek()))
+	}
+	if p.keyword("stored") {
+		stmt.Stored = true
+	} else {
+		p.keyword("virtual")
+	}
+	return stmt, nil
+}
+
+func (p *parser) parsePartition() (Statement, error) {
+	if !p.keyword("by") || !p.keyword("range") {
+		return nil, fmt.Errorf("expected by range, but got %s", describe(p.peek()))
+	}
+	if !p.symbol("(") || !p.keyword("id") || !p.symbol(")") {
+		return nil, fmt.Errorf("expected (id), tables can only be partitioned by id, but got %s", describe(p.peek()))
+	}
+	if !p.symbol("(") {
+		return nil, fmt.Errorf("expected ( before the partition bounds, but got %s", describe(p.peek()))
+	}
+	stmt := &Partition{}
+	for {
+		bound, err := p.parseId()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Bounds = append(stmt.Bounds, bound)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if !p.symbol(")") {
+		return nil, fmt.Errorf("expected ) after the partition bounds, but got %s", describe(p.peek()))
+	}
+	return stmt, nil
+}
+
+// parseSet parses set lock_timeout = <duration>, where = may also be written to,
+// and set isolation level <level>.
+func (p *parser) parseSet() (Statement, error) {
+	if p.keyword("isolation") {
+		if !p.keyword("level") {
+			return nil, fmt.Errorf("expected level, but got %s", describe(p.peek()))
+		}
+		switch {
+		case p.keyword("read"):
+			if !p.keyword("committed") {
+				return nil, fmt.Errorf("expected committed, but got %s", describe(p.peek()))
+			}
+			return &Set{Name: "isolation", Level: "read committed"}, nil
+		case p.keyword("snapshot"):
+			return &Set{Name: "isolation", Level: "snapshot"}, nil
+		case p.keyword("serializable"):
+			return &Set{Name: "isolation", Level: "serializable"}, nil
+		}
+		return nil, fmt.Errorf("expected read committed, snapshot or serializable, but got %s", describe(p.peek()))
+	}
+	if !p.keyword("lock_timeout") {
+		return nil, fmt.Errorf("unknown setting %s, expected lock_timeout or isolation", describe(p.peek()))
+	}
+	if !p.symbol("=") && !p.keyword("to") {
+		return nil, fmt.Errorf("expected = after lock_timeout, but got %s", describe(p.peek()))
+	}
+	tok := p.next()
+	timeout, err := time.ParseDuration(tok.Text)
+	if tok.Kind == TokNumber {
+		var ms int64
+		ms, err = strconv.ParseInt(tok.Text, 10, 64)
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	if (tok.Kind != TokWord && tok.Kind != TokNumber) || err != nil || timeout < 0 {
+		return nil, fmt.Errorf("expected a duration, but got %s", describe(tok))
+	}
+	return &Set{Name: "lock_timeout", Timeout: timeout}, nil
+}
+
+func (p *parser) parseInsert() (Statement, error) {
+	conflict := ""
+	if p.keyword("or") {
+		switch {
+		case p.keyword("ignore"):
+			conflict = "ignore"
+		case p.keyword("replace"):
+			conflict = "replace"
+		default:
+			return nil, fmt.Errorf("expected ignore or replace after insert or, but got %s", describe(p.peek()))
+		}
+	}
+	values := []Token{}
+	for tok := p.peek(); (tok.Kind == TokWord || tok.Kind == TokNumber || tok.Kind == TokString) && !p.isKeyword("returning"); tok = p.peek() {
+		values = append(values, p.next())
+	}
+	var box *types.Box
+	if len(values) > 3 && values[len(values)-1].Kind == TokWord && strings.EqualFold(values[len(values)-1].Text, "at") {
+		b, err := p.parseBox()
+		if err != nil {
+			return nil, err
+		}
+		box, values = &b, values[:len(values)-1]
+	}
+	var ttl int64
+	if len(values) == 5 && values[3].Kind == TokWord && strings.EqualFold(values[3].Text, "ttl") {
+		seconds, err := strconv.ParseInt(values[4].Text, 10, 64)
+		if values[4].Kind != TokNumber || err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("expected a number of seconds after ttl, but got %s", describe(values[4]))
+		}
+		ttl, values = seconds, values[:3]
+	}
+	if len(values) != 3 {
+		return nil, fmt.Errorf("expected 3 arguments for insert, but got %d", len(values))
+	}
+	id, err := toId(values[0])
+	if err != nil {
+		return nil, err
+	}
+	username, email := values[1].Text, values[2].Text
+	if len(username) > int(constants.UsernameSize) || len(email) > int(constants.EmailSize) {
+		return nil, fmt.Errorf("string is too long")
+	}
+	var returning []string
+	if p.keyword("returning") {
+		if p.symbol("*") {
+			returning = []string{"*"}
+		} else {
+			for {
+				column, err := p.parseColumn()
+				if err != nil {
+					return nil, err
+				}
+				returning = append(returning, column)
+				if !p.symbol(",") {
+					break
+				}
+			}
+		}
+	}
+	return &Insert{Id: id, Username: username, Email: email, TTL: ttl, Box: box, Conflict: conflict, Returning: returning}, nil
+}
+
+// parseBox parses the corners of a box, (<x1>, <y1>, <x2>, <y2>).
+func (p *parser) parseBox() (types.Box, error) {
+	if !p.symbol("(") {
+		return types.Box{}, fmt.Errorf("expected ( before the corners of a box, but got %s", describe(p.peek()))
+	}
+	coordinates := []float64{}
+	for len(coordinates) < 4 {
+		if len(coordinates) > 0 && !p.symbol(",") {
+			return types.Box{}, fmt.Errorf("expected 4 coordinates for a box, but got %d", len(coordinates))
+		}
+		tok := p.next()
+		c, err := strconv.ParseFloat(tok.Text, 64)
+		if (tok.Kind != TokNumber && tok.Kind != TokWord) || err != nil || math.IsInf(c, 0) || math.IsNaN(c) {
+			return types.Box{}, fmt.Errorf("expected a coordinate, but got %s", describe(tok))
+		}
+		coordinates = append(coordinates, c)
+	}
+	if !p.symbol(")") {
+		return types.Box{}, fmt.Errorf("expected ) after the corners of a box, but got %s", describe(p.peek()))
+	}
+	box := types.Box{MinX: coordinates[0], MinY: coordinates[1], MaxX: coordinates[2], MaxY: coordinates[3]}
+	if box.MinX > box.MaxX || box.MinY > box.MaxY {
+		return types.Box{}, fmt.Errorf("the first corner of a box must be below and left of the second")
+	}
+	return box, nil
+}
+
+func (p *parser) parseSelect() (Statement, error) {
+	stmt := &Select{}
+	if !p.symbol("*") && p.peek().Kind == TokWord && !p.isKeyword("from") && !p.isKeyword("where") &&
+		!p.isKeyword("group") && !p.isKeyword("order") && !p.isKeyword("limit") && !p.isKeyword("offset") && !p.isKeyword("into") {
+		for {
+			item, err := p.parseSelectItem()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Columns = append(stmt.Columns, item)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("from") {
+		name, err := p.parseViewName()
+		if err != nil {
+			return nil, err
+		}
+		stmt.From = name
+	}
+	if p.keyword("where") {
+		where, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = where
+	}
+	if p.keyword("group") {
+		if !p.keyword("by") {
+			return nil, fmt.Errorf("expected by, but got %s", describe(p.peek()))
+		}
+		column, err := p.parseColumn()
+		if err != nil {
+			return nil, err
+		}
+		stmt.GroupBy = column
+	}
+	if p.keyword("order") {
+		if !p.keyword("by") {
+			return nil, fmt.Errorf("expected by, but got %s", describe(p.peek()))
+		}
+		column, err := p.parseColumn()
+		if err != nil {
+			return nil, err
+		}
+		stmt.OrderBy = column
+		if p.keyword("desc") {
+			stmt.Desc = true
+		} else {
+			p.keyword("asc")
+		}
+	}
+	if p.keyword("limit") {
+		tok := p.next()
+		if tok.Kind != TokNumber {
+			return nil, fmt.Errorf("expected a number of rows, but got %s", describe(tok))
+		}
+		limit, err := strconv.ParseInt(tok.Text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("limit %s is out of range", tok.Text)
+		}
+		stmt.Limit = &limit
+	}
+	if p.keyword("offset") {
+		tok := p.next()
+		if tok.Kind != TokNumber {
+			return nil, fmt.Errorf("expected a number of rows, but got %s", describe(tok))
+		}
+		offset, err := strconv.ParseInt(tok.Text, 10, 64)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("offset %s is out of range", tok.Text)
+		}
+		stmt.Offset = offset
+	}
+	if p.keyword("into") {
+		if !p.keyword("parquet") {
+			return nil, fmt.Errorf("expected parquet, but got %s", describe(p.peek()))
+		}
+		tok := p.next()
+		if tok.Kind != TokString {
+			return nil, fmt.Errorf("expected a file name string, but got %s", describe(tok))
+		}
+		stmt.Into = &Into{Format: "parquet", File: tok.Text}
+	}
+	return stmt, nil
+}
+
+// parseCondition parses or, which binds weaker than and, which binds weaker than not.
+func (p *parser) parseCondition() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (Expr, error) {
+	if p.keyword("not") {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Expr: expr}, nil
+	}
+	if p.symbol("(") {
+		expr, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, fmt.Errorf("expected ), but got %s", describe(p.peek()))
+		}
+		return expr, nil
+	}
+	return p.parsePredicate()
+}
+
+var comparisons = []string{"=", "!=", "<>", "<", "<=", ">", ">="}
+
+// parsePredicate parses a comparison, <column> like '<pattern>', <column> match '<words>',
+// <column> in (<select>) or within(<x1>, <y1>, <x2>, <y2>).
+func (p *parser) parsePredicate() (Expr, error) {
+	if p.keyword("within") {
+		box, err := p.parseBox()
+		if err != nil {
+			return nil, err
+		}
+		return &Within{Box: box}, nil
+	}
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.keyword("like") {
+		column, ok := left.(*Column)
+		if !ok {
+			return nil, fmt.Errorf("expected a column before like")
+		}
+		tok := p.next()
+		if tok.Kind != TokString {
+			return nil, fmt.Errorf("expected a pattern string, but got %s", describe(tok))
+		}
+		return &Like{Column: column.Name, Pattern: tok.Text}, nil
+	}
+	if p.keyword("match") {
+		column, ok := left.(*Column)
+		if !ok {
+			return nil, fmt.Errorf("expected a column before match")
+		}
+		tok := p.next()
+		if tok.Kind != TokString {
+			return nil, fmt.Errorf("expected a string of words, but got %s", describe(tok))
+		}
+		return &Match{Column: column.Name, Words: tok.Text}, nil
+	}
+	if p.keyword("in") {
+		column, ok := left.(*Column)
+		if !ok {
+			return nil, fmt.Errorf("expected a column before in")
+		}
+		if !p.symbol("(") {
+			return nil, fmt.Errorf("expected (, but got %s", describe(p.peek()))
+		}
+		if !p.keyword("select") {
+			return nil, fmt.Errorf("expected a subquery, but got %s", describe(p.peek()))
+		}
+		subquery, err := p.parseSelect()
+		if err != nil {
+			return nil, err
+		}
+		if subquery.(*Select).Into != nil {
+			return nil, fmt.Errorf("a subquery can not select into a file")
+		}
+		if !p.symbol(")") {
+			return nil, fmt.Errorf("expected ), but got %s", describe(p.peek()))
+		}
+		return &In{Column: column.Name, Subquery: subquery.(*Select)}, nil
+	}
+	tok := p.next()
+	if tok.Kind != TokSymbol || !slices.Contains(comparisons, tok.Text) {
+		return nil, fmt.Errorf("expected a comparison, but got %s", describe(tok))
+	}
+	op := tok.Text
+	if op == "<>" {
+		op = "!="
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return &Compare{Op: op, Left: left, Right: right}, nil
+}
+
+var functions = []string{"lower", "upper", "length"}
+
+// parseOperand parses a column name, a number, a string or a function of operands.
+func (p *parser) parseOperand() (Expr, error) {
+	tok := p.next()
+	switch tok.Kind {
+	case TokWord:
+		if !p.symbol("(") {
+			return &Column{Name: strings.ToLower(tok.Text)}, nil
+		}
+		call := &Call{Func: strings.ToLower(tok.Text)}
+		if !slices.Contains(functions, call.Func) {
+			return nil, fmt.Errorf("unknown function: %s", tok.Text)
+		}
+		for !p.symbol(")") {
+			if len(call.Args) > 0 && !p.symbol(",") {
+				return nil, fmt.Errorf("expected , or ), but got %s", describe(p.peek()))
+			}
+			arg, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			call.Args = append(call.Args, arg)
+		}
+		return call, nil
+	case TokNumber:
+		n, err := strconv.ParseInt(tok.Text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("number %s is out of range", tok.Text)
+		}
+		return &Literal{Value: n}, nil
+	case TokString:
+		return &Literal{Value: tok.Text}, nil
+	}
+	return nil, fmt.Errorf("expected a column or value, but got %s", describe(tok))
+}
+
+var aggregates = []string{"count", "min", "max"}
+
+func (p *parser) parseSelectItem() (SelectItem, error) {
+	column, err := p.parseColumn()
+	if err != nil {
+		return SelectItem{}, err
+	}
+	if !p.symbol("(") {
+		return SelectItem{Column: column}, nil
+	}
+	item := SelectItem{Aggregate: strings.ToLower(column)}
+	if !slices.Contains(aggregates, item.Aggregate) {
+		return SelectItem{}, fmt.Errorf("unknown aggregate function: %s", column)
+	}
+	if item.Aggregate == "count" && p.symbol("*") {
+		item.Column = "*"
+	} else if item.Column, err = p.parseColumn(); err != nil {
+		return SelectItem{}, err
+	}
+	if !p.symbol(")") {
+		return SelectItem{}, fmt.Errorf("expected ), but got %s", describe(p.peek()))
+	}
+	return item, nil
+}
+
+func (p *parser) parseColumn() (string, error) {
+	tok := p.next()
+	if tok.Kind != TokWord {
+		return "", fmt.Errorf("expected a column name, but got %s", describe(tok))
+	}
+	return strings.ToLower(tok.Text), nil
+}
+
+func (p *parser) parseId() (uint32, error) {
+	return toId(p.next())
+}
+
+func toId(tok Token) (uint32, error) {
+	if tok.Kind != TokNumber {
+		return 0, fmt.Errorf("expected an id, but got %s", describe(tok))
+	}
+	id, err := strconv.ParseUint(tok.Text, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("id %s is out of range, the largest id is %d", tok.Text, uint32(math.MaxUint32))
+	}
+	return uint32(id), nil
+}
+
+func (p *parser) parseName() (string, error) {
+	tok := p.next()
+	if tok.Kind != TokWord && tok.Kind != TokNumber {
+		return "", fmt.Errorf("expected a savepoint name, but got %s", describe(tok))
+	}
+	return strings.ToLower(tok.Text), nil
+}
+
+func (p *parser) peek() Token {
+	return p.tokens[p.pos]
+}
+
+// next consumes the current token. At the end of the input it keeps returning TokEOF.
+func (p *parser) next() Token {
+	tok := p.tokens[p.pos]
+	if tok.Kind != TokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// keyword consumes the current token if it is the given keyword.
+func (p *parser) keyword(kw string) bool {
+	if p.isKeyword(kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) isKeyword(kw string) bool {
+	tok := p.peek()
+	return tok.Kind == TokWord && strings.EqualFold(tok.Text, kw)
+}
+
+// symbol consumes the current token if it is the given symbol.
+func (p *parser) symbol(s string) bool {
+	if tok := p.peek(); tok.Kind == TokSymbol && tok.Text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func describe(tok Token) string {
+	switch tok.Kind {
+	case TokEOF:
+		return "end of input"
+	case TokString:
+		return Quote(tok.Text)
+	}
+	return fmt.Sprintf("%q", tok.Text)
+}
@@ -0,0 +1,219 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected Statement
+	}{
+		{"insert 1 user1 person1@example.com", &Insert{Id: 1, Username: "user1", Email: "person1@example.com"}},
+		{"  INSERT   2\tuser2 'a@b.c' ; ", &Insert{Id: 2, Username: "user2", Email: "a@b.c"}},
+		{"insert 3 'John Smith' 'o''brien@example.com'", &Insert{Id: 3, Username: "John Smith", Email: "o'brien@example.com"}},
+		{`insert 5 "John Smith" "say \"hi\"\\n\ttab"`, &Insert{Id: 5, Username: "John Smith", Email: "say \"hi\"\\n\ttab"}},
+		{`insert 6 "it's" 'say "hi"'`, &Insert{Id: 6, Username: "it's", Email: `say "hi"`}},
+		{"INSERT 7 JohnSmith John@Example.COM", &Insert{Id: 7, Username: "JohnSmith", Email: "John@Example.COM"}},
+		{"insert 4294967295 '' x", &Insert{Id: 4294967295, Username: "", Email: "x"}},
+		{"insert 7 user7 a@b.c TTL 60", &Insert{Id: 7, Username: "user7", Email: "a@b.c", TTL: 60}},
+		{"set lock_timeout = 5s", &Set{Name: "lock_timeout", Timeout: 5 * time.Second}},
+		{"SET LOCK_TIMEOUT TO 250", &Set{Name: "lock_timeout", Timeout: 250 * time.Millisecond}},
+		{"set lock_timeout = 0;", &Set{Name: "lock_timeout"}},
+		{"set isolation level read committed", &Set{Name: "isolation", Level: "read committed"}},
+		{"SET ISOLATION LEVEL Serializable;", &Set{Name: "isolation", Level: "serializable"}},
+		{"insert or ignore 1 user1 a@b.c", &Insert{Id: 1, Username: "user1", Email: "a@b.c", Conflict: "ignore"}},
+		{"INSERT OR REPLACE 1 or a@b.c", &Insert{Id: 1, Username: "or", Email: "a@b.c", Conflict: "replace"}},
+		{"insert 1 user1 a@b.c returning *", &Insert{Id: 1, Username: "user1", Email: "a@b.c", Returning: []string{"*"}}},
+		{"insert 1 user1 a@b.c ttl 60 returning ID, email;", &Insert{Id: 1, Username: "user1", Email: "a@b.c", TTL: 60, Returning: []string{"id", "email"}}},
+		{"select", &Select{}},
+		{"select *;", &Select{}},
+		{"select email, id", &Select{Columns: []SelectItem{{Column: "email"}, {Column: "id"}}}},
+		{"select Username, COUNT(*), max(id) group by username", &Select{
+			Columns: []SelectItem{{Column: "username"}, {Aggregate: "count", Column: "*"}, {Aggregate: "max", Column: "id"}},
+			GroupBy: "username",
+		}},
+		{"select group by email", &Select{GroupBy: "email"}},
+		{"select id order by id desc limit 10", &Select{Columns: []SelectItem{{Column: "id"}}, OrderBy: "id", Desc: true, Limit: ptr(int64(10))}},
+		{"select order by Email asc", &Select{OrderBy: "email"}},
+		{"select limit 0", &Select{Limit: ptr(int64(0))}},
+		{"select id limit 10 offset 1000", &Select{Columns: []SelectItem{{Column: "id"}}, Limit: ptr(int64(10)), Offset: 1000}},
+		{"select offset 5", &Select{Offset: 5}},
+		{"select id where id in (select max(id) where email in (select email) group by username)", &Select{
+			Columns: []SelectItem{{Column: "id"}},
+			Where: &In{Column: "id", Subquery: &Select{
+				Columns: []SelectItem{{Aggregate: "max", Column: "id"}},
+				Where:   &In{Column: "email", Subquery: &Select{Columns: []SelectItem{{Column: "email"}}}},
+				GroupBy: "username",
+			}},
+		}},
+		{"select where not id = 1 or username <> 'x' and (5 < id)", &Select{Where: &Logical{
+			Op:   "or",
+			Left: &Not{Expr: &Compare{Op: "=", Left: &Column{Name: "id"}, Right: &Literal{Value: int64(1)}}},
+			Right: &Logical{
+				Op:    "and",
+				Left:  &Compare{Op: "!=", Left: &Column{Name: "username"}, Right: &Literal{Value: "x"}},
+				Right: &Compare{Op: "<", Left: &Literal{Value: int64(5)}, Right: &Column{Name: "id"}},
+			},
+		}}},
+		{"select where email like '%@example.com'", &Select{Where: &Like{Column: "email", Pattern: "%@example.com"}}},
+		{"SELECT Email WHERE Username = 'Bob'", &Select{
+			Columns: []SelectItem{{Column: "email"}},
+			Where:   &Compare{Op: "=", Left: &Column{Name: "username"}, Right: &Literal{Value: "Bob"}},
+		}},
+		{"select id, count(*) group by id into parquet 'out.parquet'", &Select{
+			Columns: []SelectItem{{Column: "id"}, {Aggregate: "count", Column: "*"}},
+			GroupBy: "id",
+			Into:    &Into{Format: "parquet", File: "out.parquet"},
+		}},
+		{"select INTO Parquet 'a b.parquet';", &Select{Into: &Into{Format: "parquet", File: "a b.parquet"}}},
+		{"delete 7", &Delete{Id: 7}},
+		{"begin", &Begin{}},
+		{"Commit;", &Commit{}},
+		{"rollback", &Rollback{}},
+		{"savepoint sp1", &Savepoint{Name: "sp1"}},
+		{"SAVEPOINT Sp1", &Savepoint{Name: "sp1"}},
+		{"rollback to sp1", &RollbackTo{Name: "sp1"}},
+		{"rollback to savepoint sp1", &RollbackTo{Name: "sp1"}},
+		{"release savepoint sp1", &Release{Name: "sp1"}},
+		{"grant read to alice", &Grant{Privileges: []string{"read"}, User: "alice"}},
+		{"GRANT Write, admin TO 'bob smith'", &Grant{Privileges: []string{"write", "admin"}, User: "bob smith"}},
+		{"revoke write from alice;", &Revoke{Privileges: []string{"write"}, User: "alice"}},
+		{"PARTITION BY RANGE (id) (100, 1000)", &Partition{Bounds: []uint32{100, 1000}}},
+		{"create fulltext index on Username, email", &CreateFulltextIndex{Columns: []string{"username", "email"}}},
+		{"drop fulltext index;", &DropFulltextIndex{}},
+		{"select where email match 'Example COM'", &Select{Where: &Match{Column: "email", Words: "Example COM"}}},
+		{"create spatial index", &CreateSpatialIndex{}},
+		{"insert 1 user1 a@b.c ttl 60 at (-1.5, 0, 2, 3e2)", &Insert{Id: 1, Username: "user1", Email: "a@b.c", TTL: 60,
+			Box: &types.Box{MinX: -1.5, MinY: 0, MaxX: 2, MaxY: 300}}},
+		{"select id where within(0, 0, 10, 10) and id > 5", &Select{Columns: []SelectItem{{Column: "id"}}, Where: &Logical{Op: "and",
+			Left:  &Within{Box: types.Box{MaxX: 10, MaxY: 10}},
+			Right: &Compare{Op: ">", Left: &Column{Name: "id"}, Right: &Literal{Value: int64(5)}}}}},
+		{"create materialized view Counts as select username, count(*) group by username  refresh on commit;", &CreateView{Name: "counts",
+			Query: &Select{Columns: []SelectItem{{Column: "username"}, {Aggregate: "count", Column: "*"}}, GroupBy: "username"},
+			Text:  "select username, count(*) group by username", OnCommit: true}},
+		{"create materialized view v as select * where id < 10", &CreateView{Name: "v",
+			Query: &Select{Where: &Compare{Op: "<", Left: &Column{Name: "id"}, Right: &Literal{Value: int64(10)}}}, Text: "select * where id < 10"}},
+		{"refresh view Counts", &RefreshView{Name: "counts"}},
+		{"select * from counts limit 5", &Select{From: "counts", Limit: ptr(int64(5))}},
+		{"add column Email_Lower as ( lower(email) ) stored", &AddColumn{Name: "email_lower",
+			Expr: &Call{Func: "lower", Args: []Expr{&Column{Name: "email"}}}, Text: "lower(email)", Stored: true}},
+		{"add column n as (length(upper('x'))) virtual", &AddColumn{Name: "n",
+			Expr: &Call{Func: "length", Args: []Expr{&Call{Func: "upper", Args: []Expr{&Literal{Value: "x"}}}}}, Text: "length(upper('x'))"}},
+		{"alter column Username collate NOCASE;", &Collate{Column: "username", Collation: "nocase"}},
+		{"create unique index on Username collate NOCASE", &CreateUniqueIndex{Column: "username", Collation: "nocase"}},
+		{"create unique index on email", &CreateUniqueIndex{Column: "email"}},
+		{"create index on ID desc", &CreateIndex{Column: "id", Desc: true}},
+		{"create index on id asc;", &CreateIndex{Column: "id"}},
+		{"ANALYZE;", &Analyze{}},
+		{"select where LOWER(username) = 'bob'", &Select{Where: &Compare{Op: "=",
+			Left: &Call{Func: "lower", Args: []Expr{&Column{Name: "username"}}}, Right: &Literal{Value: "bob"}}}},
+	}
+	for _, test := range tests {
+		stmt, err := Parse(test.text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", test.text, err)
+		}
+		if !reflect.DeepEqual(stmt, test.expected) {
+			t.Fatalf("Parse(%q) = %#v, expected %#v", test.text, stmt, test.expected)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"insert 1 user1", "expected 3 arguments for insert, but got 2"},
+		{"insert x user1 a@b.c", `expected an id, but got "x"`},
+		{"set timeout = 5s", `unknown setting "timeout", expected lock_timeout or isolation`},
+		{"set isolation read committed", `expected level, but got "read"`},
+		{"set isolation level read", "expected committed, but got end of input"},
+		{"set isolation level repeatable read", `expected read committed, snapshot or serializable, but got "repeatable"`},
+		{"set lock_timeout 5s", `expected = after lock_timeout, but got "5s"`},
+		{"set lock_timeout = -1s", `expected a duration, but got "-1s"`},
+		{"set lock_timeout = soon", `expected a duration, but got "soon"`},
+		{"insert or 1 user1 a@b.c", `expected ignore or replace after insert or, but got "1"`},
+		{"insert 1 user1 a@b.c returning", "expected a column name, but got end of input"},
+		{"insert 1 user1 a@b.c returning id,", "expected a column name, but got end of input"},
+		{"insert 1 user1 a@b.c ttl 0", `expected a number of seconds after ttl, but got "0"`},
+		{"insert 1 user1 a@b.c ttl x", `expected a number of seconds after ttl, but got "x"`},
+		{"insert 4294967296 user1 a@b.c", "id 4294967296 is out of range, the largest id is 4294967295"},
+		{"insert 1 " + strings.Repeat("a", 33) + " a@b.c", "string is too long"},
+		{"insert 1 'user1 a@b.c", "unterminated string starting at position 9"},
+		{`insert 1 "user1 a@b.c`, "unterminated string starting at position 9"},
+		{`insert 1 "a\"`, "unterminated string starting at position 9"},
+		{`insert 1 "a\x" b`, `unknown escape sequence \x at position 11`},
+		{"select 1", `unexpected "1" at position 7`},
+		{"select sum(id)", "unknown aggregate function: sum"},
+		{"select count(id", "expected ), but got end of input"},
+		{"select min(*)", `expected a column name, but got "*"`},
+		{"select id group email", "expected by, but got \"email\""},
+		{"select where id in select id", "expected (, but got \"select\""},
+		{"select where id in (1)", "expected a subquery, but got \"1\""},
+		{"select where id in (select id", "expected ), but got end of input"},
+		{"select where id", "expected a comparison, but got end of input"},
+		{"select where (id = 1", "expected ), but got end of input"},
+		{"select order id", `expected by, but got "id"`},
+		{"select limit x", `expected a number of rows, but got "x"`},
+		{"select limit 1 order by id", `unexpected "order" at position 15`},
+		{"select offset x", `expected a number of rows, but got "x"`},
+		{"select offset 1 limit 1", `unexpected "limit" at position 16`},
+		{"select where 1 in (select id)", "expected a column before in"},
+		{"select where email like x", `expected a pattern string, but got "x"`},
+		{"select into csv 'x'", `expected parquet, but got "csv"`},
+		{"select into parquet x", `expected a file name string, but got "x"`},
+		{"select where id in (select id into parquet 'x')", "a subquery can not select into a file"},
+		{"delete", "expected an id, but got end of input"},
+		{"savepoint", "expected a savepoint name, but got end of input"},
+		{"grant drop to alice", `expected a privilege, but got "drop"`},
+		{"grant read alice", `expected to, but got "alice"`},
+		{"revoke read from", "expected a user name, but got end of input"},
+		{"partition by range (username) (1)", `expected (id), tables can only be partitioned by id, but got "username"`},
+		{"partition by range (id) (1, 2", "expected ) after the partition bounds, but got end of input"},
+		{"create hash index on email", `expected fulltext index on, but got "hash"`},
+		{"select where email match alice", `expected a string of words, but got "alice"`},
+		{"create spatial", "expected index, but got end of input"},
+		{"insert 1 user1 a@b.c at;", `expected ( before the corners of a box, but got ";"`},
+		{"insert 1 user1 a@b.c at (1, 2, 3)", "expected 4 coordinates for a box, but got 3"},
+		{"select where within(0, 0, x, 1)", `expected a coordinate, but got "x"`},
+		{"select where within(0, 0, 1, 1", "expected ) after the corners of a box, but got end of input"},
+		{"select where within(2, 0, 1, 1)", "the first corner of a box must be below and left of the second"},
+		{"create materialized counts", `expected view, but got "counts"`},
+		{"create materialized view as select *", `expected as, but got "select"`},
+		{"create materialized view v select *", `expected as, but got "select"`},
+		{"create materialized view v as delete 1", `expected a select, but got "delete"`},
+		{"create materialized view v as select * refresh now", `expected on commit, but got "now"`},
+		{"refresh counts", `expected view, but got "counts"`},
+		{"select * from 'v'", `expected a view name, but got 'v'`},
+		{"add email", `expected column, but got "email"`},
+		{"add column x lower(email)", `expected as (, but got "lower"`},
+		{"add column x as (lower(email)", "expected ), but got end of input"},
+		{"select where trim(email) = 'x'", "unknown function: trim"},
+		{"select where lower(email username) = 'x'", `expected , or ), but got "username"`},
+		{"alter username", `expected column, but got "username"`},
+		{"alter column username nocase", `expected collate, but got "nocase"`},
+		{"create unique index username", `expected index on, but got "username"`},
+		{"create index id desc", `expected on, but got "id"`},
+		{"create index on id descending", `unexpected "descending" at position 19`},
+		{"alter column username collate 'nocase'", "expected a collation, but got 'nocase'"},
+		{"update 1", "unknown statement: update 1"},
+		{"", "unknown statement: "},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.text)
+		if err == nil || err.Error() != test.expected {
+			t.Fatalf("Parse(%q) error = %v, expected %q", test.text, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,709 @@
+/*
+Package raft keeps a log of commands the same on a small cluster of nodes
+with the Raft consensus algorithm, see https://raft.github.io/raft.pdf, and
+hands every committed entry to each node's state machine in log order.
+
+A node is a follower until it hears nothing from a leader for its election
+timeout, randomized so that nodes rarely time out together. It then asks
+the others for their votes in a new term, and becomes the leader if a
+majority grants them. A node votes once per term, and only for a candidate
+whose log is at least as up to date as its own, so a leader holds every
+committed entry. The leader appends the commands proposed to it to its log
+and sends the entries to the followers, which keep their logs equal to its
+own. An entry is committed once a majority holds it and it is from the
+leader's term, or comes before one that is. A new leader appends an entry
+without a command, which commits the entries of earlier terms it holds.
+
+The term, the vote and the log of a node are synced to files in its
+directory before it answers for them, so a node that restarts keeps its
+promises. The log is never compacted: it holds every entry since the
+cluster started, and a node that joins or lost its files catches up from
+the first entry. The members of the cluster are fixed.
+*/
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Entry is an entry of the log.
+type Entry struct {
+	Index   uint64    `json:"index"` // Position in the log, starting at 1.
+	Term    uint64    `json:"term"`  // The term of the leader that appended it.
+	Command string    `json:"command,omitempty"`
+	Time    time.Time `json:"time"` // When the leader appended it.
+}
+
+// Config configures a node.
+type Config struct {
+	ID    string   // The id of the node.
+	Peers []string // The ids of the other nodes of the cluster.
+	Dir   string   // The directory holding the term, vote and log of the node.
+	// Transport sends the requests of the node to its peers.
+	Transport Transport
+	// Apply runs a committed entry on the state machine. It is called in index
+	// order, once per entry, and not at the same time as itself. An entry
+	// without a command is called with too. Its result and error are what
+	// Propose of the entry returns, on the leader. An error wrapping
+	// ErrNotApplied means the state machine could not apply the entry at all,
+	// and stops the node, which can not apply the entries after it either.
+	Apply func(entry Entry) (any, error)
+	// Applied is the index of the last entry the state machine applied before
+	// the node started, which Apply is not called with again.
+	Applied uint64
+	// ElectionTimeout is the least time a follower waits for the leader before
+	// it starts an election, one second if 0. It waits up to twice as long.
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is how often the leader sends entries, or none, to its
+	// followers, a tenth of ElectionTimeout if 0.
+	HeartbeatInterval time.Duration
+	Logger            *slog.Logger // Nil to log nothing.
+}
+
+// ErrStopped is returned by Propose once the node was stopped.
+var ErrStopped = errors.New("the raft node is stopped")
+
+// ErrNotApplied is wrapped by the errors of Apply for entries it did not apply.
+var ErrNotApplied = errors.New("the entry was not applied")
+
+// ErrLeadershipLost is returned by Propose if the node stopped being the leader
+// before the entry was committed. Another leader may still commit it.
+var ErrLeadershipLost = errors.New("leadership was lost, the command may or may not be committed")
+
+// NotLeaderError is returned by Propose on a node that is not the leader.
+type NotLeaderError struct {
+	Leader string // The id of the leader, "" if the node does not know it.
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "this node is not the leader, and no leader is known"
+	}
+	return fmt.Sprintf("this node is not the leader, node %s is", e.Leader)
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// Node is a member of a cluster.
+type Node struct {
+	cfg     Config
+	storage *storage
+	logger  *slog.Logger
+
+	mu          sync.Mutex
+	term        uint64
+	votedFor    string
+	log         []Entry // log[i] has index i+1.
+	commitIndex uint64
+	lastApplied uint64
+	role        role
+	leader      string
+	deadline    time.Time // When a follower or candidate starts an election.
+	votes       int       // The votes a candidate was granted in its term.
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	sending     map[string]bool      // Whether a request to the peer awaits its response.
+	contact     map[string]time.Time // When the leader last heard from the peer.
+	waiters     map[uint64]*waiter   // The proposals of the leader, by index.
+	applied     *sync.Cond           // Signalled when commitIndex moves on or the node stops.
+	err         error                // Why the node stopped, if it did.
+	stopped     bool
+
+	wake chan struct{} // Makes the leader send entries right away.
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// waiter waits for the outcome of a proposed entry.
+type waiter struct {
+	term uint64
+	ch   chan outcome
+}
+
+type outcome struct {
+	result any
+	err    error
+}
+
+// Start starts a node with the term, vote and log in cfg.Dir, creating them
+// if the node is new.
+func Start(cfg Config) (*Node, error) {
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = time.Second
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = cfg.ElectionTimeout / 10
+	}
+	if cfg.ID == "" || cfg.Transport == nil || cfg.Apply == nil {
+		return nil, fmt.Errorf("a raft node needs an id, a transport and an apply function")
+	}
+	for _, peer := range cfg.Peers {
+		if peer == cfg.ID || peer == "" {
+			return nil, fmt.Errorf("invalid peer %q of node %s", peer, cfg.ID)
+		}
+	}
+	storage, state, log, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Applied > uint64(len(log)) {
+		storage.close()
+		return nil, fmt.Errorf("the state machine applied entry %d, the log in %s ends at %d", cfg.Applied, cfg.Dir, len(log))
+	}
+	n := &Node{
+		cfg:         cfg,
+		storage:     storage,
+		logger:      cfg.Logger,
+		term:        state.Term,
+		votedFor:    state.VotedFor,
+		log:         log,
+		commitIndex: cfg.Applied,
+		lastApplied: cfg.Applied,
+		sending:     map[string]bool{},
+		waiters:     map[uint64]*waiter{},
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	if n.logger == nil {
+		n.logger = slog.New(slog.DiscardHandler)
+	}
+	n.applied = sync.NewCond(&n.mu)
+	n.resetDeadline()
+	n.wg.Add(2)
+	go n.run()
+	go n.applyCommitted()
+	return n, nil
+}
+
+// Stop stops the node and waits for it to finish applying the entry it is
+// applying, if any. The proposals awaiting their outcome fail with ErrStopped.
+func (n *Node) Stop() error {
+	n.mu.Lock()
+	n.stopLocked(nil)
+	n.mu.Unlock()
+	n.wg.Wait()
+	return n.storage.close()
+}
+
+// stopLocked stops the node for err, nil if it was asked to stop.
+func (n *Node) stopLocked(err error) {
+	if n.stopped {
+		return
+	}
+	if err != nil {
+		n.logger.Error("raft node stopped", "id", n.cfg.ID, "err", err)
+		n.err = err
+	}
+	n.stopped = true
+	close(n.done)
+	n.failWaiters(0, ErrStopped)
+	n.applied.Broadcast()
+}
+
+// Err returns the error the node stopped for, nil if it runs or was stopped by Stop.
+func (n *Node) Err() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.err
+}
+
+// Leader returns the id of the leader, "" if the node does not know it, and
+// whether the node is the leader itself.
+func (n *Node) Leader() (string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader, n.role == leader
+}
+
+// Propose appends command to the log if the node is the leader, and waits for
+// it to be committed and applied. It returns what Apply returned. If ctx is
+// done first, the command may still be committed.
+func (n *Node) Propose(ctx context.Context, command string) (any, error) {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if n.role != leader {
+		leader := n.leader
+		n.mu.Unlock()
+		return nil, &NotLeaderError{Leader: leader}
+	}
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.term, Command: command, Time: time.Now().UTC()}
+	if err := n.appendLog([]Entry{entry}); err != nil {
+		n.stopLocked(err)
+		n.mu.Unlock()
+		return nil, err
+	}
+	w := &waiter{term: n.term, ch: make(chan outcome, 1)}
+	n.waiters[entry.Index] = w
+	n.advanceCommit()
+	n.mu.Unlock()
+	n.signal()
+
+	select {
+	case o := <-w.ch:
+		return o.result, o.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		if n.waiters[entry.Index] == w {
+			delete(n.waiters, entry.Index)
+		}
+		n.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// signal makes the leader send the entries it has to its followers.
+func (n *Node) signal() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run starts elections, or sends entries while the node leads, until it stops.
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		heartbeat := false
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			heartbeat = true
+		case <-n.wake:
+		}
+		n.mu.Lock()
+		switch {
+		case n.role == leader && heartbeat && !n.hasQuorum():
+			// A leader cut off from the others steps down rather than serve
+			// reads while another one is elected.
+			n.logger.Info("raft leader lost the majority", "id", n.cfg.ID, "term", n.term)
+			n.stepDown(n.term)
+		case n.role == leader:
+			n.sendEntries(heartbeat)
+		case time.Now().After(n.deadline):
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// applyCommitted hands the committed entries to Apply until the node stops.
+func (n *Node) applyCommitted() {
+	defer n.wg.Done()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		for !n.stopped && n.lastApplied >= n.commitIndex {
+			n.applied.Wait()
+		}
+		if n.stopped {
+			return
+		}
+		// Committed entries are never removed from the log.
+		entries := append([]Entry(nil), n.log[n.lastApplied:n.commitIndex]...)
+		n.mu.Unlock()
+		for _, entry := range entries {
+			result, err := n.cfg.Apply(entry)
+			n.mu.Lock()
+			if errors.Is(err, ErrNotApplied) {
+				n.stopLocked(fmt.Errorf("entry %d: %w", entry.Index, err))
+				n.mu.Unlock()
+				break
+			}
+			n.lastApplied = entry.Index
+			if w := n.waiters[entry.Index]; w != nil {
+				delete(n.waiters, entry.Index)
+				if w.term == entry.Term {
+					w.ch <- outcome{result, err}
+				} else {
+					w.ch <- outcome{err: ErrLeadershipLost}
+				}
+			}
+			stopped := n.stopped
+			n.mu.Unlock()
+			if stopped {
+				break
+			}
+		}
+		n.mu.Lock()
+	}
+}
+
+// lastIndex returns the index of the last entry of the log, 0 if it is empty.
+func (n *Node) lastIndex() uint64 {
+	return uint64(len(n.log))
+}
+
+// termAt returns the term of the entry at index, 0 for index 0.
+func (n *Node) termAt(index uint64) uint64 {
+	if index == 0 {
+		return 0
+	}
+	return n.log[index-1].Term
+}
+
+// hasQuorum returns whether the leader heard from a majority within the election timeout.
+func (n *Node) hasQuorum() bool {
+	count := 1
+	for _, contact := range n.contact {
+		if time.Since(contact) < n.cfg.ElectionTimeout {
+			count++
+		}
+	}
+	return n.majority(count)
+}
+
+// majority returns whether count nodes are a majority of the cluster.
+func (n *Node) majority(count int) bool {
+	return count > (len(n.cfg.Peers)+1)/2
+}
+
+// resetDeadline sets when the node starts an election if it hears from no leader.
+func (n *Node) resetDeadline() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+// setTerm moves the node on to a newer term, in which it votes for candidate.
+func (n *Node) setTerm(term uint64, votedFor string) error {
+	if err := n.storage.saveState(state{Term: term, VotedFor: votedFor}); err != nil {
+		return err
+	}
+	n.term, n.votedFor = term, votedFor
+	return nil
+}
+
+// stepDown makes the node a follower in term, newer than its own or the same.
+func (n *Node) stepDown(term uint64) error {
+	if term > n.term {
+		if err := n.setTerm(term, ""); err != nil {
+			return err
+		}
+		n.leader = ""
+	}
+	if n.role == leader {
+		n.leader = ""
+		n.failWaiters(0, ErrLeadershipLost)
+		n.resetDeadline()
+	}
+	n.role = follower
+	return nil
+}
+
+// failWaiters fails the proposals of the entries from index on.
+func (n *Node) failWaiters(index uint64, err error) {
+	for i, w := range n.waiters {
+		if i >= index {
+			w.ch <- outcome{err: err}
+			delete(n.waiters, i)
+		}
+	}
+}
+
+// appendLog appends entries to the log, synced to the log file.
+func (n *Node) appendLog(entries []Entry) error {
+	if err := n.storage.append(entries); err != nil {
+		return err
+	}
+	n.log = append(n.log, entries...)
+	return nil
+}
+
+// startElection makes the node a candidate in a new term and asks its peers for votes.
+func (n *Node) startElection() {
+	if err := n.setTerm(n.term+1, n.cfg.ID); err != nil {
+		n.stopLocked(err)
+		return
+	}
+	n.role = candidate
+	n.leader = ""
+	n.votes = 1
+	n.resetDeadline()
+	n.logger.Info("raft election started", "id", n.cfg.ID, "term", n.term)
+	if n.majority(n.votes) {
+		n.becomeLeader()
+		return
+	}
+	request := VoteRequest{
+		Term:         n.term,
+		Candidate:    n.cfg.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.termAt(n.lastIndex()),
+	}
+	for _, peer := range n.cfg.Peers {
+		go n.requestVote(peer, request)
+	}
+}
+
+// requestVote asks peer for its vote and counts it.
+func (n *Node) requestVote(peer string, request VoteRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	defer cancel()
+	response, err := n.cfg.Transport.RequestVote(ctx, peer, request)
+	if err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return
+	}
+	if response.Term > n.term {
+		if err := n.stepDown(response.Term); err != nil {
+			n.stopLocked(err)
+		}
+		return
+	}
+	if n.role != candidate || n.term != request.Term || !response.Granted {
+		return
+	}
+	n.votes++
+	if n.majority(n.votes) {
+		n.becomeLeader()
+	}
+}
+
+// becomeLeader makes a candidate the leader of its term.
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leader = n.cfg.ID
+	n.nextIndex = map[string]uint64{}
+	n.matchIndex = map[string]uint64{}
+	n.contact = map[string]time.Time{}
+	for _, peer := range n.cfg.Peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		n.contact[peer] = time.Now()
+	}
+	n.logger.Info("raft leader elected", "id", n.cfg.ID, "term", n.term)
+	// The entries of earlier terms are committed along with one of the leader's own.
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.term, Time: time.Now().UTC()}
+	if err := n.appendLog([]Entry{entry}); err != nil {
+		n.stopLocked(err)
+		return
+	}
+	n.advanceCommit()
+	n.sendEntries(true)
+}
+
+// sendEntries sends every follower the entries it lacks. A heartbeat goes to
+// the followers it has nothing for as well, other than those a request to
+// is still on its way to.
+func (n *Node) sendEntries(heartbeat bool) {
+	for _, peer := range n.cfg.Peers {
+		if n.sending[peer] || (!heartbeat && n.nextIndex[peer] > n.lastIndex()) {
+			continue
+		}
+		prev := n.nextIndex[peer] - 1
+		request := AppendRequest{
+			Term:        n.term,
+			Leader:      n.cfg.ID,
+			PrevIndex:   prev,
+			PrevTerm:    n.termAt(prev),
+			Entries:     append([]Entry(nil), n.log[prev:min(n.lastIndex(), prev+maxEntries)]...),
+			CommitIndex: n.commitIndex,
+		}
+		n.sending[peer] = true
+		go n.appendEntries(peer, request)
+	}
+}
+
+// maxEntries is the most entries sent in a request.
+const maxEntries = 256
+
+// appendEntries sends request to peer and handles its response.
+func (n *Node) appendEntries(peer string, request AppendRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	defer cancel()
+	response, err := n.cfg.Transport.AppendEntries(ctx, peer, request)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sending[peer] = false
+	if err != nil || n.stopped {
+		return
+	}
+	if response.Term > n.term {
+		if err := n.stepDown(response.Term); err != nil {
+			n.stopLocked(err)
+		}
+		return
+	}
+	if n.role != leader || n.term != request.Term {
+		return
+	}
+	n.contact[peer] = time.Now()
+	if response.Success {
+		match := request.PrevIndex + uint64(len(request.Entries))
+		n.matchIndex[peer] = max(n.matchIndex[peer], match)
+		n.nextIndex[peer] = max(n.nextIndex[peer], match+1)
+		n.advanceCommit()
+	} else {
+		// The follower lacks the entry before those sent, or holds another one
+		// there: the entries go back to the first it may agree on.
+		n.nextIndex[peer] = max(1, min(response.ConflictIndex, n.nextIndex[peer]-1))
+	}
+	if n.nextIndex[peer] <= n.lastIndex() {
+		n.signal()
+	}
+}
+
+// advanceCommit commits the entries a majority holds, up to the last one of the leader's term.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.term; index-- {
+		count := 1
+		for _, match := range n.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if n.majority(count) {
+			n.commitIndex = index
+			n.applied.Broadcast()
+			return
+		}
+	}
+}
+
+// VoteRequest asks for a node's vote.
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+// VoteResponse answers a VoteRequest.
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest sends a follower the entries after the one at PrevIndex.
+type AppendRequest struct {
+	Term        uint64  `json:"term"`
+	Leader      string  `json:"leader"`
+	PrevIndex   uint64  `json:"prevIndex"`
+	PrevTerm    uint64  `json:"prevTerm"`
+	Entries     []Entry `json:"entries,omitempty"`
+	CommitIndex uint64  `json:"commitIndex"` // The leader's.
+}
+
+// AppendResponse answers an AppendRequest.
+type AppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// ConflictIndex is where the leader goes back to if the follower lacks
+	// the entry at PrevIndex or holds one of another term there: the end of
+	// its log, or the first entry of the term of its entry there.
+	ConflictIndex uint64 `json:"conflictIndex,omitempty"`
+}
+
+// RequestVote answers a candidate asking for the node's vote.
+func (n *Node) RequestVote(request VoteRequest) (VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return VoteResponse{}, ErrStopped
+	}
+	if request.Term > n.term {
+		if err := n.stepDown(request.Term); err != nil {
+			n.stopLocked(err)
+			return VoteResponse{}, err
+		}
+	}
+	lastTerm := n.termAt(n.lastIndex())
+	upToDate := request.LastLogTerm > lastTerm || (request.LastLogTerm == lastTerm && request.LastLogIndex >= n.lastIndex())
+	if request.Term < n.term || !upToDate || (n.votedFor != "" && n.votedFor != request.Candidate) {
+		return VoteResponse{Term: n.term}, nil
+	}
+	if err := n.setTerm(n.term, request.Candidate); err != nil {
+		n.stopLocked(err)
+		return VoteResponse{}, err
+	}
+	n.resetDeadline()
+	return VoteResponse{Term: n.term, Granted: true}, nil
+}
+
+// AppendEntries takes the entries a leader sends.
+func (n *Node) AppendEntries(request AppendRequest) (AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return AppendResponse{}, ErrStopped
+	}
+	if request.Term < n.term {
+		return AppendResponse{Term: n.term}, nil
+	}
+	// There is one leader per term, so a candidate of the same term lost.
+	if err := n.stepDown(request.Term); err != nil {
+		n.stopLocked(err)
+		return AppendResponse{}, err
+	}
+	n.leader = request.Leader
+	n.resetDeadline()
+
+	if request.PrevIndex > n.lastIndex() {
+		return AppendResponse{Term: n.term, ConflictIndex: n.lastIndex() + 1}, nil
+	}
+	if term := n.termAt(request.PrevIndex); term != request.PrevTerm {
+		first := request.PrevIndex
+		for first > 1 && n.termAt(first-1) == term {
+			first--
+		}
+		return AppendResponse{Term: n.term, ConflictIndex: first}, nil
+	}
+	entries := request.Entries
+	for len(entries) > 0 && entries[0].Index <= n.lastIndex() {
+		if n.termAt(entries[0].Index) != entries[0].Term {
+			// The entries from here on were never committed, the leader holds
+			// every committed one.
+			if err := n.truncateLog(entries[0].Index); err != nil {
+				n.stopLocked(err)
+				return AppendResponse{}, err
+			}
+			break
+		}
+		entries = entries[1:]
+	}
+	if len(entries) > 0 {
+		if err := n.appendLog(entries); err != nil {
+			n.stopLocked(err)
+			return AppendResponse{}, err
+		}
+	}
+	if last := request.PrevIndex + uint64(len(request.Entries)); request.CommitIndex > n.commitIndex {
+		n.commitIndex = max(n.commitIndex, min(request.CommitIndex, last))
+		n.applied.Broadcast()
+	}
+	return AppendResponse{Term: n.term, Success: true}, nil
+}
+
+// truncateLog removes the entries from index on.
+func (n *Node) truncateLog(index uint64) error {
+	if index <= n.commitIndex {
+		return fmt.Errorf("entry %d is committed and can not be removed", index)
+	}
+	if err := n.storage.rewrite(n.log[:index-1]); err != nil {
+		return err
+	}
+	n.log = n.log[:index-1]
+	n.failWaiters(index, ErrLeadershipLost)
+	return nil
+}
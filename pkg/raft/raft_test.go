@@ -0,0 +1,394 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// network delivers the requests between the nodes of a test cluster, other
+// than those from or to a node cut off.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	cut   map[string]bool
+}
+
+func (n *network) route(from string, to string) (*Node, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.cut[from] || n.cut[to] || n.nodes[to] == nil {
+		return nil, fmt.Errorf("%s can not reach %s", from, to)
+	}
+	return n.nodes[to], nil
+}
+
+type memTransport struct {
+	network *network
+	from    string
+}
+
+func (t memTransport) RequestVote(ctx context.Context, peer string, request VoteRequest) (VoteResponse, error) {
+	node, err := t.network.route(t.from, peer)
+	if err != nil {
+		return VoteResponse{}, err
+	}
+	response, err := node.RequestVote(request)
+	// The response is lost if the node was cut off meanwhile.
+	if _, routeErr := t.network.route(peer, t.from); routeErr != nil {
+		return VoteResponse{}, routeErr
+	}
+	return response, err
+}
+
+func (t memTransport) AppendEntries(ctx context.Context, peer string, request AppendRequest) (AppendResponse, error) {
+	node, err := t.network.route(t.from, peer)
+	if err != nil {
+		return AppendResponse{}, err
+	}
+	response, err := node.AppendEntries(request)
+	if _, routeErr := t.network.route(peer, t.from); routeErr != nil {
+		return AppendResponse{}, routeErr
+	}
+	return response, err
+}
+
+// testCluster is a cluster whose state machines record the entries applied.
+type testCluster struct {
+	t       *testing.T
+	ids     []string
+	dir     string
+	network *network
+
+	mu      sync.Mutex
+	applied map[string][]Entry
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	c := &testCluster{
+		t:       t,
+		dir:     t.TempDir(),
+		network: &network{nodes: map[string]*Node{}, cut: map[string]bool{}},
+		applied: map[string][]Entry{},
+	}
+	for i := range size {
+		c.ids = append(c.ids, fmt.Sprint(i+1))
+	}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for _, id := range c.ids {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// start starts a node, whose state machine kept the entries it applied before.
+func (c *testCluster) start(id string) {
+	c.mu.Lock()
+	applied := uint64(len(c.applied[id]))
+	c.mu.Unlock()
+	node, err := Start(Config{
+		ID:        id,
+		Peers:     slices.DeleteFunc(slices.Clone(c.ids), func(peer string) bool { return peer == id }),
+		Dir:       filepath.Join(c.dir, id),
+		Transport: memTransport{network: c.network, from: id},
+		Apply: func(entry Entry) (any, error) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if entry.Index != uint64(len(c.applied[id])+1) {
+				c.t.Errorf("Node %s applied entry %d after %d", id, entry.Index, len(c.applied[id]))
+			}
+			c.applied[id] = append(c.applied[id], entry)
+			return entry.Index, nil
+		},
+		Applied:           applied,
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		c.t.Fatalf("Start(%s) failed: %v", id, err)
+	}
+	c.network.mu.Lock()
+	c.network.nodes[id] = node
+	c.network.mu.Unlock()
+}
+
+func (c *testCluster) stop(id string) {
+	c.network.mu.Lock()
+	node := c.network.nodes[id]
+	delete(c.network.nodes, id)
+	c.network.mu.Unlock()
+	if node != nil {
+		node.Stop()
+	}
+}
+
+func (c *testCluster) setCut(id string, cut bool) {
+	c.network.mu.Lock()
+	c.network.cut[id] = cut
+	c.network.mu.Unlock()
+}
+
+func (c *testCluster) node(id string) *Node {
+	c.network.mu.Lock()
+	defer c.network.mu.Unlock()
+	return c.network.nodes[id]
+}
+
+// leader waits for a leader among the nodes not cut off and returns it.
+func (c *testCluster) leader() string {
+	c.t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, id := range c.ids {
+			c.network.mu.Lock()
+			cut := c.network.cut[id]
+			c.network.mu.Unlock()
+			if node := c.node(id); node != nil && !cut {
+				if _, isLeader := node.Leader(); isLeader {
+					return id
+				}
+			}
+		}
+	}
+	c.t.Fatalf("No leader was elected")
+	return ""
+}
+
+// propose proposes command to the leader until it is committed.
+func (c *testCluster) propose(command string) uint64 {
+	c.t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		result, err := c.node(c.leader()).Propose(ctx, command)
+		cancel()
+		if err == nil {
+			return result.(uint64)
+		}
+	}
+	c.t.Fatalf("%q was not committed", command)
+	return 0
+}
+
+// commands returns the commands a node applied.
+func (c *testCluster) commands(id string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	commands := []string{}
+	for _, entry := range c.applied[id] {
+		if entry.Command != "" {
+			commands = append(commands, entry.Command)
+		}
+	}
+	return commands
+}
+
+// converge waits for every node to apply the same entries, and returns their commands.
+func (c *testCluster) converge() []string {
+	c.t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		c.mu.Lock()
+		same := true
+		for _, id := range c.ids {
+			same = same && slices.Equal(c.applied[id], c.applied[c.ids[0]])
+		}
+		c.mu.Unlock()
+		if same {
+			return c.commands(c.ids[0])
+		}
+	}
+	c.check()
+	c.t.Fatalf("The nodes did not apply the same entries")
+	return nil
+}
+
+// check fails unless the entries applied by one node start the entries applied by every other.
+func (c *testCluster) check() {
+	c.t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, a := range c.ids {
+		for _, b := range c.ids {
+			shorter, longer := c.applied[a], c.applied[b]
+			if len(shorter) > len(longer) {
+				continue
+			}
+			if !slices.Equal(shorter, longer[:len(shorter)]) {
+				c.t.Fatalf("Nodes %s and %s applied different entries: %v and %v", a, b, shorter, longer)
+			}
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := newTestCluster(t, 3)
+	expected := []string{}
+	for i := range 20 {
+		command := fmt.Sprintf("insert %d", i)
+		c.propose(command)
+		expected = append(expected, command)
+	}
+	if commands := c.converge(); !slices.Equal(commands, expected) {
+		t.Fatalf("Expected %v. Got: %v", expected, commands)
+	}
+	// A follower refuses proposals.
+	leader := c.leader()
+	follower := c.ids[0]
+	if follower == leader {
+		follower = c.ids[1]
+	}
+	var notLeader *NotLeaderError
+	if _, err := c.node(follower).Propose(context.Background(), "x"); !errors.As(err, &notLeader) || notLeader.Leader != leader {
+		t.Fatalf("Expected a follower to name leader %s. Got: %v", leader, err)
+	}
+}
+
+func TestLeaderCutOff(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.propose("a")
+	old := c.leader()
+	c.setCut(old, true)
+	// The leader can not commit alone.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := c.node(old).Propose(ctx, "lost"); err == nil {
+		t.Fatalf("Expected a leader cut off not to commit")
+	}
+	if leader := c.leader(); leader == old {
+		t.Fatalf("Expected another leader than %s", old)
+	}
+	// Hearing from no one, the old leader steps down.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, isLeader := c.node(old).Leader(); !isLeader {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected node %s to step down", old)
+		}
+	}
+	c.propose("b")
+	c.setCut(old, false)
+	c.propose("c")
+	if commands := c.converge(); !slices.Equal(commands, []string{"a", "b", "c"}) {
+		t.Fatalf("Expected the entry of the old leader to be dropped. Got: %v", commands)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.propose("a")
+	c.propose("b")
+	c.converge()
+	for _, id := range c.ids {
+		c.stop(id)
+	}
+	// One state machine lost what it applied, the others did not.
+	c.mu.Lock()
+	c.applied[c.ids[0]] = nil
+	c.mu.Unlock()
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	c.propose("c")
+	if commands := c.converge(); !slices.Equal(commands, []string{"a", "b", "c"}) {
+		t.Fatalf("Expected the log to survive a restart. Got: %v", commands)
+	}
+
+	// A node whose state machine is ahead of its log does not start.
+	_, err := Start(Config{ID: "4", Dir: t.TempDir(), Transport: memTransport{}, Apply: func(Entry) (any, error) { return nil, nil }, Applied: 1})
+	if err == nil {
+		t.Fatalf("Expected a node with an empty log and an entry applied to fail")
+	}
+}
+
+func TestRandomized(t *testing.T) {
+	duration := 3 * time.Second
+	if testing.Short() {
+		duration = 500 * time.Millisecond
+	}
+	c := newTestCluster(t, 5)
+	random := rand.New(rand.NewSource(1))
+	committed := []string{}
+	var committedMu sync.Mutex
+	stopProposing := make(chan struct{})
+	var wg sync.WaitGroup
+	for client := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stopProposing:
+					return
+				default:
+				}
+				for _, id := range c.ids {
+					node := c.node(id)
+					if node == nil {
+						continue
+					}
+					// A command that timed out may still be committed, so a retry is another command.
+					command := fmt.Sprintf("%d-%d-%s", client, i, id)
+					ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+					_, err := node.Propose(ctx, command)
+					cancel()
+					if err == nil {
+						committedMu.Lock()
+						committed = append(committed, command)
+						committedMu.Unlock()
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	// Nodes are cut off, healed and restarted at random, at most two at a time.
+	down := map[string]bool{}
+	for end := time.Now().Add(duration); time.Now().Before(end); time.Sleep(time.Duration(random.Intn(100)) * time.Millisecond) {
+		id := c.ids[random.Intn(len(c.ids))]
+		switch {
+		case down[id]:
+			c.setCut(id, false)
+			delete(down, id)
+		case len(down) < 2 && random.Intn(2) == 0:
+			c.setCut(id, true)
+			down[id] = true
+		case len(down) < 2:
+			c.stop(id)
+			c.start(id)
+		}
+		c.check()
+	}
+	for id := range down {
+		c.setCut(id, false)
+	}
+	close(stopProposing)
+	wg.Wait()
+	c.propose("last")
+	commands := c.converge()
+	// Every command committed was applied, once.
+	for _, command := range committed {
+		if slices.Index(commands, command) < 0 {
+			t.Fatalf("Command %s was committed but not applied", command)
+		}
+	}
+	seen := map[string]bool{}
+	for _, command := range commands {
+		if seen[command] {
+			t.Fatalf("Command %s was applied twice", command)
+		}
+		seen[command] = true
+	}
+	if len(committed) == 0 {
+		t.Fatalf("Expected commands to be committed")
+	}
+}
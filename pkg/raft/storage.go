@@ -0,0 +1,170 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The files in the directory of a node.
+const (
+	stateName = "state" // The term and vote, as JSON.
+	logName   = "log"   // The entries, as a line of JSON each.
+)
+
+// state is what a node persists besides its log.
+type state struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor,omitempty"`
+}
+
+// storage keeps the state and log of a node in its directory.
+type storage struct {
+	dir string
+	log *os.File // Open for appending.
+}
+
+// openStorage opens the files in dir, creating them if they do not exist, and
+// returns the state and log they hold. A last entry only partly written, by a
+// node that crashed while appending it, was never acknowledged and is dropped.
+func openStorage(dir string) (*storage, state, []Entry, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, state{}, nil, err
+	}
+	var st state
+	data, err := os.ReadFile(filepath.Join(dir, stateName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, state{}, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &st); err != nil {
+			return nil, state{}, nil, fmt.Errorf("corrupt raft state in %s: %w", dir, err)
+		}
+	}
+
+	logPath := filepath.Join(dir, logName)
+	data, err = os.ReadFile(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, state{}, nil, err
+	}
+	entries := []Entry{}
+	valid := 0
+	for len(data[valid:]) > 0 {
+		end := bytes.IndexByte(data[valid:], '\n')
+		if end < 0 {
+			break
+		}
+		var entry Entry
+		if err := json.Unmarshal(data[valid:valid+end], &entry); err != nil || entry.Index != uint64(len(entries)+1) {
+			if valid+end+1 < len(data) {
+				return nil, state{}, nil, fmt.Errorf("corrupt raft log in %s at entry %d", dir, len(entries)+1)
+			}
+			break
+		}
+		entries = append(entries, entry)
+		valid += end + 1
+	}
+	s := &storage{dir: dir}
+	if s.log, err = os.OpenFile(logPath, os.O_RDWR|os.O_CREATE, 0666); err != nil {
+		return nil, state{}, nil, err
+	}
+	if err := s.log.Truncate(int64(valid)); err != nil {
+		s.log.Close()
+		return nil, state{}, nil, err
+	}
+	if _, err := s.log.Seek(int64(valid), 0); err != nil {
+		s.log.Close()
+		return nil, state{}, nil, err
+	}
+	return s, st, entries, nil
+}
+
+// saveState replaces the state, so that a crash leaves the old one or the new one.
+func (s *storage) saveState(st state) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return replaceFile(filepath.Join(s.dir, stateName), data)
+}
+
+// append appends entries to the log file and syncs it.
+func (s *storage) append(entries []Entry) error {
+	data, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Write(data); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewrite replaces the log file with one holding entries.
+func (s *storage) rewrite(entries []Entry) error {
+	data, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	logPath := filepath.Join(s.dir, logName)
+	if err := replaceFile(logPath, data); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	s.log.Close()
+	s.log = f
+	return nil
+}
+
+// encodeEntries returns the lines of the log file holding entries.
+func encodeEntries(entries []Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *storage) close() error {
+	return s.log.Close()
+}
+
+// replaceFile writes data to a file next to name, syncs it and renames it to name.
+func replaceFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	// The rename itself is durable once the directory is synced.
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
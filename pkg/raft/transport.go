@@ -0,0 +1,102 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Transport sends the requests of a node to its peers.
+type Transport interface {
+	RequestVote(ctx context.Context, peer string, request VoteRequest) (VoteResponse, error)
+	AppendEntries(ctx context.Context, peer string, request AppendRequest) (AppendResponse, error)
+}
+
+// HTTPTransport sends requests as JSON over HTTP to the Handler of each peer.
+type HTTPTransport struct {
+	URLs   map[string]string // The base URL of each peer, like http://10.0.0.2:7000, by id.
+	Client *http.Client      // Nil for http.DefaultClient.
+}
+
+func (t *HTTPTransport) RequestVote(ctx context.Context, peer string, request VoteRequest) (VoteResponse, error) {
+	var response VoteResponse
+	return response, t.post(ctx, peer, "/raft/vote", request, &response)
+}
+
+func (t *HTTPTransport) AppendEntries(ctx context.Context, peer string, request AppendRequest) (AppendResponse, error) {
+	var response AppendResponse
+	return response, t.post(ctx, peer, "/raft/append", request, &response)
+}
+
+// post sends request to path on peer and decodes the response into response.
+func (t *HTTPTransport) post(ctx context.Context, peer string, path string, request any, response any) error {
+	url, ok := t.URLs[peer]
+	if !ok {
+		return fmt.Errorf("unknown raft peer %q", peer)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("raft peer %s: %s: %s", peer, resp.Status, bytes.TrimSpace(message))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// Handler returns the HTTP handler answering the requests of the node's peers.
+func Handler(n *Node) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /raft/vote", func(w http.ResponseWriter, r *http.Request) {
+		var request VoteRequest
+		if !decodeRequest(w, r, &request) {
+			return
+		}
+		response, err := n.RequestVote(request)
+		writeResponse(w, response, err)
+	})
+	mux.HandleFunc("POST /raft/append", func(w http.ResponseWriter, r *http.Request) {
+		var request AppendRequest
+		if !decodeRequest(w, r, &request) {
+			return
+		}
+		response, err := n.AppendEntries(request)
+		writeResponse(w, response, err)
+	})
+	return mux
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, request any) bool {
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeResponse(w http.ResponseWriter, response any, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,590 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+/*
+gRPC front end.
+
+ServeGRPC serves the Database service of api/db.proto. gRPC runs over
+HTTP/2, which net/http speaks: in plain text with prior knowledge, the way
+gRPC clients connect without TLS, or over TLS with SetTLSConfig. A call is a
+POST to /simpledb.v1.Database/<method> with content type application/grpc.
+The request body is the request message and the response body the response
+messages, each prefixed with a byte telling whether it is compressed and its
+length in 4 bytes big endian. The trailers grpc-status and grpc-message end
+the response with the status of the call, 0 if it succeeded, and its error.
+A grpc-timeout header sets the deadline of the call. The server offers no
+compression, so compressed requests are refused.
+
+Statements that fail get INVALID_ARGUMENT, like the 400 of the HTTP front
+end, unless a privilege or a limit failed them, or a conflict with another
+transaction, which gets ABORTED for the client to retry. Once the database has user
+accounts, every call must carry the user's name and password in the
+authorization metadata, as basic authentication.
+
+Query streams the rows of a select while it runs, 100 to a message, the
+first of which also holds the column names. A select on its own holds the
+table until the last row was sent, so a client that stops reading holds up
+the others until the statement timeout.
+
+Begin starts a transaction, in which the calls carrying its id run until
+Commit or Rollback. It is a transaction of db.Table.BeginTxn: its selects see
+its own writes, and its inserts and deletes lock their rows until it ends.
+Any number of transactions may be open, and the statements of the others
+only wait for one writing the same rows. set lock_timeout = 5s in a
+transaction fails its writes that wait longer than that for a row lock,
+which otherwise wait as long as dbtool serve --lock-timeout lets them. A
+transaction reads committed rows, unless set isolation level snapshot or
+serializable runs in it first, see the isolation levels of package db; a
+commit that conflicts under them fails with ABORTED. Statements other than insert,
+delete and select do not run in a transaction. One left idle for 30 seconds
+is rolled back. Its id is random, and only the user who began it can use it.
+
+See https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md.
+*/
+
+const (
+	grpcService        = "/simpledb.v1.Database/"
+	grpcMaxMessageSize = 4 << 20 // The default of gRPC servers.
+	grpcRowsPerMessage = 100
+	grpcTxnTimeout     = 30 * time.Second
+)
+
+// Status codes of gRPC calls.
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcAborted            = 10
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcError is an error with the status code a call fails with.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// grpcCode returns the status code of a call that failed with err.
+func grpcCode(err error) int {
+	var e *grpcError
+	switch {
+	case errors.As(err, &e):
+		return e.code
+	case errors.Is(err, db.ErrPermissionDenied):
+		return grpcPermissionDenied
+	case errors.Is(err, dberr.ErrLockTimeout), errors.Is(err, dberr.ErrDeadlock), errors.Is(err, dberr.ErrSerialization):
+		return grpcAborted
+	case errors.Is(err, errRateLimited), errors.Is(err, errTooManyRows):
+		return grpcResourceExhausted
+	case errors.Is(err, errTimedOut), errors.Is(err, context.DeadlineExceeded):
+		return grpcDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return grpcCanceled
+	}
+	return grpcInvalidArgument
+}
+
+// grpcSession is a transaction begun with Begin.
+type grpcSession struct {
+	mu    sync.Mutex // Held while a call of the transaction runs.
+	id    uint64
+	txn   *db.Txn
+	user  string      // Who began it, "" if the database has no accounts.
+	timer *time.Timer // Rolls the transaction back once it was idle for the server's txnTimeout.
+	ended bool
+}
+
+// ServeGRPC serves the gRPC front end on l until ctx is done, then rolls back
+// the open transactions and returns once the calls have finished.
+func (s *Server) ServeGRPC(ctx context.Context, l net.Listener) error {
+	protocols := new(http.Protocols)
+	if s.tls != nil {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	httpServer := &http.Server{
+		Handler:           s.grpcHandler(ctx),
+		TLSConfig:         s.tls,
+		ConnContext:       s.ConnContext,
+		Protocols:         protocols,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	served := make(chan error, 1)
+	go func() {
+		if s.tls != nil {
+			served <- httpServer.ServeTLS(l, "", "")
+		} else {
+			served <- httpServer.Serve(l)
+		}
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	// An idle transaction would keep the calls waiting for its row locks from finishing.
+	s.rollbackSessions()
+	httpServer.Shutdown(context.Background())
+	<-served
+	// Begun by a call that started while the server was shutting down.
+	s.rollbackSessions()
+	return nil
+}
+
+// grpcHandler runs the calls of the Database service until serveCtx is done.
+func (s *Server) grpcHandler(serveCtx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/grpc" && mediaType != "application/grpc+proto" {
+			http.Error(w, "the content type of a gRPC call is application/grpc", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		code, message := grpcOK, ""
+		if err := s.grpcCall(serveCtx, w, r); err != nil {
+			code, message = grpcCode(err), err.Error()
+		}
+		// Set after the header was written, these are sent as trailers.
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+		if message != "" {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEncodeMessage(message))
+		}
+	})
+}
+
+// grpcCall reads the request message of a call, runs its method and sends the responses.
+func (s *Server) grpcCall(serveCtx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	if value := r.Header.Get("Grpc-Timeout"); value != "" {
+		timeout, err := grpcTimeout(value)
+		if err != nil {
+			return &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx, err := s.grpcAuth(ctx, r)
+	if err != nil {
+		return err
+	}
+	request, err := grpcReadMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	send := func(message []byte) error {
+		return grpcWriteMessage(w, message)
+	}
+	method, ok := strings.CutPrefix(r.URL.Path, grpcService)
+	switch {
+	case ok && method == "Execute":
+		return s.grpcExecute(ctx, request, send)
+	case ok && method == "Query":
+		return s.grpcQuery(ctx, request, send)
+	case ok && method == "Begin":
+		return s.grpcBegin(serveCtx, ctx, send)
+	case ok && (method == "Commit" || method == "Rollback"):
+		return s.grpcEnd(ctx, request, method == "Commit", send)
+	}
+	return grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+}
+
+// grpcAuth returns the context of a call with the user it signed in as, if it has to.
+func (s *Server) grpcAuth(ctx context.Context, r *http.Request) (context.Context, error) {
+	required, err := s.authRequired()
+	if err != nil {
+		return nil, &grpcError{grpcInternal, err.Error()}
+	}
+	if !required {
+		return ctx, nil
+	}
+	user, password, ok := r.BasicAuth()
+	if ok {
+		if ok, err = s.authenticate(user, password); err != nil {
+			return nil, &grpcError{grpcInternal, err.Error()}
+		}
+	}
+	if !ok {
+		return nil, grpcErrorf(grpcUnauthenticated, "a valid user name and password are required")
+	}
+	return db.WithUser(ctx, user), nil
+}
+
+// grpcExecute runs a statement that returns no rows and responds with the rows it changed.
+func (s *Server) grpcExecute(ctx context.Context, request []byte, send func([]byte) error) error {
+	statement, err := decodeGRPCStatement(request)
+	if err != nil {
+		return err
+	}
+	changed, err := s.grpcRun(ctx, statement, func(columns []string) error {
+		if columns != nil {
+			return grpcErrorf(grpcInvalidArgument, "the statement returns rows, run it with Query")
+		}
+		return nil
+	}, func([]any) error { return nil })
+	if err != nil {
+		return err
+	}
+	var response []byte
+	if changed.RowsAffected != 0 {
+		response = pbAppendVarint(response, 1, uint64(changed.RowsAffected))
+	}
+	return send(response)
+}
+
+// grpcQuery runs a statement that returns rows and streams them as they come.
+func (s *Server) grpcQuery(ctx context.Context, request []byte, send func([]byte) error) error {
+	statement, err := decodeGRPCStatement(request)
+	if err != nil {
+		return err
+	}
+	var response []byte // The message being filled.
+	rows, sent := 0, false
+	_, err = s.grpcRun(ctx, statement, func(columns []string) error {
+		if columns == nil {
+			return grpcErrorf(grpcInvalidArgument, "the statement returns no rows, run it with Execute")
+		}
+		for _, name := range columns {
+			response = pbAppendBytes(response, 1, []byte(name))
+		}
+		return nil
+	}, func(values []any) error {
+		response = pbAppendBytes(response, 2, grpcRow(values))
+		if rows++; rows%grpcRowsPerMessage != 0 {
+			return nil
+		}
+		sent = true
+		err := send(response)
+		response = nil
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if response == nil && sent {
+		return nil
+	}
+	return send(response)
+}
+
+// grpcRow encodes the values of a row as a Row message.
+func grpcRow(values []any) []byte {
+	var row []byte
+	for _, value := range values {
+		// Every field is in the oneof, so it is encoded even with the default value.
+		var encoded []byte
+		switch value := value.(type) {
+		case nil:
+			encoded = pbAppendVarint(nil, 1, 1)
+		case int64:
+			encoded = pbAppendVarint(nil, 2, uint64(value))
+		case string:
+			encoded = pbAppendBytes(nil, 3, []byte(value))
+		default:
+			encoded = pbAppendBytes(nil, 3, []byte(fmt.Sprint(value)))
+		}
+		row = pbAppendBytes(row, 1, encoded)
+	}
+	return row
+}
+
+// grpcRun runs the statement of an Execute or Query call, on its own or in its
+// transaction. It calls start with the names of the columns the statement
+// returns, nil if it returns no rows, and then fn with every row.
+func (s *Server) grpcRun(ctx context.Context, request grpcStatement, start func(columns []string) error, fn func(values []any) error) (db.ExecResult, error) {
+	text := strings.TrimSpace(request.statement)
+	stmt, err := parser.Parse(text)
+	if err != nil {
+		return db.ExecResult{}, err
+	}
+	switch stmt.(type) {
+	case *parser.Begin, *parser.Commit, *parser.Rollback, *parser.Savepoint, *parser.RollbackTo, *parser.Release:
+		return db.ExecResult{}, grpcErrorf(grpcInvalidArgument, "transactions are run with the methods Begin, Commit and Rollback")
+	}
+	limits, err := s.admit(ctx, stmt, request.transactionId != 0)
+	if err != nil {
+		return db.ExecResult{}, err
+	}
+	var txn *db.Txn
+	if request.transactionId != 0 {
+		session, err := s.lockSession(ctx, request.transactionId)
+		if err != nil {
+			return db.ExecResult{}, err
+		}
+		defer s.unlockSession(session)
+		txn = session.txn
+	}
+	var columns []string
+	s.table.Exclusive(func() error {
+		columns = s.table.Columns(stmt)
+		return nil
+	})
+	if err := start(columns); err != nil {
+		return db.ExecResult{}, err
+	}
+	return s.run(ctx, text, stmt, limits, txn, fn)
+}
+
+// grpcBegin starts a transaction and responds with its id.
+func (s *Server) grpcBegin(serveCtx context.Context, ctx context.Context, send func([]byte) error) error {
+	if err := s.allow(ctx, s.currentLimits()); err != nil {
+		return err
+	}
+	if serveCtx.Err() != nil {
+		return grpcErrorf(grpcUnavailable, "the server is shutting down")
+	}
+	if s.node != nil {
+		return grpcErrorf(grpcFailedPrecondition, "transactions are not supported on a replicated database, every write is an entry of the log on its own")
+	}
+	txn, err := s.table.BeginTxn(ctx)
+	if err != nil {
+		return err
+	}
+	session := &grpcSession{txn: txn}
+	session.user, _ = db.UserFrom(ctx)
+	s.sessionMu.Lock()
+	for session.id == 0 || s.sessions[session.id] != nil {
+		var id [8]byte
+		rand.Read(id[:])
+		session.id = binary.LittleEndian.Uint64(id[:])
+	}
+	session.timer = time.AfterFunc(s.txnTimeout, func() { s.abandonSession(session) })
+	s.sessions[session.id] = session
+	s.sessionMu.Unlock()
+	if err := send(pbAppendVarint(nil, 1, session.id)); err != nil {
+		// The client never learns the id to end it with.
+		s.abandonSession(session)
+		return err
+	}
+	return nil
+}
+
+// grpcEnd commits or rolls back the transaction of a Commit or Rollback call.
+func (s *Server) grpcEnd(ctx context.Context, request []byte, commit bool, send func([]byte) error) error {
+	id, err := decodeGRPCTransaction(request)
+	if err != nil {
+		return err
+	}
+	session, err := s.lockSession(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer s.unlockSession(session)
+	if err := s.endSession(session, commit); err != nil {
+		return err
+	}
+	return send(nil)
+}
+
+// lockSession returns the open transaction with the id, locked for a call of
+// the user in ctx. Its idle timer is stopped until unlockSession.
+func (s *Server) lockSession(ctx context.Context, id uint64) (*grpcSession, error) {
+	s.sessionMu.Lock()
+	session := s.sessions[id]
+	s.sessionMu.Unlock()
+	user, _ := db.UserFrom(ctx)
+	if session == nil || session.user != user {
+		return nil, s.noSession(id)
+	}
+	session.mu.Lock()
+	// Stop fails once the timer fired, its rollback waits for the lock.
+	if session.ended || !session.timer.Stop() {
+		session.mu.Unlock()
+		return nil, s.noSession(id)
+	}
+	return session, nil
+}
+
+// unlockSession ends a call of a transaction and restarts its idle timer.
+func (s *Server) unlockSession(session *grpcSession) {
+	if !session.ended {
+		session.timer.Reset(s.txnTimeout)
+	}
+	session.mu.Unlock()
+}
+
+// endSession commits or rolls back the transaction of a locked session,
+// releasing its row locks.
+func (s *Server) endSession(session *grpcSession, commit bool) error {
+	session.ended = true
+	session.timer.Stop()
+	var err error
+	if commit {
+		err = session.txn.Commit()
+	} else {
+		err = session.txn.Rollback()
+	}
+	s.sessionMu.Lock()
+	delete(s.sessions, session.id)
+	s.sessionMu.Unlock()
+	return err
+}
+
+// abandonSession rolls back the transaction of a session unless it ended.
+func (s *Server) abandonSession(session *grpcSession) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if !session.ended {
+		s.endSession(session, false)
+	}
+}
+
+// rollbackSessions rolls back the open transactions.
+func (s *Server) rollbackSessions() {
+	s.sessionMu.Lock()
+	sessions := slices.Collect(maps.Values(s.sessions))
+	s.sessionMu.Unlock()
+	for _, session := range sessions {
+		s.abandonSession(session)
+	}
+}
+
+func (s *Server) noSession(id uint64) error {
+	return grpcErrorf(grpcFailedPrecondition, "there is no transaction %d, it ended or was rolled back after being idle for %v", id, s.txnTimeout)
+}
+
+// grpcStatement is the request of Execute and Query.
+type grpcStatement struct {
+	statement     string
+	transactionId uint64 // 0 to run the statement on its own.
+}
+
+func decodeGRPCStatement(data []byte) (grpcStatement, error) {
+	var request grpcStatement
+	err := pbFields(data, func(field int, wireType int, value uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			request.statement = string(bytes)
+			return pbExpect(field, wireType, pbBytes)
+		case 2:
+			request.transactionId = value
+			return pbExpect(field, wireType, pbVarint)
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcStatement{}, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	return request, nil
+}
+
+// decodeGRPCTransaction returns the transaction id of the request of Commit or Rollback.
+func decodeGRPCTransaction(data []byte) (uint64, error) {
+	var id uint64
+	err := pbFields(data, func(field int, wireType int, value uint64, bytes []byte) error {
+		if field != 1 {
+			return nil
+		}
+		id = value
+		return pbExpect(field, wireType, pbVarint)
+	})
+	if err != nil {
+		return 0, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	return id, nil
+}
+
+// grpcReadMessage reads the single request message of a call.
+func grpcReadMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading the request message failed: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessageSize {
+		return nil, grpcErrorf(grpcResourceExhausted, "the request message is %d bytes, more than the limit of %d", size, grpcMaxMessageSize)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading the request message failed: %v", err)
+	}
+	return message, nil
+}
+
+// grpcWriteMessage sends a response message at once.
+func grpcWriteMessage(w http.ResponseWriter, message []byte) error {
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(message)))
+	if _, err := w.Write(append(frame, message...)); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// grpcTimeout parses the value of grpc-timeout: at most 8 digits and the unit,
+// H, M or S for hours, minutes or seconds, or m, u or n for milli-, micro- or nanoseconds.
+func grpcTimeout(value string) (time.Duration, error) {
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	unit, ok := units[value[len(value)-1]]
+	n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	if n > uint64(math.MaxInt64/unit) {
+		return math.MaxInt64, nil
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// grpcEncodeMessage percent-encodes an error for grpc-message, every byte but
+// the printable ASCII ones other than %.
+func grpcEncodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,367 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// grpcTestClient calls the gRPC front end of a server like a gRPC client over
+// HTTP/2 without TLS does.
+type grpcTestClient struct {
+	t        *testing.T
+	client   *http.Client
+	url      string
+	user     string // Signs in with password if not "".
+	password string
+}
+
+// serveTestGRPC serves the gRPC front end of srv until the test ends, or until
+// the returned function stops it and returns what ServeGRPC returned.
+func serveTestGRPC(t *testing.T, srv *Server) (*grpcTestClient, func() error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeGRPC(ctx, l) }()
+	stop := func() error {
+		cancel()
+		return <-done
+	}
+	t.Cleanup(func() { cancel() })
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	return &grpcTestClient{t: t, client: client, url: "http://" + l.Addr().String() + grpcService}, stop
+}
+
+// call calls a method with a request message and returns the response messages,
+// the status code and the error message.
+func (c *grpcTestClient) call(method string, request []byte) ([][]byte, int, string) {
+	body := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(request)))
+	req, _ := http.NewRequest("POST", c.url+method, bytes.NewReader(append(body, request...)))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s failed: %v", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.Header.Get("Content-Type") != "application/grpc" {
+		c.t.Fatalf("Expected a gRPC response over HTTP/2. Got %s, %q", resp.Proto, resp.Header.Get("Content-Type"))
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("Reading the response of %s failed: %v", method, err)
+	}
+	var messages [][]byte
+	for len(data) >= 5 {
+		size := binary.BigEndian.Uint32(data[1:])
+		messages = append(messages, data[5:5+size])
+		data = data[5+size:]
+	}
+	code, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		c.t.Fatalf("Expected a grpc-status trailer. Got: %v", resp.Trailer)
+	}
+	message, _ := url.PathUnescape(resp.Trailer.Get("Grpc-Message"))
+	return messages, code, message
+}
+
+// statementRequest encodes an ExecuteRequest or QueryRequest.
+func statementRequest(statement string, transactionId uint64) []byte {
+	request := pbAppendBytes(nil, 1, []byte(statement))
+	if transactionId != 0 {
+		request = pbAppendVarint(request, 2, transactionId)
+	}
+	return request
+}
+
+// varintField returns the value of an integer field of a message, 0 if it is left out.
+func varintField(message []byte, field int) uint64 {
+	var value uint64
+	pbFields(message, func(f int, wireType int, v uint64, bytes []byte) error {
+		if f == field {
+			value = v
+		}
+		return nil
+	})
+	return value
+}
+
+// execute runs a statement with Execute and returns the rows it changed.
+func (c *grpcTestClient) execute(statement string, transactionId uint64) (int64, int, string) {
+	messages, code, message := c.call("Execute", statementRequest(statement, transactionId))
+	if code != grpcOK {
+		return 0, code, message
+	}
+	if len(messages) != 1 {
+		c.t.Fatalf("Expected one response to %s. Got %d", statement, len(messages))
+	}
+	return int64(varintField(messages[0], 1)), code, message
+}
+
+// query runs a select with Query and returns the column names, the rows with
+// their values formatted, null for a null, and the number of response messages.
+func (c *grpcTestClient) query(statement string, transactionId uint64) ([]string, [][]string, int) {
+	messages, code, message := c.call("Query", statementRequest(statement, transactionId))
+	if code != grpcOK {
+		c.t.Fatalf("%s failed with %d: %s", statement, code, message)
+	}
+	var columns []string
+	var rows [][]string
+	for _, response := range messages {
+		pbFields(response, func(field int, wireType int, value uint64, data []byte) error {
+			if field == 1 {
+				columns = append(columns, string(data))
+				return nil
+			}
+			row := []string{}
+			pbFields(data, func(field int, wireType int, value uint64, data []byte) error {
+				return pbFields(data, func(field int, wireType int, value uint64, data []byte) error {
+					switch field {
+					case 1:
+						row = append(row, "null")
+					case 2:
+						row = append(row, strconv.FormatInt(int64(value), 10))
+					case 3:
+						row = append(row, string(data))
+					}
+					return nil
+				})
+			})
+			rows = append(rows, row)
+			return nil
+		})
+	}
+	return columns, rows, len(messages)
+}
+
+func TestGRPC(t *testing.T) {
+	srv := newTestServer(t)
+	c, stop := serveTestGRPC(t, srv)
+
+	if rows, code, message := c.execute("insert 1 alice a@example.com", 0); code != grpcOK || rows != 1 {
+		t.Fatalf("Expected the insert to change a row. Got %d rows, %d: %s", rows, code, message)
+	}
+	for i := 2; i <= 250; i++ {
+		c.execute(fmt.Sprintf("insert %d user%d u%d@example.com", i, i, i), 0)
+	}
+	columns, rows, messages := c.query("select id, username where id <= 250", 0)
+	if !slices.Equal(columns, []string{"id", "username"}) || len(rows) != 250 || messages != 3 {
+		t.Fatalf("Expected 250 rows in 3 messages. Got %v, %d rows in %d messages", columns, len(rows), messages)
+	}
+	if !slices.Equal(rows[0], []string{"1", "alice"}) || !slices.Equal(rows[249], []string{"250", "user250"}) {
+		t.Fatalf("Unexpected rows: %v, %v", rows[0], rows[249])
+	}
+	if columns, rows, _ := c.query("select max(email) where id > 1000", 0); len(columns) != 1 || len(rows) != 1 || rows[0][0] != "null" {
+		t.Fatalf("Expected a null. Got %v, %v", columns, rows)
+	}
+	if _, rows, messages := c.query("select id where id > 1000", 0); len(rows) != 0 || messages != 1 {
+		t.Fatalf("Expected a message with only the columns. Got %v in %d messages", rows, messages)
+	}
+
+	tests := []struct {
+		method  string
+		request []byte
+		code    int
+		message string
+	}{
+		{"Execute", statementRequest("select id", 0), grpcInvalidArgument, "the statement returns rows, run it with Query"},
+		{"Query", statementRequest("delete 1", 0), grpcInvalidArgument, "the statement returns no rows, run it with Execute"},
+		{"Execute", statementRequest("insert 1 carol c@example.com", 0), grpcInvalidArgument, "duplicate key"},
+		{"Execute", statementRequest("update 1", 0), grpcInvalidArgument, "unknown statement: update 1"},
+		{"Execute", statementRequest("begin", 0), grpcInvalidArgument, "transactions are run with the methods Begin, Commit and Rollback"},
+		{"Execute", []byte{0x0a, 0x05, 'a'}, grpcInvalidArgument, "protobuf message is truncated"},
+		{"Commit", pbAppendVarint(nil, 1, 42), grpcFailedPrecondition, "there is no transaction 42, it ended or was rolled back after being idle for 30s"},
+		{"Drop", nil, grpcUnimplemented, "unknown method /simpledb.v1.Database/Drop"},
+	}
+	for _, test := range tests {
+		if _, code, message := c.call(test.method, test.request); code != test.code || message != test.message {
+			t.Errorf("%s %q: expected %d %q. Got: %d %q", test.method, test.request, test.code, test.message, code, message)
+		}
+	}
+
+	// A statement over the row limit fails after the rows before it were sent.
+	srv.SetLimits(Limits{MaxRows: 150})
+	if messages, code, message := c.call("Query", statementRequest("select id", 0)); code != grpcResourceExhausted || len(messages) != 1 || !strings.HasPrefix(message, "too many rows") {
+		t.Fatalf("Expected the limit to fail the query after 100 rows. Got %d messages, %d: %s", len(messages), code, message)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("ServeGRPC failed: %v", err)
+	}
+}
+
+func TestGRPCTransactions(t *testing.T) {
+	srv := newTestServer(t)
+	c, stop := serveTestGRPC(t, srv)
+	begin := func() uint64 {
+		messages, code, message := c.call("Begin", nil)
+		if code != grpcOK || len(messages) != 1 || varintField(messages[0], 1) == 0 {
+			t.Fatalf("Begin failed with %d: %s", code, message)
+		}
+		return varintField(messages[0], 1)
+	}
+
+	id := begin()
+	if _, code, message := c.execute("insert 1 alice a@example.com", id); code != grpcOK {
+		t.Fatalf("Insert in the transaction failed with %d: %s", code, message)
+	}
+	if _, rows, _ := c.query("select id", id); len(rows) != 1 {
+		t.Fatalf("Expected the transaction to see its row. Got %v", rows)
+	}
+	// The others see the rows as last committed, write other rows alongside
+	// the transaction, and wait for it to write the same row.
+	if result, err := srv.Query(context.Background(), "select id"); err != nil || len(result.Rows) != 0 {
+		t.Fatalf("Expected the uncommitted row to be unseen. Got %v, %v", result.Rows, err)
+	}
+	if _, err := srv.Query(context.Background(), "insert 10 zoe z@example.com"); err != nil {
+		t.Fatalf("Expected a write of another row to go on. Got %v", err)
+	}
+	other := make(chan error)
+	go func() {
+		_, err := srv.Query(context.Background(), "insert 1 mallory m@example.com")
+		other <- err
+	}()
+	select {
+	case err := <-other:
+		t.Fatalf("Expected the write of the locked row to wait for the transaction. Got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if messages, code, message := c.call("Commit", pbAppendVarint(nil, 1, id)); code != grpcOK || len(messages) != 1 {
+		t.Fatalf("Commit failed with %d: %s", code, message)
+	}
+	if err := <-other; err == nil || !strings.Contains(err.Error(), "duplicate key") {
+		t.Fatalf("Expected the committed row to be taken. Got %v", err)
+	}
+	c.execute("delete 10", 0)
+	if _, code, _ := c.call("Commit", pbAppendVarint(nil, 1, id)); code != grpcFailedPrecondition {
+		t.Fatalf("Expected the ended transaction to be gone. Got %d", code)
+	}
+
+	// Transactions are open side by side.
+	first, second := begin(), begin()
+	c.execute("insert 20 frank f@example.com", first)
+	c.execute("insert 21 grace g@example.com", second)
+	for _, id := range []uint64{second, first} {
+		if _, code, message := c.call("Commit", pbAppendVarint(nil, 1, id)); code != grpcOK {
+			t.Fatalf("Commit failed with %d: %s", code, message)
+		}
+	}
+	c.execute("delete 20", 0)
+	c.execute("delete 21", 0)
+
+	// set lock_timeout bounds how long the writes of a transaction wait for a row lock.
+	first, second = begin(), begin()
+	c.execute("insert 30 heidi h@example.com", first)
+	if _, code, message := c.execute("set lock_timeout = 20ms", second); code != grpcOK {
+		t.Fatalf("Setting the lock timeout failed with %d: %s", code, message)
+	}
+	if _, code, message := c.execute("insert 30 ivan i@example.com", second); code != grpcAborted || message != "lock timeout: row 30 is still locked after 20ms" {
+		t.Fatalf("Expected the write to time out. Got %d: %s", code, message)
+	}
+	c.call("Rollback", pbAppendVarint(nil, 1, first))
+	c.call("Rollback", pbAppendVarint(nil, 1, second))
+	if _, code, _ := c.execute("set lock_timeout = 20ms", 0); code != grpcInvalidArgument {
+		t.Fatalf("Expected set to be refused outside a transaction. Got %d", code)
+	}
+
+	// A serializable transaction fails to commit once a row it read changed.
+	first, second = begin(), begin()
+	for _, id := range []uint64{first, second} {
+		if _, code, message := c.execute("set isolation level serializable", id); code != grpcOK {
+			t.Fatalf("Setting the isolation level failed with %d: %s", code, message)
+		}
+		if _, rows, _ := c.query("select id where id >= 40 and id < 50", id); len(rows) != 0 {
+			t.Fatalf("Expected no rows. Got %v", rows)
+		}
+	}
+	if _, code, _ := c.execute("set isolation level snapshot", first); code != grpcInvalidArgument {
+		t.Fatalf("Expected the level of a transaction that read rows to be fixed. Got %d", code)
+	}
+	c.execute("insert 40 judy j@example.com", first)
+	c.execute("insert 41 kim k@example.com", second)
+	c.call("Commit", pbAppendVarint(nil, 1, first))
+	if _, code, message := c.call("Commit", pbAppendVarint(nil, 1, second)); code != grpcAborted || !strings.HasPrefix(message, "could not serialize") {
+		t.Fatalf("Expected the second commit to fail. Got %d: %s", code, message)
+	}
+	c.execute("delete 40", 0)
+
+	id = begin()
+	c.execute("insert 2 bob b@example.com", id)
+	if _, code, message := c.call("Rollback", pbAppendVarint(nil, 1, id)); code != grpcOK {
+		t.Fatalf("Rollback failed with %d: %s", code, message)
+	}
+	if _, rows, _ := c.query("select id", 0); len(rows) != 1 {
+		t.Fatalf("Expected the rolled back row to be gone. Got %v", rows)
+	}
+
+	// An idle transaction is rolled back and lets the others run.
+	srv.txnTimeout = 50 * time.Millisecond
+	id = begin()
+	c.execute("insert 3 carol c@example.com", id)
+	time.Sleep(200 * time.Millisecond)
+	if _, code, _ := c.execute("insert 4 dave d@example.com", id); code != grpcFailedPrecondition {
+		t.Fatalf("Expected the idle transaction to be rolled back. Got %d", code)
+	}
+	if _, rows, _ := c.query("select id", 0); len(rows) != 1 {
+		t.Fatalf("Expected only the committed row. Got %v", rows)
+	}
+
+	// Stopping the server rolls back the open transaction.
+	srv.txnTimeout = time.Minute
+	id = begin()
+	c.execute("insert 5 eve e@example.com", id)
+	if err := stop(); err != nil {
+		t.Fatalf("ServeGRPC failed: %v", err)
+	}
+	if result, _ := srv.Query(context.Background(), "select id"); len(result.Rows) != 1 {
+		t.Fatalf("Expected only the committed row. Got %v", result.Rows)
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	srv := newAuthTestServer(t)
+	if err := srv.table.AddUser("bob", "hunter2"); err != nil {
+		t.Fatalf("Failed to add a user: %v", err)
+	}
+	c, _ := serveTestGRPC(t, srv)
+	if _, code, message := c.call("Query", statementRequest("select id", 0)); code != grpcUnauthenticated || message != "a valid user name and password are required" {
+		t.Fatalf("Expected the call to need a user. Got %d: %s", code, message)
+	}
+	c.user, c.password = "alice", "wrong"
+	if _, code, _ := c.call("Begin", nil); code != grpcUnauthenticated {
+		t.Fatalf("Expected a wrong password to fail. Got %d", code)
+	}
+	c.password = "secret"
+	messages, code, message := c.call("Begin", nil)
+	if code != grpcOK {
+		t.Fatalf("Begin failed with %d: %s", code, message)
+	}
+	id := varintField(messages[0], 1)
+
+	// Only the user who began the transaction can use it.
+	c.user, c.password = "bob", "hunter2"
+	if _, code, _ := c.call("Commit", pbAppendVarint(nil, 1, id)); code != grpcFailedPrecondition {
+		t.Fatalf("Expected another user not to find the transaction. Got %d", code)
+	}
+	c.user, c.password = "alice", "secret"
+	if _, code, message := c.call("Rollback", pbAppendVarint(nil, 1, id)); code != grpcOK {
+		t.Fatalf("Rollback failed with %d: %s", code, message)
+	}
+}
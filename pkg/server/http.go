@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+)
+
+// httpMaxStatementSize limits the body of POST /query.
+const httpMaxStatementSize = 1 << 20
+
+/*
+HTTPHandler serves the database over HTTP:
+
+	POST /query    runs the statement in the body, responds with the Result as JSON
+	GET  /tables   responds with the tables as a JSON list of TableInfo
+
+Errors are responded with as {"error": "..."}. A statement that fails, for
+whatever reason, gets status 400, reading the tables 500. A body over 1 MiB
+gets 413. Once the database
+has user accounts, every request must sign in with basic authentication, and
+one the user lacks the privilege for gets status 403. A statement over the
+connection's rate limit gets 429, if the http.Server's ConnContext is the
+Server's.
+*/
+func (s *Server) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			httpError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+			return
+		}
+		text, err := io.ReadAll(http.MaxBytesReader(w, r.Body, httpMaxStatementSize))
+		if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+			httpError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		result, err := s.Query(r.Context(), string(text))
+		if errors.Is(err, db.ErrPermissionDenied) {
+			httpError(w, http.StatusForbidden, err)
+			return
+		}
+		if errors.Is(err, errRateLimited) {
+			httpError(w, http.StatusTooManyRequests, err)
+			return
+		}
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		httpJSON(w, http.StatusOK, result)
+	})
+	mux.HandleFunc("/tables", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			httpError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+			return
+		}
+		tables, err := s.Tables(r.Context())
+		if errors.Is(err, db.ErrPermissionDenied) {
+			httpError(w, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		httpJSON(w, http.StatusOK, tables)
+	})
+	return s.httpAuth(mux)
+}
+
+// httpAuth lets requests through to next once they signed in, if they have to,
+// with the user and the client's address in the context of the request.
+func (s *Server) httpAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(withClient(r.Context(), r.RemoteAddr))
+		required, err := s.authRequired()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if required {
+			user, password, ok := r.BasicAuth()
+			if ok {
+				if ok, err = s.authenticate(user, password); err != nil {
+					httpError(w, http.StatusInternalServerError, err)
+					return
+				}
+			}
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+constants.DbName+`"`)
+				httpError(w, http.StatusUnauthorized, errors.New("a valid user name and password are required"))
+				return
+			}
+			r = r.WithContext(db.WithUser(r.Context(), user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func httpJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, status int, err error) {
+	httpJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+)
+
+func newTestServer(t *testing.T) *Server {
+	table, err := db.Open(db.MemoryDbName)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	t.Cleanup(func() { table.Close() })
+	return New(table)
+}
+
+// newAuthTestServer returns a server on a db file with the account alice, password secret.
+func newAuthTestServer(t *testing.T) *Server {
+	table, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	t.Cleanup(func() { table.Close() })
+	if err := table.AddUser("alice", "secret"); err != nil {
+		t.Fatalf("Failed to add a user: %v", err)
+	}
+	return New(table)
+}
+
+func TestHTTP(t *testing.T) {
+	ts := httptest.NewServer(newTestServer(t).HTTPHandler())
+	defer ts.Close()
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		expected           string
+	}{
+		{"POST", "/query", "insert 1 alice a@example.com", 200, `{}`},
+		{"POST", "/query", "insert 2 bob b@example.com;", 200, `{}`},
+		{"POST", "/query", "select id, username where id > 0", 200, `{"columns":["id","username"],"types":["integer","text"],"rows":[[1,"alice"],[2,"bob"]]}`},
+		{"POST", "/query", "select max(email) where id > 5", 200, `{"columns":["max(email)"],"types":["text"],"rows":[[null]]}`},
+		{"POST", "/query", "insert 1 carol c@example.com", 400, `{"error":"duplicate key"}`},
+		{"POST", "/query", "update 1", 400, `{"error":"unknown statement: update 1"}`},
+		{"POST", "/query", "begin", 400, `{"error":"transactions are not supported, every statement is committed on its own"}`},
+		{"GET", "/query", "", 405, `{"error":"use POST"}`},
+		{"POST", "/query", "select " + strings.Repeat(" ", httpMaxStatementSize), 413, `{"error":"http: request body too large"}`},
+		{"GET", "/tables", "", 200, `[{"name":"users","rootPage":0,"rows":2,"pages":1}]`},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, ts.URL+test.path, strings.NewReader(test.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", test.method, test.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status || strings.TrimSpace(string(body)) != test.expected {
+			t.Fatalf("%s %s %q: expected %d %s. Got: %d %s", test.method, test.path, test.body, test.status, test.expected, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	srv := newTestServer(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			_, err := srv.Query(context.Background(), fmt.Sprintf("insert %d user%d user%d@example.com", id, id, id))
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	result, err := srv.Query(context.Background(), "select count(*)")
+	if err != nil || fmt.Sprint(result.Rows) != "[[100]]" {
+		t.Fatalf("Expected 100 rows. Got: %v, %v", result.Rows, err)
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	ts := httptest.NewServer(newAuthTestServer(t).HTTPHandler())
+	defer ts.Close()
+	for _, test := range []struct {
+		user, password string
+		status         int
+	}{
+		{"", "", 401},
+		{"alice", "wrong", 401},
+		{"bob", "secret", 401},
+		{"alice", "secret", 200},
+	} {
+		req, _ := http.NewRequest("GET", ts.URL+"/tables", nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /tables failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("%s:%s: expected %d. Got: %d", test.user, test.password, test.status, resp.StatusCode)
+		}
+		if test.status == 401 && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("Expected a WWW-Authenticate header.")
+		}
+	}
+}
+
+func TestHTTPPrivileges(t *testing.T) {
+	srv := newAuthTestServer(t)
+	ts := httptest.NewServer(srv.HTTPHandler())
+	defer ts.Close()
+	if err := srv.table.Revoke("alice", []string{"write"}); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	for _, test := range []struct {
+		body   string
+		status int
+	}{
+		{"select", 200},
+		{"insert 1 a a@b.c", 403},
+		{"grant write to alice", 403},
+	} {
+		req, _ := http.NewRequest("POST", ts.URL+"/query", strings.NewReader(test.body))
+		req.SetBasicAuth("alice", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /query failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("%s: expected %d. Got: %d", test.body, test.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	srv := newAuthTestServer(t)
+	name, _ := srv.table.AuditFile()
+	auditLog, err := db.OpenAuditLog(name, 1<<20, 1)
+	if err != nil {
+		t.Fatalf("OpenAuditLog failed: %v", err)
+	}
+	defer auditLog.Close()
+	srv.SetAuditLog(auditLog)
+	ts := httptest.NewServer(srv.HTTPHandler())
+	defer ts.Close()
+
+	for _, body := range []string{"insert 1 a a@b.c", "select", "insert 1 a a@b.c", "insert or ignore 1 a a@b.c", "revoke write from alice", "delete 1"} {
+		req, _ := http.NewRequest("POST", ts.URL+"/query", strings.NewReader(body))
+		req.SetBasicAuth("alice", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /query failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	entries, err := db.ReadAuditLog(name)
+	if err != nil {
+		t.Fatalf("ReadAuditLog failed: %v", err)
+	}
+	got := []string{}
+	for _, entry := range entries {
+		if entry.User != "alice" || !strings.HasPrefix(entry.Client, "127.0.0.1:") || entry.Time.IsZero() {
+			t.Fatalf("Expected alice's address and the time in %+v", entry)
+		}
+		got = append(got, fmt.Sprintf("%s: %d %s", entry.Statement, entry.Rows, entry.Error))
+	}
+	expected := []string{
+		"insert 1 a a@b.c: 1 ",
+		"insert 1 a a@b.c: 0 duplicate key",
+		"insert or ignore 1 a a@b.c: 0 ",
+		"revoke write from alice: 0 permission denied: alice does not have the admin privilege",
+		"delete 1: 1 ",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected %q. Got: %q", expected, got)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewUnstartedServer(srv.HTTPHandler())
+	ts.Config.ConnContext = srv.ConnContext
+	ts.Start()
+	defer ts.Close()
+	for i := 1; i <= 5; i++ {
+		if _, err := srv.Query(context.Background(), fmt.Sprintf("insert %d a a@b.c", i)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	srv.SetLimits(Limits{MaxRows: 3})
+	if _, err := srv.Query(context.Background(), "select where id <= 3"); err != nil {
+		t.Fatalf("Expected 3 rows to be within the limit. Got: %v", err)
+	}
+	_, err := srv.Query(context.Background(), "select")
+	if err == nil || err.Error() != "too many rows: the statement returned more than the limit of 3" {
+		t.Fatalf("Expected too many rows. Got: %v", err)
+	}
+
+	srv.SetLimits(Limits{MaxRuntime: time.Nanosecond})
+	if _, err := srv.Query(context.Background(), "select"); !errors.Is(err, errTimedOut) {
+		t.Fatalf("Expected the statement to time out. Got: %v", err)
+	}
+
+	// The bucket of a connection holds a second's worth of statements, the
+	// requests come in over one kept alive connection.
+	srv.SetLimits(Limits{Rate: 2})
+	statuses := []int{}
+	for i := 0; i < 3; i++ {
+		resp, err := ts.Client().Post(ts.URL+"/query", "text/plain", strings.NewReader("select"))
+		if err != nil {
+			t.Fatalf("POST /query failed: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+	if fmt.Sprint(statuses) != "[200 200 429]" {
+		t.Fatalf("Expected the third statement to be refused. Got: %v", statuses)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Limits.
+
+A server can cap what a single connection gets out of it, so one client can
+not starve the others: how many rows a statement may return, how long it may
+run and how many statements a connection may run per second. A statement over
+its row limit or deadline fails, as does one over the connection's rate, which
+is enforced with a token bucket holding a second's worth of statements.
+
+The rate is kept per connection in the context of its statements. ServePG and
+ServeRESP set it up themselves, an http.Server must get it from ConnContext.
+*/
+
+// The errors of statements over a limit, wrapped with the limit.
+var (
+	errRateLimited = errors.New("rate limit exceeded")
+	errTimedOut    = errors.New("statement timed out")
+	errTooManyRows = errors.New("too many rows")
+)
+
+// Limits caps the statements of every connection. A zero field means no limit.
+type Limits struct {
+	MaxRows    int           // Rows a statement may return.
+	MaxRuntime time.Duration // How long a statement may run.
+	Rate       float64       // Statements a connection may run per second.
+}
+
+// SetLimits applies limits to the statements run from now on.
+func (s *Server) SetLimits(limits Limits) {
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	s.limits = limits
+}
+
+func (s *Server) currentLimits() Limits {
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	return s.limits
+}
+
+// rateLimiter is the token bucket of a connection.
+type rateLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if there is one, refilling the bucket at rate tokens per second.
+func (r *rateLimiter) allow(rate float64, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	burst := math.Max(rate, 1)
+	if r.last.IsZero() {
+		r.tokens = burst
+	} else {
+		r.tokens = math.Min(burst, r.tokens+now.Sub(r.last).Seconds()*rate)
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// limiterKey is the context key of the rate limiter of a connection.
+type limiterKey struct{}
+
+// ConnContext returns the context for the statements of a new connection,
+// which carries its address and rate limit. It fits http.Server.ConnContext.
+func (s *Server) ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	ctx = withClient(ctx, conn.RemoteAddr().String())
+	return context.WithValue(ctx, limiterKey{}, &rateLimiter{})
+}
+
+// allow fails if the connection in ctx ran as many statements as its rate allows.
+func (s *Server) allow(ctx context.Context, limits Limits) error {
+	limiter, ok := ctx.Value(limiterKey{}).(*rateLimiter)
+	if ok && limits.Rate > 0 && !limiter.allow(limits.Rate, time.Now()) {
+		return fmt.Errorf("%w: at most %g statements per second", errRateLimited, limits.Rate)
+	}
+	return nil
+}
+
+// withDeadline returns the context to run a statement in, which is canceled
+// once the statement ran as long as it may. The executor checks it as it goes.
+func withDeadline(ctx context.Context, limits Limits) (context.Context, context.CancelFunc) {
+	if limits.MaxRuntime <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, limits.MaxRuntime)
+}
+
+// deadlineErr explains err if it is the deadline of the statement passing.
+func deadlineErr(err error, limits Limits) error {
+	if errors.Is(err, context.DeadlineExceeded) && limits.MaxRuntime > 0 {
+		return fmt.Errorf("%w: it ran longer than the limit of %v", errTimedOut, limits.MaxRuntime)
+	}
+	return err
+}
+
+// tooManyRows fails a statement returning more rows than it may.
+func tooManyRows(limits Limits) error {
+	return fmt.Errorf("%w: the statement returned more than the limit of %d", errTooManyRows, limits.MaxRows)
+}
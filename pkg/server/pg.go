@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+/*
+Postgres front end.
+
+Clients speak version 3 of the Postgres protocol, of which the simple query
+flow is supported: after the startup message, and the password of the user
+once the database has accounts, every Query message runs one statement and
+gets back a row description, the rows as text, a command tag and
+ReadyForQuery. The extended query protocol, used for parameters and prepared
+statements, is refused with an error, so drivers must be set to use simple
+queries.
+
+Without a TLS configuration SSL is declined and clients fall back to plain
+text. With one, clients must ask for SSL, and the connection continues
+encrypted once it was accepted.
+
+See https://www.postgresql.org/docs/current/protocol.html.
+*/
+
+const (
+	pgProtocolVersion = 3 << 16
+	pgSSLRequest      = 80877103
+	pgGSSENCRequest   = 80877104
+	pgCancelRequest   = 80877102
+	pgMaxMessageSize  = 1 << 24
+
+	// Type oids of integer and text columns.
+	pgInt8 = 20
+	pgText = 25
+)
+
+// ServePG serves the Postgres front end on l until ctx is done, then closes
+// l and every connection and returns once their statements have finished.
+func (s *Server) ServePG(ctx context.Context, l net.Listener) error {
+	return s.serveConns(ctx, l, s.pgConn)
+}
+
+// pgConn talks to a client until it terminates or the connection fails.
+func (s *Server) pgConn(ctx context.Context, conn net.Conn) error {
+	r, w, user, err := s.pgStartup(conn)
+	if err != nil {
+		return err
+	}
+	if user != "" {
+		ctx = db.WithUser(ctx, user)
+	}
+	extendedFailed := false // Whether extended query messages are skipped until Sync.
+	for {
+		typ, body, err := pgReadMessage(r)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'Q':
+			s.pgQuery(ctx, w, strings.TrimSuffix(string(body), "\x00"))
+		case 'X':
+			return nil
+		case 'S':
+			// Ends a batch of extended query messages, which are refused below.
+			extendedFailed = false
+			pgReady(w)
+		case 'P', 'B', 'D', 'E', 'C', 'H':
+			if !extendedFailed {
+				pgError(w, "0A000", "the extended query protocol is not supported, use simple queries")
+				extendedFailed = true
+			}
+		default:
+			pgError(w, "08P01", fmt.Sprintf("unsupported message type %q", typ))
+			pgReady(w)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// pgStartup reads the startup message, negotiating SSL on the way, asks for
+// a password if the database has accounts, and accepts the client. It returns
+// the reader and writer of the connection, which may have switched to TLS,
+// and the user who signed in, "" if there was no need to.
+func (s *Server) pgStartup(conn net.Conn) (*bufio.Reader, *bufio.Writer, string, error) {
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	var params []string
+	encrypted := false
+	for {
+		body, err := pgReadBody(r)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if len(body) < 4 {
+			return nil, nil, "", fmt.Errorf("startup message too short")
+		}
+		switch code := binary.BigEndian.Uint32(body); code {
+		case pgSSLRequest:
+			if s.tls == nil || encrypted {
+				w.WriteByte('N')
+				if err := w.Flush(); err != nil {
+					return nil, nil, "", err
+				}
+				continue
+			}
+			if r.Buffered() > 0 {
+				// Bytes sent before the handshake would be taken as if they had been encrypted.
+				return nil, nil, "", fmt.Errorf("data received before the TLS handshake")
+			}
+			w.WriteByte('S')
+			if err := w.Flush(); err != nil {
+				return nil, nil, "", err
+			}
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, nil, "", err
+			}
+			r, w = bufio.NewReader(tlsConn), bufio.NewWriter(tlsConn)
+			encrypted = true
+			continue
+		case pgGSSENCRequest:
+			w.WriteByte('N')
+			if err := w.Flush(); err != nil {
+				return nil, nil, "", err
+			}
+			continue
+		case pgCancelRequest:
+			// Statements can not be canceled, the request is dropped.
+			return nil, nil, "", io.EOF
+		case pgProtocolVersion:
+		default:
+			pgError(w, "0A000", fmt.Sprintf("unsupported protocol version %d.%d", code>>16, code&0xffff))
+			w.Flush()
+			return nil, nil, "", fmt.Errorf("unsupported protocol version %d", code)
+		}
+		if s.tls != nil && !encrypted {
+			pgError(w, "28000", "SSL is required")
+			w.Flush()
+			return nil, nil, "", fmt.Errorf("client did not ask for SSL")
+		}
+		// Of the parameters, pairs of null-terminated strings, only the user is used.
+		params = strings.Split(strings.TrimRight(string(body[4:]), "\x00"), "\x00")
+		break
+	}
+	user, err := s.pgAuth(r, w, params)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	pgMessage(w, 'R', binary.BigEndian.AppendUint32(nil, 0)) // AuthenticationOk.
+	for _, param := range [][2]string{
+		{"server_version", "14.0"},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+	} {
+		pgMessage(w, 'S', pgString(pgString(nil, param[0]), param[1]))
+	}
+	key := binary.BigEndian.AppendUint32(nil, 1) // Process id and secret key, for cancel requests.
+	pgMessage(w, 'K', binary.BigEndian.AppendUint32(key, 0))
+	pgReady(w)
+	return r, w, user, w.Flush()
+}
+
+// pgAuth asks the client for the password of its user, in clear text, checks
+// it and returns the user. It returns "" if the database has no accounts.
+func (s *Server) pgAuth(r *bufio.Reader, w *bufio.Writer, params []string) (string, error) {
+	required, err := s.authRequired()
+	if err != nil || !required {
+		return "", err
+	}
+	user := ""
+	for i := 0; i+1 < len(params); i += 2 {
+		if params[i] == "user" {
+			user = params[i+1]
+		}
+	}
+	pgMessage(w, 'R', binary.BigEndian.AppendUint32(nil, 3)) // AuthenticationCleartextPassword.
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	typ, body, err := pgReadMessage(r)
+	if err != nil {
+		return "", err
+	}
+	ok := false
+	if typ == 'p' {
+		if ok, err = s.authenticate(user, strings.TrimSuffix(string(body), "\x00")); err != nil {
+			return "", err
+		}
+	}
+	if !ok {
+		pgError(w, "28P01", fmt.Sprintf("password authentication failed for user %q", user))
+		w.Flush()
+		return "", fmt.Errorf("password authentication failed for user %q", user)
+	}
+	return user, nil
+}
+
+// pgQuery runs the statement of a Query message and writes the responses.
+func (s *Server) pgQuery(ctx context.Context, w *bufio.Writer, text string) {
+	defer pgReady(w)
+	text = strings.TrimSpace(text)
+	if strings.Trim(text, "; \t\r\n") == "" {
+		pgMessage(w, 'I', nil) // EmptyQueryResponse.
+		return
+	}
+	stmt, err := parser.Parse(text)
+	if err != nil {
+		pgError(w, "42601", err.Error())
+		return
+	}
+	result, err := s.Run(ctx, text, stmt)
+	if err != nil {
+		code := "XX000"
+		switch {
+		case errors.Is(err, db.ErrPermissionDenied):
+			code = "42501" // insufficient_privilege.
+		case errors.Is(err, errTimedOut):
+			code = "57014" // query_canceled, as for statement_timeout.
+		case errors.Is(err, errRateLimited):
+			code = "53400" // configuration_limit_exceeded.
+		case errors.Is(err, errTooManyRows):
+			code = "54000" // program_limit_exceeded.
+		case errors.Is(err, dberr.ErrLockTimeout):
+			code = "55P03" // lock_not_available, as for lock_timeout.
+		}
+		pgError(w, code, err.Error())
+		return
+	}
+
+	// Selects, and inserts with returning, describe their columns before the rows.
+	if result.Columns != nil {
+		description := binary.BigEndian.AppendUint16(nil, uint16(len(result.Columns)))
+		for i, name := range result.Columns {
+			oid, size := uint32(pgText), int16(-1)
+			if result.Types[i] == "integer" {
+				oid, size = pgInt8, 8
+			}
+			description = pgString(description, name)
+			description = binary.BigEndian.AppendUint32(description, 0) // Table oid.
+			description = binary.BigEndian.AppendUint16(description, 0) // Column number in the table.
+			description = binary.BigEndian.AppendUint32(description, oid)
+			description = binary.BigEndian.AppendUint16(description, uint16(size))
+			description = binary.BigEndian.AppendUint32(description, 0xffffffff) // No type modifier.
+			description = binary.BigEndian.AppendUint16(description, 0)          // Text format.
+		}
+		pgMessage(w, 'T', description)
+		for _, values := range result.Rows {
+			row := binary.BigEndian.AppendUint16(nil, uint16(len(values)))
+			for _, value := range values {
+				if value == nil {
+					row = binary.BigEndian.AppendUint32(row, 0xffffffff)
+					continue
+				}
+				text := fmt.Sprint(value)
+				row = binary.BigEndian.AppendUint32(row, uint32(len(text)))
+				row = append(row, text...)
+			}
+			pgMessage(w, 'D', row)
+		}
+	}
+
+	var tag string
+	switch stmt.(type) {
+	case *parser.Select:
+		tag = "SELECT " + strconv.Itoa(len(result.Rows))
+	case *parser.Insert:
+		tag = "INSERT 0 " + strconv.Itoa(result.Changed.RowsAffected)
+	case *parser.Delete:
+		tag = "DELETE " + strconv.Itoa(result.Changed.RowsAffected)
+	case *parser.Grant:
+		tag = "GRANT"
+	case *parser.Revoke:
+		tag = "REVOKE"
+	case *parser.Partition, *parser.AddColumn, *parser.Collate:
+		tag = "ALTER TABLE"
+	case *parser.CreateFulltextIndex, *parser.CreateSpatialIndex, *parser.CreateUniqueIndex, *parser.CreateIndex:
+		tag = "CREATE INDEX"
+	case *parser.DropFulltextIndex:
+		tag = "DROP INDEX"
+	case *parser.CreateView:
+		tag = "CREATE MATERIALIZED VIEW"
+	case *parser.RefreshView:
+		tag = "REFRESH MATERIALIZED VIEW"
+	case *parser.Analyze:
+		tag = "ANALYZE"
+	}
+	pgMessage(w, 'C', pgString(nil, tag)) // CommandComplete.
+}
+
+// pgReadMessage reads a message: its type, then its length including itself, then the body.
+func pgReadMessage(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	body, err := pgReadBody(r)
+	return typ, body, err
+}
+
+// pgReadBody reads a length, which includes itself, and that many bytes after it.
+func pgReadBody(r *bufio.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n < 4 || n > pgMaxMessageSize {
+		return nil, fmt.Errorf("invalid message length %d", n)
+	}
+	body := make([]byte, n-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+func pgMessage(w *bufio.Writer, typ byte, body []byte) {
+	w.WriteByte(typ)
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(body)+4))
+	w.Write(length[:])
+	w.Write(body)
+}
+
+// pgReady tells the client that the server waits for a query, outside of a transaction.
+func pgReady(w *bufio.Writer) {
+	pgMessage(w, 'Z', []byte{'I'})
+}
+
+func pgError(w *bufio.Writer, code string, message string) {
+	var body []byte
+	for _, field := range [][2]string{{"S", "ERROR"}, {"V", "ERROR"}, {"C", code}, {"M", message}} {
+		body = pgString(append(body, field[0][0]), field[1])
+	}
+	pgMessage(w, 'E', append(body, 0))
+}
+
+// pgString appends a null-terminated string.
+func pgString(b []byte, s string) []byte {
+	return append(append(b, s...), 0)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// pgClient speaks the client side of the simple query protocol.
+type pgClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *pgClient) send(typ byte, body []byte) {
+	msg := []byte{}
+	if typ != 0 {
+		msg = append(msg, typ)
+	}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(body)+4))
+	if _, err := c.conn.Write(append(msg, body...)); err != nil {
+		c.t.Fatalf("Failed to send: %v", err)
+	}
+}
+
+// receive returns the messages up to ReadyForQuery, each as its type and a readable body.
+func (c *pgClient) receive() []string {
+	var messages []string
+	for {
+		typ, body, err := pgReadMessage(c.r)
+		if err != nil {
+			c.t.Fatalf("Failed to receive: %v", err)
+		}
+		if typ == 'Z' {
+			return messages
+		}
+		messages = append(messages, fmt.Sprintf("%c %s", typ, pgDescribe(typ, body)))
+	}
+}
+
+// pgDescribe turns the body of a message into text: the fields of errors,
+// the values of rows and the names and type oids of a row description.
+func pgDescribe(typ byte, body []byte) string {
+	switch typ {
+	case 'E':
+		// The code and the message, each field is a type byte and a string.
+		fields := strings.Split(strings.TrimRight(string(body), "\x00"), "\x00")
+		return fields[2][1:] + " " + fields[3][1:]
+	case 'D':
+		values := []string{}
+		n := int(binary.BigEndian.Uint16(body))
+		body = body[2:]
+		for i := 0; i < n; i++ {
+			length := int32(binary.BigEndian.Uint32(body))
+			body = body[4:]
+			if length < 0 {
+				values = append(values, "NULL")
+				continue
+			}
+			values = append(values, string(body[:length]))
+			body = body[length:]
+		}
+		return strings.Join(values, ",")
+	case 'T':
+		columns := []string{}
+		n := int(binary.BigEndian.Uint16(body))
+		body = body[2:]
+		for i := 0; i < n; i++ {
+			end := strings.IndexByte(string(body), 0)
+			columns = append(columns, fmt.Sprintf("%s:%d", body[:end], binary.BigEndian.Uint32(body[end+7:])))
+			body = body[end+19:]
+		}
+		return strings.Join(columns, ",")
+	}
+	return strings.TrimRight(string(body), "\x00")
+}
+
+func TestPG(t *testing.T) {
+	srv := newTestServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- srv.ServePG(ctx, l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	c := &pgClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.send(0, binary.BigEndian.AppendUint32(nil, pgSSLRequest))
+	if b, err := c.r.ReadByte(); err != nil || b != 'N' {
+		t.Fatalf("Expected SSL to be declined. Got: %q, %v", b, err)
+	}
+	startup := binary.BigEndian.AppendUint32(nil, pgProtocolVersion)
+	startup = append(startup, "user\x00test\x00\x00"...)
+	c.send(0, startup)
+	if messages := c.receive(); !strings.HasPrefix(messages[0], "R ") || messages[len(messages)-1][0] != 'K' {
+		t.Fatalf("Expected authentication and a key. Got: %q", messages)
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"insert 1 alice a@example.com", []string{"C INSERT 0 1"}},
+		{"insert 2 bob b@example.com;", []string{"C INSERT 0 1"}},
+		{"select id, email", []string{"T id:20,email:25", "D 1,a@example.com", "D 2,b@example.com", "C SELECT 2"}},
+		{"select min(username) where id > 5", []string{"T min(username):25", "D NULL", "C SELECT 1"}},
+		{"delete 2", []string{"C DELETE 1"}},
+		{"insert 1 carol c@example.com", []string{"E XX000 duplicate key"}},
+		{"insert 3 carol c@example.com returning id, username", []string{"T id:20,username:25", "D 3,carol", "C INSERT 0 1"}},
+		{"insert or ignore 3 dave d@example.com returning id", []string{"T id:20", "C INSERT 0 0"}},
+		{"insert or ignore 3 dave d@example.com", []string{"C INSERT 0 0"}},
+		{"insert or replace 3 dave d@example.com", []string{"C INSERT 0 1"}},
+		{"selec", []string{"E 42601 unknown statement: selec"}},
+		{" ; ", []string{"I "}},
+	}
+	for _, test := range tests {
+		c.send('Q', pgString(nil, test.query))
+		if got := c.receive(); strings.Join(got, "|") != strings.Join(test.expected, "|") {
+			t.Fatalf("Query %q: expected %q. Got: %q", test.query, test.expected, got)
+		}
+	}
+
+	// Extended query messages get one error until Sync.
+	c.send('P', pgString(pgString(pgString(nil, ""), "select"), "\x00\x00"))
+	c.send('B', []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	c.send('S', nil)
+	if got := c.receive(); len(got) != 1 || !strings.HasPrefix(got[0], "E 0A000") {
+		t.Fatalf("Expected a single error for the extended protocol. Got: %q", got)
+	}
+
+	c.send('X', nil)
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the server to close the connection. Got: %v", err)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("ServePG failed: %v", err)
+	}
+}
+
+func TestPGAuth(t *testing.T) {
+	srv := newAuthTestServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.ServePG(ctx, l)
+
+	for _, password := range []string{"wrong", "secret"} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		c := &pgClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+		startup := binary.BigEndian.AppendUint32(nil, pgProtocolVersion)
+		c.send(0, append(startup, "user\x00alice\x00database\x00db\x00\x00"...))
+		typ, body, err := pgReadMessage(c.r)
+		if err != nil || typ != 'R' || binary.BigEndian.Uint32(body) != 3 {
+			t.Fatalf("Expected to be asked for a password. Got: %c %v, %v", typ, body, err)
+		}
+		c.send('p', pgString(nil, password))
+		typ, body, err = pgReadMessage(c.r)
+		if err != nil {
+			t.Fatalf("Failed to receive: %v", err)
+		}
+		got := fmt.Sprintf("%c %s", typ, pgDescribe(typ, body))
+		if password == "wrong" && got != `E 28P01 password authentication failed for user "alice"` {
+			t.Fatalf("Expected a wrong password to fail. Got: %s", got)
+		}
+		if password == "secret" && (typ != 'R' || binary.BigEndian.Uint32(body) != 0) {
+			t.Fatalf("Expected the right password to be accepted. Got: %q", got)
+		}
+	}
+}
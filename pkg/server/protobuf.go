@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+Protocol buffers.
+
+The messages of api/db.proto are encoded by hand, with what little of the
+wire format they need: a field is a tag, the field number shifted left by 3
+or'ed with its wire type, followed by its value. Integers and bools are
+varints, strings and messages are a varint length followed by their bytes,
+and a repeated field is the field once per element. Fields with the default
+value, 0 or "", are left out. Decoding skips the fields it does not know, as
+every protocol buffers decoder does, so clients built from a newer proto
+still work.
+
+See https://protobuf.dev/programming-guides/encoding/.
+*/
+
+// Wire types.
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+var errPbTruncated = errors.New("protobuf message is truncated")
+
+func pbAppendTag(b []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// pbAppendVarint appends an integer field, negative ones as their 10 byte two's complement.
+func pbAppendVarint(b []byte, field int, v uint64) []byte {
+	return binary.AppendUvarint(pbAppendTag(b, field, pbVarint), v)
+}
+
+// pbAppendBytes appends a string or an encoded message.
+func pbAppendBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(pbAppendTag(b, field, pbBytes), uint64(len(data)))
+	return append(b, data...)
+}
+
+// pbFields calls fn with every field of a message: its number, wire type and
+// value, which is the integer of a varint or fixed field and the bytes of the
+// others.
+func pbFields(data []byte, fn func(field int, wireType int, value uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errPbTruncated
+		}
+		data = data[n:]
+		field, wireType := int(tag>>3), int(tag&7)
+		if field == 0 {
+			return fmt.Errorf("protobuf field number 0 is invalid")
+		}
+		var value uint64
+		var bytes []byte
+		switch wireType {
+		case pbVarint:
+			if value, n = binary.Uvarint(data); n <= 0 {
+				return errPbTruncated
+			}
+			data = data[n:]
+		case pbFixed64:
+			if len(data) < 8 {
+				return errPbTruncated
+			}
+			value, data = binary.LittleEndian.Uint64(data), data[8:]
+		case pbFixed32:
+			if len(data) < 4 {
+				return errPbTruncated
+			}
+			value, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case pbBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return errPbTruncated
+			}
+			bytes, data = data[n:n+int(size)], data[n+int(size):]
+		default:
+			// Groups, wire types 3 and 4, are deprecated and in no message of the service.
+			return fmt.Errorf("protobuf wire type %d is not supported", wireType)
+		}
+		if err := fn(field, wireType, value, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pbExpect fails for a known field encoded with another wire type than its own.
+func pbExpect(field int, wireType int, expected int) error {
+	if wireType != expected {
+		return fmt.Errorf("protobuf field %d has wire type %d, expected %d", field, wireType, expected)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/raft"
+)
+
+/*
+Replication.
+
+A replication layer, such as Raft, orders the write statements of all nodes
+in a log and hands every committed entry to each node's Apply. Statements do
+not depend on randomness or the node, and an entry carries the time the
+leader accepted it, which a ttl counts from instead of the node's clock, so
+every node applying the same entries in the same order ends up with the same
+rows. An entry whose
+statement fails, say with duplicate key, fails the same way everywhere and
+is still applied.
+
+The index of the last entry applied is stored in the db file, committed with
+the entry's write, so a node that restarts applies the entries after it and
+no others. A snapshot is a full backup, whose file header holds the index,
+plus the index in a file of its own, which can be read without opening the
+backup. A node that falls too far behind, or a new one, restores a snapshot
+and applies the entries after its index.
+
+With SetReplication, the server is a node of a cluster replicated by the
+raft package, whose committed entries it hands to ApplyRaft. An insert or
+delete is proposed to the leader as an entry instead of being run, and
+returns once the entry was applied on the leader, with its outcome there. A
+follower refuses writes and reads alike, naming the leader: its rows may be
+behind, and the leader's are only up to date while it is the leader, which
+it stops being within an election timeout of losing touch with the others.
+The other statements would change this node only, and are refused, like
+transactions, the writes of the Redis front end and deleting the expired
+rows with SweepExpired.
+*/
+
+// snapshotIndexName is the file in a snapshot directory holding the applied index.
+const snapshotIndexName = "applied-index"
+
+// LogEntry is a committed entry of a replicated log.
+type LogEntry struct {
+	Index     uint64    // Position in the log, starting at 1.
+	Statement string    // An insert or delete.
+	Time      time.Time // When the leader accepted the entry, the time the write runs at.
+}
+
+// Apply runs a committed log entry and returns the statement's error, if any.
+// Entries must come in index order. One at or below the last applied index
+// was applied already and is skipped, so a log can be replayed. An entry
+// without a statement only moves the index on.
+func (s *Server) Apply(ctx context.Context, entry LogEntry) error {
+	_, err := s.apply(ctx, entry)
+	return err
+}
+
+// apply is Apply, returning what the statement did.
+func (s *Server) apply(ctx context.Context, entry LogEntry) (db.ExecResult, error) {
+	var stmt parser.Statement
+	if text := strings.TrimSpace(entry.Statement); text != "" {
+		var err error
+		if stmt, err = parser.Parse(text); err != nil {
+			return db.ExecResult{}, err
+		}
+		switch stmt.(type) {
+		case *parser.Insert, *parser.Delete:
+		default:
+			return db.ExecResult{}, fmt.Errorf("only inserts and deletes can be replicated")
+		}
+	}
+	if entry.Time.IsZero() {
+		return db.ExecResult{}, fmt.Errorf("entry %d has no time", entry.Index)
+	}
+
+	var changed db.ExecResult
+	err := s.table.Exclusive(func() error {
+		applied := s.table.AppliedIndex()
+		if entry.Index <= applied {
+			return nil
+		}
+		if entry.Index != applied+1 {
+			return fmt.Errorf("entry %d applied after %d, entries must not be skipped", entry.Index, applied)
+		}
+		var err error
+		changed, err = s.table.ApplyEntry(ctx, entry.Index, entry.Time, stmt)
+		return err
+	})
+	return changed, err
+}
+
+// SetReplication makes the server a node of the cluster node belongs to,
+// whose Apply must be ApplyRaft, see Apply. It must be called before the
+// server serves clients.
+func (s *Server) SetReplication(node *raft.Node) {
+	s.node = node
+}
+
+// ApplyRaft applies an entry committed by a raft node, see raft.Config.Apply.
+// It returns the db.ExecResult of the statement.
+func (s *Server) ApplyRaft(entry raft.Entry) (any, error) {
+	changed, err := s.apply(context.Background(), LogEntry{Index: entry.Index, Statement: entry.Command, Time: entry.Time})
+	if err != nil && s.Applied() < entry.Index {
+		return nil, fmt.Errorf("%w: %w", raft.ErrNotApplied, err)
+	}
+	return changed, err
+}
+
+// propose runs an insert or delete on a replicated database, see SetReplication.
+func (s *Server) propose(ctx context.Context, text string) (db.ExecResult, error) {
+	result, err := s.node.Propose(ctx, text)
+	if err != nil {
+		return db.ExecResult{}, err
+	}
+	return result.(db.ExecResult), nil
+}
+
+// checkReplicated refuses on a replicated database the statements that would
+// change this node only, and every statement on a follower.
+func (s *Server) checkReplicated(stmt parser.Statement) error {
+	if s.node == nil {
+		return nil
+	}
+	switch stmt := stmt.(type) {
+	case *parser.Insert:
+		if stmt.Returning != nil {
+			return fmt.Errorf("returning is not supported on a replicated database")
+		}
+	case *parser.Delete, *parser.Select:
+	default:
+		return fmt.Errorf("only insert, delete and select run on a replicated database, the other statements would change this node only")
+	}
+	return s.checkLeader()
+}
+
+// checkLeader fails on a follower of a replicated database.
+func (s *Server) checkLeader() error {
+	if s.node == nil {
+		return nil
+	}
+	if leader, isLeader := s.node.Leader(); !isLeader {
+		return &raft.NotLeaderError{Leader: leader}
+	}
+	return nil
+}
+
+// Applied returns the index of the last log entry applied.
+func (s *Server) Applied() uint64 {
+	var applied uint64
+	s.table.Exclusive(func() error {
+		applied = s.table.AppliedIndex()
+		return nil
+	})
+	return applied
+}
+
+// Snapshot writes a full backup of the table into dir, replacing any backup
+// there, along with the index of the last applied entry, which it returns.
+func (s *Server) Snapshot(dir string) (uint64, error) {
+	var applied uint64
+	err := s.table.Exclusive(func() error {
+		if _, err := s.table.Backup(dir, false); err != nil {
+			return err
+		}
+		applied = s.table.AppliedIndex()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	index := []byte(strconv.FormatUint(applied, 10))
+	if err := os.WriteFile(filepath.Join(dir, snapshotIndexName), index, 0666); err != nil {
+		return 0, err
+	}
+	return applied, nil
+}
+
+// RestoreSnapshot rebuilds the db file filename, which must not exist, from
+// the snapshot in dir and returns the index of the last entry applied to it.
+// A server opened on the file continues from there.
+func RestoreSnapshot(dir string, filename string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, snapshotIndexName))
+	if err != nil {
+		return 0, fmt.Errorf("no snapshot in %s: %w", dir, err)
+	}
+	index, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("corrupt snapshot index %q", data)
+	}
+	if err := db.RestoreBackup(dir, filename); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
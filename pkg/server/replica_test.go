@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/dberr"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/raft"
+)
+
+func TestApplyAndSnapshot(t *testing.T) {
+	ctx, now := context.Background(), time.Now()
+	srv := newTestServer(t)
+	entries := []LogEntry{
+		{1, "insert 1 alice a@example.com", now},
+		{2, "insert 2 bob b@example.com", now},
+		{3, "insert 1 again a@example.com", now}, // Fails on every node alike.
+		{4, "delete 2", now},
+	}
+	for _, entry := range entries {
+		err := srv.Apply(ctx, entry)
+		if expected := entry.Index == 3; (err != nil) != expected {
+			t.Fatalf("Apply(%v) = %v", entry, err)
+		}
+	}
+	// Replayed entries are skipped, gaps are refused.
+	if err := srv.Apply(ctx, entries[0]); err != nil {
+		t.Fatalf("Expected a replayed entry to be skipped. Got: %v", err)
+	}
+	if err := srv.Apply(ctx, LogEntry{6, "delete 1", now}); err == nil || err.Error() != "entry 6 applied after 4, entries must not be skipped" {
+		t.Fatalf("Expected a gap to be refused. Got: %v", err)
+	}
+	if err := srv.Apply(ctx, LogEntry{5, "select", now}); err == nil {
+		t.Fatalf("Expected a select to be refused")
+	}
+	if err := srv.Apply(ctx, LogEntry{Index: 5, Statement: "delete 1"}); err == nil || err.Error() != "entry 5 has no time" {
+		t.Fatalf("Expected an entry without a time to be refused. Got: %v", err)
+	}
+
+	dir := t.TempDir()
+	if index, err := srv.Snapshot(dir); err != nil || index != 4 {
+		t.Fatalf("Snapshot() = %d, %v", index, err)
+	}
+	filename := filepath.Join(t.TempDir(), "replica.db")
+	index, err := RestoreSnapshot(dir, filename)
+	if err != nil || index != 4 {
+		t.Fatalf("RestoreSnapshot() = %d, %v", index, err)
+	}
+	table, err := db.Open(filename)
+	if err != nil {
+		t.Fatalf("Failed to open the restored db: %v", err)
+	}
+	defer table.Close()
+	replica := New(table)
+	if applied := replica.Applied(); applied != 4 {
+		t.Fatalf("Expected the restored file to hold applied index 4. Got: %d", applied)
+	}
+	if err := replica.Apply(ctx, LogEntry{5, "insert 3 carol c@example.com", now}); err != nil {
+		t.Fatalf("Apply after restore failed: %v", err)
+	}
+	result, err := replica.Query(ctx, "select id")
+	if err != nil || fmt.Sprint(result.Rows) != "[[1] [3]]" {
+		t.Fatalf("Expected rows 1 and 3 on the replica. Got: %v, %v", result.Rows, err)
+	}
+}
+
+func TestAppliedIndexPersists(t *testing.T) {
+	ctx, now := context.Background(), time.Now()
+	filename := filepath.Join(t.TempDir(), "node.db")
+	table, err := db.Open(filename)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	srv := New(table)
+	srv.Apply(ctx, LogEntry{1, "insert 1 alice a@example.com", now})
+	srv.Apply(ctx, LogEntry{2, "insert 1 alice a@example.com", now})
+	// An entry that fails for a reason of this node's own is not applied, and must be again.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := srv.Apply(cancelled, LogEntry{3, "insert 2 bob b@example.com", now}); err == nil {
+		t.Fatalf("Expected the cancelled entry to fail.")
+	}
+	if applied := srv.Applied(); applied != 2 {
+		t.Fatalf("Expected the duplicate key to be applied but not the cancelled entry. Got: %d", applied)
+	}
+	table.Close()
+
+	table, err = db.Open(filename)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer table.Close()
+	srv = New(table)
+	if applied := srv.Applied(); applied != 2 {
+		t.Fatalf("Expected the applied index to survive a restart. Got: %d", applied)
+	}
+	if err := srv.Apply(ctx, LogEntry{3, "insert 2 bob b@example.com", now}); err != nil {
+		t.Fatalf("Apply after restart failed: %v", err)
+	}
+	result, err := srv.Query(ctx, "select id")
+	if err != nil || fmt.Sprint(result.Rows) != "[[1] [2]]" {
+		t.Fatalf("Expected rows 1 and 2. Got: %v, %v", result.Rows, err)
+	}
+}
+
+func TestReplicatedCluster(t *testing.T) {
+	ctx := context.Background()
+	ids := []string{"1", "2", "3"}
+	var mu sync.Mutex
+	nodes := map[string]*raft.Node{}
+	urls := map[string]string{}
+	for _, id := range ids {
+		peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			node := nodes[id]
+			mu.Unlock()
+			if node == nil {
+				http.Error(w, "not started", http.StatusServiceUnavailable)
+				return
+			}
+			raft.Handler(node).ServeHTTP(w, r)
+		}))
+		t.Cleanup(peer.Close)
+		urls[id] = peer.URL
+	}
+	servers := map[string]*Server{}
+	for _, id := range ids {
+		dir := t.TempDir()
+		table, err := db.Open(filepath.Join(dir, "node.db"))
+		if err != nil {
+			t.Fatalf("Failed to open db: %v", err)
+		}
+		srv := New(table)
+		node, err := raft.Start(raft.Config{
+			ID:              id,
+			Peers:           slices.DeleteFunc(slices.Clone(ids), func(peer string) bool { return peer == id }),
+			Dir:             filepath.Join(dir, "raft"),
+			Transport:       &raft.HTTPTransport{URLs: urls},
+			Apply:           srv.ApplyRaft,
+			Applied:         srv.Applied(),
+			ElectionTimeout: 100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("raft.Start failed: %v", err)
+		}
+		t.Cleanup(func() {
+			node.Stop()
+			table.Close()
+		})
+		srv.SetReplication(node)
+		mu.Lock()
+		nodes[id] = node
+		mu.Unlock()
+		servers[id] = srv
+	}
+
+	var leader string
+	for deadline := time.Now().Add(5 * time.Second); leader == ""; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("No leader was elected")
+		}
+		for _, id := range ids {
+			if _, isLeader := nodes[id].Leader(); isLeader {
+				leader = id
+			}
+		}
+	}
+	if result, err := servers[leader].Query(ctx, "insert 1 alice a@example.com"); err != nil || result.Changed.RowsAffected != 1 {
+		t.Fatalf("Expected the insert to be replicated. Got: %v, %v", result.Changed, err)
+	}
+	servers[leader].Query(ctx, "insert 2 bob b@example.com")
+	if _, err := servers[leader].Query(ctx, "insert 1 again a@example.com"); !errors.Is(err, dberr.ErrDuplicateKey) {
+		t.Fatalf("Expected the leader to return the outcome of the entry. Got: %v", err)
+	}
+	servers[leader].Query(ctx, "delete 1")
+	if _, err := servers[leader].Query(ctx, "create index on username"); err == nil {
+		t.Fatalf("Expected a statement changing the leader only to be refused")
+	}
+	if result, err := servers[leader].Query(ctx, "select id"); err != nil || fmt.Sprint(result.Rows) != "[[2]]" {
+		t.Fatalf("Expected row 2 on the leader. Got: %v, %v", result.Rows, err)
+	}
+
+	for _, id := range ids {
+		if id == leader {
+			continue
+		}
+		var notLeader *raft.NotLeaderError
+		for _, text := range []string{"select id", "insert 3 carol c@example.com"} {
+			if _, err := servers[id].Query(ctx, text); !errors.As(err, &notLeader) || notLeader.Leader != leader {
+				t.Fatalf("Expected follower %s to refuse %q, naming leader %s. Got: %v", id, text, leader, err)
+			}
+		}
+		// The follower applies the entries, up to those the leader applied.
+		for deadline := time.Now().Add(5 * time.Second); servers[id].Applied() < servers[leader].Applied(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Follower %s applied %d entries, the leader %d", id, servers[id].Applied(), servers[leader].Applied())
+			}
+		}
+		stmt, _ := parser.Parse("select id")
+		rows := [][]any{}
+		servers[id].table.Exclusive(func() error {
+			_, err := servers[id].table.Execute(ctx, stmt, func(values []any) error {
+				rows = append(rows, values)
+				return nil
+			})
+			return err
+		})
+		if fmt.Sprint(rows) != "[[2]]" {
+			t.Fatalf("Expected row 2 on follower %s. Got: %v", id, rows)
+		}
+	}
+}
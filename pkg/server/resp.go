@@ -0,0 +1,478 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/constants"
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/types"
+)
+
+/*
+Redis front end.
+
+Clients speak RESP, the protocol of Redis, and use the table as a key-value
+store. A key is a row id, a value the rest of the row as a JSON object:
+
+	SET 1 '{"username":"alice","email":"a@example.com"}'
+	GET 1                        {"username":"alice","email":"a@example.com"}
+
+These commands are supported:
+
+	GET <key>
+	SET <key> <value>            replaces the row if it exists
+	DEL <key> [<key> ...]        replies with how many rows were deleted
+	EXISTS <key> [<key> ...]
+	SCAN <cursor> [MATCH <pattern>] [COUNT <n>]
+	DBSIZE, PING [<message>], ECHO <message>, QUIT
+	AUTH [<user>] <password>     signs in, as user default if no user is given
+
+SCAN walks the ids in order. Its cursor is the id to continue from, and the
+cursor it replies with is 0 once every id was returned. Commands come as
+arrays of bulk strings, as clients send them, or as inline lines. Once the
+database has user accounts, a connection must AUTH before anything but QUIT,
+and the user needs the read privilege for GET, EXISTS, SCAN and DBSIZE and
+the write privilege for SET and DEL. The server's limits apply to every
+command but PING, ECHO, QUIT and COMMAND, with the row limit capping COUNT.
+
+See https://redis.io/docs/latest/develop/reference/protocol-spec/.
+*/
+
+const (
+	respMaxBulkLength = 1 << 20
+	respMaxArgs       = 1024
+	respScanCount     = 10 // Ids a SCAN returns when no COUNT is given.
+)
+
+// respValue is the JSON encoding of a row's value.
+type respValue struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// respError is an error replied to the client.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// ServeRESP serves the Redis front end on l until ctx is done, like ServePG.
+func (s *Server) ServeRESP(ctx context.Context, l net.Listener) error {
+	if s.tls != nil {
+		l = tls.NewListener(l, s.tls)
+	}
+	return s.serveConns(ctx, l, s.respConn)
+}
+
+func (s *Server) respConn(ctx context.Context, conn net.Conn) error {
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	authRequired, err := s.authRequired()
+	if err != nil {
+		respWrite(w, err)
+		w.Flush()
+		return err
+	}
+	for {
+		args, err := respReadCommand(r)
+		if err != nil {
+			var protocolErr respError
+			if errors.As(err, &protocolErr) {
+				respWrite(w, err)
+				w.Flush()
+			}
+			return err
+		}
+		if len(args) == 0 {
+			continue
+		}
+		command := strings.ToUpper(args[0])
+		var reply any
+		switch {
+		case command == "AUTH":
+			var user string
+			if user, err = s.respAuth(args[1:]); err == nil {
+				reply, authRequired = "OK", false
+				if user != "" {
+					ctx = db.WithUser(ctx, user)
+				}
+			}
+		case authRequired && command != "QUIT":
+			err = respError("NOAUTH Authentication required.")
+		default:
+			reply, err = s.respCommand(ctx, command, args[1:])
+		}
+		if err != nil {
+			reply = err
+		}
+		respWrite(w, reply)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if command == "QUIT" {
+			return nil
+		}
+	}
+}
+
+// respCommand runs a command and returns its reply: a string, which is sent
+// as a simple string, []byte as a bulk string, nil as the null bulk string,
+// an int, a respError or an []any of those.
+func (s *Server) respCommand(ctx context.Context, command string, args []string) (any, error) {
+	arity := map[string][2]int{ // Least and most arguments, -1 for any number.
+		"GET": {1, 1}, "SET": {2, 2}, "DEL": {1, -1}, "EXISTS": {1, -1}, "SCAN": {1, 5},
+		"DBSIZE": {0, 0}, "PING": {0, 1}, "ECHO": {1, 1}, "QUIT": {0, 0}, "COMMAND": {0, -1},
+	}
+	limits, ok := arity[command]
+	if !ok {
+		return nil, respError(fmt.Sprintf("ERR unknown command '%s'", command))
+	}
+	if len(args) < limits[0] || (limits[1] >= 0 && len(args) > limits[1]) {
+		return nil, respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+	}
+	switch command {
+	case "PING":
+		if len(args) == 1 {
+			return []byte(args[0]), nil
+		}
+		return "PONG", nil
+	case "ECHO":
+		return []byte(args[0]), nil
+	case "QUIT":
+		return "OK", nil
+	case "COMMAND":
+		// redis-cli asks for the command docs when it starts, there are none.
+		return []any{}, nil
+	}
+
+	keys := args
+	switch command {
+	case "GET", "SET":
+		keys = args[:1]
+	case "SCAN", "DBSIZE":
+		keys = nil
+	}
+	privilege, text := "read", ""
+	if command == "SET" || command == "DEL" {
+		// Writes are audited like statements, as the command line.
+		privilege, text = "write", strings.Join(append([]string{command}, args...), " ")
+	}
+	if err := s.checkPrivilege(ctx, privilege); err != nil {
+		if text != "" {
+			err = s.record(ctx, text, 0, err)
+		}
+		if errors.Is(err, db.ErrPermissionDenied) {
+			return nil, respError("NOPERM " + err.Error())
+		}
+		return nil, err
+	}
+	if s.node != nil && text != "" {
+		return nil, respError("ERR writes over the Redis protocol are not replicated, use insert and delete")
+	}
+	if err := s.checkLeader(); err != nil {
+		return nil, respError("ERR " + err.Error())
+	}
+	var ids []uint32
+	for _, key := range keys {
+		id, err := strconv.ParseUint(key, 10, 32)
+		if err != nil {
+			return nil, respError("ERR key must be a row id between 0 and 4294967295")
+		}
+		ids = append(ids, uint32(id))
+	}
+
+	quota := s.currentLimits()
+	if err := s.allow(ctx, quota); err != nil {
+		return nil, respError("ERR " + err.Error())
+	}
+	ctx, cancel := withDeadline(ctx, quota)
+	defer cancel()
+	switch command {
+	case "SET":
+		stmt, err := respInsert(ids[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		changed, err := s.write(ctx, func(txn *db.Txn) (db.ExecResult, error) {
+			return txn.Execute(ctx, stmt, func(values []any) error { return nil })
+		})
+		if err := s.record(ctx, text, changed.RowsAffected, err); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	case "DEL":
+		n := 0
+		_, err := s.write(ctx, func(txn *db.Txn) (db.ExecResult, error) {
+			for _, id := range ids {
+				_, found, err := txn.Get(ctx, id)
+				if err != nil {
+					return db.ExecResult{}, err
+				}
+				if !found {
+					continue
+				}
+				if err := txn.Delete(ctx, id); err != nil {
+					return db.ExecResult{}, err
+				}
+				n++
+			}
+			return db.ExecResult{RowsAffected: n}, nil
+		})
+		if err != nil {
+			n = 0
+		}
+		if err := s.record(ctx, text, n, err); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	var reply any
+	err := s.table.Exclusive(func() error {
+		var err error
+		reply, err = s.respRead(command, ids, args, quota)
+		return err
+	})
+	return reply, err
+}
+
+// respRead returns the reply to a command that reads rows: GET, EXISTS, DBSIZE or SCAN.
+func (s *Server) respRead(command string, ids []uint32, args []string, quota Limits) (any, error) {
+	switch command {
+	case "GET":
+		row, found, err := respGet(s.table, ids[0])
+		if err != nil || !found {
+			return nil, err
+		}
+		return json.Marshal(respValue{
+			Username: string(bytes.Trim(row.Username[:], "\x00")),
+			Email:    string(bytes.Trim(row.Email[:], "\x00")),
+		})
+	case "EXISTS":
+		n := 0
+		for _, id := range ids {
+			_, found, err := respGet(s.table, id)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				n++
+			}
+		}
+		return n, nil
+	case "DBSIZE":
+		info, err := s.table.Info()
+		if err != nil {
+			return nil, err
+		}
+		return int(info.Rows), nil
+	}
+	return s.respScan(args, quota)
+}
+
+// respAuth checks the arguments of AUTH, the password or the user and the
+// password, and returns the user. It returns "" if the database has no accounts.
+func (s *Server) respAuth(args []string) (string, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return "", respError("ERR wrong number of arguments for 'auth' command")
+	}
+	user, password := "default", args[len(args)-1]
+	if len(args) == 2 {
+		user = args[0]
+	}
+	if required, err := s.authRequired(); err != nil || !required {
+		return "", err
+	}
+	ok, err := s.authenticate(user, password)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", respError("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	return user, nil
+}
+
+// respScan returns the reply to SCAN: the next cursor and the ids it found.
+// A COUNT above the row limit is lowered to it.
+func (s *Server) respScan(args []string, limits Limits) (any, error) {
+	start, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return nil, respError("ERR invalid cursor")
+	}
+	pattern, count := "*", respScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return nil, respError("ERR syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, respError("ERR invalid pattern")
+			}
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return nil, respError("ERR value is not an integer or out of range")
+			}
+		default:
+			return nil, respError("ERR syntax error")
+		}
+	}
+	if limits.MaxRows > 0 {
+		count = min(count, limits.MaxRows)
+	}
+
+	// Like Redis, COUNT bounds the ids looked at, not the ones matching.
+	cursor := s.table.Cursor()
+	defer cursor.Close()
+	keys := []any{}
+	next := []byte("0")
+	seen := 0
+	for err = cursor.Seek(uint32(start)); cursor.Valid(); err = cursor.Next() {
+		if err != nil {
+			return nil, err
+		}
+		id, err := cursor.Key()
+		if err != nil {
+			return nil, err
+		}
+		if seen == count {
+			next = []byte(strconv.FormatUint(uint64(id), 10))
+			break
+		}
+		seen++
+		key := strconv.FormatUint(uint64(id), 10)
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, []byte(key))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []any{next, keys}, nil
+}
+
+// respGet returns the row with the given id and whether it exists.
+func respGet(table *db.Table, id uint32) (types.Row, bool, error) {
+	cursor := table.Cursor()
+	defer cursor.Close()
+	if err := cursor.Seek(id); err != nil || !cursor.Valid() {
+		return types.Row{}, false, err
+	}
+	key, err := cursor.Key()
+	if err != nil || key != id {
+		return types.Row{}, false, err
+	}
+	row, err := cursor.Value()
+	return row, err == nil, err
+}
+
+// respInsert decodes the value of SET into an insert or replace of the row with the given id.
+func respInsert(id uint32, value string) (*parser.Insert, error) {
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	var v respValue
+	if err := decoder.Decode(&v); err != nil {
+		return nil, respError(`ERR value must be a JSON object like {"username":"...","email":"..."}`)
+	}
+	if len(v.Username) > int(constants.UsernameSize) || len(v.Email) > int(constants.EmailSize) {
+		return nil, respError("ERR string is too long")
+	}
+	return &parser.Insert{Id: id, Username: v.Username, Email: v.Email, Conflict: "replace"}, nil
+}
+
+// respReadCommand reads a command, either an array of bulk strings or an inline line.
+func respReadCommand(r *bufio.Reader) ([]string, error) {
+	line, err := respReadLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > respMaxArgs {
+		return nil, respError("ERR Protocol error: invalid multibulk length")
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := respReadLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, respError(fmt.Sprintf("ERR Protocol error: expected '$', got '%.1s'", line))
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > respMaxBulkLength {
+			return nil, respError("ERR Protocol error: invalid bulk length")
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if string(data[length:]) != "\r\n" {
+			return nil, respError("ERR Protocol error: bulk string not terminated by CRLF")
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+// respReadLine reads a line ending in CRLF, or LF for inline commands typed by hand.
+// A line longer than a bulk string is refused as soon as that much of it is read.
+func respReadLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > respMaxBulkLength+len("\r\n") {
+			return "", respError("ERR Protocol error: too big inline request")
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			if errors.Is(err, io.EOF) && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+func respWrite(w *bufio.Writer, reply any) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, elem := range v {
+			respWrite(w, elem)
+		}
+	case respError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case error:
+		// Errors of the engine have no Redis error prefix yet.
+		fmt.Fprintf(w, "-ERR %s\r\n", strings.ReplaceAll(v.Error(), "\r\n", " "))
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// respCommandArray encodes a command like clients send it.
+func respCommandArray(args ...string) string {
+	s := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		s += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return s
+}
+
+func TestRESP(t *testing.T) {
+	srv := newTestServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- srv.ServeRESP(ctx, l) }()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	r := bufio.NewReader(conn)
+
+	if _, err := srv.Query(context.Background(), "insert 3 carol c@example.com"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{respCommandArray("PING"), "+PONG\r\n"},
+		{"ping hello\r\n", "$5\r\nhello\r\n"},
+		{respCommandArray("SET", "1", `{"username":"alice","email":"a@example.com"}`), "+OK\r\n"},
+		{respCommandArray("SET", "2", `{"username":"bob"}`), "+OK\r\n"},
+		{respCommandArray("GET", "1"), "$44\r\n{\"username\":\"alice\",\"email\":\"a@example.com\"}\r\n"},
+		{respCommandArray("SET", "1", `{"username":"alicia","email":""}`), "+OK\r\n"},
+		{respCommandArray("GET", "1"), "$32\r\n{\"username\":\"alicia\",\"email\":\"\"}\r\n"},
+		{respCommandArray("GET", "3"), "$44\r\n{\"username\":\"carol\",\"email\":\"c@example.com\"}\r\n"},
+		{respCommandArray("GET", "4"), "$-1\r\n"},
+		{respCommandArray("EXISTS", "1", "4", "3"), ":2\r\n"},
+		{respCommandArray("DBSIZE"), ":3\r\n"},
+		{respCommandArray("SCAN", "0", "COUNT", "2"), "*2\r\n$1\r\n3\r\n*2\r\n$1\r\n1\r\n$1\r\n2\r\n"},
+		{respCommandArray("SCAN", "3", "COUNT", "2"), "*2\r\n$1\r\n0\r\n*1\r\n$1\r\n3\r\n"},
+		{respCommandArray("SCAN", "0", "MATCH", "[12]"), "*2\r\n$1\r\n0\r\n*2\r\n$1\r\n1\r\n$1\r\n2\r\n"},
+		{respCommandArray("DEL", "2", "4", "3"), ":2\r\n"},
+		{respCommandArray("DBSIZE"), ":1\r\n"},
+		{respCommandArray("GET", "x"), "-ERR key must be a row id between 0 and 4294967295\r\n"},
+		{respCommandArray("SET", "5", "raw"), "-ERR value must be a JSON object like {\"username\":\"...\",\"email\":\"...\"}\r\n"},
+		{respCommandArray("SET", "5", `{"username":"`+strings.Repeat("a", 33)+`"}`), "-ERR string is too long\r\n"},
+		{respCommandArray("GET"), "-ERR wrong number of arguments for 'get' command\r\n"},
+		{respCommandArray("HSET", "1"), "-ERR unknown command 'HSET'\r\n"},
+		{respCommandArray("QUIT"), "+OK\r\n"},
+	}
+	for _, test := range tests {
+		if _, err := io.WriteString(conn, test.command); err != nil {
+			t.Fatalf("Failed to send %q: %v", test.command, err)
+		}
+		got := make([]byte, len(test.expected))
+		if _, err := io.ReadFull(r, got); err != nil || string(got) != test.expected {
+			t.Fatalf("Command %q: expected %q. Got: %q, %v", test.command, test.expected, got, err)
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected QUIT to close the connection. Got: %v", err)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("ServeRESP failed: %v", err)
+	}
+}
+
+func TestRESPAuth(t *testing.T) {
+	srv := newAuthTestServer(t)
+	if err := srv.table.Revoke("alice", []string{"write"}); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.ServeRESP(ctx, l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{respCommandArray("GET", "1"), "-NOAUTH Authentication required.\r\n"},
+		{respCommandArray("AUTH", "secret"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{respCommandArray("AUTH", "alice", "wrong"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{respCommandArray("AUTH", "alice", "secret"), "+OK\r\n"},
+		{respCommandArray("GET", "1"), "$-1\r\n"},
+		{respCommandArray("DEL", "1"), "-NOPERM permission denied: alice does not have the write privilege\r\n"},
+	}
+	for _, test := range tests {
+		if _, err := io.WriteString(conn, test.command); err != nil {
+			t.Fatalf("Failed to send %q: %v", test.command, err)
+		}
+		got := make([]byte, len(test.expected))
+		if _, err := io.ReadFull(r, got); err != nil || string(got) != test.expected {
+			t.Fatalf("Command %q: expected %q. Got: %q, %v", test.command, test.expected, got, err)
+		}
+	}
+}
+
+// endlessReader is a line that never ends.
+type endlessReader struct{ read int }
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	r.read += len(p)
+	return len(p), nil
+}
+
+func TestRESPReadLineLimit(t *testing.T) {
+	line, err := respReadLine(bufio.NewReader(strings.NewReader(strings.Repeat("a", respMaxBulkLength) + "\r\n")))
+	if err != nil || len(line) != respMaxBulkLength {
+		t.Fatalf("Expected a line of the longest bulk length to be read. Got %d bytes: %v", len(line), err)
+	}
+	endless := &endlessReader{}
+	if _, err := respReadLine(bufio.NewReader(endless)); err == nil || err.Error() != "ERR Protocol error: too big inline request" {
+		t.Fatalf("Expected a line without end to be refused. Got: %v", err)
+	}
+	if endless.read > respMaxBulkLength+2*4096 {
+		t.Fatalf("Expected the line to be refused once over the limit. Read %d bytes", endless.read)
+	}
+	if _, err := respReadLine(bufio.NewReader(strings.NewReader("ping"))); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected a cut off line to fail. Got: %v", err)
+	}
+}
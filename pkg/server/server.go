@@ -0,0 +1,329 @@
+/*
+Package server exposes a database to clients over the network.
+
+Inserts and deletes run in transactions of db.Table.BeginTxn, which lock
+the rows they write, so the writes of different clients go on side by side
+and only those of the same row wait for each other. A Table is otherwise not
+safe for concurrent use, so the other statements run on it one at a time,
+within db.Table.Exclusive. Every statement is committed on its own, and
+begin, commit, rollback and savepoints are refused: only the gRPC front end
+has transactions, which span its calls from Begin to Commit. A server can
+also be a node of a replicated database, see SetReplication.
+
+With an audit log set, every statement changing the database is recorded in
+it along with the user and address it came from, whether it succeeded or not.
+*/
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+	"github.com/MichalPitr/db_from_scratch/pkg/raft"
+)
+
+// Server runs the statements of its clients against a table.
+type Server struct {
+	table *db.Table
+	tls   *tls.Config  // Nil if clients connect in plain text, see SetTLSConfig.
+	audit *db.AuditLog // Nil if statements are not audited, see SetAuditLog.
+	node  *raft.Node   // Nil unless the table is replicated, see SetReplication.
+
+	limitsMu sync.Mutex // Guards limits, which are read before a statement runs.
+	limits   Limits
+
+	sessionMu  sync.Mutex              // Guards sessions.
+	sessions   map[uint64]*grpcSession // The transactions begun over gRPC, by id.
+	txnTimeout time.Duration
+}
+
+func New(table *db.Table) *Server {
+	return &Server{table: table, sessions: map[uint64]*grpcSession{}, txnTimeout: grpcTxnTimeout}
+}
+
+// Result is what a statement returned. Columns and Types are nil unless it returns rows.
+type Result struct {
+	Columns []string `json:"columns,omitempty"`
+	Types   []string `json:"types,omitempty"` // integer or text, like db.ColumnTypes.
+	Rows    [][]any  `json:"rows,omitempty"`
+	// What an insert or delete did, which the Postgres command tags report.
+	Changed db.ExecResult `json:"-"`
+}
+
+// SetAuditLog records the statements changing the database in log from now on.
+func (s *Server) SetAuditLog(log *db.AuditLog) {
+	s.audit = log
+}
+
+// clientKey is the context key of the address a client connected from.
+type clientKey struct{}
+
+func withClient(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientKey{}, addr)
+}
+
+// Query parses and runs a single statement.
+func (s *Server) Query(ctx context.Context, text string) (Result, error) {
+	text = strings.TrimSpace(text)
+	stmt, err := parser.Parse(text)
+	if err != nil {
+		return Result{}, err
+	}
+	return s.Run(ctx, text, stmt)
+}
+
+// Run runs a parsed statement, which was parsed from text. The text is only
+// used for the audit log.
+func (s *Server) Run(ctx context.Context, text string, stmt parser.Statement) (Result, error) {
+	limits, err := s.admit(ctx, stmt, false)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var result Result
+	s.table.Exclusive(func() error {
+		result = Result{Columns: s.table.Columns(stmt), Types: s.table.ColumnTypes(stmt)}
+		return nil
+	})
+	changed, err := s.run(ctx, text, stmt, limits, nil, func(values []any) error {
+		result.Rows = append(result.Rows, values)
+		return nil
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	result.Changed = changed
+	return result, nil
+}
+
+// admit refuses the statements clients may not run, on their own or in a
+// transaction, and those over the connection's rate, and returns the limits
+// to run the others with.
+func (s *Server) admit(ctx context.Context, stmt parser.Statement, inTxn bool) (Limits, error) {
+	switch stmt.(type) {
+	case *parser.Begin, *parser.Commit, *parser.Rollback, *parser.Savepoint, *parser.RollbackTo, *parser.Release:
+		return Limits{}, fmt.Errorf("transactions are not supported, every statement is committed on its own")
+	case *parser.Set:
+		if !inTxn {
+			return Limits{}, fmt.Errorf("set only applies in a transaction, begin one over gRPC; the statements run on their own share the server's settings")
+		}
+	case *parser.Select:
+		if stmt.(*parser.Select).Into != nil {
+			return Limits{}, fmt.Errorf("select into is not supported, read the rows instead")
+		}
+	}
+	if err := s.checkReplicated(stmt); err != nil {
+		return Limits{}, err
+	}
+	limits := s.currentLimits()
+	if err := s.allow(ctx, limits); err != nil {
+		return Limits{}, err
+	}
+	return limits, nil
+}
+
+// run runs a statement admitted with limits in txn, or on its own if txn is
+// nil, handing the rows it returns to fn.
+func (s *Server) run(ctx context.Context, text string, stmt parser.Statement, limits Limits, txn *db.Txn, fn func(values []any) error) (db.ExecResult, error) {
+	// Waiting for a row lock or for the table counts towards the runtime limit.
+	runCtx, cancel := withDeadline(ctx, limits)
+	defer cancel()
+	rows := 0
+	limited := func(values []any) error {
+		if limits.MaxRows > 0 && rows == limits.MaxRows {
+			return tooManyRows(limits)
+		}
+		rows++
+		return fn(values)
+	}
+	var changed db.ExecResult
+	var err error
+	switch stmt.(type) {
+	case *parser.Insert, *parser.Delete:
+		if s.node != nil {
+			// The leader checks the privilege, the entry is applied without a user.
+			if err = s.checkPrivilege(runCtx, db.RequiredPrivilege(stmt)); err == nil {
+				changed, err = s.propose(runCtx, text)
+			}
+			break
+		}
+		if txn == nil {
+			changed, err = s.write(runCtx, func(txn *db.Txn) (db.ExecResult, error) {
+				return txn.Execute(runCtx, stmt, limited)
+			})
+			break
+		}
+		changed, err = txn.Execute(runCtx, stmt, limited)
+	default:
+		if txn == nil {
+			err = s.table.Exclusive(func() error {
+				changed, err = s.table.Execute(runCtx, stmt, limited)
+				return err
+			})
+			break
+		}
+		changed, err = txn.Execute(runCtx, stmt, limited)
+	}
+	err = deadlineErr(err, limits)
+	switch stmt.(type) {
+	case *parser.Insert, *parser.Delete:
+		err = s.record(ctx, text, changed.RowsAffected, err)
+	case *parser.Grant, *parser.Revoke, *parser.Partition, *parser.CreateFulltextIndex, *parser.DropFulltextIndex,
+		*parser.CreateSpatialIndex, *parser.CreateUniqueIndex, *parser.CreateIndex, *parser.CreateView, *parser.RefreshView, *parser.AddColumn, *parser.Collate,
+		*parser.Analyze:
+		err = s.record(ctx, text, 0, err)
+	}
+	return changed, err
+}
+
+// write runs fn in a transaction of its own, which it commits unless fn fails.
+func (s *Server) write(ctx context.Context, fn func(txn *db.Txn) (db.ExecResult, error)) (db.ExecResult, error) {
+	txn, err := s.table.BeginTxn(ctx)
+	if err != nil {
+		return db.ExecResult{}, err
+	}
+	changed, err := fn(txn)
+	if err != nil {
+		txn.Rollback()
+		return db.ExecResult{}, err
+	}
+	return changed, txn.Commit()
+}
+
+// record writes a statement that failed with err, or succeeded if err is nil,
+// to the audit log if there is one, and returns err. A statement that can not
+// be recorded fails, although its changes are committed.
+func (s *Server) record(ctx context.Context, text string, rows int, err error) error {
+	if s.audit == nil {
+		return err
+	}
+	entry := db.AuditEntry{Time: time.Now().UTC(), Statement: text, Rows: rows}
+	entry.User, _ = db.UserFrom(ctx)
+	entry.Client, _ = ctx.Value(clientKey{}).(string)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if auditErr := s.audit.Write(entry); auditErr != nil && err == nil {
+		return fmt.Errorf("the statement ran, but writing the audit log failed: %w", auditErr)
+	}
+	return err
+}
+
+// authRequired reports whether clients must sign in, see db.Table.AuthRequired.
+func (s *Server) authRequired() (required bool, err error) {
+	err = s.table.Exclusive(func() error {
+		required, err = s.table.AuthRequired()
+		return err
+	})
+	return required, err
+}
+
+// authenticate reports whether the account exists and has the password. The
+// password is compared once the table was let go, deriving its key takes a while.
+func (s *Server) authenticate(user string, password string) (bool, error) {
+	var hashed db.Password
+	err := s.table.Exclusive(func() (err error) {
+		hashed, err = s.table.Password(user)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return hashed.Matches(password), nil
+}
+
+// checkPrivilege returns an error unless the user in ctx has the privilege, see db.Table.CheckPrivilege.
+func (s *Server) checkPrivilege(ctx context.Context, privilege string) error {
+	return s.table.Exclusive(func() error {
+		return s.table.CheckPrivilege(ctx, privilege)
+	})
+}
+
+// Tables describes the tables of the database, which takes the read privilege.
+func (s *Server) Tables(ctx context.Context) ([]db.TableInfo, error) {
+	if err := s.checkPrivilege(ctx, "read"); err != nil {
+		return nil, err
+	}
+	var info db.TableInfo
+	err := s.table.Exclusive(func() (err error) {
+		info, err = s.table.Info()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []db.TableInfo{info}, nil
+}
+
+// SweepExpired deletes the expired rows every interval until ctx is done. The
+// deletes are not replicated entries, so a replica must not sweep, see Apply.
+func (s *Server) SweepExpired(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		err := s.table.Exclusive(func() error {
+			_, err := s.table.DeleteExpired(ctx)
+			return err
+		})
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+	}
+}
+
+// serveConns runs handle for every connection accepted on l, in the context
+// ConnContext returns, until ctx is done, then closes l and the connections
+// and waits for handle to return.
+func (s *Server) serveConns(ctx context.Context, l net.Listener, handle func(ctx context.Context, conn net.Conn) error) error {
+	var mu sync.Mutex
+	conns := map[net.Conn]struct{}{}
+	var wg sync.WaitGroup
+	go func() {
+		<-ctx.Done()
+		l.Close()
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			wg.Wait()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		mu.Lock()
+		if ctx.Err() != nil {
+			// Accepted while the others were being closed.
+			conn.Close()
+		}
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handle(s.ConnContext(ctx, conn), conn)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCerts writes a certificate authority and a server and client certificate signed by
+// it to dir, and returns the client's certificate and a pool trusting the authority.
+func testCerts(t *testing.T, dir string) (tls.Certificate, *x509.CertPool) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create the CA: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	writePEM := func(name string, typ string, der []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	writePEM("ca.pem", "CERTIFICATE", caDER)
+
+	var client tls.Certificate
+	for i, name := range []string{"server", "client"} {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Failed to create the %s certificate: %v", name, err)
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		writePEM(name+".pem", "CERTIFICATE", der)
+		writePEM(name+"-key.pem", "EC PRIVATE KEY", keyDER)
+		client = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return client, pool
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, roots := testCerts(t, dir)
+	config, err := LoadTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatalf("LoadTLSConfig failed: %v", err)
+	}
+	srv := newTestServer(t)
+	srv.SetTLSConfig(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pgListener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go srv.ServePG(ctx, pgListener)
+	respListener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go srv.ServeRESP(ctx, respListener)
+	clientConfig := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}, ServerName: "127.0.0.1"}
+
+	// Redis clients connect with TLS right away.
+	conn, err := tls.Dial("tcp", respListener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatalf("Failed to connect with TLS: %v", err)
+	}
+	io.WriteString(conn, respCommandArray("PING"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "+PONG\r\n" {
+		t.Fatalf("Expected PONG. Got: %q, %v", line, err)
+	}
+	conn.Close()
+	conn, err = tls.Dial("tcp", respListener.Addr().String(), &tls.Config{RootCAs: roots})
+	if err == nil {
+		io.WriteString(conn, respCommandArray("PING"))
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatalf("Expected a client without a certificate to be refused.")
+	}
+
+	// Postgres clients ask for SSL first.
+	plain, err := net.Dial("tcp", pgListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer plain.Close()
+	c := &pgClient{t: t, conn: plain, r: bufio.NewReader(plain)}
+	c.send(0, binary.BigEndian.AppendUint32(nil, pgSSLRequest))
+	if b, err := c.r.ReadByte(); err != nil || b != 'S' {
+		t.Fatalf("Expected SSL to be accepted. Got: %q, %v", b, err)
+	}
+	tlsConn := tls.Client(plain, clientConfig)
+	c = &pgClient{t: t, conn: tlsConn, r: bufio.NewReader(tlsConn)}
+	c.send(0, append(binary.BigEndian.AppendUint32(nil, pgProtocolVersion), "user\x00test\x00\x00"...))
+	if messages := c.receive(); messages[len(messages)-1][0] != 'K' {
+		t.Fatalf("Expected to be accepted. Got: %q", messages)
+	}
+	c.send('Q', pgString(nil, "select count(*)"))
+	if got := strings.Join(c.receive(), "|"); got != "T count(*):20|D 0|C SELECT 1" {
+		t.Fatalf("Expected the query to run over TLS. Got: %q", got)
+	}
+
+	plain, err = net.Dial("tcp", pgListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer plain.Close()
+	c = &pgClient{t: t, conn: plain, r: bufio.NewReader(plain)}
+	c.send(0, append(binary.BigEndian.AppendUint32(nil, pgProtocolVersion), "user\x00test\x00\x00"...))
+	if typ, body, err := pgReadMessage(c.r); err != nil || pgDescribe(typ, body) != "28000 SSL is required" {
+		t.Fatalf("Expected a plain text client to be refused. Got: %c %q, %v", typ, body, err)
+	}
+}
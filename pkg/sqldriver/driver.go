@@ -0,0 +1,233 @@
+/*
+Package sqldriver registers the engine with database/sql under the name "simpledb".
+
+	conn, err := sql.Open("simpledb", "file.db")
+	conn.SetMaxOpenConns(1)
+	conn.Exec("insert ? ? ?", 1, "alice", "alice@example.com")
+	rows, err := conn.Query("select")
+
+Statements use the same syntax as the REPL, ? placeholders are replaced by the
+arguments in order. Strings are passed as quoted literals, so they may hold spaces. A db file can only be opened by one connection at a time,
+so the pool has to be limited to a single connection.
+*/
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/MichalPitr/db_from_scratch/pkg/cli"
+	"github.com/MichalPitr/db_from_scratch/pkg/db"
+	"github.com/MichalPitr/db_from_scratch/pkg/parser"
+)
+
+// DriverName is the name the driver is registered under.
+const DriverName = "simpledb"
+
+func init() {
+	sql.Register(DriverName, &Driver{open: map[string]bool{}})
+}
+
+// Driver opens connections to db files.
+type Driver struct {
+	mu   sync.Mutex
+	open map[string]bool // Files that have an open connection.
+}
+
+// Open opens the db file called name, creating it if it does not exist.
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.open[name] {
+		return nil, fmt.Errorf("database is locked: %s is already open, limit the pool to one connection", name)
+	}
+	table, err := db.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	d.open[name] = true
+	return &conn{driver: d, name: name, table: table}, nil
+}
+
+type conn struct {
+	driver *Driver
+	name   string
+	table  *db.Table
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{conn: c, query: query}, nil
+}
+
+func (c *conn) Close() error {
+	c.driver.mu.Lock()
+	delete(c.driver.open, c.name)
+	c.driver.mu.Unlock()
+	return c.table.Close()
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	if err := c.table.Begin(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *conn) Commit() error {
+	return c.table.Commit()
+}
+
+func (c *conn) Rollback() error {
+	return c.table.Rollback()
+}
+
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	tokens, err := parser.Lex(s.query)
+	if err != nil {
+		// Let Exec and Query report the error.
+		return -1
+	}
+	return len(placeholders(tokens))
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.exec(context.Background(), args)
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.exec(ctx, values(args))
+}
+
+func (s *stmt) exec(ctx context.Context, args []driver.Value) (driver.Result, error) {
+	prepared, err := s.prepare(args)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.conn.table.Execute(ctx, prepared, func(values []any) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(result.RowsAffected), nil
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.queryRows(context.Background(), args)
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.queryRows(ctx, values(args))
+}
+
+func (s *stmt) queryRows(ctx context.Context, args []driver.Value) (driver.Rows, error) {
+	prepared, err := s.prepare(args)
+	if err != nil {
+		return nil, err
+	}
+	r := &rows{columns: s.conn.table.Columns(prepared)}
+	_, err = s.conn.table.Execute(ctx, prepared, func(values []any) error {
+		r.rows = append(r.rows, values)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// values drops the names of the arguments, only positional placeholders are supported.
+func values(args []driver.NamedValue) []driver.Value {
+	vals := make([]driver.Value, len(args))
+	for i, arg := range args {
+		vals[i] = arg.Value
+	}
+	return vals
+}
+
+// placeholders returns the ? tokens of a statement.
+func placeholders(tokens []parser.Token) []parser.Token {
+	params := []parser.Token{}
+	for _, tok := range tokens {
+		if tok.Kind == parser.TokSymbol && tok.Text == "?" {
+			params = append(params, tok)
+		}
+	}
+	return params
+}
+
+// prepare substitutes the arguments for the placeholders and parses the statement.
+func (s *stmt) prepare(args []driver.Value) (parser.Statement, error) {
+	tokens, err := parser.Lex(s.query)
+	if err != nil {
+		return nil, err
+	}
+	params := placeholders(tokens)
+	if len(params) != len(args) {
+		return nil, fmt.Errorf("expected %d arguments, but got %d", len(params), len(args))
+	}
+	var sb strings.Builder
+	end := 0
+	for i, param := range params {
+		sb.WriteString(s.query[end:param.Pos])
+		switch arg := args[i].(type) {
+		case int64:
+			sb.WriteString(fmt.Sprint(arg))
+		case string:
+			sb.WriteString(parser.Quote(arg))
+		case []byte:
+			sb.WriteString(parser.Quote(string(arg)))
+		default:
+			return nil, fmt.Errorf("argument %d has unsupported type %T", i+1, arg)
+		}
+		end = param.Pos + 1
+	}
+	sb.WriteString(s.query[end:])
+	stmt, err := parser.Parse(cli.CleanInput(sb.String()))
+	if err != nil {
+		return nil, err
+	}
+	if sel, ok := stmt.(*parser.Select); ok && sel.Into != nil {
+		// Writing the file is up to the REPL, the rows are returned here.
+		return nil, fmt.Errorf("select into is not supported, read the rows instead")
+	}
+	return stmt, nil
+}
+
+// rows holds the result of a select, which is read in full before it is returned.
+type rows struct {
+	columns []string
+	rows    [][]any
+	next    int
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	for i, value := range r.rows[r.next] {
+		dest[i] = value
+	}
+	r.next++
+	return nil
+}
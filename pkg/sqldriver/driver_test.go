@@ -0,0 +1,93 @@
+package sqldriver
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDb(t *testing.T) *sql.DB {
+	dbName := filepath.Join(t.TempDir(), "test.db")
+	conn, err := sql.Open(DriverName, dbName)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	conn.SetMaxOpenConns(1)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestExecAndQuery(t *testing.T) {
+	conn := openTestDb(t)
+	for i, name := range []string{"alice", "bob"} {
+		res, err := conn.Exec("insert ? ? ?", i+1, name, name+"@example.com")
+		if err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			t.Fatalf("Expected 1 row affected. Got: %d", n)
+		}
+	}
+	if _, err := conn.Exec("insert ? ? ?", 1, "carol", "carol@example.com"); err == nil || err.Error() != "duplicate key" {
+		t.Fatalf("Expected duplicate key error. Got: %v", err)
+	}
+
+	rows, err := conn.Query("select")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	defer rows.Close()
+	got := []string{}
+	for rows.Next() {
+		var id int
+		var username, email string
+		if err := rows.Scan(&id, &username, &email); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		got = append(got, username)
+	}
+	if len(got) != 2 || got[0] != "alice" || got[1] != "bob" {
+		t.Fatalf("Unexpected rows: %v", got)
+	}
+	if _, err := conn.Query("select into parquet 'out.parquet'"); err == nil || err.Error() != "select into is not supported, read the rows instead" {
+		t.Fatalf("Expected select into to be rejected. Got: %v", err)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	conn := openTestDb(t)
+	tx, err := conn.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if _, err := tx.Exec("insert 1 alice alice@example.com"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+
+	var count int
+	rows, _ := conn.Query("select")
+	for rows.Next() {
+		count++
+	}
+	rows.Close()
+	if count != 0 {
+		t.Fatalf("Expected no rows after rollback. Got: %d", count)
+	}
+}
+
+func TestStringArgumentsAreQuoted(t *testing.T) {
+	conn := openTestDb(t)
+	if _, err := conn.Exec("INSERT ? ? ?", 1, "Alice Smith", "It's@Example.com"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	var username, email string
+	if err := conn.QueryRow("select").Scan(new(int), &username, &email); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if username != "Alice Smith" || email != "It's@Example.com" {
+		t.Fatalf("Unexpected row: %q, %q", username, email)
+	}
+}
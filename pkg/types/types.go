@@ -4,31 +4,100 @@ import (
 	"github.com/MichalPitr/db_from_scratch/pkg/constants"
 )
 
-type statementType int
-
-const (
-	StmtInsert statementType = iota
-	StmtSelect
-	StmtDelete
-)
-
 type NodeType uint8
 
 const (
 	NodeInternal NodeType = iota
 	NodeLeaf
+	NodeSpatial // A node of the R-tree of the spatial index, leaf or internal.
 )
 
-type Statement struct {
-	StmtType    statementType
-	RowToInsert Row
-	RowToDelete uint32
-}
-
 type Row struct {
 	Id       uint32
 	Username [constants.UsernameSize]byte
 	Email    [constants.EmailSize]byte
+	// Unix time in seconds from which the row counts as deleted, 0 if it never expires.
+	ExpiresAt int64
+}
+
+// Box is an axis-aligned rectangle, the bounding box of a row in the spatial index.
+type Box struct {
+	MinX, MinY float64
+	MaxX, MaxY float64
 }
 
 type Page [constants.PageSize]byte
+
+type FileHeader struct {
+	Version      uint32
+	PageSize     uint32
+	RootPageNum  uint32
+	FreelistHead uint32 // InvalidPageNum when there are no free pages.
+	WalSalt      uint32 // Random value tying WAL frames to this file.
+	// Salt of the key derived from the passphrase, all zero if the file is not encrypted.
+	KeySalt  [constants.KeySaltSize]byte
+	KeyCheck [constants.KeyCheckSize]byte // Tells a wrong passphrase apart from corrupt pages.
+	// Bloom filter of the ids of the rows, nil if the file has none.
+	Bloom []byte
+	// Bit i is set if the i-th column of the schema has a fulltext index.
+	FulltextColumns uint32
+	// Root page of the R-tree of the spatial index, 0 if there is none, as page 0
+	// is the root of the table.
+	SpatialRootPageNum uint32
+	// The partitions after the first, which holds the ids from 0 up in the tree
+	// at RootPageNum. Empty unless the table is partitioned.
+	Partitions []Partition
+	// The materialized views, each stored in a B-tree of its own.
+	Views []View
+	// Root page of the B-tree holding the values of the stored generated
+	// columns by id, 0 if there is none.
+	GeneratedRootPageNum uint32
+	// The generated columns, after the columns of the schema.
+	Generated []GeneratedColumn
+	// The collation of the i-th column, counting the generated ones, empty for binary.
+	Collations [constants.MaxColumns]string
+	// Root page of the B-tree of the unique index, 0 if there is none.
+	UniqueRootPageNum uint32
+	// The index of the column the unique index is on, counting the generated ones.
+	UniqueColumn uint32
+	// The collation the unique index compares values by, empty for binary.
+	UniqueCollation string
+	// Root page of the B-tree holding the statistics of the last analyze, 0 if
+	// the table was never analyzed.
+	StatisticsRootPageNum uint32
+	// Rows in the trees of the table, counting those that expired but were not
+	// deleted yet, and how many of them have a ttl.
+	RowCount     uint32
+	ExpiringRows uint32
+	// Index of the last entry of a replicated log applied to the table, 0 if none was.
+	AppliedIndex uint64
+	// Unix time of the last entry applied, the clock of the writes applied from the log.
+	AppliedTime int64
+	// Root page of the B-tree of the descending index on id, 0 if there is none.
+	DescendingRootPageNum uint32
+	// Root page of the B-tree of the user accounts, 0 until the first one is added.
+	UsersRootPageNum uint32
+	// Root page of the B-tree of the ordered index, 0 if there is none, and the
+	// index of the text column it is on.
+	OrderedRootPageNum uint32
+	OrderedColumn      uint32
+}
+
+// GeneratedColumn is a column whose value is computed from the other columns of the row.
+type GeneratedColumn struct {
+	Name   string
+	Expr   string // The text of the expression.
+	Stored bool   // Kept in the tree at GeneratedRootPageNum rather than computed when read.
+}
+
+// View is the name of a materialized view and the root of the tree holding its rows.
+type View struct {
+	Name        string
+	RootPageNum uint32
+}
+
+// Partition is a range of ids stored in a B-tree of its own. It ends where the next one starts.
+type Partition struct {
+	From        uint32
+	RootPageNum uint32
+}
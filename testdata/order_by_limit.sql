@@ -0,0 +1,9 @@
+insert 3 carol carol@example.com
+insert 1 alice alice@example.com
+insert 2 bob bob@example.com
+insert 4 dave dave@example.com
+select order by username desc
+select id, email order by id desc limit 2
+select where id > 1 limit 1
+select count(*)
+.exit
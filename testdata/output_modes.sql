@@ -0,0 +1,11 @@
+insert 1 alice alice@example.com
+insert 2 'bob smith' "bob@example.com"
+.mode table
+select
+.mode csv
+select
+.mode json
+select username where id = 2
+.mode tuple
+select
+.exit
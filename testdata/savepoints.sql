@@ -0,0 +1,11 @@
+begin
+insert 1 alice alice@example.com
+savepoint a
+insert 2 bob bob@example.com
+rollback to a
+insert 3 carol carol@example.com
+commit
+select
+delete 2
+.btree
+.exit